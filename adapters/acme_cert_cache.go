@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"golang.org/x/crypto/acme/autocert"
+	"io"
+)
+
+// BucketCertCache keeps the account key and certificates obtained from an ACME
+// CA (eg Let's Encrypt) in the bucket under ns-config/acme/, so a redeployed
+// server does not need to request them again and run into rate limits.
+//
+// Private keys are held unencrypted, so anyone who can read the bucket can
+// impersonate the server.
+type BucketCertCache struct {
+	BucketStore BucketCertStoreInterface
+}
+
+// BucketCertStoreInterface is implemented by bucket stores that can delete
+// objects
+type BucketCertStoreInterface interface {
+	BucketStoreInterface
+	Delete(ctx context.Context, name string) error
+}
+
+func NewBucketCertCache(bs BucketCertStoreInterface) *BucketCertCache {
+	return &BucketCertCache{BucketStore: bs}
+}
+
+func certCacheFile(key string) string {
+	return "ns-config/acme/" + key
+}
+
+// Get returns the data cached for key, or autocert.ErrCacheMiss
+func (c BucketCertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := c.BucketStore.Get(ctx, certCacheFile(key))
+	if err != nil {
+		if c.BucketStore.IsObjNotFoundErr(err) {
+			return nil, autocert.ErrCacheMiss
+		}
+		return nil, fmt.Errorf("cannot fetch acme %s: %w", key, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read acme %s: %w", key, err)
+	}
+	return b, nil
+}
+
+func (c BucketCertCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.BucketStore.Upload(ctx, certCacheFile(key), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("cannot upload acme %s: %w", key, err)
+	}
+	return nil
+}
+
+func (c BucketCertCache) Delete(ctx context.Context, key string) error {
+	err := c.BucketStore.Delete(ctx, certCacheFile(key))
+	if err != nil && !c.BucketStore.IsObjNotFoundErr(err) {
+		return fmt.Errorf("cannot delete acme %s: %w", key, err)
+	}
+	return nil
+}
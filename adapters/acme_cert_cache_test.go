@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestBucketCertCache(t *testing.T) {
+	ctx := context.Background()
+	c := NewBucketCertCache(&bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()})
+
+	_, err := c.Get(ctx, "ns.example.com")
+	assert.ErrorIs(t, err, autocert.ErrCacheMiss)
+
+	assert.NoError(t, c.Put(ctx, "ns.example.com", []byte("cert")))
+	b, err := c.Get(ctx, "ns.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "cert", string(b))
+
+	assert.NoError(t, c.Delete(ctx, "ns.example.com"))
+	_, err = c.Get(ctx, "ns.example.com")
+	assert.ErrorIs(t, err, autocert.ErrCacheMiss)
+	assert.NoError(t, c.Delete(ctx, "ns.example.com"), "deleting a missing key is not an error")
+}
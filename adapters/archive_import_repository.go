@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/adamlounds/nightscout-go/models"
+	"io"
+)
+
+var ErrInvalidArchive = errors.New("not a day, month or year file")
+
+// ArchiveImportRepository reads entries from day, month and year files, eg
+// those downloaded from another instance's bucket
+type ArchiveImportRepository struct{}
+
+func NewArchiveImportRepository() *ArchiveImportRepository {
+	return &ArchiveImportRepository{}
+}
+
+// ParseArchiveEntries returns the entries in a day, month or year file of any
+// format version, keeping their oids. Entries without a time are skipped.
+func (a *ArchiveImportRepository) ParseArchiveEntries(ctx context.Context, r io.Reader) ([]models.Entry, error) {
+	var stored []storedEntry
+	err := decodeStored(r, &stored)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidArchive, err)
+	}
+	entries := make([]models.Entry, 0, len(stored))
+	for _, e := range stored {
+		if e.Time.IsZero() {
+			continue
+		}
+		entries = append(entries, models.Entry{
+			Oid:         oidOf(e.Oid),
+			Type:        e.Type,
+			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
+			Direction:   e.Direction,
+			Device:      e.Device,
+			Time:        e.Time,
+			CreatedTime: e.CreatedTime,
+		})
+	}
+	return entries, nil
+}
@@ -1,32 +1,213 @@
 package repository
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/adamlounds/nightscout-go/models"
 	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
+const authFile = "ns-config/auth.json"
+
+// BucketAuthRepository keeps auth subjects and roles in a single file, cached
+// in memory after Boot. Tokens are only returned when a subject is created: we store a
+// digest, so a leaked auth file does not leak tokens.
+//
+// Subjects are held in memory by an HMAC of their digest, keyed randomly at
+// startup, so the time taken to look up an attacker-supplied token says
+// nothing about the digests we hold.
 type BucketAuthRepository struct {
-	APISecretHash string
-	DefaultRole   string
+	BucketStore    BucketStoreInterface
+	APISecretHash  string
+	OldSecretHash  string // accepted until OldSecretUntil, while rotating
+	OldSecretUntil time.Time
+	DefaultRole    string
+	auth           storedAuth
+	byLookupKey    map[string]authSubjectByDigest
+	lookupSecret   []byte
+	authLock       sync.RWMutex
+}
+
+type authSubjectByDigest struct {
+	subject *models.AuthSubject
+	digest  string
+}
+
+type storedAuth struct {
+	Subjects []storedAuthSubject `json:"subjects"`
+	Roles    []storedRole        `json:"roles,omitempty"`
+	Revoked  []storedRevocation  `json:"revoked,omitempty"`
+}
+
+// storedRevocation records a revoked token. Revoked subjects are kept, so it
+// remains clear what a token was for.
+type storedRevocation struct {
+	Oid         string    `json:"_id"`
+	TokenDigest string    `json:"tokenDigest"`
+	RevokedTime time.Time `json:"revoked_at"`
+}
+
+type storedRole struct {
+	Name        string    `json:"name"`
+	Permissions []string  `json:"permissions"`
+	Notes       string    `json:"notes,omitempty"`
+	CreatedTime time.Time `json:"created_at"`
+	UpdatedTime time.Time `json:"updated_at"`
+}
+
+type storedAuthSubject struct {
+	Oid         string     `json:"_id"`
+	Name        string     `json:"name"` // as given, so caps/hyphens/non-ascii are kept
+	RoleNames   []string   `json:"roles"`
+	Notes       string     `json:"notes,omitempty"`
+	CreatedTime time.Time  `json:"created_at"`
+	ExpiryTime  *time.Time `json:"expires_at,omitempty"`
+	ShareLink   bool       `json:"shareLink,omitempty"`
+	TokenDigest string     `json:"tokenDigest"` // sha256 of the token, hex
+}
+
+func NewBucketAuthRepository(bs BucketStoreInterface, APISecretHash string, DefaultRole string) *BucketAuthRepository {
+	return &BucketAuthRepository{
+		BucketStore:   bs,
+		APISecretHash: APISecretHash,
+		DefaultRole:   DefaultRole,
+		byLookupKey:   make(map[string]authSubjectByDigest),
+		lookupSecret:  newLookupSecret(),
+	}
+}
+
+func newLookupSecret() []byte {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b) // never returns an error
+	return b
+}
+
+// lookupKey returns the key a token digest is held in memory under
+func (p *BucketAuthRepository) lookupKey(digest string) string {
+	mac := hmac.New(sha256.New, p.lookupSecret)
+	mac.Write([]byte(digest))
+	return string(mac.Sum(nil))
+}
+
+// Boot fetches all auth subjects into memory, typically at server startup
+func (p *BucketAuthRepository) Boot(ctx context.Context) error {
+	log := slogctx.FromCtx(ctx)
+	auth, err := p.fetchAuth(ctx)
+	if err != nil {
+		return err
+	}
+	if auth == nil {
+		log.Debug("boot: no auth subjects found (not written yet?)")
+		return nil
+	}
+
+	p.authLock.Lock()
+	defer p.authLock.Unlock()
+	p.setAuth(*auth)
+	log.Info("boot: auth subjects loaded", slog.Int("numSubjects", len(auth.Subjects)), slog.Int("numRoles", len(auth.Roles)))
+	return nil
+}
+
+// fetchAuth returns the stored auth subjects and roles, or nil if none have
+// been written yet
+func (p *BucketAuthRepository) fetchAuth(ctx context.Context) (*storedAuth, error) {
+	r, err := p.BucketStore.Get(ctx, authFile)
+	if err != nil {
+		if p.BucketStore.IsObjNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot fetch auth subjects: %w", err)
+	}
+	defer r.Close()
+
+	var auth storedAuth
+	err = json.NewDecoder(r).Decode(&auth)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse auth subjects: %w", err)
+	}
+	return &auth, nil
 }
 
-func NewBucketAuthRepository(APISecretHash string, DefaultRole string) *BucketAuthRepository {
-	return &BucketAuthRepository{APISecretHash, DefaultRole}
+// setAuth replaces the cached subjects. Callers must hold authLock.
+func (p *BucketAuthRepository) setAuth(auth storedAuth) {
+	p.auth = auth
+	p.byLookupKey = make(map[string]authSubjectByDigest, len(auth.Subjects))
+	for _, s := range auth.Subjects {
+		as := authSubjectFromStored(s, auth.Revoked)
+		p.byLookupKey[p.lookupKey(s.TokenDigest)] = authSubjectByDigest{subject: &as, digest: s.TokenDigest}
+	}
 }
 
-func (p BucketAuthRepository) GetAPISecretHash(ctx context.Context) string {
-	return "945a6dadff2d6cd1e8faf31b2da50ce467c440e1"
+// writeAuth uploads auth, then caches it. Callers must hold authLock.
+func (p *BucketAuthRepository) writeAuth(ctx context.Context, auth storedAuth) error {
+	j, err := json.Marshal(auth)
+	if err != nil {
+		return fmt.Errorf("cannot marshal auth subjects: %w", err)
+	}
+	err = p.BucketStore.Upload(ctx, authFile, bytes.NewReader(j))
+	if err != nil {
+		return fmt.Errorf("cannot upload auth subjects: %w", err)
+	}
+	p.setAuth(auth)
+	return nil
 }
 
-func (p BucketAuthRepository) GetDefaultRole(ctx context.Context) string {
+// Reload fetches auth subjects and roles again, eg when config is reloaded,
+// then replaces them along with the api secrets and default role. If they
+// cannot be fetched nothing is changed, so the current secrets still work.
+func (p *BucketAuthRepository) Reload(ctx context.Context, apiSecretHash string, oldSecretHash string, oldSecretUntil time.Time, defaultRole string) error {
+	auth, err := p.fetchAuth(ctx)
+	if err != nil {
+		return err
+	}
+	if auth == nil {
+		auth = &storedAuth{}
+	}
+
+	p.authLock.Lock()
+	defer p.authLock.Unlock()
+	p.setAuth(*auth)
+	p.APISecretHash = apiSecretHash
+	p.OldSecretHash = oldSecretHash
+	p.OldSecretUntil = oldSecretUntil
+	p.DefaultRole = defaultRole
+	return nil
+}
+
+func (p *BucketAuthRepository) GetAPISecretHash(ctx context.Context) string {
+	p.authLock.RLock()
+	defer p.authLock.RUnlock()
+	return p.APISecretHash
+}
+
+func (p *BucketAuthRepository) GetOldAPISecretHash(ctx context.Context) (string, time.Time) {
+	p.authLock.RLock()
+	defer p.authLock.RUnlock()
+	return p.OldSecretHash, p.OldSecretUntil
+}
+
+func (p *BucketAuthRepository) GetDefaultRole(ctx context.Context) string {
+	p.authLock.RLock()
+	defer p.authLock.RUnlock()
 	return p.DefaultRole
 }
 
 var unknownAuthSubject = &models.AuthSubject{Name: "anonymous", RoleNames: []string{}}
 
-func (p BucketAuthRepository) FetchAuthSubjectByAuthToken(ctx context.Context, authToken string) *models.AuthSubject {
+func (p *BucketAuthRepository) FetchAuthSubjectByAuthToken(ctx context.Context, authToken string) *models.AuthSubject {
 	log := slogctx.FromCtx(ctx)
 	if authToken == "" {
 		return unknownAuthSubject
@@ -37,31 +218,257 @@ func (p BucketAuthRepository) FetchAuthSubjectByAuthToken(ctx context.Context, a
 		return unknownAuthSubject
 	}
 
-	// TODO persist. Note we must store Name so caps/hyphens/non-ascii are kept
-	hashes := map[string]*models.AuthSubject{
-		"ffs-358de43470f328f3": {
-			Name:      "ffs",
-			RoleNames: []string{"cgm-uploader"},
-		},
-		"-38ff267ebbec81e1": {
-			Name:      "çåƒé",
-			RoleNames: []string{"cgm-uploader"},
-		},
-		"admin-c1f54efaedccba11": {
-			Name:      "A.D.Min",
-			RoleNames: []string{"admin"},
-		},
-	}
-
-	authSubject, ok := hashes[authToken]
-	if !ok {
+	p.authLock.RLock()
+	defer p.authLock.RUnlock()
+	digest := tokenDigest(authToken)
+	held, ok := p.byLookupKey[p.lookupKey(digest)]
+	if !ok || subtle.ConstantTimeCompare([]byte(digest), []byte(held.digest)) != 1 {
 		log.Debug("auth token not recognized")
 		return unknownAuthSubject
 	}
-	return authSubject
+	if !held.subject.IsActiveAt(time.Now()) {
+		log.Info("auth token revoked or expired",
+			slog.String("oid", held.subject.Oid),
+			slog.String("name", held.subject.Name),
+		)
+		return unknownAuthSubject
+	}
+	return held.subject
 }
 
-// Decision for future: roles and AuthSubjects should be cached (they are in ns-js)
-// Keep copy of fetched users/roles with configurable ttl (infinite by default,
-// expiryTime = null). Updates to users or roles should purge both caches, so a
-// single-node system will not see stale data.
+// FetchAuthSubjectByOid returns the subject with the given oid, eg from a JWT,
+// or the anonymous subject if it has been deleted, revoked or has expired
+func (p *BucketAuthRepository) FetchAuthSubjectByOid(ctx context.Context, oid string) *models.AuthSubject {
+	log := slogctx.FromCtx(ctx)
+	if oid == "" {
+		return unknownAuthSubject
+	}
+
+	p.authLock.RLock()
+	defer p.authLock.RUnlock()
+	i := slices.IndexFunc(p.auth.Subjects, func(s storedAuthSubject) bool { return s.Oid == oid })
+	if i == -1 {
+		log.Debug("auth subject not found", slog.String("oid", oid))
+		return unknownAuthSubject
+	}
+	as := authSubjectFromStored(p.auth.Subjects[i], p.auth.Revoked)
+	if !as.IsActiveAt(time.Now()) {
+		log.Info("auth subject revoked or expired", slog.String("oid", as.Oid), slog.String("name", as.Name))
+		return unknownAuthSubject
+	}
+	return &as
+}
+
+// FetchAuthSubjects returns all auth subjects, oldest first
+func (p *BucketAuthRepository) FetchAuthSubjects(ctx context.Context) ([]models.AuthSubject, error) {
+	p.authLock.RLock()
+	defer p.authLock.RUnlock()
+	subjects := make([]models.AuthSubject, len(p.auth.Subjects))
+	for i, s := range p.auth.Subjects {
+		subjects[i] = authSubjectFromStored(s, p.auth.Revoked)
+	}
+	return subjects, nil
+}
+
+// CreateAuthSubject stores a new subject, returning it and its token. The
+// token cannot be fetched again. A subject with an ExpiryTime cannot be used
+// after then. Share links get a longer token, as they are sent around by email
+// and the like.
+func (p *BucketAuthRepository) CreateAuthSubject(ctx context.Context, subject models.AuthSubject) (*models.AuthSubject, string, error) {
+	now := time.Now()
+	token, err := newAuthToken(subject.Name)
+	if subject.ShareLink {
+		token, err = newShareLinkToken()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	s := storedAuthSubject{
+		Oid:         newOid(now),
+		Name:        subject.Name,
+		RoleNames:   slices.Clone(subject.RoleNames),
+		Notes:       subject.Notes,
+		CreatedTime: now,
+		ShareLink:   subject.ShareLink,
+		TokenDigest: tokenDigest(token),
+	}
+	if !subject.ExpiryTime.IsZero() {
+		expiry := subject.ExpiryTime
+		s.ExpiryTime = &expiry
+	}
+
+	p.authLock.Lock()
+	defer p.authLock.Unlock()
+	auth := p.auth
+	auth.Subjects = append(slices.Clip(auth.Subjects), s)
+	err = p.writeAuth(ctx, auth)
+	if err != nil {
+		return nil, "", err
+	}
+	created := authSubjectFromStored(s, nil)
+	return &created, token, nil
+}
+
+// DeleteAuthSubject removes a subject, revoking its token
+func (p *BucketAuthRepository) DeleteAuthSubject(ctx context.Context, oid string) error {
+	p.authLock.Lock()
+	defer p.authLock.Unlock()
+	i := slices.IndexFunc(p.auth.Subjects, func(s storedAuthSubject) bool { return s.Oid == oid })
+	if i == -1 {
+		return models.ErrNotFound
+	}
+	auth := p.auth
+	auth.Subjects = slices.Delete(slices.Clone(auth.Subjects), i, i+1)
+	auth.Revoked = slices.DeleteFunc(slices.Clone(auth.Revoked), func(r storedRevocation) bool { return r.Oid == oid })
+	return p.writeAuth(ctx, auth)
+}
+
+// FetchRoles returns all stored roles, by name. Built-in roles are only
+// included if they have been overridden.
+func (p *BucketAuthRepository) FetchRoles(ctx context.Context) ([]models.Role, error) {
+	p.authLock.RLock()
+	defer p.authLock.RUnlock()
+	roles := make([]models.Role, len(p.auth.Roles))
+	for i, r := range p.auth.Roles {
+		roles[i] = roleFromStored(r)
+	}
+	return roles, nil
+}
+
+// SaveRole creates a role, or replaces the role of the same name
+func (p *BucketAuthRepository) SaveRole(ctx context.Context, role models.Role) (*models.Role, error) {
+	now := time.Now()
+	r := storedRole{
+		Name:        role.Name,
+		Permissions: slices.Clone(role.Permissions),
+		Notes:       role.Notes,
+		CreatedTime: now,
+		UpdatedTime: now,
+	}
+
+	p.authLock.Lock()
+	defer p.authLock.Unlock()
+	auth := p.auth
+	auth.Roles = slices.Clone(auth.Roles)
+	i, found := slices.BinarySearchFunc(auth.Roles, r.Name, func(r storedRole, name string) int {
+		return strings.Compare(r.Name, name)
+	})
+	if found {
+		r.CreatedTime = auth.Roles[i].CreatedTime
+		auth.Roles[i] = r
+	} else {
+		auth.Roles = slices.Insert(auth.Roles, i, r)
+	}
+	err := p.writeAuth(ctx, auth)
+	if err != nil {
+		return nil, err
+	}
+	saved := roleFromStored(r)
+	return &saved, nil
+}
+
+// DeleteRole removes a stored role. Subjects holding it keep the role name,
+// and regain its permissions if it is recreated.
+func (p *BucketAuthRepository) DeleteRole(ctx context.Context, name string) error {
+	p.authLock.Lock()
+	defer p.authLock.Unlock()
+	i := slices.IndexFunc(p.auth.Roles, func(r storedRole) bool { return r.Name == name })
+	if i == -1 {
+		return models.ErrNotFound
+	}
+	auth := p.auth
+	auth.Roles = slices.Delete(slices.Clone(auth.Roles), i, i+1)
+	return p.writeAuth(ctx, auth)
+}
+
+func roleFromStored(r storedRole) models.Role {
+	return models.Role{
+		CreatedTime: r.CreatedTime,
+		UpdatedTime: r.UpdatedTime,
+		Name:        r.Name,
+		Notes:       r.Notes,
+		Permissions: slices.Clone(r.Permissions),
+	}
+}
+
+// RevokeAuthSubject revokes a subject's token, keeping the subject so it is
+// clear what the token was for. Revoking twice keeps the original time.
+func (p *BucketAuthRepository) RevokeAuthSubject(ctx context.Context, oid string) (*models.AuthSubject, error) {
+	p.authLock.Lock()
+	defer p.authLock.Unlock()
+	i := slices.IndexFunc(p.auth.Subjects, func(s storedAuthSubject) bool { return s.Oid == oid })
+	if i == -1 {
+		return nil, models.ErrNotFound
+	}
+	s := p.auth.Subjects[i]
+	if !slices.ContainsFunc(p.auth.Revoked, func(r storedRevocation) bool { return r.TokenDigest == s.TokenDigest }) {
+		auth := p.auth
+		auth.Revoked = append(slices.Clip(auth.Revoked), storedRevocation{
+			Oid:         s.Oid,
+			TokenDigest: s.TokenDigest,
+			RevokedTime: time.Now(),
+		})
+		err := p.writeAuth(ctx, auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	revoked := authSubjectFromStored(s, p.auth.Revoked)
+	return &revoked, nil
+}
+
+func authSubjectFromStored(s storedAuthSubject, revoked []storedRevocation) models.AuthSubject {
+	as := models.AuthSubject{
+		CreatedTime: s.CreatedTime,
+		UpdatedTime: s.CreatedTime,
+		Oid:         s.Oid,
+		Name:        s.Name,
+		Notes:       s.Notes,
+		RoleNames:   slices.Clone(s.RoleNames),
+		ShareLink:   s.ShareLink,
+	}
+	if s.ExpiryTime != nil {
+		as.ExpiryTime = *s.ExpiryTime
+	}
+	i := slices.IndexFunc(revoked, func(r storedRevocation) bool { return r.TokenDigest == s.TokenDigest })
+	if i != -1 {
+		as.RevokedTime = revoked[i].RevokedTime
+	}
+	return as
+}
+
+// newAuthToken returns a token in nightscout's name-hash format, eg
+// ffs-358de43470f328f3. As in nightscout the name part is the lowercased name
+// without punctuation, at most 10 characters, so may be empty.
+func newAuthToken(name string) (string, error) {
+	var abbrev strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if abbrev.Len() == 10 {
+			break
+		}
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
+			abbrev.WriteRune(r)
+		}
+	}
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate token: %w", err)
+	}
+	return abbrev.String() + "-" + hex.EncodeToString(b), nil
+}
+
+// newShareLinkToken returns a token of the form share-<256 random bits, hex>
+func newShareLinkToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("cannot generate token: %w", err)
+	}
+	return "share-" + hex.EncodeToString(b), nil
+}
+
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
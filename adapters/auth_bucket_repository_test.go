@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestAuthSubjects(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	repo := NewBucketAuthRepository(bs, "", "readable")
+	assert.NoError(t, repo.Boot(ctx), "no auth file yet")
+
+	created, token, err := repo.CreateAuthSubject(ctx, models.AuthSubject{Name: "Menu-Bar App", RoleNames: []string{"readable"}})
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^menubarapp-[0-9a-f]{16}$`), token)
+	_, otherToken, err := repo.CreateAuthSubject(ctx, models.AuthSubject{Name: "çåƒé", RoleNames: []string{"cgm-uploader"}})
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^-[0-9a-f]{16}$`), otherToken)
+	shared, shareToken, err := repo.CreateAuthSubject(ctx, models.AuthSubject{Name: "Dr Smith", RoleNames: []string{models.ShareLinkRole}, ShareLink: true})
+	assert.NoError(t, err)
+	assert.True(t, shared.ShareLink)
+	assert.Regexp(t, regexp.MustCompile(`^share-[0-9a-f]{64}$`), shareToken)
+	assert.Equal(t, "Dr Smith", repo.FetchAuthSubjectByAuthToken(ctx, shareToken).Name)
+	assert.NoError(t, repo.DeleteAuthSubject(ctx, shared.Oid))
+
+	as := repo.FetchAuthSubjectByAuthToken(ctx, token)
+	assert.Equal(t, "Menu-Bar App", as.Name)
+	assert.Equal(t, []string{"readable"}, as.RoleNames)
+	assert.True(t, repo.FetchAuthSubjectByAuthToken(ctx, "menubarapp-0000000000000000").IsAnonymous())
+
+	// another instance sees the same subjects, but not their tokens
+	other := NewBucketAuthRepository(bs, "", "readable")
+	assert.NoError(t, other.Boot(ctx))
+	subjects, err := other.FetchAuthSubjects(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, subjects, 2)
+	assert.Equal(t, created.Oid, subjects[0].Oid)
+	assert.Equal(t, "çåƒé", other.FetchAuthSubjectByAuthToken(ctx, otherToken).Name)
+	r, err := bs.Get(ctx, authFile)
+	assert.NoError(t, err)
+	stored, _ := io.ReadAll(r)
+	assert.NotContains(t, string(stored), token)
+
+	assert.NoError(t, repo.DeleteAuthSubject(ctx, created.Oid))
+	assert.True(t, repo.FetchAuthSubjectByAuthToken(ctx, token).IsAnonymous())
+	assert.ErrorIs(t, repo.DeleteAuthSubject(ctx, created.Oid), models.ErrNotFound)
+	subjects, _ = repo.FetchAuthSubjects(ctx)
+	assert.Len(t, subjects, 1)
+}
+
+func TestRoles(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	repo := NewBucketAuthRepository(bs, "", "readable")
+	assert.NoError(t, repo.Boot(ctx))
+
+	_, err := repo.SaveRole(ctx, models.Role{Name: "reporter", Permissions: []string{"api:entries:read"}})
+	assert.NoError(t, err)
+	created, err := repo.SaveRole(ctx, models.Role{Name: "careportal", Permissions: []string{"api:treatments:create"}})
+	assert.NoError(t, err)
+	updated, err := repo.SaveRole(ctx, models.Role{Name: "reporter", Permissions: []string{"api:*:read"}, Notes: "reports"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api:*:read"}, updated.Permissions)
+
+	// another instance sees the same roles, by name
+	other := NewBucketAuthRepository(bs, "", "readable")
+	assert.NoError(t, other.Boot(ctx))
+	roles, err := other.FetchRoles(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, roles, 2)
+	assert.Equal(t, "careportal", roles[0].Name)
+	assert.Equal(t, created.CreatedTime.UTC(), roles[0].CreatedTime.UTC())
+	assert.Equal(t, "reports", roles[1].Notes)
+
+	assert.NoError(t, repo.DeleteRole(ctx, "reporter"))
+	assert.ErrorIs(t, repo.DeleteRole(ctx, "reporter"), models.ErrNotFound)
+	roles, _ = repo.FetchRoles(ctx)
+	assert.Len(t, roles, 1)
+}
+
+func TestAuthSubjectExpiryAndRevocation(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	repo := NewBucketAuthRepository(bs, "", "readable")
+
+	_, token, err := repo.CreateAuthSubject(ctx, models.AuthSubject{Name: "phone", RoleNames: []string{"cgm-uploader"}})
+	assert.NoError(t, err)
+	_, expiringToken, err := repo.CreateAuthSubject(ctx, models.AuthSubject{Name: "visitor", RoleNames: []string{"readable"}, ExpiryTime: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	expired, expiredToken, err := repo.CreateAuthSubject(ctx, models.AuthSubject{Name: "expired", RoleNames: []string{"readable"}, ExpiryTime: time.Now().Add(-time.Hour)})
+	assert.NoError(t, err)
+	assert.False(t, expired.ExpiryTime.IsZero())
+
+	assert.Equal(t, "visitor", repo.FetchAuthSubjectByAuthToken(ctx, expiringToken).Name)
+	assert.True(t, repo.FetchAuthSubjectByAuthToken(ctx, expiredToken).IsAnonymous())
+	assert.True(t, repo.FetchAuthSubjectByOid(ctx, expired.Oid).IsAnonymous())
+
+	subjects, _ := repo.FetchAuthSubjects(ctx)
+	assert.Equal(t, "phone", repo.FetchAuthSubjectByOid(ctx, subjects[0].Oid).Name)
+	revoked, err := repo.RevokeAuthSubject(ctx, subjects[0].Oid)
+	assert.NoError(t, err)
+	assert.False(t, revoked.RevokedTime.IsZero())
+	assert.True(t, repo.FetchAuthSubjectByAuthToken(ctx, token).IsAnonymous())
+	assert.True(t, repo.FetchAuthSubjectByOid(ctx, subjects[0].Oid).IsAnonymous())
+	again, err := repo.RevokeAuthSubject(ctx, subjects[0].Oid)
+	assert.NoError(t, err)
+	assert.Equal(t, revoked.RevokedTime, again.RevokedTime)
+	_, err = repo.RevokeAuthSubject(ctx, "000000000000000000000000")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	assert.True(t, repo.FetchAuthSubjectByOid(ctx, "000000000000000000000000").IsAnonymous())
+	assert.True(t, repo.FetchAuthSubjectByOid(ctx, "").IsAnonymous())
+
+	// another instance sees the expiry and revocation
+	other := NewBucketAuthRepository(bs, "", "readable")
+	assert.NoError(t, other.Boot(ctx))
+	assert.True(t, other.FetchAuthSubjectByAuthToken(ctx, token).IsAnonymous())
+	assert.True(t, other.FetchAuthSubjectByAuthToken(ctx, expiredToken).IsAnonymous())
+	assert.Equal(t, "visitor", other.FetchAuthSubjectByAuthToken(ctx, expiringToken).Name)
+	subjects, _ = other.FetchAuthSubjects(ctx)
+	assert.False(t, subjects[0].RevokedTime.IsZero())
+	assert.False(t, subjects[1].ExpiryTime.IsZero())
+
+	assert.NoError(t, repo.DeleteAuthSubject(ctx, subjects[0].Oid))
+	assert.Empty(t, repo.auth.Revoked, "deleting a subject drops its revocation")
+}
@@ -0,0 +1,216 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// BucketArchiveWriter writes entries and treatments of any age into the
+// bucket layout: today in ns-day, the rest of this month in ns-month and
+// everything else in its year's ns-year file. It is used to move history into
+// a bucket, eg when migrating from postgres, and by the repositories to merge
+// entries for years they do not hold in full into the stored year files.
+//
+// Files are merged with what is already in the bucket, skipping entries we
+// already have, so writing the same data twice is harmless.
+type BucketArchiveWriter struct {
+	BucketStore          BucketStoreInterface
+	EntryCompression     bucketstore.Compression
+	TreatmentCompression bucketstore.Compression
+	IDStrategy           IDStrategy // ids are written under, see IDStrategy
+}
+
+func NewBucketArchiveWriter(bs BucketStoreInterface) *BucketArchiveWriter {
+	return &BucketArchiveWriter{BucketStore: bs, IDStrategy: objectIDStrategy{}}
+}
+
+// archiveFile returns the file an item with event time t belongs in, relative
+// to now, eg ns-year/2023-treatments.json for suffix -treatments.json
+func archiveFile(t, now time.Time, suffix string) string {
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch {
+	case !t.Before(startOfDay):
+		return fmt.Sprintf("ns-day/%s%s", now.Format("2006-01-02"), suffix)
+	case !t.Before(startOfMonth):
+		return fmt.Sprintf("ns-month/%s%s", now.Format("2006-01"), suffix)
+	}
+	return fmt.Sprintf("ns-year/%d%s", t.Year(), suffix)
+}
+
+// WriteEntries merges entries into the bucket, returning how many were new.
+// As in the entry repository, entries of the same type from the same device
+// in the same second are duplicates.
+func (p BucketArchiveWriter) WriteEntries(ctx context.Context, entries []models.Entry, now time.Time) (int, error) {
+	byFile := make(map[string][]storedEntry)
+	for _, e := range entries {
+		name := archiveFile(e.Time, now, ".json")
+		byFile[name] = append(byFile[name], storedEntry{
+			Time:        e.Time,
+			CreatedTime: e.CreatedTime,
+			Oid:         p.IDStrategy.StoredID(e.Oid),
+			Type:        e.Type,
+			Direction:   e.Direction,
+			Device:      e.Device,
+			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
+		})
+	}
+
+	numNew := 0
+	for _, name := range sortedKeys(byFile) {
+		var existing []storedEntry
+		err := p.readFile(ctx, name, p.EntryCompression, &existing)
+		if err != nil {
+			return numNew, err
+		}
+
+		type archiveKey struct {
+			device string
+			typ    string
+			second int64
+		}
+		// files written under another id strategy are compared by oid
+		seenOids := make(map[string]struct{}, len(existing))
+		seenKeys := make(map[archiveKey]struct{}, len(existing))
+		for _, e := range existing {
+			seenOids[oidOf(e.Oid)] = struct{}{}
+			seenKeys[archiveKey{e.Device, entryTypeOrSgv(e.Type), e.Time.Round(time.Second).Unix()}] = struct{}{}
+		}
+		merged := existing
+		for _, e := range byFile[name] {
+			key := archiveKey{e.Device, entryTypeOrSgv(e.Type), e.Time.Round(time.Second).Unix()}
+			if _, ok := seenOids[oidOf(e.Oid)]; ok {
+				continue
+			}
+			if _, ok := seenKeys[key]; ok {
+				continue
+			}
+			seenOids[oidOf(e.Oid)] = struct{}{}
+			seenKeys[key] = struct{}{}
+			merged = append(merged, e)
+		}
+		if len(merged) == len(existing) {
+			continue
+		}
+		slices.SortStableFunc(merged, func(a, b storedEntry) int { return a.Time.Compare(b.Time) })
+
+		err = p.writeFile(ctx, name, p.EntryCompression, merged)
+		if err != nil {
+			return numNew, err
+		}
+		numNew += len(merged) - len(existing)
+	}
+	return numNew, nil
+}
+
+// WriteTreatments merges treatments into the bucket, returning how many were
+// new. Treatments are duplicates if they have the same oid.
+func (p BucketArchiveWriter) WriteTreatments(ctx context.Context, treatments []models.Treatment, now time.Time) (int, error) {
+	byFile := make(map[string][]models.Treatment)
+	for _, t := range treatments {
+		name := archiveFile(t.Time, now, "-treatments.json")
+		byFile[name] = append(byFile[name], t)
+	}
+
+	numNew := 0
+	for _, name := range sortedKeys(byFile) {
+		var existing []storedTreatment
+		err := p.readFile(ctx, name, p.TreatmentCompression, &existing)
+		if err != nil {
+			return numNew, err
+		}
+
+		seen := make(map[string]struct{}, len(existing))
+		for _, st := range existing {
+			oid, _ := st["_id"].(string)
+			seen[oidOf(oid)] = struct{}{}
+		}
+		merged := existing
+		for _, t := range byFile[name] {
+			if _, ok := seen[oidOf(t.ID)]; ok {
+				continue
+			}
+			seen[oidOf(t.ID)] = struct{}{}
+			st := storedTreatment{
+				"_id":        p.IDStrategy.StoredID(t.ID),
+				"created_at": t.Time.Format(time.RFC3339),
+				"eventType":  t.Type,
+			}
+			for k, v := range treatmentFields(t.Fields) {
+				st[k] = v
+			}
+			merged = append(merged, st)
+		}
+		if len(merged) == len(existing) {
+			continue
+		}
+		slices.SortStableFunc(merged, func(a, b storedTreatment) int {
+			at, _ := a["created_at"].(string)
+			bt, _ := b["created_at"].(string)
+			return compareRFC3339(at, bt)
+		})
+
+		err = p.writeFile(ctx, name, p.TreatmentCompression, merged)
+		if err != nil {
+			return numNew, err
+		}
+		numNew += len(merged) - len(existing)
+	}
+	return numNew, nil
+}
+
+// readFile decodes a json file into v, leaving v empty if the file does not
+// exist yet
+func (p BucketArchiveWriter) readFile(ctx context.Context, name string, c bucketstore.Compression, v any) error {
+	r, err := getCompressed(ctx, p.BucketStore, c, name)
+	if err != nil {
+		if p.BucketStore.IsObjNotFoundErr(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot fetch %s: %w", name, err)
+	}
+	defer r.Close()
+	err = decodeStored(r, v)
+	if err != nil {
+		return fmt.Errorf("cannot decode %s: %w", name, err)
+	}
+	return nil
+}
+
+func (p BucketArchiveWriter) writeFile(ctx context.Context, name string, c bucketstore.Compression, v any) error {
+	log := slogctx.FromCtx(ctx)
+	b, err := marshalStored(v)
+	if err != nil {
+		return fmt.Errorf("cannot marshal %s: %w", name, err)
+	}
+	size, err := uploadCompressed(ctx, p.BucketStore, c, name, b)
+	if err != nil {
+		return fmt.Errorf("cannot upload %s: %w", name, err)
+	}
+	log.Debug("uploaded archive file", slog.String("name", c.Name(name)), slog.Int("byteSize", size))
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// compareRFC3339 orders timestamps as written by the treatment repository.
+// Unparseable timestamps sort first.
+func compareRFC3339(a, b string) int {
+	at, _ := time.Parse(time.RFC3339, a)
+	bt, _ := time.Parse(time.RFC3339, b)
+	return at.Compare(bt)
+}
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestArchiveFile(t *testing.T) {
+	assert.Equal(t, "ns-day/2024-11-28.json", archiveFile(recent, now, ".json"))
+	assert.Equal(t, "ns-day/2024-11-28.json", archiveFile(future, now, ".json"))
+	assert.Equal(t, "ns-month/2024-11.json", archiveFile(sameMonth, now, ".json"))
+	assert.Equal(t, "ns-year/2024-treatments.json", archiveFile(sameYear, now, "-treatments.json"))
+	assert.Equal(t, "ns-year/2023.json", archiveFile(lastYear, now, ".json"))
+}
+
+func TestBucketArchiveWriter(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	w := NewBucketArchiveWriter(bs)
+	w.EntryCompression = bucketstore.CompressionGzip
+
+	entries := []models.Entry{
+		{Oid: "lastyear", Type: "sgv", SgvMgdl: 103, Device: "a", Time: lastYear},
+		{Oid: "sameyear", Type: "sgv", SgvMgdl: 102, Device: "a", Time: sameYear},
+		{Oid: "latest", Type: "sgv", SgvMgdl: 98, Device: "a", Time: recent},
+	}
+	numNew, err := w.WriteEntries(ctx, entries, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, numNew)
+
+	// same oid, or same device+second, are skipped
+	numNew, err = w.WriteEntries(ctx, append(entries,
+		models.Entry{Oid: "other", SgvMgdl: 99, Device: "a", Time: lastYear},
+		models.Entry{Oid: "older", SgvMgdl: 100, Device: "a", Time: lastYear.AddDate(0, 1, 0)},
+	), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numNew)
+
+	// and the result can be read as usual
+	exported := map[string]string{}
+	export := NewBucketExportRepository(bs)
+	export.EntryCompression = bucketstore.CompressionGzip
+	assert.NoError(t, export.ExportEntries(ctx, func(e models.Entry) error {
+		exported[e.Oid] = e.Time.Format("2006-01")
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"lastyear": "2023-01", "older": "2023-02", "sameyear": "2024-01", "latest": "2024-11"}, exported)
+
+	numNew, err = w.WriteTreatments(ctx, []models.Treatment{
+		{ID: "note", Type: "Note", Time: recent, Fields: map[string]interface{}{"notes": "hi"}},
+		{ID: "carbs", Type: "Carbs", Time: lastYear, Fields: map[string]interface{}{"carbs": 20.0}},
+	}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numNew)
+	var treatments []string
+	assert.NoError(t, export.ExportTreatments(ctx, func(t models.Treatment) error {
+		treatments = append(treatments, t.ID)
+		return nil
+	}))
+	assert.Equal(t, []string{"carbs", "note"}, treatments)
+}
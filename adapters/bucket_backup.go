@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"time"
+)
+
+// backupDirs hold everything needed to rebuild entries and treatments
+var backupDirs = []string{"ns-day/", "ns-month/", "ns-year/"}
+
+// BackupSourceInterface is implemented by bucket stores that can report which
+// objects have changed
+type BackupSourceInterface interface {
+	BucketStoreInterface
+	ListModifiedSince(ctx context.Context, dir string, since time.Time) ([]string, error)
+}
+
+// BucketBackup copies day, month and year files to a second bucket, or to a
+// prefix in the same bucket, so a misconfigured lifecycle rule or accidental
+// deletion does not lose glucose history.
+type BucketBackup struct {
+	Source      BackupSourceInterface
+	Destination BucketStoreInterface
+	Prefix      string
+	lastRun     time.Time
+}
+
+func NewBucketBackup(source BackupSourceInterface, destination BucketStoreInterface, prefix string) *BucketBackup {
+	return &BucketBackup{
+		Source:      source,
+		Destination: destination,
+		Prefix:      prefix,
+	}
+}
+
+// Run copies objects modified since the last successful run, returning how
+// many were copied. The first run after boot copies everything. If any copy
+// fails the rest are still attempted, and all changed objects are retried on
+// the next run.
+func (b *BucketBackup) Run(ctx context.Context) (int, error) {
+	log := slogctx.FromCtx(ctx)
+	started := time.Now()
+
+	var firstErr error
+	numCopied := 0
+	for _, dir := range backupDirs {
+		names, err := b.Source.ListModifiedSince(ctx, dir, b.lastRun)
+		if err != nil {
+			return numCopied, fmt.Errorf("cannot list %s: %w", dir, err)
+		}
+		for _, name := range names {
+			err = b.copy(ctx, name)
+			if err != nil {
+				log.Warn("backup cannot copy object", slog.String("name", name), slog.Any("error", err))
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			numCopied++
+		}
+	}
+	if firstErr != nil {
+		return numCopied, firstErr
+	}
+
+	// objects modified while we were copying are picked up next time
+	b.lastRun = started
+	return numCopied, nil
+}
+
+func (b *BucketBackup) copy(ctx context.Context, name string) error {
+	r, err := b.Source.Get(ctx, name)
+	if err != nil {
+		return fmt.Errorf("cannot fetch %s: %w", name, err)
+	}
+	defer r.Close()
+
+	err = b.Destination.Upload(ctx, b.Prefix+name, r)
+	if err != nil {
+		return fmt.Errorf("cannot upload %s: %w", b.Prefix+name, err)
+	}
+	return nil
+}
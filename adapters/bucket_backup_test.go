@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBucketBackup(t *testing.T) {
+	source := &MockBucketStore{}
+	destination := &MockBucketStore{}
+	backup := NewBucketBackup(source, destination, "backup/")
+	ctx := contextWithSilentLogger()
+
+	// first run copies everything
+	source.On("ListModifiedSince", mock.Anything, "ns-day/", time.Time{}).Return([]string{"ns-day/2024-11-28.json"}, nil).Once()
+	source.On("ListModifiedSince", mock.Anything, "ns-month/", time.Time{}).Return([]string{"ns-month/2024-11.json"}, nil).Once()
+	source.On("ListModifiedSince", mock.Anything, "ns-year/", time.Time{}).Return([]string{"ns-year/2024.json"}, nil).Once()
+	for _, name := range []string{"ns-day/2024-11-28.json", "ns-month/2024-11.json", "ns-year/2024.json"} {
+		source.On("Get", mock.Anything, name).Return(io.NopCloser(strings.NewReader("[]")), nil)
+	}
+	destination.On("Upload", mock.Anything, "backup/ns-day/2024-11-28.json", mock.Anything).Return(errors.New("bucket unavailable")).Once()
+	destination.On("Upload", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	numCopied, err := backup.Run(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 2, numCopied, "other objects are still copied")
+	destination.AssertCalled(t, "Upload", mock.Anything, "backup/ns-year/2024.json", mock.Anything)
+
+	// failed runs are retried in full
+	source.On("ListModifiedSince", mock.Anything, "ns-day/", time.Time{}).Return([]string{"ns-day/2024-11-28.json"}, nil).Once()
+	source.On("ListModifiedSince", mock.Anything, "ns-month/", time.Time{}).Return([]string{}, nil).Once()
+	source.On("ListModifiedSince", mock.Anything, "ns-year/", time.Time{}).Return([]string{}, nil).Once()
+	numCopied, err = backup.Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numCopied)
+
+	// later runs only copy objects modified since the last successful run
+	source.On("ListModifiedSince", mock.Anything, mock.Anything, mock.MatchedBy(func(since time.Time) bool {
+		return !since.IsZero()
+	})).Return([]string{}, nil).Times(3)
+	numCopied, err = backup.Run(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, numCopied)
+	source.AssertExpectations(t)
+}
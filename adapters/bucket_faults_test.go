@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+// These tests run two instances over one bucket, as during a rolling deploy,
+// each seeing it through its own FaultInjector: uploads and reads fail, and
+// some uploads leave a truncated object behind. Once writes stop, the retry
+// queue and conflict checks must bring the bucket and both instances round
+// to holding everything either was given.
+
+var testFaults = bucketstore.FaultConfig{ErrorRate: 0.3, PartialWriteRate: 0.2}
+
+const maxConvergeRounds = 50
+
+func TestBucketEntryRepository_Faults(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	var instances []*BucketEntryRepository
+	for seed := int64(1); seed <= 2; seed++ {
+		faults := testFaults
+		faults.Seed = seed
+		repo := NewBucketEntryRepository(bucketstore.NewFaultInjector(bs, faults))
+		repo.CheckConflicts = true
+		repo.uploads.running = true // retry by hand rather than in the background
+		instances = append(instances, repo)
+	}
+
+	failuresBefore := uploadsFailures.Value()
+	var expected []string
+	for i := 0; i < 20; i++ {
+		repo := instances[i%2]
+		oid := fmt.Sprintf("%024x", i)
+		repo.addEntriesToMemStore(ctx, now, []models.Entry{{Oid: oid, Type: "sgv", SgvMgdl: 100 + i, Device: "dev", Time: sameDay.Add(time.Duration(i) * 5 * time.Minute)}})
+		repo.syncToBucket(ctx, now)
+		expected = append(expected, oid)
+	}
+
+	// keep syncing, as later uploads and the flush interval would, until the
+	// bucket and both instances hold every entry
+	converged := false
+	for round := 0; round < maxConvergeRounds && !converged; round++ {
+		for _, repo := range instances {
+			repo.memStore.dirtyLock.Lock()
+			repo.memStore.dirtyDay = true
+			repo.memStore.dirtyLock.Unlock()
+			repo.syncToBucket(ctx, now)
+			_ = repo.uploads.flush(ctx)
+		}
+		converged = slices.Equal(expected, storedOids(ctx, bs, "ns-day/2024-11-28.json"))
+		for _, repo := range instances {
+			for _, oid := range expected {
+				_, err := repo.FetchEntryByOid(ctx, oid)
+				converged = converged && err == nil
+			}
+		}
+	}
+	assert.True(t, converged, "entries did not converge after %d rounds", maxConvergeRounds)
+	assert.Greater(t, uploadsFailures.Value(), failuresBefore, "no faults were injected")
+	for _, repo := range instances {
+		assert.Zero(t, repo.uploads.numPending())
+	}
+}
+
+func TestBucketTreatmentRepository_Faults(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	var instances []*BucketTreatmentRepository
+	for seed := int64(3); seed <= 4; seed++ {
+		faults := testFaults
+		faults.Seed = seed
+		repo := NewBucketTreatmentRepository(bucketstore.NewFaultInjector(bs, faults))
+		repo.CheckConflicts = true
+		repo.uploads.running = true
+		instances = append(instances, repo)
+	}
+
+	failuresBefore := uploadsFailures.Value()
+	var expected []string
+	for i := 0; i < 20; i++ {
+		repo := instances[i%2]
+		oid := fmt.Sprintf("%024x", i)
+		repo.addTreatmentsToMemStore(ctx, now, []models.Treatment{{ID: oid, Type: "Note", Time: sameDay.Add(time.Duration(i) * 5 * time.Minute), Fields: map[string]interface{}{"notes": oid}}})
+		repo.syncToBucket(ctx, now)
+		expected = append(expected, oid)
+	}
+
+	converged := false
+	for round := 0; round < maxConvergeRounds && !converged; round++ {
+		for _, repo := range instances {
+			repo.memTreatmentStore.dirtyLock.Lock()
+			repo.memTreatmentStore.dirtyDay = true
+			repo.memTreatmentStore.dirtyLock.Unlock()
+			repo.syncToBucket(ctx, now)
+			_ = repo.uploads.flush(ctx)
+		}
+		converged = slices.Equal(expected, storedOids(ctx, bs, "ns-day/2024-11-28-treatments.json"))
+		for _, repo := range instances {
+			for _, oid := range expected {
+				_, err := repo.FetchTreatmentByOid(ctx, oid)
+				converged = converged && err == nil
+			}
+		}
+	}
+	assert.True(t, converged, "treatments did not converge after %d rounds", maxConvergeRounds)
+	assert.Greater(t, uploadsFailures.Value(), failuresBefore, "no faults were injected")
+	for _, repo := range instances {
+		assert.Zero(t, repo.uploads.numPending())
+	}
+}
+
+// storedOids returns the oids in a day, month or year file, in order, or nil
+// if it cannot be read, eg while a partial write is in place
+func storedOids(ctx context.Context, bs *bucketstore.BucketStore, name string) []string {
+	r, err := bs.Get(ctx, name)
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil
+	}
+	var stored []storedTreatment
+	if unmarshalStored(b, &stored) != nil {
+		return nil
+	}
+	var oids []string
+	for _, st := range stored {
+		oid, _ := st["_id"].(string)
+		oids = append(oids, oid)
+	}
+	return oids
+}
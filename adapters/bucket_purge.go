@@ -0,0 +1,390 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	slogctx "github.com/veqryn/slog-context"
+	"io"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Entries and treatments can be purged by event time (and entries by
+// device), eg to enforce retention or to remove data uploaded by mistake.
+// Every day, month and year file overlapping the purged period is rewritten
+// without it, or deleted if nothing is left, then the purged data is removed
+// from memory. That includes completed backup day/month files and years that
+// are not held in memory. If a file cannot be rewritten memory is left as it
+// was, so the purge can be retried.
+//
+// Purging rewrites files as syncing does, so needs the sync lease.
+
+// BucketPurgeInterface is implemented by bucket stores that can list and
+// delete objects
+type BucketPurgeInterface interface {
+	BucketListerInterface
+	Delete(ctx context.Context, name string) error
+}
+
+// objectPeriod returns the period covered by a day, month or year object, eg
+// ns-month/2024-11-treatments.json.gz covers November 2024 and
+// ns-day/2024-11-28/<ulid>.jsonl covers 28th November
+func objectPeriod(name string) (time.Time, time.Time, bool) {
+	dir, base, ok := strings.Cut(name, "/")
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	layout, years, months, days := "2006-01-02", 0, 0, 1
+	switch dir {
+	case "ns-year":
+		layout, years, days = "2006", 1, 0
+	case "ns-month":
+		layout, months, days = "2006-01", 1, 0
+	}
+	if len(base) < len(layout) {
+		return time.Time{}, time.Time{}, false
+	}
+	start, err := time.Parse(layout, base[:len(layout)])
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	return start, start.AddDate(years, months, days), true
+}
+
+// listObjectsRecursive lists dir, including objects in subdirectories such as
+// append mode day chunks
+func listObjectsRecursive(ctx context.Context, bs BucketListerInterface, dir string) ([]string, error) {
+	names, err := bs.List(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list %s: %w", dir, err)
+	}
+	var objects []string
+	for _, name := range names {
+		if !strings.HasSuffix(name, "/") {
+			objects = append(objects, name)
+			continue
+		}
+		children, err := listObjectsRecursive(ctx, bs, name)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, children...)
+	}
+	return objects, nil
+}
+
+// purgeObjects calls fn for each object in dirs whose period overlaps
+// [from, to), with whole set if the object's whole period is within it
+func purgeObjects(ctx context.Context, bs BucketPurgeInterface, dirs []string, from, to time.Time, fn func(name string, whole bool) error) error {
+	for _, dir := range dirs {
+		names, err := listObjectsRecursive(ctx, bs, dir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			start, end, ok := objectPeriod(name)
+			if !ok || !end.After(from) || !start.Before(to) {
+				continue
+			}
+			err = fn(name, !start.Before(from) && !end.After(to))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isTreatmentObject(name string) bool {
+	return strings.Contains(path.Base(name), "-treatments.json")
+}
+
+func inPurgePeriod(t, from, to time.Time) bool {
+	return !t.Before(from) && t.Before(to)
+}
+
+func readObject(ctx context.Context, bs BucketStoreInterface, name string) ([]byte, error) {
+	r, err := bs.Get(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch %s: %w", name, err)
+	}
+	r, err = bucketstore.Decompress(name, r)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// rewriteObject replaces the named object with b, compressed as before, or
+// deletes it if empty is set
+func rewriteObject(ctx context.Context, bs BucketPurgeInterface, name string, b []byte, empty bool) error {
+	log := slogctx.FromCtx(ctx)
+	if empty {
+		err := bs.Delete(ctx, name)
+		if err != nil {
+			return fmt.Errorf("cannot delete %s: %w", name, err)
+		}
+		log.Debug("purge deleted object", slog.String("name", name))
+		return nil
+	}
+	c, uncompressed := bucketstore.CompressionOf(name)
+	size, err := uploadCompressed(ctx, bs, c, uncompressed, b)
+	if err != nil {
+		return fmt.Errorf("cannot upload %s: %w", name, err)
+	}
+	log.Debug("purge rewrote object", slog.String("name", name), slog.Int("byteSize", size))
+	return nil
+}
+
+// PurgeEntries removes entries with an event time in [from, to), only those
+// from device if it is set, returning how many were removed
+func (p BucketEntryRepository) PurgeEntries(ctx context.Context, from, to time.Time, device string) (int, error) {
+	log := slogctx.FromCtx(ctx)
+	bs, ok := p.BucketStore.(BucketPurgeInterface)
+	if !ok {
+		return 0, errors.New("purging needs a bucket store that can list and delete objects")
+	}
+	if !p.Lease.hold(ctx, time.Now()) {
+		return 0, errors.New("cannot purge without the sync lease")
+	}
+
+	// hold every lock, in the same order as addEntriesToMemStore, so new
+	// entries cannot be synced to a file part way through being rewritten
+	p.memStore.dirtyLock.Lock()
+	defer p.memStore.dirtyLock.Unlock()
+	p.memStore.entriesLock.Lock()
+	defer p.memStore.entriesLock.Unlock()
+	p.memStore.deviceNamesLock.Lock()
+	defer p.memStore.deviceNamesLock.Unlock()
+
+	purged := make(map[string]struct{})
+	isPurged := func(e memEntry) bool {
+		if !inPurgePeriod(e.EventTime, from, to) {
+			return false
+		}
+		return device == "" || p.memStore.deviceNames[e.DeviceID] == device
+	}
+	for _, e := range p.memStore.entries {
+		if isPurged(e) {
+			purged[oidOf(e.Oid)] = struct{}{}
+		}
+	}
+	numPurged := len(purged)
+
+	numObjects := 0
+	err := purgeObjects(ctx, bs, backupDirs, from, to, func(name string, whole bool) error {
+		if isTreatmentObject(name) {
+			return nil
+		}
+		if strings.HasSuffix(name, ".parquet") {
+			// parquet is rewritten along with the year's json
+			if whole || !p.ParquetYears {
+				numObjects++
+				return rewriteObject(ctx, bs, name, nil, true)
+			}
+			return nil
+		}
+		if whole && device == "" && !strings.HasPrefix(name, "ns-year/") {
+			numObjects++
+			return rewriteObject(ctx, bs, name, nil, true)
+		}
+
+		kept, removed, err := p.purgeEntryObject(ctx, bs, name, from, to, device)
+		if err != nil {
+			return err
+		}
+		if len(removed) == 0 {
+			return nil
+		}
+		numObjects++
+		// entries not held in memory are only counted once, from their year file
+		if strings.HasPrefix(name, "ns-year/") {
+			for _, oid := range removed {
+				if _, ok := purged[oid]; !ok {
+					purged[oid] = struct{}{}
+					numPurged++
+				}
+			}
+			if p.ParquetYears && len(kept) > 0 {
+				year, _, _ := objectPeriod(name)
+				p.writeParquetToBucket(ctx, fmt.Sprintf("ns-year/%d.parquet", year.Year()), kept)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	p.memStore.entries = slices.DeleteFunc(p.memStore.entries, isPurged)
+	p.memStore.resetIndexes()
+	p.memStore.unsyncedDay = slices.DeleteFunc(p.memStore.unsyncedDay, isPurged)
+	p.history.forget(from, to)
+	log.Info("purged entries",
+		slog.Time("from", from),
+		slog.Time("to", to),
+		slog.String("device", device),
+		slog.Int("numPurged", numPurged),
+		slog.Int("numObjects", numObjects),
+	)
+	return numPurged, nil
+}
+
+// purgeEntryObject rewrites a day, month or year file (or day chunk) without
+// purged entries, returning the entries kept and the oids removed
+func (p BucketEntryRepository) purgeEntryObject(ctx context.Context, bs BucketPurgeInterface, name string, from, to time.Time, device string) ([]storedEntry, []string, error) {
+	b, err := readObject(ctx, bs, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunk := strings.HasSuffix(name, ".jsonl")
+	var entries []storedEntry
+	if chunk {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		for {
+			var e storedEntry
+			err := dec.Decode(&e)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot decode %s: %w", name, err)
+			}
+			entries = append(entries, e)
+		}
+	} else {
+		err = unmarshalStored(b, &entries)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot decode %s: %w", name, err)
+		}
+	}
+
+	var kept []storedEntry
+	var removed []string
+	for _, e := range entries {
+		if inPurgePeriod(e.Time, from, to) && (device == "" || e.Device == device) {
+			removed = append(removed, oidOf(e.Oid))
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if len(removed) == 0 {
+		return kept, nil, nil
+	}
+
+	var buf bytes.Buffer
+	if chunk {
+		enc := json.NewEncoder(&buf)
+		for _, e := range kept {
+			err = enc.Encode(e)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot marshal %s: %w", name, err)
+			}
+		}
+	} else {
+		b, err = marshalStored(kept)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot marshal %s: %w", name, err)
+		}
+		buf.Write(b)
+	}
+	return kept, removed, rewriteObject(ctx, bs, name, buf.Bytes(), len(kept) == 0)
+}
+
+// PurgeTreatments removes treatments with an event time in [from, to),
+// returning how many were removed
+func (p BucketTreatmentRepository) PurgeTreatments(ctx context.Context, from, to time.Time) (int, error) {
+	log := slogctx.FromCtx(ctx)
+	bs, ok := p.BucketStore.(BucketPurgeInterface)
+	if !ok {
+		return 0, errors.New("purging needs a bucket store that can list and delete objects")
+	}
+	if !p.Lease.hold(ctx, time.Now()) {
+		return 0, errors.New("cannot purge without the sync lease")
+	}
+
+	p.memTreatmentStore.dirtyLock.Lock()
+	defer p.memTreatmentStore.dirtyLock.Unlock()
+	p.memTreatmentStore.treatmentsLock.Lock()
+	defer p.memTreatmentStore.treatmentsLock.Unlock()
+
+	purged := make(map[string]struct{})
+	isPurged := func(t memTreatment) bool { return inPurgePeriod(t.Time, from, to) }
+	for _, t := range p.memTreatmentStore.treatments {
+		if isPurged(t) {
+			purged[oidOf(t.Oid)] = struct{}{}
+		}
+	}
+	numPurged := len(purged)
+
+	numObjects := 0
+	err := purgeObjects(ctx, bs, backupDirs, from, to, func(name string, whole bool) error {
+		if !isTreatmentObject(name) {
+			return nil
+		}
+		if whole && !strings.HasPrefix(name, "ns-year/") {
+			numObjects++
+			return rewriteObject(ctx, bs, name, nil, true)
+		}
+
+		b, err := readObject(ctx, bs, name)
+		if err != nil {
+			return err
+		}
+		var treatments []storedTreatment
+		err = unmarshalStored(b, &treatments)
+		if err != nil {
+			return fmt.Errorf("cannot decode %s: %w", name, err)
+		}
+		var kept []storedTreatment
+		var removed []string
+		for _, st := range treatments {
+			created, _ := st["created_at"].(string)
+			t, err := time.Parse(time.RFC3339, created)
+			if err == nil && inPurgePeriod(t, from, to) {
+				oid, _ := st["_id"].(string)
+				removed = append(removed, oidOf(oid))
+				continue
+			}
+			kept = append(kept, st)
+		}
+		if len(removed) == 0 {
+			return nil
+		}
+		numObjects++
+		if strings.HasPrefix(name, "ns-year/") {
+			for _, oid := range removed {
+				if _, ok := purged[oid]; !ok {
+					purged[oid] = struct{}{}
+					numPurged++
+				}
+			}
+		}
+		b, err = marshalStored(kept)
+		if err != nil {
+			return fmt.Errorf("cannot marshal %s: %w", name, err)
+		}
+		return rewriteObject(ctx, bs, name, b, len(kept) == 0)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	p.memTreatmentStore.treatments = slices.DeleteFunc(p.memTreatmentStore.treatments, isPurged)
+	p.memTreatmentStore.oids.reset()
+	log.Info("purged treatments",
+		slog.Time("from", from),
+		slog.Time("to", to),
+		slog.Int("numPurged", numPurged),
+		slog.Int("numObjects", numObjects),
+	)
+	return numPurged, nil
+}
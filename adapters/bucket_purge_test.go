@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestObjectPeriod(t *testing.T) {
+	for name, want := range map[string][2]time.Time{
+		"ns-year/2023.json.gz":             {lastYear, sameYear},
+		"ns-month/2024-11-treatments.json": {sameMonth, time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)},
+		"ns-day/2024-11-28/01ABC.jsonl":    {sameDay, sameDay.AddDate(0, 0, 1)},
+		"ns-devicestatus/2024-11-28.json":  {sameDay, sameDay.AddDate(0, 0, 1)},
+	} {
+		start, end, ok := objectPeriod(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, want, [2]time.Time{start, end}, name)
+	}
+	_, _, ok := objectPeriod("ns-config/import-cursor-llu.json")
+	assert.False(t, ok)
+}
+
+func listAll(t *testing.T, bs *bucketstore.BucketStore) []string {
+	names, err := listObjectsRecursive(context.Background(), bs, "")
+	assert.NoError(t, err)
+	return names
+}
+
+func TestPurgeEntries(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	ancient := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	entries := []models.Entry{
+		{Oid: "ancient", Type: "sgv", SgvMgdl: 104, Device: "a", Time: ancient},
+		{Oid: "lastyear", Type: "sgv", SgvMgdl: 103, Device: "a", Time: lastYear},
+		{Oid: "sameyear", Type: "sgv", SgvMgdl: 102, Device: "b", Time: sameYear},
+		{Oid: "latest", Type: "sgv", SgvMgdl: 98, Device: "a", Time: recent},
+	}
+	w := NewBucketArchiveWriter(bs)
+	w.EntryCompression = bucketstore.CompressionGzip
+	_, err := w.WriteEntries(ctx, entries, now)
+	assert.NoError(t, err)
+	assert.NoError(t, bs.Upload(ctx, "ns-day/2024-11-28/01ABC.jsonl", strings.NewReader(`{"_id":"latest","dateString":"2024-11-28T09:30:00Z","device":"a"}`+"\n")))
+
+	repo := NewBucketEntryRepository(bs)
+	repo.Compression = bucketstore.CompressionGzip
+	var stored []storedEntry
+	for _, e := range entries[1:] {
+		stored = append(stored, storedEntry{Oid: e.Oid, Type: e.Type, SgvMgdl: e.SgvMgdl, Device: e.Device, Time: e.Time})
+	}
+	repo.addStoredEntries(stored)
+
+	// one device's entries
+	numPurged, err := repo.PurgeEntries(ctx, time.Time{}, future, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numPurged)
+	assert.NotContains(t, listAll(t, bs), "ns-year/2024.json.gz")
+
+	// entries before this year, including years not held in memory
+	numPurged, err = repo.PurgeEntries(ctx, time.Time{}, sameYear, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numPurged)
+	assert.Equal(t, []string{"ns-day/2024-11-28.json.gz", "ns-day/2024-11-28/01ABC.jsonl"}, listAll(t, bs))
+	latest, err := repo.FetchLatestEntries(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"latest"}, entryOids(latest))
+
+	// part of today: the day file and chunk are rewritten, and being empty deleted
+	numPurged, err = repo.PurgeEntries(ctx, sameDay, now, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numPurged)
+	assert.Empty(t, listAll(t, bs))
+}
+
+// failingDeletes is a bucket that cannot delete objects
+type failingDeletes struct {
+	*bucketstore.BucketStore
+}
+
+func (b failingDeletes) Delete(ctx context.Context, name string) error {
+	return errors.New("cannot delete")
+}
+
+func TestPurgeBucketError(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	w := NewBucketArchiveWriter(bs)
+	_, err := w.WriteEntries(ctx, []models.Entry{{Oid: "recent", Type: "sgv", Device: "a", Time: recent}}, now)
+	assert.NoError(t, err)
+	_, err = w.WriteTreatments(ctx, []models.Treatment{{ID: "recent", Type: "Note", Time: recent}}, now)
+	assert.NoError(t, err)
+
+	repo := NewBucketEntryRepository(failingDeletes{bs})
+	repo.addStoredEntries([]storedEntry{{Oid: "recent", Type: "sgv", Device: "a", Time: recent}})
+	treatmentRepo := NewBucketTreatmentRepository(failingDeletes{bs})
+	treatmentRepo.addTreatmentsToMemStore(ctx, now, []models.Treatment{{ID: "recent", Type: "Note", Time: recent, Fields: map[string]interface{}{}}})
+
+	// memory is only purged once the files are, so it still matches them
+	_, err = repo.PurgeEntries(ctx, sameDay, future, "")
+	assert.Error(t, err)
+	latest, err := repo.FetchLatestEntries(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"recent"}, entryOids(latest))
+	_, err = treatmentRepo.PurgeTreatments(ctx, sameDay, future)
+	assert.Error(t, err)
+	treatments, err := treatmentRepo.FetchLatestTreatments(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Len(t, treatments, 1)
+
+	// so the purge can be retried
+	repo.BucketStore = bs
+	numPurged, err := repo.PurgeEntries(ctx, sameDay, future, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numPurged)
+	latest, err = repo.FetchLatestEntries(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, latest)
+	treatmentRepo.BucketStore = bs
+	numPurged, err = treatmentRepo.PurgeTreatments(ctx, sameDay, future)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numPurged)
+	assert.Empty(t, listAll(t, bs))
+}
+
+func TestPurgerPurgeBefore(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	w := NewBucketArchiveWriter(bs)
+	_, err := w.WriteTreatments(ctx, []models.Treatment{
+		{ID: "old", Type: "Note", Time: lastYear},
+		{ID: "new", Type: "Note", Time: sameMonth},
+	}, now)
+	assert.NoError(t, err)
+	for _, name := range []string{"ns-devicestatus/2024-10-01.json", "ns-hires/2024-11-27.json"} {
+		assert.NoError(t, bs.Upload(ctx, name, strings.NewReader("[]")))
+	}
+
+	purger := NewPurger(NewBucketEntryRepository(bs), NewBucketTreatmentRepository(bs), bs)
+	result, err := purger.PurgeBefore(ctx, now, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, models.PurgeResult{Treatments: 1, Files: 1}, result)
+	assert.Equal(t, []string{"ns-hires/2024-11-27.json", "ns-month/2024-11-treatments.json"}, listAll(t, bs))
+}
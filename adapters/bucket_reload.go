@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// A period can be reloaded from its day, month or year file, eg after the file
+// has been edited by hand. Whatever is in memory for the period is replaced by
+// the file's contents, which are assumed to be correct, so nothing is marked
+// dirty.
+//
+// Only the part of the period the file covers is replaced: the current month
+// file does not include today and the current year file does not include this
+// month. Month and year files written before their period ended may also be
+// missing its last day or month, so reload those too if needed.
+
+// periodObject returns the name of the day, month or year file for period,
+// eg ns-month/2024-11-treatments.json for suffix -treatments
+func periodObject(period models.Period, suffix string) string {
+	return fmt.Sprintf("ns-%s/%s%s.json", period.Unit, period.Name, suffix)
+}
+
+// reloadRange returns the part of period covered by its file
+func reloadRange(period models.Period, now time.Time) (time.Time, time.Time) {
+	to := period.End
+	switch period.Unit {
+	case "month":
+		startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		if to.After(startOfDay) {
+			to = startOfDay
+		}
+	case "year":
+		startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if to.After(startOfMonth) {
+			to = startOfMonth
+		}
+	}
+	return period.Start, to
+}
+
+// fetchPeriodObject decodes a period's file into v, returning
+// models.ErrNotFound if there is no such file
+func fetchPeriodObject(ctx context.Context, bs BucketStoreInterface, c bucketstore.Compression, name string, v any) error {
+	r, err := getCompressed(ctx, bs, c, name)
+	if err != nil {
+		if bs.IsObjNotFoundErr(err) {
+			return models.ErrNotFound
+		}
+		return fmt.Errorf("cannot fetch %s: %w", name, err)
+	}
+	defer r.Close()
+	err = decodeStored(r, v)
+	if err != nil {
+		return fmt.Errorf("cannot decode %s: %w", name, err)
+	}
+	return nil
+}
+
+// ReloadPeriod replaces the entries held for period with those in its file,
+// returning how many were loaded
+func (p BucketEntryRepository) ReloadPeriod(ctx context.Context, period models.Period) (int, error) {
+	from, to := reloadRange(period, time.Now())
+	var stored []storedEntry
+	err := fetchPeriodObject(ctx, p.BucketStore, p.Compression, periodObject(period, ""), &stored)
+	if err != nil {
+		return 0, err
+	}
+
+	p.memStore.dirtyLock.Lock()
+	defer p.memStore.dirtyLock.Unlock()
+	p.memStore.entriesLock.Lock()
+	defer p.memStore.entriesLock.Unlock()
+	p.memStore.deviceNamesLock.Lock()
+	defer p.memStore.deviceNamesLock.Unlock()
+
+	// evicted entries are read from their year file on demand, so only
+	// forget the cached copy
+	p.history.forget(from, to)
+	if from.Before(p.memStore.heldFrom) {
+		from = p.memStore.heldFrom
+	}
+	stored = slices.DeleteFunc(stored, func(e storedEntry) bool {
+		return e.Time.Before(from) || !e.Time.Before(to)
+	})
+
+	inPeriod := func(e memEntry) bool { return !e.EventTime.Before(from) && e.EventTime.Before(to) }
+	numEntries := len(p.memStore.entries)
+	p.memStore.entries = slices.DeleteFunc(p.memStore.entries, inPeriod)
+	numRemoved := numEntries - len(p.memStore.entries)
+	p.memStore.unsyncedDay = slices.DeleteFunc(p.memStore.unsyncedDay, inPeriod)
+	p.appendStoredEntries(stored)
+	slices.SortStableFunc(p.memStore.entries, func(a, b memEntry) int { return a.EventTime.Compare(b.EventTime) })
+	p.memStore.resetIndexes()
+
+	slogctx.FromCtx(ctx).Info("reloaded entries",
+		slog.String("period", period.Name),
+		slog.Int("numRemoved", numRemoved),
+		slog.Int("numLoaded", len(stored)),
+	)
+	return len(stored), nil
+}
+
+// ReloadPeriod replaces the treatments held for period with those in its
+// file, returning how many were loaded
+func (p BucketTreatmentRepository) ReloadPeriod(ctx context.Context, period models.Period) (int, error) {
+	from, to := reloadRange(period, time.Now())
+	var stored []storedTreatment
+	err := fetchPeriodObject(ctx, p.BucketStore, p.Compression, periodObject(period, "-treatments"), &stored)
+	if err != nil {
+		return 0, err
+	}
+	memTreatments := slices.DeleteFunc(p.memTreatmentsFromStored(ctx, stored), func(t memTreatment) bool {
+		return t.Time.Before(from) || !t.Time.Before(to)
+	})
+
+	p.memTreatmentStore.dirtyLock.Lock()
+	defer p.memTreatmentStore.dirtyLock.Unlock()
+	p.memTreatmentStore.treatmentsLock.Lock()
+	defer p.memTreatmentStore.treatmentsLock.Unlock()
+
+	numTreatments := len(p.memTreatmentStore.treatments)
+	p.memTreatmentStore.treatments = slices.DeleteFunc(p.memTreatmentStore.treatments, func(t memTreatment) bool {
+		return !t.Time.Before(from) && t.Time.Before(to)
+	})
+	numRemoved := numTreatments - len(p.memTreatmentStore.treatments)
+	p.memTreatmentStore.treatments = append(p.memTreatmentStore.treatments, memTreatments...)
+	slices.SortStableFunc(p.memTreatmentStore.treatments, func(a, b memTreatment) int { return a.Time.Compare(b.Time) })
+	p.memTreatmentStore.oids.reset()
+
+	slogctx.FromCtx(ctx).Info("reloaded treatments",
+		slog.String("period", period.Name),
+		slog.Int("numRemoved", numRemoved),
+		slog.Int("numLoaded", len(memTreatments)),
+	)
+	return len(memTreatments), nil
+}
+
+// ReloadPeriod reloads entries and treatments for period from the bucket. A
+// period may have entries but no treatments file or vice versa, but
+// models.ErrNotFound is returned if it has neither.
+func (s BucketSyncer) ReloadPeriod(ctx context.Context, period models.Period) (models.ReloadResult, error) {
+	var result models.ReloadResult
+	var err error
+	result.Entries, err = s.EntryRepository.ReloadPeriod(ctx, period)
+	entriesFound := !errors.Is(err, models.ErrNotFound)
+	if err != nil && entriesFound {
+		return result, fmt.Errorf("cannot reload entries: %w", err)
+	}
+	result.Treatments, err = s.TreatmentRepository.ReloadPeriod(ctx, period)
+	if errors.Is(err, models.ErrNotFound) {
+		if !entriesFound {
+			return result, models.ErrNotFound
+		}
+		return result, nil
+	}
+	if err != nil {
+		return result, fmt.Errorf("cannot reload treatments: %w", err)
+	}
+	return result, nil
+}
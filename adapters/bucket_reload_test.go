@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestReloadPeriod(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	syncer := NewBucketSyncer(NewBucketEntryRepository(bs), NewBucketTreatmentRepository(bs))
+	earlier := time.Date(2024, 11, 20, 12, 0, 0, 0, time.UTC)
+	syncer.EntryRepository.addEntriesToMemStore(ctx, now, []models.Entry{
+		{Oid: "edited-out", Type: "sgv", SgvMgdl: 100, Device: "dev", Time: earlier},
+		{Oid: "kept", Type: "sgv", SgvMgdl: 101, Device: "dev", Time: recent},
+	})
+	syncer.TreatmentRepository.addTreatmentsToMemStore(ctx, now, []models.Treatment{
+		{ID: "edited-out", Type: "Note", Time: earlier, Fields: map[string]interface{}{}},
+	})
+
+	_, err := syncer.ReloadPeriod(ctx, models.Period{Name: "2024-11-19", Unit: "day", Start: earlier.AddDate(0, 0, -1), End: earlier})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	err = bs.Upload(ctx, "ns-day/2024-11-20.json", strings.NewReader(`[
+		{"_id":"added","type":"sgv","sgv":120,"direction":"Flat","device":"other","dateString":"2024-11-20T13:00:00Z","sysTime":"2024-11-20T13:00:00Z"},
+		{"_id":"wrong-day","type":"sgv","sgv":130,"direction":"Flat","device":"other","dateString":"2024-11-21T13:00:00Z","sysTime":"2024-11-21T13:00:00Z"}
+	]`))
+	assert.NoError(t, err)
+
+	// a period with entries but no treatments file is fine
+	period, err := models.ParsePeriod("2024-11-20")
+	assert.NoError(t, err)
+	result, err := syncer.ReloadPeriod(ctx, period)
+	assert.NoError(t, err)
+	assert.Equal(t, models.ReloadResult{Entries: 1}, result)
+
+	_, err = syncer.EntryRepository.FetchEntryByOid(ctx, "edited-out")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = syncer.EntryRepository.FetchEntryByOid(ctx, "wrong-day")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	added, err := syncer.EntryRepository.FetchEntryByOid(ctx, "added")
+	assert.NoError(t, err)
+	assert.Equal(t, "other", added.Device)
+	_, err = syncer.EntryRepository.FetchEntryByOid(ctx, "kept")
+	assert.NoError(t, err)
+	_, err = syncer.TreatmentRepository.FetchTreatmentByOid(ctx, "edited-out")
+	assert.NoError(t, err)
+
+	err = bs.Upload(ctx, "ns-day/2024-11-20-treatments.json", strings.NewReader(`[
+		{"_id":"added","eventType":"Note","created_at":"2024-11-20T13:00:00Z","notes":"fixed"}
+	]`))
+	assert.NoError(t, err)
+	result, err = syncer.ReloadPeriod(ctx, period)
+	assert.NoError(t, err)
+	assert.Equal(t, models.ReloadResult{Entries: 1, Treatments: 1}, result)
+	_, err = syncer.TreatmentRepository.FetchTreatmentByOid(ctx, "edited-out")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = syncer.TreatmentRepository.FetchTreatmentByOid(ctx, "added")
+	assert.NoError(t, err)
+}
+
+func TestReloadRange(t *testing.T) {
+	month, _ := models.ParsePeriod("2024-11")
+	from, to := reloadRange(month, now)
+	assert.Equal(t, sameMonth, from)
+	assert.Equal(t, sameDay, to)
+
+	year, _ := models.ParsePeriod("2024")
+	from, to = reloadRange(year, now)
+	assert.Equal(t, sameYear, from)
+	assert.Equal(t, sameMonth, to)
+
+	from, to = reloadRange(year, now.AddDate(1, 0, 0))
+	assert.Equal(t, sameYear, from)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), to)
+}
@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// BucketRestorer rebuilds day files from the month and year files, eg after
+// day files were lost or corrupted. Past days are held in their month and
+// year files as well as their day file, so every day but today can be
+// restored.
+//
+// Day files that are still intact are left alone unless Overwrite is set, in
+// which case archived entries and treatments are merged into them.
+type BucketRestorer struct {
+	BucketStore          BucketStoreInterface
+	EntryCompression     bucketstore.Compression
+	TreatmentCompression bucketstore.Compression
+	Overwrite            bool // also merge archived data into intact day files
+	DryRun               bool // report what would be restored, but write nothing
+}
+
+func NewBucketRestorer(bs BucketStoreInterface) *BucketRestorer {
+	return &BucketRestorer{BucketStore: bs}
+}
+
+// RestoredDay describes a day file written (or, for a dry run, that would be
+// written) by RestoreDays
+type RestoredDay struct {
+	Name  string // eg ns-day/2024-11-20-treatments.json
+	Items int    // entries or treatments in the restored file
+	Was   string // missing, corrupt or intact
+}
+
+// RestoreDays rebuilds entry and treatment day files for days in [from, to)
+// that have anything in the month or year files
+func (p BucketRestorer) RestoreDays(ctx context.Context, from, to time.Time) ([]RestoredDay, error) {
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	now := time.Now()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if to.After(startOfDay) {
+		to = startOfDay
+	}
+	if !from.Before(to) {
+		return nil, nil
+	}
+
+	entryDays, err := restoreDays(ctx, p, p.EntryCompression, ".json", from, to,
+		func(e storedEntry) time.Time { return e.Time },
+		func(e storedEntry) string { return oidOf(e.Oid) },
+	)
+	if err != nil {
+		return entryDays, err
+	}
+	treatmentDays, err := restoreDays(ctx, p, p.TreatmentCompression, "-treatments.json", from, to,
+		func(st storedTreatment) time.Time {
+			created, _ := st["created_at"].(string)
+			t, _ := time.Parse(time.RFC3339, created)
+			return t
+		},
+		func(st storedTreatment) string {
+			oid, _ := st["_id"].(string)
+			return oidOf(oid)
+		},
+	)
+	return append(entryDays, treatmentDays...), err
+}
+
+// restoreDays restores day files of one kind, identified by suffix
+func restoreDays[T any](ctx context.Context, p BucketRestorer, c bucketstore.Compression, suffix string, from, to time.Time, eventTime func(T) time.Time, oid func(T) string) ([]RestoredDay, error) {
+	log := slogctx.FromCtx(ctx)
+	archived, err := readArchives(ctx, p.BucketStore, c, suffix, from, to, eventTime, oid)
+	if err != nil {
+		return nil, err
+	}
+	byDay := make(map[string][]T)
+	for _, item := range archived {
+		day := eventTime(item).Format(time.DateOnly)
+		byDay[day] = append(byDay[day], item)
+	}
+
+	var restored []RestoredDay
+	for _, day := range sortedKeys(byDay) {
+		name := fmt.Sprintf("ns-day/%s%s", day, suffix)
+		items := byDay[day]
+
+		var existing []T
+		was := "intact"
+		r, err := getCompressed(ctx, p.BucketStore, c, name)
+		switch {
+		case err != nil && p.BucketStore.IsObjNotFoundErr(err):
+			was = "missing"
+		case err != nil:
+			return restored, fmt.Errorf("cannot fetch %s: %w", name, err)
+		default:
+			err = decodeStored(r, &existing)
+			r.Close()
+			if err != nil {
+				log.Warn("restore: day file is corrupt", slog.String("name", name), slog.Any("err", err))
+				existing = nil
+				was = "corrupt"
+			}
+		}
+		if was == "intact" && !p.Overwrite {
+			continue
+		}
+
+		items = mergeByOid(existing, items, oid)
+		slices.SortStableFunc(items, func(a, b T) int { return eventTime(a).Compare(eventTime(b)) })
+		restored = append(restored, RestoredDay{Name: c.Name(name), Items: len(items), Was: was})
+		if p.DryRun {
+			continue
+		}
+		b, err := marshalStored(items)
+		if err != nil {
+			return restored, fmt.Errorf("cannot marshal %s: %w", name, err)
+		}
+		size, err := uploadCompressed(ctx, p.BucketStore, c, name, b)
+		if err != nil {
+			return restored, fmt.Errorf("cannot upload %s: %w", name, err)
+		}
+		log.Debug("restored day file", slog.String("name", c.Name(name)), slog.Int("byteSize", size), slog.String("was", was))
+	}
+	return restored, nil
+}
+
+// readArchives returns everything in [from, to) from the month and year files
+// overlapping it. Missing files are skipped, as are corrupt ones since
+// another file may hold the same data.
+func readArchives[T any](ctx context.Context, bs BucketStoreInterface, c bucketstore.Compression, suffix string, from, to time.Time, eventTime func(T) time.Time, oid func(T) string) ([]T, error) {
+	log := slogctx.FromCtx(ctx)
+	var names []string
+	for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(to); month = month.AddDate(0, 1, 0) {
+		if month.Month() == time.January || len(names) == 0 {
+			names = append(names, fmt.Sprintf("ns-year/%d%s", month.Year(), suffix))
+		}
+		names = append(names, fmt.Sprintf("ns-month/%s%s", month.Format("2006-01"), suffix))
+	}
+
+	var archived []T
+	for _, name := range names {
+		var items []T
+		r, err := getCompressed(ctx, bs, c, name)
+		if err != nil {
+			if bs.IsObjNotFoundErr(err) {
+				continue
+			}
+			return nil, fmt.Errorf("cannot fetch %s: %w", name, err)
+		}
+		err = decodeStored(r, &items)
+		r.Close()
+		if err != nil {
+			log.Warn("restore: skipping corrupt archive", slog.String("name", name), slog.Any("err", err))
+			continue
+		}
+		items = slices.DeleteFunc(items, func(item T) bool {
+			t := eventTime(item)
+			return t.Before(from) || !t.Before(to)
+		})
+		archived = mergeByOid(archived, items, oid)
+	}
+	return archived, nil
+}
+
+// mergeByOid appends items not already in existing
+func mergeByOid[T any](existing, items []T, oid func(T) string) []T {
+	seen := make(map[string]struct{}, len(existing))
+	for _, item := range existing {
+		seen[oid(item)] = struct{}{}
+	}
+	for _, item := range items {
+		if _, ok := seen[oid(item)]; ok {
+			continue
+		}
+		seen[oid(item)] = struct{}{}
+		existing = append(existing, item)
+	}
+	return existing
+}
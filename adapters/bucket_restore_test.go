@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestRestoreDays(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	for name, body := range map[string]string{
+		"ns-year/2024.json": `[{"_id":"march","type":"sgv","sgv":100,"dateString":"2024-03-05T12:00:00Z"}]`,
+		"ns-month/2024-11.json": `{"version":2,"data":[` +
+			`{"_id":"intact","type":"sgv","sgv":101,"dateString":"2024-11-19T12:00:00Z"},` +
+			`{"_id":"extra","type":"sgv","sgv":102,"dateString":"2024-11-19T13:00:00Z"},` +
+			`{"_id":"corrupt","type":"sgv","sgv":103,"dateString":"2024-11-20T12:00:00Z"}]}`,
+		"ns-month/2024-11-treatments.json": `[{"_id":"note","eventType":"Note","created_at":"2024-11-20T12:00:00Z"}]`,
+		"ns-day/2024-11-19.json":           `[{"_id":"intact","type":"sgv","sgv":101,"dateString":"2024-11-19T12:00:00Z"}]`,
+		"ns-day/2024-11-20.json":           `[{"_id":"corr`,
+	} {
+		assert.NoError(t, bs.Upload(ctx, name, strings.NewReader(body)))
+	}
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	r := NewBucketRestorer(bs)
+	r.DryRun = true
+	days, err := r.RestoreDays(ctx, from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, []RestoredDay{
+		{Name: "ns-day/2024-03-05.json", Items: 1, Was: "missing"},
+		{Name: "ns-day/2024-11-20.json", Items: 1, Was: "corrupt"},
+		{Name: "ns-day/2024-11-20-treatments.json", Items: 1, Was: "missing"},
+	}, days)
+	exists, err := bs.Bucket.Exists(ctx, "ns-day/2024-03-05.json")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	r.DryRun = false
+	r.Overwrite = true
+	days, err = r.RestoreDays(ctx, from, to)
+	assert.NoError(t, err)
+	assert.Contains(t, days, RestoredDay{Name: "ns-day/2024-11-19.json", Items: 2, Was: "intact"})
+	assert.Equal(t, []string{"intact", "extra"}, dayFileOids(t, bs, "ns-day/2024-11-19.json"))
+	assert.Equal(t, []string{"corrupt"}, dayFileOids(t, bs, "ns-day/2024-11-20.json"))
+	assert.Equal(t, []string{"march"}, dayFileOids(t, bs, "ns-day/2024-03-05.json"))
+	assert.Equal(t, []string{"note"}, dayFileOids(t, bs, "ns-day/2024-11-20-treatments.json"))
+}
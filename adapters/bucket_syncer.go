@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// BucketSyncer rewrites the current day, month and year files from memory on
+// demand, eg before planned maintenance or once bucket credentials have been
+// fixed
+type BucketSyncer struct {
+	EntryRepository     *BucketEntryRepository
+	TreatmentRepository *BucketTreatmentRepository
+}
+
+func NewBucketSyncer(entries *BucketEntryRepository, treatments *BucketTreatmentRepository) *BucketSyncer {
+	return &BucketSyncer{
+		EntryRepository:     entries,
+		TreatmentRepository: treatments,
+	}
+}
+
+// SyncAll syncs entries and treatments, returning an error if any upload
+// failed. Failed uploads are still retried in the background.
+func (s BucketSyncer) SyncAll(ctx context.Context) error {
+	var errs []error
+	err := s.EntryRepository.SyncAll(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("cannot sync entries: %w", err))
+	}
+	err = s.TreatmentRepository.SyncAll(ctx)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("cannot sync treatments: %w", err))
+	}
+	return errors.Join(errs...)
+}
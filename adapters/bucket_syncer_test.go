@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestSyncAll(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &flakyBucketStore{BucketStore: &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}}
+	syncer := NewBucketSyncer(NewBucketEntryRepository(bs), NewBucketTreatmentRepository(bs))
+	today := time.Now()
+
+	// nothing is dirty, but the files are written anyway
+	assert.NoError(t, syncer.SyncAll(ctx))
+	for _, name := range []string{
+		"ns-day/" + today.Format("2006-01-02") + ".json",
+		"ns-month/" + today.Format("2006-01") + ".json",
+		"ns-year/" + today.Format("2006") + ".json",
+		"ns-day/" + today.Format("2006-01-02") + "-treatments.json",
+	} {
+		exists, err := bs.Bucket.Exists(ctx, name)
+		assert.NoError(t, err)
+		assert.True(t, exists, name)
+	}
+
+	bs.failing = true
+	syncer.EntryRepository.uploads.running = true // retry by hand rather than in the background
+	syncer.TreatmentRepository.uploads.running = true
+	err := syncer.SyncAll(ctx)
+	assert.ErrorContains(t, err, "cannot sync entries: 3 uploads still failing")
+	assert.ErrorContains(t, err, "cannot sync treatments: 3 uploads still failing")
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/adamlounds/nightscout-go/stores/cgmdexcomshare"
+	"time"
+)
+
+type DexcomShareConfig struct {
+	Region        string
+	Password      string
+	Username      string
+	FetchInterval time.Duration
+}
+
+type DexcomShareStore interface {
+	FetchRecent(ctx context.Context, lastSeen time.Time) ([]models.Entry, error)
+	ErrorIsAuthnFailed(error) bool
+}
+
+type CGMDexcomShareRepository struct {
+	config DexcomShareConfig
+	store  DexcomShareStore
+}
+
+func NewCGMDexcomShareRepository(cfg DexcomShareConfig) *CGMDexcomShareRepository {
+	store := cgmdexcomshare.New(&cgmdexcomshare.DexcomShareConfig{
+		Username: cfg.Username,
+		Password: cfg.Password,
+		Region:   cfg.Region,
+	})
+	return &CGMDexcomShareRepository{
+		config: cfg,
+		store:  store,
+	}
+}
+
+func (r *CGMDexcomShareRepository) IsConfigured() bool {
+	return r.config.Password != "" && r.config.Username != ""
+}
+
+func (r *CGMDexcomShareRepository) FetchRecent(ctx context.Context, lastSeen time.Time) ([]models.Entry, error) {
+	return r.store.FetchRecent(ctx, lastSeen)
+}
+
+func (r *CGMDexcomShareRepository) ErrorIsAuthnFailed(err error) bool {
+	return r.store.ErrorIsAuthnFailed(err)
+}
+
+// CGMConnections is always empty, a Dexcom Share account publishes a single
+// patient's readings
+func (r *CGMDexcomShareRepository) CGMConnections(ctx context.Context) []models.CGMConnection {
+	return []models.CGMConnection{}
+}
+
+// ActiveSensor is always nil, Dexcom Share does not report sensor details
+func (r *CGMDexcomShareRepository) ActiveSensor() *models.Sensor {
+	return nil
+}
+
+// FetchInterval is how often to poll when we cannot predict the next reading,
+// and, if longer than the reading interval, the least time between polls
+// once we can (see nextPoll)
+func (r *CGMDexcomShareRepository) FetchInterval() time.Duration {
+	if r.config.FetchInterval == 0 {
+		return time.Minute
+	}
+	return r.config.FetchInterval
+}
+
+// ReadingInterval is how often dexcom sensors produce a reading
+func (r *CGMDexcomShareRepository) ReadingInterval() time.Duration {
+	return 5 * time.Minute
+}
+
+// LatestReading is always nil, Dexcom Share readings are not smoothed so the
+// entries themselves are high-resolution
+func (r *CGMDexcomShareRepository) LatestReading() *models.Entry {
+	return nil
+}
@@ -11,11 +11,18 @@ type LLUConfig struct {
 	Region        string
 	Password      string
 	Username      string
+	PatientID     string
+	Location      *time.Location
+	Archiver      cgmlibrelinkup.Archiver
+	ArchiveLimit  int
 	FetchInterval time.Duration
 }
 
 type LLUStore interface {
 	FetchRecent(ctx context.Context, lastSeen time.Time) ([]models.Entry, error)
+	AvailableConnections() []cgmlibrelinkup.Connection
+	ActiveSensor() *models.Sensor
+	LatestReading() *models.Entry
 	ErrorIsAuthnFailed(error) bool
 }
 
@@ -26,9 +33,13 @@ type CGMLibrelinkupRepository struct {
 
 func NewCGMLibrelinkupRepository(cfg LLUConfig) *CGMLibrelinkupRepository {
 	store := cgmlibrelinkup.New(&cgmlibrelinkup.LLUConfig{
-		Username: cfg.Username,
-		Password: cfg.Password,
-		Region:   cfg.Region,
+		Username:     cfg.Username,
+		Password:     cfg.Password,
+		Region:       cfg.Region,
+		PatientID:    cfg.PatientID,
+		Location:     cfg.Location,
+		Archiver:     cfg.Archiver,
+		ArchiveLimit: cfg.ArchiveLimit,
 	})
 	return &CGMLibrelinkupRepository{
 		config: cfg,
@@ -47,3 +58,44 @@ func (r *CGMLibrelinkupRepository) FetchRecent(ctx context.Context, lastSeen tim
 func (r *CGMLibrelinkupRepository) ErrorIsAuthnFailed(err error) bool {
 	return r.store.ErrorIsAuthnFailed(err)
 }
+
+// CGMConnections lists the patients the account can follow, as of the last
+// login. Accounts following several patients should set LINK_UP_PATIENT_ID.
+func (r *CGMLibrelinkupRepository) CGMConnections(ctx context.Context) []models.CGMConnection {
+	available := r.store.AvailableConnections()
+	connections := make([]models.CGMConnection, len(available))
+	for i, c := range available {
+		connections[i] = models.CGMConnection{
+			PatientID: c.PatientID,
+			Name:      c.FirstName + " " + c.LastName,
+			Selected:  c.Selected,
+		}
+	}
+	return connections
+}
+
+// ActiveSensor returns the sensor seen in the most recent fetch, or nil
+func (r *CGMLibrelinkupRepository) ActiveSensor() *models.Sensor {
+	return r.store.ActiveSensor()
+}
+
+// FetchInterval is how often to poll when we cannot predict the next reading,
+// and, if longer than the reading interval, the least time between polls
+// once we can (see nextPoll)
+func (r *CGMLibrelinkupRepository) FetchInterval() time.Duration {
+	if r.config.FetchInterval == 0 {
+		return time.Minute
+	}
+	return r.config.FetchInterval
+}
+
+// ReadingInterval is how often llu makes a new (latest) reading available
+func (r *CGMLibrelinkupRepository) ReadingInterval() time.Duration {
+	return time.Minute
+}
+
+// LatestReading returns the raw 1-minute reading from the last fetch. Older
+// readings are only available smoothed, at 15-minute intervals.
+func (r *CGMLibrelinkupRepository) LatestReading() *models.Entry {
+	return r.store.LatestReading()
+}
@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"io"
+)
+
+// getCompressed fetches the object stored as name, however it was
+// compressed. The configured compression is tried first so objects written
+// since compression was changed take precedence over older copies.
+func getCompressed(ctx context.Context, bs BucketStoreInterface, c bucketstore.Compression, name string) (io.ReadCloser, error) {
+	var err error
+	for _, n := range c.Names(name) {
+		var r io.ReadCloser
+		r, err = bs.Get(ctx, n)
+		if err == nil {
+			return bucketstore.Decompress(n, r)
+		}
+		if !bs.IsObjNotFoundErr(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// uploadCompressed compresses b and uploads it, returning the compressed size
+func uploadCompressed(ctx context.Context, bs BucketStoreInterface, c bucketstore.Compression, name string, b []byte) (int, error) {
+	compressed, err := c.Compress(b)
+	if err != nil {
+		return 0, fmt.Errorf("cannot compress %s: %w", name, err)
+	}
+	err = bs.Upload(ctx, c.Name(name), bytes.NewReader(compressed))
+	if err != nil {
+		return 0, err
+	}
+	return len(compressed), nil
+}
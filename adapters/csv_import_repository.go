@@ -0,0 +1,25 @@
+package repository
+
+import (
+	"context"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/adamlounds/nightscout-go/stores/csvimport"
+	"io"
+	"time"
+)
+
+var ErrUnknownCSVFormat = csvimport.ErrUnknownFormat
+
+// CSVImportRepository reads cgm readings from Dexcom Clarity and LibreView
+// csv exports
+type CSVImportRepository struct{}
+
+func NewCSVImportRepository() *CSVImportRepository {
+	return &CSVImportRepository{}
+}
+
+// ParseCSVEntries returns the detected export format and its readings,
+// oldest first. Export times are local, recorded in loc.
+func (c *CSVImportRepository) ParseCSVEntries(ctx context.Context, r io.Reader, loc *time.Location) (string, []models.Entry, error) {
+	return csvimport.ParseEntries(r, loc)
+}
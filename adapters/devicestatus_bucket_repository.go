@@ -0,0 +1,206 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// BucketDeviceStatusRepository keeps device status reports in
+// ns-devicestatus/<day>.json. Closed-loop systems upload every few minutes
+// and only recent statuses are interesting, so only the days we have touched
+// are held in memory.
+type BucketDeviceStatusRepository struct {
+	BucketStore BucketStoreInterface
+	days        map[string][]models.DeviceStatus // day => statuses, oldest first
+	daysLock    sync.Mutex
+}
+
+func NewBucketDeviceStatusRepository(bs BucketStoreInterface) *BucketDeviceStatusRepository {
+	return &BucketDeviceStatusRepository{
+		BucketStore: bs,
+		days:        make(map[string][]models.DeviceStatus),
+	}
+}
+
+// Boot fetches yesterday's and today's statuses into memory
+func (p *BucketDeviceStatusRepository) Boot(ctx context.Context) error {
+	log := slogctx.FromCtx(ctx)
+	p.daysLock.Lock()
+	defer p.daysLock.Unlock()
+
+	now := time.Now().UTC()
+	numStatuses := 0
+	for _, t := range []time.Time{now.AddDate(0, 0, -1), now} {
+		statuses, err := p.loadDay(ctx, t.Format("2006-01-02"))
+		if err != nil {
+			return err
+		}
+		numStatuses += len(statuses)
+	}
+	log.Info("boot: recent device statuses loaded", slog.Int("numDeviceStatuses", numStatuses))
+	return nil
+}
+
+// FetchLatestDeviceStatuses returns up to maxStatuses statuses at or before
+// maxTime, most recent first. Only statuses on days held in memory are
+// considered.
+func (p *BucketDeviceStatusRepository) FetchLatestDeviceStatuses(ctx context.Context, maxTime time.Time, maxStatuses int) ([]models.DeviceStatus, error) {
+	p.daysLock.Lock()
+	defer p.daysLock.Unlock()
+
+	days := make([]string, 0, len(p.days))
+	for day := range p.days {
+		days = append(days, day)
+	}
+	slices.Sort(days)
+
+	var statuses []models.DeviceStatus
+	for i := len(days) - 1; i >= 0 && len(statuses) < maxStatuses; i-- {
+		dayStatuses := p.days[days[i]]
+		for j := len(dayStatuses) - 1; j >= 0 && len(statuses) < maxStatuses; j-- {
+			if dayStatuses[j].Time.After(maxTime) {
+				continue
+			}
+			statuses = append(statuses, dayStatuses[j])
+		}
+	}
+	return statuses, nil
+}
+
+// CreateDeviceStatuses stores new statuses, re-writing each affected day
+// file. Statuses we already have (by oid) are skipped.
+func (p *BucketDeviceStatusRepository) CreateDeviceStatuses(ctx context.Context, statuses []models.DeviceStatus) ([]models.DeviceStatus, error) {
+	now := time.Now()
+	p.daysLock.Lock()
+	defer p.daysLock.Unlock()
+
+	var created []models.DeviceStatus
+	dirtyDays := make(map[string]struct{})
+	for _, s := range statuses {
+		if s.Time.IsZero() {
+			s.Time = now
+		}
+		day := s.Time.UTC().Format("2006-01-02")
+		dayStatuses, err := p.loadDay(ctx, day)
+		if err != nil {
+			return created, err
+		}
+		if s.ID == "" {
+			s.ID = newOid(now)
+		} else if slices.ContainsFunc(dayStatuses, func(e models.DeviceStatus) bool { return e.ID == s.ID }) {
+			continue
+		}
+		delete(s.Fields, "_id")
+		delete(s.Fields, "created_at")
+		delete(s.Fields, "device")
+		p.days[day] = append(dayStatuses, s)
+		dirtyDays[day] = struct{}{}
+		created = append(created, s)
+	}
+
+	for day := range dirtyDays {
+		slices.SortStableFunc(p.days[day], func(a, b models.DeviceStatus) int {
+			return a.Time.Compare(b.Time)
+		})
+		err := p.writeDay(ctx, day)
+		if err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// loadDay returns statuses for the given day, fetching them from the bucket
+// if we have not seen that day yet. Callers must hold daysLock.
+func (p *BucketDeviceStatusRepository) loadDay(ctx context.Context, day string) ([]models.DeviceStatus, error) {
+	log := slogctx.FromCtx(ctx)
+	if statuses, ok := p.days[day]; ok {
+		return statuses, nil
+	}
+
+	name := fmt.Sprintf("ns-devicestatus/%s.json", day)
+	r, err := p.BucketStore.Get(ctx, name)
+	if err != nil {
+		if p.BucketStore.IsObjNotFoundErr(err) {
+			p.days[day] = []models.DeviceStatus{}
+			return p.days[day], nil
+		}
+		return nil, fmt.Errorf("cannot fetch %s: %w", name, err)
+	}
+	defer r.Close()
+
+	var stored []map[string]interface{}
+	err = json.NewDecoder(r).Decode(&stored)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", name, err)
+	}
+
+	statuses := make([]models.DeviceStatus, 0, len(stored))
+	for _, d := range stored {
+		s, ok := deviceStatusFromDocument(d)
+		if !ok {
+			log.Warn("loadDay: skipping device status without _id or created_at", slog.Any("deviceStatus", d))
+			continue
+		}
+		statuses = append(statuses, s)
+	}
+	p.days[day] = statuses
+	return statuses, nil
+}
+
+// writeDay uploads the statuses for a day. Callers must hold daysLock.
+func (p *BucketDeviceStatusRepository) writeDay(ctx context.Context, day string) error {
+	statuses := p.days[day]
+	stored := make([]map[string]interface{}, len(statuses))
+	for i, s := range statuses {
+		stored[i] = deviceStatusDocument(s)
+	}
+	j, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("cannot marshal device statuses: %w", err)
+	}
+	name := fmt.Sprintf("ns-devicestatus/%s.json", day)
+	err = p.BucketStore.Upload(ctx, name, bytes.NewReader(j))
+	if err != nil {
+		return fmt.Errorf("cannot upload %s: %w", name, err)
+	}
+	return nil
+}
+
+func deviceStatusFromDocument(d map[string]interface{}) (models.DeviceStatus, bool) {
+	oid, _ := d["_id"].(string)
+	createdAt, _ := d["created_at"].(string)
+	t, err := time.Parse(time.RFC3339, createdAt)
+	if oid == "" || err != nil {
+		return models.DeviceStatus{}, false
+	}
+	device, _ := d["device"].(string)
+
+	fields := make(map[string]interface{}, len(d))
+	for k, v := range d {
+		fields[k] = v
+	}
+	delete(fields, "_id")
+	delete(fields, "created_at")
+	delete(fields, "device")
+	return models.DeviceStatus{ID: oid, Device: device, Time: t, Fields: fields}, true
+}
+
+func deviceStatusDocument(s models.DeviceStatus) map[string]interface{} {
+	d := make(map[string]interface{}, len(s.Fields)+3)
+	for k, v := range s.Fields {
+		d[k] = v
+	}
+	d["_id"] = s.ID
+	d["created_at"] = s.Time.UTC().Format(time.RFC3339)
+	d["device"] = s.Device
+	return d
+}
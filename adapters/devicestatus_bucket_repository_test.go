@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDeviceStatusRepository(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	day := recent.UTC().Format("2006-01-02")
+	stored := `[{"_id":"existing","created_at":"` + sameDay.UTC().Format("2006-01-02T15:04:05Z") + `","device":"loop://iPhone","uploader":{"battery":80}}]`
+	mockStore.On("Get", mock.Anything, "ns-devicestatus/"+day+".json").Return(io.NopCloser(strings.NewReader(stored)), nil).Once()
+	mockStore.On("Get", mock.Anything, mock.Anything).Return(io.NopCloser(strings.NewReader("")), errors.New("not found"))
+	mockStore.On("Upload", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	repo := NewBucketDeviceStatusRepository(mockStore)
+	ctx := contextWithSilentLogger()
+
+	created, err := repo.CreateDeviceStatuses(ctx, []models.DeviceStatus{
+		{ID: "existing", Device: "loop://iPhone", Time: sameDay},
+		{ID: "new", Device: "loop://iPhone", Time: recent, Fields: map[string]interface{}{"_id": "new", "uploader": map[string]interface{}{"battery": 79}}},
+		{ID: "future", Device: "loop://iPhone", Time: future},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, created, 2, "existing status skipped")
+	mockStore.AssertCalled(t, "Upload", mock.Anything, "ns-devicestatus/"+day+".json", mock.Anything)
+
+	statuses, err := repo.FetchLatestDeviceStatuses(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 2, "future status excluded")
+	assert.Equal(t, "new", statuses[0].ID)
+	assert.Equal(t, "existing", statuses[1].ID)
+	assert.NotContains(t, statuses[0].Fields, "_id")
+
+	statuses, _ = repo.FetchLatestDeviceStatuses(ctx, now, 1)
+	assert.Len(t, statuses, 1)
+}
@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"time"
+)
+
+// In dual-write mode entries and treatments are written to the bucket and to
+// postgres, so operators keep bucket archives while getting sql queryability.
+//
+// The bucket repository is the source of truth: it decides oids and which
+// entries are duplicates, and serves all reads from memory (faster than any
+// query). Whatever it stores is then written to postgres. Failed postgres
+// writes are logged but not returned to clients.
+
+// DualEntryRepository writes entries to both Primary and Secondary, reading
+// from Primary
+type DualEntryRepository struct {
+	EntryRepository
+	Secondary EntryRepository
+}
+
+func NewDualEntryRepository(primary, secondary EntryRepository) *DualEntryRepository {
+	return &DualEntryRepository{
+		EntryRepository: primary,
+		Secondary:       secondary,
+	}
+}
+
+// Boot boots both repositories. Only a primary failure is returned.
+func (p DualEntryRepository) Boot(ctx context.Context) error {
+	err := p.Secondary.Boot(ctx)
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("dual-write: cannot boot secondary entry repository", slog.Any("error", err))
+	}
+	return p.EntryRepository.Boot(ctx)
+}
+
+func (p DualEntryRepository) CreateEntries(ctx context.Context, entries []models.Entry) []models.Entry {
+	createdEntries := p.EntryRepository.CreateEntries(ctx, entries)
+	if len(createdEntries) == 0 {
+		return createdEntries
+	}
+	numWritten := len(p.Secondary.CreateEntries(ctx, createdEntries))
+	if numWritten != len(createdEntries) {
+		slogctx.FromCtx(ctx).Warn("dual-write: secondary did not store all entries",
+			slog.Int("numCreated", len(createdEntries)),
+			slog.Int("numWritten", numWritten),
+		)
+	}
+	return createdEntries
+}
+
+// PurgeEntries purges both repositories, returning how many entries the
+// primary purged
+func (p DualEntryRepository) PurgeEntries(ctx context.Context, from, to time.Time, device string) (int, error) {
+	numPurged, err := p.EntryRepository.PurgeEntries(ctx, from, to, device)
+	if err != nil {
+		return numPurged, err
+	}
+	_, err = p.Secondary.PurgeEntries(ctx, from, to, device)
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("dual-write: cannot purge secondary entries", slog.Any("error", err))
+	}
+	return numPurged, nil
+}
+
+// DualTreatmentRepository writes treatments to both Primary and Secondary,
+// reading from Primary
+type DualTreatmentRepository struct {
+	TreatmentRepository
+	Secondary TreatmentRepository
+}
+
+func NewDualTreatmentRepository(primary, secondary TreatmentRepository) *DualTreatmentRepository {
+	return &DualTreatmentRepository{
+		TreatmentRepository: primary,
+		Secondary:           secondary,
+	}
+}
+
+// Boot boots both repositories. Only a primary failure is returned.
+func (p DualTreatmentRepository) Boot(ctx context.Context) error {
+	err := p.Secondary.Boot(ctx)
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("dual-write: cannot boot secondary treatment repository", slog.Any("error", err))
+	}
+	return p.TreatmentRepository.Boot(ctx)
+}
+
+func (p DualTreatmentRepository) CreateTreatments(ctx context.Context, treatments []models.Treatment) []models.Treatment {
+	createdTreatments := p.TreatmentRepository.CreateTreatments(ctx, treatments)
+	if len(createdTreatments) == 0 {
+		return createdTreatments
+	}
+	numWritten := len(p.Secondary.CreateTreatments(ctx, createdTreatments))
+	if numWritten != len(createdTreatments) {
+		slogctx.FromCtx(ctx).Warn("dual-write: secondary did not store all treatments",
+			slog.Int("numCreated", len(createdTreatments)),
+			slog.Int("numWritten", numWritten),
+		)
+	}
+	return createdTreatments
+}
+
+func (p DualTreatmentRepository) UpdateTreatmentByOid(ctx context.Context, oid string, treatment *models.Treatment) error {
+	err := p.TreatmentRepository.UpdateTreatmentByOid(ctx, oid, treatment)
+	if err != nil {
+		return err
+	}
+
+	err = p.Secondary.UpdateTreatmentByOid(ctx, oid, treatment)
+	if errors.Is(err, models.ErrNotFound) {
+		// eg created before dual-write was enabled
+		treatment.ID = oid
+		p.Secondary.CreateTreatments(ctx, []models.Treatment{*treatment})
+		return nil
+	}
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("dual-write: cannot update secondary treatment", slog.String("oid", oid), slog.Any("error", err))
+	}
+	return nil
+}
+
+func (p DualTreatmentRepository) DeleteTreatmentByOid(ctx context.Context, oid string) error {
+	err := p.TreatmentRepository.DeleteTreatmentByOid(ctx, oid)
+	if err != nil {
+		return err
+	}
+
+	err = p.Secondary.DeleteTreatmentByOid(ctx, oid)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		slogctx.FromCtx(ctx).Warn("dual-write: cannot delete secondary treatment", slog.String("oid", oid), slog.Any("error", err))
+	}
+	return nil
+}
+
+// PurgeTreatments purges both repositories, returning how many treatments the
+// primary purged
+func (p DualTreatmentRepository) PurgeTreatments(ctx context.Context, from, to time.Time) (int, error) {
+	numPurged, err := p.TreatmentRepository.PurgeTreatments(ctx, from, to)
+	if err != nil {
+		return numPurged, err
+	}
+	_, err = p.Secondary.PurgeTreatments(ctx, from, to)
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("dual-write: cannot purge secondary treatments", slog.Any("error", err))
+	}
+	return numPurged, nil
+}
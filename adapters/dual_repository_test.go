@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEntryRepository records created entries. Unimplemented methods panic.
+type fakeEntryRepository struct {
+	EntryRepository
+	bootErr error
+	created []models.Entry
+}
+
+func (f *fakeEntryRepository) Boot(ctx context.Context) error { return f.bootErr }
+
+func (f *fakeEntryRepository) CreateEntries(ctx context.Context, entries []models.Entry) []models.Entry {
+	var created []models.Entry
+	for _, e := range entries {
+		if e.Oid == "" {
+			e.Oid = "generated"
+		}
+		if e.SgvMgdl == 0 {
+			continue // stands in for a duplicate
+		}
+		created = append(created, e)
+	}
+	f.created = append(f.created, created...)
+	return created
+}
+
+type fakeTreatmentRepository struct {
+	TreatmentRepository
+	treatments map[string]models.Treatment
+}
+
+func (f *fakeTreatmentRepository) CreateTreatments(ctx context.Context, treatments []models.Treatment) []models.Treatment {
+	for _, t := range treatments {
+		f.treatments[t.ID] = t
+	}
+	return treatments
+}
+
+func (f *fakeTreatmentRepository) UpdateTreatmentByOid(ctx context.Context, oid string, treatment *models.Treatment) error {
+	if _, ok := f.treatments[oid]; !ok {
+		return models.ErrNotFound
+	}
+	f.treatments[oid] = *treatment
+	return nil
+}
+
+func (f *fakeTreatmentRepository) DeleteTreatmentByOid(ctx context.Context, oid string) error {
+	if _, ok := f.treatments[oid]; !ok {
+		return models.ErrNotFound
+	}
+	delete(f.treatments, oid)
+	return nil
+}
+
+func TestDualEntryRepository(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	primary := &fakeEntryRepository{}
+	secondary := &fakeEntryRepository{bootErr: errors.New("connection refused")}
+	repo := NewDualEntryRepository(primary, secondary)
+
+	// secondary failures do not stop us booting
+	assert.NoError(t, repo.Boot(ctx))
+
+	created := repo.CreateEntries(ctx, []models.Entry{{SgvMgdl: 100, Time: recent}, {Oid: "dupe", Time: recent}})
+	assert.Equal(t, []models.Entry{{Oid: "generated", SgvMgdl: 100, Time: recent}}, created)
+	// the secondary gets the primary's oids, and not the duplicate
+	assert.Equal(t, created, secondary.created)
+}
+
+func TestDualTreatmentRepository(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	primary := &fakeTreatmentRepository{treatments: map[string]models.Treatment{"old": {ID: "old", Type: "Note"}}}
+	secondary := &fakeTreatmentRepository{treatments: map[string]models.Treatment{}}
+	repo := NewDualTreatmentRepository(primary, secondary)
+
+	repo.CreateTreatments(ctx, []models.Treatment{{ID: "new", Type: "Carbs", Time: recent}})
+	assert.Contains(t, secondary.treatments, "new")
+
+	// updates to treatments the secondary has never seen create them
+	assert.NoError(t, repo.UpdateTreatmentByOid(ctx, "old", &models.Treatment{Type: "Announcement", Time: recent}))
+	assert.Equal(t, models.Treatment{ID: "old", Type: "Announcement", Time: recent}, secondary.treatments["old"])
+
+	assert.NoError(t, repo.DeleteTreatmentByOid(ctx, "new"))
+	assert.NotContains(t, secondary.treatments, "new")
+	assert.ErrorIs(t, repo.DeleteTreatmentByOid(ctx, "missing"), models.ErrNotFound)
+}
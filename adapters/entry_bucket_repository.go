@@ -1,16 +1,16 @@
 package repository
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
 	slogctx "github.com/veqryn/slog-context"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"io"
 	"log/slog"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -29,23 +29,97 @@ import (
 type memEntry struct {
 	EventTime   time.Time
 	CreatedTime time.Time
-	Oid         string
+	Oid         string // the stored id, see IDStrategy
 	Type        string
 	Trend       string
 	SgvMgdl     int
 	DeviceID    int
+	UtcOffset   int // minutes
 }
 
+// memStore is read far more often than it is written, so readers share
+// entriesLock and only writers (adding, sorting, purging, evicting) take it
+// exclusively. deviceNames and deviceIDsByName only change while entriesLock
+// is held for writing, so readers need not also take deviceNamesLock.
+//
+// Locks are taken in the order dirtyLock, entriesLock, deviceNamesLock,
+// indexLock. Sync holds dirtyLock while uploading, taking entriesLock for
+// reading only while it copies out the entries it needs.
 type memStore struct {
 	deviceNames     []string
 	deviceIDsByName map[string]int
 	dirtyYears      map[int]struct{} // new memEntry outside of this month: update year file
 	entries         []memEntry
-	entriesLock     sync.Mutex
+	oids            oidIndex  // position in entries, see FetchEntryByOid
+	types           typeIndex // positions in entries by type, see FetchLatestSGVs
+	entriesLock     sync.RWMutex
 	deviceNamesLock sync.Mutex
+	indexLock       sync.Mutex // indexes are built lazily, by readers
 	dirtyLock       sync.Mutex
-	dirtyDay        bool // new memEntry today = update day file
-	dirtyMonth      bool // new memEntry this month (but not today): update month
+	dirtyDay        bool       // new memEntry today = update day file
+	dirtyMonth      bool       // new memEntry this month (but not today): update month
+	unsyncedDay     []memEntry // append mode: new entries not yet in a day chunk
+	chunkDay        string     // append mode: the day we are writing chunks for
+	heldFrom        time.Time  // all entries from here on are held, see FetchEntriesBetween
+}
+
+// typeIndex lists the positions of each type of entry, so eg the latest sgvs
+// can be found without skipping past mbg and cal entries. Like oidIndex, it
+// is built on first use, kept current by add and reset when entries move.
+type typeIndex map[string][]int
+
+// lookup returns the positions of entries of type typ, in order, where
+// typeAt returns the type of the entry at position i
+func (idx *typeIndex) lookup(n int, typeAt func(i int) string, typ string) []int {
+	if *idx == nil {
+		*idx = make(typeIndex)
+		for i := 0; i < n; i++ {
+			(*idx)[typeAt(i)] = append((*idx)[typeAt(i)], i)
+		}
+	}
+	return (*idx)[typ]
+}
+
+// add records that an entry of type typ has been appended at position i
+func (idx *typeIndex) add(typ string, i int) {
+	if *idx != nil {
+		(*idx)[typ] = append((*idx)[typ], i)
+	}
+}
+
+func (idx *typeIndex) reset() {
+	*idx = nil
+}
+
+// indexLast adds the last entry to the indexes. Callers must hold entriesLock
+// for writing.
+func (m *memStore) indexLast() {
+	i := len(m.entries) - 1
+	m.oids.add(m.entries[i].Oid, i)
+	m.types.add(m.entries[i].Type, i)
+}
+
+// resetIndexes must be called after entries are sorted or removed. Callers
+// must hold entriesLock for writing.
+func (m *memStore) resetIndexes() {
+	m.oids.reset()
+	m.types.reset()
+}
+
+// positionsOfType returns the positions of entries of type typ, in event time
+// order. Callers must hold entriesLock, for reading at least.
+func (m *memStore) positionsOfType(typ string) []int {
+	m.indexLock.Lock()
+	defer m.indexLock.Unlock()
+	return m.types.lookup(len(m.entries), func(i int) string { return m.entries[i].Type }, typ)
+}
+
+// positionOfOid returns the position of the entry with oid. Callers must hold
+// entriesLock, for reading at least.
+func (m *memStore) positionOfOid(oid string) (int, bool) {
+	m.indexLock.Lock()
+	defer m.indexLock.Unlock()
+	return m.oids.lookup(len(m.entries), func(i int) string { return m.entries[i].Oid }, oid)
 }
 
 type BucketStoreInterface interface {
@@ -56,8 +130,20 @@ type BucketStoreInterface interface {
 }
 
 type BucketEntryRepository struct {
-	BucketStore BucketStoreInterface
-	memStore    *memStore
+	BucketStore    BucketStoreInterface
+	IDStrategy     IDStrategy // ids entries are held and stored under
+	Compression    bucketstore.Compression
+	ParquetYears   bool       // also write year files as parquet, for analysis
+	AppendDays     bool       // write new entries as day chunks, see appendDayChunk
+	HistoryYears   int        // archived years kept in memory after a date range query
+	MemoryDays     int        // evict entries older than this, see EvictEntries. 0 keeps everything
+	CheckConflicts bool       // merge files written by other instances, see reconcileEntries
+	Lease          *SyncLease // only sync while holding the lease, if set
+	memStore       *memStore
+	history        *entryHistory
+	uploads        *uploadRetryQueue
+	syncs          *syncTracker    // in-progress syncToBucket calls
+	versions       *objectVersions // files as last read or written
 }
 
 func NewBucketEntryRepository(bs BucketStoreInterface) *BucketEntryRepository {
@@ -68,7 +154,22 @@ func NewBucketEntryRepository(bs BucketStoreInterface) *BucketEntryRepository {
 		},
 		dirtyYears: make(map[int]struct{}),
 	}
-	return &BucketEntryRepository{bs, m}
+	return &BucketEntryRepository{
+		BucketStore:  bs,
+		IDStrategy:   objectIDStrategy{},
+		HistoryYears: 2,
+		memStore:     m,
+		history:      &entryHistory{},
+		uploads:      newUploadRetryQueue(bs, &m.dirtyLock),
+		syncs:        &syncTracker{},
+		versions:     newObjectVersions(),
+	}
+}
+
+// SetAdminNotifies shows uploads to the bucket that keep failing in the
+// admin notifies panel
+func (p *BucketEntryRepository) SetAdminNotifies(n *models.AdminNotifies) {
+	p.uploads.setAdminNotifies(n)
 }
 
 // Boot fetches common data into memory, typically at server startup
@@ -77,6 +178,9 @@ func (p BucketEntryRepository) Boot(ctx context.Context) error {
 
 	// loading files in order means we don't have to sort afterwards.
 	now := time.Now()
+	p.memStore.entriesLock.Lock()
+	p.memStore.heldFrom = time.Date(now.Year()-1, time.January, 1, 0, 0, 0, 0, time.UTC)
+	p.memStore.entriesLock.Unlock()
 	entryFiles := []string{
 		fmt.Sprintf("ns-year/%d.json", now.Year()-1),            // last year
 		fmt.Sprintf("ns-year/%d.json", now.Year()),              // year to date excl month
@@ -107,6 +211,13 @@ func (p BucketEntryRepository) Boot(ctx context.Context) error {
 		}
 	}
 
+	if p.AppendDays {
+		err := p.fetchDayChunks(ctx, now)
+		if err != nil {
+			log.Warn("boot: cannot fetch day chunks", slog.Any("err", err))
+		}
+	}
+
 	var mostRecentTime time.Time
 	if len(p.memStore.entries) > 0 {
 		mostRecentTime = p.memStore.entries[len(p.memStore.entries)-1].EventTime
@@ -122,7 +233,7 @@ func (p BucketEntryRepository) Boot(ctx context.Context) error {
 func (p BucketEntryRepository) fetchEntries(ctx context.Context, file string) error {
 	log := slogctx.FromCtx(ctx)
 	t1 := time.Now()
-	r, err := p.BucketStore.Get(ctx, file)
+	r, err := getCompressed(ctx, p.BucketStore, p.Compression, file)
 	log.Debug("fetched from s3",
 		slog.String("file", file),
 		slog.Int64("duration_ms", time.Since(t1).Milliseconds()),
@@ -131,9 +242,14 @@ func (p BucketEntryRepository) fetchEntries(ctx context.Context, file string) er
 		return err
 	}
 	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p.versions.set(file, b)
 
 	var result []storedEntry
-	err = json.NewDecoder(r).Decode(&result)
+	err = unmarshalStored(b, &result)
 	if err != nil {
 		return err
 	}
@@ -143,10 +259,22 @@ func (p BucketEntryRepository) fetchEntries(ctx context.Context, file string) er
 	// Time:time.Date(2024, time.November, 21, 10, 29, 48, 0, time.UTC),
 	// CreatedTime:time.Date(2024, time.November, 21, 12, 18, 24, 942444000, time.UTC)}}
 
+	p.addStoredEntries(result)
+	return nil
+}
+
+// addStoredEntries appends entries read from the bucket to the memstore
+func (p BucketEntryRepository) addStoredEntries(result []storedEntry) {
 	p.memStore.entriesLock.Lock()
 	defer p.memStore.entriesLock.Unlock()
 	p.memStore.deviceNamesLock.Lock()
 	defer p.memStore.deviceNamesLock.Unlock()
+	p.appendStoredEntries(result)
+}
+
+// appendStoredEntries appends entries read from the bucket to the memstore.
+// Callers must hold entriesLock and deviceNamesLock.
+func (p BucketEntryRepository) appendStoredEntries(result []storedEntry) {
 	for _, e := range result {
 		deviceID, ok := p.memStore.deviceIDsByName[e.Device]
 		if !ok {
@@ -157,27 +285,64 @@ func (p BucketEntryRepository) fetchEntries(ctx context.Context, file string) er
 		p.memStore.entries = append(p.memStore.entries, memEntry{
 			EventTime:   e.Time,
 			CreatedTime: e.CreatedTime,
-			Oid:         e.Oid,
+			Oid:         p.IDStrategy.StoredID(e.Oid),
 			Type:        e.Type,
 			Trend:       e.Direction,
 			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
 			DeviceID:    deviceID,
 		})
+		p.memStore.indexLast()
 	}
-	return nil
 }
 
 func (p BucketEntryRepository) FetchEntryByOid(ctx context.Context, oid string) (*models.Entry, error) {
+	p.memStore.entriesLock.RLock()
+	defer p.memStore.entriesLock.RUnlock()
+	i, ok := p.memStore.positionOfOid(p.IDStrategy.StoredID(oid))
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	e := p.memStore.entries[i]
+	return &models.Entry{
+		Oid:         oidOf(e.Oid),
+		Type:        e.Type,
+		SgvMgdl:     e.SgvMgdl,
+		UtcOffset:   e.UtcOffset,
+		Direction:   e.Trend,
+		Device:      p.memStore.deviceNames[e.DeviceID],
+		Time:        e.EventTime,
+		CreatedTime: e.CreatedTime,
+	}, nil
+}
 
-	for i := len(p.memStore.entries) - 1; i >= 0; i-- {
-		e := p.memStore.entries[i]
-		if e.Oid != oid {
+// FetchMatchingEntry returns a stored entry with the same time, device, type and sgv
+// as the given entry. Used to make uploads idempotent: uploaders retry on
+// timeouts and re-send readings we already have.
+func (p BucketEntryRepository) FetchMatchingEntry(ctx context.Context, entry models.Entry) (*models.Entry, error) {
+	p.memStore.entriesLock.RLock()
+	defer p.memStore.entriesLock.RUnlock()
+
+	deviceID, ok := p.memStore.deviceIDsByName[entry.Device]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+
+	entries := p.memStore.entries
+	i, _ := slices.BinarySearchFunc(entries, entry.Time, func(e memEntry, t time.Time) int {
+		return e.EventTime.Compare(t)
+	})
+	entryType := entryTypeOrSgv(entry.Type)
+	for ; i < len(entries) && entries[i].EventTime.Equal(entry.Time); i++ {
+		e := entries[i]
+		if e.DeviceID != deviceID || e.Type != entryType || e.SgvMgdl != entry.SgvMgdl {
 			continue
 		}
 		return &models.Entry{
-			Oid:         e.Oid,
+			Oid:         oidOf(e.Oid),
 			Type:        e.Type,
 			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
 			Direction:   e.Trend,
 			Device:      p.memStore.deviceNames[e.DeviceID],
 			Time:        e.EventTime,
@@ -188,22 +353,55 @@ func (p BucketEntryRepository) FetchEntryByOid(ctx context.Context, oid string)
 }
 
 func (p BucketEntryRepository) FetchLatestSgvEntry(ctx context.Context, maxTime time.Time) (*models.Entry, error) {
+	p.memStore.entriesLock.RLock()
+	defer p.memStore.entriesLock.RUnlock()
 
 	// nb (unexpected?) future entries are excluded
-	for i := len(p.memStore.entries) - 1; i >= 0; i-- {
-		e := p.memStore.entries[i]
-		if e.Type != "sgv" {
+	sgvs := p.memStore.positionsOfType("sgv")
+	for j := len(sgvs) - 1; j >= 0; j-- {
+		e := p.memStore.entries[sgvs[j]]
+		if e.EventTime.After(maxTime) {
 			continue
 		}
+		return &models.Entry{
+			Oid:         oidOf(e.Oid),
+			Type:        e.Type,
+			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
+			Direction:   e.Trend,
+			Device:      p.memStore.deviceNames[e.DeviceID],
+			Time:        e.EventTime,
+			CreatedTime: e.CreatedTime,
+		}, nil
+	}
+
+	return nil, models.ErrNotFound
+}
+
+// FetchLatestSgvEntryForDevice returns the latest sgv entry from a device
+// whose name starts with devicePrefix, eg "llu ingestor"
+func (p BucketEntryRepository) FetchLatestSgvEntryForDevice(ctx context.Context, maxTime time.Time, devicePrefix string) (*models.Entry, error) {
+	p.memStore.entriesLock.RLock()
+	defer p.memStore.entriesLock.RUnlock()
+
+	// nb (unexpected?) future entries are excluded
+	sgvs := p.memStore.positionsOfType("sgv")
+	for j := len(sgvs) - 1; j >= 0; j-- {
+		e := p.memStore.entries[sgvs[j]]
 		if e.EventTime.After(maxTime) {
 			continue
 		}
+		device := p.memStore.deviceNames[e.DeviceID]
+		if !strings.HasPrefix(device, devicePrefix) {
+			continue
+		}
 		return &models.Entry{
-			Oid:         e.Oid,
+			Oid:         oidOf(e.Oid),
 			Type:        e.Type,
 			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
 			Direction:   e.Trend,
-			Device:      p.memStore.deviceNames[e.DeviceID],
+			Device:      device,
 			Time:        e.EventTime,
 			CreatedTime: e.CreatedTime,
 		}, nil
@@ -213,6 +411,8 @@ func (p BucketEntryRepository) FetchLatestSgvEntry(ctx context.Context, maxTime
 }
 
 func (p BucketEntryRepository) FetchLatestEntries(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+	p.memStore.entriesLock.RLock()
+	defer p.memStore.entriesLock.RUnlock()
 
 	// nb (unexpected?) future entries are excluded
 	var entries []models.Entry
@@ -223,9 +423,10 @@ func (p BucketEntryRepository) FetchLatestEntries(ctx context.Context, maxTime t
 			continue
 		}
 		entries = append(entries, models.Entry{
-			Oid:         e.Oid,
+			Oid:         oidOf(e.Oid),
 			Type:        e.Type,
 			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
 			Direction:   e.Trend,
 			Device:      p.memStore.deviceNames[e.DeviceID],
 			Time:        e.EventTime,
@@ -239,22 +440,23 @@ func (p BucketEntryRepository) FetchLatestEntries(ctx context.Context, maxTime t
 }
 
 func (p BucketEntryRepository) FetchLatestSGVs(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+	p.memStore.entriesLock.RLock()
+	defer p.memStore.entriesLock.RUnlock()
 
 	// nb (unexpected?) future entries are excluded
 	var entries []models.Entry
-	for i := len(p.memStore.entries) - 1; i >= 0; i-- {
-		e := p.memStore.entries[i]
+	sgvs := p.memStore.positionsOfType("sgv")
+	for j := len(sgvs) - 1; j >= 0; j-- {
+		e := p.memStore.entries[sgvs[j]]
 
 		if e.EventTime.After(maxTime) {
 			continue
 		}
-		if e.Type != "sgv" {
-			continue
-		}
 		entries = append(entries, models.Entry{
-			Oid:         e.Oid,
+			Oid:         oidOf(e.Oid),
 			Type:        e.Type,
 			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
 			Direction:   e.Trend,
 			Device:      p.memStore.deviceNames[e.DeviceID],
 			Time:        e.EventTime,
@@ -267,6 +469,36 @@ func (p BucketEntryRepository) FetchLatestSGVs(ctx context.Context, maxTime time
 	return entries, nil
 }
 
+// FetchEntriesCreatedAfter returns entries added to the store after
+// createdAfter, regardless of their event time. Entries are returned in
+// created order, oldest first.
+func (p BucketEntryRepository) FetchEntriesCreatedAfter(ctx context.Context, createdAfter time.Time) ([]models.Entry, error) {
+	p.memStore.entriesLock.RLock()
+	defer p.memStore.entriesLock.RUnlock()
+
+	// entries are sorted by event time, so we must check all of them
+	var entries []models.Entry
+	for _, e := range p.memStore.entries {
+		if !e.CreatedTime.After(createdAfter) {
+			continue
+		}
+		entries = append(entries, models.Entry{
+			Oid:         oidOf(e.Oid),
+			Type:        e.Type,
+			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
+			Direction:   e.Trend,
+			Device:      p.memStore.deviceNames[e.DeviceID],
+			Time:        e.EventTime,
+			CreatedTime: e.CreatedTime,
+		})
+	}
+	slices.SortStableFunc(entries, func(a, b models.Entry) int {
+		return a.CreatedTime.Compare(b.CreatedTime)
+	})
+	return entries, nil
+}
+
 type storedEntry struct {
 	Time        time.Time `json:"dateString"`
 	CreatedTime time.Time `json:"sysTime"`
@@ -275,6 +507,7 @@ type storedEntry struct {
 	Direction   string    `json:"direction"`
 	Device      string    `json:"device"`
 	SgvMgdl     int       `json:"sgv"`
+	UtcOffset   int       `json:"utcOffset,omitempty"` // minutes
 }
 
 // TODO: Events in the far future should end up in day file?
@@ -284,31 +517,37 @@ type storedEntry struct {
 // Note currentTime arg is passed to avoid race condition around time boundaries.
 // The year/month/day storage system is designed so we mostly update a single file,
 // and at startup read four files (previous year, this year, this month, today).
-// Data older than the previous year can be fetched on demand (?)
+// Data older than the previous year is fetched on demand, see FetchEntriesBetween
 // They are designed such that reading those files will not have any duplicate/overlapping entries
 func (p BucketEntryRepository) syncToBucket(ctx context.Context, currentTime time.Time) {
 	log := slogctx.FromCtx(ctx)
+	p.memStore.dirtyLock.Lock()
+	defer p.memStore.dirtyLock.Unlock()
 	log.Debug("syncing",
 		slog.Time("time", currentTime),
 		slog.Bool("dirtyDay", p.memStore.dirtyDay),
 		slog.Bool("dirtyMonth", p.memStore.dirtyMonth),
 		slog.Any("dirtyYears", p.memStore.dirtyYears),
 	)
+	if !p.Lease.hold(ctx, currentTime) {
+		return
+	}
 
-	p.memStore.dirtyLock.Lock()
-	defer p.memStore.dirtyLock.Unlock()
 	p.syncDayToBucket(ctx, currentTime)
 	p.memStore.dirtyDay = false
 	p.syncMonthToBucket(ctx, currentTime)
 	p.memStore.dirtyMonth = false
 	p.syncYearsToBucket(ctx, currentTime)
-	clear(p.memStore.dirtyYears)
 }
 
 // syncDayToBucket updates the day file in the object store.
 // day files contain data for the current day
 func (p BucketEntryRepository) syncDayToBucket(ctx context.Context, currentTime time.Time) {
 	log := slogctx.FromCtx(ctx)
+	if p.AppendDays {
+		p.appendDayChunk(ctx, currentTime)
+		return
+	}
 	if !p.memStore.dirtyDay {
 		return
 	}
@@ -317,46 +556,35 @@ func (p BucketEntryRepository) syncDayToBucket(ctx context.Context, currentTime
 		slog.Bool("dirtyDay", p.memStore.dirtyDay),
 	)
 
-	var dayEntries []storedEntry
 	startOfDay := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, time.UTC)
-
-	// TODO:  p.memStore.entries is sorted: we can use binary search to find start of day & write everything after that.
-	for _, entry := range p.memStore.entries {
-		if entry.EventTime.Before(startOfDay) {
-			continue
-		}
-		dayEntries = append(dayEntries, storedEntry{
-			Oid:         entry.Oid,
-			Type:        entry.Type,
-			SgvMgdl:     entry.SgvMgdl,
-			Direction:   entry.Trend,
-			Device:      p.memStore.deviceNames[entry.DeviceID],
-			Time:        entry.EventTime,
-			CreatedTime: entry.CreatedTime,
-		})
-	}
+	dayEntries := p.storedEntriesBetween(startOfDay, time.Time{})
 
 	name := fmt.Sprintf("ns-day/%s.json", currentTime.Format("2006-01-02"))
 	p.writeEntriesToBucket(ctx, name, dayEntries)
 }
 
+// writeEntriesToBucket uploads a day, month or year file. Callers must hold
+// dirtyLock.
 func (p BucketEntryRepository) writeEntriesToBucket(ctx context.Context, name string, storedEntries []storedEntry) {
 	log := slogctx.FromCtx(ctx)
-	b, err := json.Marshal(storedEntries)
+	if p.CheckConflicts {
+		storedEntries = p.reconcileEntries(ctx, name, storedEntries)
+	}
+	b, err := marshalStored(storedEntries)
 	if err != nil {
 		log.Warn("cannot marshal entries", slog.String("name", name), slog.Any("err", err))
 		return
 	}
 
-	r := bytes.NewReader(b)
-	err = p.BucketStore.Upload(ctx, name, r)
+	size, err := p.uploads.upload(ctx, p.Compression, name, b)
 	if err != nil {
-		log.Warn("cannot upload entries", slog.String("name", name), slog.Any("err", err))
+		log.Warn("cannot upload entries, will retry", slog.String("name", name), slog.Any("err", err))
 		return
 	}
+	p.versions.set(name, b)
 	slog.Debug("uploaded entries",
-		slog.String("name", name),
-		slog.Int("byteSize", len(b)),
+		slog.String("name", p.Compression.Name(name)),
+		slog.Int("byteSize", size),
 		slog.Int("numEntries", len(storedEntries)),
 	)
 }
@@ -372,34 +600,23 @@ func (p BucketEntryRepository) syncMonthToBucket(ctx context.Context, currentTim
 		slog.Time("time", currentTime),
 		slog.Bool("dirtyMonth", p.memStore.dirtyMonth),
 	)
-	var monthEntries []storedEntry
 	startOfMonth := time.Date(currentTime.Year(), currentTime.Month(), 1, 0, 0, 0, 0, time.UTC)
 	startOfDay := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, time.UTC)
-	for _, entry := range p.memStore.entries {
-		if entry.EventTime.Before(startOfMonth) {
-			continue
-		}
-		// month files do not include today's data
-		if !entry.EventTime.Before(startOfDay) {
-			continue
-		}
-		monthEntries = append(monthEntries, storedEntry{
-			Oid:         entry.Oid,
-			Type:        entry.Type,
-			SgvMgdl:     entry.SgvMgdl,
-			Direction:   entry.Trend,
-			Device:      p.memStore.deviceNames[entry.DeviceID],
-			Time:        entry.EventTime,
-			CreatedTime: entry.CreatedTime,
-		})
-	}
+	// month files do not include today's data
+	monthEntries := p.storedEntriesBetween(startOfMonth, startOfDay)
 	name := fmt.Sprintf("ns-month/%s.json", currentTime.Format("2006-01"))
 	p.writeEntriesToBucket(ctx, name, monthEntries)
 }
 
-// syncMonthToBucket updates a year file in the object store.
+// syncYearsToBucket updates year files in the object store.
 // previous year files contain all data for that year.
 // the current year-file contains data for the current year, excluding this month.
+//
+// Memory holds all of the current year, so its file is rewritten from memory.
+// Earlier years may be only partly held (eg entries imported from an archive,
+// or years Boot does not load), so their entries are merged into the stored
+// year file instead. Years that cannot be merged stay dirty, and are retried
+// on the next sync.
 func (p BucketEntryRepository) syncYearsToBucket(ctx context.Context, currentTime time.Time) {
 	log := slogctx.FromCtx(ctx)
 	if len(p.memStore.dirtyYears) == 0 {
@@ -409,33 +626,102 @@ func (p BucketEntryRepository) syncYearsToBucket(ctx context.Context, currentTim
 		slog.Time("time", currentTime),
 		slog.Any("dirtyYears", p.memStore.dirtyYears),
 	)
-	// TODO - this is more complex, we need to work on one year at a time,
-	// and fetch data if it's for a year we don't already have in memory
 
-	// for now, work on current year only?
-	yearsEntries := make(map[int][]storedEntry)
-	startOfYear := time.Date(currentTime.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
-	startOfMonth := time.Date(currentTime.Year(), currentTime.Month(), 1, 0, 0, 0, 0, time.UTC)
-	for _, e := range p.memStore.entries {
-		if e.EventTime.Before(startOfYear) {
+	for _, year := range sortedYears(p.memStore.dirtyYears) {
+		if year < currentTime.Year() {
+			err := p.mergeYearToBucket(ctx, year, currentTime)
+			if err != nil {
+				log.Warn("cannot sync year, will retry", slog.Int("year", year), slog.Any("err", err))
+				continue
+			}
+			delete(p.memStore.dirtyYears, year)
 			continue
 		}
+
+		startOfYear := time.Date(currentTime.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+		startOfMonth := time.Date(currentTime.Year(), currentTime.Month(), 1, 0, 0, 0, 0, time.UTC)
 		// year files do not include data for current month
-		if !e.EventTime.Before(startOfMonth) {
-			continue
+		yearEntries := p.storedEntriesBetween(startOfYear, startOfMonth)
+		name := fmt.Sprintf("ns-year/%s.json", currentTime.Format("2006"))
+		p.writeEntriesToBucket(ctx, name, yearEntries)
+		if p.ParquetYears {
+			name = fmt.Sprintf("ns-year/%s.parquet", currentTime.Format("2006"))
+			p.writeParquetToBucket(ctx, name, yearEntries)
 		}
-		yearsEntries[e.EventTime.Year()] = append(yearsEntries[e.EventTime.Year()], storedEntry{
-			Oid:         e.Oid,
+		delete(p.memStore.dirtyYears, year)
+	}
+}
+
+// mergeYearToBucket merges the entries held in memory for a past year into
+// its year file. Callers must hold dirtyLock.
+func (p BucketEntryRepository) mergeYearToBucket(ctx context.Context, year int, currentTime time.Time) error {
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(1, 0, 0)
+	storedEntries := p.storedEntriesBetween(from, to)
+	entries := make([]models.Entry, len(storedEntries))
+	for i, e := range storedEntries {
+		entries[i] = models.Entry{
+			Oid:         oidOf(e.Oid),
 			Type:        e.Type,
 			SgvMgdl:     e.SgvMgdl,
-			Direction:   e.Trend,
-			Device:      p.memStore.deviceNames[e.DeviceID],
-			Time:        e.EventTime,
+			UtcOffset:   e.UtcOffset,
+			Direction:   e.Direction,
+			Device:      e.Device,
+			Time:        e.Time,
 			CreatedTime: e.CreatedTime,
-		})
+		}
 	}
-	name := fmt.Sprintf("ns-year/%s.json", currentTime.Format("2006"))
-	p.writeEntriesToBucket(ctx, name, yearsEntries[currentTime.Year()])
+
+	w := NewBucketArchiveWriter(p.BucketStore)
+	w.EntryCompression = p.Compression
+	w.IDStrategy = p.IDStrategy
+	numNew, err := w.WriteEntries(ctx, entries, currentTime)
+	if err != nil {
+		return err
+	}
+	if numNew == 0 {
+		return nil
+	}
+	// the year file has changed under any copy loaded for a date range query
+	p.history.forget(from, to)
+
+	if p.ParquetYears {
+		var merged []storedEntry
+		err = w.readFile(ctx, fmt.Sprintf("ns-year/%d.json", year), p.Compression, &merged)
+		if err != nil {
+			return err
+		}
+		p.writeParquetToBucket(ctx, fmt.Sprintf("ns-year/%d.parquet", year), merged)
+	}
+	return nil
+}
+
+// sortedYears returns the dirty years, oldest first
+func sortedYears(years map[int]struct{}) []int {
+	sorted := make([]int, 0, len(years))
+	for year := range years {
+		sorted = append(sorted, year)
+	}
+	slices.Sort(sorted)
+	return sorted
+}
+
+// storedEntriesBetween copies out entries with an event time in [from, to),
+// or from on if to is zero, so they can be written without holding
+// entriesLock
+func (p BucketEntryRepository) storedEntriesBetween(from, to time.Time) []storedEntry {
+	p.memStore.entriesLock.RLock()
+	defer p.memStore.entriesLock.RUnlock()
+	entries := p.memStore.entries
+	end := len(entries)
+	if !to.IsZero() {
+		end = firstAtOrAfter(entries, to, memEntryTime)
+	}
+	var storedEntries []storedEntry
+	for _, e := range entries[firstAtOrAfter(entries, from, memEntryTime):end] {
+		storedEntries = append(storedEntries, p.storedEntry(e))
+	}
+	return storedEntries
 }
 
 // CreateEntries supports adding new entries to the stores
@@ -443,13 +729,125 @@ func (p BucketEntryRepository) CreateEntries(ctx context.Context, entries []mode
 	now := time.Now()
 	createdEntries := p.addEntriesToMemStore(ctx, now, entries)
 
-	if p.memStore.dirtyMonth || p.memStore.dirtyDay || len(p.memStore.dirtyYears) != 0 {
-		syncContext := context.WithoutCancel(ctx)
-		go p.syncToBucket(syncContext, now)
+	// any new entry marks a file dirty
+	if len(createdEntries) > 0 {
+		p.startSync(ctx, now)
 	}
 	return createdEntries
 }
 
+// startSync syncs to the bucket in the background, see syncTracker.request
+func (p BucketEntryRepository) startSync(ctx context.Context, now time.Time) {
+	syncContext := context.WithoutCancel(ctx)
+	p.syncs.request(now, func(now time.Time) {
+		p.syncToBucket(syncContext, now)
+	})
+}
+
+// WaitForSyncs waits for background syncs to finish, eg at shutdown, or
+// until ctx is done
+func (p BucketEntryRepository) WaitForSyncs(ctx context.Context) error {
+	return p.syncs.wait(ctx)
+}
+
+// Sync writes any dirty periods now rather than waiting for the next write,
+// eg if a sync failed or the day has rolled over since the last one
+func (p BucketEntryRepository) Sync(ctx context.Context) {
+	p.syncs.start()
+	defer p.syncs.done()
+	p.syncToBucket(ctx, time.Now())
+}
+
+// SyncAll marks the current day, month and year dirty and flushes them, so
+// they are rewritten from memory whether or not anything has changed.
+// In append mode the day file is not rewritten, but any entries not yet in a
+// day chunk are uploaded.
+func (p BucketEntryRepository) SyncAll(ctx context.Context) error {
+	now := time.Now()
+	p.memStore.dirtyLock.Lock()
+	p.memStore.dirtyDay = true
+	p.memStore.dirtyMonth = true
+	p.memStore.dirtyYears[now.Year()] = struct{}{}
+	p.memStore.dirtyLock.Unlock()
+	return p.Flush(ctx)
+}
+
+// Flush waits for background syncs, then syncs anything still dirty and
+// retries any failed uploads, eg at shutdown
+func (p BucketEntryRepository) Flush(ctx context.Context) error {
+	err := p.WaitForSyncs(ctx)
+	if err != nil {
+		return err
+	}
+	p.syncToBucket(ctx, time.Now())
+	err = p.uploads.flush(ctx)
+	if err != nil {
+		return err
+	}
+	p.memStore.dirtyLock.Lock()
+	defer p.memStore.dirtyLock.Unlock()
+	if p.memStore.dirtyDay || p.memStore.dirtyMonth {
+		return errors.New("cannot sync without the sync lease")
+	}
+	if len(p.memStore.dirtyYears) > 0 {
+		return fmt.Errorf("cannot sync years %v", sortedYears(p.memStore.dirtyYears))
+	}
+	return nil
+}
+
+// firstAtOrAfter returns the position of the first item at or after t in items
+// sorted by time, so sync can slice out a day, month or year rather than
+// checking every item
+func firstAtOrAfter[T any](items []T, t time.Time, timeOf func(T) time.Time) int {
+	i, _ := slices.BinarySearchFunc(items, t, func(item T, t time.Time) int {
+		return timeOf(item).Compare(t)
+	})
+	return i
+}
+
+func memEntryTime(e memEntry) time.Time { return e.EventTime }
+
+// dedupeKey identifies an entry for de-duplication: entries of the same type
+// from the same device in the same second are the same reading. An mbg or cal
+// uploaded alongside an sgv is a different record.
+type dedupeKey struct {
+	second   int64
+	deviceID int
+	typ      string
+}
+
+func entryDedupeKey(deviceID int, typ string, t time.Time) dedupeKey {
+	return dedupeKey{second: t.Round(time.Second).Unix(), deviceID: deviceID, typ: typ}
+}
+
+// entryTypeOrSgv returns typ, or sgv if it is unknown: uploaders do not
+// always send a type
+func entryTypeOrSgv(typ string) string {
+	if typ == "" {
+		return "sgv"
+	}
+	return typ
+}
+
+// hasEntry reports whether a stored entry has the same dedupe key. The store
+// is sorted by event time, so we binary search rather than scan: bulk imports
+// (maybe 250k entries, 6mo) with heavy overlap stay O(n log n).
+// Callers must hold entriesLock, and only stored (sorted) entries are checked.
+func (p BucketEntryRepository) hasEntry(numSorted int, key dedupeKey) bool {
+	entries := p.memStore.entries[:numSorted]
+	from := time.Unix(key.second, 0).Add(-time.Second)
+	to := time.Unix(key.second, 0).Add(time.Second)
+	i, _ := slices.BinarySearchFunc(entries, from, func(e memEntry, t time.Time) int {
+		return e.EventTime.Compare(t)
+	})
+	for ; i < len(entries) && !entries[i].EventTime.After(to); i++ {
+		if entryDedupeKey(entries[i].DeviceID, entries[i].Type, entries[i].EventTime) == key {
+			return true
+		}
+	}
+	return false
+}
+
 func (p BucketEntryRepository) addEntriesToMemStore(ctx context.Context, now time.Time, entries []models.Entry) []models.Entry {
 	var modelEntries []models.Entry
 	if len(entries) == 0 {
@@ -457,27 +855,13 @@ func (p BucketEntryRepository) addEntriesToMemStore(ctx context.Context, now tim
 	}
 	log := slogctx.FromCtx(ctx)
 
-	// TODO de-dupe. We want to support bulk-import, maybe 250k entries (6mo),
-	// so naive scan-all-existing-entries for each new memEntry may be bad
-	if len(p.memStore.entries) > 0 {
-		lastEntry := p.memStore.entries[len(p.memStore.entries)-1]
-		// events within 10 seconds of each other should be checked for dupes
-		lastEventTime := lastEntry.EventTime.Add(time.Second * 10)
-		for _, entry := range entries {
-			if !entry.Time.After(lastEventTime) {
-				// potential dupe
-				log.Info("potential dupe", slog.Time("evt", entry.Time), slog.Time("lastEvent", lastEventTime))
-			}
-		}
-	}
-
 	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
 	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 
-	p.memStore.entriesLock.Lock()
-	defer p.memStore.entriesLock.Unlock()
 	p.memStore.dirtyLock.Lock()
 	defer p.memStore.dirtyLock.Unlock()
+	p.memStore.entriesLock.Lock()
+	defer p.memStore.entriesLock.Unlock()
 	var lastEventTime time.Time // last as in "furthest forward in time"
 	if len(p.memStore.entries) > 0 {
 		lastEventTime = p.memStore.entries[len(p.memStore.entries)-1].EventTime
@@ -486,6 +870,10 @@ func (p BucketEntryRepository) addEntriesToMemStore(ctx context.Context, now tim
 	p.memStore.deviceNamesLock.Lock()
 	defer p.memStore.deviceNamesLock.Unlock()
 
+	numSorted := len(p.memStore.entries)
+	seen := make(map[dedupeKey]struct{}) // within this batch
+	numDupes := 0
+
 	entriesNeedSorting := false
 	for _, e := range entries {
 
@@ -496,33 +884,44 @@ func (p BucketEntryRepository) addEntriesToMemStore(ctx context.Context, now tim
 			p.memStore.deviceIDsByName[e.Device] = deviceID
 		}
 
+		entryType := entryTypeOrSgv(e.Type)
+
+		// overlapping fetches (eg llu graph history) return entries we
+		// already have, skip them.
+		key := entryDedupeKey(deviceID, entryType, e.Time)
+		if _, ok := seen[key]; ok || p.hasEntry(numSorted, key) {
+			numDupes++
+			continue
+		}
+		seen[key] = struct{}{}
+
 		// Preserve oid on import.
-		// May need to rethink if we generate our own "oid"s with different structure
-		oid := e.Oid
+		oid := p.IDStrategy.StoredID(e.Oid)
 		if oid == "" {
-			oid = primitive.NewObjectIDFromTimestamp(now).Hex()
+			oid = p.IDStrategy.NewID(now)
 		}
 
 		memEntry := memEntry{
 			Oid:         oid,
-			Type:        e.Type,
+			Type:        entryType,
 			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
 			Trend:       e.Direction,
 			DeviceID:    deviceID,
 			EventTime:   e.Time,
 			CreatedTime: now,
 		}
-		if memEntry.Type == "" {
-			memEntry.Type = "sgv"
-		}
-
 		p.memStore.entries = append(p.memStore.entries, memEntry)
+		p.memStore.indexLast()
 
 		if memEntry.EventTime.Before(lastEventTime) {
 			entriesNeedSorting = true
 		}
 
 		if !memEntry.EventTime.Before(startOfDay) {
+			if p.AppendDays {
+				p.memStore.unsyncedDay = append(p.memStore.unsyncedDay, memEntry)
+			}
 			if !p.memStore.dirtyDay {
 				p.memStore.dirtyDay = true
 				log.Debug("marking day dirty", slog.Any("memEntry", memEntry))
@@ -543,20 +942,26 @@ func (p BucketEntryRepository) addEntriesToMemStore(ctx context.Context, now tim
 		lastEventTime = memEntry.EventTime
 
 		modelEntries = append(modelEntries, models.Entry{
-			Oid:         memEntry.Oid,
+			Oid:         oidOf(memEntry.Oid),
 			Type:        memEntry.Type,
 			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
 			Direction:   e.Direction,
 			Device:      e.Device,
 			Time:        e.Time,
 			CreatedTime: now,
 		})
 	}
-	log.Info("inserted entries", slog.Int("totalEntries", len(p.memStore.entries)), slog.Int("numInserted", len(entries)))
+	log.Info("inserted entries",
+		slog.Int("totalEntries", len(p.memStore.entries)),
+		slog.Int("numInserted", len(modelEntries)),
+		slog.Int("numDuplicates", numDupes),
+	)
 
 	if entriesNeedSorting {
 		t1 := time.Now()
 		slices.SortFunc(p.memStore.entries, func(a, b memEntry) int { return a.EventTime.Compare(b.EventTime) })
+		p.memStore.resetIndexes()
 		log.Debug("entries sorted", slog.Int64("duration_us", time.Since(t1).Microseconds()))
 	}
 
@@ -1,18 +1,24 @@
 package repository
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	slogctx "github.com/veqryn/slog-context"
 
 	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/thanos-io/objstore"
 )
 
 var now = time.Date(2024, 11, 28, 10, 0, 0, 0, time.UTC)
@@ -46,6 +52,16 @@ func (m *MockBucketStore) Upload(ctx context.Context, name string, r io.Reader)
 	return args.Error(0)
 }
 
+func (m *MockBucketStore) List(ctx context.Context, dir string) ([]string, error) {
+	args := m.Called(ctx, dir)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockBucketStore) ListModifiedSince(ctx context.Context, dir string, since time.Time) ([]string, error) {
+	args := m.Called(ctx, dir, since)
+	return args.Get(0).([]string), args.Error(1)
+}
+
 func (m *MockBucketStore) IsObjNotFoundErr(err error) bool {
 	return err != nil && err.Error() == "not found"
 }
@@ -85,6 +101,34 @@ func TestFetchEntries(t *testing.T) {
 	assert.Equal(t, 105, memEntries[0].SgvMgdl)
 }
 
+func TestFetchEntriesCompressed(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	repo.Compression = bucketstore.CompressionGzip
+	ctx := contextWithSilentLogger()
+
+	// entries written before compression was enabled are still read
+	dayEntries := `[{"dateString":"2024-11-27T11:50:21.723Z","sysTime":"2024-11-27T11:56:16.158187Z","_id":"674708e0575df739a9711a40","type":"sgv","direction":"Flat","device":"xDrip","sgv":105}]`
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-27.json.gz").Return(io.NopCloser(strings.NewReader("")), errors.New("not found")).Once()
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-27.json").Return(io.NopCloser(strings.NewReader(dayEntries)), nil).Once()
+	assert.NoError(t, repo.fetchEntries(ctx, "ns-day/2024-11-27.json"))
+	assert.Len(t, repo.memStore.entries, 1)
+
+	// new files are written compressed, and read back
+	var uploaded bytes.Buffer
+	mockStore.On("Upload", mock.Anything, "ns-day/2024-11-27.json.gz", mock.Anything).Run(func(args mock.Arguments) {
+		_, _ = io.Copy(&uploaded, args.Get(2).(io.Reader))
+	}).Return(nil)
+	repo.writeEntriesToBucket(ctx, "ns-day/2024-11-27.json", []storedEntry{{Oid: "compressed", Type: "sgv", SgvMgdl: 110, Time: recent}})
+	assert.NotContains(t, uploaded.String(), "compressed")
+
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-27.json.gz").Return(io.NopCloser(&uploaded), nil).Once()
+	assert.NoError(t, repo.fetchEntries(ctx, "ns-day/2024-11-27.json"))
+	assert.Len(t, repo.memStore.entries, 2)
+	assert.Equal(t, "compressed", repo.memStore.entries[1].Oid)
+	mockStore.AssertExpectations(t)
+}
+
 // TestFetchEntryByOid tests fetching an memEntry by Oid
 func TestFetchEntryByOid(t *testing.T) {
 	mockStore := &MockBucketStore{}
@@ -127,6 +171,37 @@ func TestFetchEntryByOid(t *testing.T) {
 	assert.Error(t, err)
 	assert.ErrorIs(t, err, models.ErrNotFound)
 	assert.Nil(t, fetchedEntry)
+
+	// the oid index follows entries added out of order, which sorts them
+	repo.addEntriesToMemStore(contextWithSilentLogger(), e.Time, []models.Entry{
+		{Oid: "late", Device: "test-device", Time: e.Time.Add(time.Minute)},
+		{Oid: "early", Device: "test-device", Time: e.Time.Add(-time.Hour)},
+	})
+	for _, oid := range []string{"late", "early", e.Oid} {
+		fetchedEntry, err = repo.FetchEntryByOid(contextWithSilentLogger(), oid)
+		assert.NoError(t, err)
+		assert.Equal(t, oid, fetchedEntry.Oid)
+	}
+}
+
+func TestFetchMatchingEntry(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	repo.memStore.entries = []memEntry{sameDayEntry, recentEntry, futureEntry}
+
+	fetchedEntry, err := repo.FetchMatchingEntry(contextWithSilentLogger(), models.Entry{Device: "unknown", Time: recent, SgvMgdl: 98})
+	assert.NoError(t, err)
+	assert.Equal(t, "latest", fetchedEntry.Oid)
+
+	// any difference means a new reading
+	_, err = repo.FetchMatchingEntry(contextWithSilentLogger(), models.Entry{Device: "unknown", Time: recent, SgvMgdl: 97})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = repo.FetchMatchingEntry(contextWithSilentLogger(), models.Entry{Device: "unknown", Time: recent.Add(time.Millisecond), SgvMgdl: 98})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = repo.FetchMatchingEntry(contextWithSilentLogger(), models.Entry{Device: "xDrip", Time: recent, SgvMgdl: 98})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = repo.FetchMatchingEntry(contextWithSilentLogger(), models.Entry{Type: "mbg", Device: "unknown", Time: recent, SgvMgdl: 98})
+	assert.ErrorIs(t, err, models.ErrNotFound)
 }
 
 // TestFetchLatestSgvEntry tests fetching the latest SGV memEntry
@@ -148,10 +223,30 @@ func TestFetchLatestSgvEntry(t *testing.T) {
 	repo.memStore.entries = []memEntry{
 		{Oid: "non-sgv", Type: "mbg", SgvMgdl: 99, DeviceID: 0, EventTime: recent, CreatedTime: now},
 	}
+	repo.memStore.resetIndexes() // entries replaced wholesale
 	fetchedEntry, err = repo.FetchLatestSgvEntry(contextWithSilentLogger(), now)
 	assert.Error(t, err)
 }
 
+func TestFetchLatestSgvEntryForDevice(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	repo.memStore.deviceNames = []string{"unknown", "llu ingestor/Libre2"}
+
+	repo.memStore.entries = []memEntry{
+		{Oid: "llu", Type: "sgv", SgvMgdl: 99, DeviceID: 1, EventTime: sameDay, CreatedTime: now},
+		recentEntry,
+	}
+
+	fetchedEntry, err := repo.FetchLatestSgvEntryForDevice(contextWithSilentLogger(), now, "llu ingestor")
+	assert.NoError(t, err)
+	assert.Equal(t, "llu", fetchedEntry.Oid)
+	assert.Equal(t, "llu ingestor/Libre2", fetchedEntry.Device)
+
+	_, err = repo.FetchLatestSgvEntryForDevice(contextWithSilentLogger(), now, "dexcom share ingestor")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
+
 func TestFetchLatestEntries(t *testing.T) {
 	mockStore := &MockBucketStore{}
 	repo := NewBucketEntryRepository(mockStore)
@@ -168,6 +263,33 @@ func TestFetchLatestEntries(t *testing.T) {
 	assert.Equal(t, "oid2", entries[0].Oid)
 }
 
+func TestFetchLatestSGVs(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	repo := NewBucketEntryRepository(&MockBucketStore{})
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{
+		{Oid: "sgv1", Type: "sgv", Time: sameDay},
+		{Oid: "mbg", Type: "mbg", Time: sameDay.Add(time.Minute)},
+		{Oid: "sgv2", Type: "sgv", Time: recent},
+	})
+
+	entries, err := repo.FetchLatestSGVs(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sgv2", "sgv1"}, entryOids(entries))
+
+	// the type index follows appends, and out of order inserts
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{
+		{Oid: "cal", Type: "cal", Time: recent.Add(time.Second)},
+		{Oid: "sgv3", Type: "sgv", Time: recent.Add(2 * time.Second)},
+	})
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Oid: "sgv0", Type: "sgv", Time: sameDay.Add(-time.Minute)}})
+	entries, err = repo.FetchLatestSGVs(ctx, future, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sgv3", "sgv2", "sgv1", "sgv0"}, entryOids(entries))
+	entries, err = repo.FetchLatestSGVs(ctx, recent, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sgv2"}, entryOids(entries))
+}
+
 func TestAddEntriesToMemStore(t *testing.T) {
 	mockStore := &MockBucketStore{}
 	repo := NewBucketEntryRepository(mockStore)
@@ -209,6 +331,75 @@ func TestAddEntriesToMemStore(t *testing.T) {
 	assert.Equal(t, repo.memStore.entries[1].Type, "sgv", "unknown Type assumed to be sgv")
 }
 
+func TestAddEntriesToMemStoreDedupe(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	ctx := contextWithSilentLogger()
+
+	entries := []models.Entry{
+		{SgvMgdl: 100, Device: "llu", Time: sameDay},
+		{SgvMgdl: 101, Device: "llu", Time: recent},
+	}
+	createdEntries := repo.addEntriesToMemStore(ctx, now, entries)
+	assert.Len(t, createdEntries, 2)
+
+	entries = []models.Entry{
+		{SgvMgdl: 101, Device: "llu", Time: recent.Add(300 * time.Millisecond)}, // same second
+		{SgvMgdl: 101, Device: "dexcom", Time: recent},                          // different device
+		{SgvMgdl: 102, Device: "llu", Time: now},
+		{SgvMgdl: 102, Device: "llu", Time: now}, // duplicate within batch
+	}
+	createdEntries = repo.addEntriesToMemStore(ctx, now, entries)
+	assert.Len(t, createdEntries, 2, "only genuinely new entries are returned")
+	assert.Equal(t, "dexcom", createdEntries[0].Device)
+	assert.Equal(t, now, createdEntries[1].Time)
+	assert.Len(t, repo.memStore.entries, 4)
+}
+
+func TestAddEntriesToMemStoreDedupeByType(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	ctx := contextWithSilentLogger()
+
+	// xDrip uploads a finger-prick with the same timestamp as the sensor reading
+	createdEntries := repo.addEntriesToMemStore(ctx, now, []models.Entry{
+		{SgvMgdl: 100, Device: "xDrip", Time: recent},
+		{Type: "mbg", SgvMgdl: 104, Device: "xDrip", Time: recent},
+	})
+	assert.Len(t, createdEntries, 2)
+
+	createdEntries = repo.addEntriesToMemStore(ctx, now, []models.Entry{
+		{Type: "sgv", SgvMgdl: 100, Device: "xDrip", Time: recent},
+		{Type: "mbg", SgvMgdl: 104, Device: "xDrip", Time: recent},
+		{Type: "cal", Device: "xDrip", Time: recent},
+	})
+	assert.Len(t, createdEntries, 1, "only the cal record is new")
+	assert.Equal(t, "cal", createdEntries[0].Type)
+	assert.Len(t, repo.memStore.entries, 3)
+
+	mbg, err := repo.FetchMatchingEntry(ctx, models.Entry{Type: "mbg", SgvMgdl: 104, Device: "xDrip", Time: recent})
+	assert.NoError(t, err)
+	assert.Equal(t, "mbg", mbg.Type)
+}
+
+func TestAddEntriesToMemStoreBulkDedupe(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	ctx := contextWithSilentLogger()
+
+	// six months of 5-minute readings, re-imported with a little overlap
+	var entries []models.Entry
+	for i := 0; i < 50000; i++ {
+		entries = append(entries, models.Entry{SgvMgdl: 100, Device: "import", Time: lastYear.Add(time.Duration(i) * 5 * time.Minute)})
+	}
+	assert.Len(t, repo.addEntriesToMemStore(ctx, now, entries), 50000)
+
+	overlapping := append(entries[25000:], models.Entry{SgvMgdl: 100, Device: "import", Time: now})
+	createdEntries := repo.addEntriesToMemStore(ctx, now, overlapping)
+	assert.Len(t, createdEntries, 1)
+	assert.Len(t, repo.memStore.entries, 50001)
+}
+
 func TestAddEntriesToMemStoreDirtyDetection(t *testing.T) {
 	mockStore := &MockBucketStore{}
 	repo := NewBucketEntryRepository(mockStore)
@@ -269,30 +460,40 @@ func TestAddEntriesToMemStoreDirtyDetection(t *testing.T) {
 	assert.Contains(t, repo.memStore.dirtyYears, 2023)
 }
 
+func TestFirstAtOrAfter(t *testing.T) {
+	entries := []memEntry{{EventTime: lastYear}, {EventTime: sameMonth}, {EventTime: sameDay}, {EventTime: sameDay}, {EventTime: recent}}
+	assert.Equal(t, 0, firstAtOrAfter(entries, time.Time{}, memEntryTime))
+	assert.Equal(t, 1, firstAtOrAfter(entries, sameYear, memEntryTime))
+	assert.Equal(t, 2, firstAtOrAfter(entries, sameDay, memEntryTime), "first of equal times")
+	assert.Equal(t, 5, firstAtOrAfter(entries, future, memEntryTime))
+	assert.Equal(t, 0, firstAtOrAfter([]memEntry{}, now, memEntryTime))
+}
+
 // TestSyncToBucket tests the various day/month/year sync functions
 func TestSyncToBucket(t *testing.T) {
 	mockStore := &MockBucketStore{}
 	repo := NewBucketEntryRepository(mockStore)
 	repo.memStore.deviceNames = []string{"unknown", "device1", "device2", "device3", "device4"}
 
+	// the store is kept sorted by event time
 	repo.memStore.entries = []memEntry{
-		{Oid: "sameday", Type: "sgv", SgvMgdl: 100, Trend: "DoubleUp", DeviceID: 3, EventTime: sameDay, CreatedTime: now},
-		{Oid: "samemonth", Type: "sgv", SgvMgdl: 101, Trend: "SingleUp", DeviceID: 2, EventTime: sameMonth, CreatedTime: now},
-		{Oid: "sameyear", Type: "sgv", SgvMgdl: 102, Trend: "Flat", DeviceID: 1, EventTime: sameYear, CreatedTime: now},
 		{Oid: "lastyear", Type: "sgv", SgvMgdl: 103, Trend: "SingleDown", DeviceID: 0, EventTime: lastYear, CreatedTime: now},
+		{Oid: "sameyear", Type: "sgv", SgvMgdl: 102, Trend: "Flat", DeviceID: 1, EventTime: sameYear, CreatedTime: now},
+		{Oid: "samemonth", Type: "sgv", SgvMgdl: 101, Trend: "SingleUp", DeviceID: 2, EventTime: sameMonth, CreatedTime: now},
+		{Oid: "sameday", Type: "sgv", SgvMgdl: 100, Trend: "DoubleUp", DeviceID: 3, EventTime: sameDay, CreatedTime: now, UtcOffset: 60},
 	}
 	repo.memStore.dirtyDay = true
 	repo.memStore.dirtyMonth = true
 	repo.memStore.dirtyYears = map[int]struct{}{
 		2024: {},
-		//2023: {},
+		2023: {},
 	}
 
 	// day files contain entries from today
 	thisDayMatcher := mock.MatchedBy(func(r io.ReadSeeker) bool {
 		json, _ := io.ReadAll(r)
 		r.Seek(0, io.SeekStart) //nolint:errcheck
-		expectedJSON := `[{"dateString":"2024-11-28T00:00:00Z","sysTime":"2024-11-28T10:00:00Z","_id":"sameday","type":"sgv","direction":"DoubleUp","device":"device3","sgv":100}]`
+		expectedJSON := `{"version":2,"data":[{"dateString":"2024-11-28T00:00:00Z","sysTime":"2024-11-28T10:00:00Z","_id":"sameday","type":"sgv","direction":"DoubleUp","device":"device3","sgv":100,"utcOffset":60}]}`
 		return string(json) == expectedJSON
 	})
 	mockStore.On("Upload", mock.Anything, "ns-day/2024-11-28.json", thisDayMatcher).Return(nil).Once()
@@ -301,7 +502,7 @@ func TestSyncToBucket(t *testing.T) {
 	thisMonthMatcher := mock.MatchedBy(func(r io.ReadSeeker) bool {
 		json, _ := io.ReadAll(r)
 		r.Seek(0, io.SeekStart) //nolint:errcheck
-		expectedJSON := `[{"dateString":"2024-11-01T00:00:00Z","sysTime":"2024-11-28T10:00:00Z","_id":"samemonth","type":"sgv","direction":"SingleUp","device":"device2","sgv":101}]`
+		expectedJSON := `{"version":2,"data":[{"dateString":"2024-11-01T00:00:00Z","sysTime":"2024-11-28T10:00:00Z","_id":"samemonth","type":"sgv","direction":"SingleUp","device":"device2","sgv":101}]}`
 		return string(json) == expectedJSON
 	})
 	mockStore.On("Upload", mock.Anything, "ns-month/2024-11.json", thisMonthMatcher).Return(nil)
@@ -310,22 +511,176 @@ func TestSyncToBucket(t *testing.T) {
 	thisYearMatcher := mock.MatchedBy(func(r io.ReadSeeker) bool {
 		json, _ := io.ReadAll(r)
 		r.Seek(0, io.SeekStart) //nolint:errcheck
-		expectedJSON := `[{"dateString":"2024-01-01T00:00:00Z","sysTime":"2024-11-28T10:00:00Z","_id":"sameyear","type":"sgv","direction":"Flat","device":"device1","sgv":102}]`
+		expectedJSON := `{"version":2,"data":[{"dateString":"2024-01-01T00:00:00Z","sysTime":"2024-11-28T10:00:00Z","_id":"sameyear","type":"sgv","direction":"Flat","device":"device1","sgv":102}]}`
 		return string(json) == expectedJSON
 	})
 	mockStore.On("Upload", mock.Anything, "ns-year/2024.json", thisYearMatcher).Return(nil)
 
-	// TODO implement writing of other years too
-	//lastYearMatcher := mock.MatchedBy(func(r io.ReadSeeker) bool {
-	//	json, _ := io.ReadAll(r)
-	//  r.Seek(0, io.SeekStart)
-	//	expectedJSON := `[{"dateString":"2023-01-01T00:00:00Z","sysTime":"2024-11-28T10:00:00Z","_id":"lastyear","type":"sgv","direction":"SingleDown","device":"device1","sgv":103}]`
-	//	fmt.Println(string(json))
-	//	return string(json) == expectedJSON
-	//})
-	//mockStore.On("Upload", mock.Anything, "ns-year/2023.json", lastYearMatcher).Return(nil)
+	// earlier years are merged into their year file, here not written yet
+	mockStore.On("Get", mock.Anything, mock.Anything).Return(io.NopCloser(strings.NewReader("")), errors.New("not found"))
+	lastYearMatcher := mock.MatchedBy(func(r io.ReadSeeker) bool {
+		json, _ := io.ReadAll(r)
+		r.Seek(0, io.SeekStart) //nolint:errcheck
+		expectedJSON := `{"version":2,"data":[{"dateString":"2023-01-01T00:00:00Z","sysTime":"2024-11-28T10:00:00Z","_id":"lastyear","type":"sgv","direction":"SingleDown","device":"unknown","sgv":103}]}`
+		return string(json) == expectedJSON
+	})
+	mockStore.On("Upload", mock.Anything, "ns-year/2023.json", lastYearMatcher).Return(nil)
 
 	repo.syncToBucket(contextWithSilentLogger(), now)
 
 	mockStore.AssertExpectations(t)
+	assert.Empty(t, repo.memStore.dirtyYears)
+}
+
+func TestSyncPastYears(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	twoYearsAgo := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	_, err := NewBucketArchiveWriter(bs).WriteEntries(ctx, []models.Entry{
+		{Oid: "archived", Type: "sgv", Device: "a", Time: twoYearsAgo},
+	}, now)
+	assert.NoError(t, err)
+
+	repo := NewBucketEntryRepository(bs)
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{
+		{Oid: "imported", Type: "sgv", Device: "a", Time: twoYearsAgo.Add(time.Hour)},
+	})
+	assert.Contains(t, repo.memStore.dirtyYears, 2022)
+	repo.syncToBucket(ctx, now)
+	assert.Empty(t, repo.memStore.dirtyYears)
+
+	// imported entries are merged into the stored year file
+	var stored []storedEntry
+	assert.NoError(t, NewBucketArchiveWriter(bs).readFile(ctx, "ns-year/2022.json", repo.Compression, &stored))
+	assert.Len(t, stored, 2)
+	assert.Equal(t, "archived", stored[0].Oid)
+	assert.Equal(t, "imported", stored[1].Oid)
+}
+
+func TestSyncPastYearsRetry(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Type: "sgv", Device: "a", Time: lastYear}})
+
+	// a year file we cannot read is not overwritten, and stays dirty
+	mockStore.On("Get", mock.Anything, mock.Anything).Return(io.NopCloser(strings.NewReader("")), errors.New("access denied"))
+	repo.syncToBucket(ctx, now)
+	mockStore.AssertNotCalled(t, "Upload", mock.Anything, mock.Anything, mock.Anything)
+	assert.Contains(t, repo.memStore.dirtyYears, 2023)
+	assert.Error(t, repo.Flush(ctx))
+}
+
+// run with -race: readers share entriesLock while writers append, sort and sync
+func TestEntriesStoredAsULIDs(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	repo := NewBucketEntryRepository(bs)
+	repo.IDStrategy = &ulidStrategy{}
+	clientOid := "673f0b9c2d9a23bffdc4a2cb"
+	created := repo.addEntriesToMemStore(ctx, now, []models.Entry{
+		{Type: "sgv", SgvMgdl: 100, Device: "dev", Time: recent},
+		{Oid: clientOid, Type: "sgv", SgvMgdl: 101, Device: "dev", Time: future},
+	})
+
+	// clients see oids, while memory and files hold ULIDs
+	assert.Len(t, created[0].Oid, 24)
+	assert.Equal(t, clientOid, created[1].Oid)
+	assert.Equal(t, repo.IDStrategy.StoredID(clientOid), repo.memStore.entries[1].Oid)
+	assert.Len(t, repo.memStore.entries[1].Oid, 26)
+	e, err := repo.FetchEntryByOid(ctx, clientOid)
+	assert.NoError(t, err)
+	assert.Equal(t, clientOid, e.Oid)
+	latest, err := repo.FetchLatestEntries(ctx, future, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{clientOid, created[0].Oid}, []string{latest[0].Oid, latest[1].Oid})
+
+	repo.syncToBucket(ctx, now)
+	stored := dayFileOids(t, bs, "ns-day/2024-11-28.json")
+	assert.Equal(t, []string{repo.memStore.entries[0].Oid, repo.memStore.entries[1].Oid}, stored)
+
+	// switching back to objectids keeps the oids clients have seen
+	objectIDRepo := NewBucketEntryRepository(bs)
+	assert.NoError(t, objectIDRepo.fetchEntries(ctx, "ns-day/2024-11-28.json"))
+	assert.Equal(t, clientOid, objectIDRepo.memStore.entries[1].Oid)
+	e, err = objectIDRepo.FetchEntryByOid(ctx, created[0].Oid)
+	assert.NoError(t, err)
+	assert.Equal(t, created[0].Oid, e.Oid)
+}
+
+func TestConcurrentReadsAndWrites(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	repo := NewBucketEntryRepository(&bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()})
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Oid: "first", Type: "sgv", SgvMgdl: 100, Device: "dev", Time: sameDay}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, _ = repo.FetchLatestEntries(ctx, now, 10)
+				_, _ = repo.FetchLatestSGVs(ctx, now, 10)
+				_, _ = repo.FetchEntryByOid(ctx, "first")
+				_, _ = repo.FetchMatchingEntry(ctx, models.Entry{Device: "dev", SgvMgdl: 100, Time: sameDay})
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			// alternate in-order and out-of-order writes, so entries are resorted
+			eventTime := recent.Add(-time.Duration(j%2*100+j) * time.Second)
+			repo.addEntriesToMemStore(ctx, now, []models.Entry{{Type: "sgv", SgvMgdl: j, Device: fmt.Sprintf("dev%d", j), Time: eventTime}})
+			repo.syncToBucket(ctx, now)
+		}
+	}()
+	wg.Wait()
+
+	entry, err := repo.FetchEntryByOid(ctx, "first")
+	assert.NoError(t, err)
+	assert.Equal(t, 100, entry.SgvMgdl)
+	entries, _ := repo.FetchLatestEntries(ctx, now, 1000)
+	assert.Len(t, entries, 101)
+}
+
+func TestWaitForSyncs(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	repo := NewBucketEntryRepository(bs)
+
+	// hold dirtyLock so the sync cannot complete
+	repo.memStore.dirtyLock.Lock()
+	repo.startSync(ctx, now)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, repo.WaitForSyncs(timeoutCtx), context.DeadlineExceeded)
+	repo.memStore.dirtyLock.Unlock()
+	assert.NoError(t, repo.WaitForSyncs(ctx))
+
+	created := repo.CreateEntries(ctx, []models.Entry{{Type: "sgv", SgvMgdl: 100, Device: "dev", Time: time.Now()}})
+	assert.Len(t, created, 1)
+	assert.NoError(t, repo.WaitForSyncs(ctx))
+	exists, err := bs.Bucket.Exists(ctx, fmt.Sprintf("ns-day/%s.json", time.Now().Format("2006-01-02")))
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestSync(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	repo := NewBucketEntryRepository(bs)
+	dayFile := fmt.Sprintf("ns-day/%s.json", time.Now().Format("2006-01-02"))
+
+	// marks the day dirty without syncing
+	repo.addEntriesToMemStore(ctx, time.Now(), []models.Entry{{Type: "sgv", SgvMgdl: 100, Device: "dev", Time: time.Now()}})
+	exists, _ := bs.Bucket.Exists(ctx, dayFile)
+	assert.False(t, exists)
+
+	repo.Sync(ctx)
+	exists, err := bs.Bucket.Exists(ctx, dayFile)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.False(t, repo.memStore.dirtyDay)
 }
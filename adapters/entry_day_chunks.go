@@ -0,0 +1,191 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/oklog/ulid/v2"
+	slogctx "github.com/veqryn/slog-context"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// In append mode, rather than rewriting the whole day file each time entries
+// arrive, new entries are written as a chunk: ns-day/<day>/<ulid>.jsonl, one
+// entry per line. Busy instances (several uploaders, every minute) then PUT a
+// few hundred bytes rather than the whole day, and two syncs cannot
+// overwrite each other's entries.
+//
+// When the day rolls over the finished day is compacted: the full day file
+// is written and the month file is rewritten to include it. Chunks are left
+// in place, only today's chunks are read at boot.
+
+// appendDayChunk writes entries added since the last sync as a new chunk.
+// Entries are kept for the next sync if the upload fails. Callers must hold
+// dirtyLock.
+func (p BucketEntryRepository) appendDayChunk(ctx context.Context, currentTime time.Time) {
+	log := slogctx.FromCtx(ctx)
+	day := currentTime.Format("2006-01-02")
+	if p.memStore.chunkDay != "" && p.memStore.chunkDay != day {
+		p.compactDay(ctx, currentTime)
+	}
+	p.memStore.chunkDay = day
+
+	if len(p.memStore.unsyncedDay) == 0 {
+		return
+	}
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	p.memStore.entriesLock.RLock() // for deviceNames
+	for _, e := range p.memStore.unsyncedDay {
+		err := enc.Encode(p.storedEntry(e))
+		if err != nil {
+			p.memStore.entriesLock.RUnlock()
+			log.Warn("cannot marshal day chunk", slog.Any("err", err))
+			return
+		}
+	}
+	p.memStore.entriesLock.RUnlock()
+
+	name := fmt.Sprintf("ns-day/%s/%s.jsonl", day, ulid.Make())
+	size, err := uploadCompressed(ctx, p.BucketStore, p.Compression, name, b.Bytes())
+	if err != nil {
+		log.Warn("cannot upload day chunk, will retry", slog.String("name", name), slog.Any("err", err))
+		return
+	}
+	log.Debug("uploaded day chunk",
+		slog.String("name", p.Compression.Name(name)),
+		slog.Int("byteSize", size),
+		slog.Int("numEntries", len(p.memStore.unsyncedDay)),
+	)
+	p.memStore.unsyncedDay = nil
+}
+
+// compactDay writes the full file for the day we were writing chunks for, and
+// marks the month (or, on the first of the month, the year) dirty so the
+// finished day is included. Callers must hold dirtyLock.
+func (p BucketEntryRepository) compactDay(ctx context.Context, currentTime time.Time) {
+	log := slogctx.FromCtx(ctx)
+	chunkDay, err := time.Parse("2006-01-02", p.memStore.chunkDay)
+	if err != nil {
+		return
+	}
+	log.Info("compacting day chunks", slog.String("day", p.memStore.chunkDay))
+
+	startOfDay := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, time.UTC)
+	endOfChunkDay := chunkDay.AddDate(0, 0, 1)
+	dayEntries := p.storedEntriesBetween(chunkDay, endOfChunkDay)
+	p.writeEntriesToBucket(ctx, fmt.Sprintf("ns-day/%s.json", p.memStore.chunkDay), dayEntries)
+
+	if chunkDay.Month() == currentTime.Month() && chunkDay.Year() == currentTime.Year() {
+		p.memStore.dirtyMonth = true
+	} else {
+		p.memStore.dirtyYears[currentTime.Year()] = struct{}{}
+	}
+
+	// unsynced entries from before today are now in the compacted files
+	p.memStore.unsyncedDay = slices.DeleteFunc(p.memStore.unsyncedDay, func(e memEntry) bool {
+		return e.EventTime.Before(startOfDay)
+	})
+}
+
+// fetchDayChunks loads the day's chunks into the memstore. Entries we already
+// have (eg from a day file written before append mode was enabled) are
+// skipped.
+func (p BucketEntryRepository) fetchDayChunks(ctx context.Context, day time.Time) error {
+	log := slogctx.FromCtx(ctx)
+	lister, ok := p.BucketStore.(BucketListerInterface)
+	if !ok {
+		return errors.New("append mode needs a bucket store that can list objects")
+	}
+
+	dayName := day.Format("2006-01-02")
+	dir := fmt.Sprintf("ns-day/%s/", dayName)
+	names, err := lister.List(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("cannot list %s: %w", dir, err)
+	}
+
+	startOfDay := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	seen := make(map[string]struct{})
+	p.memStore.entriesLock.RLock()
+	for i := len(p.memStore.entries) - 1; i >= 0 && !p.memStore.entries[i].EventTime.Before(startOfDay); i-- {
+		seen[oidOf(p.memStore.entries[i].Oid)] = struct{}{}
+	}
+	p.memStore.entriesLock.RUnlock()
+
+	var chunkEntries []storedEntry
+	for _, name := range names {
+		entries, err := p.fetchDayChunk(ctx, name)
+		if err != nil {
+			// most likely a partial write, the other chunks are still good
+			log.Warn("boot: skipping unreadable day chunk", slog.String("name", name), slog.Any("err", err))
+			continue
+		}
+		for _, e := range entries {
+			if _, ok := seen[oidOf(e.Oid)]; ok {
+				continue
+			}
+			seen[oidOf(e.Oid)] = struct{}{}
+			chunkEntries = append(chunkEntries, e)
+		}
+	}
+	p.addStoredEntries(chunkEntries)
+
+	p.memStore.entriesLock.Lock()
+	slices.SortStableFunc(p.memStore.entries, func(a, b memEntry) int { return a.EventTime.Compare(b.EventTime) })
+	p.memStore.resetIndexes()
+	p.memStore.entriesLock.Unlock()
+
+	p.memStore.dirtyLock.Lock()
+	p.memStore.chunkDay = dayName
+	p.memStore.dirtyLock.Unlock()
+
+	log.Debug("boot: day chunks loaded", slog.Int("numChunks", len(names)), slog.Int("numEntries", len(chunkEntries)))
+	return nil
+}
+
+func (p BucketEntryRepository) fetchDayChunk(ctx context.Context, name string) ([]storedEntry, error) {
+	r, err := p.BucketStore.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r, err = bucketstore.Decompress(name, r)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var entries []storedEntry
+	dec := json.NewDecoder(r)
+	for {
+		var e storedEntry
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+func (p BucketEntryRepository) storedEntry(e memEntry) storedEntry {
+	return storedEntry{
+		Oid:         e.Oid,
+		Type:        e.Type,
+		SgvMgdl:     e.SgvMgdl,
+		UtcOffset:   e.UtcOffset,
+		Direction:   e.Trend,
+		Device:      p.memStore.deviceNames[e.DeviceID],
+		Time:        e.EventTime,
+		CreatedTime: e.CreatedTime,
+	}
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestAppendDayChunk(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	repo.AppendDays = true
+	ctx := contextWithSilentLogger()
+
+	var chunks []string
+	mockStore.On("Upload", mock.Anything, mock.MatchedBy(func(name string) bool {
+		return strings.HasPrefix(name, "ns-day/2024-11-28/") && strings.HasSuffix(name, ".jsonl")
+	}), mock.Anything).Run(func(args mock.Arguments) {
+		b, _ := io.ReadAll(args.Get(2).(io.Reader))
+		chunks = append(chunks, string(b))
+	}).Return(nil)
+
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Type: "sgv", SgvMgdl: 100, Time: sameDay, Device: "xDrip"}})
+	repo.syncToBucket(ctx, now)
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Type: "sgv", SgvMgdl: 101, Time: recent, Device: "xDrip"}})
+	repo.syncToBucket(ctx, now)
+
+	// each chunk only holds the new entries, one per line
+	assert.Len(t, chunks, 2)
+	assert.Equal(t, 1, strings.Count(chunks[0], "\n"))
+	assert.Contains(t, chunks[0], `"sgv":100`)
+	assert.Contains(t, chunks[1], `"sgv":101`)
+	mockStore.AssertNotCalled(t, "Upload", mock.Anything, "ns-day/2024-11-28.json", mock.Anything)
+
+	// nothing new, nothing written
+	repo.syncToBucket(ctx, now)
+	assert.Len(t, chunks, 2)
+}
+
+func TestAppendDayChunkRetry(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	repo.AppendDays = true
+	ctx := contextWithSilentLogger()
+
+	mockStore.On("Upload", mock.Anything, mock.Anything, mock.Anything).Return(errors.New("bucket unavailable")).Once()
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Type: "sgv", SgvMgdl: 100, Time: sameDay}})
+	repo.syncToBucket(ctx, now)
+	assert.Len(t, repo.memStore.unsyncedDay, 1, "kept for the next sync")
+
+	mockStore.On("Upload", mock.Anything, mock.Anything, mock.Anything).Return(nil).Once()
+	repo.syncToBucket(ctx, now)
+	assert.Empty(t, repo.memStore.unsyncedDay)
+	mockStore.AssertExpectations(t)
+}
+
+func TestAppendDayChunkRollover(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	repo.AppendDays = true
+	ctx := contextWithSilentLogger()
+	yesterday := now.AddDate(0, 0, -1)
+
+	mockStore.On("Upload", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	repo.addEntriesToMemStore(ctx, yesterday, []models.Entry{{Type: "sgv", SgvMgdl: 100, Time: recent.AddDate(0, 0, -1)}})
+	repo.syncToBucket(ctx, yesterday)
+
+	// first sync of the new day compacts yesterday into the day and month files
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Type: "sgv", SgvMgdl: 101, Time: recent}})
+	repo.syncToBucket(ctx, now)
+	mockStore.AssertCalled(t, "Upload", mock.Anything, "ns-day/2024-11-27.json", mock.Anything)
+	mockStore.AssertCalled(t, "Upload", mock.Anything, "ns-month/2024-11.json", mock.Anything)
+	assert.Equal(t, "2024-11-28", repo.memStore.chunkDay)
+}
+
+func TestFetchDayChunks(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	repo.AppendDays = true
+	ctx := contextWithSilentLogger()
+
+	// entry already loaded from the day file
+	repo.memStore.entries = []memEntry{recentEntry}
+
+	mockStore.On("List", mock.Anything, "ns-day/2024-11-28/").Return([]string{"ns-day/2024-11-28/01.jsonl", "ns-day/2024-11-28/02.jsonl", "ns-day/2024-11-28/03.jsonl"}, nil)
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-28/01.jsonl").Return(io.NopCloser(strings.NewReader(
+		`{"dateString":"2024-11-28T09:45:00Z","_id":"b","type":"sgv","sgv":120}`+"\n"+
+			`{"dateString":"2024-11-28T09:30:00Z","_id":"latest","type":"sgv","sgv":98}`+"\n")), nil)
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-28/02.jsonl").Return(io.NopCloser(bytes.NewReader([]byte(`{"dateString":"2024-11-28T09:40:00Z","_id":"a","type":"sgv","sgv":110}`))), nil)
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-28/03.jsonl").Return(io.NopCloser(strings.NewReader(`{"dateString":"2024-11-2`)), nil)
+
+	err := repo.fetchDayChunks(ctx, now)
+	assert.NoError(t, err)
+
+	var oids []string
+	for _, e := range repo.memStore.entries {
+		oids = append(oids, e.Oid)
+	}
+	assert.Equal(t, []string{"latest", "a", "b"}, oids, "sorted, de-duped, truncated chunk skipped")
+	assert.Equal(t, "2024-11-28", repo.memStore.chunkDay)
+	assert.True(t, repo.memStore.entries[2].EventTime.Equal(time.Date(2024, 11, 28, 9, 45, 0, 0, time.UTC)))
+}
@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Left running, an instance would hold every entry it has ever seen. With
+// MemoryDays set, entries older than that are evicted from memory once they
+// are safely in their year file, and read back from it on demand (see
+// FetchEntriesBetween).
+//
+// The current year, month and day files are rewritten from memory, so this
+// year's entries are never evicted however small MemoryDays is.
+
+// evictionCutoff returns the time before which entries may be evicted
+func (p BucketEntryRepository) evictionCutoff(now time.Time) time.Time {
+	windowStart := now.AddDate(0, 0, -p.MemoryDays)
+	cutoff := time.Date(windowStart.Year(), windowStart.Month(), windowStart.Day(), 0, 0, 0, 0, time.UTC)
+	startOfYear := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	if cutoff.After(startOfYear) {
+		return startOfYear
+	}
+	return cutoff
+}
+
+// EvictEntries removes entries older than MemoryDays from memory, returning
+// how many were evicted. They are first merged into their year files, which
+// is a no-op for entries loaded from those files, so entries posted for past
+// years are not lost. Merging rewrites files as syncing does, so nothing is
+// evicted without the sync lease.
+func (p BucketEntryRepository) EvictEntries(ctx context.Context, now time.Time) (int, error) {
+	log := slogctx.FromCtx(ctx)
+	if p.MemoryDays <= 0 {
+		return 0, nil
+	}
+	cutoff := p.evictionCutoff(now)
+
+	p.memStore.entriesLock.RLock()
+	n, _ := slices.BinarySearchFunc(p.memStore.entries, cutoff, func(e memEntry, t time.Time) int {
+		return e.EventTime.Compare(t)
+	})
+	evicted := make([]models.Entry, n)
+	for i, e := range p.memStore.entries[:n] {
+		evicted[i] = models.Entry{
+			Oid:         oidOf(e.Oid),
+			Type:        e.Type,
+			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
+			Direction:   e.Trend,
+			Device:      p.memStore.deviceNames[e.DeviceID],
+			Time:        e.EventTime,
+			CreatedTime: e.CreatedTime,
+		}
+	}
+	p.memStore.entriesLock.RUnlock()
+	if n == 0 {
+		return 0, nil
+	}
+	if !p.Lease.hold(ctx, now) {
+		return 0, errors.New("cannot evict entries without the sync lease")
+	}
+
+	w := NewBucketArchiveWriter(p.BucketStore)
+	w.EntryCompression = p.Compression
+	w.IDStrategy = p.IDStrategy
+	numNew, err := w.WriteEntries(ctx, evicted, now)
+	if err != nil {
+		return 0, fmt.Errorf("cannot flush entries before eviction: %w", err)
+	}
+
+	// entries may have been added or purged while we were writing, so only
+	// remove those we flushed
+	flushed := make(map[string]struct{}, len(evicted))
+	for _, e := range evicted {
+		flushed[e.Oid] = struct{}{}
+	}
+	p.memStore.entriesLock.Lock()
+	numEntries := len(p.memStore.entries)
+	p.memStore.entries = slices.DeleteFunc(p.memStore.entries, func(e memEntry) bool {
+		_, ok := flushed[oidOf(e.Oid)]
+		return ok && e.EventTime.Before(cutoff)
+	})
+	numEvicted := numEntries - len(p.memStore.entries)
+	p.memStore.resetIndexes()
+	if cutoff.After(p.memStore.heldFrom) {
+		p.memStore.heldFrom = cutoff
+	}
+	p.memStore.entriesLock.Unlock()
+	if numNew > 0 {
+		p.history.forget(time.Time{}, cutoff)
+	}
+
+	log.Info("evicted entries",
+		slog.Time("cutoff", cutoff),
+		slog.Int("numEvicted", numEvicted),
+		slog.Int("numFlushed", numNew),
+	)
+	return numEvicted, nil
+}
@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestEvictionCutoff(t *testing.T) {
+	repo := NewBucketEntryRepository(&MockBucketStore{})
+	repo.MemoryDays = 400
+	assert.Equal(t, time.Date(2023, 10, 25, 0, 0, 0, 0, time.UTC), repo.evictionCutoff(now))
+	// this year is rewritten from memory, so is never evicted
+	repo.MemoryDays = 30
+	assert.Equal(t, sameYear, repo.evictionCutoff(now))
+}
+
+func TestEvictEntries(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	y2022 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	_, err := NewBucketArchiveWriter(bs).WriteEntries(ctx, []models.Entry{
+		{Oid: "archived", Type: "sgv", Device: "a", Time: y2022},
+	}, now)
+	assert.NoError(t, err)
+
+	repo := NewBucketEntryRepository(bs)
+	repo.memStore.heldFrom = lastYear
+	repo.addStoredEntries([]storedEntry{
+		{Oid: "lastyear", Type: "sgv", Device: "a", Time: lastYear},
+		{Oid: "sameyear", Type: "sgv", Device: "a", Time: sameYear},
+		{Oid: "recent", Type: "sgv", Device: "a", Time: recent},
+	})
+	// posted since boot, not yet in any file
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Oid: "posted", Type: "sgv", Device: "a", Time: y2022.Add(time.Hour)}})
+
+	numEvicted, err := repo.EvictEntries(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, numEvicted, "MemoryDays unset")
+
+	repo.MemoryDays = 30
+	numEvicted, err = repo.EvictEntries(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numEvicted)
+	assert.Equal(t, sameYear, repo.memStore.heldFrom)
+	latest, err := repo.FetchLatestEntries(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"recent", "sameyear"}, entryOids(latest))
+
+	// evicted entries were flushed, and are read back on demand
+	entries, err := repo.FetchEntriesBetween(ctx, time.Unix(0, 0), now, "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"recent", "sameyear", "lastyear", "posted", "archived"}, entryOids(entries))
+}
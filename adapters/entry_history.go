@@ -0,0 +1,188 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Boot only loads last year onwards, and older entries may since have been
+// evicted (see EvictEntries). Date range queries reaching further back
+// read the archived year files on demand, keeping the most recently used few
+// years in memory so paging through history does not refetch a year per page.
+// History is assumed to be contiguous: a missing year file ends the search, so
+// queries without a lower bound stop at the first year we have no data for.
+
+// entryHistory holds archived years loaded on demand, least recently used
+// first
+type entryHistory struct {
+	lock  sync.Mutex
+	years []historyYear
+}
+
+type historyYear struct {
+	year    int
+	entries []storedEntry // sorted by event time
+}
+
+// get returns a year's entries, marking it as most recently used
+func (h *entryHistory) get(year int) ([]storedEntry, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	i := slices.IndexFunc(h.years, func(y historyYear) bool { return y.year == year })
+	if i == -1 {
+		return nil, false
+	}
+	y := h.years[i]
+	h.years = append(slices.Delete(h.years, i, i+1), y)
+	return y.entries, true
+}
+
+// put adds a year's entries, evicting the least recently used years beyond
+// maxYears
+func (h *entryHistory) put(year int, entries []storedEntry, maxYears int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.years = slices.DeleteFunc(h.years, func(y historyYear) bool { return y.year == year })
+	h.years = append(h.years, historyYear{year: year, entries: entries})
+	if len(h.years) > maxYears {
+		h.years = slices.Delete(h.years, 0, len(h.years)-maxYears)
+	}
+}
+
+// forget drops any loaded years overlapping [from, to), eg after a purge
+func (h *entryHistory) forget(from, to time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.years = slices.DeleteFunc(h.years, func(y historyYear) bool {
+		return y.year >= from.Year() && y.year <= to.Add(-time.Nanosecond).Year()
+	})
+}
+
+// historyYearEntries returns the archived entries for year, fetching the
+// year file if it is not already loaded, or false if there is no year file
+func (p BucketEntryRepository) historyYearEntries(ctx context.Context, year int) ([]storedEntry, bool, error) {
+	if entries, ok := p.history.get(year); ok {
+		return entries, entries != nil, nil
+	}
+	log := slogctx.FromCtx(ctx)
+	name := fmt.Sprintf("ns-year/%d.json", year)
+	t1 := time.Now()
+	r, err := getCompressed(ctx, p.BucketStore, p.Compression, name)
+	if err != nil {
+		if !p.BucketStore.IsObjNotFoundErr(err) {
+			return nil, false, fmt.Errorf("cannot fetch %s: %w", name, err)
+		}
+		log.Debug("history: no year file", slog.String("file", name))
+		p.history.put(year, nil, p.HistoryYears)
+		return nil, false, nil
+	}
+	defer r.Close()
+	var entries []storedEntry
+	err = decodeStored(r, &entries)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot decode %s: %w", name, err)
+	}
+	if entries == nil {
+		entries = []storedEntry{}
+	}
+	slices.SortStableFunc(entries, func(a, b storedEntry) int { return a.Time.Compare(b.Time) })
+	log.Info("history: loaded year",
+		slog.String("file", name),
+		slog.Int("numEntries", len(entries)),
+		slog.Int64("duration_ms", time.Since(t1).Milliseconds()),
+	)
+	p.history.put(year, entries, p.HistoryYears)
+	return entries, true, nil
+}
+
+// FetchEntriesBetween returns entries with an event time in [from, to), only
+// those of entryType if it is set, newest first. Entries older than those held
+// in memory are read from their year files.
+func (p BucketEntryRepository) FetchEntriesBetween(ctx context.Context, from, to time.Time, entryType string, maxEntries int) ([]models.Entry, error) {
+	var entries []models.Entry
+	seen := make(map[string]struct{})
+	matches := func(t time.Time, typ string) bool {
+		return !t.Before(from) && t.Before(to) && (entryType == "" || typ == entryType)
+	}
+
+	p.memStore.entriesLock.RLock()
+	for i := len(p.memStore.entries) - 1; i >= 0 && len(entries) < maxEntries; i-- {
+		e := p.memStore.entries[i]
+		if e.EventTime.Before(from) {
+			break
+		}
+		if !matches(e.EventTime, e.Type) {
+			continue
+		}
+		seen[oidOf(e.Oid)] = struct{}{}
+		entries = append(entries, models.Entry{
+			Oid:         oidOf(e.Oid),
+			Type:        e.Type,
+			SgvMgdl:     e.SgvMgdl,
+			UtcOffset:   e.UtcOffset,
+			Direction:   e.Trend,
+			Device:      p.memStore.deviceNames[e.DeviceID],
+			Time:        e.EventTime,
+			CreatedTime: e.CreatedTime,
+		})
+	}
+	heldFrom := p.memStore.heldFrom
+	p.memStore.entriesLock.RUnlock()
+
+	if heldFrom.IsZero() || !from.Before(heldFrom) {
+		return entries, nil
+	}
+
+	// a year can be skipped if we already have enough entries newer than it
+	needYear := func(year int) bool {
+		return len(entries) < maxEntries || entries[len(entries)-1].Time.Before(time.Date(year+1, time.January, 1, 0, 0, 0, 0, time.UTC))
+	}
+	// entries from heldFrom on are in memory. Older entries posted since they
+	// were evicted (or since boot) are in memory as well as, once flushed, their
+	// year file, so skip any we already have.
+	lastYear := min(to.Add(-time.Nanosecond).Year(), heldFrom.Add(-time.Nanosecond).Year())
+	for year := lastYear; year >= from.Year() && needYear(year); year-- {
+		yearEntries, found, err := p.historyYearEntries(ctx, year)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			break
+		}
+		var older []models.Entry
+		for i := len(yearEntries) - 1; i >= 0; i-- {
+			e := yearEntries[i]
+			if e.Time.Before(from) {
+				break
+			}
+			if !e.Time.Before(heldFrom) {
+				continue
+			}
+			if _, ok := seen[oidOf(e.Oid)]; ok || !matches(e.Time, e.Type) {
+				continue
+			}
+			older = append(older, models.Entry{
+				Oid:         oidOf(e.Oid),
+				Type:        e.Type,
+				SgvMgdl:     e.SgvMgdl,
+				UtcOffset:   e.UtcOffset,
+				Direction:   e.Direction,
+				Device:      e.Device,
+				Time:        e.Time,
+				CreatedTime: e.CreatedTime,
+			})
+		}
+		entries = append(entries, older...)
+		slices.SortStableFunc(entries, func(a, b models.Entry) int { return b.Time.Compare(a.Time) })
+		if len(entries) > maxEntries {
+			entries = entries[:maxEntries]
+		}
+	}
+	return entries, nil
+}
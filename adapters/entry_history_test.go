@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestFetchEntriesBetween(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	y2021 := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	y2022 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	_, err := NewBucketArchiveWriter(bs).WriteEntries(ctx, []models.Entry{
+		{Oid: "2019", Type: "sgv", Time: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{Oid: "2021", Type: "sgv", Time: y2021},
+		{Oid: "2021mbg", Type: "mbg", Time: y2021.Add(time.Hour)},
+		{Oid: "2022", Type: "sgv", Time: y2022},
+	}, now)
+	assert.NoError(t, err)
+
+	repo := NewBucketEntryRepository(bs)
+	repo.HistoryYears = 1
+	repo.memStore.heldFrom = lastYear
+	repo.addStoredEntries([]storedEntry{
+		{Oid: "lastyear", Type: "sgv", Time: lastYear},
+		{Oid: "recent", Type: "sgv", Time: recent},
+	})
+
+	// within the years loaded at boot
+	entries, err := repo.FetchEntriesBetween(ctx, lastYear, now, "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"recent", "lastyear"}, entryOids(entries))
+	assert.Empty(t, repo.history.years)
+
+	// spanning memory and archived years, newest first
+	entries, err = repo.FetchEntriesBetween(ctx, y2021, now, "sgv", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"recent", "lastyear", "2022", "2021"}, entryOids(entries))
+	assert.Len(t, repo.history.years, 1)
+	assert.Equal(t, 2021, repo.history.years[0].year)
+
+	// count is satisfied by newer years, so 2021 is not read again
+	entries, err = repo.FetchEntriesBetween(ctx, time.Unix(0, 0), now, "", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"recent", "lastyear", "2022"}, entryOids(entries))
+	assert.Equal(t, 2022, repo.history.years[0].year)
+
+	// no lower bound: 2020 has no year file, so 2019 is never reached
+	entries, err = repo.FetchEntriesBetween(ctx, time.Unix(0, 0), lastYear, "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2022", "2021mbg", "2021"}, entryOids(entries))
+
+	// purging forgets the loaded year
+	_, err = repo.PurgeEntries(ctx, y2021.Add(time.Minute), y2021.Add(2*time.Hour), "")
+	assert.NoError(t, err)
+	entries, err = repo.FetchEntriesBetween(ctx, y2021, lastYear, "", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2022", "2021"}, entryOids(entries))
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress/zstd"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"time"
+)
+
+// parquetEntry is a row of an ns-year/<year>.parquet file. Columns follow
+// the json year files so queries can move between the two, eg in duckdb
+// `select date, sgv from 'ns-year/2024.parquet' where type = 'sgv'`
+type parquetEntry struct {
+	Time        time.Time `parquet:"date,timestamp(millisecond)"`
+	CreatedTime time.Time `parquet:"sysTime,timestamp(millisecond)"`
+	Oid         string    `parquet:"_id"`
+	Type        string    `parquet:"type,dict"`
+	Direction   string    `parquet:"direction,dict"`
+	Device      string    `parquet:"device,dict"`
+	SgvMgdl     int32     `parquet:"sgv"`
+	UtcOffset   int32     `parquet:"utcOffset"`
+}
+
+// writeParquetToBucket writes entries as parquet. Like the json year files,
+// parquet files are rewritten in full each time.
+func (p BucketEntryRepository) writeParquetToBucket(ctx context.Context, name string, storedEntries []storedEntry) {
+	log := slogctx.FromCtx(ctx)
+
+	rows := make([]parquetEntry, len(storedEntries))
+	for i, e := range storedEntries {
+		rows[i] = parquetEntry{
+			Time:        e.Time,
+			CreatedTime: e.CreatedTime,
+			Oid:         oidOf(e.Oid),
+			Type:        e.Type,
+			Direction:   e.Direction,
+			Device:      e.Device,
+			SgvMgdl:     int32(e.SgvMgdl),
+			UtcOffset:   int32(e.UtcOffset),
+		}
+	}
+
+	var buf bytes.Buffer
+	err := parquet.Write(&buf, rows, parquet.Compression(&zstd.Codec{}))
+	if err != nil {
+		log.Warn("cannot write parquet entries", slog.String("name", name), slog.Any("err", err))
+		return
+	}
+
+	size := buf.Len()
+	err = p.BucketStore.Upload(ctx, name, &buf)
+	if err != nil {
+		log.Warn("cannot upload parquet entries", slog.String("name", name), slog.Any("err", err))
+		return
+	}
+	log.Debug("uploaded parquet entries",
+		slog.String("name", name),
+		slog.Int("byteSize", size),
+		slog.Int("numEntries", len(rows)),
+	)
+}
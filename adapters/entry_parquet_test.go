@@ -0,0 +1,37 @@
+package repository
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSyncYearsToBucketParquet(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketEntryRepository(mockStore)
+	repo.ParquetYears = true
+	repo.memStore.deviceNames = []string{"unknown", "device1"}
+	repo.memStore.entries = []memEntry{sameYearEntry}
+	repo.memStore.dirtyYears = map[int]struct{}{2024: {}}
+
+	var uploaded bytes.Buffer
+	mockStore.On("Upload", mock.Anything, "ns-year/2024.json", mock.Anything).Return(nil)
+	mockStore.On("Upload", mock.Anything, "ns-year/2024.parquet", mock.Anything).Run(func(args mock.Arguments) {
+		_, _ = io.Copy(&uploaded, args.Get(2).(io.Reader))
+	}).Return(nil)
+
+	repo.syncYearsToBucket(contextWithSilentLogger(), now)
+	mockStore.AssertExpectations(t)
+
+	rows, err := parquet.Read[parquetEntry](bytes.NewReader(uploaded.Bytes()), int64(uploaded.Len()))
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, "sameyear", rows[0].Oid)
+	assert.Equal(t, int32(102), rows[0].SgvMgdl)
+	assert.Equal(t, "device1", rows[0].Device)
+	assert.True(t, sameYear.Equal(rows[0].Time))
+}
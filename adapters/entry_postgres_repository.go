@@ -0,0 +1,267 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/jackc/pgx/v5"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"time"
+)
+
+// dedupe_second matches the bucket repository's de-duplication: entries of the
+// same type from the same device in the same second are the same reading.
+const entrySchema = `
+CREATE TABLE IF NOT EXISTS entries (
+	oid           text PRIMARY KEY,
+	type          text NOT NULL,
+	sgv_mgdl      integer NOT NULL DEFAULT 0,
+	direction     text NOT NULL DEFAULT '',
+	device        text NOT NULL DEFAULT '',
+	event_time    timestamptz NOT NULL,
+	created_time  timestamptz NOT NULL,
+	dedupe_second bigint NOT NULL
+);
+ALTER TABLE entries ADD COLUMN IF NOT EXISTS utc_offset integer NOT NULL DEFAULT 0;
+DROP INDEX IF EXISTS entries_device_second;
+CREATE UNIQUE INDEX IF NOT EXISTS entries_device_type_second ON entries (device, type, dedupe_second);
+CREATE INDEX IF NOT EXISTS entries_event_time ON entries (event_time);
+CREATE INDEX IF NOT EXISTS entries_created_time ON entries (created_time);
+`
+
+const entryColumns = "oid, type, sgv_mgdl, direction, device, event_time, created_time, utc_offset"
+
+type PostgresEntryRepository struct {
+	DB                  PostgresInterface
+	PreserveCreatedTime bool // keep the entry's created time, eg when migrating
+}
+
+func NewPostgresEntryRepository(db PostgresInterface) *PostgresEntryRepository {
+	return &PostgresEntryRepository{
+		DB: db,
+	}
+}
+
+// Boot creates the entries table if needed. Entries are not cached in
+// memory, every request is a query.
+func (p PostgresEntryRepository) Boot(ctx context.Context) error {
+	log := slogctx.FromCtx(ctx)
+	_, err := p.DB.Exec(ctx, entrySchema)
+	if err != nil {
+		return fmt.Errorf("cannot create entries schema: %w", err)
+	}
+
+	var numEntries int
+	var mostRecentTime *time.Time
+	err = p.DB.QueryRow(ctx, "SELECT count(*), max(event_time) FROM entries").Scan(&numEntries, &mostRecentTime)
+	if err != nil {
+		return fmt.Errorf("cannot count entries: %w", err)
+	}
+	attrs := []any{slog.Int("numEntries", numEntries)}
+	if mostRecentTime != nil {
+		attrs = append(attrs, slog.Time("mostRecentEntryTime", *mostRecentTime))
+	}
+	log.Info("boot: postgres entries ready", attrs...)
+	return nil
+}
+
+func (p PostgresEntryRepository) FetchEntryByOid(ctx context.Context, oid string) (*models.Entry, error) {
+	row := p.DB.QueryRow(ctx, "SELECT "+entryColumns+" FROM entries WHERE oid = $1", oid)
+	return fetchOneEntry(row)
+}
+
+// FetchMatchingEntry returns a stored entry with the same time, device, type and sgv
+// as the given entry. Used to make uploads idempotent.
+func (p PostgresEntryRepository) FetchMatchingEntry(ctx context.Context, entry models.Entry) (*models.Entry, error) {
+	row := p.DB.QueryRow(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE event_time = $1 AND device = $2 AND type = $3 AND sgv_mgdl = $4 LIMIT 1",
+		entry.Time.UTC(), entry.Device, entryTypeOrSgv(entry.Type), entry.SgvMgdl,
+	)
+	return fetchOneEntry(row)
+}
+
+func (p PostgresEntryRepository) FetchLatestSgvEntry(ctx context.Context, maxTime time.Time) (*models.Entry, error) {
+	row := p.DB.QueryRow(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE type = 'sgv' AND event_time <= $1 ORDER BY event_time DESC LIMIT 1",
+		maxTime.UTC(),
+	)
+	return fetchOneEntry(row)
+}
+
+// FetchLatestSgvEntryForDevice returns the latest sgv entry from a device
+// whose name starts with devicePrefix, eg "llu ingestor"
+func (p PostgresEntryRepository) FetchLatestSgvEntryForDevice(ctx context.Context, maxTime time.Time, devicePrefix string) (*models.Entry, error) {
+	row := p.DB.QueryRow(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE type = 'sgv' AND event_time <= $1 AND starts_with(device, $2) ORDER BY event_time DESC LIMIT 1",
+		maxTime.UTC(), devicePrefix,
+	)
+	return fetchOneEntry(row)
+}
+
+func (p PostgresEntryRepository) FetchLatestEntries(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+	rows, err := p.DB.Query(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE event_time <= $1 ORDER BY event_time DESC LIMIT $2",
+		maxTime.UTC(), maxEntries,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectEntries(rows)
+}
+
+func (p PostgresEntryRepository) FetchLatestSGVs(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+	rows, err := p.DB.Query(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE type = 'sgv' AND event_time <= $1 ORDER BY event_time DESC LIMIT $2",
+		maxTime.UTC(), maxEntries,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectEntries(rows)
+}
+
+// FetchEntriesBetween returns entries with an event time in [from, to), only
+// those of entryType if it is set, newest first
+func (p PostgresEntryRepository) FetchEntriesBetween(ctx context.Context, from, to time.Time, entryType string, maxEntries int) ([]models.Entry, error) {
+	rows, err := p.DB.Query(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE event_time >= $1 AND event_time < $2 AND ($3 = '' OR type = $3) ORDER BY event_time DESC LIMIT $4",
+		from.UTC(), to.UTC(), entryType, maxEntries,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectEntries(rows)
+}
+
+// FetchEntriesCreatedAfter returns entries added to the store after
+// createdAfter, regardless of their event time, oldest first.
+func (p PostgresEntryRepository) FetchEntriesCreatedAfter(ctx context.Context, createdAfter time.Time) ([]models.Entry, error) {
+	rows, err := p.DB.Query(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE created_time > $1 ORDER BY created_time, event_time",
+		createdAfter.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectEntries(rows)
+}
+
+// ExportEntries calls fn for every entry, oldest first
+func (p PostgresEntryRepository) ExportEntries(ctx context.Context, fn func(models.Entry) error) error {
+	rows, err := p.DB.Query(ctx, "SELECT "+entryColumns+" FROM entries ORDER BY event_time")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return err
+		}
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// PurgeEntries deletes entries with an event time in [from, to), only those
+// from device if it is set, returning how many were deleted
+func (p PostgresEntryRepository) PurgeEntries(ctx context.Context, from, to time.Time, device string) (int, error) {
+	tag, err := p.DB.Exec(ctx,
+		"DELETE FROM entries WHERE event_time >= $1 AND event_time < $2 AND ($3 = '' OR device = $3)",
+		from.UTC(), to.UTC(), device,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// CreateEntries inserts entries in a single batch, returning those inserted.
+// Entries whose oid we already have, or from the same device in the same
+// second as one we already have, are skipped.
+func (p PostgresEntryRepository) CreateEntries(ctx context.Context, entries []models.Entry) []models.Entry {
+	log := slogctx.FromCtx(ctx)
+	var modelEntries []models.Entry
+	if len(entries) == 0 {
+		return modelEntries
+	}
+
+	now := time.Now()
+	toInsert := make([]models.Entry, len(entries))
+	batch := &pgx.Batch{}
+	for i, e := range entries {
+		// Preserve oid on import.
+		if e.Oid == "" {
+			e.Oid = newOid(now)
+		}
+		if e.Type == "" {
+			e.Type = "sgv"
+		}
+		if !p.PreserveCreatedTime || e.CreatedTime.IsZero() {
+			e.CreatedTime = now
+		}
+		toInsert[i] = e
+		batch.Queue(
+			"INSERT INTO entries (oid, type, sgv_mgdl, direction, device, event_time, created_time, utc_offset, dedupe_second) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING",
+			e.Oid, e.Type, e.SgvMgdl, e.Direction, e.Device, e.Time.UTC(), e.CreatedTime.UTC(), e.UtcOffset, e.Time.Round(time.Second).Unix(),
+		)
+	}
+
+	results := p.DB.SendBatch(ctx, batch)
+	defer results.Close()
+	numDupes := 0
+	for _, e := range toInsert {
+		tag, err := results.Exec()
+		if err != nil {
+			log.Warn("cannot insert entry", slog.String("oid", e.Oid), slog.Any("err", err))
+			continue
+		}
+		if tag.RowsAffected() == 0 {
+			numDupes++
+			continue
+		}
+		modelEntries = append(modelEntries, e)
+	}
+	log.Info("inserted entries", slog.Int("numInserted", len(modelEntries)), slog.Int("numDupes", numDupes))
+	return modelEntries
+}
+
+func scanEntry(row pgx.Row) (models.Entry, error) {
+	var e models.Entry
+	err := row.Scan(&e.Oid, &e.Type, &e.SgvMgdl, &e.Direction, &e.Device, &e.Time, &e.CreatedTime, &e.UtcOffset)
+	if err != nil {
+		return e, err
+	}
+	e.Time = e.Time.UTC()
+	e.CreatedTime = e.CreatedTime.UTC()
+	return e, nil
+}
+
+func fetchOneEntry(row pgx.Row) (*models.Entry, error) {
+	e, err := scanEntry(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func collectEntries(rows pgx.Rows) ([]models.Entry, error) {
+	defer rows.Close()
+	var entries []models.Entry
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
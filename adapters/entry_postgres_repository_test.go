@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgresEntryRepository(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	repo := NewPostgresEntryRepository(postgresForTest(t, "entries"))
+	assert.NoError(t, repo.Boot(ctx))
+
+	_, err := repo.FetchLatestSgvEntry(ctx, now)
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	created := repo.CreateEntries(ctx, []models.Entry{
+		{Oid: "sameyear", Type: "sgv", SgvMgdl: 102, Direction: "Flat", Device: "xDrip-LimiTTer", Time: sameYear},
+		{Type: "mbg", SgvMgdl: 98, Device: "xDrip-LimiTTer", Time: recent.Add(-time.Minute)},
+		{SgvMgdl: 98, Direction: "DoubleUp", Device: "llu ingestor", Time: recent},
+		// same device, same second: a duplicate
+		{SgvMgdl: 99, Device: "llu ingestor", Time: recent.Add(200 * time.Millisecond)},
+	})
+	assert.Len(t, created, 3)
+	assert.Equal(t, "sgv", created[2].Type)
+
+	// duplicate oids are skipped
+	assert.Empty(t, repo.CreateEntries(ctx, []models.Entry{{Oid: "sameyear", Device: "other", Time: sameDay}}))
+
+	entry, err := repo.FetchEntryByOid(ctx, "sameyear")
+	assert.NoError(t, err)
+	assert.Equal(t, sameYear, entry.Time)
+	assert.Equal(t, "xDrip-LimiTTer", entry.Device)
+
+	entry, err = repo.FetchLatestSgvEntry(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, created[2].Oid, entry.Oid)
+
+	entry, err = repo.FetchLatestSgvEntryForDevice(ctx, now, "xDrip")
+	assert.NoError(t, err)
+	assert.Equal(t, "sameyear", entry.Oid)
+
+	entry, err = repo.FetchMatchingEntry(ctx, models.Entry{Time: recent, Device: "llu ingestor", SgvMgdl: 98})
+	assert.NoError(t, err)
+	assert.Equal(t, created[2].Oid, entry.Oid)
+
+	entries, err := repo.FetchLatestEntries(ctx, now, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{created[2].Oid, created[1].Oid}, entryOids(entries))
+
+	entries, err = repo.FetchLatestSGVs(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{created[2].Oid, "sameyear"}, entryOids(entries))
+
+	entries, err = repo.FetchEntriesBetween(ctx, sameYear, recent, "sgv", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sameyear"}, entryOids(entries))
+
+	entries, err = repo.FetchEntriesCreatedAfter(ctx, created[0].CreatedTime.Add(-time.Second))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+
+	var exported []string
+	assert.NoError(t, repo.ExportEntries(ctx, func(e models.Entry) error {
+		exported = append(exported, e.Oid)
+		return nil
+	}))
+	assert.Equal(t, []string{"sameyear", created[1].Oid, created[2].Oid}, exported)
+
+	numPurged, err := repo.PurgeEntries(ctx, sameYear, now, "xDrip-LimiTTer")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, numPurged)
+	_, err = repo.FetchEntryByOid(ctx, "sameyear")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	// a finger-prick in the same second as a reading is not a duplicate
+	created = repo.CreateEntries(ctx, []models.Entry{
+		{Type: "sgv", SgvMgdl: 100, Device: "xDrip", Time: sameDay},
+		{Type: "mbg", SgvMgdl: 104, Device: "xDrip", Time: sameDay},
+	})
+	assert.Len(t, created, 2)
+}
+
+func entryOids(entries []models.Entry) []string {
+	var oids []string
+	for _, e := range entries {
+		oids = append(oids, e.Oid)
+	}
+	return oids
+}
@@ -0,0 +1,22 @@
+package repository
+
+import (
+	"context"
+	"github.com/adamlounds/nightscout-go/models"
+	"time"
+)
+
+// EntryRepository is implemented by each entry storage backend
+type EntryRepository interface {
+	Boot(ctx context.Context) error
+	FetchEntryByOid(ctx context.Context, oid string) (*models.Entry, error)
+	FetchMatchingEntry(ctx context.Context, entry models.Entry) (*models.Entry, error)
+	FetchLatestSgvEntry(ctx context.Context, maxTime time.Time) (*models.Entry, error)
+	FetchLatestSgvEntryForDevice(ctx context.Context, maxTime time.Time, devicePrefix string) (*models.Entry, error)
+	FetchLatestEntries(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error)
+	FetchLatestSGVs(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error)
+	FetchEntriesBetween(ctx context.Context, from, to time.Time, entryType string, maxEntries int) ([]models.Entry, error)
+	FetchEntriesCreatedAfter(ctx context.Context, createdAfter time.Time) ([]models.Entry, error)
+	CreateEntries(ctx context.Context, entries []models.Entry) []models.Entry
+	PurgeEntries(ctx context.Context, from, to time.Time, device string) (int, error)
+}
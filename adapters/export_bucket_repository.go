@@ -0,0 +1,256 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BucketListerInterface is implemented by bucket stores that can list the
+// objects they hold
+type BucketListerInterface interface {
+	BucketStoreInterface
+	List(ctx context.Context, dir string) ([]string, error)
+}
+
+// BucketExportRepository reads every stored entry and treatment straight from
+// the year/month/day files, including years that are not held in memory.
+type BucketExportRepository struct {
+	BucketStore          BucketListerInterface
+	EntryCompression     bucketstore.Compression
+	TreatmentCompression bucketstore.Compression
+	EntryExporter        EntryExporter     // set when entries are not stored in the bucket
+	TreatmentExporter    TreatmentExporter // set when treatments are not stored in the bucket
+}
+
+// EntryExporter is implemented by entry repositories that do not store
+// entries in bucket files
+type EntryExporter interface {
+	ExportEntries(ctx context.Context, fn func(models.Entry) error) error
+}
+
+// TreatmentExporter is implemented by treatment repositories that do not
+// store treatments in bucket files
+type TreatmentExporter interface {
+	ExportTreatments(ctx context.Context, fn func(models.Treatment) error) error
+}
+
+func NewBucketExportRepository(bs BucketListerInterface) *BucketExportRepository {
+	return &BucketExportRepository{BucketStore: bs}
+}
+
+// ExportEntries calls fn for each stored entry, a year at a time, oldest year
+// first. A day's entries appear in the day file and again in the month and
+// year files once the day has passed, so entries are de-duped by oid within
+// each year. Only one file is decoded at a time.
+func (p BucketExportRepository) ExportEntries(ctx context.Context, fn func(models.Entry) error) error {
+	if p.EntryExporter != nil {
+		return p.EntryExporter.ExportEntries(ctx, fn)
+	}
+	return p.exportFiles(ctx, ".json", p.EntryCompression, func(name string, seen map[string]struct{}) error {
+		return p.streamFile(ctx, name, func(dec *json.Decoder) error {
+			var e storedEntry
+			err := dec.Decode(&e)
+			if err != nil {
+				return err
+			}
+			oid := oidOf(e.Oid)
+			if _, ok := seen[oid]; ok {
+				return nil
+			}
+			seen[oid] = struct{}{}
+			return fn(models.Entry{
+				Oid:         oid,
+				Type:        e.Type,
+				SgvMgdl:     e.SgvMgdl,
+				UtcOffset:   e.UtcOffset,
+				Direction:   e.Direction,
+				Device:      e.Device,
+				Time:        e.Time,
+				CreatedTime: e.CreatedTime,
+			})
+		})
+	})
+}
+
+// ExportTreatments calls fn for each stored treatment, as ExportEntries
+func (p BucketExportRepository) ExportTreatments(ctx context.Context, fn func(models.Treatment) error) error {
+	if p.TreatmentExporter != nil {
+		return p.TreatmentExporter.ExportTreatments(ctx, fn)
+	}
+	log := slogctx.FromCtx(ctx)
+	return p.exportFiles(ctx, "-treatments.json", p.TreatmentCompression, func(name string, seen map[string]struct{}) error {
+		return p.streamFile(ctx, name, func(dec *json.Decoder) error {
+			var st storedTreatment
+			err := dec.Decode(&st)
+			if err != nil {
+				return err
+			}
+			t, ok := treatmentFromStored(st)
+			if !ok {
+				log.Warn("export: skipping treatment without _id, eventType or created_at", slog.String("file", name), slog.Any("treatment", st))
+				return nil
+			}
+			if _, ok := seen[t.ID]; ok {
+				return nil
+			}
+			seen[t.ID] = struct{}{}
+			return fn(t)
+		})
+	})
+}
+
+// exportFiles calls fn for each file with the given suffix, grouped by year:
+// the year file, then month files, then day files and day chunks. Entry files are plain
+// .json, so treatment files are excluded when exporting entries. If a file
+// has been written with more than one compression, the copy with the
+// configured compression is the current one.
+func (p BucketExportRepository) exportFiles(ctx context.Context, suffix string, c bucketstore.Compression, fn func(name string, seen map[string]struct{}) error) error {
+	filesByYear := make(map[int][]string)
+	for _, dir := range []string{"ns-year/", "ns-month/", "ns-day/"} {
+		names, err := p.BucketStore.List(ctx, dir)
+		if err != nil {
+			return fmt.Errorf("cannot list %s: %w", dir, err)
+		}
+
+		stored := make(map[string]struct{}, len(names))
+		uncompressedSet := make(map[string]struct{}, len(names))
+		for _, name := range names {
+			if strings.HasSuffix(name, "/") {
+				// ns-day/<day>/ holds append mode chunks of entries
+				if suffix != ".json" {
+					continue
+				}
+				dayDir := strings.TrimPrefix(name, dir)
+				if len(dayDir) < 4 {
+					continue
+				}
+				year, err := strconv.Atoi(dayDir[:4])
+				if err != nil {
+					continue
+				}
+				chunks, err := p.BucketStore.List(ctx, name)
+				if err != nil {
+					return fmt.Errorf("cannot list %s: %w", name, err)
+				}
+				filesByYear[year] = append(filesByYear[year], chunks...)
+				continue
+			}
+			stored[name] = struct{}{}
+			_, uncompressed := bucketstore.CompressionOf(name)
+			uncompressedSet[uncompressed] = struct{}{}
+		}
+		uncompressedNames := make([]string, 0, len(uncompressedSet))
+		for name := range uncompressedSet {
+			uncompressedNames = append(uncompressedNames, name)
+		}
+		slices.Sort(uncompressedNames)
+
+		for _, uncompressed := range uncompressedNames {
+			base := path.Base(uncompressed)
+			if !strings.HasSuffix(base, suffix) {
+				continue
+			}
+			if suffix != "-treatments.json" && strings.HasSuffix(base, "-treatments.json") {
+				continue
+			}
+			if len(base) < 4 {
+				continue
+			}
+			year, err := strconv.Atoi(base[:4])
+			if err != nil {
+				continue
+			}
+			for _, name := range c.Names(uncompressed) {
+				if _, ok := stored[name]; ok {
+					filesByYear[year] = append(filesByYear[year], name)
+					break
+				}
+			}
+		}
+	}
+
+	years := make([]int, 0, len(filesByYear))
+	for year := range filesByYear {
+		years = append(years, year)
+	}
+	slices.Sort(years)
+
+	for _, year := range years {
+		seen := make(map[string]struct{})
+		for _, name := range filesByYear[year] {
+			err := fn(name, seen)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// streamFile decodes a day, month or year file (or day chunk) from the bucket
+// one element at a time, calling fn to decode each element
+func (p BucketExportRepository) streamFile(ctx context.Context, name string, fn func(dec *json.Decoder) error) error {
+	r, err := p.BucketStore.Get(ctx, name)
+	if err != nil {
+		if p.BucketStore.IsObjNotFoundErr(err) {
+			// deleted since we listed it
+			return nil
+		}
+		return fmt.Errorf("cannot fetch %s: %w", name, err)
+	}
+	r, err = bucketstore.Decompress(name, r)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if _, uncompressed := bucketstore.CompressionOf(name); strings.HasSuffix(uncompressed, ".jsonl") {
+		dec := json.NewDecoder(r)
+		for dec.More() {
+			err = fn(dec)
+			if err != nil {
+				return fmt.Errorf("cannot export %s: %w", name, err)
+			}
+		}
+		return nil
+	}
+
+	// elements are kept raw, so only one copy of the file is decoded at once
+	var elements []json.RawMessage
+	err = decodeStored(r, &elements)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s: %w", name, err)
+	}
+	for _, e := range elements {
+		err = fn(json.NewDecoder(bytes.NewReader(e)))
+		if err != nil {
+			return fmt.Errorf("cannot export %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func treatmentFromStored(st storedTreatment) (models.Treatment, bool) {
+	oid, _ := st["_id"].(string)
+	eventType, hasType := st["eventType"].(string)
+	createdAt, _ := st["created_at"].(string)
+	t, err := time.Parse(time.RFC3339, createdAt)
+	if oid == "" || !hasType || err != nil {
+		return models.Treatment{}, false
+	}
+	delete(st, "_id")
+	delete(st, "eventType")
+	delete(st, "created_at")
+	return models.Treatment{ID: oidOf(oid), Type: eventType, Time: t, Fields: st}, true
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestExportEntries(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketExportRepository(mockStore)
+	ctx := contextWithSilentLogger()
+
+	mockStore.On("List", mock.Anything, "ns-year/").Return([]string{"ns-year/2023.json", "ns-year/2023-treatments.json", "ns-year/2024.json"}, nil)
+	mockStore.On("List", mock.Anything, "ns-month/").Return([]string{"ns-month/2024-11.json"}, nil)
+	mockStore.On("List", mock.Anything, "ns-day/").Return([]string{"ns-day/2024-11-27.json", "ns-day/2024-11-28.json", "ns-day/2024-11-28/"}, nil)
+	mockStore.On("List", mock.Anything, "ns-day/2024-11-28/").Return([]string{"ns-day/2024-11-28/01.jsonl"}, nil)
+
+	file := func(body string) io.ReadCloser { return io.NopCloser(strings.NewReader(body)) }
+	mockStore.On("Get", mock.Anything, "ns-year/2023.json").Return(file(`[{"_id":"lastyear","type":"sgv","sgv":103,"dateString":"2023-01-01T00:00:00Z"}]`), nil)
+	mockStore.On("Get", mock.Anything, "ns-year/2024.json").Return(file(`[{"_id":"sameyear","type":"sgv","sgv":102,"dateString":"2024-01-01T00:00:00Z"}]`), nil)
+	mockStore.On("Get", mock.Anything, "ns-month/2024-11.json").Return(file(`[{"_id":"samemonth","type":"sgv","sgv":101,"dateString":"2024-11-01T00:00:00Z"},{"_id":"yesterday","type":"sgv","sgv":104,"dateString":"2024-11-27T00:00:00Z"}]`), nil)
+	// the day file for yesterday is superseded by the month file
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-27.json").Return(file(`[{"_id":"yesterday","type":"sgv","sgv":104,"dateString":"2024-11-27T00:00:00Z"}]`), nil)
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-28.json").Return(file(`null`), nil)
+	// append mode chunks
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-28/01.jsonl").Return(file(`{"_id":"today","type":"sgv","sgv":105,"dateString":"2024-11-28T09:00:00Z"}`+"\n"), nil)
+
+	var oids []string
+	err := repo.ExportEntries(ctx, func(e models.Entry) error {
+		oids = append(oids, e.Oid)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lastyear", "sameyear", "samemonth", "yesterday", "today"}, oids)
+	mockStore.AssertNotCalled(t, "Get", mock.Anything, "ns-year/2023-treatments.json")
+}
+
+func TestExportTreatments(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketExportRepository(mockStore)
+	ctx := contextWithSilentLogger()
+
+	mockStore.On("List", mock.Anything, "ns-year/").Return([]string{"ns-year/2024.json", "ns-year/2024-treatments.json"}, nil)
+	mockStore.On("List", mock.Anything, "ns-month/").Return([]string{}, nil)
+	mockStore.On("List", mock.Anything, "ns-day/").Return([]string{"ns-day/2024-11-28-treatments.json"}, nil)
+	mockStore.On("Get", mock.Anything, "ns-year/2024-treatments.json").Return(io.NopCloser(strings.NewReader(
+		`[{"_id":"t1","eventType":"Meal Bolus","created_at":"2024-03-01T12:00:00Z","insulin":4},{"_id":"bad","eventType":"Note"}]`)), nil)
+	mockStore.On("Get", mock.Anything, "ns-day/2024-11-28-treatments.json").Return(io.NopCloser(strings.NewReader("")), assert.AnError)
+
+	var treatments []models.Treatment
+	err := repo.ExportTreatments(ctx, func(t models.Treatment) error {
+		treatments = append(treatments, t)
+		return nil
+	})
+	assert.Error(t, err, "fetch errors are returned")
+	assert.Len(t, treatments, 1, "treatments without created_at are skipped")
+	assert.Equal(t, "Meal Bolus", treatments[0].Type)
+	assert.Equal(t, map[string]interface{}{"insulin": float64(4)}, treatments[0].Fields)
+}
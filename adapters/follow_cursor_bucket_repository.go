@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	"time"
+)
+
+// BucketFollowCursorRepository persists follow cursors to
+// ns-config/follow-cursor-<source>.json, one file per followed nightscout.
+type BucketFollowCursorRepository struct {
+	BucketStore BucketStoreInterface
+}
+
+type storedFollowCursor struct {
+	Source     string    `json:"source"`
+	Entries    time.Time `json:"entries"`
+	Treatments time.Time `json:"treatments"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+func NewBucketFollowCursorRepository(bs BucketStoreInterface) *BucketFollowCursorRepository {
+	return &BucketFollowCursorRepository{BucketStore: bs}
+}
+
+func followCursorFile(source string) string {
+	return fmt.Sprintf("ns-config/follow-cursor-%s.json", source)
+}
+
+// FetchFollowCursor returns the cursor for the given source, or
+// models.ErrNotFound if we have never followed it.
+func (p BucketFollowCursorRepository) FetchFollowCursor(ctx context.Context, source string) (*models.FollowCursor, error) {
+	r, err := p.BucketStore.Get(ctx, followCursorFile(source))
+	if err != nil {
+		if p.BucketStore.IsObjNotFoundErr(err) {
+			return nil, models.ErrNotFound
+		}
+		return nil, fmt.Errorf("cannot fetch follow cursor: %w", err)
+	}
+	defer r.Close()
+
+	var c storedFollowCursor
+	err = json.NewDecoder(r).Decode(&c)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse follow cursor: %w", err)
+	}
+	return &models.FollowCursor{
+		Source:     c.Source,
+		Entries:    c.Entries,
+		Treatments: c.Treatments,
+	}, nil
+}
+
+func (p BucketFollowCursorRepository) SaveFollowCursor(ctx context.Context, cursor models.FollowCursor) error {
+	j, err := json.Marshal(storedFollowCursor{
+		Source:     cursor.Source,
+		Entries:    cursor.Entries,
+		Treatments: cursor.Treatments,
+		UpdatedAt:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal follow cursor: %w", err)
+	}
+	err = p.BucketStore.Upload(ctx, followCursorFile(cursor.Source), bytes.NewReader(j))
+	if err != nil {
+		return fmt.Errorf("cannot upload follow cursor: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFollowCursorRepository(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	repo := NewBucketFollowCursorRepository(mockStore)
+	ctx := contextWithSilentLogger()
+
+	mockStore.On("Get", mock.Anything, "ns-config/follow-cursor-example.com.json").Return(io.NopCloser(strings.NewReader("")), errors.New("not found")).Once()
+	_, err := repo.FetchFollowCursor(ctx, "example.com")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	var saved bytes.Buffer
+	mockStore.On("Upload", mock.Anything, "ns-config/follow-cursor-example.com.json", mock.Anything).Run(func(args mock.Arguments) {
+		_, _ = io.Copy(&saved, args.Get(2).(io.Reader))
+	}).Return(nil)
+	cursor := models.FollowCursor{Source: "example.com", Entries: recent, Treatments: sameDay}
+	assert.NoError(t, repo.SaveFollowCursor(ctx, cursor))
+
+	mockStore.On("Get", mock.Anything, "ns-config/follow-cursor-example.com.json").Return(io.NopCloser(&saved), nil).Once()
+	fetched, err := repo.FetchFollowCursor(ctx, "example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, cursor, *fetched)
+}
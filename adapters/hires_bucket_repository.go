@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"sync"
+)
+
+// BucketHiresRepository keeps raw, high-resolution cgm readings in
+// ns-hires/<day>.json, separately from the main (often smoothed) entries.
+// LibreLinkUp only gives us smoothed 15-minute history, so without this the
+// 1-minute readings we see while polling would be lost.
+type BucketHiresRepository struct {
+	BucketStore  BucketStoreInterface
+	day          string
+	readings     []storedEntry
+	readingsLock sync.Mutex
+}
+
+func NewBucketHiresRepository(bs BucketStoreInterface) *BucketHiresRepository {
+	return &BucketHiresRepository{BucketStore: bs}
+}
+
+// AddReading appends a reading to its day file. Readings we already have
+// are ignored.
+func (p *BucketHiresRepository) AddReading(ctx context.Context, e models.Entry) error {
+	log := slogctx.FromCtx(ctx)
+	p.readingsLock.Lock()
+	defer p.readingsLock.Unlock()
+
+	day := e.Time.UTC().Format("2006-01-02")
+	if day != p.day {
+		readings, err := p.loadDay(ctx, day)
+		if err != nil {
+			return err
+		}
+		p.day = day
+		p.readings = readings
+	}
+
+	for i := len(p.readings) - 1; i >= 0; i-- {
+		if p.readings[i].Time.Equal(e.Time) {
+			return nil
+		}
+	}
+
+	p.readings = append(p.readings, storedEntry{
+		Time:        e.Time,
+		CreatedTime: e.CreatedTime,
+		Type:        e.Type,
+		Direction:   e.Direction,
+		Device:      e.Device,
+		SgvMgdl:     e.SgvMgdl,
+		UtcOffset:   e.UtcOffset,
+	})
+
+	j, err := json.Marshal(p.readings)
+	if err != nil {
+		return fmt.Errorf("hires cannot marshal readings: %w", err)
+	}
+	name := fmt.Sprintf("ns-hires/%s.json", day)
+	err = p.BucketStore.Upload(ctx, name, bytes.NewReader(j))
+	if err != nil {
+		return fmt.Errorf("hires cannot upload %s: %w", name, err)
+	}
+	log.Debug("hires reading stored", slog.String("name", name), slog.Int("numReadings", len(p.readings)))
+	return nil
+}
+
+func (p *BucketHiresRepository) loadDay(ctx context.Context, day string) ([]storedEntry, error) {
+	name := fmt.Sprintf("ns-hires/%s.json", day)
+	r, err := p.BucketStore.Get(ctx, name)
+	if err != nil {
+		if p.BucketStore.IsObjNotFoundErr(err) {
+			return []storedEntry{}, nil
+		}
+		return nil, fmt.Errorf("hires cannot fetch %s: %w", name, err)
+	}
+	defer r.Close()
+
+	var readings []storedEntry
+	err = json.NewDecoder(r).Decode(&readings)
+	if err != nil {
+		return nil, fmt.Errorf("hires cannot parse %s: %w", name, err)
+	}
+	return readings, nil
+}
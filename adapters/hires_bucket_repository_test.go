@@ -0,0 +1,36 @@
+package repository
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHiresAddReading(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	existing := `[{"dateString":"2024-11-28T09:00:00Z","sysTime":"2024-11-28T09:00:10Z","_id":"","type":"sgv","direction":"Flat","device":"llu ingestor/Libre2","sgv":101}]`
+	mockStore.On("Get", mock.Anything, "ns-hires/2024-11-28.json").Return(io.NopCloser(strings.NewReader(existing)), nil).Once()
+	mockStore.On("Get", mock.Anything, "ns-hires/2024-11-29.json").Return(io.NopCloser(strings.NewReader("")), errors.New("not found")).Once()
+	mockStore.On("Upload", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	repo := NewBucketHiresRepository(mockStore)
+	ctx := contextWithSilentLogger()
+
+	reading := models.Entry{Type: "sgv", SgvMgdl: 102, Direction: "Flat", Device: "llu ingestor/Libre2", Time: recent, CreatedTime: now}
+	assert.NoError(t, repo.AddReading(ctx, reading))
+	assert.Len(t, repo.readings, 2, "appended to existing day file")
+
+	assert.NoError(t, repo.AddReading(ctx, reading))
+	assert.Len(t, repo.readings, 2, "duplicate reading ignored")
+	mockStore.AssertNumberOfCalls(t, "Upload", 1)
+
+	reading.Time = recent.AddDate(0, 0, 1)
+	assert.NoError(t, repo.AddReading(ctx, reading))
+	assert.Len(t, repo.readings, 1, "new day file started")
+	mockStore.AssertCalled(t, "Upload", mock.Anything, "ns-hires/2024-11-29.json", mock.Anything)
+	mockStore.AssertExpectations(t)
+}
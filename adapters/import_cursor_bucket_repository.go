@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	"time"
+)
+
+// BucketImportCursorRepository persists import cursors to
+// ns-config/import-cursor-<source>.json, one file per remote source.
+type BucketImportCursorRepository struct {
+	BucketStore BucketStoreInterface
+}
+
+type storedImportCursor struct {
+	Source         string    `json:"source"`
+	Before         time.Time `json:"before"`
+	EntriesFetched int       `json:"entriesFetched"`
+	Complete       bool      `json:"complete"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+func NewBucketImportCursorRepository(bs BucketStoreInterface) *BucketImportCursorRepository {
+	return &BucketImportCursorRepository{BucketStore: bs}
+}
+
+func importCursorFile(source string) string {
+	return fmt.Sprintf("ns-config/import-cursor-%s.json", source)
+}
+
+// FetchImportCursor returns the cursor for the given source, or
+// models.ErrNotFound if we have never imported from it.
+func (p BucketImportCursorRepository) FetchImportCursor(ctx context.Context, source string) (*models.ImportCursor, error) {
+	r, err := p.BucketStore.Get(ctx, importCursorFile(source))
+	if err != nil {
+		if p.BucketStore.IsObjNotFoundErr(err) {
+			return nil, models.ErrNotFound
+		}
+		return nil, fmt.Errorf("cannot fetch import cursor: %w", err)
+	}
+	defer r.Close()
+
+	var c storedImportCursor
+	err = json.NewDecoder(r).Decode(&c)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse import cursor: %w", err)
+	}
+	return &models.ImportCursor{
+		Source:         c.Source,
+		Before:         c.Before,
+		EntriesFetched: c.EntriesFetched,
+		Complete:       c.Complete,
+	}, nil
+}
+
+func (p BucketImportCursorRepository) SaveImportCursor(ctx context.Context, cursor models.ImportCursor) error {
+	j, err := json.Marshal(storedImportCursor{
+		Source:         cursor.Source,
+		Before:         cursor.Before,
+		EntriesFetched: cursor.EntriesFetched,
+		Complete:       cursor.Complete,
+		UpdatedAt:      time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal import cursor: %w", err)
+	}
+	err = p.BucketStore.Upload(ctx, importCursorFile(cursor.Source), bytes.NewReader(j))
+	if err != nil {
+		return fmt.Errorf("cannot upload import cursor: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"time"
+)
+
+const bridgeCursorFile = "ns-config/bridge-cursor.json"
+
+// bridgeBatchSize limits the size of each POST to the remote nightscout
+const bridgeBatchSize = 500
+
+// bridgeTreatmentLookback is how far before the cursor we look for
+// treatments. Treatments are often entered after the fact (eg "bolus 20
+// minutes ago"), so an event-time cursor alone would miss them.
+const bridgeTreatmentLookback = 24 * time.Hour
+
+// bridgeCursor records how far we have pushed data to the remote nightscout.
+// Entries are tracked by created time, so backfilled entries are pushed too.
+type bridgeCursor struct {
+	EntriesCreatedAfter time.Time `json:"entriesCreatedAfter"`
+	TreatmentsAfter     time.Time `json:"treatmentsAfter"`
+}
+
+// NightscoutBridge pushes new entries and treatments to a remote nightscout
+// instance, so nightscout-go can act as a feeder for an existing hosted
+// nightscout. The cursor is persisted to the bucket so restarts do not re-send
+// everything.
+type NightscoutBridge struct {
+	BucketStore          BucketStoreInterface
+	EntryRepository      EntryRepository
+	TreatmentRepository  TreatmentRepository
+	NightscoutRepository *NightscoutRepository
+	Config               NightscoutConfig
+	cursor               bridgeCursor
+	uploadedTreatments   map[string]time.Time // oid => event time, within lookback
+}
+
+func NewNightscoutBridge(bs BucketStoreInterface, entryRepository EntryRepository, treatmentRepository TreatmentRepository, nsCfg NightscoutConfig) *NightscoutBridge {
+	return &NightscoutBridge{
+		BucketStore:          bs,
+		EntryRepository:      entryRepository,
+		TreatmentRepository:  treatmentRepository,
+		NightscoutRepository: NewNightscoutRepository(),
+		Config:               nsCfg,
+		uploadedTreatments:   make(map[string]time.Time),
+	}
+}
+
+// Boot loads the cursor from the bucket. If there is no cursor we start from
+// recent data only; historic data should be imported by the remote instance.
+func (b *NightscoutBridge) Boot(ctx context.Context) error {
+	log := slogctx.FromCtx(ctx)
+
+	r, err := b.BucketStore.Get(ctx, bridgeCursorFile)
+	if err != nil {
+		if b.BucketStore.IsObjNotFoundErr(err) {
+			start := time.Now().Add(-bridgeTreatmentLookback)
+			b.cursor = bridgeCursor{EntriesCreatedAfter: start, TreatmentsAfter: start}
+			log.Info("bridge: no cursor found, starting from recent data", slog.Time("start", start))
+			return nil
+		}
+		return fmt.Errorf("bridge cannot fetch cursor: %w", err)
+	}
+	defer r.Close()
+
+	err = json.NewDecoder(r).Decode(&b.cursor)
+	if err != nil {
+		return fmt.Errorf("bridge cannot parse cursor: %w", err)
+	}
+	log.Info("bridge: cursor loaded",
+		slog.Time("entriesCreatedAfter", b.cursor.EntriesCreatedAfter),
+		slog.Time("treatmentsAfter", b.cursor.TreatmentsAfter),
+	)
+	return nil
+}
+
+// Sync pushes everything added since the last sync. The cursor only moves
+// forward once data has been accepted by the remote instance.
+func (b *NightscoutBridge) Sync(ctx context.Context) error {
+	previous := b.cursor
+
+	entriesErr := b.syncEntries(ctx)
+	treatmentsErr := b.syncTreatments(ctx)
+
+	if b.cursor != previous {
+		err := b.saveCursor(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if entriesErr != nil {
+		return entriesErr
+	}
+	return treatmentsErr
+}
+
+func (b *NightscoutBridge) syncEntries(ctx context.Context) error {
+	log := slogctx.FromCtx(ctx)
+
+	entries, err := b.EntryRepository.FetchEntriesCreatedAfter(ctx, b.cursor.EntriesCreatedAfter)
+	if err != nil {
+		return fmt.Errorf("bridge cannot fetch entries: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// entries created together share a created time, so we only move the
+	// cursor once every batch has been sent.
+	for start := 0; start < len(entries); start += bridgeBatchSize {
+		end := min(start+bridgeBatchSize, len(entries))
+		err = b.NightscoutRepository.UploadEntries(ctx, b.Config, entries[start:end])
+		if err != nil {
+			return fmt.Errorf("bridge cannot upload entries: %w", err)
+		}
+	}
+	b.cursor.EntriesCreatedAfter = entries[len(entries)-1].CreatedTime
+
+	log.Info("bridge: uploaded entries", slog.Int("numEntries", len(entries)))
+	return nil
+}
+
+func (b *NightscoutBridge) syncTreatments(ctx context.Context) error {
+	log := slogctx.FromCtx(ctx)
+
+	treatments, err := b.TreatmentRepository.FetchTreatmentsAfter(ctx, b.cursor.TreatmentsAfter.Add(-bridgeTreatmentLookback))
+	if err != nil {
+		return fmt.Errorf("bridge cannot fetch treatments: %w", err)
+	}
+
+	var newTreatments []models.Treatment
+	for _, t := range treatments {
+		if _, ok := b.uploadedTreatments[t.ID]; ok {
+			continue
+		}
+		newTreatments = append(newTreatments, t)
+	}
+
+	for start := 0; start < len(newTreatments); start += bridgeBatchSize {
+		end := min(start+bridgeBatchSize, len(newTreatments))
+		batch := newTreatments[start:end]
+		err = b.NightscoutRepository.UploadTreatments(ctx, b.Config, batch)
+		if err != nil {
+			return fmt.Errorf("bridge cannot upload treatments: %w", err)
+		}
+		for _, t := range batch {
+			b.uploadedTreatments[t.ID] = t.Time
+			// future treatments must not push the cursor past now
+			if t.Time.After(b.cursor.TreatmentsAfter) && t.Time.Before(time.Now()) {
+				b.cursor.TreatmentsAfter = t.Time
+			}
+		}
+	}
+
+	oldest := b.cursor.TreatmentsAfter.Add(-bridgeTreatmentLookback)
+	for oid, t := range b.uploadedTreatments {
+		if t.Before(oldest) {
+			delete(b.uploadedTreatments, oid)
+		}
+	}
+
+	if len(newTreatments) > 0 {
+		log.Info("bridge: uploaded treatments", slog.Int("numTreatments", len(newTreatments)))
+	}
+	return nil
+}
+
+func (b *NightscoutBridge) saveCursor(ctx context.Context) error {
+	j, err := json.Marshal(b.cursor)
+	if err != nil {
+		return fmt.Errorf("bridge cannot marshal cursor: %w", err)
+	}
+	err = b.BucketStore.Upload(ctx, bridgeCursorFile, bytes.NewReader(j))
+	if err != nil {
+		return fmt.Errorf("bridge cannot upload cursor: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNightscoutBridgeSync(t *testing.T) {
+	var uploaded = map[string][]map[string]interface{}{}
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "sometoken-1234567", r.URL.Query().Get("token"))
+		var docs []map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&docs)
+		uploaded[r.URL.Path] = append(uploaded[r.URL.Path], docs...)
+	}))
+	defer remote.Close()
+	remoteURL, _ := url.Parse(remote.URL)
+
+	mockStore := &MockBucketStore{}
+	mockStore.On("Upload", mock.Anything, bridgeCursorFile, mock.Anything).Return(nil)
+	entryRepository := NewBucketEntryRepository(mockStore)
+	treatmentRepository := NewBucketTreatmentRepository(mockStore)
+	entryRepository.memStore.entries = []memEntry{sameDayEntry, recentEntry}
+	entryRepository.memStore.entries[0].CreatedTime = recent
+	treatmentRepository.memTreatmentStore.treatments = []memTreatment{
+		{Oid: "old", Type: "Note", Time: lastYear},
+		{Oid: "recent", Type: "Note", Time: recent, fields: map[string]interface{}{"notes": "hi"}},
+	}
+
+	bridge := NewNightscoutBridge(mockStore, entryRepository, treatmentRepository, NightscoutConfig{URL: remoteURL, Token: "sometoken-1234567"})
+	bridge.cursor = bridgeCursor{EntriesCreatedAfter: recent, TreatmentsAfter: sameDay}
+
+	err := bridge.Sync(contextWithSilentLogger())
+	assert.NoError(t, err)
+
+	// only entries created after the cursor are sent
+	assert.Len(t, uploaded["/api/v1/entries"], 1)
+	assert.Equal(t, float64(98), uploaded["/api/v1/entries"][0]["sgv"])
+	assert.Equal(t, now, bridge.cursor.EntriesCreatedAfter)
+
+	// treatments within the lookback window are sent
+	assert.Len(t, uploaded["/api/v1/treatments"], 1)
+	assert.Equal(t, "hi", uploaded["/api/v1/treatments"][0]["notes"])
+	assert.Equal(t, "Note", uploaded["/api/v1/treatments"][0]["eventType"])
+	assert.Equal(t, recent, bridge.cursor.TreatmentsAfter)
+	mockStore.AssertNumberOfCalls(t, "Upload", 1)
+
+	// nothing new: nothing is re-sent and the cursor is not re-saved
+	err = bridge.Sync(contextWithSilentLogger())
+	assert.NoError(t, err)
+	assert.Len(t, uploaded["/api/v1/entries"], 1)
+	assert.Len(t, uploaded["/api/v1/treatments"], 1)
+	mockStore.AssertNumberOfCalls(t, "Upload", 1)
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/adamlounds/nightscout-go/models"
 	nightscoutstore "github.com/adamlounds/nightscout-go/stores/nightscout"
 	"net/url"
+	"time"
 )
 
 type NightscoutRepository struct{}
@@ -20,11 +21,42 @@ func NewNightscoutRepository() *NightscoutRepository {
 	return &NightscoutRepository{}
 }
 
-func (b *NightscoutRepository) FetchAllEntries(ctx context.Context, nsCfg NightscoutConfig) ([]models.Entry, error) {
-	store := nightscoutstore.New(nightscoutstore.NightscoutConfig{
+func (b *NightscoutRepository) FetchEntriesBefore(ctx context.Context, nsCfg NightscoutConfig, before time.Time, count int) ([]models.Entry, error) {
+	return b.store(nsCfg).FetchEntriesBefore(ctx, before, count)
+}
+
+func (b *NightscoutRepository) FetchAllTreatments(ctx context.Context, nsCfg NightscoutConfig) ([]models.Treatment, error) {
+	return b.store(nsCfg).FetchAllTreatments(ctx)
+}
+
+func (b *NightscoutRepository) FetchProfiles(ctx context.Context, nsCfg NightscoutConfig) ([]models.Profile, error) {
+	return b.store(nsCfg).FetchProfiles(ctx)
+}
+
+func (b *NightscoutRepository) FetchDeviceStatusSince(ctx context.Context, nsCfg NightscoutConfig, since time.Time) ([]models.DeviceStatus, error) {
+	return b.store(nsCfg).FetchDeviceStatusSince(ctx, since)
+}
+
+func (b *NightscoutRepository) FetchEntriesSince(ctx context.Context, nsCfg NightscoutConfig, since time.Time, count int) ([]models.Entry, error) {
+	return b.store(nsCfg).FetchEntriesSince(ctx, since, count)
+}
+
+func (b *NightscoutRepository) FetchTreatmentsSince(ctx context.Context, nsCfg NightscoutConfig, since time.Time, count int) ([]models.Treatment, error) {
+	return b.store(nsCfg).FetchTreatmentsSince(ctx, since, count)
+}
+
+func (b *NightscoutRepository) UploadEntries(ctx context.Context, nsCfg NightscoutConfig, entries []models.Entry) error {
+	return b.store(nsCfg).UploadEntries(ctx, entries)
+}
+
+func (b *NightscoutRepository) UploadTreatments(ctx context.Context, nsCfg NightscoutConfig, treatments []models.Treatment) error {
+	return b.store(nsCfg).UploadTreatments(ctx, treatments)
+}
+
+func (b *NightscoutRepository) store(nsCfg NightscoutConfig) *nightscoutstore.NightscoutStore {
+	return nightscoutstore.New(nightscoutstore.NightscoutConfig{
 		URL:       nsCfg.URL,
 		Token:     nsCfg.Token,
 		APISecret: nsCfg.APISecret,
 	})
-	return store.FetchAllEntries(ctx)
 }
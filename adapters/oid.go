@@ -0,0 +1,149 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/oklog/ulid/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"sync"
+	"time"
+)
+
+// IDStrategy decides the ids entries and treatments are held and stored
+// under. Clients always see 24-hexit mongo-style oids: a stored id is mapped
+// to its oid with oidOf as it leaves a repository, and an oid to the stored
+// id with StoredID as it comes in.
+type IDStrategy interface {
+	// NewID returns the id for an entry or treatment created at t
+	NewID(t time.Time) string
+	// StoredID returns the id that an oid, or a stored id of any strategy, is
+	// held under
+	StoredID(id string) string
+}
+
+// NewIDStrategy returns the named strategy, "objectid" (the default) or "ulid"
+func NewIDStrategy(name string) (IDStrategy, error) {
+	switch name {
+	case "", "objectid":
+		return objectIDStrategy{}, nil
+	case "ulid":
+		return &ulidStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown id strategy %q", name)
+}
+
+func newOid(t time.Time) string {
+	return primitive.NewObjectIDFromTimestamp(t).Hex()
+}
+
+// objectIDStrategy stores mongo ObjectIDs, so stored ids are oids
+type objectIDStrategy struct{}
+
+func (objectIDStrategy) NewID(t time.Time) string { return newOid(t) }
+
+func (objectIDStrategy) StoredID(id string) string { return oidOf(id) }
+
+// ulidStrategy stores ULIDs. ULIDs and oids map one to one: an oid is a
+// 32-bit timestamp in seconds and 64 further bits, a ULID a 48-bit timestamp
+// in milliseconds and 80 bits of entropy. An oid maps to a ULID at the start
+// of its second whose entropy is its 64 bits, zero-padded, and a ULID of that
+// form maps back. ULIDs generated here are of that form and monotonic within
+// each second, so they sort in the order they were created.
+type ulidStrategy struct {
+	lock sync.Mutex
+	last ulid.ULID
+}
+
+func (s *ulidStrategy) NewID(t time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ms := uint64(t.Unix()) * 1000
+	id := s.last
+	if id.Time() == ms {
+		binary.BigEndian.PutUint64(id[8:], binary.BigEndian.Uint64(id[8:])+1)
+	} else {
+		id = ulid.ULID{}
+		_ = id.SetTime(ms)
+		_, _ = rand.Read(id[8:])
+		id[8] &= 0x7f // room to count up within the second
+	}
+	s.last = id
+	return id.String()
+}
+
+func (s *ulidStrategy) StoredID(id string) string {
+	oid, err := primitive.ObjectIDFromHex(oidOf(id))
+	if err != nil {
+		// not an oid, eg an identifier chosen by an uploader
+		return id
+	}
+	return ulidFromOid(oid).String()
+}
+
+// oidOf returns the oid for a stored id of any strategy. Ids that are not
+// ULIDs mapped from oids are returned as they are.
+func oidOf(id string) string {
+	if len(id) != ulid.EncodedSize {
+		return id
+	}
+	u, err := ulid.ParseStrict(id)
+	if err != nil {
+		return id
+	}
+	oid, ok := oidFromULID(u)
+	if !ok {
+		return id
+	}
+	return oid.Hex()
+}
+
+func ulidFromOid(oid primitive.ObjectID) ulid.ULID {
+	var u ulid.ULID
+	_ = u.SetTime(uint64(binary.BigEndian.Uint32(oid[:4])) * 1000)
+	copy(u[8:], oid[4:])
+	return u
+}
+
+// oidFromULID reverses ulidFromOid, failing for ULIDs not of its form
+func oidFromULID(u ulid.ULID) (primitive.ObjectID, bool) {
+	var oid primitive.ObjectID
+	ms := u.Time()
+	if ms%1000 != 0 || ms/1000 > math.MaxUint32 || u[6] != 0 || u[7] != 0 {
+		return oid, false
+	}
+	binary.BigEndian.PutUint32(oid[:4], uint32(ms/1000))
+	copy(oid[4:], u[8:])
+	return oid, true
+}
+
+// oidIndex finds a record in a store's slice by stored id without scanning
+// it. It is built on first use and kept current by add. Anything that moves
+// records (sorting, deleting) must reset it, so it is rebuilt on next use.
+// Callers must hold the store's lock.
+type oidIndex map[string]int
+
+// lookup returns the position of oid in a slice of n records, where oidAt
+// returns the oid of the record at position i
+func (idx *oidIndex) lookup(n int, oidAt func(i int) string, oid string) (int, bool) {
+	if *idx == nil {
+		*idx = make(oidIndex, n)
+		for i := 0; i < n; i++ {
+			(*idx)[oidAt(i)] = i
+		}
+	}
+	i, ok := (*idx)[oid]
+	return i, ok
+}
+
+// add records that oid has been appended at position i
+func (idx *oidIndex) add(oid string, i int) {
+	if *idx != nil {
+		(*idx)[oid] = i
+	}
+}
+
+func (idx *oidIndex) reset() {
+	*idx = nil
+}
@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestObjectIDStrategy(t *testing.T) {
+	s := objectIDStrategy{}
+	seen := make(map[string]struct{})
+	for i := 0; i < 1000; i++ {
+		oid := s.NewID(now)
+		objectID, err := primitive.ObjectIDFromHex(oid)
+		assert.NoError(t, err)
+		assert.Equal(t, now, objectID.Timestamp().UTC())
+		assert.Equal(t, oid, s.StoredID(oid))
+		seen[oid] = struct{}{}
+	}
+	assert.Len(t, seen, 1000, "oids are unique")
+}
+
+func TestULIDStrategy(t *testing.T) {
+	s := &ulidStrategy{}
+	var last string
+	for i := 0; i < 1000; i++ {
+		id := s.NewID(now.Add(time.Duration(i) * time.Millisecond))
+		assert.Len(t, id, 26)
+		assert.Greater(t, id, last, "ids sort in creation order")
+		last = id
+
+		// ulid -> oid -> ulid
+		oid := oidOf(id)
+		objectID, err := primitive.ObjectIDFromHex(oid)
+		assert.NoError(t, err)
+		assert.Equal(t, now, objectID.Timestamp().UTC())
+		assert.Equal(t, id, s.StoredID(oid))
+		assert.Equal(t, id, s.StoredID(id))
+		assert.Equal(t, oid, objectIDStrategy{}.StoredID(id))
+	}
+	assert.Greater(t, s.NewID(now.Add(time.Second)), last)
+
+	// oid -> ulid -> oid
+	for i := 0; i < 1000; i++ {
+		oid := primitive.NewObjectIDFromTimestamp(now).Hex()
+		id := s.StoredID(oid)
+		u, err := ulid.ParseStrict(id)
+		assert.NoError(t, err)
+		assert.Equal(t, ulid.Timestamp(now), u.Time())
+		assert.Equal(t, oid, oidOf(id))
+	}
+	assert.Equal(t, "00000000000000000000000000", s.StoredID("000000000000000000000000"))
+	assert.Equal(t, "ffffffffffffffffffffffff", oidOf(s.StoredID("ffffffffffffffffffffffff")))
+
+	// ids that are not oids, or ULIDs mapped from them, are left alone
+	for _, id := range []string{"", "uploader-chosen-id", "not-hex-but-24-chars-lng", ulid.Make().String()} {
+		assert.Equal(t, id, s.StoredID(id))
+		assert.Equal(t, id, objectIDStrategy{}.StoredID(id))
+		assert.Equal(t, id, oidOf(id))
+	}
+}
+
+func TestNewIDStrategy(t *testing.T) {
+	s, err := NewIDStrategy("")
+	assert.NoError(t, err)
+	assert.IsType(t, objectIDStrategy{}, s)
+	s, err = NewIDStrategy("ulid")
+	assert.NoError(t, err)
+	assert.IsType(t, &ulidStrategy{}, s)
+	_, err = NewIDStrategy("sequential")
+	assert.Error(t, err)
+}
+
+func TestOidIndex(t *testing.T) {
+	oids := []string{"a", "b", "c"}
+	oidAt := func(i int) string { return oids[i] }
+	var idx oidIndex
+
+	idx.add("ignored", 5) // not built yet
+	i, ok := idx.lookup(len(oids), oidAt, "b")
+	assert.True(t, ok)
+	assert.Equal(t, 1, i)
+	_, ok = idx.lookup(len(oids), oidAt, "ignored")
+	assert.False(t, ok)
+
+	oids = append(oids, "d")
+	idx.add("d", 3)
+	i, ok = idx.lookup(len(oids), oidAt, "d")
+	assert.True(t, ok)
+	assert.Equal(t, 3, i)
+
+	oids = []string{"d", "c"}
+	idx.reset()
+	i, ok = idx.lookup(len(oids), oidAt, "c")
+	assert.True(t, ok)
+	assert.Equal(t, 1, i)
+	_, ok = idx.lookup(len(oids), oidAt, "a")
+	assert.False(t, ok)
+}
@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+const profilesFile = "ns-profile/profiles.json"
+
+// BucketProfileRepository keeps all profiles in a single file. There are
+// rarely more than a few hundred profiles, even after years of use, so they
+// are all held in memory, oldest first.
+type BucketProfileRepository struct {
+	BucketStore  BucketStoreInterface
+	profiles     []models.Profile
+	profilesLock sync.Mutex
+}
+
+func NewBucketProfileRepository(bs BucketStoreInterface) *BucketProfileRepository {
+	return &BucketProfileRepository{
+		BucketStore: bs,
+	}
+}
+
+// Boot fetches all profiles into memory, typically at server startup
+func (p *BucketProfileRepository) Boot(ctx context.Context) error {
+	log := slogctx.FromCtx(ctx)
+
+	r, err := p.BucketStore.Get(ctx, profilesFile)
+	if err != nil {
+		if p.BucketStore.IsObjNotFoundErr(err) {
+			log.Debug("boot: no profiles found (not written yet?)")
+			return nil
+		}
+		return fmt.Errorf("cannot fetch profiles: %w", err)
+	}
+	defer r.Close()
+
+	var stored []map[string]interface{}
+	err = json.NewDecoder(r).Decode(&stored)
+	if err != nil {
+		return fmt.Errorf("cannot parse profiles: %w", err)
+	}
+
+	p.profilesLock.Lock()
+	defer p.profilesLock.Unlock()
+	p.profiles = p.profiles[:0]
+	for _, s := range stored {
+		profile, ok := profileFromDocument(s)
+		if !ok {
+			log.Warn("boot: skipping profile without _id or startDate", slog.Any("profile", s))
+			continue
+		}
+		p.profiles = append(p.profiles, profile)
+	}
+	sortProfiles(p.profiles)
+
+	log.Info("boot: all profiles loaded", slog.Int("numProfiles", len(p.profiles)))
+	return nil
+}
+
+// FetchProfiles returns all profiles, most recent first, as nightscout does
+func (p *BucketProfileRepository) FetchProfiles(ctx context.Context) ([]models.Profile, error) {
+	p.profilesLock.Lock()
+	defer p.profilesLock.Unlock()
+
+	profiles := slices.Clone(p.profiles)
+	slices.Reverse(profiles)
+	return profiles, nil
+}
+
+// CreateProfiles stores new profiles. Profiles we already have (by oid) are
+// skipped, so imports can be re-run.
+func (p *BucketProfileRepository) CreateProfiles(ctx context.Context, profiles []models.Profile) ([]models.Profile, error) {
+	if len(profiles) == 0 {
+		return nil, nil
+	}
+	now := time.Now()
+
+	p.profilesLock.Lock()
+	defer p.profilesLock.Unlock()
+
+	var created []models.Profile
+	for _, profile := range profiles {
+		if profile.ID == "" {
+			profile.ID = newOid(now)
+		} else if slices.ContainsFunc(p.profiles, func(e models.Profile) bool { return e.ID == profile.ID }) {
+			continue
+		}
+		if profile.Time.IsZero() {
+			profile.Time = now
+		}
+		delete(profile.Fields, "_id")
+		delete(profile.Fields, "startDate")
+		p.profiles = append(p.profiles, profile)
+		created = append(created, profile)
+	}
+	if len(created) == 0 {
+		return nil, nil
+	}
+	sortProfiles(p.profiles)
+
+	err := p.writeProfiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// writeProfiles uploads all profiles. Callers must hold profilesLock.
+func (p *BucketProfileRepository) writeProfiles(ctx context.Context) error {
+	stored := make([]map[string]interface{}, len(p.profiles))
+	for i, profile := range p.profiles {
+		stored[i] = profileDocument(profile)
+	}
+	j, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("cannot marshal profiles: %w", err)
+	}
+	err = p.BucketStore.Upload(ctx, profilesFile, bytes.NewReader(j))
+	if err != nil {
+		return fmt.Errorf("cannot upload profiles: %w", err)
+	}
+	return nil
+}
+
+func sortProfiles(profiles []models.Profile) {
+	slices.SortStableFunc(profiles, func(a, b models.Profile) int {
+		return a.Time.Compare(b.Time)
+	})
+}
+
+// profileFromDocument converts a nightscout profile document. startDate is
+// when the profile takes effect, falling back to created_at.
+func profileFromDocument(d map[string]interface{}) (models.Profile, bool) {
+	oid, _ := d["_id"].(string)
+	if oid == "" {
+		return models.Profile{}, false
+	}
+	var startTime time.Time
+	for _, k := range []string{"startDate", "created_at"} {
+		s, _ := d[k].(string)
+		t, err := time.Parse(time.RFC3339, s)
+		if err == nil {
+			startTime = t
+			break
+		}
+	}
+	if startTime.IsZero() {
+		return models.Profile{}, false
+	}
+
+	fields := make(map[string]interface{}, len(d))
+	for k, v := range d {
+		fields[k] = v
+	}
+	delete(fields, "_id")
+	delete(fields, "startDate")
+	return models.Profile{ID: oid, Time: startTime, Fields: fields}, true
+}
+
+func profileDocument(profile models.Profile) map[string]interface{} {
+	d := make(map[string]interface{}, len(profile.Fields)+2)
+	for k, v := range profile.Fields {
+		d[k] = v
+	}
+	d["_id"] = profile.ID
+	d["startDate"] = profile.Time.UTC().Format(time.RFC3339)
+	return d
+}
@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestProfileRepository(t *testing.T) {
+	mockStore := &MockBucketStore{}
+	stored := `[{"_id":"older","startDate":"2024-01-01T00:00:00Z","defaultProfile":"Default"},{"_id":"bad"}]`
+	mockStore.On("Get", mock.Anything, profilesFile).Return(io.NopCloser(strings.NewReader(stored)), nil)
+	mockStore.On("Upload", mock.Anything, profilesFile, mock.Anything).Return(nil)
+	repo := NewBucketProfileRepository(mockStore)
+	ctx := contextWithSilentLogger()
+
+	assert.NoError(t, repo.Boot(ctx))
+	profiles, err := repo.FetchProfiles(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, profiles, 1, "profile without startDate skipped")
+	assert.Equal(t, "Default", profiles[0].Fields["defaultProfile"])
+
+	created, err := repo.CreateProfiles(ctx, []models.Profile{
+		{ID: "older", Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: "newer", Time: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), Fields: map[string]interface{}{"_id": "newer", "units": "mmol"}},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, created, 1, "existing profile skipped")
+
+	profiles, _ = repo.FetchProfiles(ctx)
+	assert.Equal(t, "newer", profiles[0].ID, "most recent first")
+	assert.Equal(t, map[string]interface{}{"units": "mmol"}, profiles[0].Fields)
+	mockStore.AssertNumberOfCalls(t, "Upload", 1)
+
+	_, err = repo.CreateProfiles(ctx, []models.Profile{{ID: "newer"}})
+	assert.NoError(t, err)
+	mockStore.AssertNumberOfCalls(t, "Upload", 1)
+}
@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"time"
+)
+
+// dayFileDirs hold one file per day of data that is neither an entry nor a
+// treatment
+var dayFileDirs = []string{"ns-devicestatus/", "ns-hires/"}
+
+// Purger removes data by time range, to enforce retention or when asked by an
+// admin (eg to remove a misbehaving uploader's readings)
+type Purger struct {
+	EntryRepository     EntryRepository
+	TreatmentRepository TreatmentRepository
+	BucketStore         BucketStoreInterface
+}
+
+func NewPurger(entries EntryRepository, treatments TreatmentRepository, bs BucketStoreInterface) *Purger {
+	return &Purger{
+		EntryRepository:     entries,
+		TreatmentRepository: treatments,
+		BucketStore:         bs,
+	}
+}
+
+// Purge removes entries with an event time in [from, to), only those from
+// device if it is set. Without a device, treatments in the range are removed
+// too, as are device status and hires day files wholly within it.
+func (p Purger) Purge(ctx context.Context, from, to time.Time, device string) (models.PurgeResult, error) {
+	var result models.PurgeResult
+	var err error
+	result.Entries, err = p.EntryRepository.PurgeEntries(ctx, from, to, device)
+	if err != nil {
+		return result, fmt.Errorf("cannot purge entries: %w", err)
+	}
+	if device != "" {
+		return result, nil
+	}
+
+	result.Treatments, err = p.TreatmentRepository.PurgeTreatments(ctx, from, to)
+	if err != nil {
+		return result, fmt.Errorf("cannot purge treatments: %w", err)
+	}
+
+	bs, ok := p.BucketStore.(BucketPurgeInterface)
+	if !ok {
+		slogctx.FromCtx(ctx).Warn("cannot purge day files, bucket store cannot list and delete objects")
+		return result, nil
+	}
+	err = purgeObjects(ctx, bs, dayFileDirs, from, to, func(name string, whole bool) error {
+		if !whole {
+			return nil
+		}
+		result.Files++
+		return rewriteObject(ctx, bs, name, nil, true)
+	})
+	if err != nil {
+		return result, fmt.Errorf("cannot purge day files: %w", err)
+	}
+	return result, nil
+}
+
+// PurgeBefore enforces retention, purging everything before the start of the
+// day keepDays ago
+func (p Purger) PurgeBefore(ctx context.Context, now time.Time, keepDays int) (models.PurgeResult, error) {
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	cutoff := startOfDay.AddDate(0, 0, -keepDays)
+	slogctx.FromCtx(ctx).Debug("enforcing retention", slog.Time("cutoff", cutoff))
+	return p.Purge(ctx, time.Time{}, cutoff, "")
+}
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/adamlounds/nightscout-go/models"
+	redisstore "github.com/adamlounds/nightscout-go/stores/redis"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"time"
+)
+
+// In multi-instance deployments the latest entries, sgvs and treatments are
+// kept in redis, so read-heavy follower traffic is served from there rather
+// than from a single instance's memory or the bucket.
+//
+// The cached lists are refreshed by whichever instance handles a write, from
+// its own repository. They are never populated at boot or on a miss, as an
+// instance that has not seen recent writes would overwrite a newer list with
+// a stale one. Reads the cached list cannot fully answer (more items than we
+// cache, or an older maxTime) fall through to the wrapped repository.
+
+const (
+	cacheKeyEntries    = "nightscout:entries:latest"
+	cacheKeySGVs       = "nightscout:sgvs:latest"
+	cacheKeyTreatments = "nightscout:treatments:latest"
+)
+
+// cacheHorizon is how far past the time of caching a list is fetched, so
+// reads made after the list was cached (with a later maxTime) still see
+// entries that were in the future when it was cached
+const cacheHorizon = 24 * time.Hour
+
+type CacheStoreInterface interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+}
+
+// cachedList is the latest items with a time at or before MaxTime, newest
+// first. Complete is set when there were fewer items than we cache, ie the
+// list holds everything up to MaxTime.
+type cachedList[T any] struct {
+	MaxTime  time.Time
+	Complete bool
+	Items    []T
+}
+
+// latest returns up to count items at or before maxTime, or false if the
+// list cannot tell us
+func (c cachedList[T]) latest(maxTime time.Time, count int, itemTime func(T) time.Time) ([]T, bool) {
+	if maxTime.After(c.MaxTime) {
+		return nil, false
+	}
+	items := make([]T, 0, min(count, len(c.Items)))
+	for _, item := range c.Items {
+		if itemTime(item).After(maxTime) {
+			continue
+		}
+		items = append(items, item)
+		if len(items) == count {
+			return items, true
+		}
+	}
+	return items, c.Complete
+}
+
+func loadCachedList[T any](ctx context.Context, cache CacheStoreInterface, key string) (*cachedList[T], bool) {
+	b, err := cache.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, redisstore.ErrCacheMiss) {
+			slogctx.FromCtx(ctx).Warn("cannot read cache", slog.String("key", key), slog.Any("error", err))
+		}
+		return nil, false
+	}
+	var list cachedList[T]
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("cannot decode cache", slog.String("key", key), slog.Any("error", err))
+		return nil, false
+	}
+	return &list, true
+}
+
+func storeCachedList[T any](ctx context.Context, cache CacheStoreInterface, key string, ttl time.Duration, maxTime time.Time, size int, items []T) {
+	b, err := json.Marshal(cachedList[T]{
+		MaxTime:  maxTime,
+		Complete: len(items) < size,
+		Items:    items,
+	})
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("cannot encode cache", slog.String("key", key), slog.Any("error", err))
+		return
+	}
+	err = cache.Set(ctx, key, b, ttl)
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("cannot write cache", slog.String("key", key), slog.Any("error", err))
+	}
+}
+
+func entryTime(e models.Entry) time.Time         { return e.Time }
+func treatmentTime(t models.Treatment) time.Time { return t.Time }
+
+// CachedEntryRepository serves the latest entries and sgvs from Cache,
+// refreshing it from the wrapped repository when entries are created
+type CachedEntryRepository struct {
+	EntryRepository
+	Cache CacheStoreInterface
+	Size  int // number of entries and sgvs cached
+	TTL   time.Duration
+}
+
+func NewCachedEntryRepository(r EntryRepository, cache CacheStoreInterface) *CachedEntryRepository {
+	return &CachedEntryRepository{
+		EntryRepository: r,
+		Cache:           cache,
+		Size:            1000,
+		TTL:             time.Hour,
+	}
+}
+
+func (p CachedEntryRepository) FetchLatestEntries(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+	if list, ok := loadCachedList[models.Entry](ctx, p.Cache, cacheKeyEntries); ok {
+		if entries, ok := list.latest(maxTime, maxEntries, entryTime); ok {
+			return entries, nil
+		}
+	}
+	return p.EntryRepository.FetchLatestEntries(ctx, maxTime, maxEntries)
+}
+
+func (p CachedEntryRepository) FetchLatestSGVs(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+	if list, ok := loadCachedList[models.Entry](ctx, p.Cache, cacheKeySGVs); ok {
+		if entries, ok := list.latest(maxTime, maxEntries, entryTime); ok {
+			return entries, nil
+		}
+	}
+	return p.EntryRepository.FetchLatestSGVs(ctx, maxTime, maxEntries)
+}
+
+func (p CachedEntryRepository) FetchLatestSgvEntry(ctx context.Context, maxTime time.Time) (*models.Entry, error) {
+	if list, ok := loadCachedList[models.Entry](ctx, p.Cache, cacheKeySGVs); ok {
+		if entries, ok := list.latest(maxTime, 1, entryTime); ok {
+			if len(entries) == 0 {
+				return nil, models.ErrNotFound
+			}
+			return &entries[0], nil
+		}
+	}
+	return p.EntryRepository.FetchLatestSgvEntry(ctx, maxTime)
+}
+
+func (p CachedEntryRepository) CreateEntries(ctx context.Context, entries []models.Entry) []models.Entry {
+	createdEntries := p.EntryRepository.CreateEntries(ctx, entries)
+	if len(createdEntries) > 0 {
+		p.refresh(ctx)
+	}
+	return createdEntries
+}
+
+func (p CachedEntryRepository) PurgeEntries(ctx context.Context, from, to time.Time, device string) (int, error) {
+	numPurged, err := p.EntryRepository.PurgeEntries(ctx, from, to, device)
+	if numPurged > 0 {
+		p.refresh(ctx)
+	}
+	return numPurged, err
+}
+
+func (p CachedEntryRepository) refresh(ctx context.Context) {
+	log := slogctx.FromCtx(ctx)
+	maxTime := time.Now().Add(cacheHorizon)
+	entries, err := p.EntryRepository.FetchLatestEntries(ctx, maxTime, p.Size)
+	if err != nil {
+		log.Warn("cannot fetch entries to cache", slog.Any("error", err))
+	} else {
+		storeCachedList(ctx, p.Cache, cacheKeyEntries, p.TTL, maxTime, p.Size, entries)
+	}
+	sgvs, err := p.EntryRepository.FetchLatestSGVs(ctx, maxTime, p.Size)
+	if err != nil {
+		log.Warn("cannot fetch sgvs to cache", slog.Any("error", err))
+		return
+	}
+	storeCachedList(ctx, p.Cache, cacheKeySGVs, p.TTL, maxTime, p.Size, sgvs)
+}
+
+// CachedTreatmentRepository serves the latest treatments from Cache,
+// refreshing it from the wrapped repository when treatments change
+type CachedTreatmentRepository struct {
+	TreatmentRepository
+	Cache CacheStoreInterface
+	Size  int // number of treatments cached
+	TTL   time.Duration
+}
+
+func NewCachedTreatmentRepository(r TreatmentRepository, cache CacheStoreInterface) *CachedTreatmentRepository {
+	return &CachedTreatmentRepository{
+		TreatmentRepository: r,
+		Cache:               cache,
+		Size:                1000,
+		TTL:                 time.Hour,
+	}
+}
+
+func (p CachedTreatmentRepository) FetchLatestTreatments(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error) {
+	if list, ok := loadCachedList[models.Treatment](ctx, p.Cache, cacheKeyTreatments); ok {
+		if treatments, ok := list.latest(maxTime, maxTreatments, treatmentTime); ok {
+			return treatments, nil
+		}
+	}
+	return p.TreatmentRepository.FetchLatestTreatments(ctx, maxTime, maxTreatments)
+}
+
+func (p CachedTreatmentRepository) CreateTreatments(ctx context.Context, treatments []models.Treatment) []models.Treatment {
+	createdTreatments := p.TreatmentRepository.CreateTreatments(ctx, treatments)
+	if len(createdTreatments) > 0 {
+		p.refresh(ctx)
+	}
+	return createdTreatments
+}
+
+func (p CachedTreatmentRepository) UpdateTreatmentByOid(ctx context.Context, oid string, treatment *models.Treatment) error {
+	err := p.TreatmentRepository.UpdateTreatmentByOid(ctx, oid, treatment)
+	if err != nil {
+		return err
+	}
+	p.refresh(ctx)
+	return nil
+}
+
+func (p CachedTreatmentRepository) DeleteTreatmentByOid(ctx context.Context, oid string) error {
+	err := p.TreatmentRepository.DeleteTreatmentByOid(ctx, oid)
+	if err != nil {
+		return err
+	}
+	p.refresh(ctx)
+	return nil
+}
+
+func (p CachedTreatmentRepository) PurgeTreatments(ctx context.Context, from, to time.Time) (int, error) {
+	numPurged, err := p.TreatmentRepository.PurgeTreatments(ctx, from, to)
+	if numPurged > 0 {
+		p.refresh(ctx)
+	}
+	return numPurged, err
+}
+
+func (p CachedTreatmentRepository) refresh(ctx context.Context) {
+	maxTime := time.Now().Add(cacheHorizon)
+	treatments, err := p.TreatmentRepository.FetchLatestTreatments(ctx, maxTime, p.Size)
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("cannot fetch treatments to cache", slog.Any("error", err))
+		return
+	}
+	storeCachedList(ctx, p.Cache, cacheKeyTreatments, p.TTL, maxTime, p.Size, treatments)
+}
@@ -0,0 +1,130 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	redisstore "github.com/adamlounds/nightscout-go/stores/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCacheStore map[string][]byte
+
+func (f fakeCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, ok := f[key]
+	if !ok {
+		return nil, redisstore.ErrCacheMiss
+	}
+	return b, nil
+}
+
+func (f fakeCacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	f[key] = value
+	return nil
+}
+
+// latestEntryRepository holds entries newest first, counting fetches
+type latestEntryRepository struct {
+	EntryRepository
+	entries    []models.Entry
+	numFetches int
+}
+
+func (f *latestEntryRepository) FetchLatestEntries(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+	f.numFetches++
+	var entries []models.Entry
+	for _, e := range f.entries {
+		if !e.Time.After(maxTime) && len(entries) < maxEntries {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (f *latestEntryRepository) FetchLatestSGVs(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+	return f.FetchLatestEntries(ctx, maxTime, maxEntries)
+}
+
+func (f *latestEntryRepository) CreateEntries(ctx context.Context, entries []models.Entry) []models.Entry {
+	f.entries = append(entries, f.entries...)
+	return entries
+}
+
+func TestCachedEntryRepository(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	underlying := &latestEntryRepository{}
+	cache := fakeCacheStore{}
+	repo := NewCachedEntryRepository(underlying, cache)
+	repo.Size = 3
+
+	// nothing cached until an instance writes
+	_, err := repo.FetchLatestEntries(ctx, now, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, underlying.numFetches)
+
+	repo.CreateEntries(ctx, []models.Entry{{Oid: "a", Time: now.Add(-3 * time.Minute)}})
+	underlying.numFetches = 0
+
+	// fewer entries than we cache, so the list is complete
+	entries, err := repo.FetchLatestEntries(ctx, now, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, entryOids(entries))
+	assert.Equal(t, 0, underlying.numFetches)
+	_, err = repo.FetchLatestSgvEntry(ctx, now.Add(-time.Hour))
+	assert.ErrorIs(t, err, models.ErrNotFound)
+
+	repo.CreateEntries(ctx, []models.Entry{
+		{Oid: "d", Time: now},
+		{Oid: "c", Time: now.Add(-time.Minute)},
+		{Oid: "b", Time: now.Add(-2 * time.Minute)},
+	})
+	underlying.numFetches = 0
+
+	entries, err = repo.FetchLatestSGVs(ctx, now.Add(-30*time.Second), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c", "b"}, entryOids(entries))
+	entry, err := repo.FetchLatestSgvEntry(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "d", entry.Oid)
+	assert.Equal(t, 0, underlying.numFetches)
+
+	// "a" fell off the cached list, so ask the repository
+	entries, err = repo.FetchLatestEntries(ctx, now, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d", "c", "b", "a"}, entryOids(entries))
+	assert.Equal(t, 1, underlying.numFetches)
+}
+
+func TestCachedTreatmentRepository(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	underlying := &fakeTreatmentRepository{treatments: map[string]models.Treatment{}}
+	cache := fakeCacheStore{}
+	repo := NewCachedTreatmentRepository(latestTreatmentRepository{underlying}, cache)
+
+	repo.CreateTreatments(ctx, []models.Treatment{{ID: "t1", Type: "Note", Time: recent}})
+	treatments, err := repo.FetchLatestTreatments(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Len(t, treatments, 1)
+
+	// deleting refreshes the cached list
+	assert.NoError(t, repo.DeleteTreatmentByOid(ctx, "t1"))
+	treatments, err = repo.FetchLatestTreatments(ctx, now, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, treatments)
+	assert.Contains(t, cache, cacheKeyTreatments)
+}
+
+// latestTreatmentRepository returns every treatment as the latest
+type latestTreatmentRepository struct {
+	*fakeTreatmentRepository
+}
+
+func (f latestTreatmentRepository) FetchLatestTreatments(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error) {
+	var treatments []models.Treatment
+	for _, t := range f.treatments {
+		treatments = append(treatments, t)
+	}
+	return treatments, nil
+}
@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Day, month and year files were originally a bare json array of entries or
+// treatments. From version 2 the array is wrapped in an object carrying the
+// format version, so the format can change without rewriting old files:
+//
+//	{"version":2,"data":[...]}
+//
+// Files of any known version are read, older data being migrated as it is
+// decoded, and files are always written as storedFormatVersion. A file newer
+// than this build understands is an error, rather than being misread and then
+// overwritten.
+
+const storedFormatVersion = 2
+
+var errUnsupportedFormat = errors.New("unsupported file format version")
+
+type storedFile struct {
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// storedMigrations upgrade a file's data to the next version, keyed by the
+// version being upgraded from. Entry and treatment files share a version, so
+// a migration must cope with both.
+var storedMigrations = map[int]func(data json.RawMessage) (json.RawMessage, error){
+	// version 2 only added the envelope
+	1: func(data json.RawMessage) (json.RawMessage, error) { return data, nil },
+}
+
+// decodeStored decodes a day, month or year file of any known version into v,
+// a pointer to a slice
+func decodeStored(r io.Reader, v any) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return unmarshalStored(b, v)
+}
+
+// unmarshalStored is decodeStored for a file already read into memory
+func unmarshalStored(b []byte, v any) error {
+	f := storedFile{Version: 1, Data: b}
+	if trimmed := bytes.TrimLeft(b, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '{' {
+		f = storedFile{}
+		err := json.Unmarshal(b, &f)
+		if err != nil {
+			return err
+		}
+	}
+	if f.Version < 1 || f.Version > storedFormatVersion {
+		return fmt.Errorf("%w %d", errUnsupportedFormat, f.Version)
+	}
+	for version := f.Version; version < storedFormatVersion; version++ {
+		var err error
+		f.Data, err = storedMigrations[version](f.Data)
+		if err != nil {
+			return fmt.Errorf("cannot migrate from version %d: %w", version, err)
+		}
+	}
+	if len(f.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(f.Data, v)
+}
+
+// marshalStored encodes v, a slice of entries or treatments, as a day, month
+// or year file
+func marshalStored(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(storedFile{Version: storedFormatVersion, Data: data})
+}
@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmarshalStored(t *testing.T) {
+	for name, tt := range map[string]struct {
+		file    string
+		want    []storedEntry
+		wantErr error
+	}{
+		"version 1":           {file: `[{"_id":"a","sgv":100}]`, want: []storedEntry{{Oid: "a", SgvMgdl: 100}}},
+		"version 1, empty":    {file: `null`},
+		"version 2":           {file: `{"version":2,"data":[{"_id":"a","sgv":100}]}`, want: []storedEntry{{Oid: "a", SgvMgdl: 100}}},
+		"version 2, empty":    {file: `{"version":2,"data":null}`},
+		"version 2, reversed": {file: ` {"data":[{"_id":"a"}],"version":2}`, want: []storedEntry{{Oid: "a"}}},
+		"no version":          {file: `{"data":[]}`, wantErr: errUnsupportedFormat},
+		"newer version":       {file: `{"version":99,"data":[{"_id":"a"}]}`, wantErr: errUnsupportedFormat},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var got []storedEntry
+			err := unmarshalStored([]byte(tt.file), &got)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMarshalStored(t *testing.T) {
+	b, err := marshalStored([]storedTreatment{{"_id": "a"}})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"version":2,"data":[{"_id":"a"}]}`, string(b))
+
+	var got []storedTreatment
+	assert.NoError(t, unmarshalStored(b, &got))
+	assert.Equal(t, []storedTreatment{{"_id": "a"}}, got)
+}
@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Checking for conflicting writes (see objectVersions) narrows the window in
+// which two instances sharing a bucket can overwrite each other's files, but
+// cannot close it. With a SyncLease only one instance syncs at a time: the
+// lease is checked before each sync, and an instance that does not hold it
+// leaves its files dirty until it can take the lease, eg when the old
+// instance releases it at the end of a rolling deploy.
+//
+// The object store client cannot make conditional uploads, so two instances
+// taking a free lease at the same moment can both write it. Each reads the
+// lease back after writing it and only syncs if it still holds it, which
+// leaves a much smaller window than before.
+
+const syncLeaseFile = "ns-config/lease.json"
+
+type storedLease struct {
+	Owner  string    `json:"owner"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// SyncLease is shared by the entry and treatment repositories of an instance.
+// A nil lease is always held.
+type SyncLease struct {
+	BucketStore BucketStoreInterface
+	Owner       string        // identifies this instance, eg hostname and pid
+	TTL         time.Duration // should be longer than the time between syncs
+	lock        sync.Mutex
+}
+
+func NewSyncLease(bs BucketStoreInterface, owner string, ttl time.Duration) *SyncLease {
+	return &SyncLease{BucketStore: bs, Owner: owner, TTL: ttl}
+}
+
+// hold takes or renews the lease, returning false if another instance holds
+// it or it cannot be checked
+func (l *SyncLease) hold(ctx context.Context, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	log := slogctx.FromCtx(ctx)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	current, err := l.fetch(ctx)
+	if err != nil {
+		log.Warn("cannot check sync lease", slog.Any("err", err))
+		return false
+	}
+	if current.Owner != l.Owner && current.Expiry.After(now) {
+		log.Info("another instance holds the sync lease, not syncing",
+			slog.String("owner", current.Owner),
+			slog.Time("expiry", current.Expiry),
+		)
+		return false
+	}
+	// renew once half the lease has gone, rather than on every sync
+	if current.Owner == l.Owner && current.Expiry.Sub(now) > l.TTL/2 {
+		return true
+	}
+
+	err = l.write(ctx, storedLease{Owner: l.Owner, Expiry: now.Add(l.TTL)})
+	if err != nil {
+		log.Warn("cannot take sync lease", slog.Any("err", err))
+		return false
+	}
+	current, err = l.fetch(ctx)
+	if err != nil {
+		log.Warn("cannot check sync lease", slog.Any("err", err))
+		return false
+	}
+	if current.Owner != l.Owner {
+		log.Info("another instance took the sync lease, not syncing", slog.String("owner", current.Owner))
+		return false
+	}
+	return true
+}
+
+// Release gives up the lease if we hold it, eg at shutdown once everything
+// is synced, so another instance can sync without waiting for it to expire
+func (l *SyncLease) Release(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	current, err := l.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if current.Owner != l.Owner {
+		return nil
+	}
+	return l.write(ctx, storedLease{})
+}
+
+// fetch returns the stored lease. A missing lease has expired.
+func (l *SyncLease) fetch(ctx context.Context) (storedLease, error) {
+	var lease storedLease
+	r, err := l.BucketStore.Get(ctx, syncLeaseFile)
+	if err != nil {
+		if l.BucketStore.IsObjNotFoundErr(err) {
+			return lease, nil
+		}
+		return lease, fmt.Errorf("cannot fetch sync lease: %w", err)
+	}
+	defer r.Close()
+	err = json.NewDecoder(r).Decode(&lease)
+	if err != nil {
+		return lease, fmt.Errorf("cannot parse sync lease: %w", err)
+	}
+	return lease, nil
+}
+
+func (l *SyncLease) write(ctx context.Context, lease storedLease) error {
+	j, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("cannot marshal sync lease: %w", err)
+	}
+	err = l.BucketStore.Upload(ctx, syncLeaseFile, bytes.NewReader(j))
+	if err != nil {
+		return fmt.Errorf("cannot upload sync lease: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestSyncLease(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	oldInstance := NewSyncLease(bs, "old", 10*time.Minute)
+	newInstance := NewSyncLease(bs, "new", 10*time.Minute)
+
+	assert.True(t, oldInstance.hold(ctx, now), "free lease is taken")
+	assert.True(t, oldInstance.hold(ctx, now.Add(time.Minute)), "owner keeps its lease")
+	assert.False(t, newInstance.hold(ctx, now.Add(time.Minute)), "held lease is not taken")
+
+	// renewed once half the lease has gone
+	assert.True(t, oldInstance.hold(ctx, now.Add(6*time.Minute)))
+	lease, err := oldInstance.fetch(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(16*time.Minute), lease.Expiry)
+
+	assert.True(t, newInstance.hold(ctx, now.Add(17*time.Minute)), "expired lease is taken")
+	assert.False(t, oldInstance.hold(ctx, now.Add(18*time.Minute)))
+
+	// only the owner can release the lease
+	assert.NoError(t, oldInstance.Release(ctx))
+	assert.False(t, oldInstance.hold(ctx, now.Add(18*time.Minute)))
+	assert.NoError(t, newInstance.Release(ctx))
+	assert.True(t, oldInstance.hold(ctx, now))
+
+	var none *SyncLease
+	assert.True(t, none.hold(ctx, now), "no lease is always held")
+}
+
+func TestSyncLeaseHeldElsewhere(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	oldInstance := NewSyncLease(bs, "old", time.Hour)
+	assert.True(t, oldInstance.hold(ctx, time.Now()))
+
+	repo := NewBucketEntryRepository(bs)
+	repo.Lease = NewSyncLease(bs, "new", time.Hour)
+	treatmentRepo := NewBucketTreatmentRepository(bs)
+	treatmentRepo.Lease = repo.Lease
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Oid: "new", Type: "sgv", SgvMgdl: 100, Device: "dev", Time: recent}})
+	treatmentRepo.addTreatmentsToMemStore(ctx, now, []models.Treatment{{ID: "new", Type: "Note", Time: recent, Fields: map[string]interface{}{}}})
+
+	// nothing is written while another instance holds the lease
+	repo.syncToBucket(ctx, now)
+	treatmentRepo.syncToBucket(ctx, now)
+	exists, err := bs.Bucket.Exists(ctx, "ns-day/2024-11-28.json")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.True(t, repo.memStore.dirtyDay)
+	assert.True(t, treatmentRepo.memTreatmentStore.dirtyDay)
+	assert.Error(t, repo.Flush(ctx))
+	assert.Error(t, treatmentRepo.Flush(ctx))
+
+	// once it is released, dirty files are synced
+	assert.NoError(t, oldInstance.Release(ctx))
+	repo.syncToBucket(ctx, now)
+	treatmentRepo.syncToBucket(ctx, now)
+	assert.Equal(t, []string{"new"}, dayFileOids(t, bs, "ns-day/2024-11-28.json"))
+	assert.Equal(t, []string{"new"}, dayFileOids(t, bs, "ns-day/2024-11-28-treatments.json"))
+	assert.False(t, repo.memStore.dirtyDay)
+}
+
+func TestPurgeAndEvictionNeedSyncLease(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	oldInstance := NewSyncLease(bs, "old", time.Hour)
+	assert.True(t, oldInstance.hold(ctx, time.Now()))
+
+	_, err := NewBucketArchiveWriter(bs).WriteEntries(ctx, []models.Entry{{Oid: "lastyear", Type: "sgv", Device: "a", Time: lastYear}}, now)
+	assert.NoError(t, err)
+	_, err = NewBucketArchiveWriter(bs).WriteTreatments(ctx, []models.Treatment{{ID: "lastyear", Type: "Note", Time: lastYear}}, now)
+	assert.NoError(t, err)
+	repo := NewBucketEntryRepository(bs)
+	repo.Lease = NewSyncLease(bs, "new", time.Hour)
+	repo.MemoryDays = 30
+	repo.addStoredEntries([]storedEntry{{Oid: "lastyear", Type: "sgv", Device: "a", Time: lastYear}})
+	treatmentRepo := NewBucketTreatmentRepository(bs)
+	treatmentRepo.Lease = repo.Lease
+	treatmentRepo.addTreatmentsToMemStore(ctx, now, []models.Treatment{{ID: "lastyear", Type: "Note", Time: lastYear, Fields: map[string]interface{}{}}})
+
+	// files are not rewritten while another instance holds the lease
+	_, err = repo.PurgeEntries(ctx, time.Time{}, future, "")
+	assert.ErrorContains(t, err, "sync lease")
+	_, err = treatmentRepo.PurgeTreatments(ctx, time.Time{}, future)
+	assert.ErrorContains(t, err, "sync lease")
+	_, err = repo.EvictEntries(ctx, time.Now())
+	assert.ErrorContains(t, err, "sync lease")
+	assert.Equal(t, []string{"lastyear"}, dayFileOids(t, bs, "ns-year/2023.json"))
+	assert.Equal(t, []string{"lastyear"}, dayFileOids(t, bs, "ns-year/2023-treatments.json"))
+	assert.Len(t, repo.memStore.entries, 1)
+	assert.Len(t, treatmentRepo.memTreatmentStore.treatments, 1)
+
+	assert.NoError(t, oldInstance.Release(ctx))
+	numPurged, err := repo.PurgeEntries(ctx, time.Time{}, future, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numPurged)
+	numPurged, err = treatmentRepo.PurgeTreatments(ctx, time.Time{}, future)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, numPurged)
+}
@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Entries and treatments are synced to the bucket in the background, so a
+// write can still be in progress when the server is asked to stop. The
+// repositories track their syncs so shutdown can wait for them.
+
+// syncTracker counts in-progress syncs. Unlike a sync.WaitGroup it can be
+// waited on (and the wait abandoned) while new syncs are still starting, eg
+// from ingesters during shutdown.
+//
+// Background syncs are single-flight: a busy uploader posting every few
+// seconds would otherwise start overlapping syncs that queue on dirtyLock
+// and rewrite the same files one after another.
+type syncTracker struct {
+	lock    sync.Mutex
+	n       int
+	idle    chan struct{} // closed when n drops to 0
+	running bool          // a background sync is running
+	next    time.Time     // set if another is wanted once it finishes
+}
+
+func (t *syncTracker) start() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.startLocked()
+}
+
+func (t *syncTracker) startLocked() {
+	if t.n == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.n++
+}
+
+func (t *syncTracker) done() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.doneLocked()
+}
+
+func (t *syncTracker) doneLocked() {
+	t.n--
+	if t.n == 0 {
+		close(t.idle)
+	}
+}
+
+// request runs sync in the background, unless one is already running, in
+// which case it is run once more when that finishes. Requests made meanwhile
+// collapse into that one follow-up sync, at the latest time requested.
+func (t *syncTracker) request(now time.Time, sync func(now time.Time)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.running {
+		if now.After(t.next) {
+			t.next = now
+		}
+		return
+	}
+	t.running = true
+	t.startLocked()
+	go func() {
+		for {
+			sync(now)
+			t.lock.Lock()
+			if t.next.IsZero() {
+				t.running = false
+				t.doneLocked()
+				t.lock.Unlock()
+				return
+			}
+			now, t.next = t.next, time.Time{}
+			t.lock.Unlock()
+		}
+	}()
+}
+
+// wait waits until no syncs are in progress, or until ctx is done
+func (t *syncTracker) wait(ctx context.Context) error {
+	t.lock.Lock()
+	if t.n == 0 {
+		t.lock.Unlock()
+		return nil
+	}
+	idle := t.idle
+	t.lock.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncTrackerRequest(t *testing.T) {
+	var tracker syncTracker
+	var lock sync.Mutex
+	var synced []time.Time
+	release := make(chan struct{})
+	syncFn := func(now time.Time) {
+		<-release
+		lock.Lock()
+		synced = append(synced, now)
+		lock.Unlock()
+	}
+
+	tracker.request(sameDay, syncFn)
+	// the first sync is still running, so these collapse into one more
+	tracker.request(recent, syncFn)
+	tracker.request(now, syncFn)
+	tracker.request(sameMonth, syncFn)
+
+	close(release)
+	assert.NoError(t, tracker.wait(context.Background()))
+	assert.Equal(t, []time.Time{sameDay, now}, synced)
+
+	// and once idle, a request starts a new sync
+	tracker.request(future, syncFn)
+	assert.NoError(t, tracker.wait(context.Background()))
+	assert.Equal(t, []time.Time{sameDay, now, future}, synced)
+}
@@ -1,13 +1,13 @@
 package repository
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
 	slogctx "github.com/veqryn/slog-context"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
 	"log/slog"
 	"slices"
 	"sync"
@@ -27,7 +27,7 @@ import (
 // the original/imported oid, not when this system first saw them.
 type memTreatment struct {
 	Time   time.Time
-	Oid    string
+	Oid    string // the stored id, see IDStrategy
 	Type   string
 	fields map[string]interface{}
 }
@@ -36,27 +36,54 @@ func (t *memTreatment) IsAfter(time time.Time) bool {
 	return t.Time.After(time)
 }
 
+func memTreatmentTime(t memTreatment) time.Time { return t.Time }
+
 type storedTreatment map[string]interface{}
 
+// memTreatmentStore is locked like memStore: readers share treatmentsLock,
+// and locks are taken in the order dirtyLock, treatmentsLock, indexLock.
 type memTreatmentStore struct {
 	dirtyYears     map[int]struct{} // new memEntry outside of this month: update year file
 	treatments     []memTreatment
-	treatmentsLock sync.Mutex
+	oids           oidIndex // position in treatments, see FetchTreatmentByOid
+	treatmentsLock sync.RWMutex
+	indexLock      sync.Mutex // the index is built lazily, by readers
 	dirtyLock      sync.Mutex
-	dirtyDay       bool // new memTreatment today = update day file
-	dirtyMonth     bool // new memTreatment this month (but not today): update month
+	dirtyDay       bool      // new memTreatment today = update day file
+	dirtyMonth     bool      // new memTreatment this month (but not today): update month
+	heldFrom       time.Time // all treatments from here on are held, see syncYearsToBucket
 }
 
 type BucketTreatmentRepository struct {
 	BucketStore       BucketStoreInterface
+	IDStrategy        IDStrategy // ids treatments are held and stored under
+	Compression       bucketstore.Compression
+	CheckConflicts    bool       // merge files written by other instances, see reconcileTreatments
+	Lease             *SyncLease // only sync while holding the lease, if set
 	memTreatmentStore *memTreatmentStore
+	uploads           *uploadRetryQueue
+	syncs             *syncTracker    // in-progress syncToBucket calls
+	versions          *objectVersions // files as last read or written
 }
 
 func NewBucketTreatmentRepository(bs BucketStoreInterface) *BucketTreatmentRepository {
 	m := &memTreatmentStore{
 		dirtyYears: make(map[int]struct{}),
 	}
-	return &BucketTreatmentRepository{bs, m}
+	return &BucketTreatmentRepository{
+		BucketStore:       bs,
+		IDStrategy:        objectIDStrategy{},
+		memTreatmentStore: m,
+		uploads:           newUploadRetryQueue(bs, &m.dirtyLock),
+		syncs:             &syncTracker{},
+		versions:          newObjectVersions(),
+	}
+}
+
+// SetAdminNotifies shows uploads to the bucket that keep failing in the
+// admin notifies panel
+func (p *BucketTreatmentRepository) SetAdminNotifies(n *models.AdminNotifies) {
+	p.uploads.setAdminNotifies(n)
 }
 
 // Boot fetches common data into memory, typically at server startup
@@ -65,6 +92,9 @@ func (p BucketTreatmentRepository) Boot(ctx context.Context) error {
 
 	// loading files in order means we don't have to sort afterwards.
 	now := time.Now()
+	p.memTreatmentStore.dirtyLock.Lock()
+	p.memTreatmentStore.heldFrom = time.Date(now.Year()-1, time.January, 1, 0, 0, 0, 0, time.UTC)
+	p.memTreatmentStore.dirtyLock.Unlock()
 	entryFiles := []string{
 		fmt.Sprintf("ns-year/%d-treatments.json", now.Year()-1),            // last year
 		fmt.Sprintf("ns-year/%d-treatments.json", now.Year()),              // year to date excl month
@@ -110,7 +140,7 @@ func (p BucketTreatmentRepository) Boot(ctx context.Context) error {
 func (p BucketTreatmentRepository) loadTreatments(ctx context.Context, file string) error {
 	log := slogctx.FromCtx(ctx)
 	t1 := time.Now()
-	r, err := p.BucketStore.Get(ctx, file)
+	r, err := getCompressed(ctx, p.BucketStore, p.Compression, file)
 	log.Debug("fetched from s3",
 		slog.String("file", file),
 		slog.Int64("duration_ms", time.Since(t1).Milliseconds()),
@@ -119,15 +149,33 @@ func (p BucketTreatmentRepository) loadTreatments(ctx context.Context, file stri
 		return err
 	}
 	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p.versions.set(file, b)
 
 	var result []storedTreatment
-	err = json.NewDecoder(r).Decode(&result)
+	err = unmarshalStored(b, &result)
 	if err != nil {
 		return err
 	}
 
+	memTreatments := p.memTreatmentsFromStored(ctx, result)
 	p.memTreatmentStore.treatmentsLock.Lock()
 	defer p.memTreatmentStore.treatmentsLock.Unlock()
+	for _, t := range memTreatments {
+		p.memTreatmentStore.treatments = append(p.memTreatmentStore.treatments, t)
+		p.memTreatmentStore.oids.add(t.Oid, len(p.memTreatmentStore.treatments)-1)
+	}
+	return nil
+}
+
+// memTreatmentsFromStored converts treatments read from the bucket, skipping
+// any without a time, type or id
+func (p BucketTreatmentRepository) memTreatmentsFromStored(ctx context.Context, result []storedTreatment) []memTreatment {
+	log := slogctx.FromCtx(ctx)
+	memTreatments := make([]memTreatment, 0, len(result))
 	for _, t := range result {
 		tTimeStr, ok := t["created_at"].(string)
 		if !ok {
@@ -154,128 +202,134 @@ func (p BucketTreatmentRepository) loadTreatments(ctx context.Context, file stri
 		delete(t, "created_at")
 		delete(t, "eventType")
 
-		p.memTreatmentStore.treatments = append(p.memTreatmentStore.treatments, memTreatment{
+		memTreatments = append(memTreatments, memTreatment{
 			Time:   tTime,
-			Oid:    tOid,
+			Oid:    p.IDStrategy.StoredID(tOid),
 			Type:   tType,
 			fields: t,
 		})
 	}
-	return nil
+	return memTreatments
 }
 
 func (p BucketTreatmentRepository) FetchTreatmentByOid(ctx context.Context, oid string) (*models.Treatment, error) {
-	memTreatments := p.memTreatmentStore.treatments
-
-	for i := len(memTreatments) - 1; i >= 0; i-- {
-		t := memTreatments[i]
-		if t.Oid != oid {
-			continue
-		}
-
-		return &models.Treatment{
-			ID:     t.Oid,
-			Time:   t.Time,
-			Type:   t.Type,
-			Fields: t.fields,
-		}, nil
+	p.memTreatmentStore.treatmentsLock.RLock()
+	defer p.memTreatmentStore.treatmentsLock.RUnlock()
+	i, ok := p.treatmentIndex(oid)
+	if !ok {
+		return nil, models.ErrNotFound
 	}
+	t := p.memTreatmentStore.treatments[i]
+	return &models.Treatment{
+		ID:     oidOf(t.Oid),
+		Time:   t.Time,
+		Type:   t.Type,
+		Fields: t.fields,
+	}, nil
+}
 
-	return nil, models.ErrNotFound
+// treatmentIndex returns the position of the treatment with oid. Callers
+// must hold treatmentsLock, for reading at least.
+func (p BucketTreatmentRepository) treatmentIndex(oid string) (int, bool) {
+	p.memTreatmentStore.indexLock.Lock()
+	defer p.memTreatmentStore.indexLock.Unlock()
+	memTreatments := p.memTreatmentStore.treatments
+	return p.memTreatmentStore.oids.lookup(len(memTreatments), func(i int) string { return memTreatments[i].Oid }, p.IDStrategy.StoredID(oid))
 }
 
 func (p BucketTreatmentRepository) DeleteTreatmentByOid(ctx context.Context, oid string) error {
 	log := slogctx.FromCtx(ctx)
+	p.memTreatmentStore.dirtyLock.Lock()
+	defer p.memTreatmentStore.dirtyLock.Unlock()
+	p.memTreatmentStore.treatmentsLock.Lock()
+	defer p.memTreatmentStore.treatmentsLock.Unlock()
+
+	i, ok := p.treatmentIndex(oid)
+	if !ok {
+		return models.ErrNotFound
+	}
 	memTreatments := p.memTreatmentStore.treatments
+	t := memTreatments[i]
+	p.memTreatmentStore.treatments = append(memTreatments[:i], memTreatments[i+1:]...)
+	p.memTreatmentStore.oids.reset()
 
-	for i := len(memTreatments) - 1; i >= 0; i-- {
-		t := memTreatments[i]
-		if t.Oid != oid {
-			continue
+	now := time.Now()
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !t.Time.Before(startOfDay) {
+		if !p.memTreatmentStore.dirtyDay {
+			log.Debug("marking day dirty", slog.Time("deletedTreatmentTime", t.Time))
+			p.memTreatmentStore.dirtyDay = true
 		}
-
-		p.memTreatmentStore.treatments = append(memTreatments[:i], memTreatments[i+1:]...)
-
-		now := time.Now()
-		startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
-		startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-		if !t.Time.Before(startOfDay) {
-			if !p.memTreatmentStore.dirtyDay {
-				log.Debug("marking day dirty", slog.Time("deletedTreatmentTime", t.Time))
-				p.memTreatmentStore.dirtyDay = true
-			}
-		} else if !t.Time.Before(startOfMonth) {
-			if !p.memTreatmentStore.dirtyMonth {
-				log.Debug("marking month dirty", slog.Time("deletedTreatmentTime", t.Time))
-				p.memTreatmentStore.dirtyMonth = true
-			}
-		} else {
-			_, ok := p.memTreatmentStore.dirtyYears[t.Time.Year()]
-			if !ok {
-				log.Debug("marking year dirty", slog.Int("year", t.Time.Year()))
-				p.memTreatmentStore.dirtyYears[t.Time.Year()] = struct{}{}
-			}
+	} else if !t.Time.Before(startOfMonth) {
+		if !p.memTreatmentStore.dirtyMonth {
+			log.Debug("marking month dirty", slog.Time("deletedTreatmentTime", t.Time))
+			p.memTreatmentStore.dirtyMonth = true
 		}
+	} else {
+		_, ok := p.memTreatmentStore.dirtyYears[t.Time.Year()]
+		if !ok {
+			log.Debug("marking year dirty", slog.Int("year", t.Time.Year()))
+			p.memTreatmentStore.dirtyYears[t.Time.Year()] = struct{}{}
+		}
+	}
 
-		// TODO mark things dirty, trigger save
-
-		// something _must_ be dirty, so trigger sync
-		syncContext := context.WithoutCancel(ctx)
-		go p.syncToBucket(syncContext, now)
+	// TODO mark things dirty, trigger save
 
-		return nil
-	}
+	// something _must_ be dirty, so trigger sync
+	p.startSync(ctx, now)
 
-	return models.ErrNotFound
+	return nil
 }
 
 func (p BucketTreatmentRepository) UpdateTreatmentByOid(ctx context.Context, oid string, treatment *models.Treatment) error {
 	log := slogctx.FromCtx(ctx)
-	memTreatments := p.memTreatmentStore.treatments
-
-	treatmentsNeedSorting := false
-	for i := len(memTreatments) - 1; i >= 0; i-- {
-		t := memTreatments[i]
-		if t.Oid != oid {
-			continue
-		}
-
-		now := time.Now()
-		startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
-		startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-
-		// if time has changed we probably need to do more cleanup
-		if t.Time != treatment.Time {
-			treatmentsNeedSorting = true
-			p.markDirty(ctx, startOfMonth, startOfDay, t.Time)
-			t.Time = treatment.Time
-		}
-		t.Type = treatment.Type
-		t.fields = treatment.Fields
+	p.memTreatmentStore.dirtyLock.Lock()
+	defer p.memTreatmentStore.dirtyLock.Unlock()
+	p.memTreatmentStore.treatmentsLock.Lock()
+	defer p.memTreatmentStore.treatmentsLock.Unlock()
 
-		delete(t.fields, "_id")
-		delete(t.fields, "eventType")
-		delete(t.fields, "eventTime")
-		delete(t.fields, "created_at")
+	i, ok := p.treatmentIndex(oid)
+	if !ok {
+		return models.ErrNotFound
+	}
+	memTreatments := p.memTreatmentStore.treatments
+	t := memTreatments[i]
 
-		memTreatments[i] = t
+	now := time.Now()
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 
+	// if time has changed we probably need to do more cleanup
+	treatmentsNeedSorting := false
+	if t.Time != treatment.Time {
+		treatmentsNeedSorting = true
 		p.markDirty(ctx, startOfMonth, startOfDay, t.Time)
+		t.Time = treatment.Time
+	}
+	t.Type = treatment.Type
+	t.fields = treatment.Fields
 
-		if treatmentsNeedSorting {
-			t1 := time.Now()
-			slices.SortFunc(p.memTreatmentStore.treatments, func(a, b memTreatment) int { return a.Time.Compare(b.Time) })
-			log.Debug("treatments sorted", slog.Int64("duration_us", time.Since(t1).Microseconds()))
-		}
+	delete(t.fields, "_id")
+	delete(t.fields, "eventType")
+	delete(t.fields, "eventTime")
+	delete(t.fields, "created_at")
+
+	memTreatments[i] = t
 
-		// assume a change was made: trigger sync
-		syncContext := context.WithoutCancel(ctx)
-		go p.syncToBucket(syncContext, now)
+	p.markDirty(ctx, startOfMonth, startOfDay, t.Time)
 
-		return nil
+	if treatmentsNeedSorting {
+		t1 := time.Now()
+		slices.SortFunc(p.memTreatmentStore.treatments, func(a, b memTreatment) int { return a.Time.Compare(b.Time) })
+		p.memTreatmentStore.oids.reset()
+		log.Debug("treatments sorted", slog.Int64("duration_us", time.Since(t1).Microseconds()))
 	}
 
-	return models.ErrNotFound
+	// assume a change was made: trigger sync
+	p.startSync(ctx, now)
+
+	return nil
 }
 func (p BucketTreatmentRepository) markDirty(ctx context.Context, startOfMonth time.Time, startOfDay time.Time, t time.Time) {
 	log := slogctx.FromCtx(ctx)
@@ -299,6 +353,8 @@ func (p BucketTreatmentRepository) markDirty(ctx context.Context, startOfMonth t
 }
 
 func (p BucketTreatmentRepository) FetchLatestTreatments(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error) {
+	p.memTreatmentStore.treatmentsLock.RLock()
+	defer p.memTreatmentStore.treatmentsLock.RUnlock()
 	memTreatments := p.memTreatmentStore.treatments
 
 	if len(memTreatments) < maxTreatments {
@@ -313,7 +369,7 @@ func (p BucketTreatmentRepository) FetchLatestTreatments(ctx context.Context, ma
 			continue
 		}
 		treatments = append(treatments, models.Treatment{
-			ID:     t.Oid,
+			ID:     oidOf(t.Oid),
 			Time:   t.Time,
 			Type:   t.Type,
 			Fields: t.fields,
@@ -325,24 +381,50 @@ func (p BucketTreatmentRepository) FetchLatestTreatments(ctx context.Context, ma
 	return treatments, nil
 }
 
+// FetchTreatmentsAfter returns treatments with an event time after minTime,
+// oldest first.
+func (p BucketTreatmentRepository) FetchTreatmentsAfter(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+	p.memTreatmentStore.treatmentsLock.RLock()
+	defer p.memTreatmentStore.treatmentsLock.RUnlock()
+	memTreatments := p.memTreatmentStore.treatments
+
+	first := len(memTreatments)
+	for first > 0 && memTreatments[first-1].IsAfter(minTime) {
+		first--
+	}
+
+	treatments := make([]models.Treatment, 0, len(memTreatments)-first)
+	for _, t := range memTreatments[first:] {
+		treatments = append(treatments, models.Treatment{
+			ID:     oidOf(t.Oid),
+			Time:   t.Time,
+			Type:   t.Type,
+			Fields: t.fields,
+		})
+	}
+	return treatments, nil
+}
+
 // syncToBucket will update any bucket objects that have been updated recently.
 func (p BucketTreatmentRepository) syncToBucket(ctx context.Context, currentTime time.Time) {
 	log := slogctx.FromCtx(ctx)
+	p.memTreatmentStore.dirtyLock.Lock()
+	defer p.memTreatmentStore.dirtyLock.Unlock()
 	log.Debug("syncing treatments",
 		slog.Time("time", currentTime),
 		slog.Bool("dirtyDay", p.memTreatmentStore.dirtyDay),
 		slog.Bool("dirtyMonth", p.memTreatmentStore.dirtyMonth),
 		slog.Any("dirtyYears", p.memTreatmentStore.dirtyYears),
 	)
+	if !p.Lease.hold(ctx, currentTime) {
+		return
+	}
 
-	p.memTreatmentStore.dirtyLock.Lock()
-	defer p.memTreatmentStore.dirtyLock.Unlock()
 	p.syncDayToBucket(ctx, currentTime)
 	p.memTreatmentStore.dirtyDay = false
 	p.syncMonthToBucket(ctx, currentTime)
 	p.memTreatmentStore.dirtyMonth = false
 	p.syncYearsToBucket(ctx, currentTime)
-	clear(p.memTreatmentStore.dirtyYears)
 }
 
 func (p BucketTreatmentRepository) syncDayToBucket(ctx context.Context, currentTime time.Time) {
@@ -355,45 +437,35 @@ func (p BucketTreatmentRepository) syncDayToBucket(ctx context.Context, currentT
 		slog.Bool("dirtyDay", p.memTreatmentStore.dirtyDay),
 	)
 
-	var dayTreatments []storedTreatment
 	startOfDay := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, time.UTC)
-
-	for _, treatment := range p.memTreatmentStore.treatments {
-		if treatment.Time.Before(startOfDay) {
-			continue
-		}
-		st := storedTreatment{
-			"_id":        treatment.Oid,
-			"created_at": treatment.Time.Format(time.RFC3339),
-			"eventType":  treatment.Type,
-		}
-		for k, v := range treatment.fields {
-			st[k] = v
-		}
-		dayTreatments = append(dayTreatments, st)
-	}
+	dayTreatments := p.storedTreatmentsBetween(startOfDay, time.Time{})
 
 	name := fmt.Sprintf("ns-day/%s-treatments.json", currentTime.Format("2006-01-02"))
 	p.writeTreatmentsToBucket(ctx, name, dayTreatments)
 }
 
+// writeTreatmentsToBucket uploads a day, month or year file. Callers must
+// hold dirtyLock.
 func (p BucketTreatmentRepository) writeTreatmentsToBucket(ctx context.Context, name string, storedTreatments []storedTreatment) {
 	log := slogctx.FromCtx(ctx)
-	b, err := json.Marshal(storedTreatments)
+	if p.CheckConflicts {
+		storedTreatments = p.reconcileTreatments(ctx, name, storedTreatments)
+	}
+	b, err := marshalStored(storedTreatments)
 	if err != nil {
 		log.Warn("cannot marshal treatments", slog.String("name", name), slog.Any("err", err))
 		return
 	}
 
-	r := bytes.NewReader(b)
-	err = p.BucketStore.Upload(ctx, name, r)
+	size, err := p.uploads.upload(ctx, p.Compression, name, b)
 	if err != nil {
-		log.Warn("cannot upload treatments", slog.String("name", name), slog.Any("err", err))
+		log.Warn("cannot upload treatments, will retry", slog.String("name", name), slog.Any("err", err))
 		return
 	}
+	p.versions.set(name, b)
 	log.Debug("uploaded treatments",
-		slog.String("name", name),
-		slog.Int("byteSize", len(b)),
+		slog.String("name", p.Compression.Name(name)),
+		slog.Int("byteSize", size),
 		slog.Int("numTreatments", len(storedTreatments)),
 	)
 }
@@ -407,32 +479,18 @@ func (p BucketTreatmentRepository) syncMonthToBucket(ctx context.Context, curren
 		slog.Time("time", currentTime),
 		slog.Bool("dirtyMonth", p.memTreatmentStore.dirtyMonth),
 	)
-	var monthTreatments []storedTreatment
 	startOfMonth := time.Date(currentTime.Year(), currentTime.Month(), 1, 0, 0, 0, 0, time.UTC)
 	startOfDay := time.Date(currentTime.Year(), currentTime.Month(), currentTime.Day(), 0, 0, 0, 0, time.UTC)
-
-	for _, treatment := range p.memTreatmentStore.treatments {
-		if treatment.Time.Before(startOfMonth) {
-			continue
-		}
-		if !treatment.Time.Before(startOfDay) {
-			continue
-		}
-
-		st := storedTreatment{
-			"_id":        treatment.Oid,
-			"created_at": treatment.Time.Format(time.RFC3339),
-			"eventType":  treatment.Type,
-		}
-		for k, v := range treatment.fields {
-			st[k] = v
-		}
-		monthTreatments = append(monthTreatments, st)
-	}
+	monthTreatments := p.storedTreatmentsBetween(startOfMonth, startOfDay)
 	name := fmt.Sprintf("ns-month/%s-treatments.json", currentTime.Format("2006-01"))
 	p.writeTreatmentsToBucket(ctx, name, monthTreatments)
 }
 
+// syncYearsToBucket updates year files in the object store. Boot loads last
+// year and this year, so their files are rewritten from memory, keeping
+// updates and deletions. Treatments for earlier years (eg from an import) are
+// merged into the stored year file instead. Years that cannot be merged stay
+// dirty, and are retried on the next sync.
 func (p BucketTreatmentRepository) syncYearsToBucket(ctx context.Context, currentTime time.Time) {
 	log := slogctx.FromCtx(ctx)
 	if len(p.memTreatmentStore.dirtyYears) == 0 {
@@ -443,17 +501,67 @@ func (p BucketTreatmentRepository) syncYearsToBucket(ctx context.Context, curren
 		slog.Any("dirtyYears", p.memTreatmentStore.dirtyYears),
 	)
 
-	yearsTreatments := make(map[int][]storedTreatment)
-	startOfYear := time.Date(currentTime.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
-	startOfMonth := time.Date(currentTime.Year(), currentTime.Month(), 1, 0, 0, 0, 0, time.UTC)
-
-	for _, treatment := range p.memTreatmentStore.treatments {
-		if treatment.Time.Before(startOfYear) {
-			continue
+	heldFrom := p.memTreatmentStore.heldFrom
+	for _, year := range sortedYears(p.memTreatmentStore.dirtyYears) {
+		startOfYear := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		name := fmt.Sprintf("ns-year/%d-treatments.json", year)
+		switch {
+		case year >= currentTime.Year():
+			// year files do not include data for current month
+			startOfMonth := time.Date(currentTime.Year(), currentTime.Month(), 1, 0, 0, 0, 0, time.UTC)
+			p.writeTreatmentsToBucket(ctx, name, p.storedTreatmentsBetween(startOfYear, startOfMonth))
+		case !heldFrom.IsZero() && !startOfYear.Before(heldFrom):
+			p.writeTreatmentsToBucket(ctx, name, p.storedTreatmentsBetween(startOfYear, startOfYear.AddDate(1, 0, 0)))
+		default:
+			err := p.mergeYearToBucket(ctx, startOfYear, currentTime)
+			if err != nil {
+				log.Warn("cannot sync year, will retry", slog.Int("year", year), slog.Any("err", err))
+				continue
+			}
 		}
-		if !treatment.Time.Before(startOfMonth) {
-			continue
+		delete(p.memTreatmentStore.dirtyYears, year)
+	}
+}
+
+// mergeYearToBucket merges the treatments held in memory for the year
+// starting at startOfYear into its year file. Callers must hold dirtyLock.
+func (p BucketTreatmentRepository) mergeYearToBucket(ctx context.Context, startOfYear, currentTime time.Time) error {
+	p.memTreatmentStore.treatmentsLock.RLock()
+	memTreatments := p.memTreatmentStore.treatments
+	start := firstAtOrAfter(memTreatments, startOfYear, memTreatmentTime)
+	end := firstAtOrAfter(memTreatments, startOfYear.AddDate(1, 0, 0), memTreatmentTime)
+	memTreatments = memTreatments[start:end]
+	treatments := make([]models.Treatment, len(memTreatments))
+	for i, t := range memTreatments {
+		treatments[i] = models.Treatment{
+			ID:     oidOf(t.Oid),
+			Time:   t.Time,
+			Type:   t.Type,
+			Fields: t.fields,
 		}
+	}
+	p.memTreatmentStore.treatmentsLock.RUnlock()
+
+	w := NewBucketArchiveWriter(p.BucketStore)
+	w.TreatmentCompression = p.Compression
+	w.IDStrategy = p.IDStrategy
+	_, err := w.WriteTreatments(ctx, treatments, currentTime)
+	return err
+}
+
+// storedTreatmentsBetween copies out treatments with a time in [from, to), or
+// from on if to is zero, so they can be written without holding
+// treatmentsLock
+func (p BucketTreatmentRepository) storedTreatmentsBetween(from, to time.Time) []storedTreatment {
+	p.memTreatmentStore.treatmentsLock.RLock()
+	defer p.memTreatmentStore.treatmentsLock.RUnlock()
+	treatments := p.memTreatmentStore.treatments
+	end := len(treatments)
+	if !to.IsZero() {
+		end = firstAtOrAfter(treatments, to, memTreatmentTime)
+	}
+	var storedTreatments []storedTreatment
+	for _, treatment := range treatments[firstAtOrAfter(treatments, from, memTreatmentTime):end] {
 		st := storedTreatment{
 			"_id":        treatment.Oid,
 			"created_at": treatment.Time.Format(time.RFC3339),
@@ -462,23 +570,79 @@ func (p BucketTreatmentRepository) syncYearsToBucket(ctx context.Context, curren
 		for k, v := range treatment.fields {
 			st[k] = v
 		}
-		yearsTreatments[treatment.Time.Year()] = append(yearsTreatments[treatment.Time.Year()], st)
+		storedTreatments = append(storedTreatments, st)
 	}
-	name := fmt.Sprintf("ns-year/%d-treatments.json", currentTime.Year())
-	p.writeTreatmentsToBucket(ctx, name, yearsTreatments[currentTime.Year()])
+	return storedTreatments
 }
 
 func (p BucketTreatmentRepository) CreateTreatments(ctx context.Context, treatments []models.Treatment) []models.Treatment {
 	now := time.Now()
 	createdTreatments := p.addTreatmentsToMemStore(ctx, now, treatments)
 
-	if p.memTreatmentStore.dirtyMonth || p.memTreatmentStore.dirtyDay || len(p.memTreatmentStore.dirtyYears) != 0 {
-		syncContext := context.WithoutCancel(ctx)
-		go p.syncToBucket(syncContext, now)
+	// any new treatment marks a file dirty
+	if len(createdTreatments) > 0 {
+		p.startSync(ctx, now)
 	}
 	return createdTreatments
 }
 
+// startSync syncs to the bucket in the background, see syncTracker.request
+func (p BucketTreatmentRepository) startSync(ctx context.Context, now time.Time) {
+	syncContext := context.WithoutCancel(ctx)
+	p.syncs.request(now, func(now time.Time) {
+		p.syncToBucket(syncContext, now)
+	})
+}
+
+// WaitForSyncs waits for background syncs to finish, eg at shutdown, or
+// until ctx is done
+func (p BucketTreatmentRepository) WaitForSyncs(ctx context.Context) error {
+	return p.syncs.wait(ctx)
+}
+
+// Sync writes any dirty periods now rather than waiting for the next write,
+// eg if a sync failed or the day has rolled over since the last one
+func (p BucketTreatmentRepository) Sync(ctx context.Context) {
+	p.syncs.start()
+	defer p.syncs.done()
+	p.syncToBucket(ctx, time.Now())
+}
+
+// SyncAll marks the current day, month and year dirty and flushes them, so
+// they are rewritten from memory whether or not anything has changed.
+func (p BucketTreatmentRepository) SyncAll(ctx context.Context) error {
+	now := time.Now()
+	p.memTreatmentStore.dirtyLock.Lock()
+	p.memTreatmentStore.dirtyDay = true
+	p.memTreatmentStore.dirtyMonth = true
+	p.memTreatmentStore.dirtyYears[now.Year()] = struct{}{}
+	p.memTreatmentStore.dirtyLock.Unlock()
+	return p.Flush(ctx)
+}
+
+// Flush waits for background syncs, then syncs anything still dirty and
+// retries any failed uploads, eg at shutdown
+func (p BucketTreatmentRepository) Flush(ctx context.Context) error {
+	err := p.WaitForSyncs(ctx)
+	if err != nil {
+		return err
+	}
+	p.syncToBucket(ctx, time.Now())
+	err = p.uploads.flush(ctx)
+	if err != nil {
+		return err
+	}
+	p.memTreatmentStore.dirtyLock.Lock()
+	defer p.memTreatmentStore.dirtyLock.Unlock()
+	if p.memTreatmentStore.dirtyDay || p.memTreatmentStore.dirtyMonth {
+		return errors.New("cannot sync without the sync lease")
+	}
+	if len(p.memTreatmentStore.dirtyYears) > 0 {
+		return fmt.Errorf("cannot sync years %v", sortedYears(p.memTreatmentStore.dirtyYears))
+	}
+	return nil
+}
+
 func (p BucketTreatmentRepository) addTreatmentsToMemStore(ctx context.Context, now time.Time, treatments []models.Treatment) []models.Treatment {
 	var modelTreatments []models.Treatment
 	if len(treatments) == 0 {
@@ -486,6 +650,14 @@ func (p BucketTreatmentRepository) addTreatmentsToMemStore(ctx context.Context,
 	}
 	log := slogctx.FromCtx(ctx)
 
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	p.memTreatmentStore.dirtyLock.Lock()
+	defer p.memTreatmentStore.dirtyLock.Unlock()
+	p.memTreatmentStore.treatmentsLock.Lock()
+	defer p.memTreatmentStore.treatmentsLock.Unlock()
+
 	if len(p.memTreatmentStore.treatments) > 0 {
 		lastTreatment := p.memTreatmentStore.treatments[len(p.memTreatmentStore.treatments)-1]
 		lastTreatmentTime := lastTreatment.Time.Add(time.Second * 10)
@@ -496,14 +668,6 @@ func (p BucketTreatmentRepository) addTreatmentsToMemStore(ctx context.Context,
 		}
 	}
 
-	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
-	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-
-	p.memTreatmentStore.treatmentsLock.Lock()
-	defer p.memTreatmentStore.treatmentsLock.Unlock()
-	p.memTreatmentStore.dirtyLock.Lock()
-	defer p.memTreatmentStore.dirtyLock.Unlock()
-
 	var lastTreatmentTime time.Time
 	if len(p.memTreatmentStore.treatments) > 0 {
 		lastTreatmentTime = p.memTreatmentStore.treatments[len(p.memTreatmentStore.treatments)-1].Time
@@ -511,13 +675,13 @@ func (p BucketTreatmentRepository) addTreatmentsToMemStore(ctx context.Context,
 
 	treatmentsNeedSorting := false
 	for _, t := range treatments {
-		oid := t.ID
-		if oid == "" {
-			oid = primitive.NewObjectIDFromTimestamp(now).Hex()
+		id := p.IDStrategy.StoredID(t.ID)
+		if id == "" {
+			id = p.IDStrategy.NewID(now)
 		}
 
 		memTreatment := memTreatment{
-			Oid:    oid,
+			Oid:    id,
 			Type:   t.Type,
 			Time:   t.Time,
 			fields: t.Fields,
@@ -528,6 +692,7 @@ func (p BucketTreatmentRepository) addTreatmentsToMemStore(ctx context.Context,
 		delete(memTreatment.fields, "created_at")
 
 		p.memTreatmentStore.treatments = append(p.memTreatmentStore.treatments, memTreatment)
+		p.memTreatmentStore.oids.add(memTreatment.Oid, len(p.memTreatmentStore.treatments)-1)
 
 		if memTreatment.Time.Before(lastTreatmentTime) {
 			treatmentsNeedSorting = true
@@ -553,7 +718,7 @@ func (p BucketTreatmentRepository) addTreatmentsToMemStore(ctx context.Context,
 
 		lastTreatmentTime = memTreatment.Time
 
-		t.ID = oid
+		t.ID = oidOf(id)
 		modelTreatments = append(modelTreatments, t)
 	}
 	log.Info("inserted treatments", slog.Int("totalTreatments", len(p.memTreatmentStore.treatments)), slog.Int("numInserted", len(treatments)))
@@ -561,6 +726,7 @@ func (p BucketTreatmentRepository) addTreatmentsToMemStore(ctx context.Context,
 	if treatmentsNeedSorting {
 		t1 := time.Now()
 		slices.SortFunc(p.memTreatmentStore.treatments, func(a, b memTreatment) int { return a.Time.Compare(b.Time) })
+		p.memTreatmentStore.oids.reset()
 		log.Debug("treatments sorted", slog.Int64("duration_us", time.Since(t1).Microseconds()))
 	}
 
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestSyncTreatmentPastYears(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	twoYearsAgo := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	_, err := NewBucketArchiveWriter(bs).WriteTreatments(ctx, []models.Treatment{
+		{ID: "archived", Type: "Note", Time: twoYearsAgo},
+	}, now)
+	assert.NoError(t, err)
+
+	repo := NewBucketTreatmentRepository(bs)
+	repo.memTreatmentStore.heldFrom = lastYear
+	repo.addTreatmentsToMemStore(ctx, now, []models.Treatment{
+		{ID: "imported", Type: "Meal Bolus", Time: twoYearsAgo.Add(time.Hour), Fields: map[string]interface{}{"insulin": 2.5}},
+		{ID: "lastyear", Type: "Note", Time: lastYear, Fields: map[string]interface{}{}},
+		{ID: "deleted", Type: "Note", Time: lastYear.Add(time.Hour), Fields: map[string]interface{}{}},
+	})
+	repo.syncToBucket(ctx, now)
+	assert.Empty(t, repo.memTreatmentStore.dirtyYears)
+
+	// years we do not hold are merged into the stored year file
+	assert.Equal(t, []string{"archived", "imported"}, dayFileOids(t, bs, "ns-year/2022-treatments.json"))
+	assert.Equal(t, []string{"lastyear", "deleted"}, dayFileOids(t, bs, "ns-year/2023-treatments.json"))
+
+	// years loaded at boot are rewritten from memory, so deletions stick
+	assert.NoError(t, repo.DeleteTreatmentByOid(ctx, "deleted"))
+	assert.NoError(t, repo.Flush(ctx))
+	assert.Equal(t, []string{"lastyear"}, dayFileOids(t, bs, "ns-year/2023-treatments.json"))
+}
+
+func TestTreatmentsStoredAsULIDs(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	repo := NewBucketTreatmentRepository(bs)
+	repo.IDStrategy = &ulidStrategy{}
+	clientOid := "673f0b9c2d9a23bffdc4a2cb"
+	created := repo.addTreatmentsToMemStore(ctx, now, []models.Treatment{
+		{Type: "Note", Time: recent, Fields: map[string]interface{}{}},
+		{ID: clientOid, Type: "Note", Time: future, Fields: map[string]interface{}{}},
+	})
+
+	// clients see oids, while memory and files hold ULIDs
+	assert.Len(t, created[0].ID, 24)
+	assert.Equal(t, clientOid, created[1].ID)
+	assert.Len(t, repo.memTreatmentStore.treatments[1].Oid, 26)
+	treatment, err := repo.FetchTreatmentByOid(ctx, created[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, created[0].ID, treatment.ID)
+
+	repo.syncToBucket(ctx, now)
+	stored := dayFileOids(t, bs, "ns-day/2024-11-28-treatments.json")
+	assert.Equal(t, []string{repo.IDStrategy.StoredID(created[0].ID), repo.IDStrategy.StoredID(clientOid)}, stored)
+
+	// switching back to objectids keeps the oids clients have seen
+	objectIDRepo := NewBucketTreatmentRepository(bs)
+	assert.NoError(t, objectIDRepo.loadTreatments(ctx, "ns-day/2024-11-28-treatments.json"))
+	assert.NoError(t, objectIDRepo.DeleteTreatmentByOid(ctx, clientOid))
+	latest, err := objectIDRepo.FetchLatestTreatments(ctx, future, 2)
+	assert.NoError(t, err)
+	assert.Len(t, latest, 1)
+	assert.Equal(t, created[0].ID, latest[0].ID)
+}
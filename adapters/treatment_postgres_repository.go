@@ -0,0 +1,235 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// PostgresInterface is the subset of a connection pool the postgres
+// repositories use
+type PostgresInterface interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// treatments hold the well-known columns we query on. Everything else the
+// client sent is kept as-is in fields.
+const treatmentSchema = `
+CREATE TABLE IF NOT EXISTS treatments (
+	oid        text PRIMARY KEY,
+	event_type text NOT NULL,
+	event_time timestamptz NOT NULL,
+	fields     jsonb NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS treatments_event_time ON treatments (event_time);
+`
+
+type PostgresTreatmentRepository struct {
+	DB PostgresInterface
+}
+
+func NewPostgresTreatmentRepository(db PostgresInterface) *PostgresTreatmentRepository {
+	return &PostgresTreatmentRepository{
+		DB: db,
+	}
+}
+
+// Boot creates the treatments table if needed. Treatments are not cached in
+// memory, every request is a query.
+func (p PostgresTreatmentRepository) Boot(ctx context.Context) error {
+	log := slogctx.FromCtx(ctx)
+	_, err := p.DB.Exec(ctx, treatmentSchema)
+	if err != nil {
+		return fmt.Errorf("cannot create treatments schema: %w", err)
+	}
+
+	var numTreatments int
+	var mostRecentTime *time.Time
+	err = p.DB.QueryRow(ctx, "SELECT count(*), max(event_time) FROM treatments").Scan(&numTreatments, &mostRecentTime)
+	if err != nil {
+		return fmt.Errorf("cannot count treatments: %w", err)
+	}
+	attrs := []any{slog.Int("numTreatments", numTreatments)}
+	if mostRecentTime != nil {
+		attrs = append(attrs, slog.Time("mostRecentTreatmentTime", *mostRecentTime))
+	}
+	log.Info("boot: postgres treatments ready", attrs...)
+	return nil
+}
+
+func (p PostgresTreatmentRepository) FetchTreatmentByOid(ctx context.Context, oid string) (*models.Treatment, error) {
+	row := p.DB.QueryRow(ctx, "SELECT oid, event_type, event_time, fields FROM treatments WHERE oid = $1", oid)
+	t, err := scanTreatment(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (p PostgresTreatmentRepository) DeleteTreatmentByOid(ctx context.Context, oid string) error {
+	tag, err := p.DB.Exec(ctx, "DELETE FROM treatments WHERE oid = $1", oid)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+// PurgeTreatments deletes treatments with an event time in [from, to),
+// returning how many were deleted
+func (p PostgresTreatmentRepository) PurgeTreatments(ctx context.Context, from, to time.Time) (int, error) {
+	tag, err := p.DB.Exec(ctx, "DELETE FROM treatments WHERE event_time >= $1 AND event_time < $2", from.UTC(), to.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+func (p PostgresTreatmentRepository) UpdateTreatmentByOid(ctx context.Context, oid string, treatment *models.Treatment) error {
+	tag, err := p.DB.Exec(ctx,
+		"UPDATE treatments SET event_type = $2, event_time = $3, fields = $4 WHERE oid = $1",
+		oid, treatment.Type, treatment.Time.UTC(), treatmentFields(treatment.Fields),
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return models.ErrNotFound
+	}
+	return nil
+}
+
+func (p PostgresTreatmentRepository) FetchLatestTreatments(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error) {
+	rows, err := p.DB.Query(ctx,
+		"SELECT oid, event_type, event_time, fields FROM treatments WHERE event_time <= $1 ORDER BY event_time DESC LIMIT $2",
+		maxTime.UTC(), maxTreatments,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectTreatments(rows)
+}
+
+// FetchTreatmentsAfter returns treatments with an event time after minTime,
+// oldest first.
+func (p PostgresTreatmentRepository) FetchTreatmentsAfter(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+	rows, err := p.DB.Query(ctx,
+		"SELECT oid, event_type, event_time, fields FROM treatments WHERE event_time > $1 ORDER BY event_time",
+		minTime.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectTreatments(rows)
+}
+
+// ExportTreatments calls fn for every treatment, oldest first
+func (p PostgresTreatmentRepository) ExportTreatments(ctx context.Context, fn func(models.Treatment) error) error {
+	rows, err := p.DB.Query(ctx, "SELECT oid, event_type, event_time, fields FROM treatments ORDER BY event_time")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanTreatment(rows)
+		if err != nil {
+			return err
+		}
+		err = fn(t)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CreateTreatments inserts treatments in a single batch, returning those
+// inserted. Treatments whose oid we already have are skipped.
+func (p PostgresTreatmentRepository) CreateTreatments(ctx context.Context, treatments []models.Treatment) []models.Treatment {
+	log := slogctx.FromCtx(ctx)
+	var modelTreatments []models.Treatment
+	if len(treatments) == 0 {
+		return modelTreatments
+	}
+
+	now := time.Now()
+	toInsert := slices.Clone(treatments)
+	batch := &pgx.Batch{}
+	for i, t := range toInsert {
+		if t.ID == "" {
+			toInsert[i].ID = newOid(now)
+		}
+		batch.Queue(
+			"INSERT INTO treatments (oid, event_type, event_time, fields) VALUES ($1, $2, $3, $4) ON CONFLICT (oid) DO NOTHING",
+			toInsert[i].ID, t.Type, t.Time.UTC(), treatmentFields(t.Fields),
+		)
+	}
+
+	results := p.DB.SendBatch(ctx, batch)
+	defer results.Close()
+	for _, t := range toInsert {
+		tag, err := results.Exec()
+		if err != nil {
+			log.Warn("cannot insert treatment", slog.String("oid", t.ID), slog.Any("err", err))
+			continue
+		}
+		if tag.RowsAffected() == 0 {
+			log.Debug("skipping duplicate treatment", slog.String("oid", t.ID))
+			continue
+		}
+		modelTreatments = append(modelTreatments, t)
+	}
+	log.Info("inserted treatments", slog.Int("numInserted", len(modelTreatments)))
+	return modelTreatments
+}
+
+// treatmentFields returns fields without those stored in their own columns
+func treatmentFields(fields map[string]interface{}) map[string]interface{} {
+	stored := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		switch k {
+		case "_id", "eventType", "eventTime", "created_at":
+			continue
+		}
+		stored[k] = v
+	}
+	return stored
+}
+
+func scanTreatment(row pgx.Row) (models.Treatment, error) {
+	var t models.Treatment
+	err := row.Scan(&t.ID, &t.Type, &t.Time, &t.Fields)
+	if err != nil {
+		return t, err
+	}
+	t.Time = t.Time.UTC()
+	return t, nil
+}
+
+func collectTreatments(rows pgx.Rows) ([]models.Treatment, error) {
+	defer rows.Close()
+	treatments := make([]models.Treatment, 0)
+	for rows.Next() {
+		t, err := scanTreatment(rows)
+		if err != nil {
+			return nil, err
+		}
+		treatments = append(treatments, t)
+	}
+	return treatments, rows.Err()
+}
@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	postgresstore "github.com/adamlounds/nightscout-go/stores/postgres"
+	"github.com/stretchr/testify/assert"
+)
+
+// postgresForTest connects to TEST_DATABASE_URL, skipping the test if it is
+// not set. Tables are dropped first, so never point this at real data.
+func postgresForTest(t *testing.T, tables ...string) *postgresstore.PostgresStore {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	ctx := contextWithSilentLogger()
+	db, err := postgresstore.New(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	for _, table := range tables {
+		_, err = db.Exec(ctx, "DROP TABLE IF EXISTS "+table)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestPostgresTreatmentRepository(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	repo := NewPostgresTreatmentRepository(postgresForTest(t, "treatments"))
+	assert.NoError(t, repo.Boot(ctx))
+
+	created := repo.CreateTreatments(ctx, []models.Treatment{
+		{ID: "carbs", Type: "Carbs", Time: sameMonth, Fields: map[string]interface{}{"carbs": 20.0, "eventType": "Carbs"}},
+		{Type: "Note", Time: recent, Fields: map[string]interface{}{"notes": "hello"}},
+	})
+	assert.Len(t, created, 2)
+	assert.NotEmpty(t, created[1].ID)
+
+	// duplicate oids are skipped
+	assert.Empty(t, repo.CreateTreatments(ctx, []models.Treatment{{ID: "carbs", Type: "Carbs", Time: sameDay}}))
+
+	treatment, err := repo.FetchTreatmentByOid(ctx, "carbs")
+	assert.NoError(t, err)
+	assert.Equal(t, models.Treatment{ID: "carbs", Type: "Carbs", Time: sameMonth, Fields: map[string]interface{}{"carbs": 20.0}}, *treatment)
+
+	latest, err := repo.FetchLatestTreatments(ctx, now, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Treatment{{ID: created[1].ID, Type: "Note", Time: recent, Fields: map[string]interface{}{"notes": "hello"}}}, latest)
+
+	after, err := repo.FetchTreatmentsAfter(ctx, lastYear)
+	assert.NoError(t, err)
+	assert.Len(t, after, 2)
+	assert.Equal(t, "carbs", after[0].ID)
+
+	treatment.Time = sameDay
+	treatment.Fields["carbs"] = 30.0
+	assert.NoError(t, repo.UpdateTreatmentByOid(ctx, "carbs", treatment))
+	treatment, err = repo.FetchTreatmentByOid(ctx, "carbs")
+	assert.NoError(t, err)
+	assert.Equal(t, sameDay, treatment.Time)
+	assert.Equal(t, 30.0, treatment.Fields["carbs"])
+
+	var exported []string
+	assert.NoError(t, repo.ExportTreatments(ctx, func(t models.Treatment) error {
+		exported = append(exported, t.ID)
+		return nil
+	}))
+	assert.Equal(t, []string{"carbs", created[1].ID}, exported)
+
+	assert.NoError(t, repo.DeleteTreatmentByOid(ctx, "carbs"))
+	assert.ErrorIs(t, repo.DeleteTreatmentByOid(ctx, "carbs"), models.ErrNotFound)
+	_, err = repo.FetchTreatmentByOid(ctx, "carbs")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	assert.ErrorIs(t, repo.UpdateTreatmentByOid(ctx, "carbs", &models.Treatment{Time: time.Now()}), models.ErrNotFound)
+}
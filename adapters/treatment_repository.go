@@ -0,0 +1,19 @@
+package repository
+
+import (
+	"context"
+	"github.com/adamlounds/nightscout-go/models"
+	"time"
+)
+
+// TreatmentRepository is implemented by each treatment storage backend
+type TreatmentRepository interface {
+	Boot(ctx context.Context) error
+	FetchTreatmentByOid(ctx context.Context, oid string) (*models.Treatment, error)
+	DeleteTreatmentByOid(ctx context.Context, oid string) error
+	FetchLatestTreatments(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error)
+	FetchTreatmentsAfter(ctx context.Context, minTime time.Time) ([]models.Treatment, error)
+	CreateTreatments(ctx context.Context, treatments []models.Treatment) []models.Treatment
+	UpdateTreatmentByOid(ctx context.Context, oid string, treatment *models.Treatment) error
+	PurgeTreatments(ctx context.Context, from, to time.Time) (int, error)
+}
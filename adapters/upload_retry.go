@@ -0,0 +1,192 @@
+package repository
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Day, month and year files are only rewritten when something new makes them
+// dirty, so a failed upload would otherwise leave the bucket stale until the
+// next entry arrives (or for good, if that entry is for a different period).
+// Failed uploads are queued and retried with exponential backoff until they
+// succeed. Each upload is the whole file, so a newer write for the same object
+// replaces any queued one.
+//
+// Pending and failed uploads are published at /debug/vars, and a retry that
+// is still failing after alertAttempts is logged as an error.
+
+var (
+	uploadsPending  = expvar.NewInt("bucket_uploads_pending")
+	uploadsFailures = expvar.NewInt("bucket_upload_failures")
+)
+
+const (
+	retryMinBackoff = time.Second
+	retryMaxBackoff = 5 * time.Minute
+	alertAttempts   = 5
+)
+
+type pendingUpload struct {
+	body        []byte // uncompressed
+	compression bucketstore.Compression
+	attempts    int
+	nextAttempt time.Time
+}
+
+// uploadRetryQueue retries failed uploads in the background. Retries are made
+// holding lock, the lock writers hold, so a retry can never overwrite a newer
+// successful write.
+type uploadRetryQueue struct {
+	bucketStore   BucketStoreInterface
+	lock          sync.Locker
+	queueLock     sync.Mutex
+	pending       map[string]*pendingUpload // by object name
+	running       bool
+	adminNotifies *models.AdminNotifies // told about uploads still failing
+}
+
+func newUploadRetryQueue(bs BucketStoreInterface, lock sync.Locker) *uploadRetryQueue {
+	return &uploadRetryQueue{
+		bucketStore: bs,
+		lock:        lock,
+		pending:     make(map[string]*pendingUpload),
+	}
+}
+
+// backoff returns how long to wait after a number of failed attempts
+func backoff(attempts int) time.Duration {
+	d := retryMinBackoff
+	for i := 1; i < attempts && d < retryMaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, retryMaxBackoff)
+}
+
+// upload uploads b as name, queueing it for retry if the upload fails.
+// Callers must hold the queue's lock.
+func (q *uploadRetryQueue) upload(ctx context.Context, c bucketstore.Compression, name string, b []byte) (int, error) {
+	size, err := uploadCompressed(ctx, q.bucketStore, c, name, b)
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	if err == nil {
+		if _, ok := q.pending[name]; ok {
+			delete(q.pending, name)
+			uploadsPending.Add(-1)
+		}
+		return size, nil
+	}
+
+	uploadsFailures.Add(1)
+	u, ok := q.pending[name]
+	if !ok {
+		u = &pendingUpload{}
+		q.pending[name] = u
+		uploadsPending.Add(1)
+	}
+	u.body = b
+	u.compression = c
+	u.attempts++
+	u.nextAttempt = time.Now().Add(backoff(u.attempts))
+	if !q.running {
+		q.running = true
+		go q.run(context.WithoutCancel(ctx))
+	}
+	return 0, err
+}
+
+// setAdminNotifies tells n about uploads that keep failing, as well as
+// logging them
+func (q *uploadRetryQueue) setAdminNotifies(n *models.AdminNotifies) {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	q.adminNotifies = n
+}
+
+// numPending returns the number of uploads waiting to be retried
+func (q *uploadRetryQueue) numPending() int {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	return len(q.pending)
+}
+
+// flush retries every pending upload now, whether or not it is due, eg at
+// shutdown
+func (q *uploadRetryQueue) flush(ctx context.Context) error {
+	q.retryDue(ctx, time.Now().Add(retryMaxBackoff))
+	n := q.numPending()
+	if n > 0 {
+		return fmt.Errorf("%d uploads still failing", n)
+	}
+	return nil
+}
+
+// run retries pending uploads as they fall due, returning once none are left
+func (q *uploadRetryQueue) run(ctx context.Context) {
+	for {
+		q.queueLock.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.queueLock.Unlock()
+			return
+		}
+		var next time.Time
+		for _, u := range q.pending {
+			if next.IsZero() || u.nextAttempt.Before(next) {
+				next = u.nextAttempt
+			}
+		}
+		q.queueLock.Unlock()
+
+		time.Sleep(time.Until(next))
+		q.retryDue(ctx, time.Now())
+	}
+}
+
+// retryDue retries every upload due by now
+func (q *uploadRetryQueue) retryDue(ctx context.Context, now time.Time) {
+	log := slogctx.FromCtx(ctx)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.queueLock.Lock()
+	due := make(map[string]pendingUpload)
+	for name, u := range q.pending {
+		if !u.nextAttempt.After(now) {
+			due[name] = *u
+		}
+	}
+	q.queueLock.Unlock()
+
+	for name, u := range due {
+		_, err := uploadCompressed(ctx, q.bucketStore, u.compression, name, u.body)
+		q.queueLock.Lock()
+		if err == nil {
+			delete(q.pending, name)
+			uploadsPending.Add(-1)
+			q.queueLock.Unlock()
+			log.Info("retried upload succeeded", slog.String("name", name), slog.Int("attempts", u.attempts+1))
+			continue
+		}
+		uploadsFailures.Add(1)
+		p := q.pending[name]
+		p.attempts++
+		p.nextAttempt = time.Now().Add(backoff(p.attempts))
+		attempts := p.attempts
+		adminNotifies := q.adminNotifies
+		q.queueLock.Unlock()
+
+		if attempts >= alertAttempts {
+			log.Error("upload still failing", slog.String("name", name), slog.Int("attempts", attempts), slog.Any("err", err))
+			adminNotifies.Add("Bucket upload failing", fmt.Sprintf("cannot write %s to the bucket, still retrying: %v", name, err))
+		} else {
+			log.Warn("upload failed, will retry", slog.String("name", name), slog.Int("attempts", attempts), slog.Any("err", err))
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+// flakyBucketStore fails uploads while failing is set
+type flakyBucketStore struct {
+	*bucketstore.BucketStore
+	failing bool
+}
+
+func (f *flakyBucketStore) Upload(ctx context.Context, name string, r io.Reader) error {
+	if f.failing {
+		return errors.New("service unavailable")
+	}
+	return f.BucketStore.Upload(ctx, name, r)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, backoff(1))
+	assert.Equal(t, 2*time.Second, backoff(2))
+	assert.Equal(t, 16*time.Second, backoff(5))
+	assert.Equal(t, retryMaxBackoff, backoff(20))
+}
+
+func TestUploadRetryQueue(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &flakyBucketStore{BucketStore: &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}, failing: true}
+	var lock sync.Mutex
+	q := newUploadRetryQueue(bs, &lock)
+	q.running = true // retry by hand rather than in the background
+	c := bucketstore.CompressionNone
+
+	lock.Lock()
+	_, err := q.upload(ctx, c, "ns-day/2024-11-28.json", []byte(`[1]`))
+	lock.Unlock()
+	assert.Error(t, err)
+	assert.Equal(t, 1, q.numPending())
+
+	// not due yet
+	q.retryDue(ctx, time.Now())
+	assert.Equal(t, 1, q.pending["ns-day/2024-11-28.json"].attempts)
+
+	q.retryDue(ctx, time.Now().Add(time.Hour))
+	assert.Equal(t, 2, q.pending["ns-day/2024-11-28.json"].attempts)
+
+	// a newer write replaces the queued one
+	lock.Lock()
+	_, err = q.upload(ctx, c, "ns-day/2024-11-28.json", []byte(`[1,2]`))
+	lock.Unlock()
+	assert.Error(t, err)
+	assert.Equal(t, 1, q.numPending())
+
+	bs.failing = false
+	q.retryDue(ctx, time.Now().Add(time.Hour))
+	assert.Equal(t, 0, q.numPending())
+	r, err := bs.Get(ctx, "ns-day/2024-11-28.json")
+	assert.NoError(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, `[1,2]`, string(b))
+
+	// a successful write drops a queued retry, which would now be stale
+	bs.failing = true
+	lock.Lock()
+	_, _ = q.upload(ctx, c, "ns-day/2024-11-29.json", []byte(`[3]`))
+	bs.failing = false
+	_, err = q.upload(ctx, c, "ns-day/2024-11-29.json", []byte(`[3,4]`))
+	lock.Unlock()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.numPending())
+}
+
+func TestFlush(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &flakyBucketStore{BucketStore: &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}, failing: true}
+	repo := NewBucketEntryRepository(bs)
+	repo.uploads.running = true // retry by hand rather than in the background
+
+	repo.addEntriesToMemStore(ctx, now, []models.Entry{{Type: "sgv", SgvMgdl: 100, Device: "dev", Time: recent}})
+	repo.syncToBucket(ctx, now)
+	assert.Equal(t, 1, repo.uploads.numPending())
+	assert.EqualError(t, repo.Flush(ctx), "1 uploads still failing")
+
+	bs.failing = false
+	assert.NoError(t, repo.Flush(ctx))
+	exists, err := bs.Bucket.Exists(ctx, "ns-day/2024-11-28.json")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestUploadRetryQueue_AdminNotifies(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &flakyBucketStore{BucketStore: &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}, failing: true}
+	var lock sync.Mutex
+	q := newUploadRetryQueue(bs, &lock)
+	q.running = true // retry by hand rather than in the background
+	adminNotifies := models.NewAdminNotifies()
+	q.setAdminNotifies(adminNotifies)
+
+	lock.Lock()
+	_, _ = q.upload(ctx, bucketstore.CompressionNone, "ns-day/2024-11-28.json", []byte(`[1]`))
+	lock.Unlock()
+	for range alertAttempts - 2 {
+		q.retryDue(ctx, time.Now().Add(time.Hour))
+	}
+	assert.Empty(t, adminNotifies.Recent(time.Now()), "a few failures are only logged")
+
+	q.retryDue(ctx, time.Now().Add(time.Hour))
+	q.retryDue(ctx, time.Now().Add(time.Hour))
+	notifies := adminNotifies.Recent(time.Now())
+	assert.Len(t, notifies, 1)
+	assert.Equal(t, "cannot write ns-day/2024-11-28.json to the bucket, still retrying: service unavailable", notifies[0].Message)
+	assert.Equal(t, 2, notifies[0].Count)
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookTimeout limits how long we wait for the webhook to accept a
+// notification
+const webhookTimeout = 10 * time.Second
+
+// webhookNotification is what is POSTed to the webhook
+type webhookNotification struct {
+	Level          int    `json:"level"`
+	Title          string `json:"title"`
+	Message        string `json:"message"`
+	Group          string `json:"group"`
+	Time           string `json:"time"` // rfc3339 plus ms
+	IsAnnouncement bool   `json:"isAnnouncement,omitempty"`
+}
+
+// WebhookNotifier POSTs notifications as json to a url, eg an automation
+// service that forwards them to phones
+type WebhookNotifier struct {
+	URL    *url.URL
+	Client *http.Client
+}
+
+func NewWebhookNotifier(u *url.URL) *WebhookNotifier {
+	return &WebhookNotifier{URL: u, Client: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Notify sends the notification in the background, so callers are not held
+// up by a slow webhook. Failures are logged.
+func (n *WebhookNotifier) Notify(ctx context.Context, notification models.Notification) {
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		err := n.send(ctx, notification)
+		if err != nil {
+			slogctx.FromCtx(ctx).Warn("cannot send notification to webhook",
+				slog.String("title", notification.Title),
+				slog.Any("error", err),
+			)
+		}
+	}()
+}
+
+func (n *WebhookNotifier) send(ctx context.Context, notification models.Notification) error {
+	body, err := json.Marshal(webhookNotification{
+		Level:          notification.Level,
+		Title:          notification.Title,
+		Message:        notification.Message,
+		Group:          notification.Group,
+		Time:           notification.Time.UTC().Format("2006-01-02T15:04:05.000Z"),
+		IsAnnouncement: notification.IsAnnouncement,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
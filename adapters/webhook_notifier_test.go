@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookNotifier_Notify(t *testing.T) {
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	NewWebhookNotifier(u).Notify(ctx, models.Notification{
+		Level:          models.LevelInfo,
+		Title:          "Announcement",
+		Message:        "gone for a run",
+		Group:          models.AnnouncementGroup,
+		Time:           time.Date(2024, 12, 15, 11, 50, 0, 0, time.UTC),
+		IsAnnouncement: true,
+	})
+	cancel() // the request finishing does not stop the notification
+
+	select {
+	case body := <-bodies:
+		assert.JSONEq(t, `{"level":0,"title":"Announcement","message":"gone for a run","group":"Announcement","time":"2024-12-15T11:50:00.000Z","isAnnouncement":true}`, body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+}
+
+func TestWebhookNotifier_send(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	err := NewWebhookNotifier(u).send(context.Background(), models.Notification{Title: "Announcement"})
+	assert.ErrorContains(t, err, "502")
+}
@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	slogctx "github.com/veqryn/slog-context"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Two instances writing to the same bucket, eg while a rolling deploy
+// overlaps, would each rewrite the day file from their own memory, and the
+// last writer would silently drop the other's entries. The object store
+// client cannot make conditional (If-Match) uploads, so with CheckConflicts
+// set each day, month and year file is read back before it is rewritten. If it
+// has changed since this instance last read or wrote it, anything it holds
+// that we do not is merged into memory and into the file being written.
+//
+// This narrows the window for lost updates to the time between the check and
+// the upload rather than closing it, and as files hold no tombstones an entry
+// deleted by one instance can be restored by the other. A SyncLease makes
+// instances take turns instead.
+
+// objectVersions remembers a checksum of each file as this instance last read
+// or wrote it
+type objectVersions struct {
+	lock sync.Mutex
+	sums map[string][sha256.Size]byte
+}
+
+func newObjectVersions() *objectVersions {
+	return &objectVersions{sums: make(map[string][sha256.Size]byte)}
+}
+
+// set records the uncompressed contents of name, as read or written
+func (v *objectVersions) set(name string, b []byte) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.sums[name] = sha256.Sum256(b)
+}
+
+// changed fetches name, returning its contents if it has been written by
+// someone else since we last saw it. Missing files have not changed.
+func (v *objectVersions) changed(ctx context.Context, bs BucketStoreInterface, c bucketstore.Compression, name string) ([]byte, bool, error) {
+	r, err := getCompressed(ctx, bs, c, name)
+	if err != nil {
+		if bs.IsObjNotFoundErr(err) {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("cannot fetch %s: %w", name, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot read %s: %w", name, err)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	sum, ok := v.sums[name]
+	if ok && sum == sha256.Sum256(b) {
+		return nil, false, nil
+	}
+	return b, true, nil
+}
+
+// reconcileEntries merges entries written to name by another instance into
+// memory and into storedEntries, which are about to be written. Callers must
+// hold dirtyLock.
+func (p BucketEntryRepository) reconcileEntries(ctx context.Context, name string, storedEntries []storedEntry) []storedEntry {
+	log := slogctx.FromCtx(ctx)
+	b, changed, err := p.versions.changed(ctx, p.BucketStore, p.Compression, name)
+	if err != nil {
+		log.Warn("cannot check for conflicting write", slog.String("name", name), slog.Any("err", err))
+		return storedEntries
+	}
+	if !changed {
+		return storedEntries
+	}
+	var theirs []storedEntry
+	err = unmarshalStored(b, &theirs)
+	if err != nil {
+		log.Warn("cannot decode conflicting write", slog.String("name", name), slog.Any("err", err))
+		return storedEntries
+	}
+
+	// the other instance may store ids under another strategy
+	ours := make(map[string]struct{}, len(storedEntries))
+	for _, e := range storedEntries {
+		ours[oidOf(e.Oid)] = struct{}{}
+	}
+	var missing []storedEntry
+	for _, e := range theirs {
+		if _, ok := ours[oidOf(e.Oid)]; !ok {
+			missing = append(missing, e)
+		}
+	}
+	if len(missing) == 0 {
+		return storedEntries
+	}
+
+	p.memStore.entriesLock.Lock()
+	p.memStore.deviceNamesLock.Lock()
+	p.appendStoredEntries(missing)
+	slices.SortStableFunc(p.memStore.entries, func(a, b memEntry) int { return a.EventTime.Compare(b.EventTime) })
+	p.memStore.resetIndexes()
+	p.memStore.deviceNamesLock.Unlock()
+	p.memStore.entriesLock.Unlock()
+
+	log.Warn("merged entries written by another instance", slog.String("name", name), slog.Int("numMerged", len(missing)))
+	merged := append(slices.Clip(storedEntries), missing...)
+	slices.SortStableFunc(merged, func(a, b storedEntry) int { return a.Time.Compare(b.Time) })
+	return merged
+}
+
+// reconcileTreatments merges treatments written to name by another instance,
+// as reconcileEntries. Callers must hold dirtyLock.
+func (p BucketTreatmentRepository) reconcileTreatments(ctx context.Context, name string, storedTreatments []storedTreatment) []storedTreatment {
+	log := slogctx.FromCtx(ctx)
+	b, changed, err := p.versions.changed(ctx, p.BucketStore, p.Compression, name)
+	if err != nil {
+		log.Warn("cannot check for conflicting write", slog.String("name", name), slog.Any("err", err))
+		return storedTreatments
+	}
+	if !changed {
+		return storedTreatments
+	}
+	var theirs []storedTreatment
+	err = unmarshalStored(b, &theirs)
+	if err != nil {
+		log.Warn("cannot decode conflicting write", slog.String("name", name), slog.Any("err", err))
+		return storedTreatments
+	}
+
+	ours := make(map[string]struct{}, len(storedTreatments))
+	for _, st := range storedTreatments {
+		oid, _ := st["_id"].(string)
+		ours[oidOf(oid)] = struct{}{}
+	}
+	var missing []storedTreatment
+	for _, st := range theirs {
+		oid, _ := st["_id"].(string)
+		if _, ok := ours[oidOf(oid)]; !ok {
+			missing = append(missing, st)
+		}
+	}
+	if len(missing) == 0 {
+		return storedTreatments
+	}
+	merged := append(slices.Clip(storedTreatments), missing...)
+	slices.SortStableFunc(merged, func(a, b storedTreatment) int {
+		at, _ := a["created_at"].(string)
+		bt, _ := b["created_at"].(string)
+		return compareRFC3339(at, bt)
+	})
+
+	// memTreatmentsFromStored consumes the fields it lifts out, so convert a copy
+	copies := make([]storedTreatment, len(missing))
+	for i, st := range missing {
+		copies[i] = maps.Clone(st)
+	}
+	p.memTreatmentStore.treatmentsLock.Lock()
+	p.memTreatmentStore.treatments = append(p.memTreatmentStore.treatments, p.memTreatmentsFromStored(ctx, copies)...)
+	slices.SortStableFunc(p.memTreatmentStore.treatments, func(a, b memTreatment) int { return a.Time.Compare(b.Time) })
+	p.memTreatmentStore.oids.reset()
+	p.memTreatmentStore.treatmentsLock.Unlock()
+
+	log.Warn("merged treatments written by another instance", slog.String("name", name), slog.Int("numMerged", len(missing)))
+	return merged
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"io"
+	"testing"
+
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestReconcileEntries(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	oldInstance := NewBucketEntryRepository(bs)
+	oldInstance.CheckConflicts = true
+	newInstance := NewBucketEntryRepository(bs)
+	newInstance.CheckConflicts = true
+
+	oldInstance.addEntriesToMemStore(ctx, now, []models.Entry{{Oid: "old", Type: "sgv", SgvMgdl: 100, Device: "dev", Time: sameDay}})
+	oldInstance.syncToBucket(ctx, now)
+	newInstance.addEntriesToMemStore(ctx, now, []models.Entry{{Oid: "new", Type: "sgv", SgvMgdl: 101, Device: "dev", Time: recent}})
+	newInstance.syncToBucket(ctx, now)
+
+	// the new instance merged the old one's entry rather than overwriting it
+	_, err := newInstance.FetchEntryByOid(ctx, "old")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old", "new"}, dayFileOids(t, bs, "ns-day/2024-11-28.json"))
+
+	// and vice versa
+	oldInstance.addEntriesToMemStore(ctx, now, []models.Entry{{Oid: "later", Type: "sgv", SgvMgdl: 102, Device: "dev", Time: future}})
+	oldInstance.syncToBucket(ctx, now)
+	_, err = oldInstance.FetchEntryByOid(ctx, "new")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"old", "new", "later"}, dayFileOids(t, bs, "ns-day/2024-11-28.json"))
+}
+
+func TestReconcileTreatments(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	oldInstance := NewBucketTreatmentRepository(bs)
+	oldInstance.CheckConflicts = true
+	newInstance := NewBucketTreatmentRepository(bs)
+	newInstance.CheckConflicts = true
+
+	oldInstance.addTreatmentsToMemStore(ctx, now, []models.Treatment{{ID: "old", Type: "Note", Time: sameDay, Fields: map[string]interface{}{"notes": "old"}}})
+	oldInstance.syncToBucket(ctx, now)
+	newInstance.addTreatmentsToMemStore(ctx, now, []models.Treatment{{ID: "new", Type: "Note", Time: recent, Fields: map[string]interface{}{}}})
+	newInstance.syncToBucket(ctx, now)
+
+	merged, err := newInstance.FetchTreatmentByOid(ctx, "old")
+	assert.NoError(t, err)
+	assert.Equal(t, "old", merged.Fields["notes"])
+	assert.Equal(t, []string{"old", "new"}, dayFileOids(t, bs, "ns-day/2024-11-28-treatments.json"))
+}
+
+func TestReconcileWithoutConflicts(t *testing.T) {
+	ctx := contextWithSilentLogger()
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	repo := NewBucketTreatmentRepository(bs)
+	repo.CheckConflicts = true
+
+	repo.addTreatmentsToMemStore(ctx, now, []models.Treatment{
+		{ID: "a", Type: "Note", Time: sameDay, Fields: map[string]interface{}{}},
+		{ID: "b", Type: "Note", Time: recent, Fields: map[string]interface{}{}},
+	})
+	repo.syncToBucket(ctx, now)
+	assert.NoError(t, repo.DeleteTreatmentByOid(ctx, "a"))
+	assert.NoError(t, repo.WaitForSyncs(ctx))
+	repo.memTreatmentStore.dirtyDay = true
+	repo.syncToBucket(ctx, now)
+
+	// the file was as we last wrote it, so the deleted treatment stays deleted
+	_, err := repo.FetchTreatmentByOid(ctx, "a")
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	assert.Equal(t, []string{"b"}, dayFileOids(t, bs, "ns-day/2024-11-28-treatments.json"))
+}
+
+// dayFileOids returns the oids in a day, month or year file, in order
+func dayFileOids(t *testing.T, bs *bucketstore.BucketStore, name string) []string {
+	r, err := bs.Get(contextWithSilentLogger(), name)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	var stored []storedTreatment
+	assert.NoError(t, unmarshalStored(b, &stored))
+	var oids []string
+	for _, st := range stored {
+		oids = append(oids, st["_id"].(string))
+	}
+	return oids
+}
@@ -0,0 +1,242 @@
+// Command migrate copies every entry and treatment between storage backends,
+// eg when moving from STORAGE_BACKEND=bucket to postgres:
+//
+//	migrate -from bucket -to postgres
+//
+// Backends are configured from the same environment as the server
+// (OBJSTORE_CONFIG or S3_CONFIG, DATABASE_URL, ENTRY_COMPRESSION etc).
+// Entries and treatments the destination already has are skipped, so an
+// interrupted migration can simply be run again.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/config"
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	postgresstore "github.com/adamlounds/nightscout-go/stores/postgres"
+	slogctx "github.com/veqryn/slog-context"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+type exporter interface {
+	ExportEntries(ctx context.Context, fn func(models.Entry) error) error
+	ExportTreatments(ctx context.Context, fn func(models.Treatment) error) error
+}
+
+// importer writes a batch, returning how many were new
+type importer interface {
+	ImportEntries(ctx context.Context, entries []models.Entry) (int, error)
+	ImportTreatments(ctx context.Context, treatments []models.Treatment) (int, error)
+}
+
+func main() {
+	from := flag.String("from", "bucket", "backend to copy from: bucket or postgres")
+	to := flag.String("to", "postgres", "backend to copy to: bucket or postgres")
+	batchSize := flag.Int("batch", 5000, "number of entries/treatments written at a time")
+	flag.Parse()
+
+	var cfg config.ServerConfig
+	err := cfg.RegisterEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	h := slogctx.NewHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel}), nil)
+	ctx := slogctx.NewCtx(context.Background(), slog.New(h))
+
+	if *from == *to {
+		fmt.Fprintln(os.Stderr, "-from and -to must be different backends")
+		os.Exit(2)
+	}
+	if *batchSize < 1 {
+		fmt.Fprintln(os.Stderr, "-batch must be at least 1")
+		os.Exit(2)
+	}
+
+	src, err := newExporter(ctx, cfg, *from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	dst, err := newImporter(ctx, cfg, *to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	err = migrate(ctx, src, dst, *batchSize, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// migrate copies entries then treatments from src to dst in batches,
+// writing progress to out
+func migrate(ctx context.Context, src exporter, dst importer, batchSize int, out io.Writer) error {
+	started := time.Now()
+	numRead, numNew := 0, 0
+	entries := make([]models.Entry, 0, batchSize)
+	flushEntries := func() error {
+		n, err := dst.ImportEntries(ctx, entries)
+		if err != nil {
+			return err
+		}
+		numNew += n
+		entries = entries[:0]
+		fmt.Fprintf(out, "entries: %d read, %d new\n", numRead, numNew)
+		return nil
+	}
+	err := src.ExportEntries(ctx, func(e models.Entry) error {
+		numRead++
+		entries = append(entries, e)
+		if len(entries) < batchSize {
+			return nil
+		}
+		return flushEntries()
+	})
+	if err == nil && len(entries) > 0 {
+		err = flushEntries()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot migrate entries after %d: %w", numRead, err)
+	}
+	fmt.Fprintf(out, "entries done: %d read, %d new, %d already present\n", numRead, numNew, numRead-numNew)
+
+	numRead, numNew = 0, 0
+	treatments := make([]models.Treatment, 0, batchSize)
+	flushTreatments := func() error {
+		n, err := dst.ImportTreatments(ctx, treatments)
+		if err != nil {
+			return err
+		}
+		numNew += n
+		treatments = treatments[:0]
+		fmt.Fprintf(out, "treatments: %d read, %d new\n", numRead, numNew)
+		return nil
+	}
+	err = src.ExportTreatments(ctx, func(t models.Treatment) error {
+		numRead++
+		treatments = append(treatments, t)
+		if len(treatments) < batchSize {
+			return nil
+		}
+		return flushTreatments()
+	})
+	if err == nil && len(treatments) > 0 {
+		err = flushTreatments()
+	}
+	if err != nil {
+		return fmt.Errorf("cannot migrate treatments after %d: %w", numRead, err)
+	}
+	fmt.Fprintf(out, "treatments done: %d read, %d new, %d already present\n", numRead, numNew, numRead-numNew)
+	fmt.Fprintf(out, "migration took %s\n", time.Since(started).Round(time.Second))
+	return nil
+}
+
+func newBucket(cfg config.ServerConfig) (*bucketstore.BucketStore, error) {
+	return bucketstore.New(cfg.BucketConfig)
+}
+
+func newPostgres(ctx context.Context, cfg config.ServerConfig) (*postgresstore.PostgresStore, error) {
+	if cfg.DatabaseURL == "" {
+		return nil, fmt.Errorf("DATABASE_URL must be set")
+	}
+	return postgresstore.New(ctx, cfg.DatabaseURL)
+}
+
+func newExporter(ctx context.Context, cfg config.ServerConfig, backend string) (exporter, error) {
+	switch backend {
+	case "bucket":
+		bs, err := newBucket(cfg)
+		if err != nil {
+			return nil, err
+		}
+		e := repository.NewBucketExportRepository(bs)
+		e.EntryCompression = cfg.Compression.Entries
+		e.TreatmentCompression = cfg.Compression.Treatments
+		return e, nil
+	case "postgres":
+		db, err := newPostgres(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return postgresExporter{
+			PostgresEntryRepository:     repository.NewPostgresEntryRepository(db),
+			PostgresTreatmentRepository: repository.NewPostgresTreatmentRepository(db),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q, expected bucket or postgres", backend)
+}
+
+func newImporter(ctx context.Context, cfg config.ServerConfig, backend string) (importer, error) {
+	switch backend {
+	case "bucket":
+		bs, err := newBucket(cfg)
+		if err != nil {
+			return nil, err
+		}
+		w := repository.NewBucketArchiveWriter(bs)
+		w.EntryCompression = cfg.Compression.Entries
+		w.TreatmentCompression = cfg.Compression.Treatments
+		return bucketImporter{writer: w, now: time.Now()}, nil
+	case "postgres":
+		db, err := newPostgres(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		entries := repository.NewPostgresEntryRepository(db)
+		entries.PreserveCreatedTime = true
+		treatments := repository.NewPostgresTreatmentRepository(db)
+		err = entries.Boot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = treatments.Boot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return postgresImporter{entries: entries, treatments: treatments}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q, expected bucket or postgres", backend)
+}
+
+type postgresExporter struct {
+	*repository.PostgresEntryRepository
+	*repository.PostgresTreatmentRepository
+}
+
+type postgresImporter struct {
+	entries    *repository.PostgresEntryRepository
+	treatments *repository.PostgresTreatmentRepository
+}
+
+func (i postgresImporter) ImportEntries(ctx context.Context, entries []models.Entry) (int, error) {
+	return len(i.entries.CreateEntries(ctx, entries)), nil
+}
+
+func (i postgresImporter) ImportTreatments(ctx context.Context, treatments []models.Treatment) (int, error) {
+	return len(i.treatments.CreateTreatments(ctx, treatments)), nil
+}
+
+// bucketImporter places everything relative to when the migration started, so
+// batches either side of midnight agree on which files to write
+type bucketImporter struct {
+	writer *repository.BucketArchiveWriter
+	now    time.Time
+}
+
+func (i bucketImporter) ImportEntries(ctx context.Context, entries []models.Entry) (int, error) {
+	return i.writer.WriteEntries(ctx, entries, i.now)
+}
+
+func (i bucketImporter) ImportTreatments(ctx context.Context, treatments []models.Treatment) (int, error) {
+	return i.writer.WriteTreatments(ctx, treatments, i.now)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	slogctx "github.com/veqryn/slog-context"
+
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestMigrateBetweenBuckets(t *testing.T) {
+	ctx := slogctx.NewCtx(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Now().UTC()
+
+	src := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	var entries []models.Entry
+	for i := range 5 {
+		entries = append(entries, models.Entry{Oid: string(rune('a' + i)), Type: "sgv", SgvMgdl: 100 + i, Device: "d", Time: now.AddDate(-1, 0, -i)})
+	}
+	_, err := repository.NewBucketArchiveWriter(src).WriteEntries(ctx, entries, now)
+	assert.NoError(t, err)
+	_, err = repository.NewBucketArchiveWriter(src).WriteTreatments(ctx, []models.Treatment{{ID: "t", Type: "Note", Time: now}}, now)
+	assert.NoError(t, err)
+
+	dst := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	importer := bucketImporter{writer: repository.NewBucketArchiveWriter(dst), now: now}
+
+	var out bytes.Buffer
+	err = migrate(ctx, repository.NewBucketExportRepository(src), importer, 2, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "entries: 2 read, 2 new\n")
+	assert.Contains(t, out.String(), "entries done: 5 read, 5 new, 0 already present\n")
+	assert.Contains(t, out.String(), "treatments done: 1 read, 1 new, 0 already present\n")
+
+	// running again copies nothing
+	out.Reset()
+	err = migrate(ctx, repository.NewBucketExportRepository(src), importer, 2, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "entries done: 5 read, 0 new, 5 already present\n")
+	assert.Contains(t, out.String(), "treatments done: 1 read, 0 new, 1 already present\n")
+}
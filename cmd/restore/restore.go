@@ -0,0 +1,90 @@
+// Command restore rebuilds missing or corrupt day files from the month and
+// year files, eg after day files were deleted by a retention rule or mangled
+// by hand:
+//
+//	restore -from 2024-11-01 -to 2024-12-01
+//
+// The bucket is configured from the same environment as the server
+// (OBJSTORE_CONFIG or S3_CONFIG, ENTRY_COMPRESSION etc). Intact day files are
+// left alone unless -overwrite is given, and -dry-run lists what would be
+// restored without writing anything.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/config"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	slogctx "github.com/veqryn/slog-context"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+func main() {
+	fromFlag := flag.String("from", "", "first day to restore, yyyy-mm-dd")
+	toFlag := flag.String("to", "", "day to stop before, yyyy-mm-dd. Defaults to today")
+	overwrite := flag.Bool("overwrite", false, "also merge archived data into intact day files")
+	dryRun := flag.Bool("dry-run", false, "list the day files that would be restored without writing them")
+	flag.Parse()
+
+	var cfg config.ServerConfig
+	err := cfg.RegisterEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	h := slogctx.NewHandler(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: cfg.LogLevel}), nil)
+	ctx := slogctx.NewCtx(context.Background(), slog.New(h))
+
+	from, err := time.Parse(time.DateOnly, *fromFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-from must be a date, eg 2024-11-01")
+		os.Exit(2)
+	}
+	to := time.Now().UTC()
+	if *toFlag != "" {
+		to, err = time.Parse(time.DateOnly, *toFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "-to must be a date, eg 2024-12-01")
+			os.Exit(2)
+		}
+	}
+
+	bs, err := bucketstore.New(cfg.BucketConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	r := repository.NewBucketRestorer(bs)
+	r.EntryCompression = cfg.Compression.Entries
+	r.TreatmentCompression = cfg.Compression.Treatments
+	r.Overwrite = *overwrite
+	r.DryRun = *dryRun
+
+	err = restore(ctx, r, from, to, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// restore rebuilds day files in [from, to), writing what was restored to out
+func restore(ctx context.Context, r *repository.BucketRestorer, from, to time.Time, out io.Writer) error {
+	days, err := r.RestoreDays(ctx, from, to)
+	for _, d := range days {
+		fmt.Fprintf(out, "%s: %d restored (was %s)\n", d.Name, d.Items, d.Was)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot restore day files: %w", err)
+	}
+	verb := "restored"
+	if r.DryRun {
+		verb = "would restore"
+	}
+	fmt.Fprintf(out, "%s %d day files\n", verb, len(days))
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	slogctx "github.com/veqryn/slog-context"
+
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestRestore(t *testing.T) {
+	ctx := slogctx.NewCtx(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	err := bs.Upload(ctx, "ns-month/2024-11.json", strings.NewReader(`[{"_id":"a","type":"sgv","sgv":100,"dateString":"2024-11-20T12:00:00Z"}]`))
+	assert.NoError(t, err)
+
+	r := repository.NewBucketRestorer(bs)
+	r.DryRun = true
+	var out bytes.Buffer
+	err = restore(ctx, r, time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "ns-day/2024-11-20.json: 1 restored (was missing)\nwould restore 1 day files\n", out.String())
+}
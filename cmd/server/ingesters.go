@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/adamlounds/nightscout-go/stores/cgmlibrelinkup"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ingester pulls data from an external source into our repositories
+type Ingester interface {
+	Name() string
+	IngestOnce(ctx context.Context)
+	NextIngest(now time.Time) time.Duration
+}
+
+// CGMRepository is a source of cgm readings, eg LibreLinkUp or Dexcom Share
+type CGMRepository interface {
+	IsConfigured() bool
+	FetchRecent(ctx context.Context, lastSeen time.Time) ([]models.Entry, error)
+	CGMConnections(ctx context.Context) []models.CGMConnection
+	ActiveSensor() *models.Sensor
+	LatestReading() *models.Entry
+	FetchInterval() time.Duration
+	ReadingInterval() time.Duration
+	ErrorIsAuthnFailed(error) bool
+}
+
+// cgmSources maps CGM_SOURCE names to the device name prefix of entries they
+// create, which we use to find where each source left off.
+var cgmSources = map[string]string{
+	"librelinkup": "llu ingestor",
+	"dexcomshare": "dexcom share ingestor",
+}
+
+// newCGMRepositories returns the configured cgm repositories. CGM_SOURCE is
+// an optional comma-separated list of sources, eg "librelinkup,dexcomshare";
+// if it is empty every source with credentials is used.
+func newCGMRepositories(sources string, archiver cgmlibrelinkup.Archiver) (map[string]CGMRepository, error) {
+	names := strings.Split(strings.ToLower(sources), ",")
+	if sources == "" {
+		names = []string{"librelinkup", "dexcomshare"}
+	}
+
+	cgms := make(map[string]CGMRepository)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		cgm, err := newCGMRepository(name, archiver)
+		if err != nil {
+			return nil, err
+		}
+		if !cgm.IsConfigured() {
+			if sources != "" {
+				return nil, fmt.Errorf("CGM_SOURCE %s is not configured, check username/password", name)
+			}
+			continue
+		}
+		cgms[name] = cgm
+	}
+	return cgms, nil
+}
+
+func newCGMRepository(source string, archiver cgmlibrelinkup.Archiver) (CGMRepository, error) {
+	switch source {
+	case "dexcomshare":
+		fetchInterval, err := durationFromEnv("DEXCOM_SHARE_FETCH_INTERVAL")
+		if err != nil {
+			return nil, err
+		}
+		return repository.NewCGMDexcomShareRepository(repository.DexcomShareConfig{
+			Region:        strings.ToLower(os.Getenv("DEXCOM_SHARE_REGION")),
+			Username:      os.Getenv("DEXCOM_SHARE_USERNAME"),
+			Password:      os.Getenv("DEXCOM_SHARE_PASSWORD"),
+			FetchInterval: fetchInterval,
+		}), nil
+	case "librelinkup":
+	default:
+		return nil, fmt.Errorf("unknown CGM_SOURCE %q", source)
+	}
+
+	// llu timestamps are in the patient's local time, eg "Europe/London"
+	location, err := time.LoadLocation(os.Getenv("LINK_UP_TIMEZONE"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load LINK_UP_TIMEZONE: %w", err)
+	}
+
+	// raw responses may be archived to the bucket to debug data mismatches
+	var archiveLimit int
+	if v := os.Getenv("LINK_UP_DEBUG_ARCHIVE"); v != "" {
+		archiveLimit, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("LINK_UP_DEBUG_ARCHIVE must be the number of responses to keep: %w", err)
+		}
+	}
+	fetchInterval, err := durationFromEnv("LINK_UP_FETCH_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	return repository.NewCGMLibrelinkupRepository(repository.LLUConfig{
+		FetchInterval: fetchInterval,
+		Region:        strings.ToLower(os.Getenv("LINK_UP_REGION")),
+		Username:      os.Getenv("LINK_UP_USERNAME"),
+		Password:      os.Getenv("LINK_UP_PASSWORD"),
+		PatientID:     os.Getenv("LINK_UP_PATIENT_ID"),
+		Location:      location,
+		Archiver:      archiver,
+		ArchiveLimit:  archiveLimit,
+	}), nil
+}
+
+// durationFromEnv parses an optional duration, eg "90s"
+func durationFromEnv(name string) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 10*time.Second {
+		return 0, fmt.Errorf("%s must be a duration of at least 10s, eg 90s", name)
+	}
+	return d, nil
+}
+
+// cgmRepositories lets the api list connections across all cgm sources
+type cgmRepositories map[string]CGMRepository
+
+func (c cgmRepositories) CGMConnections(ctx context.Context) []models.CGMConnection {
+	connections := []models.CGMConnection{}
+	for _, name := range slices.Sorted(maps.Keys(c)) {
+		connections = append(connections, c[name].CGMConnections(ctx)...)
+	}
+	return connections
+}
+
+// startIngestors runs each ingester immediately, then as often as it asks
+func startIngestors(ctx context.Context, ingesters []Ingester) {
+	for _, ingester := range ingesters {
+		ingester.IngestOnce(ctx)
+
+		go func() {
+			log := slogctx.FromCtx(ctx).With(slog.String("ingester", ingester.Name()))
+			log.Info("starting ingester")
+
+			timer := time.NewTimer(ingester.NextIngest(time.Now()))
+			defer timer.Stop()
+			for {
+				select {
+				case <-timer.C:
+					log.Debug("ingester tick")
+					ingester.IngestOnce(ctx)
+					wait := ingester.NextIngest(time.Now())
+					log.Debug("ingester next poll", slog.Duration("wait", wait))
+					timer.Reset(wait)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// pollSlack allows for the time taken for a reading to reach the cgm
+// provider's servers after the sensor takes it
+const pollSlack = 15 * time.Second
+
+// minPollWait stops us hammering a provider if the clocks disagree
+const minPollWait = 10 * time.Second
+
+// nextPoll aligns polling with the sensor: we poll just after the next reading
+// is expected rather than on a fixed ticker, reducing both latency and api
+// calls. Until we have seen a reading we poll every fetchInterval.
+//
+// fetchInterval is also a lower bound: if it is longer than the sensor's
+// reading interval (eg to cut api calls) we skip to the first reading slot at
+// least fetchInterval away.
+func nextPoll(now, lastReading time.Time, fetchInterval, readingInterval time.Duration) time.Duration {
+	if lastReading.IsZero() || readingInterval <= 0 {
+		return fetchInterval
+	}
+
+	expected := lastReading.Add(readingInterval + pollSlack)
+	if expected.Before(now) {
+		// we missed one or more readings (eg sensor warmup or signal loss),
+		// wait for the next slot
+		missed := now.Sub(expected)/readingInterval + 1
+		expected = expected.Add(missed * readingInterval)
+	}
+
+	wait := expected.Sub(now)
+	if wait > max(fetchInterval, readingInterval) {
+		// the last reading is in the future, our clocks disagree
+		return max(fetchInterval, readingInterval)
+	}
+	if fetchInterval > readingInterval && wait < fetchInterval {
+		slots := (fetchInterval - wait + readingInterval - 1) / readingInterval
+		wait += slots * readingInterval
+	}
+	return max(wait, minPollWait)
+}
+
+// cgmIngester fetches readings from a single cgm source. Each source has its
+// own cursor, so sources do not hide each other's readings.
+type cgmIngester struct {
+	name                string
+	devicePrefix        string
+	cgm                 CGMRepository
+	entryRepository     repository.EntryRepository
+	treatmentRepository repository.TreatmentRepository
+	hiresRepository     *repository.BucketHiresRepository
+	adminNotifies       *models.AdminNotifies
+	lastSeen            time.Time
+}
+
+func (i *cgmIngester) Name() string {
+	return i.name
+}
+
+func (i *cgmIngester) NextIngest(now time.Time) time.Duration {
+	return nextPoll(now, i.lastSeen, i.cgm.FetchInterval(), i.cgm.ReadingInterval())
+}
+
+func (i *cgmIngester) IngestOnce(ctx context.Context) {
+	log := slogctx.FromCtx(ctx).With(slog.String("ingester", i.name))
+
+	// after restart, resume from the last reading this source gave us
+	if i.lastSeen.IsZero() {
+		entry, err := i.entryRepository.FetchLatestSgvEntryForDevice(ctx, time.Now(), i.devicePrefix)
+		if err == nil {
+			i.lastSeen = entry.Time
+		}
+	}
+
+	newEntries, err := i.cgm.FetchRecent(ctx, i.lastSeen)
+	if err != nil {
+		if i.cgm.ErrorIsAuthnFailed(err) {
+			log.Warn("cgm cannot authenticate, check username/password")
+			i.adminNotifies.Add("CGM login failed", i.name+" cannot authenticate, check username/password")
+		} else {
+			log.Warn("cgm cannot fetch entries", slog.Any("error", err))
+		}
+		return
+	}
+	recordSensorStart(ctx, i.treatmentRepository, i.cgm.ActiveSensor())
+
+	if reading := i.cgm.LatestReading(); reading != nil {
+		err = i.hiresRepository.AddReading(ctx, *reading)
+		if err != nil {
+			log.Warn("cgm cannot store hires reading", slog.Any("error", err))
+		}
+	}
+
+	insertedEntries := i.entryRepository.CreateEntries(ctx, newEntries)
+	if len(insertedEntries) == 0 {
+		log.Info("ingester: no new entries")
+		return
+	}
+
+	previousLastSeen := i.lastSeen
+	for _, e := range insertedEntries {
+		if e.Time.After(i.lastSeen) {
+			i.lastSeen = e.Time
+		}
+	}
+	log.Info("ingested entries",
+		slog.Int("numEntries", len(insertedEntries)),
+		slog.Time("previousNewestEntryTime", previousLastSeen),
+		slog.Time("newestEntryTime", i.lastSeen),
+	)
+}
+
+// followEntryLookback and followTreatmentLookback determine how far before the
+// newest data we fetched from the remote we ask it for more. Entries may
+// arrive late (eg uploader offline) and treatments are often entered after
+// the fact.
+const followEntryLookback = time.Hour
+const followTreatmentLookback = 24 * time.Hour
+
+// FollowCursorRepository persists how far the follower has got with each
+// remote nightscout
+type FollowCursorRepository interface {
+	FetchFollowCursor(ctx context.Context, source string) (*models.FollowCursor, error)
+	SaveFollowCursor(ctx context.Context, cursor models.FollowCursor) error
+}
+
+// followIngester polls a remote nightscout for entries and treatments
+type followIngester struct {
+	nsCfg                repository.NightscoutConfig
+	nightscoutRepository *repository.NightscoutRepository
+	entryRepository      repository.EntryRepository
+	treatmentRepository  repository.TreatmentRepository
+	cursorRepository     FollowCursorRepository
+	cursor               *models.FollowCursor // loaded on the first poll
+}
+
+func (i *followIngester) Name() string {
+	return "follow " + i.nsCfg.URL.Host
+}
+
+func (i *followIngester) NextIngest(now time.Time) time.Duration {
+	return time.Minute
+}
+
+// followPageSize is how many entries or treatments are asked for at once.
+// maxFollowPages stops a misbehaving remote from keeping us paging forever:
+// 500 pages is several years of 5-minute readings.
+const followPageSize = 1000
+const maxFollowPages = 500
+
+// IngestOnce fetches recent entries and treatments from the remote nightscout.
+// Remote oids are preserved, so we use them to skip data we already have.
+//
+// We resume from our own cursor rather than our newest data: another source,
+// eg LibreLinkUp, may have newer entries while the remote still has a gap
+// for us to backfill.
+func (i *followIngester) IngestOnce(ctx context.Context) {
+	log := slogctx.FromCtx(ctx).With(slog.String("ingester", i.Name()))
+
+	if i.cursor == nil {
+		cursor, err := i.cursorRepository.FetchFollowCursor(ctx, i.nsCfg.URL.Host)
+		if errors.Is(err, models.ErrNotFound) {
+			cursor = &models.FollowCursor{Source: i.nsCfg.URL.Host}
+		} else if err != nil {
+			log.Warn("follower cannot fetch cursor", slog.Any("error", err))
+			return
+		}
+		i.cursor = cursor
+	}
+	previous := *i.cursor
+	now := time.Now()
+
+	var entriesSince time.Time
+	if !i.cursor.Entries.IsZero() {
+		entriesSince = i.cursor.Entries.Add(-followEntryLookback)
+	}
+	numEntries, newestEntry, err := i.followEntries(ctx, entriesSince)
+	if err != nil {
+		log.Warn("follower cannot fetch entries", slog.Any("error", err))
+	}
+	// a clock-skewed uploader must not move the cursor past data to come
+	if newestEntry.After(now) {
+		newestEntry = now
+	}
+	if newestEntry.After(i.cursor.Entries) {
+		i.cursor.Entries = newestEntry
+	}
+	if numEntries > 0 {
+		log.Info("follower: ingested entries", slog.Int("numEntries", numEntries))
+	}
+
+	var treatmentsSince time.Time
+	if !i.cursor.Treatments.IsZero() {
+		treatmentsSince = i.cursor.Treatments.Add(-followTreatmentLookback)
+	}
+	numTreatments, newestTreatment, err := i.followTreatments(ctx, treatmentsSince)
+	if err != nil {
+		log.Warn("follower cannot fetch treatments", slog.Any("error", err))
+	}
+	if newestTreatment.After(now) {
+		newestTreatment = now
+	}
+	if newestTreatment.After(i.cursor.Treatments) {
+		i.cursor.Treatments = newestTreatment
+	}
+	if numTreatments > 0 {
+		log.Info("follower: ingested treatments", slog.Int("numTreatments", numTreatments))
+	}
+
+	// failing to save only means fetching more again after a restart
+	if *i.cursor != previous {
+		err = i.cursorRepository.SaveFollowCursor(ctx, *i.cursor)
+		if err != nil {
+			log.Warn("follower cannot save cursor", slog.Any("error", err))
+		}
+	}
+}
+
+// followEntries pages forward through the remote's entries from since,
+// storing each page before asking for the next, so a first run or a long
+// outage is backfilled in full and progress survives a failed request. It
+// returns how many entries were new and the time of the newest entry fetched.
+func (i *followIngester) followEntries(ctx context.Context, since time.Time) (int, time.Time, error) {
+	numInserted := 0
+	var newest time.Time
+	for page := 0; page < maxFollowPages; page++ {
+		remoteEntries, err := i.nightscoutRepository.FetchEntriesSince(ctx, i.nsCfg, since, followPageSize)
+		if err != nil {
+			return numInserted, newest, err
+		}
+		var newEntries []models.Entry
+		for _, e := range remoteEntries {
+			_, err := i.entryRepository.FetchEntryByOid(ctx, e.Oid)
+			if errors.Is(err, models.ErrNotFound) {
+				newEntries = append(newEntries, e)
+			}
+			if e.Time.After(newest) {
+				newest = e.Time
+			}
+		}
+		numInserted += len(i.entryRepository.CreateEntries(ctx, newEntries))
+
+		// a short page is the last. A full page that gets no further than
+		// since would be asked for again, so stop rather than loop.
+		if len(remoteEntries) < followPageSize || !remoteEntries[len(remoteEntries)-1].Time.After(since) {
+			return numInserted, newest, nil
+		}
+		since = remoteEntries[len(remoteEntries)-1].Time
+	}
+	return numInserted, newest, fmt.Errorf("still more entries after %d pages", maxFollowPages)
+}
+
+// followTreatments pages forward through the remote's treatments from since,
+// as followEntries
+func (i *followIngester) followTreatments(ctx context.Context, since time.Time) (int, time.Time, error) {
+	numInserted := 0
+	var newest time.Time
+	for page := 0; page < maxFollowPages; page++ {
+		remoteTreatments, err := i.nightscoutRepository.FetchTreatmentsSince(ctx, i.nsCfg, since, followPageSize)
+		if err != nil {
+			return numInserted, newest, err
+		}
+		var newTreatments []models.Treatment
+		for _, t := range remoteTreatments {
+			_, err := i.treatmentRepository.FetchTreatmentByOid(ctx, t.ID)
+			if errors.Is(err, models.ErrNotFound) {
+				newTreatments = append(newTreatments, t)
+			}
+			if t.Time.After(newest) {
+				newest = t.Time
+			}
+		}
+		numInserted += len(i.treatmentRepository.CreateTreatments(ctx, newTreatments))
+
+		if len(remoteTreatments) < followPageSize || !remoteTreatments[len(remoteTreatments)-1].Time.After(since) {
+			return numInserted, newest, nil
+		}
+		since = remoteTreatments[len(remoteTreatments)-1].Time
+	}
+	return numInserted, newest, fmt.Errorf("still more treatments after %d pages", maxFollowPages)
+}
+
+// sensorStartWindow is how far a manually recorded sensor start may be from
+// the time the cgm provider reports
+const sensorStartWindow = 24 * time.Hour
+
+// recordSensorStart creates a Sensor Start treatment for the active sensor,
+// unless one already exists, so sensor age (SAGE) is tracked automatically.
+func recordSensorStart(ctx context.Context, treatmentRepository repository.TreatmentRepository, sensor *models.Sensor) {
+	log := slogctx.FromCtx(ctx)
+	if sensor == nil {
+		return
+	}
+
+	// the sensor may have been recorded manually, eg via careportal, with a
+	// less accurate time and no sensor code
+	treatments, err := treatmentRepository.FetchTreatmentsAfter(ctx, sensor.StartTime.Add(-sensorStartWindow))
+	if err != nil {
+		log.Warn("ingester cannot fetch treatments", slog.Any("error", err))
+		return
+	}
+	for _, t := range treatments {
+		if t.Type == "Sensor Start" && t.Fields["sensorCode"] == sensor.Serial {
+			return
+		}
+		if t.Type != "Sensor Start" && t.Type != "Sensor Change" {
+			continue
+		}
+		sensorCode, _ := t.Fields["sensorCode"].(string)
+		if sensorCode == "" && t.Time.Before(sensor.StartTime.Add(sensorStartWindow)) {
+			return
+		}
+	}
+
+	treatmentRepository.CreateTreatments(ctx, []models.Treatment{{
+		Type: "Sensor Start",
+		Time: sensor.StartTime,
+		Fields: map[string]interface{}{
+			"sensorCode": sensor.Serial,
+			"enteredBy":  "cgm ingestor",
+		},
+	}})
+	log.Info("ingester: recorded sensor start",
+		slog.String("serial", sensor.Serial),
+		slog.Time("startTime", sensor.StartTime),
+	)
+}
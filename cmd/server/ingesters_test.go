@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestNextPoll(t *testing.T) {
+	reading := time.Date(2024, 11, 28, 10, 0, 0, 0, time.UTC)
+
+	// no readings yet: use the fetch interval
+	assert.Equal(t, time.Minute, nextPoll(reading, time.Time{}, time.Minute, 5*time.Minute))
+
+	// poll just after the next reading is expected
+	assert.Equal(t, 55*time.Second, nextPoll(reading.Add(20*time.Second), reading, time.Minute, time.Minute))
+	assert.Equal(t, 4*time.Minute+55*time.Second, nextPoll(reading.Add(20*time.Second), reading, time.Minute, 5*time.Minute))
+
+	// missed readings: wait for the next slot
+	assert.Equal(t, 15*time.Second, nextPoll(reading.Add(3*time.Minute), reading, time.Minute, time.Minute))
+
+	// a longer fetch interval is honoured, polling just after the first
+	// reading slot at least that far away
+	assert.Equal(t, 5*time.Minute+55*time.Second, nextPoll(reading.Add(20*time.Second), reading, 5*time.Minute, time.Minute))
+	assert.Equal(t, 5*time.Minute, nextPoll(reading.Add(15*time.Second), reading, 5*time.Minute, time.Minute))
+	assert.Equal(t, 5*time.Minute+15*time.Second, nextPoll(reading.Add(3*time.Minute), reading, 5*time.Minute, time.Minute))
+
+	// never wait too little, or longer than the slower of the two intervals
+	assert.Equal(t, 10*time.Second, nextPoll(reading.Add(74*time.Second), reading, time.Minute, time.Minute))
+	assert.Equal(t, 2*time.Minute, nextPoll(reading.Add(-5*time.Minute), reading, 2*time.Minute, time.Minute))
+}
+
+func TestRecordSensorStart(t *testing.T) {
+	ctx := context.Background()
+	started := time.Now().Add(-48 * time.Hour).Truncate(time.Second).UTC()
+	sensor := &models.Sensor{Serial: "ABC123", StartTime: started}
+	sensorStarts := func(repo *repository.BucketTreatmentRepository) int {
+		treatments, err := repo.FetchTreatmentsAfter(ctx, started.Add(-7*24*time.Hour))
+		assert.NoError(t, err)
+		n := 0
+		for _, tr := range treatments {
+			if tr.Type == "Sensor Start" || tr.Type == "Sensor Change" {
+				n++
+			}
+		}
+		return n
+	}
+
+	// recorded once, however often the ingester sees the sensor
+	repo := repository.NewBucketTreatmentRepository(&bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()})
+	recordSensorStart(ctx, repo, sensor)
+	recordSensorStart(ctx, repo, sensor)
+	assert.Equal(t, 1, sensorStarts(repo))
+
+	// a sensor change entered by hand, a few hours out, is the same sensor
+	repo = repository.NewBucketTreatmentRepository(&bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()})
+	repo.CreateTreatments(ctx, []models.Treatment{{Type: "Sensor Change", Time: started.Add(3 * time.Hour), Fields: map[string]interface{}{}}})
+	recordSensorStart(ctx, repo, sensor)
+	assert.Equal(t, 1, sensorStarts(repo))
+
+	// ...but not if it was for the previous sensor, or another sensor code
+	repo = repository.NewBucketTreatmentRepository(&bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()})
+	repo.CreateTreatments(ctx, []models.Treatment{
+		{Type: "Sensor Change", Time: started.Add(-10 * 24 * time.Hour), Fields: map[string]interface{}{}},
+		{Type: "Sensor Start", Time: started, Fields: map[string]interface{}{"sensorCode": "OTHER"}},
+	})
+	recordSensorStart(ctx, repo, sensor)
+	assert.Equal(t, 2, sensorStarts(repo))
+	assert.NoError(t, repo.WaitForSyncs(ctx))
+}
+
+func TestFollowIngester_Backfill(t *testing.T) {
+	ctx := context.Background()
+	const numRemote = 2500
+	first := time.Now().Add(-numRemote * 5 * time.Minute).Truncate(time.Second).UTC()
+	var entries, treatments []map[string]interface{}
+	for n := 0; n < numRemote; n++ {
+		at := first.Add(time.Duration(n) * 5 * time.Minute)
+		entries = append(entries, map[string]interface{}{
+			"_id": fmt.Sprintf("%024x", n), "type": "sgv", "sgv": 100, "device": "remote",
+			"date": at.UnixMilli(), "dateString": at.Format(time.RFC3339),
+		})
+		if n%2 == 0 {
+			treatments = append(treatments, map[string]interface{}{
+				"_id": fmt.Sprintf("%024x", n), "eventType": "Note", "created_at": at.Format(time.RFC3339),
+			})
+		}
+	}
+
+	var requests []string
+	remote := fakeNightscout(t, &entries, &treatments, &requests)
+	defer remote.Close()
+	remoteURL, _ := url.Parse(remote.URL)
+
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	ingester := &followIngester{
+		nsCfg:                repository.NightscoutConfig{URL: remoteURL},
+		nightscoutRepository: repository.NewNightscoutRepository(),
+		entryRepository:      repository.NewBucketEntryRepository(bs),
+		treatmentRepository:  repository.NewBucketTreatmentRepository(bs),
+		cursorRepository:     repository.NewBucketFollowCursorRepository(bs),
+	}
+	ingester.IngestOnce(ctx)
+
+	// more than a page of each is backfilled on the first run
+	stored, err := ingester.entryRepository.FetchLatestEntries(ctx, time.Now(), 2*numRemote)
+	assert.NoError(t, err)
+	assert.Len(t, stored, numRemote)
+	storedTreatments, err := ingester.treatmentRepository.FetchLatestTreatments(ctx, time.Now(), 2*numRemote)
+	assert.NoError(t, err)
+	assert.Len(t, storedTreatments, numRemote/2)
+	assert.Len(t, requests, 5, "3 pages of entries, 2 of treatments")
+
+	// later polls start from what we have
+	requests = nil
+	ingester.IngestOnce(ctx)
+	assert.Len(t, requests, 2)
+}
+
+func TestFollowIngester_OwnCursor(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now().Add(-12 * time.Hour).Truncate(time.Second).UTC()
+	remoteEntry := func(n int, at time.Time) map[string]interface{} {
+		return map[string]interface{}{
+			"_id": fmt.Sprintf("%024x", n), "type": "sgv", "sgv": 100, "device": "remote",
+			"date": at.UnixMilli(), "dateString": at.Format(time.RFC3339),
+		}
+	}
+	remoteTreatment := func(n int, at time.Time) map[string]interface{} {
+		return map[string]interface{}{
+			"_id": fmt.Sprintf("%024x", n), "eventType": "Note", "created_at": at.Format(time.RFC3339),
+		}
+	}
+	entries := []map[string]interface{}{remoteEntry(1, start)}
+	treatments := []map[string]interface{}{remoteTreatment(1, start.Add(-3*24*time.Hour))}
+	var since []string
+	remote := fakeNightscout(t, &entries, &treatments, &since)
+	defer remote.Close()
+	remoteURL, _ := url.Parse(remote.URL)
+
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	newIngester := func() *followIngester {
+		return &followIngester{
+			nsCfg:                repository.NightscoutConfig{URL: remoteURL},
+			nightscoutRepository: repository.NewNightscoutRepository(),
+			entryRepository:      repository.NewBucketEntryRepository(bs),
+			treatmentRepository:  repository.NewBucketTreatmentRepository(bs),
+			cursorRepository:     repository.NewBucketFollowCursorRepository(bs),
+		}
+	}
+	ingester := newIngester()
+	ingester.IngestOnce(ctx)
+
+	// another source has newer data than the remote...
+	ingester.entryRepository.CreateEntries(ctx, []models.Entry{{Type: "sgv", SgvMgdl: 120, Device: "llu ingestor", Time: time.Now()}})
+	ingester.treatmentRepository.CreateTreatments(ctx, []models.Treatment{{Type: "Note", Time: time.Now(), Fields: map[string]interface{}{}}})
+
+	// ...while the remote fills a gap older than the lookback
+	entries = append(entries, remoteEntry(2, start.Add(5*time.Minute)), remoteEntry(3, start.Add(6*time.Hour)))
+	treatments = append(treatments, remoteTreatment(2, start.Add(-2*24*time.Hour)))
+	ingester.IngestOnce(ctx)
+
+	storedEntries, err := ingester.entryRepository.FetchLatestEntries(ctx, time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, storedEntries, 4)
+	storedTreatments, err := ingester.treatmentRepository.FetchLatestTreatments(ctx, time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, storedTreatments, 3)
+
+	// the cursor is persisted, so a restarted follower resumes from it
+	// rather than from the start of the remote's data
+	cursor, err := repository.NewBucketFollowCursorRepository(bs).FetchFollowCursor(ctx, remoteURL.Host)
+	assert.NoError(t, err)
+	assert.Equal(t, start.Add(6*time.Hour), cursor.Entries.UTC())
+	assert.Equal(t, start.Add(-2*24*time.Hour), cursor.Treatments.UTC())
+
+	since = nil
+	newIngester().IngestOnce(ctx)
+	assert.Equal(t, []string{
+		strconv.FormatInt(start.Add(5*time.Hour).UnixMilli(), 10),
+		start.Add(-3 * 24 * time.Hour).Format("2006-01-02T15:04:05.000Z"),
+	}, since)
+}
+
+// fakeNightscout serves entries and treatments as nightscout does: each
+// request returns at most count documents, in the requested order. It records
+// the time each request asks for data since.
+func fakeNightscout(t *testing.T, entries, treatments *[]map[string]interface{}, since *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		*since = append(*since, q.Get("find[date][$gte]")+q.Get("find[created_at][$gte]"))
+		count, _ := strconv.Atoi(q.Get("count"))
+		var page []map[string]interface{}
+		switch r.URL.Path {
+		case "/api/v1/entries.json":
+			assert.Equal(t, "1", q.Get("sort[date]"))
+			since, _ := strconv.ParseInt(q.Get("find[date][$gte]"), 10, 64)
+			for _, e := range *entries {
+				if e["date"].(int64) >= since && len(page) < count {
+					page = append(page, e)
+				}
+			}
+		case "/api/v1/treatments.json":
+			assert.Equal(t, "1", q.Get("sort[created_at]"))
+			since, _ := time.Parse(time.RFC3339, q.Get("find[created_at][$gte]"))
+			for _, tr := range *treatments {
+				at, _ := time.Parse(time.RFC3339, tr["created_at"].(string))
+				if !at.Before(since) && len(page) < count {
+					page = append(page, tr)
+				}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// listen opens a listener for each address, host:port or unix:/path. A stale
+// socket left by a previous run is replaced, and sockets are given mode, so
+// eg a reverse proxy in the same group can connect.
+func listen(addresses []string, mode os.FileMode) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range addresses {
+		l, err := listenOn(address, mode)
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func listenOn(address string, mode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	fi, err := os.Lstat(path)
+	if err == nil && fi.Mode().Type() != fs.ModeSocket {
+		return nil, fmt.Errorf("cannot listen on %s: not a socket", path)
+	}
+	if err == nil {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot remove stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("cannot listen on %s: %w", path, err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("cannot set socket mode: %w", err)
+	}
+	return l, nil
+}
+
+// isUnixSocket reports whether l is a unix socket. The api is served over
+// plain http on unix sockets, even with TLS configured, as only a local
+// reverse proxy can connect.
+func isUnixSocket(l net.Listener) bool {
+	return l.Addr().Network() == "unix"
+}
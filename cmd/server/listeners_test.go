@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListen(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "ns.sock")
+
+	listeners, err := listen([]string{"127.0.0.1:0", "unix:" + socket}, 0o660)
+	assert.NoError(t, err)
+	assert.Len(t, listeners, 2)
+	assert.False(t, isUnixSocket(listeners[0]))
+	assert.True(t, isUnixSocket(listeners[1]))
+	fi, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o660), fi.Mode().Perm())
+
+	// a socket left behind, eg after a crash, is replaced
+	listeners[1].(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+	for _, l := range listeners {
+		assert.NoError(t, l.Close())
+	}
+	listeners, err = listen([]string{"unix:" + socket}, 0o600)
+	assert.NoError(t, err)
+	assert.NoError(t, listeners[0].Close())
+
+	// other files are not
+	file := filepath.Join(dir, "not-a-socket")
+	assert.NoError(t, os.WriteFile(file, nil, 0o600))
+	_, err = listen([]string{"127.0.0.1:0", "unix:" + file}, 0o660)
+	assert.ErrorContains(t, err, "not a socket")
+}
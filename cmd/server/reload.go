@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/config"
+	"github.com/adamlounds/nightscout-go/controllers"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// reloader re-reads config on SIGHUP, applying what can change without a
+// restart: log level, settings advertised to clients, api secrets, default
+// roles, and auth subjects and roles (from the bucket). Anything else, eg
+// storage or the listen address, still needs a restart.
+//
+// The new config is only applied if it is valid, so a bad edit leaves the
+// server running as it was.
+type reloader struct {
+	configFile     string // empty if config is only from the environment
+	cfg            config.ServerConfig
+	logLevel       *slog.LevelVar
+	settings       *controllers.LiveSettings
+	authRepository *repository.BucketAuthRepository
+	authService    *models.AuthService
+}
+
+// reload re-reads config, applying the parts that can change while running.
+// Nothing is applied until the new config has been built and the auth data
+// fetched, and on error the environment is restored, so a failed reload leaves
+// the server as it was.
+func (rl *reloader) reload(ctx context.Context) error {
+	restore := func() {}
+	if rl.configFile != "" {
+		vars, err := config.ReadFile(rl.configFile)
+		if err != nil {
+			return err
+		}
+		restore, err = config.SetFileVars(vars)
+		if err != nil {
+			return err
+		}
+	}
+	var cfg config.ServerConfig
+	err := cfg.RegisterEnv()
+	if err != nil {
+		restore()
+		return err
+	}
+
+	err = rl.authRepository.Reload(ctx, cfg.APISecretHash, cfg.OldAPISecret.Hash, cfg.OldAPISecret.Until, cfg.DefaultRole)
+	if err != nil {
+		restore()
+		return err
+	}
+	rl.authService.InvalidateRoles()
+
+	settings := newSettings(cfg)
+	// the auth failure tracker is not reloaded, so keep advertising its delay
+	settings.AuthFailDelay = rl.settings.Load().AuthFailDelay
+	rl.settings.Store(settings)
+	rl.logLevel.Set(cfg.LogLevel)
+	rl.cfg = cfg
+	return nil
+}
+
+// start reloads config each time the process receives SIGHUP
+func (rl *reloader) start(ctx context.Context) {
+	log := slogctx.FromCtx(ctx)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				err := rl.reload(ctx)
+				if err != nil {
+					log.Error("cannot reload config, keeping current config", slog.Any("error", err))
+					continue
+				}
+				log.Info("config reloaded", slog.String("logLevel", rl.cfg.LogLevel.String()))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// newSettings returns the settings advertised to clients
+func newSettings(cfg config.ServerConfig) controllers.Settings {
+	return controllers.Settings{
+		Units:              cfg.Display.Units,
+		Language:           cfg.Language,
+		Thresholds:         cfg.Display.Thresholds,
+		Enable:             cfg.Display.Enable,
+		ShowPlugins:        strings.Join(cfg.Display.ShowPlugins, " "),
+		ShowForecast:       strings.Join(cfg.Display.ShowForecast, " "),
+		AuthDefaultRoles:   cfg.DefaultRole,
+		AuthFailDelay:      cfg.AuthFailures.Delay.Milliseconds(),
+		Insulin:            cfg.Insulin,
+		CarbAbsorptionRate: cfg.CarbAbsorptionRate,
+		UploaderBattery:    cfg.UploaderBattery,
+		TreatmentTypes:     cfg.TreatmentTypes,
+		BGCheckMbg:         cfg.BGCheckMbg,
+		APISecretHashOnly:  cfg.APISecretHashOnly,
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/config"
+	"github.com/adamlounds/nightscout-go/controllers"
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestReload(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("OBJSTORE_CONFIG", `{"type":"FILESYSTEM","config":{"directory":"/tmp"}}`)
+	t.Setenv("API_SECRET", "first-secret-123")
+	t.Setenv("OLD_API_SECRET", "older-secret-123")
+	oldSecretUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	t.Setenv("OLD_API_SECRET_UNTIL", oldSecretUntil.Format(time.RFC3339))
+	t.Cleanup(func() {
+		for _, name := range []string{"LOG_LEVEL", "AUTH_DEFAULT_ROLES", "BASE_PATH"} {
+			_ = os.Unsetenv(name) // set from the config file
+		}
+	})
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("server:\n  log_level: info\n"), 0o600))
+
+	var cfg config.ServerConfig
+	assert.NoError(t, config.LoadFile(path))
+	assert.NoError(t, cfg.RegisterEnv())
+
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	authRepository := repository.NewBucketAuthRepository(bs, cfg.APISecretHash, cfg.DefaultRole)
+	logLevel := &slog.LevelVar{}
+	rl := &reloader{
+		configFile:     path,
+		cfg:            cfg,
+		logLevel:       logLevel,
+		settings:       controllers.NewLiveSettings(newSettings(cfg)),
+		authRepository: authRepository,
+		authService:    &models.AuthService{AuthRepository: authRepository},
+	}
+
+	assert.NoError(t, os.WriteFile(path, []byte("server:\n  log_level: debug\nauth:\n  auth_default_roles: denied\n"), 0o600))
+	t.Setenv("API_SECRET", "second-secret-123")
+	assert.NoError(t, rl.reload(ctx))
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+	assert.Equal(t, "denied", rl.settings.Load().AuthDefaultRoles)
+	assert.Equal(t, "denied", authRepository.GetDefaultRole(ctx))
+	assert.Equal(t, rl.cfg.APISecretHash, authRepository.GetAPISecretHash(ctx))
+	assert.NotEqual(t, cfg.APISecretHash, rl.cfg.APISecretHash)
+	_, until := authRepository.GetOldAPISecretHash(ctx)
+	assert.Equal(t, oldSecretUntil, until, "reloading does not extend the old secret's grace period")
+
+	// invalid config is not applied
+	assert.NoError(t, os.WriteFile(path, []byte("server:\n  log_level: warn\n  base_path: nightscout\n"), 0o600))
+	assert.Error(t, rl.reload(ctx))
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+	assert.Equal(t, "denied", authRepository.GetDefaultRole(ctx))
+	assert.Equal(t, "debug", os.Getenv("LOG_LEVEL"), "environment is restored")
+
+	// nor is anything applied if the auth data cannot be reloaded
+	secretHash := rl.cfg.APISecretHash
+	assert.NoError(t, bs.Bucket.Upload(ctx, "ns-config/auth.json", strings.NewReader("not json")))
+	assert.NoError(t, os.WriteFile(path, []byte("server:\n  log_level: warn\n"), 0o600))
+	t.Setenv("API_SECRET", "third-secret-123")
+	assert.Error(t, rl.reload(ctx))
+	assert.True(t, rl.authService.IsAPISecretHashValid(ctx, secretHash), "the current secret still authenticates")
+	assert.Equal(t, secretHash, rl.cfg.APISecretHash)
+	assert.Equal(t, slog.LevelDebug, logLevel.Level())
+	assert.Equal(t, "denied", rl.settings.Load().AuthDefaultRoles)
+	assert.Equal(t, "debug", os.Getenv("LOG_LEVEL"))
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	repository "github.com/adamlounds/nightscout-go/adapters"
 	"github.com/adamlounds/nightscout-go/config"
 	"github.com/adamlounds/nightscout-go/controllers"
+	"github.com/adamlounds/nightscout-go/i18n"
 	"github.com/adamlounds/nightscout-go/models"
 	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	postgresstore "github.com/adamlounds/nightscout-go/stores/postgres"
+	redisstore "github.com/adamlounds/nightscout-go/stores/redis"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	slogctx "github.com/veqryn/slog-context"
@@ -17,48 +21,170 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
+	configFile := flag.String("config", "", "yaml config file, overridden by environment variables")
+	flag.Parse()
+
+	if *configFile != "" {
+		err := config.LoadFile(*configFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	var cfg config.ServerConfig
 	err := cfg.RegisterEnv()
 	if err != nil {
 		panic(err)
 	}
 
+	// the level can change on SIGHUP
+	logLevel := &slog.LevelVar{}
+	logLevel.Set(cfg.LogLevel)
 	opts := &slog.HandlerOptions{
-		Level: cfg.LogLevel,
+		Level: logLevel,
 	}
 	h := slogctx.NewHandler(slog.NewJSONHandler(os.Stdout, opts), nil)
 	log := slog.New(h)
 	slog.SetDefault(log.With(slog.Int("pid", os.Getpid())))
 	ctx := slogctx.NewCtx(context.Background(), slog.Default())
 
-	run(ctx, cfg)
+	run(ctx, cfg, *configFile, logLevel)
 }
 
-func run(ctx context.Context, cfg config.ServerConfig) {
+func run(ctx context.Context, cfg config.ServerConfig, configFile string, logLevel *slog.LevelVar) {
 	log := slogctx.FromCtx(ctx)
 	serverCtx, serverStopCtx := context.WithCancel(ctx)
 
-	bs, err := bucketstore.New(cfg.S3Config)
+	bs, err := bucketstore.New(cfg.BucketConfig)
 	if err != nil {
-		log.Error("run cannot configure s3 storage", slog.Any("error", err))
+		log.Error("run cannot configure bucket storage", slog.Any("error", err))
 		os.Exit(1)
 	}
 
 	err = bs.Ping(serverCtx)
 	if err != nil {
-		log.Error("run cannot ping s3 storage", slog.Any("error", err))
+		log.Error("run cannot ping bucket storage", slog.Any("error", err))
 		os.Exit(1)
 	}
 
-	authRepository := repository.NewBucketAuthRepository(cfg.APISecretHash, cfg.DefaultRole)
-	entryRepository := repository.NewBucketEntryRepository(bs)
-	treatmentRepository := repository.NewBucketTreatmentRepository(bs)
+	var bucket repository.BucketStoreInterface = bs
+	if cfg.BucketCache.Dir != "" {
+		cache, err := bucketstore.NewDiskCache(bs, cfg.BucketCache.Dir, cfg.BucketCache.MaxBytes)
+		if err != nil {
+			log.Error("run cannot configure bucket cache", slog.Any("error", err))
+			os.Exit(1)
+		}
+		bucket = cache
+	}
+	if cfg.BucketFaults.Enabled() {
+		log.Warn("run injecting faults into s3 storage, do not use in production",
+			slog.Float64("errorRate", cfg.BucketFaults.ErrorRate),
+			slog.Float64("partialWriteRate", cfg.BucketFaults.PartialWriteRate),
+			slog.Duration("maxLatency", cfg.BucketFaults.MaxLatency),
+		)
+		bucket = bucketstore.NewFaultInjector(bucket, cfg.BucketFaults)
+	}
+
+	idStrategy, err := repository.NewIDStrategy(cfg.IDStrategy)
+	if err != nil {
+		log.Error("run cannot configure id strategy", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	authRepository := repository.NewBucketAuthRepository(bucket, cfg.APISecretHash, cfg.DefaultRole)
+	authRepository.OldSecretHash = cfg.OldAPISecret.Hash
+	authRepository.OldSecretUntil = cfg.OldAPISecret.Until
+	if cfg.APISecretHash == "" {
+		log.Warn("API_SECRET is not set, only tokens can authenticate")
+	}
+	if cfg.OldAPISecret.Hash != "" {
+		log.Info("accepting OLD_API_SECRET while rotating", slog.Time("until", cfg.OldAPISecret.Until))
+	}
+	// problems operators should know about, shown in the admin notifies panel
+	adminNotifies := models.NewAdminNotifies()
+	var entryRepository repository.EntryRepository
+	var treatmentRepository repository.TreatmentRepository
+	var entryExporter repository.EntryExporter
+	var treatmentExporter repository.TreatmentExporter
+	var bucketEntryRepository *repository.BucketEntryRepository
+	var bucketTreatmentRepository *repository.BucketTreatmentRepository
+	if cfg.StorageBackend != "postgres" {
+		bucketEntryRepository = repository.NewBucketEntryRepository(bucket)
+		bucketEntryRepository.IDStrategy = idStrategy
+		bucketEntryRepository.Compression = cfg.Compression.Entries
+		bucketEntryRepository.ParquetYears = cfg.ParquetYears
+		bucketEntryRepository.AppendDays = cfg.AppendDayFiles
+		bucketEntryRepository.HistoryYears = cfg.HistoryYears
+		bucketEntryRepository.MemoryDays = cfg.MemoryDays
+		bucketEntryRepository.CheckConflicts = cfg.CheckConflicts
+		bucketEntryRepository.SetAdminNotifies(adminNotifies)
+		entryRepository = bucketEntryRepository
+		bucketTreatmentRepository = repository.NewBucketTreatmentRepository(bucket)
+		bucketTreatmentRepository.IDStrategy = idStrategy
+		bucketTreatmentRepository.Compression = cfg.Compression.Treatments
+		bucketTreatmentRepository.CheckConflicts = cfg.CheckConflicts
+		if cfg.SyncLease {
+			lease := repository.NewSyncLease(bucket, leaseOwner(), cfg.SyncLeaseTTL)
+			bucketEntryRepository.Lease = lease
+			bucketTreatmentRepository.Lease = lease
+		}
+		bucketTreatmentRepository.SetAdminNotifies(adminNotifies)
+		treatmentRepository = bucketTreatmentRepository
+	}
+	if cfg.StorageBackend != "bucket" {
+		db, err := postgresstore.New(serverCtx, cfg.DatabaseURL)
+		if err != nil {
+			log.Error("run cannot configure postgres", slog.Any("error", err))
+			os.Exit(1)
+		}
+		defer db.Close()
+		pgEntryRepository := repository.NewPostgresEntryRepository(db)
+		pgTreatmentRepository := repository.NewPostgresTreatmentRepository(db)
+		if cfg.StorageBackend == "both" {
+			// bucket files are still complete, so export from them
+			entryRepository = repository.NewDualEntryRepository(entryRepository, pgEntryRepository)
+			treatmentRepository = repository.NewDualTreatmentRepository(treatmentRepository, pgTreatmentRepository)
+		} else {
+			entryRepository = pgEntryRepository
+			treatmentRepository = pgTreatmentRepository
+			entryExporter = pgEntryRepository
+			treatmentExporter = pgTreatmentRepository
+		}
+	}
+	if cfg.Redis.URL != "" {
+		rs, err := redisstore.New(cfg.Redis.URL)
+		if err != nil {
+			log.Error("run cannot configure redis", slog.Any("error", err))
+			os.Exit(1)
+		}
+		defer rs.Close()
+		err = rs.Ping(serverCtx)
+		if err != nil {
+			log.Warn("run cannot ping redis, reads will fall back to storage", slog.Any("error", err))
+		}
+		cachedEntryRepository := repository.NewCachedEntryRepository(entryRepository, rs)
+		cachedEntryRepository.Size = cfg.Redis.Size
+		cachedEntryRepository.TTL = cfg.Redis.TTL
+		entryRepository = cachedEntryRepository
+		cachedTreatmentRepository := repository.NewCachedTreatmentRepository(treatmentRepository, rs)
+		cachedTreatmentRepository.Size = cfg.Redis.Size
+		cachedTreatmentRepository.TTL = cfg.Redis.TTL
+		treatmentRepository = cachedTreatmentRepository
+	}
+	profileRepository := repository.NewBucketProfileRepository(bucket)
+	deviceStatusRepository := repository.NewBucketDeviceStatusRepository(bucket)
+	exportRepository := repository.NewBucketExportRepository(bs)
+	exportRepository.EntryCompression = cfg.Compression.Entries
+	exportRepository.TreatmentCompression = cfg.Compression.Treatments
+	exportRepository.EntryExporter = entryExporter
+	exportRepository.TreatmentExporter = treatmentExporter
 	nightscoutRepository := repository.NewNightscoutRepository()
 
 	err = entryRepository.Boot(serverCtx)
@@ -71,27 +197,156 @@ func run(ctx context.Context, cfg config.ServerConfig) {
 		log.Error("run cannot load treatments", slog.Any("error", err))
 	}
 
+	err = profileRepository.Boot(serverCtx)
+	if err != nil {
+		log.Error("run cannot load profiles", slog.Any("error", err))
+	}
+
+	err = deviceStatusRepository.Boot(serverCtx)
+	if err != nil {
+		log.Error("run cannot load device statuses", slog.Any("error", err))
+	}
+
+	err = authRepository.Boot(serverCtx)
+	if err != nil {
+		log.Error("run cannot load auth subjects", slog.Any("error", err))
+	}
 	authService := &models.AuthService{AuthRepository: authRepository}
 
-	cgm := repository.NewCGMLibrelinkupRepository(repository.LLUConfig{
-		Region:   strings.ToLower(os.Getenv("LINK_UP_REGION")),
-		Username: os.Getenv("LINK_UP_USERNAME"),
-		Password: os.Getenv("LINK_UP_PASSWORD"),
-	})
+	cgms, err := newCGMRepositories(os.Getenv("CGM_SOURCE"), bs)
+	if err != nil {
+		log.Error("run cannot configure cgm", slog.Any("error", err))
+		os.Exit(1)
+	}
+	hiresRepository := repository.NewBucketHiresRepository(bucket)
+	var ingesters []Ingester
+	for name, cgm := range cgms {
+		ingesters = append(ingesters, &cgmIngester{
+			name:                name,
+			devicePrefix:        cgmSources[name],
+			cgm:                 cgm,
+			entryRepository:     entryRepository,
+			treatmentRepository: treatmentRepository,
+			hiresRepository:     hiresRepository,
+			adminNotifies:       adminNotifies,
+		})
+	}
 
-	if cgm.IsConfigured() {
-		startIngestor(serverCtx, entryRepository, cgm)
+	if cfg.Bridge.URL != nil {
+		bridge := repository.NewNightscoutBridge(bucket, entryRepository, treatmentRepository, repository.NightscoutConfig{
+			URL:       cfg.Bridge.URL,
+			Token:     cfg.Bridge.Token,
+			APISecret: cfg.Bridge.APISecret,
+		})
+		err = bridge.Boot(serverCtx)
+		if err != nil {
+			log.Error("run cannot boot bridge", slog.Any("error", err))
+		} else {
+			startBridge(serverCtx, bridge)
+		}
 	}
 
+	if cfg.Backup.Enabled() {
+		var destination repository.BucketStoreInterface = bs
+		if cfg.Backup.BucketConfig != nil {
+			backupBucket, err := bucketstore.New(cfg.Backup.BucketConfig)
+			if err != nil {
+				log.Error("run cannot configure backup bucket storage", slog.Any("error", err))
+				os.Exit(1)
+			}
+			destination = backupBucket
+		}
+		startBackup(serverCtx, repository.NewBucketBackup(bs, destination, cfg.Backup.Prefix), cfg.Backup.Interval)
+	}
+
+	purger := repository.NewPurger(entryRepository, treatmentRepository, bucket)
+	if cfg.RetentionDays > 0 {
+		startRetention(serverCtx, purger, cfg.RetentionDays)
+	}
+	if cfg.MemoryDays > 0 && bucketEntryRepository != nil {
+		startEviction(serverCtx, bucketEntryRepository)
+	}
+	if cfg.FlushInterval > 0 && bucketEntryRepository != nil {
+		startFlush(serverCtx, bucketEntryRepository, bucketTreatmentRepository, cfg.FlushInterval)
+	}
+
+	if cfg.Follow.URL != nil {
+		ingesters = append(ingesters, &followIngester{
+			nsCfg: repository.NightscoutConfig{
+				URL:       cfg.Follow.URL,
+				Token:     cfg.Follow.Token,
+				APISecret: cfg.Follow.APISecret,
+			},
+			nightscoutRepository: nightscoutRepository,
+			entryRepository:      entryRepository,
+			treatmentRepository:  treatmentRepository,
+			cursorRepository:     repository.NewBucketFollowCursorRepository(bucket),
+		})
+	}
+	startIngestors(serverCtx, ingesters)
+
+	importJobs := controllers.NewImportJobs()
+	importJobs.AdminNotifies = adminNotifies
+	var notifier controllers.Notifier
+	if cfg.NotifyWebhookURL != nil {
+		notifier = repository.NewWebhookNotifier(cfg.NotifyWebhookURL)
+	}
 	apiV1C := controllers.ApiV1{
-		EntryRepository:      entryRepository,
-		TreatmentRepository:  treatmentRepository,
-		NightscoutRepository: nightscoutRepository,
+		EntryRepository:        entryRepository,
+		TreatmentRepository:    treatmentRepository,
+		NightscoutRepository:   nightscoutRepository,
+		AuthService:            authService,
+		CGMRepository:          cgmRepositories(cgms),
+		ProfileRepository:      profileRepository,
+		DeviceStatusRepository: deviceStatusRepository,
+		ImportCursorRepository: repository.NewBucketImportCursorRepository(bucket),
+		ImportJobs:             importJobs,
+		Notifier:               notifier,
+		AdminNotifies:          adminNotifies,
+		CSVRepository:          repository.NewCSVImportRepository(),
+		ArchiveRepository:      repository.NewArchiveImportRepository(),
+		ExportRepository:       exportRepository,
+		PurgeRepository:        purger,
+		AuthSubjectRepository:  authRepository,
+		RoleRepository:         authService,
+		BasePath:               cfg.Server.BasePath,
+		CountLimits:            controllers.CountLimits{Default: cfg.Counts.Default, Max: cfg.Counts.Max},
+		APIUnits:               cfg.Display.APIUnits,
+		AuthFailures:           controllers.NewAuthFailureTracker(cfg.AuthFailures.Delay, cfg.AuthFailures.LockoutAfter, cfg.AuthFailures.LockoutFor, slices.Concat(cfg.AuthFailures.TrustedProxies, cfg.ProxyAuth.TrustedProxies)),
+		Settings:               controllers.NewLiveSettings(newSettings(cfg)),
+	}
+	if bucketEntryRepository != nil {
+		apiV1C.SyncRepository = repository.NewBucketSyncer(bucketEntryRepository, bucketTreatmentRepository)
 	}
 	apiV1mw := controllers.ApiV1AuthnMiddleware{
-		AuthService: authService,
+		AuthService:  authService,
+		Settings:     apiV1C.Settings,
+		AuthFailures: apiV1C.AuthFailures,
+	}
+	if cfg.ProxyAuth.Enabled() {
+		apiV1mw.ProxyAuth = &controllers.ProxyAuth{
+			TrustedProxies: cfg.ProxyAuth.TrustedProxies,
+			UnixSocket:     cfg.ProxyAuth.UnixSocket,
+			UserHeader:     cfg.ProxyAuth.UserHeader,
+			GroupsHeader:   cfg.ProxyAuth.GroupsHeader,
+			GroupRoles:     cfg.ProxyAuth.GroupRoles,
+		}
+		log.Info("trusting users authenticated by proxy", slog.Any("trustedProxies", cfg.ProxyAuth.TrustedProxies), slog.Bool("unixSocket", cfg.ProxyAuth.UnixSocket))
+	}
+	if !i18n.IsSupported(cfg.Language) {
+		log.Warn("no translations for language, using english", slog.String("language", cfg.Language))
 	}
 
+	rl := &reloader{
+		configFile:     configFile,
+		cfg:            cfg,
+		logLevel:       logLevel,
+		settings:       apiV1C.Settings,
+		authRepository: authRepository,
+		authService:    authService,
+	}
+	rl.start(serverCtx)
+
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
@@ -101,6 +356,10 @@ func run(ctx context.Context, cfg config.ServerConfig) {
 		r.Use(middleware.URLFormat)
 		r.With(apiV1mw.Authz("api:entries:create")).Post("/entries", apiV1C.CreateEntries)
 		r.With(apiV1mw.Authz("api:entries:create")).Post("/entries/import/nightscout", apiV1C.ImportNightscoutEntries)
+		r.With(apiV1mw.Authz("api:entries:create")).Post("/entries/import/csv", apiV1C.ImportCSVEntries)
+		r.With(apiV1mw.Authz("api:entries:create")).Post("/entries/import/jsonl", apiV1C.ImportJSONLEntries)
+		r.With(apiV1mw.Authz("api:entries:create")).Post("/entries/import/archive", apiV1C.ImportArchiveEntries)
+		r.With(apiV1mw.Authz("api:entries:create")).Get("/import/status/{id}", apiV1C.ImportStatus)
 		r.With(apiV1mw.Authz("api:entries:read")).Get("/entries", apiV1C.ListEntries)
 		r.With(apiV1mw.Authz("api:entries:read")).Get("/entries/{oid:[a-f0-9]{24}}", apiV1C.EntryByOid)
 		r.With(apiV1mw.Authz("api:entries:read")).Get("/entries/sgv", apiV1C.ListSGVs)
@@ -109,12 +368,55 @@ func run(ctx context.Context, cfg config.ServerConfig) {
 		r.With(apiV1mw.Authz("api:entries:read")).Get("/treatments", apiV1C.ListTreatments)
 		r.With(apiV1mw.Authz("api:entries:create")).Post("/treatments", apiV1C.CreateTreatments)
 		r.With(apiV1mw.Authz("api:entries:create")).Put("/treatments", apiV1C.PutTreatment)
+		r.With(apiV1mw.Authz("api:entries:create")).Delete("/treatments", apiV1C.DeleteTreatments)
+		r.With(apiV1mw.Authz("api:entries:create")).Put("/treatments/{oid:[a-f0-9]{24}}", apiV1C.PutTreatment)
 		r.With(apiV1mw.Authz("api:entries:read")).Get("/treatments/{oid:[a-f0-9]{24}}", apiV1C.TreatmentByOid)
 		r.With(apiV1mw.Authz("api:entries:create")).Delete("/treatments/{oid:[a-f0-9]{24}}", apiV1C.DeleteTreatment)
+		r.With(apiV1mw.Authz("api:entries:create")).Post("/treatments/import/nightscout", apiV1C.ImportNightscoutTreatments)
+
+		r.With(apiV1mw.Authz("api:export:read")).Get("/export", apiV1C.Export)
+		r.With(apiV1mw.Authz("api:entries:read")).Get("/stats/tir", apiV1C.TimeInRange)
+		r.With(apiV1mw.Authz("api:entries:read")).Get("/stats/gmi", apiV1C.GMI)
 
 		r.With(apiV1mw.Authz("api:entries:read")).Get("/experiments/test", apiV1C.StatusCheck)
+
+		r.With(apiV1mw.Authz("admin:api:cgm:read")).Get("/admin/cgm/connections", apiV1C.ListCGMConnections)
+		r.With(apiV1mw.Authz("admin:api:data:delete")).Post("/admin/purge", apiV1C.PurgeData)
+		r.With(apiV1mw.Authz("admin:api:data:update")).Post("/admin/sync", apiV1C.SyncData)
+		r.With(apiV1mw.Authz("admin:api:data:update")).Post("/admin/reload", apiV1C.ReloadData)
+		r.With(apiV1mw.Authz("admin:api:subjects:read")).Get("/admin/subjects", apiV1C.ListAuthSubjects)
+		r.With(apiV1mw.Authz("admin:api:subjects:create")).Post("/admin/subjects", apiV1C.CreateAuthSubject)
+		r.With(apiV1mw.Authz("admin:api:subjects:delete")).Delete("/admin/subjects/{oid}", apiV1C.DeleteAuthSubject)
+		r.With(apiV1mw.Authz("admin:api:subjects:delete")).Post("/admin/subjects/{oid}/revoke", apiV1C.RevokeAuthSubject)
+		r.With(apiV1mw.Authz("admin:api:subjects:read")).Get("/admin/share-links", apiV1C.ListShareLinks)
+		r.With(apiV1mw.Authz("admin:api:subjects:create")).Post("/admin/share-links", apiV1C.CreateShareLink)
+		r.With(apiV1mw.Authz("admin:api:roles:read")).Get("/admin/roles", apiV1C.ListRoles)
+		r.With(apiV1mw.Authz("admin:api:roles:update")).Put("/admin/roles/{name}", apiV1C.SaveRole)
+		r.With(apiV1mw.Authz("admin:api:roles:delete")).Delete("/admin/roles/{name}", apiV1C.DeleteRole)
+
+		// status is available to all, clients use it to determine what they can do
+		r.Get("/status", apiV1C.Status)
+		r.Get("/verifyauth", apiV1C.VerifyAuth)
+		// everyone sees how many admin notifies there are, only admins what they say
+		r.Get("/adminnotifies", apiV1C.ListAdminNotifies)
+		// nightscout acks with GET, so clients may too
+		r.With(apiV1mw.Authz("notifications:*:ack")).Get("/notifications/ack", apiV1C.AckNotifications)
+		r.With(apiV1mw.Authz("notifications:*:ack")).Post("/notifications/ack", apiV1C.AckNotifications)
+	})
+	r.Route("/api/v2", func(r chi.Router) {
+		// the access token is checked by the handler, exchanged for a jwt
+		r.Get("/authorization/request/{token}", apiV1C.AuthorizationRequest)
+		r.With(apiV1mw.SetAuthentication, apiV1mw.Authz("api:entries:read")).Get("/properties", apiV1C.Properties)
+		r.With(apiV1mw.SetAuthentication, apiV1mw.Authz("api:entries:read")).Get("/properties/{names}", apiV1C.Properties)
 	})
-	r.Mount("/debug", middleware.Profiler())
+	var debugServer *http.Server
+	if cfg.Server.DebugAddress != "" {
+		debugRouter := chi.NewRouter()
+		debugRouter.Mount("/debug", middleware.Profiler())
+		debugServer = &http.Server{Handler: debugRouter}
+	} else {
+		r.Mount("/debug", middleware.Profiler())
+	}
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		entry, err := entryRepository.FetchLatestSgvEntry(r.Context(), time.Now())
 		if err != nil {
@@ -129,14 +431,31 @@ func run(ctx context.Context, cfg config.ServerConfig) {
 		_, _ = w.Write([]byte(fmt.Sprintf("%#v", entry))) //nolint:errcheck
 	})
 
-	// TODO look at how to prevent shutdown if s3 writes are in-progress?
-	server := &http.Server{Addr: cfg.Server.Address, Handler: r}
+	var handler http.Handler = r
+	if cfg.Server.BasePath != "" {
+		root := chi.NewRouter()
+		root.Mount(cfg.Server.BasePath, r)
+		handler = root
+		log.Info("serving under base path", slog.String("basePath", cfg.Server.BasePath))
+	}
+	server := &http.Server{Handler: handler, ConnContext: controllers.UnixSocketConnContext}
+	for _, address := range cfg.Server.Addresses {
+		if !strings.HasPrefix(address, "unix:") {
+			server.Addr = address // the https address http is redirected to
+			break
+		}
+	}
+	var httpServer *http.Server
+	if cfg.Server.TLS.Enabled() {
+		httpServer = configureTLS(serverCtx, server, cfg.Server.TLS, bs)
+	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		<-sig
-		shutdownCtx, _ := context.WithTimeout(serverCtx, time.Second*10) //nolint:govet
+		shutdownCtx, cancel := context.WithTimeout(serverCtx, time.Second*10)
+		defer cancel()
 		go func() {
 			<-shutdownCtx.Done()
 			if errors.Is(shutdownCtx.Err(), context.DeadlineExceeded) {
@@ -148,11 +467,64 @@ func run(ctx context.Context, cfg config.ServerConfig) {
 		if err != nil {
 			log.Error("cannot shutdown server", slog.Any("error", err))
 		}
+		if httpServer != nil {
+			_ = httpServer.Shutdown(shutdownCtx)
+		}
+		if debugServer != nil {
+			_ = debugServer.Shutdown(shutdownCtx)
+		}
+		// imports write through the entry repository, so stop them first
+		err = importJobs.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Error("cannot stop imports", slog.Any("error", err))
+		}
+		flushBucketWrites(shutdownCtx, bucketEntryRepository, bucketTreatmentRepository)
 		serverStopCtx()
 	}()
 
-	log.Info("Starting server on", "address", cfg.Server.Address)
-	err = server.ListenAndServe()
+	if httpServer != nil {
+		go func() {
+			log.Info("redirecting http to https", slog.String("address", httpServer.Addr))
+			err := httpServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("http server terminated", slog.Any("error", err))
+			}
+		}()
+	}
+
+	if debugServer != nil {
+		debugListeners, err := listen([]string{cfg.Server.DebugAddress}, cfg.Server.SocketMode)
+		if err != nil {
+			log.Error("run cannot listen for debug", slog.Any("error", err))
+			os.Exit(1)
+		}
+		go func() {
+			log.Info("serving debug endpoints", slog.String("address", cfg.Server.DebugAddress))
+			err := debugServer.Serve(debugListeners[0])
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error("debug server terminated", slog.Any("error", err))
+			}
+		}()
+	}
+
+	listeners, err := listen(cfg.Server.Addresses, cfg.Server.SocketMode)
+	if err != nil {
+		log.Error("run cannot listen", slog.Any("error", err))
+		os.Exit(1)
+	}
+	// each listener is served until shutdown, or until one fails
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func() {
+			log.Info("Starting server on", "address", l.Addr().String())
+			if cfg.Server.TLS.Enabled() && !isUnixSocket(l) {
+				served <- server.ServeTLS(l, cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+				return
+			}
+			served <- server.Serve(l)
+		}()
+	}
+	err = <-served
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Error("server terminated", slog.Any("error", err))
 	}
@@ -160,21 +532,84 @@ func run(ctx context.Context, cfg config.ServerConfig) {
 	<-serverCtx.Done()
 }
 
-func startIngestor(ctx context.Context, entryRepository *repository.BucketEntryRepository, cgm *repository.CGMLibrelinkupRepository) {
+// flushBucketWrites waits for in-progress bucket writes, then syncs anything
+// still dirty, so the latest data is not lost when the server is stopped, eg
+// on deploy. Once everything is synced the sync lease is released, so the
+// next instance need not wait for it to expire.
+func flushBucketWrites(ctx context.Context, entryRepository *repository.BucketEntryRepository, treatmentRepository *repository.BucketTreatmentRepository) {
 	log := slogctx.FromCtx(ctx)
+	if entryRepository == nil {
+		return
+	}
+	synced := true
+	err := entryRepository.Flush(ctx)
+	if err != nil {
+		log.Error("shutting down before entries were synced", slog.Any("error", err))
+		synced = false
+	}
+	err = treatmentRepository.Flush(ctx)
+	if err != nil {
+		log.Error("shutting down before treatments were synced", slog.Any("error", err))
+		synced = false
+	}
+	if synced && entryRepository.Lease != nil {
+		err = entryRepository.Lease.Release(ctx)
+		if err != nil {
+			log.Warn("cannot release sync lease", slog.Any("error", err))
+		}
+	}
+}
 
-	ingestOnce(ctx, entryRepository, cgm)
+// leaseOwner identifies this instance in the sync lease. A restart in the
+// same container usually keeps the hostname and pid, so can resume syncing
+// at once after a crash.
+func leaseOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// startFlush syncs dirty periods every interval, so deletes, updates and day
+// rollovers reach the bucket even when no new data arrives
+func startFlush(ctx context.Context, entryRepository *repository.BucketEntryRepository, treatmentRepository *repository.BucketTreatmentRepository, interval time.Duration) {
+	log := slogctx.FromCtx(ctx)
 
 	go func() {
-		log.Info("starting ingester")
+		log.Info("starting periodic flush", slog.Duration("interval", interval))
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.Debug("flush tick")
+				entryRepository.Sync(ctx)
+				treatmentRepository.Sync(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func startBridge(ctx context.Context, bridge *repository.NightscoutBridge) {
+	log := slogctx.FromCtx(ctx)
+
+	go func() {
+		log.Info("starting bridge", slog.String("host", bridge.Config.URL.Host))
 
 		ticker := time.NewTicker(time.Second * 60)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				log.Debug("ingester tick")
-				ingestOnce(ctx, entryRepository, cgm)
+				log.Debug("bridge tick")
+				err := bridge.Sync(ctx)
+				if err != nil {
+					log.Warn("bridge cannot sync", slog.Any("error", err))
+				}
 			case <-ctx.Done():
 				return
 			}
@@ -182,34 +617,100 @@ func startIngestor(ctx context.Context, entryRepository *repository.BucketEntryR
 	}()
 }
 
-func ingestOnce(ctx context.Context, entryRepository *repository.BucketEntryRepository, cgm *repository.CGMLibrelinkupRepository) {
+func startBackup(ctx context.Context, backup *repository.BucketBackup, interval time.Duration) {
 	log := slogctx.FromCtx(ctx)
 
-	var mostRecentEntryTime time.Time
-	entry, err := entryRepository.FetchLatestSgvEntry(ctx, time.Now())
-	if err == nil {
-		mostRecentEntryTime = entry.Time
+	run := func() {
+		t1 := time.Now()
+		numCopied, err := backup.Run(ctx)
+		if err != nil {
+			log.Warn("backup failed, will retry next time", slog.Int("numCopied", numCopied), slog.Any("error", err))
+			return
+		}
+		log.Info("backup complete", slog.Int("numCopied", numCopied), slog.Int64("duration_ms", time.Since(t1).Milliseconds()))
 	}
 
-	newEntries, err := cgm.FetchRecent(ctx, mostRecentEntryTime)
-	if err != nil {
-		if cgm.ErrorIsAuthnFailed(err) {
-			log.Warn("librelinkup cannot authenticate, check username/password")
-		} else {
-			log.Warn("llu cannot fetch entries", slog.Any("error", err))
+	go func() {
+		log.Info("starting backup", slog.String("prefix", backup.Prefix), slog.Duration("interval", interval))
+		run()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				run()
+			case <-ctx.Done():
+				return
+			}
 		}
-		return
+	}()
+}
+
+func startEviction(ctx context.Context, entryRepository *repository.BucketEntryRepository) {
+	log := slogctx.FromCtx(ctx)
+
+	run := func() {
+		t1 := time.Now()
+		numEvicted, err := entryRepository.EvictEntries(ctx, t1)
+		if err != nil {
+			log.Warn("eviction failed, will retry next time", slog.Any("error", err))
+			return
+		}
+		log.Info("eviction complete",
+			slog.Int("numEvicted", numEvicted),
+			slog.Int64("duration_ms", time.Since(t1).Milliseconds()),
+		)
 	}
-	insertedEntries := entryRepository.CreateEntries(ctx, newEntries)
-	if len(insertedEntries) == 0 {
-		log.Info("ingester: no new entries")
-		return
+
+	go func() {
+		log.Info("starting eviction", slog.Int("memoryDays", entryRepository.MemoryDays))
+		run()
+
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				run()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func startRetention(ctx context.Context, purger *repository.Purger, keepDays int) {
+	log := slogctx.FromCtx(ctx)
+
+	run := func() {
+		t1 := time.Now()
+		result, err := purger.PurgeBefore(ctx, t1, keepDays)
+		if err != nil {
+			log.Warn("retention failed, will retry next time", slog.Any("error", err))
+			return
+		}
+		log.Info("retention complete",
+			slog.Int("numEntries", result.Entries),
+			slog.Int("numTreatments", result.Treatments),
+			slog.Int("numFiles", result.Files),
+			slog.Int64("duration_ms", time.Since(t1).Milliseconds()),
+		)
 	}
 
-	newestEntry := insertedEntries[len(insertedEntries)-1]
-	log.Info("ingested entries",
-		slog.Int("numEntries", len(insertedEntries)),
-		slog.Time("previousNewestEntryTime", mostRecentEntryTime),
-		slog.Time("newestEntryTime", newestEntry.Time),
-	)
+	go func() {
+		log.Info("starting retention", slog.Int("keepDays", keepDays))
+		run()
+
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				run()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/config"
+	slogctx "github.com/veqryn/slog-context"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// configureTLS sets server up to serve https, with a certificate from file or
+// obtained by ACME. It returns the server for TLS_HTTP_ADDRESS, which answers
+// ACME http-01 challenges and redirects everything else to https, or nil if
+// that is not configured.
+//
+// Without an http listener, ACME uses the tls-alpn-01 challenge, which needs
+// the https server to be reachable on port 443.
+func configureTLS(ctx context.Context, server *http.Server, cfg config.TLSConfig, bs repository.BucketCertStoreInterface) *http.Server {
+	log := slogctx.FromCtx(ctx)
+	var redirect http.Handler = httpsRedirect(server.Addr)
+
+	if len(cfg.ACMEHosts) > 0 {
+		var cache autocert.Cache = repository.NewBucketCertCache(bs)
+		if cfg.ACMECacheDir != "" {
+			cache = autocert.DirCache(cfg.ACMECacheDir)
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.ACMEHosts...),
+			Email:      cfg.ACMEEmail,
+			Cache:      cache,
+		}
+		if cfg.ACMEDir != "" {
+			m.Client = &acme.Client{DirectoryURL: cfg.ACMEDir}
+		}
+		server.TLSConfig = m.TLSConfig()
+		redirect = m.HTTPHandler(redirect)
+		log.Info("serving https with acme certificates", slog.Any("hosts", cfg.ACMEHosts))
+	} else {
+		log.Info("serving https", slog.String("cert", cfg.CertFile))
+	}
+
+	if cfg.HTTPAddress == "" {
+		return nil
+	}
+	return &http.Server{Addr: cfg.HTTPAddress, Handler: redirect}
+}
+
+// httpsRedirect redirects requests to the same url over https, on the port
+// of the https address
+func httpsRedirect(httpsAddress string) http.HandlerFunc {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		httpsAddress string
+		host         string
+		expected     string
+	}{
+		{httpsAddress: ":443", host: "ns.example.com", expected: "https://ns.example.com/api/v1/status?token=x"},
+		{httpsAddress: "0.0.0.0:8443", host: "ns.example.com:8080", expected: "https://ns.example.com:8443/api/v1/status?token=x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.httpsAddress, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/status?token=x", nil)
+			req.Host = tt.host
+			w := httptest.NewRecorder()
+			httpsRedirect(tt.httpsAddress)(w, req)
+			assert.Equal(t, http.StatusMovedPermanently, w.Code)
+			assert.Equal(t, tt.expected, w.Header().Get("Location"))
+		})
+	}
+}
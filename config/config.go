@@ -3,12 +3,21 @@ package config
 import (
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"github.com/thanos-io/objstore/providers/s3"
+	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
+	"github.com/thanos-io/objstore/client"
 	"gopkg.in/yaml.v2"
 	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var logLevels = map[string]slog.Level{
@@ -20,32 +29,233 @@ var logLevels = map[string]slog.Level{
 
 // ServerConfig is the root config for a nightscout server
 type ServerConfig struct {
-	APISecretHash string
-	DefaultRole   string
-	S3Config      s3.Config
-	Server        struct {
-		Address string
+	APISecretHash string // empty if API_SECRET is not set
+	OldAPISecret  struct {
+		Hash  string // empty if OLD_API_SECRET is not set
+		Until time.Time
 	}
-	LogLevel slog.Level
+	DefaultRole    string
+	IDStrategy     string
+	Language       string
+	BucketConfig   []byte
+	StorageBackend string
+	DatabaseURL    string
+	BucketFaults   bucketstore.FaultConfig
+	Compression    struct {
+		Entries    bucketstore.Compression
+		Treatments bucketstore.Compression
+	}
+	BucketCache struct {
+		Dir      string // empty to disable
+		MaxBytes int64
+	}
+	Redis struct {
+		URL  string // empty to disable
+		Size int
+		TTL  time.Duration
+	}
+	ParquetYears   bool
+	AppendDayFiles bool
+	CheckConflicts bool
+	SyncLease      bool
+	SyncLeaseTTL   time.Duration
+	HistoryYears   int
+	MemoryDays     int           // 0 keeps everything
+	RetentionDays  int           // 0 keeps everything
+	FlushInterval  time.Duration // 0 to only sync when data changes
+	Counts         struct {
+		Default int // entries or treatments listed without ?count=
+		Max     int
+	}
+	AuthFailures struct {
+		Delay          time.Duration
+		LockoutAfter   int // 0 never locks out
+		LockoutFor     time.Duration
+		TrustedProxies []netip.Prefix // clients are read from their X-Forwarded-For
+	}
+	Server struct {
+		Addresses    []string // host:port, or unix:/path for a unix socket
+		SocketMode   os.FileMode
+		DebugAddress string // serves /debug alone, empty to serve it with the api
+		BasePath     string // eg /nightscout, empty to serve from /
+		TLS          TLSConfig
+	}
+	Bridge             RemoteNightscout
+	Follow             RemoteNightscout
+	Backup             BackupConfig
+	ProxyAuth          ProxyAuthConfig
+	Display            DisplayConfig
+	Insulin            models.InsulinModel // the profile's dia takes precedence
+	CarbAbsorptionRate float64             // g/hour, the profile's carbs_hr takes precedence
+	UploaderBattery    models.BatteryThresholds
+	TreatmentTypes     models.TreatmentTypes
+	BGCheckMbg         bool     // also store BG Check treatments as mbg entries
+	NotifyWebhookURL   *url.URL // nil to not send notifications
+	APISecretHashOnly  bool     // reject API_SECRET sent unhashed
+	LogLevel           slog.Level
+}
+
+// BackupConfig determines where day, month and year files are copied to for
+// safe keeping
+type BackupConfig struct {
+	BucketConfig []byte // nil to back up to a prefix in the main bucket
+	Prefix       string
+	Interval     time.Duration
+}
+
+// ProxyAuthConfig determines whether users authenticated by a reverse proxy
+// (eg Authelia, oauth2-proxy) are trusted, and the roles their groups get
+type ProxyAuthConfig struct {
+	TrustedProxies []netip.Prefix
+	UnixSocket     bool // trust the proxy connecting over a unix socket
+	UserHeader     string
+	GroupsHeader   string
+	GroupRoles     map[string][]string
+}
+
+func (p ProxyAuthConfig) Enabled() bool {
+	return len(p.TrustedProxies) > 0 || p.UnixSocket
+}
+
+// Enabled reports whether backups are configured. Backing up to the main
+// bucket without a prefix would copy objects onto themselves, so that does
+// not count.
+func (b BackupConfig) Enabled() bool {
+	return b.BucketConfig != nil || b.Prefix != ""
+}
+
+// TLSConfig determines whether https is served directly, with a given
+// certificate or one obtained by ACME (eg from Let's Encrypt)
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ACMEHosts    []string // empty to disable acme
+	ACMEEmail    string
+	ACMEDir      string // acme directory url, empty for Let's Encrypt
+	ACMECacheDir string // empty to keep certificates in the bucket
+	HTTPAddress  string // serves acme http-01 challenges and redirects to https, empty to disable
+}
+
+// Enabled reports whether https is served
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || len(t.ACMEHosts) > 0
+}
+
+// DisplayConfig determines how clients display glucose, and which plugins
+// (pills, in the web ui) are enabled and shown
+type DisplayConfig struct {
+	Units        string // models.UnitsMgdl or models.UnitsMmol
+	APIUnits     string // units the api returns glucose in, empty to return it as stored
+	Thresholds   models.Thresholds
+	Enable       []string
+	ShowPlugins  []string
+	ShowForecast []string // forecasts the web ui draws, eg ar2
+}
+
+// RemoteNightscout is another nightscout instance we exchange data with
+type RemoteNightscout struct {
+	URL       *url.URL
+	Token     string
+	APISecret string
 }
 
 // RegisterEnv registers config from the environment
 func (c *ServerConfig) RegisterEnv() error {
-	c.Server.Address = os.Getenv("SERVER_ADDRESS")
-	if c.Server.Address == "" {
-		c.Server.Address = "0.0.0.0:8080"
+	// SERVER_ADDRESS may list several addresses, eg to listen on a unix
+	// socket for a reverse proxy as well as a port
+	var err error
+	c.Server.Addresses, err = listenAddresses("SERVER_ADDRESS", "0.0.0.0:8080")
+	if err != nil {
+		return err
+	}
+	c.Server.SocketMode = 0o660
+	if raw := os.Getenv("SERVER_SOCKET_MODE"); raw != "" {
+		mode, err := strconv.ParseUint(raw, 8, 32)
+		if err != nil || mode > 0o777 {
+			return fmt.Errorf("SERVER_SOCKET_MODE must be octal permissions, eg 0660, not %q", raw)
+		}
+		c.Server.SocketMode = os.FileMode(mode)
 	}
 
-	// authn may be performed using a sha1 of API_SECRET
-	apiSecret := os.Getenv("API_SECRET")
-	hasher := sha1.New()
-	hasher.Write([]byte(apiSecret))
-	c.APISecretHash = hex.EncodeToString(hasher.Sum(nil))
-	c.DefaultRole = os.Getenv("DEFAULT_ROLE")
+	// everything can be served under a path, behind path-based proxies
+	if raw := os.Getenv("BASE_PATH"); raw != "" {
+		c.Server.BasePath = strings.TrimRight(raw, "/")
+		if !strings.HasPrefix(raw, "/") || strings.ContainsAny(raw, "?#*{} ") {
+			return fmt.Errorf("BASE_PATH must be a path, eg /nightscout, not %q", raw)
+		}
+	}
+
+	// the profiler and /debug/vars can be kept off the public address
+	if raw := os.Getenv("DEBUG_ADDRESS"); raw != "" {
+		debugAddresses, err := listenAddresses("DEBUG_ADDRESS", "")
+		if err != nil || len(debugAddresses) != 1 {
+			return fmt.Errorf("DEBUG_ADDRESS must be a single host:port or unix:/path, not %q", raw)
+		}
+		c.Server.DebugAddress = debugAddresses[0]
+	}
+
+	// authn may be performed using a sha1 of API_SECRET. Without one, only
+	// tokens can authenticate.
+	c.APISecretHash = secretHash(os.Getenv("API_SECRET"))
+
+	// while rotating API_SECRET, clients may keep using OLD_API_SECRET until
+	// OLD_API_SECRET_UNTIL. There is no default: one relative to startup would
+	// start again on every restart, and never retire the old secret.
+	c.OldAPISecret.Hash = secretHash(os.Getenv("OLD_API_SECRET"))
+	if c.OldAPISecret.Hash != "" {
+		raw := os.Getenv("OLD_API_SECRET_UNTIL")
+		if raw == "" {
+			return fmt.Errorf("OLD_API_SECRET_UNTIL must be set with OLD_API_SECRET, eg %s", time.Now().AddDate(0, 0, 7).UTC().Format(time.RFC3339))
+		}
+		c.OldAPISecret.Until, err = time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return fmt.Errorf("OLD_API_SECRET_UNTIL must be an rfc3339 time, not %q", raw)
+		}
+	}
+
+	// some clients send API_SECRET itself rather than its sha1. That is
+	// accepted unless API_SECRET_HASH_ONLY is set.
+	if raw := os.Getenv("API_SECRET_HASH_ONLY"); raw != "" {
+		c.APISecretHashOnly, err = strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("API_SECRET_HASH_ONLY must be true or false, not %q", raw)
+		}
+	}
+	// the roles anonymous requests get, AUTH_DEFAULT_ROLES as in nightscout
+	c.DefaultRole = os.Getenv("AUTH_DEFAULT_ROLES")
+	if c.DefaultRole == "" {
+		c.DefaultRole = os.Getenv("DEFAULT_ROLE")
+	}
 	if c.DefaultRole == "" {
 		c.DefaultRole = "readable"
 	}
 
+	// oids are always exposed to clients, this determines what is stored
+	c.IDStrategy = strings.ToLower(os.Getenv("ID_STRATEGY"))
+	if c.IDStrategy != "" && c.IDStrategy != "objectid" && c.IDStrategy != "ulid" {
+		return fmt.Errorf("ID_STRATEGY must be objectid or ulid, not %q", c.IDStrategy)
+	}
+
+	// user-facing text is translated where possible, falling back to english
+	c.Language = strings.ToLower(os.Getenv("LANGUAGE"))
+	if c.Language == "" {
+		c.Language = "en"
+	}
+
+	// bridge mode pushes new data to another nightscout instance
+	bridge, err := registerRemoteNightscout("BRIDGE")
+	if err != nil {
+		return err
+	}
+	c.Bridge = bridge
+
+	// follow mode polls another nightscout instance for new data
+	follow, err := registerRemoteNightscout("FOLLOW")
+	if err != nil {
+		return err
+	}
+	c.Follow = follow
+
 	logLevel, ok := logLevels[strings.ToLower(os.Getenv("LOG_LEVEL"))]
 	if !ok {
 		logLevel = slog.LevelInfo
@@ -54,14 +264,641 @@ func (c *ServerConfig) RegisterEnv() error {
 
 	// nb "yaml is a superset of json", so we can load json from env while
 	// using the standard Thanos yaml code
-	// future: support additional object stores,
-	// see https://github.com/thanos-io/objstore/blob/main/client/factory.go
-	var s3Config s3.Config
-	err := yaml.Unmarshal([]byte(os.Getenv("S3_CONFIG")), &s3Config)
+	c.BucketConfig, err = bucketConfig("OBJSTORE_CONFIG", "S3_CONFIG")
+	if err != nil {
+		return err
+	}
+	if c.BucketConfig == nil {
+		return fmt.Errorf("one of OBJSTORE_CONFIG or S3_CONFIG must be set")
+	}
+
+	// entries and treatments may be stored in postgres rather than the
+	// bucket. Other data (profiles, device status etc) is always in the bucket
+	c.DatabaseURL = os.Getenv("DATABASE_URL")
+	c.StorageBackend = strings.ToLower(os.Getenv("STORAGE_BACKEND"))
+	if c.StorageBackend == "" {
+		c.StorageBackend = "bucket"
+		if c.DatabaseURL != "" {
+			c.StorageBackend = "postgres"
+		}
+	}
+	switch c.StorageBackend {
+	case "bucket":
+	case "postgres", "both":
+		if c.DatabaseURL == "" {
+			return fmt.Errorf("STORAGE_BACKEND=%s needs DATABASE_URL", c.StorageBackend)
+		}
+	default:
+		return fmt.Errorf("STORAGE_BACKEND must be bucket, postgres or both, not %q", c.StorageBackend)
+	}
+
+	// fault injection is for testing resilience only, never set in production
+	c.BucketFaults, err = bucketstore.ParseFaultConfig(os.Getenv("BUCKET_FAULTS"))
+	if err != nil {
+		return fmt.Errorf("cannot parse BUCKET_FAULTS: %w", err)
+	}
+
+	// year and month files can be cached on local disk, so restarts do not
+	// download them again
+	c.BucketCache.Dir = os.Getenv("BUCKET_CACHE_DIR")
+	c.BucketCache.MaxBytes = 512 << 20
+	if raw := os.Getenv("BUCKET_CACHE_MAX_MB"); raw != "" {
+		maxMB, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || maxMB < 1 {
+			return fmt.Errorf("BUCKET_CACHE_MAX_MB must be a positive number of megabytes, not %q", raw)
+		}
+		c.BucketCache.MaxBytes = maxMB << 20
+	}
+
+	// multi-instance deployments can share the latest entries and treatments
+	// through redis
+	c.Redis.URL = os.Getenv("REDIS_URL")
+	c.Redis.Size = 1000
+	if raw := os.Getenv("REDIS_CACHE_SIZE"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size < 1 {
+			return fmt.Errorf("REDIS_CACHE_SIZE must be a positive number, not %q", raw)
+		}
+		c.Redis.Size = size
+	}
+	c.Redis.TTL = time.Hour
+	if raw := os.Getenv("REDIS_CACHE_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl < time.Second {
+			return fmt.Errorf("REDIS_CACHE_TTL must be a duration of at least 1s, not %q", raw)
+		}
+		c.Redis.TTL = ttl
+	}
+
+	// day/month/year files can be compressed, set per store
+	c.Compression.Entries, err = bucketstore.ParseCompression(os.Getenv("ENTRY_COMPRESSION"))
+	if err != nil {
+		return fmt.Errorf("cannot parse ENTRY_COMPRESSION: %w", err)
+	}
+	c.Compression.Treatments, err = bucketstore.ParseCompression(os.Getenv("TREATMENT_COMPRESSION"))
+	if err != nil {
+		return fmt.Errorf("cannot parse TREATMENT_COMPRESSION: %w", err)
+	}
+
+	// year files can also be written as parquet, for duckdb/pandas users
+	if raw := os.Getenv("PARQUET_YEARS"); raw != "" {
+		c.ParquetYears, err = strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("PARQUET_YEARS must be true or false, not %q", raw)
+		}
+	}
+
+	// busy instances can append new entries to the day as small chunks
+	// rather than rewriting the whole day file each time
+	if raw := os.Getenv("APPEND_DAY_FILES"); raw != "" {
+		c.AppendDayFiles, err = strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("APPEND_DAY_FILES must be true or false, not %q", raw)
+		}
+	}
+
+	// instances sharing a bucket, eg during a rolling deploy, can check for
+	// each other's writes before rewriting a file
+	if raw := os.Getenv("CHECK_WRITE_CONFLICTS"); raw != "" {
+		c.CheckConflicts, err = strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("CHECK_WRITE_CONFLICTS must be true or false, not %q", raw)
+		}
+	}
+
+	// or take turns, only syncing while holding a lease in the bucket
+	if raw := os.Getenv("SYNC_LEASE"); raw != "" {
+		c.SyncLease, err = strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("SYNC_LEASE must be true or false, not %q", raw)
+		}
+	}
+
+	// years before last year are loaded for date range queries, keeping
+	// the most recently used HISTORY_CACHE_YEARS in memory
+	c.HistoryYears = 2
+	if raw := os.Getenv("HISTORY_CACHE_YEARS"); raw != "" {
+		c.HistoryYears, err = strconv.Atoi(raw)
+		if err != nil || c.HistoryYears < 1 {
+			return fmt.Errorf("HISTORY_CACHE_YEARS must be a positive number, not %q", raw)
+		}
+	}
+
+	// entries older than MEMORY_DAYS are evicted from memory daily, once
+	// they are in their year file
+	if raw := os.Getenv("MEMORY_DAYS"); raw != "" {
+		c.MemoryDays, err = strconv.Atoi(raw)
+		if err != nil || c.MemoryDays < 0 {
+			return fmt.Errorf("MEMORY_DAYS must be a number of days (0 to keep everything), not %q", raw)
+		}
+	}
+
+	// data older than RETENTION_DAYS is purged daily
+	if raw := os.Getenv("RETENTION_DAYS"); raw != "" {
+		c.RetentionDays, err = strconv.Atoi(raw)
+		if err != nil || c.RetentionDays < 0 {
+			return fmt.Errorf("RETENTION_DAYS must be a number of days (0 to keep everything), not %q", raw)
+		}
+	}
+
+	// dirty periods are synced every FLUSH_INTERVAL, even without new data
+	c.FlushInterval = 5 * time.Minute
+	if raw := os.Getenv("FLUSH_INTERVAL"); raw != "" {
+		c.FlushInterval, err = time.ParseDuration(raw)
+		if err != nil || (c.FlushInterval != 0 && c.FlushInterval < 10*time.Second) {
+			return fmt.Errorf("FLUSH_INTERVAL must be a duration of at least 10s (0 to disable), not %q", raw)
+		}
+	}
+
+	// a lease is renewed when syncing, so it must outlast FLUSH_INTERVAL or
+	// it would lapse between syncs
+	c.SyncLeaseTTL = 15 * time.Minute
+	if raw := os.Getenv("SYNC_LEASE_TTL"); raw != "" {
+		c.SyncLeaseTTL, err = time.ParseDuration(raw)
+		if err != nil || c.SyncLeaseTTL <= 0 {
+			return fmt.Errorf("SYNC_LEASE_TTL must be a positive duration, not %q", raw)
+		}
+	}
+	if c.SyncLease && c.SyncLeaseTTL <= c.FlushInterval {
+		return fmt.Errorf("SYNC_LEASE_TTL (%s) must be longer than FLUSH_INTERVAL (%s)", c.SyncLeaseTTL, c.FlushInterval)
+	}
+
+	// lists return DEFAULT_COUNT entries or treatments unless ?count= is
+	// given, which may be up to MAX_COUNT
+	c.Counts.Default = 20
+	if raw := os.Getenv("DEFAULT_COUNT"); raw != "" {
+		c.Counts.Default, err = strconv.Atoi(raw)
+		if err != nil || c.Counts.Default < 1 {
+			return fmt.Errorf("DEFAULT_COUNT must be a positive number, not %q", raw)
+		}
+	}
+	c.Counts.Max = 50000
+	if raw := os.Getenv("MAX_COUNT"); raw != "" {
+		c.Counts.Max, err = strconv.Atoi(raw)
+		if err != nil || c.Counts.Max < 1 {
+			return fmt.Errorf("MAX_COUNT must be a positive number, not %q", raw)
+		}
+	}
+	if c.Counts.Default > c.Counts.Max {
+		return fmt.Errorf("DEFAULT_COUNT (%d) must not be more than MAX_COUNT (%d)", c.Counts.Default, c.Counts.Max)
+	}
+
+	// failed authentication delays the response by AUTH_FAIL_DELAY per
+	// recent failure, and AUTH_LOCKOUT_AFTER failures lock the source out
+	c.AuthFailures.Delay = 5 * time.Second
+	if raw := os.Getenv("AUTH_FAIL_DELAY"); raw != "" {
+		c.AuthFailures.Delay, err = time.ParseDuration(raw)
+		if err != nil || c.AuthFailures.Delay < 0 {
+			return fmt.Errorf("AUTH_FAIL_DELAY must be a duration (0 to disable), not %q", raw)
+		}
+	}
+	c.AuthFailures.LockoutAfter = 10
+	if raw := os.Getenv("AUTH_LOCKOUT_AFTER"); raw != "" {
+		c.AuthFailures.LockoutAfter, err = strconv.Atoi(raw)
+		if err != nil || c.AuthFailures.LockoutAfter < 0 {
+			return fmt.Errorf("AUTH_LOCKOUT_AFTER must be a number of failures (0 to disable), not %q", raw)
+		}
+	}
+	c.AuthFailures.LockoutFor = 15 * time.Minute
+	if raw := os.Getenv("AUTH_LOCKOUT_DURATION"); raw != "" {
+		c.AuthFailures.LockoutFor, err = time.ParseDuration(raw)
+		if err != nil || c.AuthFailures.LockoutFor < time.Second {
+			return fmt.Errorf("AUTH_LOCKOUT_DURATION must be a duration of at least 1s, not %q", raw)
+		}
+	}
+	c.AuthFailures.TrustedProxies, err = parsePrefixes("TRUSTED_PROXIES", os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return err
+	}
+
+	c.Backup, err = registerBackup()
+	if err != nil {
+		return err
+	}
+
+	c.ProxyAuth, err = registerProxyAuth()
+	if err != nil {
+		return err
+	}
+
+	c.Display, err = registerDisplay()
 	if err != nil {
-		return fmt.Errorf("cannot parse S3 config: %w", err)
+		return err
+	}
+
+	c.Server.TLS, err = registerTLS()
+	if err != nil {
+		return err
+	}
+
+	c.Insulin, err = registerInsulin()
+	if err != nil {
+		return err
+	}
+	c.CarbAbsorptionRate, err = registerCarbAbsorptionRate()
+	if err != nil {
+		return err
+	}
+	c.UploaderBattery, err = registerUploaderBattery()
+	if err != nil {
+		return err
+	}
+	c.TreatmentTypes, err = registerTreatmentTypes()
+	if err != nil {
+		return err
+	}
+
+	// notifications, eg announcements, can be POSTed to a webhook
+	if raw := os.Getenv("NOTIFY_WEBHOOK_URL"); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("NOTIFY_WEBHOOK_URL must be an http/https url, not %q", raw)
+		}
+		c.NotifyWebhookURL = u
+	}
+
+	// finger-stick BG Checks can also be stored as mbg entries, so they
+	// show on the glucose chart
+	if raw := os.Getenv("BG_CHECK_MBG"); raw != "" {
+		c.BGCheckMbg, err = strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("BG_CHECK_MBG must be true or false, not %q", raw)
+		}
 	}
-	c.S3Config = s3Config
 
 	return nil
 }
+
+// bucketConfig returns Thanos objstore client config, from objstoreEnv if set
+// (eg `{"type":"GCS","config":{"bucket":"nightscout"}}`) or else from s3Env,
+// which holds just the s3 config as before other providers were supported.
+// Returns nil if neither is set.
+func bucketConfig(objstoreEnv, s3Env string) ([]byte, error) {
+	if raw := os.Getenv(objstoreEnv); raw != "" {
+		var conf client.BucketConfig
+		err := yaml.UnmarshalStrict([]byte(raw), &conf)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %w", objstoreEnv, err)
+		}
+		if conf.Type == "" {
+			return nil, fmt.Errorf("%s must include a type, eg S3, GCS, AZURE, SWIFT or FILESYSTEM", objstoreEnv)
+		}
+		return []byte(raw), nil
+	}
+
+	raw := os.Getenv(s3Env)
+	if raw == "" {
+		return nil, nil
+	}
+	// keep the s3 config as given, so Thanos defaults apply to unset fields
+	var s3Config yaml.MapSlice
+	err := yaml.Unmarshal([]byte(raw), &s3Config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", s3Env, err)
+	}
+	conf, err := yaml.Marshal(client.BucketConfig{Type: client.S3, Config: s3Config})
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert %s: %w", s3Env, err)
+	}
+	return conf, nil
+}
+
+// registerBackup reads BACKUP_OBJSTORE_CONFIG (or BACKUP_S3_CONFIG),
+// BACKUP_PREFIX and BACKUP_INTERVAL from the environment
+func registerBackup() (BackupConfig, error) {
+	b := BackupConfig{Interval: 24 * time.Hour}
+	var err error
+	b.BucketConfig, err = bucketConfig("BACKUP_OBJSTORE_CONFIG", "BACKUP_S3_CONFIG")
+	if err != nil {
+		return b, err
+	}
+
+	b.Prefix = os.Getenv("BACKUP_PREFIX")
+	if b.Prefix != "" && !strings.HasSuffix(b.Prefix, "/") {
+		b.Prefix += "/"
+	}
+
+	if raw := os.Getenv("BACKUP_INTERVAL"); raw != "" {
+		interval, err := time.ParseDuration(raw)
+		if err != nil || interval < time.Minute {
+			return b, fmt.Errorf("BACKUP_INTERVAL must be a duration of at least 1m, not %q", raw)
+		}
+		b.Interval = interval
+	}
+	return b, nil
+}
+
+// parsePrefixes parses the comma-separated addresses or cidrs in env var name
+func parsePrefixes(name string, raw string) ([]netip.Prefix, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(field)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%s must be comma-separated addresses or cidrs, not %q", name, field)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// registerProxyAuth reads PROXY_AUTH_TRUSTED (comma-separated addresses or
+// cidrs of the proxies, or "unix" for a proxy connecting over a unix socket),
+// the header names and PROXY_AUTH_ROLES, eg
+// "admins=admin,family=readable+careportal"
+func registerProxyAuth() (ProxyAuthConfig, error) {
+	p := ProxyAuthConfig{
+		UserHeader:   "X-Forwarded-User",
+		GroupsHeader: "X-Forwarded-Groups",
+		GroupRoles:   make(map[string][]string),
+	}
+	var trusted []string
+	for _, field := range strings.Split(os.Getenv("PROXY_AUTH_TRUSTED"), ",") {
+		if strings.TrimSpace(field) == "unix" {
+			p.UnixSocket = true
+			continue
+		}
+		trusted = append(trusted, field)
+	}
+	var err error
+	p.TrustedProxies, err = parsePrefixes("PROXY_AUTH_TRUSTED", strings.Join(trusted, ","))
+	if err != nil || !p.Enabled() {
+		return p, err
+	}
+
+	if header := os.Getenv("PROXY_AUTH_USER_HEADER"); header != "" {
+		p.UserHeader = header
+	}
+	if header := os.Getenv("PROXY_AUTH_GROUPS_HEADER"); header != "" {
+		p.GroupsHeader = header
+	}
+	if raw := os.Getenv("PROXY_AUTH_ROLES"); raw != "" {
+		for _, mapping := range strings.Split(raw, ",") {
+			group, roles, found := strings.Cut(strings.TrimSpace(mapping), "=")
+			if !found || group == "" || roles == "" {
+				return p, fmt.Errorf("PROXY_AUTH_ROLES must be comma-separated group=role+role mappings, not %q", mapping)
+			}
+			p.GroupRoles[group] = append(p.GroupRoles[group], strings.Split(roles, "+")...)
+		}
+	}
+	return p, nil
+}
+
+// listenAddresses reads comma-separated listen addresses from env, each
+// host:port or unix:/path
+func listenAddresses(env string, defaultAddress string) ([]string, error) {
+	raw := os.Getenv(env)
+	if raw == "" {
+		return []string{defaultAddress}, nil
+	}
+	var addresses []string
+	for _, address := range strings.Split(raw, ",") {
+		address = strings.TrimSpace(address)
+		if path, ok := strings.CutPrefix(address, "unix:"); ok {
+			if path == "" {
+				return nil, fmt.Errorf("%s must give a path for unix sockets, eg unix:/run/nightscout.sock", env)
+			}
+		} else if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("%s must be comma-separated host:port or unix:/path addresses, not %q", env, address)
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// registerTLS reads TLS_CERT and TLS_KEY (pem files), or TLS_ACME_HOSTS (a
+// comma-separated allowlist of hostnames to obtain certificates for) and the
+// other TLS_ACME_* settings
+func registerTLS() (TLSConfig, error) {
+	t := TLSConfig{
+		CertFile:     os.Getenv("TLS_CERT"),
+		KeyFile:      os.Getenv("TLS_KEY"),
+		ACMEEmail:    os.Getenv("TLS_ACME_EMAIL"),
+		ACMEDir:      os.Getenv("TLS_ACME_DIRECTORY"),
+		ACMECacheDir: os.Getenv("TLS_ACME_CACHE_DIR"),
+		HTTPAddress:  os.Getenv("TLS_HTTP_ADDRESS"),
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return t, fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	for _, host := range strings.Split(os.Getenv("TLS_ACME_HOSTS"), ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if strings.ContainsAny(host, ":/ ") {
+			return t, fmt.Errorf("TLS_ACME_HOSTS must be comma-separated hostnames, not %q", host)
+		}
+		t.ACMEHosts = append(t.ACMEHosts, strings.ToLower(host))
+	}
+	if t.CertFile != "" && len(t.ACMEHosts) > 0 {
+		return t, fmt.Errorf("only one of TLS_CERT or TLS_ACME_HOSTS can be set")
+	}
+	if t.HTTPAddress != "" && !t.Enabled() {
+		return t, fmt.Errorf("TLS_HTTP_ADDRESS needs TLS_CERT or TLS_ACME_HOSTS")
+	}
+	return t, nil
+}
+
+// registerDisplay reads UNITS, the BG_* thresholds, ENABLE, SHOW_PLUGINS and
+// SHOW_FORECAST, as nightscout does. Thresholds are in UNITS, although as in nightscout
+// values above 50 are taken to be mg/dL whatever the units.
+func registerDisplay() (DisplayConfig, error) {
+	d := DisplayConfig{
+		Units:      models.UnitsMgdl,
+		Thresholds: models.DefaultThresholds,
+		Enable:     []string{"careportal"},
+	}
+	switch raw := strings.ToLower(os.Getenv("UNITS")); raw {
+	case "", "mg/dl", "mgdl":
+	case "mmol", "mmol/l":
+		d.Units = models.UnitsMmol
+	default:
+		return d, fmt.Errorf("UNITS must be mg/dl or mmol, not %q", raw)
+	}
+
+	// nightscout clients expect mg/dL from the api whatever UNITS is, so
+	// converting needs asking for separately
+	switch raw := strings.ToLower(os.Getenv("API_UNITS")); raw {
+	case "":
+	case "mg/dl", "mgdl":
+		d.APIUnits = models.UnitsMgdl
+	case "mmol", "mmol/l":
+		d.APIUnits = models.UnitsMmol
+	default:
+		return d, fmt.Errorf("API_UNITS must be mg/dl or mmol, not %q", raw)
+	}
+
+	thresholds := []struct {
+		env  string
+		mgdl *int
+	}{
+		{"BG_HIGH", &d.Thresholds.High},
+		{"BG_TARGET_TOP", &d.Thresholds.TargetTop},
+		{"BG_TARGET_BOTTOM", &d.Thresholds.TargetBottom},
+		{"BG_LOW", &d.Thresholds.Low},
+	}
+	for _, t := range thresholds {
+		raw := os.Getenv(t.env)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil || value <= 0 {
+			return d, fmt.Errorf("%s must be a positive number, not %q", t.env, raw)
+		}
+		if value < 50 {
+			*t.mgdl = models.MmolToMgdl(value)
+		} else {
+			*t.mgdl = int(math.Round(value))
+		}
+	}
+	th := d.Thresholds
+	if th.Low >= th.TargetBottom || th.TargetBottom >= th.TargetTop || th.TargetTop >= th.High {
+		return d, fmt.Errorf("thresholds must be BG_LOW < BG_TARGET_BOTTOM < BG_TARGET_TOP < BG_HIGH, not %d < %d < %d < %d (mg/dl)",
+			th.Low, th.TargetBottom, th.TargetTop, th.High)
+	}
+
+	// nightscout separates plugins with spaces, commas are accepted too
+	if raw := os.Getenv("ENABLE"); raw != "" {
+		d.Enable = pluginNames(raw)
+	}
+	d.ShowPlugins = pluginNames(os.Getenv("SHOW_PLUGINS"))
+	d.ShowForecast = []string{"ar2"}
+	if raw, ok := os.LookupEnv("SHOW_FORECAST"); ok {
+		d.ShowForecast = pluginNames(raw)
+	}
+	return d, nil
+}
+
+// registerInsulin reads INSULIN_DIA (hours), INSULIN_CURVE and INSULIN_PEAK
+// (minutes), used to calculate insulin on board
+func registerInsulin() (models.InsulinModel, error) {
+	m := models.DefaultInsulinModel
+	if raw := os.Getenv("INSULIN_DIA"); raw != "" {
+		hours, err := strconv.ParseFloat(raw, 64)
+		if err != nil || hours < 1 || hours > 24 {
+			return m, fmt.Errorf("INSULIN_DIA must be a number of hours between 1 and 24, not %q", raw)
+		}
+		m.DIA = time.Duration(hours * float64(time.Hour))
+	}
+	switch raw := strings.ToLower(os.Getenv("INSULIN_CURVE")); raw {
+	case "", models.InsulinCurveBilinear:
+	case models.InsulinCurveExponential:
+		m.Curve = models.InsulinCurveExponential
+	default:
+		return m, fmt.Errorf("INSULIN_CURVE must be bilinear or exponential, not %q", raw)
+	}
+	if raw := os.Getenv("INSULIN_PEAK"); raw != "" {
+		minutes, err := strconv.Atoi(raw)
+		if err != nil || minutes < 35 || minutes > 120 {
+			return m, fmt.Errorf("INSULIN_PEAK must be a number of minutes between 35 and 120, not %q", raw)
+		}
+		m.Peak = time.Duration(minutes) * time.Minute
+	}
+	return m, nil
+}
+
+// registerCarbAbsorptionRate reads CARBS_HR (g/hour), used to calculate carbs
+// on board
+func registerCarbAbsorptionRate() (float64, error) {
+	raw := os.Getenv("CARBS_HR")
+	if raw == "" {
+		return models.DefaultCarbAbsorptionRate, nil
+	}
+	rate, err := strconv.ParseFloat(raw, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("CARBS_HR must be a positive number of grams per hour, not %q", raw)
+	}
+	return rate, nil
+}
+
+// registerUploaderBattery reads UPBAT_WARN and UPBAT_URGENT (percent), the
+// uploader battery levels at and below which the upbat property warns
+func registerUploaderBattery() (models.BatteryThresholds, error) {
+	th := models.DefaultBatteryThresholds
+	for _, v := range []struct {
+		env   string
+		value *int
+	}{{"UPBAT_WARN", &th.Warn}, {"UPBAT_URGENT", &th.Urgent}} {
+		raw := os.Getenv(v.env)
+		if raw == "" {
+			continue
+		}
+		percent, err := strconv.Atoi(raw)
+		if err != nil || percent < 0 || percent > 100 {
+			return th, fmt.Errorf("%s must be a percentage between 0 and 100, not %q", v.env, raw)
+		}
+		*v.value = percent
+	}
+	if th.Urgent > th.Warn {
+		return th, fmt.Errorf("UPBAT_URGENT (%d) must not be above UPBAT_WARN (%d)", th.Urgent, th.Warn)
+	}
+	return th, nil
+}
+
+// registerTreatmentTypes reads TREATMENT_TYPES, a yaml (or json) map of
+// custom eventTypes to the fields their treatments must have, eg
+// `{"Pump Battery Change": [], "Ketones": [ketones]}`. They are added to
+// models.DefaultTreatmentTypes.
+func registerTreatmentTypes() (models.TreatmentTypes, error) {
+	types := models.DefaultTreatmentTypes
+	raw := os.Getenv("TREATMENT_TYPES")
+	if raw == "" {
+		return types, nil
+	}
+	var custom map[string][]string
+	if err := yaml.UnmarshalStrict([]byte(raw), &custom); err != nil {
+		return types, fmt.Errorf("TREATMENT_TYPES must map eventTypes to lists of required fields: %w", err)
+	}
+	for name, required := range custom {
+		if strings.TrimSpace(name) == "" {
+			return types, errors.New("TREATMENT_TYPES cannot have an empty eventType")
+		}
+		types = types.Register(name, required...)
+	}
+	return types, nil
+}
+
+func pluginNames(raw string) []string {
+	return strings.FieldsFunc(strings.ToLower(raw), func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// registerRemoteNightscout reads <prefix>_URL, <prefix>_TOKEN and
+// <prefix>_API_SECRET from the environment. The URL is nil if not configured.
+func registerRemoteNightscout(prefix string) (RemoteNightscout, error) {
+	var r RemoteNightscout
+	rawURL := os.Getenv(prefix + "_URL")
+	if rawURL == "" {
+		return r, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return r, fmt.Errorf("%s_URL must be an http/https url, not %q", prefix, rawURL)
+	}
+	r.URL = u
+	r.Token = os.Getenv(prefix + "_TOKEN")
+	r.APISecret = os.Getenv(prefix + "_API_SECRET")
+	if r.Token == "" && r.APISecret == "" {
+		return r, fmt.Errorf("%s_TOKEN or %s_API_SECRET must be set when %s_URL is set", prefix, prefix, prefix)
+	}
+	return r, nil
+}
+
+// secretHash returns the sha1 of secret as hex, as clients send it, or empty
+// if secret is
+func secretHash(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	hasher := sha1.New()
+	hasher.Write([]byte(secret))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerConfig_RegisterEnvOldAPISecret(t *testing.T) {
+	t.Setenv("OBJSTORE_CONFIG", `{"type":"FILESYSTEM","config":{"directory":"/tmp"}}`)
+	t.Setenv("API_SECRET", "new secret value")
+	t.Setenv("OLD_API_SECRET", "old secret value")
+
+	var cfg ServerConfig
+	assert.ErrorContains(t, cfg.RegisterEnv(), "OLD_API_SECRET_UNTIL must be set")
+
+	t.Setenv("OLD_API_SECRET_UNTIL", "2024-12-05T10:00:00Z")
+	assert.NoError(t, cfg.RegisterEnv())
+	until := time.Date(2024, 12, 5, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, until, cfg.OldAPISecret.Until)
+
+	// a restart or reload does not extend the grace period
+	var again ServerConfig
+	assert.NoError(t, again.RegisterEnv())
+	assert.Equal(t, until, again.OldAPISecret.Until)
+}
+
+func TestRegisterTreatmentTypes(t *testing.T) {
+	vars, err := parseConfigFile([]byte("settings:\n  treatment_types:\n    Pump Battery Change: []\n    Ketones: [ketones]\n"))
+	assert.NoError(t, err)
+	t.Setenv("TREATMENT_TYPES", vars["TREATMENT_TYPES"])
+
+	types, err := registerTreatmentTypes()
+	assert.NoError(t, err)
+	assert.Contains(t, types, "Pump Battery Change")
+	assert.Equal(t, []string{"ketones"}, types["Ketones"].Required)
+	assert.Contains(t, types, "Carbs", "defaults kept")
+
+	t.Setenv("TREATMENT_TYPES", "[Ketones]")
+	_, err = registerTreatmentTypes()
+	assert.ErrorContains(t, err, "TREATMENT_TYPES must map eventTypes")
+}
+
+func TestRegisterProxyAuth(t *testing.T) {
+	p, err := registerProxyAuth()
+	assert.NoError(t, err)
+	assert.False(t, p.Enabled())
+
+	t.Setenv("PROXY_AUTH_TRUSTED", "unix")
+	p, err = registerProxyAuth()
+	assert.NoError(t, err)
+	assert.True(t, p.Enabled())
+	assert.True(t, p.UnixSocket)
+	assert.Empty(t, p.TrustedProxies)
+
+	t.Setenv("PROXY_AUTH_TRUSTED", "10.0.0.0/8, unix")
+	p, err = registerProxyAuth()
+	assert.NoError(t, err)
+	assert.True(t, p.UnixSocket)
+	assert.Len(t, p.TrustedProxies, 1)
+}
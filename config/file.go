@@ -0,0 +1,167 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// A config file groups the environment variables into sections, eg
+//
+//	server:
+//	  server_address: 0.0.0.0:8080
+//	auth:
+//	  api_secret: ...
+//	storage:
+//	  objstore_config:
+//	    type: S3
+//	    config: {bucket: nightscout-go, ...}
+//
+// Keys are the environment variable names, lowercased. Lists are joined with
+// commas and maps (eg objstore_config) passed on as yaml. Environment
+// variables override the file, so secrets can be kept out of it.
+
+var configSections = []string{"server", "storage", "auth", "cgm", "alarms", "settings"}
+
+var configKey = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// fileVars holds the environment variables set by LoadFile, so reloading the
+// file can replace or unset them without overriding the real environment
+var fileVars = make(map[string]bool)
+
+// LoadFile applies a yaml (or json) config file, setting each environment
+// variable not already set. Call before RegisterEnv.
+func LoadFile(path string) error {
+	vars, err := ReadFile(path)
+	if err != nil {
+		return err
+	}
+	_, err = SetFileVars(vars)
+	return err
+}
+
+// ReadFile returns the environment variables a config file sets, without
+// applying them
+func ReadFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file: %w", err)
+	}
+	vars, err := parseConfigFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse config file %s: %w", path, err)
+	}
+	return vars, nil
+}
+
+// SetFileVars sets each environment variable from ReadFile not already set in
+// the real environment, and unsets any a previous file set but this one does
+// not, eg when reloading on SIGHUP. The returned func restores the previous
+// environment, so a reload can be abandoned if the new config is invalid.
+func SetFileVars(vars map[string]string) (restore func(), err error) {
+	previousFileVars := maps.Clone(fileVars)
+	previousEnv := make(map[string]*string)
+	for name := range fileVars {
+		previousEnv[name] = lookupEnv(name)
+	}
+	for name := range vars {
+		previousEnv[name] = lookupEnv(name)
+	}
+	restore = func() {
+		for name, value := range previousEnv {
+			if value == nil {
+				_ = os.Unsetenv(name)
+				continue
+			}
+			_ = os.Setenv(name, *value)
+		}
+		fileVars = previousFileVars
+	}
+
+	for name := range fileVars {
+		if _, ok := vars[name]; !ok {
+			_ = os.Unsetenv(name)
+			delete(fileVars, name)
+		}
+	}
+	for name, value := range vars {
+		if _, ok := os.LookupEnv(name); ok && !fileVars[name] {
+			continue
+		}
+		err = os.Setenv(name, value)
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("cannot set %s: %w", name, err)
+		}
+		fileVars[name] = true
+	}
+	return restore, nil
+}
+
+func lookupEnv(name string) *string {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	return &value
+}
+
+// parseConfigFile returns the environment variables a config file sets
+func parseConfigFile(b []byte) (map[string]string, error) {
+	var sections map[string]map[string]interface{}
+	err := yaml.UnmarshalStrict(b, &sections)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for section, values := range sections {
+		if !slices.Contains(configSections, section) {
+			return nil, fmt.Errorf("unknown section %q, expected one of %s", section, strings.Join(configSections, ", "))
+		}
+		for key, value := range values {
+			if !configKey.MatchString(key) {
+				return nil, fmt.Errorf("%s: key %q should be a lowercased environment variable name, eg api_secret", section, key)
+			}
+			name := strings.ToUpper(key)
+			if _, ok := vars[name]; ok {
+				return nil, fmt.Errorf("%s: %s is set in more than one section", section, key)
+			}
+			vars[name], err = configValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", section, key, err)
+			}
+		}
+	}
+	return vars, nil
+}
+
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[interface{}]interface{}:
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
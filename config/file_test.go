@@ -0,0 +1,83 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	vars, err := parseConfigFile([]byte(`
+server:
+  server_address: 127.0.0.1:8080
+auth:
+  api_secret: "not a secret"
+  auth_lockout_after: 5
+  proxy_auth_trusted: [10.0.0.0/8, 192.0.2.1]
+storage:
+  check_write_conflicts: true
+  objstore_config:
+    type: S3
+    config:
+      bucket: nightscout-go
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:8080", vars["SERVER_ADDRESS"])
+	assert.Equal(t, "not a secret", vars["API_SECRET"])
+	assert.Equal(t, "5", vars["AUTH_LOCKOUT_AFTER"])
+	assert.Equal(t, "10.0.0.0/8,192.0.2.1", vars["PROXY_AUTH_TRUSTED"])
+	assert.Equal(t, "true", vars["CHECK_WRITE_CONFLICTS"])
+	assert.YAMLEq(t, `{type: S3, config: {bucket: nightscout-go}}`, vars["OBJSTORE_CONFIG"])
+
+	// json is yaml too
+	vars, err = parseConfigFile([]byte(`{"auth": {"api_secret": "x"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "x", vars["API_SECRET"])
+
+	_, err = parseConfigFile([]byte("alerts:\n  api_secret: x\n"))
+	assert.ErrorContains(t, err, `unknown section "alerts"`)
+	_, err = parseConfigFile([]byte("auth:\n  API_SECRET: x\n"))
+	assert.ErrorContains(t, err, "lowercased environment variable name")
+	_, err = parseConfigFile([]byte("auth:\n  api_secret: x\nserver:\n  api_secret: y\n"))
+	assert.ErrorContains(t, err, "more than one section")
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("server:\n  server_address: 127.0.0.1:1\n  test_load_file: from-file\n"), 0o600))
+	t.Setenv("SERVER_ADDRESS", "127.0.0.1:2")
+	t.Cleanup(func() { _ = os.Unsetenv("TEST_LOAD_FILE") })
+
+	assert.NoError(t, LoadFile(path))
+	assert.Equal(t, "127.0.0.1:2", os.Getenv("SERVER_ADDRESS"), "environment variables override the file")
+	assert.Equal(t, "from-file", os.Getenv("TEST_LOAD_FILE"))
+
+	// reloading replaces values from the file, and unsets those removed
+	assert.NoError(t, os.WriteFile(path, []byte("server:\n  server_address: 127.0.0.1:1\n  test_reload_file: from-file\n"), 0o600))
+	t.Cleanup(func() { _ = os.Unsetenv("TEST_RELOAD_FILE") })
+	assert.NoError(t, LoadFile(path))
+	assert.Equal(t, "127.0.0.1:2", os.Getenv("SERVER_ADDRESS"))
+	assert.Equal(t, "from-file", os.Getenv("TEST_RELOAD_FILE"))
+	_, ok := os.LookupEnv("TEST_LOAD_FILE")
+	assert.False(t, ok)
+
+	assert.Error(t, LoadFile(filepath.Join(t.TempDir(), "missing.yaml")))
+
+	// an abandoned reload restores the environment as it was
+	restore, err := SetFileVars(map[string]string{"SERVER_ADDRESS": "127.0.0.1:3", "TEST_LOAD_FILE": "restored"})
+	assert.NoError(t, err)
+	assert.Equal(t, "restored", os.Getenv("TEST_LOAD_FILE"))
+	_, ok = os.LookupEnv("TEST_RELOAD_FILE")
+	assert.False(t, ok)
+	restore()
+	assert.Equal(t, "127.0.0.1:2", os.Getenv("SERVER_ADDRESS"))
+	assert.Equal(t, "from-file", os.Getenv("TEST_RELOAD_FILE"))
+	_, ok = os.LookupEnv("TEST_LOAD_FILE")
+	assert.False(t, ok)
+
+	// ...and the file's variables are still replaced by the next reload
+	assert.NoError(t, LoadFile(path))
+	assert.Equal(t, "from-file", os.Getenv("TEST_RELOAD_FILE"))
+}
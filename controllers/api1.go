@@ -1,11 +1,13 @@
 package controllers
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/i18n"
 	"github.com/adamlounds/nightscout-go/models"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -13,8 +15,9 @@ import (
 	slogctx "github.com/veqryn/slog-context"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
-	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -27,6 +30,8 @@ type EntryRepository interface {
 	FetchLatestSgvEntry(ctx context.Context, maxTime time.Time) (*models.Entry, error)
 	FetchLatestEntries(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error)
 	FetchLatestSGVs(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error)
+	FetchEntriesBetween(ctx context.Context, from, to time.Time, entryType string, maxEntries int) ([]models.Entry, error)
+	FetchMatchingEntry(ctx context.Context, entry models.Entry) (*models.Entry, error)
 	CreateEntries(ctx context.Context, entries []models.Entry) []models.Entry
 }
 type TreatmentRepository interface {
@@ -34,6 +39,7 @@ type TreatmentRepository interface {
 	FetchTreatmentByOid(ctx context.Context, oid string) (*models.Treatment, error)
 	DeleteTreatmentByOid(ctx context.Context, oid string) error
 	FetchLatestTreatments(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error)
+	FetchTreatmentsAfter(ctx context.Context, minTime time.Time) ([]models.Treatment, error)
 	CreateTreatments(ctx context.Context, treatments []models.Treatment) []models.Treatment
 	UpdateTreatmentByOid(ctx context.Context, oid string, treatment *models.Treatment) error
 }
@@ -44,34 +50,104 @@ type AuthRepository interface {
 }
 
 type NightscoutRepository interface {
-	FetchAllEntries(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Entry, error)
+	FetchEntriesBefore(ctx context.Context, nsCfg repository.NightscoutConfig, before time.Time, count int) ([]models.Entry, error)
+	FetchAllTreatments(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Treatment, error)
+	FetchProfiles(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Profile, error)
+	FetchDeviceStatusSince(ctx context.Context, nsCfg repository.NightscoutConfig, since time.Time) ([]models.DeviceStatus, error)
+}
+
+type ProfileRepository interface {
+	FetchProfiles(ctx context.Context) ([]models.Profile, error)
+	CreateProfiles(ctx context.Context, profiles []models.Profile) ([]models.Profile, error)
+}
+
+type DeviceStatusRepository interface {
+	FetchLatestDeviceStatuses(ctx context.Context, maxTime time.Time, maxStatuses int) ([]models.DeviceStatus, error)
+	CreateDeviceStatuses(ctx context.Context, statuses []models.DeviceStatus) ([]models.DeviceStatus, error)
+}
+
+// Notifier tells users about notifications, eg announcements, somewhere
+// outside the api
+type Notifier interface {
+	Notify(ctx context.Context, notification models.Notification)
+}
+
+type AuthService interface {
+	PermissionGroups(ctx context.Context, authSubject *models.AuthSubject) [][]string
+	IssueJWT(ctx context.Context, accessToken string, now time.Time) (*models.JWT, error)
+	IsPermitted(ctx context.Context, authn *models.Authn, requiredPermission string) bool
 }
 
 type ApiV1 struct {
 	EntryRepository
 	TreatmentRepository
 	NightscoutRepository
+	AuthService
+	CGMRepository
+	ProfileRepository      ProfileRepository
+	DeviceStatusRepository DeviceStatusRepository
+	ImportCursorRepository ImportCursorRepository
+	CSVRepository          CSVRepository
+	ArchiveRepository      ArchiveRepository
+	ExportRepository       ExportRepository
+	PurgeRepository        PurgeRepository
+	SyncRepository         SyncRepository // nil unless storing in the bucket
+	AuthSubjectRepository  AuthSubjectRepository
+	RoleRepository         RoleRepository
+	ImportJobs             *ImportJobs
+	Notifier               Notifier              // nil unless notifications are sent anywhere
+	AdminNotifies          *models.AdminNotifies // problems for operators, nil to not record any
+	AuthFailures           *AuthFailureTracker   // shared with ApiV1AuthnMiddleware, nil to never delay
+	Settings               *LiveSettings
+	BasePath               string // the path everything is served under, eg /nightscout, or empty
+	CountLimits            CountLimits
+	APIUnits               string // units glucose is returned in without ?units=, empty to return it as stored
+}
+
+// CountLimits are the number of entries or treatments lists return by
+// default, and the most a client can ask for. Zero values use the defaults.
+type CountLimits struct {
+	Default int
+	Max     int
+}
+
+const (
+	DefaultCount    = 20
+	DefaultMaxCount = 50000
+)
+
+func (l CountLimits) withDefaults() CountLimits {
+	if l.Default == 0 {
+		l.Default = DefaultCount
+	}
+	if l.Max == 0 {
+		l.Max = DefaultMaxCount
+	}
+	return l
 }
 
 type APIV1EntryResponse struct {
-	Oid        string `json:"_id"`        // mongo object id [0-9a-f]{24} eg "67261314d689f977f773bc19"
-	Type       string `json:"type"`       // "sgv"
-	Direction  string `json:"direction"`  // "Flat"
-	Device     string `json:"device"`     // "nightscout-librelink-up"
-	DateString string `json:"dateString"` // rfc3339 plus ms
-	SysTime    string `json:"sysTime"`    // same as dateString
-	Date       int64  `json:"date"`       // ms since epoch
-	Mills      int64  `json:"mills"`      // ms since epoch
-	UtcOffset  int64  `json:"utcOffset"`  // always 0
-	SgvMgdl    int    `json:"sgv"`        //
+	Oid        string  `json:"_id"`             // mongo object id [0-9a-f]{24} eg "67261314d689f977f773bc19"
+	Type       string  `json:"type"`            // "sgv"
+	Direction  string  `json:"direction"`       // "Flat"
+	Device     string  `json:"device"`          // "nightscout-librelink-up"
+	DateString string  `json:"dateString"`      // rfc3339 plus ms
+	SysTime    string  `json:"sysTime"`         // same as dateString
+	Date       int64   `json:"date"`            // ms since epoch
+	Mills      int64   `json:"mills"`           // ms since epoch
+	UtcOffset  int     `json:"utcOffset"`       // minutes east of UTC, as uploaded
+	Sgv        float64 `json:"sgv"`             // mg/dL, or mmol/L with ?units=mmol
+	Units      string  `json:"units,omitempty"` // only given for mmol/L
 }
 
 type APIV1EntryRequest struct {
+	Oid       string `json:"_id"`
 	Type      string `json:"type"`
 	Direction string `json:"direction"`
 	Device    string `json:"device"`
 	Date      string `json:"dateString"`
 	SgvMgdl   int    `json:"sgv"`
+	UtcOffset int    `json:"utcOffset"` // minutes, eg xDrip's local time offset
 }
 
 var rfc3339msLayout = "2006-01-02T15:04:05.000Z"
@@ -93,29 +169,33 @@ func (a ApiV1) EntryByOid(w http.ResponseWriter, r *http.Request) {
 	oid := chi.URLParam(r, "oid")
 	ctx := r.Context()
 	log := slogctx.FromCtx(ctx)
+	units, ok := a.unitsParam(w, r)
+	if !ok {
+		return
+	}
 	entry, err := a.FetchEntryByOid(ctx, oid)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "not found", http.StatusNotFound)
+			a.httpError(w, "not found", http.StatusNotFound)
 			return
 		}
 		log.Warn("entryService.ByID failed", slog.Any("error", err))
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	responseEntry := &APIV1EntryResponse{
 		Oid:        entry.Oid,
 		Type:       entry.Type,
-		SgvMgdl:    entry.SgvMgdl,
 		Direction:  entry.Direction,
 		Device:     entry.Device,
 		Date:       entry.CreatedTime.UnixMilli(),
 		Mills:      entry.CreatedTime.UnixMilli(),
 		DateString: entry.CreatedTime.Format(rfc3339msLayout),
 		SysTime:    entry.CreatedTime.Format(rfc3339msLayout),
-		UtcOffset:  0,
+		UtcOffset:  entry.UtcOffset,
 	}
+	responseEntry.setSgv(entry.SgvMgdl, units)
 	render.JSON(w, r, responseEntry)
 }
 
@@ -125,10 +205,10 @@ func (a ApiV1) LatestEntry(w http.ResponseWriter, r *http.Request) {
 	entry, err := a.FetchLatestSgvEntry(ctx, time.Now())
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "not found", http.StatusNotFound)
+			a.httpError(w, "not found", http.StatusNotFound)
 			return
 		}
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
@@ -192,33 +272,31 @@ var entryTypeIDByName = map[string]entryTypeID{
 }
 
 // ListEntries returns zero or more entries matching any conditions in the query
-// Default is `count=10`, for only 10 latest entries, reverse sorted by date
+// Default is `count=20` (DEFAULT_COUNT), for only 20 latest entries, reverse sorted by date
 // /api/v1/entries?count=60&token=ffs-358de43470f328f3
 // /api/v1/entries?count=1 for FreeStyle LibreLink Up NightScout Uploader
 func (a ApiV1) ListEntries(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := slogctx.FromCtx(ctx)
 
-	count, err := strconv.Atoi(r.URL.Query().Get("count"))
-	if err != nil {
-		if r.URL.Query().Get("count") != "" {
-			http.Error(w, "count must be an integer", http.StatusBadRequest)
-			return
-		}
-		count = 20
-	}
-	if count < 1 {
-		http.Error(w, "count must be >= 1", http.StatusBadRequest)
+	count, ok := a.countParam(w, r)
+	if !ok {
 		return
 	}
-	if count > 50000 {
-		http.Error(w, "count must be <= 50000", http.StatusBadRequest)
+	find, ok, err := parseEntryFind(r.URL.Query(), time.Now())
+	if err != nil {
+		a.httpError(w, "invalid find query", http.StatusBadRequest)
 		return
 	}
-	entries, err := a.FetchLatestEntries(ctx, time.Now(), count)
+	var entries []models.Entry
+	if ok {
+		entries, err = a.FetchEntriesBetween(ctx, find.From, find.To, find.Type, count)
+	} else {
+		entries, err = a.FetchLatestEntries(ctx, time.Now(), count)
+	}
 	if err != nil {
 		log.Warn("entryService.ByID failed", slog.Any("error", err))
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
@@ -229,26 +307,24 @@ func (a ApiV1) ListSGVs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := slogctx.FromCtx(ctx)
 
-	count, err := strconv.Atoi(r.URL.Query().Get("count"))
-	if err != nil {
-		if r.URL.Query().Get("count") != "" {
-			http.Error(w, "count must be an integer", http.StatusBadRequest)
-			return
-		}
-		count = 20
-	}
-	if count < 1 {
-		http.Error(w, "count must be >= 1", http.StatusBadRequest)
+	count, ok := a.countParam(w, r)
+	if !ok {
 		return
 	}
-	if count > 50000 {
-		http.Error(w, "count must be <= 50000", http.StatusBadRequest)
+	find, ok, err := parseEntryFind(r.URL.Query(), time.Now())
+	if err != nil {
+		a.httpError(w, "invalid find query", http.StatusBadRequest)
 		return
 	}
-	entries, err := a.FetchLatestSGVs(ctx, time.Now(), count)
+	var entries []models.Entry
+	if ok {
+		entries, err = a.FetchEntriesBetween(ctx, find.From, find.To, "sgv", count)
+	} else {
+		entries, err = a.FetchLatestSGVs(ctx, time.Now(), count)
+	}
 	if err != nil {
 		log.Warn("entryService.ByID failed", slog.Any("error", err))
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
@@ -273,171 +349,190 @@ func (a ApiV1) CreateEntries(w http.ResponseWriter, r *http.Request) {
 
 	var requestEntries []APIV1EntryRequest
 	if err := render.DecodeJSON(r.Body, &requestEntries); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		a.httpError(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
 
+	// accepted is in request order: the stored entry for each, or nil until
+	// it is inserted
+	accepted := make([]*models.Entry, len(requestEntries))
 	var entries []models.Entry
-	for _, reqEntry := range requestEntries {
-		now := time.Now()
-		entryTime, err := parseTime(reqEntry.Date)
-		if err != nil || entryTime.IsZero() {
-			log.Info("invalid date format", slog.String("entryDate", reqEntry.Date))
-			http.Error(w, "invalid date format", http.StatusBadRequest)
+	var entryPositions []int
+	numExisting := 0
+	for i, reqEntry := range requestEntries {
+		entry, err := entryFromRequest(reqEntry, time.Now())
+		if err != nil {
+			log.Info("invalid entry", slog.Any("error", err), slog.String("entryDate", reqEntry.Date), slog.String("type", reqEntry.Type))
+			a.httpError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		_, ok := entryTypeIDByName[reqEntry.Type]
-		if !ok {
-			log.Info("unknown type", slog.String("type", reqEntry.Type))
-			http.Error(w, "invalid type", http.StatusBadRequest)
+		existing, err := a.existingEntry(ctx, entry)
+		if err != nil {
+			log.Warn("cannot check for existing entry", slog.Any("error", err))
+			a.httpError(w, "internal server error", http.StatusInternalServerError)
 			return
 		}
-
-		entries = append(entries, models.Entry{
-			Type:        reqEntry.Type,
-			SgvMgdl:     reqEntry.SgvMgdl,
-			Direction:   reqEntry.Direction,
-			Time:        entryTime,
-			Device:      reqEntry.Device,
-			CreatedTime: now,
-		})
+		if existing != nil {
+			accepted[i] = existing
+			numExisting++
+			continue
+		}
+		entries = append(entries, entry)
+		entryPositions = append(entryPositions, i)
 	}
-
-	insertedEntries := a.EntryRepository.CreateEntries(ctx, entries)
-
-	// NB while swagger.json says this should return the _rejected_ entries,
-	// cgm_remote_monitor returns the accepted entries
-	a.renderEntryList(w, r, insertedEntries)
-}
-
-type ImportNSRequest struct {
-	Url       string `json:"url"`
-	Token     string `json:"token"`
-	APISecret string `json:"api_secret"`
-}
-
-func (a ApiV1) ImportNightscoutEntries(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	log := slogctx.FromCtx(ctx)
-
-	// TODO look at https://grafana.com/blog/2024/02/09/how-i-write-http-services-in-go-after-13-years/#validating-data
-	// pattern for validation
-	var req ImportNSRequest
-	if err := render.DecodeJSON(r.Body, &req); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
-		return
+	a.deriveDirections(ctx, entries)
+
+	// inserted keeps the order of entries, less any the repository skipped
+	// as duplicates within the upload
+	inserted := a.EntryRepository.CreateEntries(ctx, entries)
+	next := 0
+	for i, e := range entries {
+		if next < len(inserted) && inserted[next].Time.Equal(e.Time) && inserted[next].Device == e.Device {
+			accepted[entryPositions[i]] = &inserted[next]
+			next++
+		}
 	}
-	if req.Url == "" {
-		log.Debug("missing url")
-		http.Error(w, "missing url", http.StatusBadRequest)
-		return
+	if numExisting > 0 {
+		log.Info("skipped entries already stored", slog.Int("numExisting", numExisting))
 	}
 
-	nsUrl, err := url.Parse(req.Url)
-	if err != nil {
-		// Pretty rare, Parse is very lax. ":" seems to work :)
-		log.Debug("bad url: parse fail", slog.String("url", req.Url))
-		http.Error(w, "bad url", http.StatusBadRequest)
-		return
-	}
-	if nsUrl.Scheme != "http" && nsUrl.Scheme != "https" {
-		log.Debug("bad url: unsupported scheme", slog.String("url", req.Url))
-		http.Error(w, "url must be http/https", http.StatusBadRequest)
-		return
-	}
-	if nsUrl.Host == "" {
-		log.Debug("bad url: no host", slog.String("url", req.Url))
-		http.Error(w, "url must include a hostname", http.StatusBadRequest)
-		return
+	// NB while swagger.json says this should return the _rejected_ entries,
+	// cgm_remote_monitor returns the accepted entries. Entries we already
+	// had count as accepted, so a retried upload sees the same response, in
+	// the same order.
+	response := make([]models.Entry, 0, len(accepted))
+	for _, e := range accepted {
+		if e != nil {
+			response = append(response, *e)
+		}
 	}
+	a.renderEntryList(w, r, response)
+}
 
-	if req.Token == "" && req.APISecret == "" {
-		log.Debug("missing credentials", slog.String("token", req.Token), slog.String("api_secret", req.APISecret))
-		http.Error(w, "token or api_secret must be supplied", http.StatusBadRequest)
-		return
+// entryFromRequest validates a posted entry. Errors are suitable for
+// returning to the client. An _id that is not an oid is ignored, as entries
+// stored with it could never be fetched or deleted.
+func entryFromRequest(reqEntry APIV1EntryRequest, now time.Time) (models.Entry, error) {
+	entryTime, err := parseTime(reqEntry.Date)
+	if err != nil || entryTime.IsZero() {
+		return models.Entry{}, errors.New("invalid date format")
 	}
-	if req.APISecret != "" && len(req.APISecret) < 12 {
-		log.Debug("credentials: api_secret too short", slog.String("api_secret", req.APISecret))
-		http.Error(w, "api_secret must be at least 12 characters long", http.StatusBadRequest)
-		return
+	if _, ok := entryTypeIDByName[reqEntry.Type]; !ok {
+		return models.Entry{}, errors.New("invalid type")
 	}
-
-	// name-<16 hexits>
-	if req.Token != "" && len(req.Token) < 17 {
-		log.Debug("credentials: token too short", slog.String("api_secret", req.APISecret))
-		http.Error(w, "token must be at least 17 characters long", http.StatusBadRequest)
-		return
+	oid := reqEntry.Oid
+	if !models.IsOid(oid) {
+		oid = ""
 	}
+	return models.Entry{
+		Oid:         oid,
+		Type:        reqEntry.Type,
+		SgvMgdl:     reqEntry.SgvMgdl,
+		Direction:   reqEntry.Direction,
+		Time:        entryTime,
+		Device:      reqEntry.Device,
+		CreatedTime: now,
+		UtcOffset:   reqEntry.UtcOffset,
+	}, nil
+}
 
-	u := &url.URL{Scheme: nsUrl.Scheme, Host: nsUrl.Host}
-
-	nsCfg := repository.NightscoutConfig{
-		URL:       u,
-		Token:     req.Token,
-		APISecret: req.APISecret,
+// deriveDirections sets the direction of sgvs uploaded without one, from the
+// slope to the previous reading: the previous sgv in the upload, or for the
+// earliest, the latest stored before it.
+func (a ApiV1) deriveDirections(ctx context.Context, entries []models.Entry) {
+	log := slogctx.FromCtx(ctx)
+	var sgvs []*models.Entry
+	for i := range entries {
+		if entries[i].Type == "sgv" {
+			sgvs = append(sgvs, &entries[i])
+		}
 	}
-
-	entries, err := a.FetchAllEntries(ctx, nsCfg)
-	if err != nil {
-		log.Info("cannot fetch entries from ns", slog.Any("err", err))
-		http.Error(w, "Cannot fetch entries from remote nightscout instance", http.StatusBadRequest)
-		return
+	slices.SortStableFunc(sgvs, func(a, b *models.Entry) int {
+		return a.Time.Compare(b.Time)
+	})
+
+	var prev *models.Entry
+	for i, e := range sgvs {
+		if i > 0 {
+			prev = sgvs[i-1]
+		}
+		if e.Direction != "" {
+			continue
+		}
+		if prev == nil {
+			stored, err := a.EntryRepository.FetchLatestSgvEntry(ctx, e.Time.Add(-time.Millisecond))
+			if err != nil {
+				if !errors.Is(err, models.ErrNotFound) {
+					log.Warn("cannot fetch previous sgv for direction", slog.Any("error", err))
+				}
+				continue
+			}
+			prev = stored
+		}
+		e.Direction = models.DirectionBetween(*prev, *e)
 	}
-	log.Debug("fetched entries from remote nightscout instance",
-		slog.Int("numEntries", len(entries)),
-		slog.Time("latestEntry", entries[0].Time),
-		slog.Time("earliestEntry", entries[len(entries)-1].Time),
-	)
+}
 
-	// We receive entries from ns in most-recent-first order. Pass them to
-	// CreateEntries in ascending date order for slight speedup
-	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
-		entries[i], entries[j] = entries[j], entries[i]
+// existingEntry returns the stored copy of a posted entry, or nil if it is
+// new. Uploaders retry on timeouts; like cgm_remote_monitor's upsert we match
+// on _id if supplied, otherwise on time, device and sgv.
+func (a ApiV1) existingEntry(ctx context.Context, entry models.Entry) (*models.Entry, error) {
+	if entry.Oid != "" {
+		existing, err := a.EntryRepository.FetchEntryByOid(ctx, entry.Oid)
+		if err == nil {
+			return existing, nil
+		}
+		if !errors.Is(err, models.ErrNotFound) {
+			return nil, err
+		}
 	}
-
-	insertedEntries := a.EntryRepository.CreateEntries(ctx, entries)
-	log.Info("imported entries from remote nightscout instance",
-		slog.Int("numEntries", len(insertedEntries)),
-		slog.Time("latestEntry", insertedEntries[0].Time),
-		slog.Time("earliestEntry", insertedEntries[len(insertedEntries)-1].Time),
-	)
-
-	w.WriteHeader(http.StatusOK)
+	existing, err := a.EntryRepository.FetchMatchingEntry(ctx, entry)
+	if errors.Is(err, models.ErrNotFound) {
+		return nil, nil
+	}
+	return existing, err
 }
 
+// renderEntryList streams entries as they are encoded rather than building
+// the whole response first: lists can be up to 50k entries long.
 func (a ApiV1) renderEntryList(w http.ResponseWriter, r *http.Request, entries []models.Entry) {
 	urlFormat := a.urlFormat(r)
-
-	if urlFormat == "json" {
-
-		var response []APIV1EntryResponse
-		for _, entry := range entries {
-			response = append(response, APIV1EntryResponse{
-				Oid:        entry.Oid,
-				Type:       entry.Type,
-				SgvMgdl:    entry.SgvMgdl,
-				Direction:  entry.Direction,
-				Device:     entry.Device,
-				Date:       entry.Time.UnixMilli(),
-				Mills:      entry.Time.UnixMilli(),
-				DateString: entry.Time.Format(rfc3339msLayout),
-				SysTime:    entry.Time.Format(rfc3339msLayout),
-				UtcOffset:  0,
-			})
-		}
-
-		render.JSON(w, r, response)
+	if urlFormat != "" && urlFormat != "json" {
+		a.httpError(w, "unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+	units, ok := a.unitsParam(w, r)
+	if !ok {
 		return
 	}
 
-	if urlFormat != "" {
-		http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	if urlFormat == "json" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc := json.NewEncoder(bw)
+		_, _ = bw.WriteString("[")
+		for i, entry := range entries {
+			if i > 0 {
+				_, _ = bw.WriteString(",")
+			}
+			err := enc.Encode(entryResponse(entry, units))
+			if err != nil {
+				slogctx.FromCtx(r.Context()).Warn("cannot encode entry", slog.Any("error", err))
+				return
+			}
+		}
+		_, _ = bw.WriteString("]\n")
 		return
 	}
 
-	var responseEntries []string
-	for _, entry := range entries {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for i, entry := range entries {
+		if i > 0 {
+			_, _ = bw.WriteString("\r\n")
+		}
 		direction := ""
 		if entry.Direction != "" {
 			direction = fmt.Sprintf(`"%s"`, entry.Direction)
@@ -445,36 +540,177 @@ func (a ApiV1) renderEntryList(w http.ResponseWriter, r *http.Request, entries [
 		parts := []string{
 			fmt.Sprintf(`"%s"`, entry.Time.Format(rfc3339msLayout)),
 			strconv.FormatInt(entry.Time.UnixMilli(), 10),
-			strconv.Itoa(entry.SgvMgdl),
+			formatGlucose(entry.SgvMgdl, units),
 			direction,
 			fmt.Sprintf(`"%s"`, entry.Device),
 		}
-		responseEntries = append(responseEntries, strings.Join(parts, "\t"))
+		_, _ = bw.WriteString(strings.Join(parts, "\t"))
 	}
-
-	render.PlainText(w, r, strings.Join(responseEntries, "\r\n"))
 }
 
 func (a ApiV1) renderTreatmentList(w http.ResponseWriter, r *http.Request, treatments []models.Treatment) {
 	// treatments are always json, there are too many distinct fields for tsv
+	units, ok := a.unitsParam(w, r)
+	if !ok {
+		return
+	}
 
 	response := make([]map[string]interface{}, 0)
 	for _, treatment := range treatments {
-		tTime := treatment.Time
-		var treatmentData = map[string]interface{}{
-			"_id":        treatment.ID,
-			"eventType":  treatment.Type,
-			"mills":      tTime.UnixMilli(),
-			"created_at": tTime.Format(rfc3339msLayout),
+		response = append(response, treatmentResponse(treatment, units, a.Settings.Load().Units))
+	}
+
+	render.JSON(w, r, response)
+}
+
+// entryResponse returns entry for clients, with the sgv in units
+func entryResponse(entry models.Entry, units string) APIV1EntryResponse {
+	response := APIV1EntryResponse{
+		Oid:        entry.Oid,
+		Type:       entry.Type,
+		Direction:  entry.Direction,
+		Device:     entry.Device,
+		Date:       entry.Time.UnixMilli(),
+		Mills:      entry.Time.UnixMilli(),
+		DateString: entry.Time.Format(rfc3339msLayout),
+		SysTime:    entry.Time.Format(rfc3339msLayout),
+		UtcOffset:  entry.UtcOffset,
+	}
+	response.setSgv(entry.SgvMgdl, units)
+	return response
+}
+
+func (e *APIV1EntryResponse) setSgv(mgdl int, units string) {
+	e.Sgv = float64(mgdl)
+	if units == models.UnitsMmol {
+		e.Sgv = models.MgdlToMmol(mgdl)
+		e.Units = units
+	}
+}
+
+// formatGlucose formats a glucose value in units, eg 7.2 for mmol/L
+func formatGlucose(mgdl int, units string) string {
+	if units == models.UnitsMmol {
+		return strconv.FormatFloat(models.MgdlToMmol(mgdl), 'f', 1, 64)
+	}
+	return strconv.Itoa(mgdl)
+}
+
+// treatmentResponse returns treatment for clients. Unless units is empty,
+// any glucose reading is converted to units; readings without units are taken
+// to be in defaultUnits, as nightscout does.
+func treatmentResponse(treatment models.Treatment, units string, defaultUnits string) map[string]interface{} {
+	tTime := treatment.Time
+	var treatmentData = map[string]interface{}{
+		"_id":        treatment.ID,
+		"eventType":  treatment.Type,
+		"mills":      tTime.UnixMilli(),
+		"created_at": tTime.Format(rfc3339msLayout),
+	}
+	for k, v := range treatment.Fields {
+		treatmentData[k] = v
+	}
+	if glucose, ok := treatmentData["glucose"]; ok && units != "" {
+		from, _ := treatmentData["units"].(string)
+		if from == "" {
+			from = defaultUnits
 		}
-		for k, v := range treatment.Fields {
-			treatmentData[k] = v
+		if converted, ok := convertGlucose(glucose, from, units); ok {
+			treatmentData["glucose"] = converted
+			treatmentData["units"] = units
 		}
+	}
+	return treatmentData
+}
+
+// convertGlucose converts a treatment's glucose value, a number or numeric
+// string, between units
+func convertGlucose(glucose interface{}, from string, to string) (float64, bool) {
+	var value float64
+	switch v := glucose.(type) {
+	case float64:
+		value = v
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, false
+		}
+		value = parsed
+	default:
+		return 0, false
+	}
+	from, ok := parseUnits(from)
+	if !ok {
+		return 0, false
+	}
+	switch {
+	case from == to:
+		return value, true
+	case to == models.UnitsMmol:
+		return models.MgdlToMmol(int(math.Round(value))), true
+	default:
+		return float64(models.MmolToMgdl(value)), true
+	}
+}
 
-		response = append(response, treatmentData)
+// parseUnits returns the units named by s, eg mmol/L, or false if it names
+// none
+func parseUnits(s string) (string, bool) {
+	switch strings.ToLower(s) {
+	case "mg/dl", "mgdl":
+		return models.UnitsMgdl, true
+	case "mmol", "mmol/l":
+		return models.UnitsMmol, true
+	default:
+		return "", false
 	}
+}
 
-	render.JSON(w, r, response)
+// unitsParam returns the units query parameter, or the units the api
+// defaults to. Empty units leave glucose as stored: sgvs in mg/dL and
+// treatments in whatever units they were given in. If the parameter is
+// invalid it replies with an error and returns false.
+func (a ApiV1) unitsParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	raw := r.URL.Query().Get("units")
+	if raw == "" {
+		return a.APIUnits, true
+	}
+	units, ok := parseUnits(raw)
+	if !ok {
+		a.httpError(w, "units must be mg/dl or mmol", http.StatusBadRequest)
+		return "", false
+	}
+	return units, true
+}
+
+// httpError replies with a plaintext error, in the configured language
+func (a ApiV1) httpError(w http.ResponseWriter, msg string, code int) {
+	http.Error(w, i18n.New(a.Settings.Load().Language).T(msg), code)
+}
+
+// countParam returns the count query parameter, or the default count. If it
+// is invalid it replies with an error and returns false.
+func (a ApiV1) countParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	limits := a.CountLimits.withDefaults()
+	raw := r.URL.Query().Get("count")
+	if raw == "" {
+		return limits.Default, true
+	}
+	count, err := strconv.Atoi(raw)
+	if err != nil {
+		a.httpError(w, "count must be an integer", http.StatusBadRequest)
+		return 0, false
+	}
+	if count < 1 {
+		a.httpError(w, "count must be >= 1", http.StatusBadRequest)
+		return 0, false
+	}
+	if count > limits.Max {
+		msg := fmt.Sprintf(i18n.New(a.Settings.Load().Language).T("count must be <= %d"), limits.Max)
+		http.Error(w, msg, http.StatusBadRequest)
+		return 0, false
+	}
+	return count, true
 }
 
 func (a ApiV1) StatusCheck(w http.ResponseWriter, r *http.Request) {
@@ -487,33 +723,48 @@ func (a ApiV1) ListTreatments(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := slogctx.FromCtx(ctx)
 
-	count, err := strconv.Atoi(r.URL.Query().Get("count"))
-	if err != nil {
-		if r.URL.Query().Get("count") != "" {
-			http.Error(w, "count must be an integer", http.StatusBadRequest)
-			return
-		}
-		count = 20
-	}
-	if count < 1 {
-		http.Error(w, "count must be >= 1", http.StatusBadRequest)
+	count, ok := a.countParam(w, r)
+	if !ok {
 		return
 	}
-	if count > 50000 {
-		http.Error(w, "count must be <= 50000", http.StatusBadRequest)
+
+	find, ok, err := parseTreatmentFind(r.URL.Query())
+	if err != nil {
+		a.httpError(w, "invalid find query", http.StatusBadRequest)
 		return
 	}
-
-	treatments, err := a.FetchLatestTreatments(ctx, time.Now(), count)
+	var treatments []models.Treatment
+	if ok {
+		treatments, err = a.findTreatments(ctx, find, count)
+	} else {
+		treatments, err = a.FetchLatestTreatments(ctx, time.Now(), count)
+	}
 	if err != nil {
-		log.Warn("FetchLatestTreatments failed", slog.Any("error", err))
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		log.Warn("cannot fetch treatments", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	a.renderTreatmentList(w, r, treatments)
 }
 
+// findTreatments returns up to count treatments matching find, most recent
+// first. Unlike unfiltered lists, future treatments are included unless find
+// gives an upper bound.
+func (a ApiV1) findTreatments(ctx context.Context, find treatmentFind, count int) ([]models.Treatment, error) {
+	treatments, err := a.FetchTreatmentsAfter(ctx, find.From.Add(-time.Nanosecond))
+	if err != nil {
+		return nil, err
+	}
+	var found []models.Treatment
+	for i := len(treatments) - 1; i >= 0 && len(found) < count; i-- {
+		if find.Matches(treatments[i]) {
+			found = append(found, treatments[i])
+		}
+	}
+	return found, nil
+}
+
 // api can be either json or x-www-urlencoded. ns web ui uses form,
 // shuggah/xdrip uses json
 
@@ -549,6 +800,7 @@ type APIV1TreatmentRequest struct {
 func (a ApiV1) CreateTreatments(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := slogctx.FromCtx(ctx)
+	settings := a.Settings.Load()
 
 	body, _ := io.ReadAll(r.Body)
 	defer r.Body.Close()
@@ -557,21 +809,21 @@ func (a ApiV1) CreateTreatments(w http.ResponseWriter, r *http.Request) {
 	err := json.Unmarshal(body, &whatevs)
 	if err != nil {
 		log.Info("cannot unmarshal request body", slog.Any("err", err))
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		a.httpError(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
 
 	var treatments []models.Treatment
 	for _, reqTreatment := range whatevs {
 
-		treatment, err := treatmentFromJSON(ctx, reqTreatment)
+		treatment, err := treatmentFromJSON(ctx, settings.TreatmentTypes, reqTreatment)
 		if err != nil {
 			if errors.Is(err, ErrInvalidTimeString) {
 				log.Info("cannot parse treatment eventTime",
 					slog.Any("eventTime", reqTreatment["eventTime"]),
 					slog.Any("fields", reqTreatment),
 				)
-				http.Error(w, "unparseable treatment eventTime", http.StatusBadRequest)
+				a.httpError(w, "unparseable treatment eventTime", http.StatusBadRequest)
 				return
 			}
 
@@ -580,7 +832,7 @@ func (a ApiV1) CreateTreatments(w http.ResponseWriter, r *http.Request) {
 					slog.Any("entryType", reqTreatment["eventType"]),
 					slog.Any("fields", reqTreatment),
 				)
-				http.Error(w, "unknown treatment type", http.StatusBadRequest)
+				a.httpError(w, "unknown treatment type", http.StatusBadRequest)
 				return
 			}
 
@@ -589,21 +841,117 @@ func (a ApiV1) CreateTreatments(w http.ResponseWriter, r *http.Request) {
 				slog.Any("err", err),
 				slog.Any("fields", reqTreatment),
 			)
-			http.Error(w, "invalid treatment type", http.StatusBadRequest)
+			a.httpError(w, "invalid treatment type", http.StatusBadRequest)
 			return
 		}
+		err = a.checkProfileSwitch(ctx, *treatment)
+		if err != nil {
+			if errors.Is(err, models.ErrUnknownProfile) {
+				log.Info("profile switch to unknown profile", slog.Any("profile", reqTreatment["profile"]))
+				a.httpError(w, "unknown profile", http.StatusBadRequest)
+				return
+			}
+			log.Warn("cannot check profile switch", slog.Any("error", err))
+			a.httpError(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		setDefaultEnteredBy(ctx, treatment)
+		preBolus := treatment.SplitPreBolus()
 		treatments = append(treatments, *treatment)
+		if preBolus != nil {
+			treatments = append(treatments, *preBolus)
+		}
 	}
 	log.Info("parsed treatments ok", slog.Any("treatments", treatments))
 
 	insertedTreatments := a.TreatmentRepository.CreateTreatments(ctx, treatments)
+	if settings.BGCheckMbg {
+		a.createBGCheckEntries(ctx, settings.Units, insertedTreatments)
+	}
+	a.notifyAnnouncements(ctx, insertedTreatments)
 
 	// NB while swagger.json says this should return the _rejected_ entries,
 	// cgm_remote_monitor returns the accepted entries
 	a.renderTreatmentList(w, r, insertedTreatments)
 }
 
-func treatmentFromJSON(ctx context.Context, request map[string]interface{}) (*models.Treatment, error) {
+// checkProfileSwitch returns models.ErrUnknownProfile if t switches to a
+// profile that is not in the store of the profile in effect then (or the
+// earliest, for a switch before any profile started). Switches carrying the
+// profile as profileJson, as AAPS sends, need no stored profile.
+func (a ApiV1) checkProfileSwitch(ctx context.Context, t models.Treatment) error {
+	if t.Type != models.ProfileSwitchType || t.Fields["profileJson"] != nil || a.ProfileRepository == nil {
+		return nil
+	}
+	profiles, err := a.fetchProfiles(ctx)
+	if err != nil {
+		return err
+	}
+	if len(profiles) == 0 {
+		return models.ErrUnknownProfile
+	}
+	profile := models.ActiveProfile(profiles, t.Time)
+	if profile == nil {
+		profile = &profiles[0]
+	}
+	name, _ := t.Fields["profile"].(string)
+	if !profile.HasProfile(name) {
+		return models.ErrUnknownProfile
+	}
+	return nil
+}
+
+// notifyAnnouncements sends a notification for each announcement treatment,
+// so announcements from eg xDrip reach followers
+func (a ApiV1) notifyAnnouncements(ctx context.Context, treatments []models.Treatment) {
+	if a.Notifier == nil {
+		return
+	}
+	for _, t := range treatments {
+		if n, ok := t.Announcement(); ok {
+			slogctx.FromCtx(ctx).Info("announcement", slog.String("message", n.Message))
+			a.Notifier.Notify(ctx, n)
+		}
+	}
+}
+
+// createBGCheckEntries stores an mbg entry for each BG Check with a meter
+// glucose, so finger-sticks show on the glucose chart. Sensor BG Checks
+// would only repeat the sgvs. The treatments are already stored, so
+// failures are logged rather than returned; retries are skipped as
+// existing entries.
+func (a ApiV1) createBGCheckEntries(ctx context.Context, units string, treatments []models.Treatment) {
+	log := slogctx.FromCtx(ctx)
+	var entries []models.Entry
+	for _, t := range treatments {
+		if t.Type != models.BGCheckType || t.Fields["glucoseType"] == "Sensor" {
+			continue
+		}
+		mgdl, ok := t.GlucoseMgdl(units)
+		if !ok {
+			continue
+		}
+		device, _ := t.Fields["enteredBy"].(string)
+		if device == "" {
+			device = "careportal"
+		}
+		entry := models.Entry{Type: "mbg", SgvMgdl: mgdl, Device: device, Time: t.Time, CreatedTime: time.Now()}
+		existing, err := a.existingEntry(ctx, entry)
+		if err != nil {
+			log.Warn("cannot check for existing mbg entry", slog.Any("error", err))
+			return
+		}
+		if existing == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) > 0 {
+		inserted := a.EntryRepository.CreateEntries(ctx, entries)
+		log.Info("created mbg entries from BG Checks", slog.Int("numEntries", len(inserted)))
+	}
+}
+
+func treatmentFromJSON(ctx context.Context, types models.TreatmentTypes, request map[string]interface{}) (*models.Treatment, error) {
 	eventType, ok := request["eventType"].(string)
 	if !ok {
 		return nil, errors.New("missing eventType")
@@ -631,8 +979,9 @@ func treatmentFromJSON(ctx context.Context, request map[string]interface{}) (*mo
 		Type:   eventType,
 		Fields: map[string]interface{}{},
 	}
+	// an _id that is not an oid is ignored, as for entries
 	existingID, ok := request["_id"].(string)
-	if ok && existingID != "" {
+	if ok && models.IsOid(existingID) {
 		t.ID = existingID
 	}
 
@@ -644,7 +993,7 @@ func treatmentFromJSON(ctx context.Context, request map[string]interface{}) (*mo
 	delete(t.Fields, "eventType")
 	delete(t.Fields, "created_at")
 
-	err = t.Valid(ctx)
+	err = types.Validate(ctx, t)
 	if err != nil {
 		return nil, err
 	}
@@ -708,17 +1057,68 @@ func (a ApiV1) TreatmentByOid(w http.ResponseWriter, r *http.Request) {
 	treatment, err := a.FetchTreatmentByOid(ctx, oid)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "not found", http.StatusNotFound)
+			a.httpError(w, "not found", http.StatusNotFound)
 			return
 		}
 		log.Warn("treatmentService.ByID failed", slog.Any("error", err))
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	a.renderTreatmentList(w, r, []models.Treatment{*treatment})
 }
 
+// APIV1DeleteResponse is how many documents a bulk delete removed, shaped
+// like the mongo result cgm-remote-monitor returns
+type APIV1DeleteResponse struct {
+	N  int `json:"n"`
+	OK int `json:"ok"`
+}
+
+// DeleteTreatments handler supports DELETE /api/v1/treatments?find[...],
+// removing every treatment the find query matches, eg a day's bad
+// careportal entries. A query without find[] is refused rather than
+// deleting everything.
+func (a ApiV1) DeleteTreatments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	find, ok, err := parseTreatmentFind(r.URL.Query())
+	if err != nil {
+		a.httpError(w, "invalid find query", http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		a.httpError(w, "find query required", http.StatusBadRequest)
+		return
+	}
+
+	treatments, err := a.FetchTreatmentsAfter(ctx, find.From.Add(-time.Nanosecond))
+	if err != nil {
+		log.Warn("cannot fetch treatments to delete", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	deleted := 0
+	for _, t := range treatments {
+		if !find.Matches(t) {
+			continue
+		}
+		err = a.DeleteTreatmentByOid(ctx, t.ID)
+		if errors.Is(err, models.ErrNotFound) {
+			continue // deleted meanwhile
+		}
+		if err != nil {
+			log.Warn("cannot delete treatment", slog.String("oid", t.ID), slog.Any("error", err))
+			a.httpError(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		deleted++
+	}
+	log.Info("deleted treatments", slog.Int("numTreatments", deleted))
+	render.JSON(w, r, APIV1DeleteResponse{N: deleted, OK: 1})
+}
+
 func (a ApiV1) DeleteTreatment(w http.ResponseWriter, r *http.Request) {
 	oid := chi.URLParam(r, "oid")
 	ctx := r.Context()
@@ -732,16 +1132,19 @@ func (a ApiV1) DeleteTreatment(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		log.Warn("cannot delete treatment", slog.Any("error", err))
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// PutTreatment handler replaces a treatment, identified by the _id in the
+// body or, for PUT /api/v1/treatments/{oid}, by the path
 func (a ApiV1) PutTreatment(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	log := slogctx.FromCtx(ctx)
+	settings := a.Settings.Load()
 
 	body, _ := io.ReadAll(r.Body)
 	defer r.Body.Close()
@@ -750,18 +1153,18 @@ func (a ApiV1) PutTreatment(w http.ResponseWriter, r *http.Request) {
 	err := json.Unmarshal(body, &reqTreatment)
 	if err != nil {
 		log.Info("cannot unmarshal request body - invalid json?", slog.Any("err", err))
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+		a.httpError(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	treatment, err := treatmentFromJSON(ctx, reqTreatment)
+	treatment, err := treatmentFromJSON(ctx, settings.TreatmentTypes, reqTreatment)
 	if err != nil {
 		if errors.Is(err, ErrInvalidTimeString) {
 			log.Info("cannot parse treatment eventTime",
 				slog.Any("eventTime", reqTreatment["eventTime"]),
 				slog.Any("fields", reqTreatment),
 			)
-			http.Error(w, "unparseable treatment eventTime", http.StatusBadRequest)
+			a.httpError(w, "unparseable treatment eventTime", http.StatusBadRequest)
 			return
 		}
 
@@ -770,7 +1173,7 @@ func (a ApiV1) PutTreatment(w http.ResponseWriter, r *http.Request) {
 				slog.Any("entryType", reqTreatment["eventType"]),
 				slog.Any("fields", reqTreatment),
 			)
-			http.Error(w, "unknown treatment type", http.StatusBadRequest)
+			a.httpError(w, "unknown treatment type", http.StatusBadRequest)
 			return
 		}
 
@@ -779,7 +1182,30 @@ func (a ApiV1) PutTreatment(w http.ResponseWriter, r *http.Request) {
 			slog.Any("err", err),
 			slog.Any("fields", reqTreatment),
 		)
-		http.Error(w, "invalid treatment type", http.StatusBadRequest)
+		a.httpError(w, "invalid treatment type", http.StatusBadRequest)
+		return
+	}
+
+	// PUT /treatments/{oid} (as Shuggah sends) names the treatment in the
+	// path. A body _id, if any, must agree.
+	if oid := chi.URLParam(r, "oid"); oid != "" {
+		if bodyID, ok := reqTreatment["_id"].(string); ok && bodyID != oid {
+			log.Info("treatment _id does not match path", slog.String("oid", oid), slog.String("_id", bodyID))
+			a.httpError(w, "_id does not match path", http.StatusBadRequest)
+			return
+		}
+		treatment.ID = oid
+	}
+
+	err = a.checkProfileSwitch(ctx, *treatment)
+	if err != nil {
+		if errors.Is(err, models.ErrUnknownProfile) {
+			log.Info("profile switch to unknown profile", slog.Any("profile", reqTreatment["profile"]))
+			a.httpError(w, "unknown profile", http.StatusBadRequest)
+			return
+		}
+		log.Warn("cannot check profile switch", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
@@ -787,11 +1213,11 @@ func (a ApiV1) PutTreatment(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "not found", http.StatusNotFound)
+			a.httpError(w, "not found", http.StatusNotFound)
 			return
 		}
 		log.Warn("cannot update treatment", slog.Any("error", err))
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/render"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type CGMRepository interface {
+	CGMConnections(ctx context.Context) []models.CGMConnection
+}
+
+type PurgeRepository interface {
+	Purge(ctx context.Context, from, to time.Time, device string) (models.PurgeResult, error)
+}
+
+type SyncRepository interface {
+	SyncAll(ctx context.Context) error
+	ReloadPeriod(ctx context.Context, period models.Period) (models.ReloadResult, error)
+}
+
+type APIV1CGMConnectionResponse struct {
+	PatientID string `json:"patientId"`
+	Name      string `json:"name"`
+	Selected  bool   `json:"selected"`
+}
+
+// ListCGMConnections lists the patients the cgm account can follow, so
+// accounts following several patients can choose one. The list is as of the
+// last cgm login, so may be empty shortly after startup.
+func (a ApiV1) ListCGMConnections(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	connections := a.CGMConnections(ctx)
+	response := make([]APIV1CGMConnectionResponse, len(connections))
+	for i, c := range connections {
+		response[i] = APIV1CGMConnectionResponse{
+			PatientID: c.PatientID,
+			Name:      c.Name,
+			Selected:  c.Selected,
+		}
+	}
+	render.JSON(w, r, response)
+}
+
+type APIV1PurgeRequest struct {
+	From   string `json:"from"` // rfc3339, inclusive. Empty for the beginning of time
+	To     string `json:"to"`   // rfc3339, exclusive. Empty for the end of time
+	Device string `json:"device"`
+}
+
+type APIV1PurgeResponse struct {
+	Entries    int `json:"entries"`
+	Treatments int `json:"treatments"`
+	Files      int `json:"files"`
+}
+
+// PurgeData permanently removes entries and treatments between from and to.
+// If device is given only that device's entries are removed, eg to clean up
+// after a misbehaving uploader.
+func (a ApiV1) PurgeData(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	var req APIV1PurgeRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		a.httpError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.From == "" && req.To == "" && req.Device == "" {
+		a.httpError(w, "from, to or device must be supplied", http.StatusBadRequest)
+		return
+	}
+
+	var from time.Time
+	to := time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+	var err error
+	if req.From != "" {
+		from, err = parseTime(req.From)
+		if err != nil {
+			a.httpError(w, "invalid date format", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.To != "" {
+		to, err = parseTime(req.To)
+		if err != nil {
+			a.httpError(w, "invalid date format", http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		a.httpError(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	result, err := a.PurgeRepository.Purge(ctx, from, to, req.Device)
+	if err != nil {
+		log.Warn("purge failed", slog.Any("error", err), slog.Any("partialResult", result))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("purged data",
+		slog.Time("from", from),
+		slog.Time("to", to),
+		slog.String("device", req.Device),
+		slog.Int("numEntries", result.Entries),
+		slog.Int("numTreatments", result.Treatments),
+		slog.Int("numFiles", result.Files),
+	)
+	render.JSON(w, r, APIV1PurgeResponse{
+		Entries:    result.Entries,
+		Treatments: result.Treatments,
+		Files:      result.Files,
+	})
+}
+
+// SyncData rewrites the current day, month and year files from memory, eg
+// before planned maintenance or after fixing bucket credentials. Uploads that
+// fail are retried in the background.
+func (a ApiV1) SyncData(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	if a.SyncRepository == nil {
+		a.httpError(w, "not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	err := a.SyncRepository.SyncAll(ctx)
+	if err != nil {
+		log.Warn("sync failed", slog.Any("error", err))
+		a.httpError(w, "sync failed, will retry", http.StatusServiceUnavailable)
+		return
+	}
+	log.Info("synced data")
+	render.JSON(w, r, map[string]string{"status": "ok"})
+}
+
+type APIV1ReloadResponse struct {
+	Entries    int `json:"entries"`
+	Treatments int `json:"treatments"`
+}
+
+// ReloadData replaces a day, month or year held in memory with the contents
+// of its bucket file, eg after the file has been edited by hand.
+func (a ApiV1) ReloadData(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	period, err := models.ParsePeriod(r.URL.Query().Get("period"))
+	if err != nil {
+		a.httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if a.SyncRepository == nil {
+		a.httpError(w, "not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	result, err := a.SyncRepository.ReloadPeriod(ctx, period)
+	if errors.Is(err, models.ErrNotFound) {
+		a.httpError(w, "no file for period", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Warn("reload failed", slog.String("period", period.Name), slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("reloaded data",
+		slog.String("period", period.Name),
+		slog.Int("numEntries", result.Entries),
+		slog.Int("numTreatments", result.Treatments),
+	)
+	render.JSON(w, r, APIV1ReloadResponse{
+		Entries:    result.Entries,
+		Treatments: result.Treatments,
+	})
+}
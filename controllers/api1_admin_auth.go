@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type AuthSubjectRepository interface {
+	FetchAuthSubjects(ctx context.Context) ([]models.AuthSubject, error)
+	CreateAuthSubject(ctx context.Context, subject models.AuthSubject) (*models.AuthSubject, string, error)
+	DeleteAuthSubject(ctx context.Context, oid string) error
+	RevokeAuthSubject(ctx context.Context, oid string) (*models.AuthSubject, error)
+}
+
+type APIV1AuthSubjectRequest struct {
+	Name      string   `json:"name"`
+	RoleNames []string `json:"roles"`
+	Notes     string   `json:"notes"`
+	ExpiresAt string   `json:"expires_at"` // rfc3339, optional
+}
+
+type APIV1AuthSubjectResponse struct {
+	Oid         string   `json:"_id"`
+	Name        string   `json:"name"`
+	RoleNames   []string `json:"roles"`
+	Notes       string   `json:"notes"`
+	CreatedAt   string   `json:"created_at"`
+	ExpiresAt   string   `json:"expires_at,omitempty"`
+	RevokedAt   string   `json:"revoked_at,omitempty"`
+	ShareLink   bool     `json:"shareLink,omitempty"`
+	AccessToken string   `json:"accessToken,omitempty"` // only when created
+}
+
+func authSubjectResponse(s models.AuthSubject) APIV1AuthSubjectResponse {
+	roleNames := s.RoleNames
+	if roleNames == nil {
+		roleNames = []string{}
+	}
+	response := APIV1AuthSubjectResponse{
+		Oid:       s.Oid,
+		Name:      s.Name,
+		RoleNames: roleNames,
+		Notes:     s.Notes,
+		CreatedAt: s.CreatedTime.UTC().Format(time.RFC3339),
+		ShareLink: s.ShareLink,
+	}
+	if !s.ExpiryTime.IsZero() {
+		response.ExpiresAt = s.ExpiryTime.UTC().Format(time.RFC3339)
+	}
+	if !s.RevokedTime.IsZero() {
+		response.RevokedAt = s.RevokedTime.UTC().Format(time.RFC3339)
+	}
+	return response
+}
+
+// ListAuthSubjects lists the subjects tokens have been created for. Tokens
+// themselves are only shown when created.
+func (a ApiV1) ListAuthSubjects(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	subjects, err := a.AuthSubjectRepository.FetchAuthSubjects(ctx)
+	if err != nil {
+		log.Warn("cannot fetch auth subjects", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	response := make([]APIV1AuthSubjectResponse, len(subjects))
+	for i, s := range subjects {
+		response[i] = authSubjectResponse(s)
+	}
+	render.JSON(w, r, response)
+}
+
+// CreateAuthSubject creates a subject with the given roles, responding with
+// its name-hash access token. The token cannot be retrieved again: if it is
+// lost, delete the subject and create another.
+func (a ApiV1) CreateAuthSubject(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	var req APIV1AuthSubjectRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		a.httpError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		a.httpError(w, "name must be supplied", http.StatusBadRequest)
+		return
+	}
+
+	var expiryTime time.Time
+	if req.ExpiresAt != "" {
+		var err error
+		expiryTime, err = time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil || !expiryTime.After(time.Now()) {
+			a.httpError(w, "expires_at must be a future rfc3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	subject, token, err := a.AuthSubjectRepository.CreateAuthSubject(ctx, models.AuthSubject{
+		Name:       req.Name,
+		RoleNames:  req.RoleNames,
+		Notes:      req.Notes,
+		ExpiryTime: expiryTime,
+	})
+	if err != nil {
+		log.Warn("cannot create auth subject", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("created auth subject",
+		slog.String("oid", subject.Oid),
+		slog.String("name", subject.Name),
+		slog.Any("roles", subject.RoleNames),
+	)
+	response := authSubjectResponse(*subject)
+	response.AccessToken = token
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, response)
+}
+
+// DeleteAuthSubject deletes a subject, revoking its token
+func (a ApiV1) DeleteAuthSubject(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	oid := chi.URLParam(r, "oid")
+	err := a.AuthSubjectRepository.DeleteAuthSubject(ctx, oid)
+	if errors.Is(err, models.ErrNotFound) {
+		a.httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Warn("cannot delete auth subject", slog.String("oid", oid), slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("deleted auth subject", slog.String("oid", oid))
+	render.JSON(w, r, map[string]string{"status": "ok"})
+}
+
+// RevokeAuthSubject revokes a subject's token, eg for a lost phone, keeping the
+// subject so it is clear what the token was for
+func (a ApiV1) RevokeAuthSubject(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	oid := chi.URLParam(r, "oid")
+	subject, err := a.AuthSubjectRepository.RevokeAuthSubject(ctx, oid)
+	if errors.Is(err, models.ErrNotFound) {
+		a.httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Warn("cannot revoke auth subject", slog.String("oid", oid), slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("revoked auth subject", slog.String("oid", oid), slog.String("name", subject.Name))
+	render.JSON(w, r, authSubjectResponse(*subject))
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAuthSubjectRepository struct {
+	subjects []models.AuthSubject
+}
+
+func (m *mockAuthSubjectRepository) FetchAuthSubjects(ctx context.Context) ([]models.AuthSubject, error) {
+	return m.subjects, nil
+}
+
+func (m *mockAuthSubjectRepository) CreateAuthSubject(ctx context.Context, subject models.AuthSubject) (*models.AuthSubject, string, error) {
+	subject.Oid = "67261314d689f977f773bc19"
+	subject.CreatedTime = time.Date(2024, 11, 28, 10, 0, 0, 0, time.UTC)
+	m.subjects = append(m.subjects, subject)
+	return &subject, "menubar-358de43470f328f3", nil
+}
+
+func (m *mockAuthSubjectRepository) DeleteAuthSubject(ctx context.Context, oid string) error {
+	for i, s := range m.subjects {
+		if s.Oid == oid {
+			m.subjects = append(m.subjects[:i], m.subjects[i+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+func (m *mockAuthSubjectRepository) RevokeAuthSubject(ctx context.Context, oid string) (*models.AuthSubject, error) {
+	for i, s := range m.subjects {
+		if s.Oid == oid {
+			m.subjects[i].RevokedTime = time.Date(2024, 11, 28, 11, 0, 0, 0, time.UTC)
+			return &m.subjects[i], nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+func TestApiV1_AuthSubjects(t *testing.T) {
+	repo := &mockAuthSubjectRepository{}
+	api := ApiV1{AuthSubjectRepository: repo}
+
+	r := setupTestRouter(api.CreateAuthSubject, "POST", "/admin/subjects")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/subjects", strings.NewReader(`{"name":"menubar","roles":["readable"]}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.JSONEq(t, `{"_id":"67261314d689f977f773bc19","name":"menubar","roles":["readable"],"notes":"","created_at":"2024-11-28T10:00:00Z","accessToken":"menubar-358de43470f328f3"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/subjects", strings.NewReader(`{"roles":["readable"]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r = setupTestRouter(api.ListAuthSubjects, "GET", "/admin/subjects")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/admin/subjects", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var subjects []APIV1AuthSubjectResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&subjects))
+	assert.Len(t, subjects, 1)
+	assert.Empty(t, subjects[0].AccessToken, "tokens are only shown when created")
+
+	w = httptest.NewRecorder()
+	r = setupTestRouter(api.CreateAuthSubject, "POST", "/admin/subjects")
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/subjects", strings.NewReader(`{"name":"old","expires_at":"2024-01-01T00:00:00Z"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "expiry must be in the future")
+
+	r = setupTestRouter(api.RevokeAuthSubject, "POST", "/admin/subjects/{oid}/revoke")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/subjects/67261314d689f977f773bc19/revoke", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"_id":"67261314d689f977f773bc19","name":"menubar","roles":["readable"],"notes":"","created_at":"2024-11-28T10:00:00Z","revoked_at":"2024-11-28T11:00:00Z"}`, w.Body.String())
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/subjects/000000000000000000000000/revoke", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	r = setupTestRouter(api.DeleteAuthSubject, "DELETE", "/admin/subjects/{oid}")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/subjects/67261314d689f977f773bc19", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, repo.subjects)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/subjects/67261314d689f977f773bc19", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
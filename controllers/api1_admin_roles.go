@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type RoleRepository interface {
+	ListRoles(ctx context.Context) []models.Role
+	SaveRole(ctx context.Context, role models.Role) (*models.Role, error)
+	DeleteRole(ctx context.Context, name string) error
+}
+
+type APIV1RoleRequest struct {
+	Permissions []string `json:"permissions"`
+	Notes       string   `json:"notes"`
+}
+
+type APIV1RoleResponse struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	Notes       string   `json:"notes"`
+	BuiltIn     bool     `json:"builtIn"` // provided by default, may be overridden
+	UpdatedAt   string   `json:"updated_at,omitempty"`
+}
+
+func roleResponse(role models.Role) APIV1RoleResponse {
+	permissions := role.Permissions
+	if permissions == nil {
+		permissions = []string{}
+	}
+	response := APIV1RoleResponse{
+		Name:        role.Name,
+		Permissions: permissions,
+		Notes:       role.Notes,
+		BuiltIn:     models.IsBuiltInRole(role.Name),
+	}
+	if !role.UpdatedTime.IsZero() {
+		response.UpdatedAt = role.UpdatedTime.UTC().Format(time.RFC3339)
+	}
+	return response
+}
+
+// ListRoles lists every role, built-in or stored
+func (a ApiV1) ListRoles(w http.ResponseWriter, r *http.Request) {
+	roles := a.RoleRepository.ListRoles(r.Context())
+	response := make([]APIV1RoleResponse, len(roles))
+	for i, role := range roles {
+		response[i] = roleResponse(role)
+	}
+	render.JSON(w, r, response)
+}
+
+// SaveRole creates or replaces the named role. Subjects holding the role get
+// its new permissions on their next request.
+func (a ApiV1) SaveRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	var req APIV1RoleRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		a.httpError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	role, err := a.RoleRepository.SaveRole(ctx, models.Role{
+		Name:        name,
+		Permissions: req.Permissions,
+		Notes:       req.Notes,
+	})
+	if errors.Is(err, models.ErrInvalidRole) {
+		a.httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Warn("cannot save role", slog.String("name", name), slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("saved role", slog.String("name", role.Name), slog.Any("permissions", role.Permissions))
+	render.JSON(w, r, roleResponse(*role))
+}
+
+// DeleteRole deletes a stored role. Built-in roles revert to their default
+// permissions.
+func (a ApiV1) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	name := chi.URLParam(r, "name")
+	err := a.RoleRepository.DeleteRole(ctx, name)
+	if errors.Is(err, models.ErrInvalidRole) {
+		a.httpError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, models.ErrNotFound) {
+		a.httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Warn("cannot delete role", slog.String("name", name), slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("deleted role", slog.String("name", name))
+	render.JSON(w, r, map[string]string{"status": "ok"})
+}
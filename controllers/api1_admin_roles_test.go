@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockRoleRepository struct {
+	roles []models.Role
+}
+
+func (m *mockRoleRepository) ListRoles(ctx context.Context) []models.Role {
+	return m.roles
+}
+
+func (m *mockRoleRepository) SaveRole(ctx context.Context, role models.Role) (*models.Role, error) {
+	if role.Name == "admin" {
+		return nil, models.ErrInvalidRole
+	}
+	m.roles = append(m.roles, role)
+	return &role, nil
+}
+
+func (m *mockRoleRepository) DeleteRole(ctx context.Context, name string) error {
+	for i, r := range m.roles {
+		if r.Name == name {
+			m.roles = append(m.roles[:i], m.roles[i+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+func TestApiV1_Roles(t *testing.T) {
+	repo := &mockRoleRepository{}
+	api := ApiV1{RoleRepository: repo}
+
+	r := setupTestRouter(api.SaveRole, "PUT", "/admin/roles/{name}")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/roles/reporter", strings.NewReader(`{"permissions":["api:entries:read"]}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"name":"reporter","permissions":["api:entries:read"],"notes":"","builtIn":false}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/roles/admin", strings.NewReader(`{"permissions":[]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r = setupTestRouter(api.ListRoles, "GET", "/admin/roles")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/admin/roles", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var roles []APIV1RoleResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&roles))
+	assert.Len(t, roles, 1)
+
+	r = setupTestRouter(api.DeleteRole, "DELETE", "/admin/roles/{name}")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/roles/reporter", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/roles/reporter", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
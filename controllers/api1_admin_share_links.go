@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/render"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type APIV1ShareLinkRequest struct {
+	Name      string `json:"name"`       // who it is for, eg "Dr Smith"
+	ExpiresAt string `json:"expires_at"` // rfc3339, optional
+}
+
+type APIV1ShareLinkResponse struct {
+	APIV1AuthSubjectResponse
+	Link string `json:"link,omitempty"` // only when created
+}
+
+// CreateShareLink creates a read-only token, optionally expiring, for giving
+// someone (eg a clinician) access to the dashboard. Share links are subjects,
+// so are revoked or deleted like any other.
+func (a ApiV1) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	var req APIV1ShareLinkRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		a.httpError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		a.httpError(w, "name must be supplied", http.StatusBadRequest)
+		return
+	}
+	var expiryTime time.Time
+	if req.ExpiresAt != "" {
+		var err error
+		expiryTime, err = time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil || !expiryTime.After(time.Now()) {
+			a.httpError(w, "expires_at must be a future rfc3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	subject, token, err := a.AuthSubjectRepository.CreateAuthSubject(ctx, models.AuthSubject{
+		Name:       req.Name,
+		RoleNames:  []string{models.ShareLinkRole},
+		ShareLink:  true,
+		ExpiryTime: expiryTime,
+	})
+	if err != nil {
+		log.Warn("cannot create share link", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Info("created share link",
+		slog.String("oid", subject.Oid),
+		slog.String("name", subject.Name),
+		slog.Time("expiryTime", subject.ExpiryTime),
+	)
+	response := APIV1ShareLinkResponse{
+		APIV1AuthSubjectResponse: authSubjectResponse(*subject),
+		Link:                     shareLink(r, a.BasePath, token),
+	}
+	response.AccessToken = token
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, response)
+}
+
+// ListShareLinks lists share links that have been neither revoked nor expired
+func (a ApiV1) ListShareLinks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	subjects, err := a.AuthSubjectRepository.FetchAuthSubjects(ctx)
+	if err != nil {
+		log.Warn("cannot fetch auth subjects", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	response := make([]APIV1ShareLinkResponse, 0)
+	for _, s := range subjects {
+		if s.ShareLink && s.IsActiveAt(now) {
+			response = append(response, APIV1ShareLinkResponse{APIV1AuthSubjectResponse: authSubjectResponse(s)})
+		}
+	}
+	render.JSON(w, r, response)
+}
+
+// shareLink returns a link to the dashboard of the server handling r, served
+// under basePath
+func shareLink(r *http.Request, basePath string, token string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: basePath + "/", RawQuery: url.Values{"token": {token}}.Encode()}
+	return u.String()
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiV1_ShareLinks(t *testing.T) {
+	repo := &mockAuthSubjectRepository{subjects: []models.AuthSubject{
+		{Oid: "67261314d689f977f773bc10", Name: "menubar", RoleNames: []string{"readable"}},
+		{Oid: "67261314d689f977f773bc11", Name: "expired", RoleNames: []string{models.ShareLinkRole}, ShareLink: true, ExpiryTime: time.Now().Add(-time.Hour)},
+	}}
+	api := ApiV1{AuthSubjectRepository: repo}
+
+	r := setupTestRouter(api.CreateShareLink, "POST", "/admin/share-links")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "https://ns.example.com/admin/share-links", strings.NewReader(`{"name":"Dr Smith","expires_at":"2099-01-01T00:00:00Z"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created APIV1ShareLinkResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, []string{models.ShareLinkRole}, created.RoleNames)
+	assert.Equal(t, "2099-01-01T00:00:00Z", created.ExpiresAt)
+	assert.True(t, created.ShareLink)
+	assert.Equal(t, "https://ns.example.com/?token="+created.AccessToken, created.Link)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/share-links", strings.NewReader(`{"expires_at":"2099-01-01T00:00:00Z"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r = setupTestRouter(api.ListShareLinks, "GET", "/admin/share-links")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/admin/share-links", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var links []APIV1ShareLinkResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&links))
+	assert.Len(t, links, 1, "only active share links are listed")
+	assert.Equal(t, "Dr Smith", links[0].Name)
+	assert.Empty(t, links[0].AccessToken)
+	assert.Empty(t, links[0].Link)
+
+	// links point under the base path
+	api.BasePath = "/nightscout"
+	root := chi.NewRouter()
+	root.Mount("/nightscout", setupTestRouter(api.CreateShareLink, "POST", "/admin/share-links"))
+	w = httptest.NewRecorder()
+	root.ServeHTTP(w, httptest.NewRequest("POST", "https://ns.example.com/nightscout/admin/share-links", strings.NewReader(`{"name":"Dr Jones","expires_at":"2099-01-01T00:00:00Z"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Equal(t, "https://ns.example.com/nightscout/?token="+created.AccessToken, created.Link)
+}
@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockPurgeRepository struct {
+	from, to time.Time
+	device   string
+}
+
+func (m *mockPurgeRepository) Purge(ctx context.Context, from, to time.Time, device string) (models.PurgeResult, error) {
+	m.from, m.to, m.device = from, to, device
+	return models.PurgeResult{Entries: 12, Treatments: 1}, nil
+}
+
+func TestApiV1_PurgeData(t *testing.T) {
+	purger := &mockPurgeRepository{}
+	api := ApiV1{PurgeRepository: purger}
+	r := setupTestRouter(api.PurgeData, "POST", "/admin/purge")
+
+	for body, wantCode := range map[string]int{
+		`{}`:                   http.StatusBadRequest,
+		`{"from":"yesterday"}`: http.StatusBadRequest,
+		`{"from":"2024-11-28T00:00:00Z","to":"2024-11-27T00:00:00Z"}`: http.StatusBadRequest,
+		`not json`: http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/purge", strings.NewReader(body)))
+		assert.Equal(t, wantCode, w.Code, body)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/purge", strings.NewReader(`{"to":"2024-11-28T00:00:00Z","device":"xdrip"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response APIV1PurgeResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, APIV1PurgeResponse{Entries: 12, Treatments: 1}, response)
+	assert.True(t, purger.from.IsZero())
+	assert.Equal(t, time.Date(2024, 11, 28, 0, 0, 0, 0, time.UTC), purger.to)
+	assert.Equal(t, "xdrip", purger.device)
+}
+
+type mockSyncRepository struct {
+	err    error
+	reload models.ReloadResult
+}
+
+func (m mockSyncRepository) SyncAll(ctx context.Context) error {
+	return m.err
+}
+
+func (m mockSyncRepository) ReloadPeriod(ctx context.Context, period models.Period) (models.ReloadResult, error) {
+	return m.reload, m.err
+}
+
+func TestApiV1_SyncData(t *testing.T) {
+	for name, tt := range map[string]struct {
+		repo     SyncRepository
+		wantCode int
+	}{
+		"synced":           {repo: mockSyncRepository{}, wantCode: http.StatusOK},
+		"upload failed":    {repo: mockSyncRepository{err: errors.New("access denied")}, wantCode: http.StatusServiceUnavailable},
+		"postgres backend": {repo: nil, wantCode: http.StatusNotImplemented},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := ApiV1{SyncRepository: tt.repo}
+			r := setupTestRouter(api.SyncData, "POST", "/admin/sync")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/sync", nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+}
+
+func TestApiV1_ReloadData(t *testing.T) {
+	for name, tt := range map[string]struct {
+		repo     SyncRepository
+		period   string
+		wantCode int
+		wantBody string
+	}{
+		"reloaded":         {repo: mockSyncRepository{reload: models.ReloadResult{Entries: 3, Treatments: 1}}, period: "2024-11", wantCode: http.StatusOK, wantBody: `{"entries":3,"treatments":1}`},
+		"no file":          {repo: mockSyncRepository{err: models.ErrNotFound}, period: "2024-11-28", wantCode: http.StatusNotFound},
+		"fetch failed":     {repo: mockSyncRepository{err: errors.New("access denied")}, period: "2024", wantCode: http.StatusInternalServerError},
+		"invalid period":   {repo: mockSyncRepository{}, period: "2024-13", wantCode: http.StatusBadRequest},
+		"missing period":   {repo: mockSyncRepository{}, period: "", wantCode: http.StatusBadRequest},
+		"postgres backend": {repo: nil, period: "2024-11", wantCode: http.StatusNotImplemented},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := ApiV1{SyncRepository: tt.repo}
+			r := setupTestRouter(api.ReloadData, "POST", "/admin/reload")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/reload?period="+tt.period, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"github.com/adamlounds/nightscout-go/middleware"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/render"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// APIV1AdminNotifiesResponse is nightscout's adminnotifies response. Only
+// admins see the notifies, everyone else just how many there are.
+type APIV1AdminNotifiesResponse struct {
+	Status  int                       `json:"status"`
+	Message APIV1AdminNotifiesMessage `json:"message"`
+}
+
+type APIV1AdminNotifiesMessage struct {
+	Notifies    []APIV1AdminNotify `json:"notifies"`
+	NotifyCount int                `json:"notifyCount"`
+}
+
+type APIV1AdminNotify struct {
+	Title        string `json:"title"`
+	Message      string `json:"message"`
+	Count        int    `json:"count"`
+	LastRecorded int64  `json:"lastRecorded"` // ms since epoch
+}
+
+// ListAdminNotifies lists problems operators should know about, eg failing
+// uploads to the bucket, for the admin notifies panel. Notifies the caller
+// has acknowledged are left out.
+func (a ApiV1) ListAdminNotifies(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authn := middleware.GetAuthn(ctx)
+	var subject string
+	if authn != nil {
+		subject = authn.AuthSubject.Name
+	}
+	recent := a.AdminNotifies.RecentFor(subject, time.Now())
+	message := APIV1AdminNotifiesMessage{Notifies: []APIV1AdminNotify{}, NotifyCount: len(recent)}
+
+	if authn != nil && a.IsPermitted(ctx, authn, "*:*:admin") {
+		for _, n := range recent {
+			message.Notifies = append(message.Notifies, APIV1AdminNotify{
+				Title:        n.Title,
+				Message:      n.Message,
+				Count:        n.Count,
+				LastRecorded: n.LastRecorded.UnixMilli(),
+			})
+		}
+	}
+
+	render.JSON(w, r, APIV1AdminNotifiesResponse{Status: http.StatusOK, Message: message})
+}
+
+// AckNotifications acknowledges notifications of a level and group, as
+// nightscout's /notifications/ack. We have no alarms to snooze, so this
+// hides the admin notifies recorded so far from whoever acknowledged them.
+func (a ApiV1) AckNotifications(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+	level, err := strconv.Atoi(r.URL.Query().Get("level"))
+	if err != nil || level < models.LevelNone || level > models.LevelUrgent {
+		a.httpError(w, "level must be an integer from -3 to 2", http.StatusBadRequest)
+		return
+	}
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = "default"
+	}
+
+	authn := middleware.GetAuthn(ctx)
+	a.AdminNotifies.Ack(authn.AuthSubject.Name, time.Now())
+	log.Info("notifications acknowledged",
+		slog.Int("level", level),
+		slog.String("group", group),
+		slog.String("subject", authn.AuthSubject.Name),
+	)
+	w.WriteHeader(http.StatusOK)
+}
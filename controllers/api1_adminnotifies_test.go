@@ -0,0 +1,90 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/middleware"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiV1_ListAdminNotifies(t *testing.T) {
+	adminNotifies := models.NewAdminNotifies()
+	adminNotifies.Add("CGM login failed", "librelinkup cannot authenticate, check username/password")
+	api := ApiV1{
+		AuthService: mockAuthService{
+			isPermittedFn: func(ctx context.Context, authn *models.Authn, requiredPermission string) bool {
+				return authn.AuthSubject.Name == "admin"
+			},
+		},
+		AdminNotifies: adminNotifies,
+	}
+
+	tests := []struct {
+		name      string
+		subject   string
+		wantCount int
+		wantLen   int
+	}{
+		{name: "admin", subject: "admin", wantCount: 1, wantLen: 1},
+		{name: "reader", subject: "menubar", wantCount: 1, wantLen: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authn := &models.Authn{AuthSubject: &models.AuthSubject{Name: tt.subject}}
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/adminnotifies", nil)
+			r = r.WithContext(middleware.WithAuthn(r.Context(), authn))
+			w := httptest.NewRecorder()
+			api.ListAdminNotifies(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			var response APIV1AdminNotifiesResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+			assert.Equal(t, tt.wantCount, response.Message.NotifyCount)
+			assert.Len(t, response.Message.Notifies, tt.wantLen)
+			if tt.wantLen > 0 {
+				assert.Equal(t, "CGM login failed", response.Message.Notifies[0].Title)
+				assert.Equal(t, 1, response.Message.Notifies[0].Count)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	ApiV1{}.ListAdminNotifies(w, httptest.NewRequest(http.MethodGet, "/api/v1/adminnotifies", nil))
+	assert.JSONEq(t, `{"status":200,"message":{"notifies":[],"notifyCount":0}}`, w.Body.String())
+}
+
+func TestApiV1_AckNotifications(t *testing.T) {
+	adminNotifies := models.NewAdminNotifies()
+	adminNotifies.Add("CGM login failed", "librelinkup cannot authenticate, check username/password")
+	api := ApiV1{AdminNotifies: adminNotifies, Settings: NewLiveSettings(Settings{})}
+	authn := &models.Authn{AuthSubject: &models.AuthSubject{Name: "admin", RoleNames: []string{"admin"}}}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+	}{
+		{name: "no level", query: "", wantCode: http.StatusBadRequest},
+		{name: "bad level", query: "?level=loud", wantCode: http.StatusBadRequest},
+		{name: "out of range", query: "?level=3", wantCode: http.StatusBadRequest},
+		{name: "ok", query: "?level=2&group=default", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/notifications/ack"+tt.query, nil)
+			r = r.WithContext(middleware.WithAuthn(contextWithSilentLogger(), authn))
+			w := httptest.NewRecorder()
+			api.AckNotifications(w, r)
+			assert.Equal(t, tt.wantCode, w.Code)
+		})
+	}
+
+	assert.Empty(t, adminNotifies.RecentFor("admin", time.Now()))
+	assert.Len(t, adminNotifies.RecentFor("ops", time.Now()), 1)
+}
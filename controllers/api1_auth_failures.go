@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"context"
+	"github.com/adamlounds/nightscout-go/i18n"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed authentication is tracked per client address. Each failure from an
+// address delays the response by FailDelay times the number of recent
+// failures (as nightscout does with authFailDelay), and after LockoutAfter
+// failures the address is locked out for LockoutFor: requests presenting
+// credentials are refused without being checked. Requests without credentials
+// are never delayed, so anonymous readers behind the same address are
+// unaffected.
+//
+// Failures are not tracked by token name: the name is the unverified start of
+// whatever token is sent, so anyone could lock a real uploader out by sending
+// bad tokens in its name.
+//
+// Behind a reverse proxy every request comes from the proxy's address, so for
+// requests from TrustedProxies, or over a unix socket, the client is taken
+// from X-Forwarded-For.
+//
+// An address's failures are forgotten after LockoutFor without a failure, or
+// as soon as it authenticates successfully.
+
+const authFailurePruneInterval = time.Minute
+
+type authFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// AuthFailureTracker delays and locks out sources of repeated bad secrets and
+// tokens. The zero value does nothing.
+type AuthFailureTracker struct {
+	FailDelay      time.Duration
+	LockoutAfter   int // 0 never locks out
+	LockoutFor     time.Duration
+	TrustedProxies []netip.Prefix // whose X-Forwarded-For is believed
+	lock           sync.Mutex
+	sources        map[string]*authFailures
+	nextPrune      time.Time
+}
+
+func NewAuthFailureTracker(failDelay time.Duration, lockoutAfter int, lockoutFor time.Duration, trustedProxies []netip.Prefix) *AuthFailureTracker {
+	return &AuthFailureTracker{
+		FailDelay:      failDelay,
+		LockoutAfter:   lockoutAfter,
+		LockoutFor:     lockoutFor,
+		TrustedProxies: trustedProxies,
+		sources:        make(map[string]*authFailures),
+	}
+}
+
+// source returns the client address failures are tracked under. Addresses in
+// X-Forwarded-For are read right to left, skipping trusted proxies, as only
+// the entries our own proxies added can be believed.
+func (t *AuthFailureTracker) source(r *http.Request) string {
+	source := r.RemoteAddr
+	addr, ok := parseHostAddr(r.RemoteAddr)
+	if ok {
+		source = addr.String()
+	}
+	if t == nil {
+		return source
+	}
+	// a unix socket has no client address, and only our own proxy can
+	// connect to it
+	if !fromUnixSocket(r) && (!ok || !isTrustedProxy(t.TrustedProxies, addr)) {
+		return source
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		client, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = client.Unmap()
+		source = addr.String()
+		if !isTrustedProxy(t.TrustedProxies, addr) {
+			break
+		}
+	}
+	return source
+}
+
+// refuse responds with 429 Too Many Requests if source is locked out,
+// returning whether it did
+func (t *AuthFailureTracker) refuse(w http.ResponseWriter, r *http.Request, source string, language string) bool {
+	log := slogctx.FromCtx(r.Context())
+	lockedUntil := t.lockedUntil(source, time.Now())
+	if lockedUntil.IsZero() {
+		return false
+	}
+	log.Warn("authentication locked out", slog.String("source", source), slog.Time("lockedUntil", lockedUntil))
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(lockedUntil).Seconds())+1))
+	http.Error(w, i18n.New(language).T("Unauthorized"), http.StatusTooManyRequests)
+	return true
+}
+
+// record records whether source authenticated successfully, delaying after a
+// failure
+func (t *AuthFailureTracker) record(ctx context.Context, source string, ok bool) {
+	log := slogctx.FromCtx(ctx)
+	if ok {
+		t.succeed(source)
+		return
+	}
+	delay, lockedOut := t.fail(source, time.Now())
+	if lockedOut {
+		log.Warn("authentication failed, locking out", slog.String("source", source), slog.Duration("lockoutFor", t.LockoutFor))
+	} else {
+		log.Info("authentication failed", slog.String("source", source), slog.Duration("delay", delay))
+	}
+	sleep(ctx, delay)
+}
+
+// lockedUntil returns when the lockout of source ends, or the zero time if it
+// is not locked out
+func (t *AuthFailureTracker) lockedUntil(source string, now time.Time) time.Time {
+	if t == nil || t.LockoutAfter == 0 {
+		return time.Time{}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if f, ok := t.sources[source]; ok && f.lockedUntil.After(now) {
+		return f.lockedUntil
+	}
+	return time.Time{}
+}
+
+// fail records a failure for source, returning how long to delay the response
+// and whether this failure locked it out
+func (t *AuthFailureTracker) fail(source string, now time.Time) (delay time.Duration, lockedOut bool) {
+	if t == nil {
+		return 0, false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.prune(now)
+	f, ok := t.sources[source]
+	if !ok {
+		f = &authFailures{}
+		t.sources[source] = f
+	}
+	f.count++
+	f.lastFailure = now
+	if t.LockoutAfter > 0 && f.count >= t.LockoutAfter && !f.lockedUntil.After(now) {
+		f.lockedUntil = now.Add(t.LockoutFor)
+		f.count = 0
+		lockedOut = true
+	}
+	return t.FailDelay * time.Duration(f.count), lockedOut
+}
+
+// succeed forgets any failures recorded for source
+func (t *AuthFailureTracker) succeed(source string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.sources, source)
+}
+
+// prune forgets sources without a recent failure. Callers must hold lock.
+func (t *AuthFailureTracker) prune(now time.Time) {
+	if now.Before(t.nextPrune) {
+		return
+	}
+	t.nextPrune = now.Add(authFailurePruneInterval)
+	for source, f := range t.sources {
+		if now.Sub(f.lastFailure) > t.LockoutFor && !f.lockedUntil.After(now) {
+			delete(t.sources, source)
+		}
+	}
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAuthRepository struct {
+	apiSecretHash string // "secrethash" if empty
+}
+
+func (m mockAuthRepository) GetAPISecretHash(ctx context.Context) string {
+	if m.apiSecretHash != "" {
+		return m.apiSecretHash
+	}
+	return "secrethash"
+}
+func (m mockAuthRepository) GetOldAPISecretHash(ctx context.Context) (string, time.Time) {
+	return "", time.Time{}
+}
+func (m mockAuthRepository) GetDefaultRole(ctx context.Context) string { return "readable" }
+func (m mockAuthRepository) FetchAuthSubjectByAuthToken(ctx context.Context, authToken string) *models.AuthSubject {
+	if authToken == "menubar-358de43470f328f3" {
+		return &models.AuthSubject{Oid: "674846dc2a9abd0d2c5a3e2b", Name: "menubar", RoleNames: []string{"readable"}}
+	}
+	return &models.AuthSubject{Name: "anonymous"}
+}
+func (m mockAuthRepository) FetchAuthSubjectByOid(ctx context.Context, oid string) *models.AuthSubject {
+	if oid == "674846dc2a9abd0d2c5a3e2b" {
+		return &models.AuthSubject{Oid: oid, Name: "menubar", RoleNames: []string{"readable"}}
+	}
+	return &models.AuthSubject{Name: "anonymous"}
+}
+func (m mockAuthRepository) FetchRoles(ctx context.Context) ([]models.Role, error) { return nil, nil }
+func (m mockAuthRepository) SaveRole(ctx context.Context, role models.Role) (*models.Role, error) {
+	return &role, nil
+}
+func (m mockAuthRepository) DeleteRole(ctx context.Context, name string) error { return nil }
+
+func TestAuthFailureTracker(t *testing.T) {
+	now := time.Date(2024, 11, 28, 10, 0, 0, 0, time.UTC)
+	tracker := NewAuthFailureTracker(time.Second, 3, time.Minute, nil)
+	source := "192.0.2.1"
+
+	delay, lockedOut := tracker.fail(source, now)
+	assert.Equal(t, time.Second, delay)
+	assert.False(t, lockedOut)
+	delay, _ = tracker.fail(source, now)
+	assert.Equal(t, 2*time.Second, delay)
+	assert.True(t, tracker.lockedUntil(source, now).IsZero())
+
+	_, lockedOut = tracker.fail(source, now)
+	assert.True(t, lockedOut)
+	assert.Equal(t, now.Add(time.Minute), tracker.lockedUntil(source, now))
+	assert.True(t, tracker.lockedUntil("192.0.2.3", now).IsZero())
+	assert.True(t, tracker.lockedUntil(source, now.Add(time.Minute)).IsZero(), "lockouts expire")
+
+	tracker.succeed(source)
+	delay, _ = tracker.fail(source, now)
+	assert.Equal(t, time.Second, delay, "success forgets failures")
+
+	tracker.prune(now.Add(2 * time.Minute))
+	assert.Empty(t, tracker.sources, "old failures are forgotten")
+
+	var disabled *AuthFailureTracker
+	delay, lockedOut = disabled.fail(source, now)
+	assert.Zero(t, delay)
+	assert.False(t, lockedOut)
+}
+
+func TestAuthFailureTracker_Source(t *testing.T) {
+	tracker := NewAuthFailureTracker(0, 2, time.Minute, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		unixSocket    bool
+		forwardedFor  []string
+		expectAddress string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", expectAddress: "192.0.2.1"},
+		{name: "untrusted proxy", remoteAddr: "192.0.2.1:1234", forwardedFor: []string{"198.51.100.1"}, expectAddress: "192.0.2.1"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.1"}, expectAddress: "198.51.100.1"},
+		{name: "spoofed before the proxy", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"203.0.113.1, 198.51.100.1"}, expectAddress: "198.51.100.1"},
+		{name: "chained proxies", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.1", "10.0.0.2"}, expectAddress: "198.51.100.1"},
+		{name: "trusted proxy without header", remoteAddr: "10.0.0.1:1234", expectAddress: "10.0.0.1"},
+		{name: "garbage header", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"unknown"}, expectAddress: "10.0.0.1"},
+		{name: "unix socket", remoteAddr: "@", unixSocket: true, forwardedFor: []string{"198.51.100.1"}, expectAddress: "198.51.100.1"},
+		{name: "unix socket, spoofed before the proxy", remoteAddr: "@", unixSocket: true, forwardedFor: []string{"203.0.113.1, 198.51.100.1"}, expectAddress: "198.51.100.1"},
+		{name: "unix socket without header", remoteAddr: "@", unixSocket: true, expectAddress: "@"},
+		{name: "spoofed unix socket address", remoteAddr: "@", forwardedFor: []string{"198.51.100.1"}, expectAddress: "@"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/entries", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.unixSocket {
+				r = r.WithContext(context.WithValue(r.Context(), unixSocketKey{}, true))
+			}
+			for _, v := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			assert.Equal(t, tt.expectAddress, tracker.source(r))
+		})
+	}
+}
+
+func TestApiV1AuthnMiddleware_AuthFailures(t *testing.T) {
+	mw := ApiV1AuthnMiddleware{
+		AuthService:  &models.AuthService{AuthRepository: mockAuthRepository{}},
+		AuthFailures: NewAuthFailureTracker(0, 2, time.Minute, nil),
+	}
+	h := mw.SetAuthentication(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(remoteAddr string, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", url, nil)
+		r.RemoteAddr = remoteAddr
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, request("192.0.2.1:1234", "/api/v1/entries?token=menubar-0000000000000000").Code)
+	assert.Equal(t, http.StatusOK, request("192.0.2.1:1234", "/api/v1/entries?token=menubar-0000000000000001").Code)
+	w := request("192.0.2.1:1234", "/api/v1/entries?token=menubar-358de43470f328f3")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "even a good token is refused while locked out")
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, request("192.0.2.1:1234", "/api/v1/entries").Code, "anonymous requests are not locked out")
+
+	// bad tokens in another's name do not lock its real uploader out
+	w = request("192.0.2.2:1234", "/api/v1/entries?token=menubar-358de43470f328f3")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -1,15 +1,23 @@
 package controllers
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/adamlounds/nightscout-go/i18n"
 	"github.com/adamlounds/nightscout-go/middleware"
 	"github.com/adamlounds/nightscout-go/models"
 	slogctx "github.com/veqryn/slog-context"
 	"log/slog"
 	"net/http"
+	"strings"
 )
 
 type ApiV1AuthnMiddleware struct {
 	*models.AuthService
+	Settings     *LiveSettings
+	AuthFailures *AuthFailureTracker // nil to never delay or lock out
+	ProxyAuth    *ProxyAuth          // nil unless behind an authenticating proxy
 }
 
 func (a ApiV1AuthnMiddleware) SetAuthentication(next http.Handler) http.Handler {
@@ -17,13 +25,40 @@ func (a ApiV1AuthnMiddleware) SetAuthentication(next http.Handler) http.Handler
 		ctx := r.Context()
 		log := slogctx.FromCtx(ctx)
 
+		if authSubject, ok := a.ProxyAuth.authSubject(r); ok {
+			authn := &models.Authn{AuthSubject: authSubject}
+			log.Debug("SetAuthentication from proxy", slog.Any("authn", authn), slog.Any("roles", authSubject.RoleNames))
+			next.ServeHTTP(w, r.WithContext(middleware.WithAuthn(ctx, authn)))
+			return
+		}
+
 		apiSecretHash := r.Header.Get("api-secret")
 		if apiSecretHash == "" {
 			apiSecretHash = r.URL.Query().Get("secret")
 		}
-		authToken := r.URL.Query().Get("token")
+		if !a.Settings.Load().APISecretHashOnly {
+			apiSecretHash = a.hashPlainAPISecret(ctx, apiSecretHash)
+		}
+		authToken := authTokenFromHTTP(r)
+
+		credentialed := apiSecretHash != "" || authToken != ""
+		source := a.AuthFailures.source(r)
+		if credentialed && a.AuthFailures.refuse(w, r, source, a.Settings.Load().Language) {
+			return
+		}
 
 		authn := a.AuthFromHTTP(ctx, apiSecretHash, authToken)
+		if credentialed {
+			a.AuthFailures.record(ctx, source, !authn.AuthSubject.IsAnonymous())
+		}
+
+		if authn.OldAPISecret {
+			log.Warn("old api secret used, update this client",
+				slog.String("remoteAddr", r.RemoteAddr),
+				slog.String("userAgent", r.UserAgent()),
+				slog.String("path", r.URL.Path),
+			)
+		}
 
 		log.Debug("SetAuthentication", slog.Any("authn", authn))
 		ctx = middleware.WithAuthn(ctx, authn)
@@ -32,6 +67,47 @@ func (a ApiV1AuthnMiddleware) SetAuthentication(next http.Handler) http.Handler
 	})
 }
 
+// hashPlainAPISecret returns the sha1 of secret if it is the api secret sent
+// unhashed, as some clients do. Anything else, eg a hash or a token, is
+// returned as it is.
+func (a ApiV1AuthnMiddleware) hashPlainAPISecret(ctx context.Context, secret string) string {
+	if secret == "" || isSHA1Hex(secret) {
+		return secret
+	}
+	sum := sha1.Sum([]byte(secret))
+	hash := hex.EncodeToString(sum[:])
+	if !a.IsAPISecretHashValid(ctx, hash) {
+		return secret
+	}
+	slogctx.FromCtx(ctx).Debug("api secret was sent unhashed")
+	return hash
+}
+
+// isSHA1Hex reports whether s looks like a hex-encoded sha1
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// authTokenFromHTTP returns the access token or JWT sent as ?token=, a token
+// header or Authorization: Bearer, in that order of preference
+func authTokenFromHTTP(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if token := r.Header.Get("token"); token != "" {
+		return token
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
 func (a ApiV1AuthnMiddleware) Authz(requiredRole string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -45,9 +121,22 @@ func (a ApiV1AuthnMiddleware) Authz(requiredRole string) func(http.Handler) http
 				next.ServeHTTP(w, r)
 			} else {
 				log.Debug("Authzmw rejected", slog.String("requiredRole", requiredRole))
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				http.Error(w, i18n.New(a.Settings.Load().Language).T("Unauthorized"), http.StatusUnauthorized)
 				return
 			}
 		})
 	}
 }
+
+// setDefaultEnteredBy attributes treatments without enteredBy to whoever
+// authenticated the request, eg the name of their token
+func setDefaultEnteredBy(ctx context.Context, t *models.Treatment) {
+	if enteredBy, _ := t.Fields["enteredBy"].(string); enteredBy != "" {
+		return
+	}
+	authn := middleware.GetAuthn(ctx)
+	if authn == nil || authn.AuthSubject.IsAnonymous() {
+		return
+	}
+	t.Fields["enteredBy"] = authn.AuthSubject.Name
+}
@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ExportRepository interface {
+	ExportEntries(ctx context.Context, fn func(models.Entry) error) error
+	ExportTreatments(ctx context.Context, fn func(models.Treatment) error) error
+}
+
+// Export streams every stored entry and treatment as a single json document,
+// {"entries":[...],"treatments":[...]}, each in the same format the entries
+// and treatments endpoints use. Pass ?gzip=true for a compressed download.
+//
+// Once the response has started we cannot change the status code, so if the
+// export fails part-way through the connection is aborted, leaving the client
+// with a truncated (invalid) document rather than an incomplete-but-valid one.
+func (a ApiV1) Export(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	compress := false
+	if s := r.URL.Query().Get("gzip"); s != "" {
+		var err error
+		compress, err = strconv.ParseBool(s)
+		if err != nil {
+			a.httpError(w, "gzip must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filename := fmt.Sprintf("nightscout-export-%s.json", time.Now().UTC().Format("2006-01-02"))
+	var out io.Writer = w
+	var zw *gzip.Writer
+	if compress {
+		filename += ".gz"
+		w.Header().Set("Content-Type", "application/gzip")
+		zw = gzip.NewWriter(w)
+		out = zw
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.WriteHeader(http.StatusOK)
+
+	bw := bufio.NewWriter(out)
+	numEntries, numTreatments := 0, 0
+	writeItem := func(n int, v any) error {
+		if n > 0 {
+			_, _ = bw.WriteString(",")
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(b)
+		return err
+	}
+
+	_, _ = bw.WriteString(`{"entries":[`)
+	err := a.ExportRepository.ExportEntries(ctx, func(e models.Entry) error {
+		err := writeItem(numEntries, entryResponse(e, ""))
+		numEntries++
+		return err
+	})
+	if err == nil {
+		_, _ = bw.WriteString(`],"treatments":[`)
+		err = a.ExportRepository.ExportTreatments(ctx, func(t models.Treatment) error {
+			err := writeItem(numTreatments, treatmentResponse(t, "", ""))
+			numTreatments++
+			return err
+		})
+	}
+	if err == nil {
+		_, _ = bw.WriteString("]}\n")
+		err = bw.Flush()
+	}
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Warn("export failed", slog.Int("numEntries", numEntries), slog.Int("numTreatments", numTreatments), slog.Any("error", err))
+		panic(http.ErrAbortHandler)
+	}
+
+	log.Info("exported all data", slog.Int("numEntries", numEntries), slog.Int("numTreatments", numTreatments))
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mockExportRepository struct {
+	entries    []models.Entry
+	treatments []models.Treatment
+	err        error
+}
+
+func (m mockExportRepository) ExportEntries(ctx context.Context, fn func(models.Entry) error) error {
+	for _, e := range m.entries {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return m.err
+}
+func (m mockExportRepository) ExportTreatments(ctx context.Context, fn func(models.Treatment) error) error {
+	for _, t := range m.treatments {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type exportResponse struct {
+	Entries    []APIV1EntryResponse     `json:"entries"`
+	Treatments []map[string]interface{} `json:"treatments"`
+}
+
+func TestApiV1_Export(t *testing.T) {
+	api := ApiV1{ExportRepository: mockExportRepository{
+		entries: []models.Entry{*createTestEntry("e1"), *createTestEntry("e2")},
+		treatments: []models.Treatment{
+			{ID: "t1", Type: "Note", Time: time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), Fields: map[string]interface{}{"notes": "hi"}},
+		},
+	}}
+	r := setupTestRouter(api.Export, "GET", "/export")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/export", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var res exportResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	assert.Len(t, res.Entries, 2)
+	assert.Equal(t, "e2", res.Entries[1].Oid)
+	assert.Equal(t, int64(1704197594000), res.Entries[0].Date)
+	assert.Equal(t, []map[string]interface{}{{
+		"_id":        "t1",
+		"eventType":  "Note",
+		"created_at": "2024-01-02T12:00:00.000Z",
+		"mills":      float64(1704196800000),
+		"notes":      "hi",
+	}}, res.Treatments)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/export?gzip=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), ".json.gz")
+	zr, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	res = exportResponse{}
+	assert.NoError(t, json.NewDecoder(zr).Decode(&res))
+	assert.Len(t, res.Entries, 2)
+	assert.Len(t, res.Treatments, 1)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/export?gzip=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestApiV1_ExportFailure(t *testing.T) {
+	api := ApiV1{ExportRepository: mockExportRepository{
+		entries: []models.Entry{*createTestEntry("e1")},
+		err:     errors.New("bucket unavailable"),
+	}}
+	ctx := contextWithSilentLogger()
+	req := httptest.NewRequest("GET", "/export", nil).WithContext(ctx)
+
+	assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		api.Export(httptest.NewRecorder(), req)
+	}, "connection is aborted so clients do not see a complete export")
+}
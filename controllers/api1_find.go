@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/adamlounds/nightscout-go/models"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entryFind is the subset of nightscout's mongo-style find[] query we
+// support on entries, eg
+// find[type]=sgv&find[date][$gte]=1730764800000&find[date][$lt]=1730851200000
+type entryFind struct {
+	From time.Time // inclusive
+	To   time.Time // exclusive
+	Type string    // empty for any type
+}
+
+var ErrInvalidFind = errors.New("invalid find query")
+
+// parseEntryFind returns the date range and type asked for, or false if the
+// query has no find[] filter. Dates can be given in ms (find[date]) or as
+// rfc3339 or yyyy-mm-dd (find[dateString]), with $gt, $gte, $lt and $lte
+// operators. Without an upper bound we stop at now, so as with unfiltered
+// queries future entries are excluded.
+func parseEntryFind(q url.Values, now time.Time) (entryFind, bool, error) {
+	f := entryFind{
+		From: time.Unix(0, 0).UTC(),
+		To:   now.Add(time.Nanosecond),
+		Type: q.Get("find[type]"),
+	}
+	found := f.Type != ""
+	for _, field := range []string{"date", "dateString"} {
+		for _, op := range []string{"$gt", "$gte", "$lt", "$lte"} {
+			raw := q.Get("find[" + field + "][" + op + "]")
+			if raw == "" {
+				continue
+			}
+			found = true
+			t, err := parseFindTime(field, raw)
+			if err != nil {
+				return f, true, err
+			}
+			switch op {
+			case "$gt":
+				f.From = t.Add(time.Nanosecond)
+			case "$gte":
+				f.From = t
+			case "$lt":
+				f.To = t
+			case "$lte":
+				f.To = t.Add(time.Nanosecond)
+			}
+		}
+	}
+	return f, found, nil
+}
+
+// parseFindTime parses a find[date] (ms since epoch) or find[dateString]
+// value. Some clients send ms as a float, or with a stray trailing "}".
+func parseFindTime(field, raw string) (time.Time, error) {
+	raw = strings.TrimSuffix(raw, "}")
+	if field == "date" {
+		ms, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return time.Time{}, ErrInvalidFind
+		}
+		return time.UnixMilli(int64(ms)).UTC(), nil
+	}
+	t, err := time.Parse(time.DateOnly, raw)
+	if err == nil {
+		return t, nil
+	}
+	t, err = parseTime(raw)
+	if err != nil {
+		return time.Time{}, ErrInvalidFind
+	}
+	return t.UTC(), nil
+}
+
+// treatmentFind is the subset of nightscout's find[] query we support on
+// treatments, eg
+// find[created_at][$gte]=2024-12-15&find[eventType]=/Sensor Start|Sensor Change/&find[notes]=/pizza/i
+type treatmentFind struct {
+	From      time.Time // inclusive
+	To        time.Time // exclusive
+	EventType func(string) bool
+	Notes     func(string) bool
+	EnteredBy func(string) bool
+}
+
+// parseTreatmentFind returns the created_at range and the eventType, notes
+// and enteredBy asked for, or false if the query has no find[] filter. Times
+// are rfc3339 or yyyy-mm-dd, with $gt, $gte, $lt and $lte operators. Text is
+// matched as findMatcher describes.
+func parseTreatmentFind(q url.Values) (treatmentFind, bool, error) {
+	f := treatmentFind{
+		From: time.Unix(0, 0).UTC(),
+		To:   time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	found := false
+	for field, match := range map[string]*func(string) bool{
+		"eventType": &f.EventType,
+		"notes":     &f.Notes,
+		"enteredBy": &f.EnteredBy,
+	} {
+		m, ok, err := parseFindText(q, field)
+		if err != nil {
+			return f, true, err
+		}
+		found = found || ok
+		*match = m
+	}
+	for _, op := range []string{"$gt", "$gte", "$lt", "$lte"} {
+		raw := q.Get("find[created_at][" + op + "]")
+		if raw == "" {
+			continue
+		}
+		found = true
+		t, err := parseFindTime("created_at", raw)
+		if err != nil {
+			return f, true, err
+		}
+		switch op {
+		case "$gt":
+			f.From = t.Add(time.Nanosecond)
+		case "$gte":
+			f.From = t
+		case "$lt":
+			f.To = t
+		case "$lte":
+			f.To = t.Add(time.Nanosecond)
+		}
+	}
+	return f, found, nil
+}
+
+// Matches reports whether a treatment is one the query asked for
+func (f treatmentFind) Matches(t models.Treatment) bool {
+	notes, _ := t.Fields["notes"].(string)
+	enteredBy, _ := t.Fields["enteredBy"].(string)
+	return !t.Time.Before(f.From) && t.Time.Before(f.To) &&
+		f.EventType(t.Type) && f.Notes(notes) && f.EnteredBy(enteredBy)
+}
+
+// parseFindText returns a matcher for find[field], or for
+// find[field][$regex] (with find[field][$options]=i to ignore case). It
+// matches anything, and returns false, if neither is given.
+func parseFindText(q url.Values, field string) (func(string) bool, bool, error) {
+	if raw := q.Get("find[" + field + "]"); raw != "" {
+		match, err := findMatcher(raw)
+		return match, true, err
+	}
+	if raw := q.Get("find[" + field + "][$regex]"); raw != "" {
+		match, err := findMatcher("/" + raw + "/" + q.Get("find["+field+"][$options]"))
+		return match, true, err
+	}
+	return func(string) bool { return true }, false, nil
+}
+
+// findRegex is a find[] value given as /regex/, optionally with the i flag
+var findRegex = regexp.MustCompile(`^/(.*)/(i?)$`)
+
+// findMatcher matches a find[] value exactly or, if given as /regex/ or
+// /regex/i, as a regular expression, so /pizza/i finds "Pizza" anywhere in
+// the text
+func findMatcher(raw string) (func(string) bool, error) {
+	m := findRegex.FindStringSubmatch(raw)
+	if m == nil {
+		return func(s string) bool { return s == raw }, nil
+	}
+	expr := m[1]
+	if m[2] == "i" {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, ErrInvalidFind
+	}
+	return re.MatchString, nil
+}
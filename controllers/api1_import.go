@@ -0,0 +1,670 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	repository "github.com/adamlounds/nightscout-go/adapters"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/oklog/ulid/v2"
+	slogctx "github.com/veqryn/slog-context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// importBatchSize is how many entries we ask a remote nightscout for at once.
+// Remote servers cap responses: one instance would not send more than 5417
+// entries, another capped itself at 1152 entries, 258KB.
+const importBatchSize = 1000
+
+// importMaxBatches stops us hammering a remote server if something _weird_
+// happens. 500 batches is about a year of 1-minute readings; larger imports
+// resume where they stopped when started again.
+const importMaxBatches = 500
+
+// importJobRetention is how long finished jobs can be polled for
+const importJobRetention = 24 * time.Hour
+
+type ImportCursorRepository interface {
+	FetchImportCursor(ctx context.Context, source string) (*models.ImportCursor, error)
+	SaveImportCursor(ctx context.Context, cursor models.ImportCursor) error
+}
+
+type CSVRepository interface {
+	ParseCSVEntries(ctx context.Context, r io.Reader, loc *time.Location) (string, []models.Entry, error)
+}
+
+type ArchiveRepository interface {
+	ParseArchiveEntries(ctx context.Context, r io.Reader) ([]models.Entry, error)
+}
+
+// errImportInterrupted is recorded against jobs stopped by Shutdown. Their
+// cursor has been saved, so starting the import again resumes it.
+var errImportInterrupted = errors.New("import interrupted by shutdown, start it again to continue")
+
+// ImportJobs tracks running and recently-finished imports so clients can
+// poll for progress. Jobs are held in memory only, they do not survive a
+// restart.
+type ImportJobs struct {
+	AdminNotifies *models.AdminNotifies // told about failed imports
+	jobs          map[string]*importJob
+	jobsLock      sync.Mutex
+
+	// ctx is cancelled by Shutdown, stopping running jobs. running counts
+	// their goroutines, and closed refuses new ones once Shutdown has begun.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+	closed  bool
+}
+
+func NewImportJobs() *ImportJobs {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ImportJobs{jobs: make(map[string]*importJob), ctx: ctx, cancel: cancel}
+}
+
+// run calls fn for job in a new goroutine. The job outlives the request that
+// started it, so fn's context keeps ctx's values but is only cancelled by
+// Shutdown.
+func (j *ImportJobs) run(ctx context.Context, job *importJob, fn func(ctx context.Context)) {
+	j.jobsLock.Lock()
+	defer j.jobsLock.Unlock()
+	if j.closed {
+		job.finish(errImportInterrupted)
+		return
+	}
+
+	jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(j.ctx, cancel)
+	j.running.Add(1)
+	go func() {
+		defer j.running.Done()
+		defer cancel()
+		defer stop()
+		fn(jobCtx)
+	}()
+}
+
+// Shutdown cancels running jobs and waits for them to stop, or for ctx to
+// end. Entries they fetched have been passed to the entry repository, so
+// callers should flush it afterwards.
+func (j *ImportJobs) Shutdown(ctx context.Context) error {
+	j.jobsLock.Lock()
+	j.closed = true
+	j.jobsLock.Unlock()
+	j.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		j.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("import jobs still running: %w", ctx.Err())
+	}
+}
+
+type importJob struct {
+	lock          sync.Mutex
+	status        APIV1ImportStatusResponse
+	adminNotifies *models.AdminNotifies
+}
+
+type APIV1ImportStatusResponse struct {
+	ID              string     `json:"id"`
+	State           string     `json:"state"` // "running", "done" or "failed"
+	StartedAt       time.Time  `json:"startedAt"`
+	ResumedFrom     *time.Time `json:"resumedFrom,omitempty"` // continuing an interrupted import, from this time back
+	FinishedAt      *time.Time `json:"finishedAt,omitempty"`
+	BatchesFetched  int        `json:"batchesFetched"`
+	EntriesFetched  int        `json:"entriesFetched"`
+	EntriesInserted int        `json:"entriesInserted"`
+	Errors          []string   `json:"errors"`
+}
+
+func (j *ImportJobs) start() *importJob {
+	j.jobsLock.Lock()
+	defer j.jobsLock.Unlock()
+
+	now := time.Now()
+	for id, job := range j.jobs {
+		finishedAt := job.snapshot().FinishedAt
+		if finishedAt != nil && now.Sub(*finishedAt) > importJobRetention {
+			delete(j.jobs, id)
+		}
+	}
+
+	job := &importJob{adminNotifies: j.AdminNotifies, status: APIV1ImportStatusResponse{
+		ID:        ulid.Make().String(),
+		State:     "running",
+		StartedAt: now,
+		Errors:    []string{},
+	}}
+	j.jobs[job.status.ID] = job
+	return job
+}
+
+func (j *ImportJobs) get(id string) (*importJob, bool) {
+	j.jobsLock.Lock()
+	defer j.jobsLock.Unlock()
+	job, ok := j.jobs[id]
+	return job, ok
+}
+
+func (job *importJob) snapshot() APIV1ImportStatusResponse {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	status := job.status
+	status.Errors = slices.Clone(job.status.Errors)
+	return status
+}
+
+func (job *importJob) update(fn func(status *APIV1ImportStatusResponse)) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	fn(&job.status)
+}
+
+// finish marks the job as done, or failed if err is not nil. Non-fatal
+// errors may already have been recorded. Failures other than being
+// interrupted by shutdown are shown to admins.
+func (job *importJob) finish(err error) {
+	if err != nil && !errors.Is(err, errImportInterrupted) {
+		job.adminNotifies.Add("Import failed", err.Error())
+	}
+	job.update(func(status *APIV1ImportStatusResponse) {
+		now := time.Now()
+		status.FinishedAt = &now
+		status.State = "done"
+		if err != nil {
+			status.State = "failed"
+			status.Errors = append(status.Errors, err.Error())
+		}
+	})
+}
+
+// ImportNightscoutEntries starts importing all entries from a remote
+// nightscout instance. A large import can take minutes, so it runs in the
+// background: we respond with a job id whose progress can be polled via
+// ImportStatus.
+func (a ApiV1) ImportNightscoutEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	nsCfg, ok := a.decodeImportNSRequest(w, r)
+	if !ok {
+		return
+	}
+
+	job := a.ImportJobs.start()
+	a.ImportJobs.run(ctx, job, func(ctx context.Context) {
+		a.runNightscoutImport(ctx, job, nsCfg)
+	})
+
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, job.snapshot())
+}
+
+// csvImportMaxBytes limits csv uploads. A year of 5-minute Clarity readings
+// is around 15MB.
+const csvImportMaxBytes = 64 << 20
+
+type APIV1ImportCSVResponse struct {
+	Format          string `json:"format"` // "clarity" or "libreview"
+	EntriesRead     int    `json:"entriesRead"`
+	EntriesInserted int    `json:"entriesInserted"`
+}
+
+// ImportCSVEntries imports readings from a Dexcom Clarity or LibreView csv
+// export, sent as the request body or as the "file" field of a multipart
+// form. Export times are local, so clients should pass the timezone they were
+// recorded in as ?tz= (default UTC).
+func (a ApiV1) ImportCSVEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	loc := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			log.Debug("bad timezone", slog.String("tz", tz))
+			a.httpError(w, "unknown timezone", http.StatusBadRequest)
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, csvImportMaxBytes)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			log.Debug("cannot read csv upload", slog.Any("err", err))
+			a.httpError(w, "missing file", http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		body = f
+	}
+
+	format, entries, err := a.CSVRepository.ParseCSVEntries(ctx, body, loc)
+	if err != nil {
+		if errors.Is(err, repository.ErrUnknownCSVFormat) {
+			a.httpError(w, "unrecognised csv, expected a Dexcom Clarity or LibreView export", http.StatusBadRequest)
+			return
+		}
+		log.Info("cannot parse csv", slog.String("format", format), slog.Any("err", err))
+		a.httpError(w, "cannot parse csv", http.StatusBadRequest)
+		return
+	}
+
+	insertedEntries := a.EntryRepository.CreateEntries(ctx, entries)
+	log.Info("imported entries from csv",
+		slog.String("format", format),
+		slog.Int("numRead", len(entries)),
+		slog.Int("numEntries", len(insertedEntries)),
+	)
+	render.JSON(w, r, APIV1ImportCSVResponse{
+		Format:          format,
+		EntriesRead:     len(entries),
+		EntriesInserted: len(insertedEntries),
+	})
+}
+
+// archiveImportMaxBytes limits archive uploads. A year file of 1-minute
+// readings is around 90MB.
+const archiveImportMaxBytes = 128 << 20
+
+type APIV1ImportArchiveResponse struct {
+	EntriesRead     int `json:"entriesRead"`
+	EntriesInserted int `json:"entriesInserted"`
+}
+
+// ImportArchiveEntries imports a day, month or year file as stored in the
+// bucket, eg ns-month/2024-11.json from another nightscout-go instance.
+// Oids are kept, and entries we already have are skipped, so importing
+// overlapping files is harmless. Compressed files must be decompressed first.
+func (a ApiV1) ImportArchiveEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	r.Body = http.MaxBytesReader(w, r.Body, archiveImportMaxBytes)
+	entries, err := a.ArchiveRepository.ParseArchiveEntries(ctx, r.Body)
+	if err != nil {
+		log.Info("cannot parse archive", slog.Any("err", err))
+		a.httpError(w, "cannot parse archive, expected a day, month or year file", http.StatusBadRequest)
+		return
+	}
+
+	insertedEntries := a.EntryRepository.CreateEntries(ctx, entries)
+	log.Info("imported entries from archive",
+		slog.Int("numRead", len(entries)),
+		slog.Int("numEntries", len(insertedEntries)),
+	)
+	render.JSON(w, r, APIV1ImportArchiveResponse{
+		EntriesRead:     len(entries),
+		EntriesInserted: len(insertedEntries),
+	})
+}
+
+const (
+	jsonlImportChunkSize = 1000
+	jsonlMaxLineBytes    = 64 * 1024
+	jsonlMaxErrors       = 100
+)
+
+type APIV1ImportJSONLResponse struct {
+	LinesRead       int      `json:"linesRead"`
+	EntriesInserted int      `json:"entriesInserted"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
+// ImportJSONLEntries imports entries sent as newline-delimited json, one
+// entry per line in the same format as POST /entries. Entries are inserted in
+// chunks as they are read, so very large histories need not be held in memory.
+// Earlier chunks are kept if a later line is invalid: bad lines are skipped
+// and reported, and re-sending the file is harmless as entries are de-duped.
+func (a ApiV1) ImportJSONLEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	var res APIV1ImportJSONLResponse
+	addError := func(msg string) {
+		if len(res.Errors) < jsonlMaxErrors {
+			res.Errors = append(res.Errors, msg)
+		}
+	}
+
+	chunk := make([]models.Entry, 0, jsonlImportChunkSize)
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		inserted := a.EntryRepository.CreateEntries(ctx, chunk)
+		res.EntriesInserted += len(inserted)
+		chunk = make([]models.Entry, 0, jsonlImportChunkSize)
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 4096), jsonlMaxLineBytes)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		res.LinesRead++
+
+		var reqEntry APIV1EntryRequest
+		err := json.Unmarshal(line, &reqEntry)
+		if err != nil {
+			addError(fmt.Sprintf("line %d: invalid json", lineNum))
+			continue
+		}
+		entry, err := entryFromRequest(reqEntry, time.Now())
+		if err != nil {
+			addError(fmt.Sprintf("line %d: %s", lineNum, err))
+			continue
+		}
+		chunk = append(chunk, entry)
+		if len(chunk) == jsonlImportChunkSize {
+			flush()
+		}
+	}
+	flush()
+
+	err := scanner.Err()
+	if err != nil {
+		// entries before this point have been stored, report what we did
+		log.Info("cannot read jsonl import", slog.Int("line", lineNum), slog.Any("err", err))
+		addError(fmt.Sprintf("line %d: cannot read request body", lineNum+1))
+	}
+
+	log.Info("imported entries from jsonl",
+		slog.Int("numLines", res.LinesRead),
+		slog.Int("numEntries", res.EntriesInserted),
+		slog.Int("numErrors", len(res.Errors)),
+	)
+	render.JSON(w, r, res)
+}
+
+// ImportStatus reports the progress of an import job
+func (a ApiV1) ImportStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.ImportJobs.get(chi.URLParam(r, "id"))
+	if !ok {
+		a.httpError(w, "not found", http.StatusNotFound)
+		return
+	}
+	render.JSON(w, r, job.snapshot())
+}
+
+func (a ApiV1) runNightscoutImport(ctx context.Context, job *importJob, nsCfg repository.NightscoutConfig) {
+	log := slogctx.FromCtx(ctx).With(slog.String("importJob", job.snapshot().ID))
+
+	cursor := models.ImportCursor{Source: nsCfg.URL.Host}
+	previous, err := a.ImportCursorRepository.FetchImportCursor(ctx, cursor.Source)
+	if err == nil && !previous.Complete {
+		cursor = *previous
+		job.update(func(status *APIV1ImportStatusResponse) {
+			status.ResumedFrom = &previous.Before
+		})
+		log.Info("resuming import from remote nightscout instance", slog.Time("before", cursor.Before))
+	} else if err != nil && !errors.Is(err, models.ErrNotFound) {
+		log.Warn("cannot fetch import cursor, starting from latest entries", slog.Any("err", err))
+	}
+
+	// We receive entries from ns in most-recent-first order, each batch
+	// older than the last.
+	complete := false
+	for i := 0; i < importMaxBatches; i++ {
+		batch, err := a.NightscoutRepository.FetchEntriesBefore(ctx, nsCfg, cursor.Before, importBatchSize)
+		if ctx.Err() != nil {
+			// the cursor has not moved past this batch, so it is fetched
+			// again when the import resumes
+			log.Info("import interrupted", slog.Time("before", cursor.Before))
+			job.finish(errImportInterrupted)
+			return
+		}
+		if err != nil {
+			log.Info("cannot fetch entries from ns", slog.Any("err", err))
+			job.finish(errors.New("cannot fetch entries from remote nightscout instance"))
+			return
+		}
+		job.update(func(status *APIV1ImportStatusResponse) {
+			status.BatchesFetched++
+			status.EntriesFetched += len(batch)
+		})
+
+		if len(batch) > 0 {
+			oldest := batch[len(batch)-1].Time
+
+			// Pass entries to CreateEntries in ascending date order for
+			// slight speedup
+			slices.Reverse(batch)
+			insertedEntries := a.EntryRepository.CreateEntries(ctx, batch)
+			job.update(func(status *APIV1ImportStatusResponse) {
+				status.EntriesInserted += len(insertedEntries)
+			})
+
+			// Save the cursor this batch was fetched from, not its oldest
+			// entry: entries reach the bucket asynchronously, so if we are
+			// interrupted we re-fetch the latest batch and let dedupe
+			// discard whatever was already stored.
+			cursor.EntriesFetched += len(batch)
+			a.saveImportCursor(ctx, cursor)
+			cursor.Before = oldest
+		}
+
+		if len(batch) < importBatchSize {
+			complete = true
+			break
+		}
+	}
+
+	if complete {
+		cursor.Complete = true
+		a.saveImportCursor(ctx, cursor)
+	} else {
+		job.update(func(status *APIV1ImportStatusResponse) {
+			status.Errors = append(status.Errors, "import stopped early, start it again to continue")
+		})
+	}
+	log.Info("imported entries from remote nightscout instance",
+		slog.Int("numFetched", job.snapshot().EntriesFetched),
+		slog.Int("numEntries", job.snapshot().EntriesInserted),
+		slog.Bool("complete", complete),
+	)
+
+	// Profiles and device statuses round out a migration. Older instances or
+	// read-only tokens may not expose them, so failures are not fatal.
+	for _, importFn := range []func(context.Context, repository.NightscoutConfig) error{
+		a.importNightscoutProfiles,
+		a.importNightscoutDeviceStatus,
+	} {
+		err := importFn(ctx, nsCfg)
+		if err != nil {
+			job.update(func(status *APIV1ImportStatusResponse) {
+				status.Errors = append(status.Errors, err.Error())
+			})
+		}
+	}
+	job.finish(nil)
+}
+
+// saveImportCursor persists the cursor. Failure is not fatal, it only means
+// an interrupted import cannot resume.
+func (a ApiV1) saveImportCursor(ctx context.Context, cursor models.ImportCursor) {
+	err := a.ImportCursorRepository.SaveImportCursor(ctx, cursor)
+	if err != nil {
+		slogctx.FromCtx(ctx).Warn("cannot save import cursor", slog.Any("err", err))
+	}
+}
+
+type ImportNSRequest struct {
+	Url       string `json:"url"`
+	Token     string `json:"token"`
+	APISecret string `json:"api_secret"`
+}
+
+// importDeviceStatusLookback limits device status import to recent
+// statuses: they describe the current state of pumps and loops, history is
+// rarely interesting.
+const importDeviceStatusLookback = 48 * time.Hour
+
+func (a ApiV1) importNightscoutProfiles(ctx context.Context, nsCfg repository.NightscoutConfig) error {
+	log := slogctx.FromCtx(ctx)
+
+	profiles, err := a.NightscoutRepository.FetchProfiles(ctx, nsCfg)
+	if err != nil {
+		log.Info("cannot fetch profiles from ns", slog.Any("err", err))
+		return errors.New("cannot fetch profiles from remote nightscout instance")
+	}
+	insertedProfiles, err := a.ProfileRepository.CreateProfiles(ctx, profiles)
+	if err != nil {
+		log.Warn("cannot store profiles from ns", slog.Any("err", err))
+		return errors.New("cannot store profiles")
+	}
+	log.Info("imported profiles from remote nightscout instance", slog.Int("numProfiles", len(insertedProfiles)))
+	return nil
+}
+
+func (a ApiV1) importNightscoutDeviceStatus(ctx context.Context, nsCfg repository.NightscoutConfig) error {
+	log := slogctx.FromCtx(ctx)
+
+	statuses, err := a.NightscoutRepository.FetchDeviceStatusSince(ctx, nsCfg, time.Now().Add(-importDeviceStatusLookback))
+	if err != nil {
+		log.Info("cannot fetch device statuses from ns", slog.Any("err", err))
+		return errors.New("cannot fetch device statuses from remote nightscout instance")
+	}
+	insertedStatuses, err := a.DeviceStatusRepository.CreateDeviceStatuses(ctx, statuses)
+	if err != nil {
+		log.Warn("cannot store device statuses from ns", slog.Any("err", err))
+		return errors.New("cannot store device statuses")
+	}
+	log.Info("imported device statuses from remote nightscout instance", slog.Int("numDeviceStatuses", len(insertedStatuses)))
+	return nil
+}
+
+// ImportNightscoutTreatments copies all treatments (boluses, carbs, sensor
+// changes etc) from a remote nightscout instance. Treatments we already have
+// (by oid) are skipped, so an import can safely be re-run.
+func (a ApiV1) ImportNightscoutTreatments(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	nsCfg, ok := a.decodeImportNSRequest(w, r)
+	if !ok {
+		return
+	}
+
+	treatments, err := a.FetchAllTreatments(ctx, nsCfg)
+	if err != nil {
+		log.Info("cannot fetch treatments from ns", slog.Any("err", err))
+		a.httpError(w, "Cannot fetch treatments from remote nightscout instance", http.StatusBadRequest)
+		return
+	}
+
+	// We receive treatments from ns in most-recent-first order. Pass them to
+	// CreateTreatments in ascending date order, as for entries
+	var newTreatments []models.Treatment
+	for i := len(treatments) - 1; i >= 0; i-- {
+		t := treatments[i]
+		if t.ID != "" {
+			_, err := a.TreatmentRepository.FetchTreatmentByOid(ctx, t.ID)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, models.ErrNotFound) {
+				log.Warn("cannot check for existing treatment", slog.Any("error", err))
+				a.httpError(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		newTreatments = append(newTreatments, t)
+	}
+
+	insertedTreatments := a.TreatmentRepository.CreateTreatments(ctx, newTreatments)
+	log.Info("imported treatments from remote nightscout instance",
+		slog.Int("numFetched", len(treatments)),
+		slog.Int("numTreatments", len(insertedTreatments)),
+	)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// decodeImportNSRequest validates an ImportNSRequest. If it returns false an
+// error response has already been sent.
+func (a ApiV1) decodeImportNSRequest(w http.ResponseWriter, r *http.Request) (repository.NightscoutConfig, bool) {
+	log := slogctx.FromCtx(r.Context())
+
+	// TODO look at https://grafana.com/blog/2024/02/09/how-i-write-http-services-in-go-after-13-years/#validating-data
+	// pattern for validation
+	var req ImportNSRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		a.httpError(w, "invalid request body", http.StatusBadRequest)
+		return repository.NightscoutConfig{}, false
+	}
+	if req.Url == "" {
+		log.Debug("missing url")
+		a.httpError(w, "missing url", http.StatusBadRequest)
+		return repository.NightscoutConfig{}, false
+	}
+
+	nsUrl, err := url.Parse(req.Url)
+	if err != nil {
+		// Pretty rare, Parse is very lax. ":" seems to work :)
+		log.Debug("bad url: parse fail", slog.String("url", req.Url))
+		a.httpError(w, "bad url", http.StatusBadRequest)
+		return repository.NightscoutConfig{}, false
+	}
+	if nsUrl.Scheme != "http" && nsUrl.Scheme != "https" {
+		log.Debug("bad url: unsupported scheme", slog.String("url", req.Url))
+		a.httpError(w, "url must be http/https", http.StatusBadRequest)
+		return repository.NightscoutConfig{}, false
+	}
+	if nsUrl.Host == "" {
+		log.Debug("bad url: no host", slog.String("url", req.Url))
+		a.httpError(w, "url must include a hostname", http.StatusBadRequest)
+		return repository.NightscoutConfig{}, false
+	}
+
+	if req.Token == "" && req.APISecret == "" {
+		log.Debug("missing credentials", slog.String("token", req.Token), slog.String("api_secret", req.APISecret))
+		a.httpError(w, "token or api_secret must be supplied", http.StatusBadRequest)
+		return repository.NightscoutConfig{}, false
+	}
+	if req.APISecret != "" && len(req.APISecret) < 12 {
+		log.Debug("credentials: api_secret too short", slog.String("api_secret", req.APISecret))
+		a.httpError(w, "api_secret must be at least 12 characters long", http.StatusBadRequest)
+		return repository.NightscoutConfig{}, false
+	}
+
+	// name-<16 hexits>
+	if req.Token != "" && len(req.Token) < 17 {
+		log.Debug("credentials: token too short", slog.String("api_secret", req.APISecret))
+		a.httpError(w, "token must be at least 17 characters long", http.StatusBadRequest)
+		return repository.NightscoutConfig{}, false
+	}
+
+	u := &url.URL{Scheme: nsUrl.Scheme, Host: nsUrl.Host}
+
+	return repository.NightscoutConfig{
+		URL:       u,
+		Token:     req.Token,
+		APISecret: req.APISecret,
+	}, true
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"context"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ProxyAuth trusts users authenticated by a reverse proxy such as Authelia or
+// oauth2-proxy, so the web ui needs no token. Their groups are mapped to
+// roles. The headers are only believed from TrustedProxies (and, with
+// UnixSocket, from a proxy connecting over a unix socket), as anyone else can
+// set them.
+type ProxyAuth struct {
+	TrustedProxies []netip.Prefix
+	UnixSocket     bool
+	UserHeader     string // eg X-Forwarded-User
+	GroupsHeader   string // eg X-Forwarded-Groups, comma-separated
+	GroupRoles     map[string][]string
+}
+
+// authSubject returns the user the proxy authenticated, or false if the
+// request did not come through a trusted proxy or it did not authenticate a
+// user
+func (p *ProxyAuth) authSubject(r *http.Request) (*models.AuthSubject, bool) {
+	if p == nil {
+		return nil, false
+	}
+	user := r.Header.Get(p.UserHeader)
+	if user == "" {
+		return nil, false
+	}
+	if !p.isTrusted(r) {
+		log := slogctx.FromCtx(r.Context())
+		log.Warn("ignoring proxy auth headers from untrusted address", slog.String("remoteAddr", r.RemoteAddr), slog.String("user", user))
+		return nil, false
+	}
+
+	roleNames := []string{}
+	for _, group := range strings.Split(r.Header.Get(p.GroupsHeader), ",") {
+		for _, role := range p.GroupRoles[strings.TrimSpace(group)] {
+			if !slices.Contains(roleNames, role) {
+				roleNames = append(roleNames, role)
+			}
+		}
+	}
+	return &models.AuthSubject{Name: user, RoleNames: roleNames}, true
+}
+
+func (p *ProxyAuth) isTrusted(r *http.Request) bool {
+	if fromUnixSocket(r) {
+		return p.UnixSocket
+	}
+	addr, ok := parseHostAddr(r.RemoteAddr)
+	return ok && isTrustedProxy(p.TrustedProxies, addr)
+}
+
+type unixSocketKey struct{}
+
+// UnixSocketConnContext is an http.Server ConnContext that marks connections
+// accepted on a unix socket. They have no client address, and only a local
+// reverse proxy can connect (see SERVER_SOCKET_MODE), so they are treated as
+// coming from a trusted proxy.
+func UnixSocketConnContext(ctx context.Context, c net.Conn) context.Context {
+	if c.LocalAddr().Network() == "unix" {
+		return context.WithValue(ctx, unixSocketKey{}, true)
+	}
+	return ctx
+}
+
+// fromUnixSocket reports whether r was received on a unix socket
+func fromUnixSocket(r *http.Request) bool {
+	unix, _ := r.Context().Value(unixSocketKey{}).(bool)
+	return unix
+}
+
+// parseHostAddr returns the address of a host:port, eg http.Request.RemoteAddr
+func parseHostAddr(hostport string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func isTrustedProxy(trusted []netip.Prefix, addr netip.Addr) bool {
+	return slices.ContainsFunc(trusted, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
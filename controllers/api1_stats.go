@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/adamlounds/nightscout-go/i18n"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/render"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// statsMaxDays limits how far back statistics look, so the sgvs they need
+// fit comfortably in memory
+const statsMaxDays = 90
+
+// statsMaxEntries is enough sgvs for statsMaxDays of 1-minute readings from
+// two sources
+const statsMaxEntries = statsMaxDays * 24 * 60 * 2
+
+// APIV1TimeInRangeResponse is the percentage of sgvs in each band of the
+// configured thresholds, for sharing with clinicians. See
+// models.TimeInRange for the bands.
+type APIV1TimeInRangeResponse struct {
+	From       string            `json:"from"`
+	To         string            `json:"to"`
+	Days       int               `json:"days"`
+	Readings   int               `json:"readings"`
+	Thresholds models.Thresholds `json:"thresholds"` // mg/dL
+	VeryLow    float64           `json:"veryLow"`
+	Low        float64           `json:"low"`
+	Below      float64           `json:"below"`
+	InRange    float64           `json:"inRange"`
+	Above      float64           `json:"above"`
+	High       float64           `json:"high"`
+	VeryHigh   float64           `json:"veryHigh"`
+}
+
+// TimeInRange handles /api/v1/stats/tir?days=14, judging the sgvs of the
+// last days against the configured thresholds
+func (a ApiV1) TimeInRange(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+	days, ok := a.daysParam(w, r, 14)
+	if !ok {
+		return
+	}
+	to := time.Now()
+	from := to.AddDate(0, 0, -days)
+	sgvs, err := a.FetchEntriesBetween(ctx, from, to, "sgv", statsMaxEntries)
+	if err != nil {
+		log.Warn("cannot fetch sgvs for time in range", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	thresholds := a.Settings.Load().Thresholds
+	tir := thresholds.TimeInRange(sgvs)
+	render.JSON(w, r, APIV1TimeInRangeResponse{
+		From:       from.UTC().Format(rfc3339msLayout),
+		To:         to.UTC().Format(rfc3339msLayout),
+		Days:       days,
+		Readings:   tir.Readings,
+		Thresholds: thresholds,
+		VeryLow:    tir.VeryLow,
+		Low:        tir.Low,
+		Below:      tir.Below,
+		InRange:    tir.InRange,
+		Above:      tir.Above,
+		High:       tir.High,
+		VeryHigh:   tir.VeryHigh,
+	})
+}
+
+// daysParam returns the days query parameter, or def. If it is invalid it
+// replies with an error and returns false.
+func (a ApiV1) daysParam(w http.ResponseWriter, r *http.Request, def int) (int, bool) {
+	raw := r.URL.Query().Get("days")
+	if raw == "" {
+		return def, true
+	}
+	days, err := strconv.Atoi(raw)
+	if err != nil || days < 1 {
+		a.httpError(w, "days must be an integer >= 1", http.StatusBadRequest)
+		return 0, false
+	}
+	if days > statsMaxDays {
+		msg := fmt.Sprintf(i18n.New(a.Settings.Load().Language).T("days must be <= %d"), statsMaxDays)
+		http.Error(w, msg, http.StatusBadRequest)
+		return 0, false
+	}
+	return days, true
+}
+
+// APIV1GMIResponse is the mean glucose of a period and the HbA1c it
+// suggests, see models.GlucoseMean. Everything is zero without readings.
+type APIV1GMIResponse struct {
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	Days     int     `json:"days"`
+	Readings int     `json:"readings"`
+	MeanMgdl int     `json:"meanMgdl"`
+	Mean     float64 `json:"mean"` // in units
+	Units    string  `json:"units"`
+	GMI      float64 `json:"gmi"`  // %
+	EA1c     float64 `json:"eA1c"` // %
+}
+
+// GMI handles /api/v1/stats/gmi?days=90, the mean glucose of the last days
+// and the GMI and eA1c from it
+func (a ApiV1) GMI(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+	days, ok := a.daysParam(w, r, 90)
+	if !ok {
+		return
+	}
+	to := time.Now()
+	from := to.AddDate(0, 0, -days)
+	sgvs, err := a.FetchEntriesBetween(ctx, from, to, "sgv", statsMaxEntries)
+	if err != nil {
+		log.Warn("cannot fetch sgvs for gmi", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	units := a.Settings.Load().Units
+	mean := models.MeanGlucose(sgvs)
+	render.JSON(w, r, APIV1GMIResponse{
+		From:     from.UTC().Format(rfc3339msLayout),
+		To:       to.UTC().Format(rfc3339msLayout),
+		Days:     days,
+		Readings: mean.Readings,
+		MeanMgdl: mean.MeanMgdl,
+		Mean:     scaleMgdl(units, mean.MeanMgdl),
+		Units:    units,
+		GMI:      mean.GMI,
+		EA1c:     mean.EA1c,
+	})
+}
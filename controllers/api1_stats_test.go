@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiV1_TimeInRange(t *testing.T) {
+	var gotFrom, gotTo time.Time
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			fetchBetweenFn: func(ctx context.Context, from, to time.Time, entryType string, maxEntries int) ([]models.Entry, error) {
+				gotFrom, gotTo = from, to
+				assert.Equal(t, "sgv", entryType)
+				return []models.Entry{
+					{Type: "sgv", SgvMgdl: 50},
+					{Type: "sgv", SgvMgdl: 100},
+					{Type: "sgv", SgvMgdl: 120},
+					{Type: "sgv", SgvMgdl: 200},
+				}, nil
+			},
+		},
+		Settings: NewLiveSettings(Settings{Thresholds: models.DefaultThresholds}),
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantDays int
+	}{
+		{name: "default", query: "", wantCode: http.StatusOK, wantDays: 14},
+		{name: "days", query: "?days=30", wantCode: http.StatusOK, wantDays: 30},
+		{name: "not a number", query: "?days=a", wantCode: http.StatusBadRequest},
+		{name: "zero", query: "?days=0", wantCode: http.StatusBadRequest},
+		{name: "too many", query: "?days=91", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/stats/tir"+tt.query, nil).WithContext(contextWithSilentLogger())
+			w := httptest.NewRecorder()
+			api.TimeInRange(w, r)
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			assert.Equal(t, tt.wantDays, int(gotTo.Sub(gotFrom).Round(time.Hour).Hours()/24))
+			var response APIV1TimeInRangeResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+			assert.Equal(t, APIV1TimeInRangeResponse{
+				From:       gotFrom.UTC().Format(rfc3339msLayout),
+				To:         gotTo.UTC().Format(rfc3339msLayout),
+				Days:       tt.wantDays,
+				Readings:   4,
+				Thresholds: models.DefaultThresholds,
+				VeryLow:    25,
+				Below:      25,
+				InRange:    50,
+				Above:      25,
+				High:       25,
+			}, response)
+		})
+	}
+}
+
+func TestApiV1_GMI(t *testing.T) {
+	var gotFrom, gotTo time.Time
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			fetchBetweenFn: func(ctx context.Context, from, to time.Time, entryType string, maxEntries int) ([]models.Entry, error) {
+				gotFrom, gotTo = from, to
+				assert.Equal(t, "sgv", entryType)
+				assert.GreaterOrEqual(t, maxEntries, statsMaxDays*24*60, "room for 1-minute readings")
+				return []models.Entry{
+					{Type: "sgv", SgvMgdl: 120},
+					{Type: "sgv", SgvMgdl: 188},
+				}, nil
+			},
+		},
+		Settings: NewLiveSettings(Settings{Units: models.UnitsMmol}),
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/stats/gmi", nil).WithContext(contextWithSilentLogger())
+	w := httptest.NewRecorder()
+	api.GMI(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 90, int(gotTo.Sub(gotFrom).Round(time.Hour).Hours()/24))
+
+	var response APIV1GMIResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, APIV1GMIResponse{
+		From:     gotFrom.UTC().Format(rfc3339msLayout),
+		To:       gotTo.UTC().Format(rfc3339msLayout),
+		Days:     90,
+		Readings: 2,
+		MeanMgdl: 154,
+		Mean:     8.5,
+		Units:    models.UnitsMmol,
+		GMI:      7.0,
+		EA1c:     7.0,
+	}, response)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/v1/stats/gmi?days=365", nil).WithContext(contextWithSilentLogger())
+	w = httptest.NewRecorder()
+	api.GMI(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
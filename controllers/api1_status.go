@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"github.com/adamlounds/nightscout-go/middleware"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/render"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// nightscoutVersion is the cgm-remote-monitor version we aim to be compatible
+// with. Some clients decide which api features to use based on this.
+const nightscoutVersion = "15.0.2"
+
+// Settings holds the server settings advertised to clients via status
+type Settings struct {
+	Units            string            `json:"units"` // models.UnitsMgdl or models.UnitsMmol
+	Language         string            `json:"language"`
+	Thresholds       models.Thresholds `json:"thresholds"`
+	Enable           []string          `json:"enable"`
+	ShowPlugins      string            `json:"showPlugins"`  // space-separated, as nightscout
+	ShowForecast     string            `json:"showForecast"` // space-separated, eg ar2
+	AuthDefaultRoles string            `json:"authDefaultRoles"`
+	AuthFailDelay    int64             `json:"authFailDelay"` // ms
+	// not advertised, used for iob and cob when the profile does not say
+	Insulin            models.InsulinModel      `json:"-"`
+	CarbAbsorptionRate float64                  `json:"-"` // g/hour
+	UploaderBattery    models.BatteryThresholds `json:"-"`
+	TreatmentTypes     models.TreatmentTypes    `json:"-"` // validates new treatments
+	BGCheckMbg         bool                     `json:"-"` // store BG Checks as mbg entries too
+	APISecretHashOnly  bool                     `json:"-"` // reject the api secret sent unhashed
+}
+
+// IsEnabled reports whether a plugin is in ENABLE
+func (s Settings) IsEnabled(plugin string) bool {
+	return slices.Contains(s.Enable, plugin)
+}
+
+// LiveSettings holds the current Settings, which may be replaced while the
+// server is running, eg when config is reloaded
+type LiveSettings struct {
+	settings atomic.Pointer[Settings]
+}
+
+func NewLiveSettings(s Settings) *LiveSettings {
+	l := &LiveSettings{}
+	l.Store(s)
+	return l
+}
+
+// Load returns the current settings. A nil LiveSettings has the zero Settings.
+func (l *LiveSettings) Load() Settings {
+	if l == nil {
+		return Settings{}
+	}
+	return *l.settings.Load()
+}
+
+func (l *LiveSettings) Store(s Settings) {
+	l.settings.Store(&s)
+}
+
+type APIV1StatusResponse struct {
+	Status            string                 `json:"status"`
+	Name              string                 `json:"name"`
+	Version           string                 `json:"version"`
+	ServerTime        string                 `json:"serverTime"`
+	ServerTimeEpoch   int64                  `json:"serverTimeEpoch"`
+	APIEnabled        bool                   `json:"apiEnabled"`
+	CareportalEnabled bool                   `json:"careportalEnabled"`
+	BoluscalcEnabled  bool                   `json:"boluscalcEnabled"`
+	Settings          Settings               `json:"settings"`
+	ExtendedSettings  map[string]interface{} `json:"extendedSettings"`
+	Authorized        *APIV1StatusAuthorized `json:"authorized"`
+}
+
+// APIV1StatusAuthorized mirrors the decoded token nightscout-js returns in
+// status when a token is supplied.
+type APIV1StatusAuthorized struct {
+	Token            string     `json:"token"`
+	Sub              string     `json:"sub"`
+	PermissionGroups [][]string `json:"permissionGroups"`
+	Iat              int64      `json:"iat"` // seconds since epoch
+	Exp              int64      `json:"exp"` // seconds since epoch
+}
+
+// Status handler supports /api/v1/status endpoint
+func (a ApiV1) Status(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	now := time.Now()
+	settings := a.Settings.Load()
+
+	response := APIV1StatusResponse{
+		Status:            "ok",
+		Name:              "nightscout",
+		Version:           nightscoutVersion,
+		ServerTime:        now.UTC().Format(rfc3339msLayout),
+		ServerTimeEpoch:   now.UnixMilli(),
+		APIEnabled:        true,
+		CareportalEnabled: settings.IsEnabled("careportal"),
+		BoluscalcEnabled:  settings.IsEnabled("boluscalc"),
+		Settings:          settings,
+		ExtendedSettings:  map[string]interface{}{},
+	}
+
+	// nb authorized is only populated for tokens, not for api-secret authn
+	authn := middleware.GetAuthn(ctx)
+	if authn != nil && authn.AuthToken != "" && !authn.AuthSubject.IsAnonymous() {
+		response.Authorized = &APIV1StatusAuthorized{
+			Token:            authn.AuthToken,
+			Sub:              authn.AuthSubject.Name,
+			PermissionGroups: a.PermissionGroups(ctx, authn.AuthSubject),
+			Iat:              now.Unix(),
+			Exp:              now.Add(models.JWTLifetime).Unix(),
+		}
+	}
+
+	render.JSON(w, r, response)
+}
@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/adamlounds/nightscout-go/middleware"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mockAuthService struct {
+	permissionGroupsFn func(ctx context.Context, authSubject *models.AuthSubject) [][]string
+	issueJWTFn         func(ctx context.Context, accessToken string, now time.Time) (*models.JWT, error)
+	isPermittedFn      func(ctx context.Context, authn *models.Authn, requiredPermission string) bool
+}
+
+func (m mockAuthService) PermissionGroups(ctx context.Context, authSubject *models.AuthSubject) [][]string {
+	return m.permissionGroupsFn(ctx, authSubject)
+}
+
+func (m mockAuthService) IssueJWT(ctx context.Context, accessToken string, now time.Time) (*models.JWT, error) {
+	return m.issueJWTFn(ctx, accessToken, now)
+}
+
+func (m mockAuthService) IsPermitted(ctx context.Context, authn *models.Authn, requiredPermission string) bool {
+	if m.isPermittedFn == nil {
+		return false
+	}
+	return m.isPermittedFn(ctx, authn, requiredPermission)
+}
+
+func TestApiV1_Status(t *testing.T) {
+	tests := []struct {
+		name             string
+		authn            *models.Authn
+		expectAuthorized bool
+	}{
+		{
+			name:             "no authn",
+			authn:            nil,
+			expectAuthorized: false,
+		},
+		{
+			name: "anonymous",
+			authn: &models.Authn{
+				AuthSubject: &models.AuthSubject{Name: "anonymous"},
+			},
+			expectAuthorized: false,
+		},
+		{
+			name: "api secret",
+			authn: &models.Authn{
+				ApiSecretHash: "abc",
+				AuthSubject:   &models.AuthSubject{Name: "admin", RoleNames: []string{"admin"}},
+			},
+			expectAuthorized: false,
+		},
+		{
+			name: "token",
+			authn: &models.Authn{
+				AuthToken:   "ffs-358de43470f328f3",
+				AuthSubject: &models.AuthSubject{Name: "ffs", RoleNames: []string{"cgm-uploader"}},
+			},
+			expectAuthorized: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := ApiV1{
+				AuthService: mockAuthService{
+					permissionGroupsFn: func(ctx context.Context, authSubject *models.AuthSubject) [][]string {
+						return [][]string{{"api:entries:read", "api:entries:create"}}
+					},
+				},
+				Settings: NewLiveSettings(Settings{Units: "mmol", Thresholds: models.DefaultThresholds, Enable: []string{"careportal"}, AuthDefaultRoles: "readable"}),
+			}
+
+			req := httptest.NewRequest("GET", "/api/v1/status.json", nil)
+			if tt.authn != nil {
+				req = req.WithContext(middleware.WithAuthn(req.Context(), tt.authn))
+			}
+			w := httptest.NewRecorder()
+
+			api.Status(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			var response APIV1StatusResponse
+			err := json.NewDecoder(w.Body).Decode(&response)
+			assert.NoError(t, err)
+			assert.Equal(t, "ok", response.Status)
+			assert.Equal(t, "mmol", response.Settings.Units)
+			assert.Equal(t, 180, response.Settings.Thresholds.TargetTop)
+			assert.True(t, response.CareportalEnabled)
+			assert.False(t, response.BoluscalcEnabled)
+
+			if !tt.expectAuthorized {
+				assert.Nil(t, response.Authorized)
+				return
+			}
+			assert.NotNil(t, response.Authorized)
+			assert.Equal(t, "ffs", response.Authorized.Sub)
+			assert.Equal(t, tt.authn.AuthToken, response.Authorized.Token)
+			assert.Equal(t, [][]string{{"api:entries:read", "api:entries:create"}}, response.Authorized.PermissionGroups)
+			assert.Greater(t, response.Authorized.Exp, response.Authorized.Iat)
+		})
+	}
+}
@@ -5,16 +5,22 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	repository "github.com/adamlounds/nightscout-go/adapters"
+	nsmiddleware "github.com/adamlounds/nightscout-go/middleware"
 	"github.com/adamlounds/nightscout-go/models"
+	bucketstore "github.com/adamlounds/nightscout-go/stores/bucket"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
 	slogctx "github.com/veqryn/slog-context"
 	"io"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -25,11 +31,107 @@ func contextWithSilentLogger() context.Context {
 }
 
 type mockNightscoutRepository struct {
-	fetchAllEntriesFn func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Entry, error)
+	fetchEntriesBeforeFn func(ctx context.Context, nsCfg repository.NightscoutConfig, before time.Time, count int) ([]models.Entry, error)
+	fetchAllTreatmentsFn func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Treatment, error)
+	fetchProfilesFn      func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Profile, error)
+	fetchDeviceStatusFn  func(ctx context.Context, nsCfg repository.NightscoutConfig, since time.Time) ([]models.DeviceStatus, error)
 }
 
-func (m mockNightscoutRepository) FetchAllEntries(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Entry, error) {
-	return m.fetchAllEntriesFn(ctx, nsCfg)
+func (m mockNightscoutRepository) FetchEntriesBefore(ctx context.Context, nsCfg repository.NightscoutConfig, before time.Time, count int) ([]models.Entry, error) {
+	return m.fetchEntriesBeforeFn(ctx, nsCfg, before, count)
+}
+func (m mockNightscoutRepository) FetchAllTreatments(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Treatment, error) {
+	return m.fetchAllTreatmentsFn(ctx, nsCfg)
+}
+func (m mockNightscoutRepository) FetchProfiles(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Profile, error) {
+	return m.fetchProfilesFn(ctx, nsCfg)
+}
+func (m mockNightscoutRepository) FetchDeviceStatusSince(ctx context.Context, nsCfg repository.NightscoutConfig, since time.Time) ([]models.DeviceStatus, error) {
+	return m.fetchDeviceStatusFn(ctx, nsCfg, since)
+}
+
+type mockProfileRepository struct {
+	profiles []models.Profile
+}
+
+func (m *mockProfileRepository) FetchProfiles(ctx context.Context) ([]models.Profile, error) {
+	return m.profiles, nil
+}
+func (m *mockProfileRepository) CreateProfiles(ctx context.Context, profiles []models.Profile) ([]models.Profile, error) {
+	m.profiles = append(m.profiles, profiles...)
+	return profiles, nil
+}
+
+type mockImportCursorRepository struct {
+	cursors map[string]models.ImportCursor
+	saved   []models.ImportCursor
+}
+
+func (m *mockImportCursorRepository) FetchImportCursor(ctx context.Context, source string) (*models.ImportCursor, error) {
+	c, ok := m.cursors[source]
+	if !ok {
+		return nil, models.ErrNotFound
+	}
+	return &c, nil
+}
+func (m *mockImportCursorRepository) SaveImportCursor(ctx context.Context, cursor models.ImportCursor) error {
+	m.saved = append(m.saved, cursor)
+	return nil
+}
+
+type mockDeviceStatusRepository struct {
+	statuses []models.DeviceStatus
+}
+
+func (m *mockDeviceStatusRepository) FetchLatestDeviceStatuses(ctx context.Context, maxTime time.Time, maxStatuses int) ([]models.DeviceStatus, error) {
+	return m.statuses, nil
+}
+func (m *mockDeviceStatusRepository) CreateDeviceStatuses(ctx context.Context, statuses []models.DeviceStatus) ([]models.DeviceStatus, error) {
+	m.statuses = append(m.statuses, statuses...)
+	return statuses, nil
+}
+
+type mockTreatmentRepository struct {
+	fetchByOidFn       func(ctx context.Context, oid string) (*models.Treatment, error)
+	createTreatmentsFn func(ctx context.Context, treatments []models.Treatment) []models.Treatment
+	fetchLatestFn      func(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error)
+	fetchAfterFn       func(ctx context.Context, minTime time.Time) ([]models.Treatment, error)
+	updateByOidFn      func(ctx context.Context, oid string, treatment *models.Treatment) error
+	deleteByOidFn      func(ctx context.Context, oid string) error
+}
+
+func (m mockTreatmentRepository) Boot(ctx context.Context) error {
+	return nil
+}
+func (m mockTreatmentRepository) FetchTreatmentByOid(ctx context.Context, oid string) (*models.Treatment, error) {
+	return m.fetchByOidFn(ctx, oid)
+}
+func (m mockTreatmentRepository) DeleteTreatmentByOid(ctx context.Context, oid string) error {
+	if m.deleteByOidFn == nil {
+		return nil
+	}
+	return m.deleteByOidFn(ctx, oid)
+}
+func (m mockTreatmentRepository) FetchLatestTreatments(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error) {
+	if m.fetchLatestFn == nil {
+		return nil, nil
+	}
+	return m.fetchLatestFn(ctx, maxTime, maxTreatments)
+}
+func (m mockTreatmentRepository) FetchTreatmentsAfter(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+	if m.fetchAfterFn == nil {
+		return nil, nil
+	}
+	return m.fetchAfterFn(ctx, minTime)
+}
+func (m mockTreatmentRepository) CreateTreatments(ctx context.Context, treatments []models.Treatment) []models.Treatment {
+	return m.createTreatmentsFn(ctx, treatments)
+}
+func (m mockTreatmentRepository) UpdateTreatmentByOid(ctx context.Context, oid string, treatment *models.Treatment) error {
+	if m.updateByOidFn == nil {
+		return nil
+	}
+	return m.updateByOidFn(ctx, oid, treatment)
 }
 
 type mockEntryRepository struct {
@@ -37,6 +139,8 @@ type mockEntryRepository struct {
 	fetchLatestFn     func(ctx context.Context, maxTime time.Time) (*models.Entry, error)
 	fetchLatestListFn func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error)
 	fetchLatestSGVsFn func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error)
+	fetchBetweenFn    func(ctx context.Context, from, to time.Time, entryType string, maxEntries int) ([]models.Entry, error)
+	fetchMatchingFn   func(ctx context.Context, entry models.Entry) (*models.Entry, error)
 	createEntriesFn   func(ctx context.Context, entries []models.Entry) []models.Entry
 }
 
@@ -52,6 +156,12 @@ func (m mockEntryRepository) FetchLatestEntries(ctx context.Context, maxTime tim
 func (m mockEntryRepository) FetchLatestSGVs(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
 	return m.fetchLatestSGVsFn(ctx, maxTime, maxEntries)
 }
+func (m mockEntryRepository) FetchEntriesBetween(ctx context.Context, from, to time.Time, entryType string, maxEntries int) ([]models.Entry, error) {
+	return m.fetchBetweenFn(ctx, from, to, entryType, maxEntries)
+}
+func (m mockEntryRepository) FetchMatchingEntry(ctx context.Context, entry models.Entry) (*models.Entry, error) {
+	return m.fetchMatchingFn(ctx, entry)
+}
 func (m mockEntryRepository) CreateEntries(ctx context.Context, entries []models.Entry) []models.Entry {
 	return m.createEntriesFn(ctx, entries)
 }
@@ -82,7 +192,8 @@ func TestApiV1_ImportNightscoutEntries(t *testing.T) {
 		requestBody    string
 		expectedStatus int
 		expectedBody   string
-		mockFn         func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Entry, error)
+		expectedState  string
+		mockFn         func(ctx context.Context, nsCfg repository.NightscoutConfig, before time.Time, count int) ([]models.Entry, error)
 	}{
 		{
 			name:           "invalid request body",
@@ -135,8 +246,9 @@ func TestApiV1_ImportNightscoutEntries(t *testing.T) {
 		{
 			name:           "successful import",
 			requestBody:    `{"url": "https://example.com", "token": "sometoken-1234567890abcdef"}`,
-			expectedStatus: http.StatusOK,
-			mockFn: func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Entry, error) {
+			expectedStatus: http.StatusAccepted,
+			expectedState:  "done",
+			mockFn: func(ctx context.Context, nsCfg repository.NightscoutConfig, before time.Time, count int) ([]models.Entry, error) {
 				return []models.Entry{
 					{
 						Time:      time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC),
@@ -158,9 +270,9 @@ func TestApiV1_ImportNightscoutEntries(t *testing.T) {
 		{
 			name:           "nightscout fetch error",
 			requestBody:    `{"url": "https://example.com", "token": "sometoken-1234567890abcdef"}`,
-			expectedStatus: http.StatusBadRequest,
-			expectedBody:   "Cannot fetch entries from remote nightscout instance\n",
-			mockFn: func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Entry, error) {
+			expectedStatus: http.StatusAccepted,
+			expectedState:  "failed",
+			mockFn: func(ctx context.Context, nsCfg repository.NightscoutConfig, before time.Time, count int) ([]models.Entry, error) {
 				return nil, errors.New("fetch failed")
 			},
 		},
@@ -174,14 +286,27 @@ func TestApiV1_ImportNightscoutEntries(t *testing.T) {
 					return entries
 				},
 			}
-			mockNSRepo := &mockNightscoutRepository{}
+			mockNSRepo := &mockNightscoutRepository{
+				fetchProfilesFn: func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Profile, error) {
+					return []models.Profile{{ID: "profile", Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}}, nil
+				},
+				// devicestatus may not be readable, import carries on regardless
+				fetchDeviceStatusFn: func(ctx context.Context, nsCfg repository.NightscoutConfig, since time.Time) ([]models.DeviceStatus, error) {
+					return nil, errors.New("permission denied")
+				},
+			}
 			if tt.mockFn != nil {
-				mockNSRepo.fetchAllEntriesFn = tt.mockFn
+				mockNSRepo.fetchEntriesBeforeFn = tt.mockFn
 			}
+			mockProfileRepo := &mockProfileRepository{}
 
 			api := ApiV1{
-				EntryRepository:      mockEntryRepo,
-				NightscoutRepository: mockNSRepo,
+				EntryRepository:        mockEntryRepo,
+				NightscoutRepository:   mockNSRepo,
+				ProfileRepository:      mockProfileRepo,
+				DeviceStatusRepository: &mockDeviceStatusRepository{},
+				ImportCursorRepository: &mockImportCursorRepository{},
+				ImportJobs:             NewImportJobs(),
 			}
 
 			// Create request
@@ -200,6 +325,461 @@ func TestApiV1_ImportNightscoutEntries(t *testing.T) {
 			if tt.expectedBody != "" && w.Body.String() != tt.expectedBody {
 				t.Errorf("expected body %q, got %q", tt.expectedBody, w.Body.String())
 			}
+
+			if tt.expectedState == "" {
+				return
+			}
+			var started APIV1ImportStatusResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&started))
+			job, ok := api.ImportJobs.get(started.ID)
+			assert.True(t, ok)
+			assert.Eventually(t, func() bool {
+				return job.snapshot().State != "running"
+			}, time.Second, time.Millisecond)
+
+			status := job.snapshot()
+			assert.Equal(t, tt.expectedState, status.State)
+			assert.NotNil(t, status.FinishedAt)
+			if tt.expectedState == "done" {
+				assert.Equal(t, 1, status.BatchesFetched)
+				assert.Equal(t, 2, status.EntriesInserted)
+				assert.Len(t, mockProfileRepo.profiles, 1)
+				// device statuses could not be fetched, which is not fatal
+				assert.Equal(t, []string{"cannot fetch device statuses from remote nightscout instance"}, status.Errors)
+			} else {
+				assert.Equal(t, []string{"cannot fetch entries from remote nightscout instance"}, status.Errors)
+			}
+		})
+	}
+}
+
+func TestApiV1_ImportNightscoutTreatments(t *testing.T) {
+	var created []models.Treatment
+	mockTreatmentRepo := mockTreatmentRepository{
+		fetchByOidFn: func(ctx context.Context, oid string) (*models.Treatment, error) {
+			if oid == "aaaaaaaaaaaaaaaaaaaaaaaa" {
+				return &models.Treatment{ID: oid}, nil
+			}
+			return nil, models.ErrNotFound
+		},
+		createTreatmentsFn: func(ctx context.Context, treatments []models.Treatment) []models.Treatment {
+			created = append(created, treatments...)
+			return treatments
+		},
+	}
+	mockNSRepo := mockNightscoutRepository{
+		fetchAllTreatmentsFn: func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Treatment, error) {
+			assert.Equal(t, "https://example.com", nsCfg.URL.String())
+			return []models.Treatment{
+				{ID: "bbbbbbbbbbbbbbbbbbbbbbbb", Type: "Meal Bolus", Time: time.Date(2024, 3, 1, 12, 5, 0, 0, time.UTC)},
+				{ID: "aaaaaaaaaaaaaaaaaaaaaaaa", Type: "Sensor Change", Time: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)},
+				{ID: "cccccccccccccccccccccccc", Type: "Note", Time: time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC)},
+			}, nil
+		},
+	}
+	api := ApiV1{TreatmentRepository: mockTreatmentRepo, NightscoutRepository: mockNSRepo}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/treatments/import/nightscout", strings.NewReader(`{"url": "https://example.com/some/path", "token": "sometoken-1234567890abcdef"}`))
+	req = req.WithContext(contextWithSilentLogger())
+	w := httptest.NewRecorder()
+	api.ImportNightscoutTreatments(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	// existing treatments are skipped, new ones are created oldest first
+	assert.Len(t, created, 2)
+	assert.Equal(t, "Note", created[0].Type)
+	assert.Equal(t, "Meal Bolus", created[1].Type)
+
+	// validation is shared with entry import
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/treatments/import/nightscout", strings.NewReader(`{"url": "https://example.com"}`))
+	req = req.WithContext(contextWithSilentLogger())
+	w = httptest.NewRecorder()
+	api.ImportNightscoutTreatments(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "token or api_secret must be supplied\n", w.Body.String())
+}
+
+func TestApiV1_ImportNightscoutEntriesResume(t *testing.T) {
+	interruptedAt := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	oldest := interruptedAt.Add(-time.Duration(importBatchSize) * time.Minute)
+	var fetchedBefore []time.Time
+	mockNSRepo := mockNightscoutRepository{
+		fetchEntriesBeforeFn: func(ctx context.Context, nsCfg repository.NightscoutConfig, before time.Time, count int) ([]models.Entry, error) {
+			fetchedBefore = append(fetchedBefore, before)
+			if !before.Equal(interruptedAt) {
+				return nil, nil
+			}
+			batch := make([]models.Entry, count)
+			for i := range batch {
+				batch[i] = models.Entry{Type: "sgv", SgvMgdl: 100, Time: interruptedAt.Add(-time.Duration(i+1) * time.Minute)}
+			}
+			return batch, nil
+		},
+		fetchProfilesFn: func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Profile, error) {
+			return nil, nil
+		},
+		fetchDeviceStatusFn: func(ctx context.Context, nsCfg repository.NightscoutConfig, since time.Time) ([]models.DeviceStatus, error) {
+			return nil, nil
+		},
+	}
+	cursors := &mockImportCursorRepository{cursors: map[string]models.ImportCursor{
+		"example.com": {Source: "example.com", Before: interruptedAt, EntriesFetched: 5000},
+	}}
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{createEntriesFn: func(ctx context.Context, entries []models.Entry) []models.Entry {
+			return entries
+		}},
+		NightscoutRepository:   mockNSRepo,
+		ProfileRepository:      &mockProfileRepository{},
+		DeviceStatusRepository: &mockDeviceStatusRepository{},
+		ImportCursorRepository: cursors,
+		ImportJobs:             NewImportJobs(),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/entries/import/nightscout", strings.NewReader(`{"url": "https://example.com", "token": "sometoken-1234567890abcdef"}`))
+	w := httptest.NewRecorder()
+	api.ImportNightscoutEntries(w, req.WithContext(contextWithSilentLogger()))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var started APIV1ImportStatusResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&started))
+	job, _ := api.ImportJobs.get(started.ID)
+	assert.Eventually(t, func() bool {
+		return job.snapshot().State != "running"
+	}, time.Second, time.Millisecond)
+
+	status := job.snapshot()
+	assert.Equal(t, "done", status.State)
+	assert.Equal(t, interruptedAt, *status.ResumedFrom)
+	assert.Equal(t, []time.Time{interruptedAt, oldest}, fetchedBefore)
+	assert.Equal(t, importBatchSize, status.EntriesInserted)
+
+	// the cursor lags by a batch, then records completion
+	assert.Len(t, cursors.saved, 2)
+	assert.Equal(t, interruptedAt, cursors.saved[0].Before)
+	assert.Equal(t, 5000+importBatchSize, cursors.saved[0].EntriesFetched)
+	assert.False(t, cursors.saved[0].Complete)
+	assert.Equal(t, oldest, cursors.saved[1].Before)
+	assert.True(t, cursors.saved[1].Complete)
+}
+
+func TestImportJobs_Shutdown(t *testing.T) {
+	fetching := make(chan struct{})
+	mockNSRepo := mockNightscoutRepository{
+		// the fetch only ends when the import is cancelled
+		fetchEntriesBeforeFn: func(ctx context.Context, nsCfg repository.NightscoutConfig, before time.Time, count int) ([]models.Entry, error) {
+			close(fetching)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	cursors := &mockImportCursorRepository{}
+	api := ApiV1{
+		NightscoutRepository:   mockNSRepo,
+		ImportCursorRepository: cursors,
+		ImportJobs:             NewImportJobs(),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/entries/import/nightscout", strings.NewReader(`{"url": "https://example.com", "token": "sometoken-1234567890abcdef"}`))
+	w := httptest.NewRecorder()
+	api.ImportNightscoutEntries(w, req.WithContext(contextWithSilentLogger()))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var started APIV1ImportStatusResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&started))
+	<-fetching
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, api.ImportJobs.Shutdown(ctx))
+
+	// Shutdown waited for the job, which can be resumed later
+	job, _ := api.ImportJobs.get(started.ID)
+	status := job.snapshot()
+	assert.Equal(t, "failed", status.State)
+	assert.Equal(t, []string{errImportInterrupted.Error()}, status.Errors)
+	assert.Empty(t, cursors.saved)
+
+	// later imports are refused
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/entries/import/nightscout", strings.NewReader(`{"url": "https://example.com", "token": "sometoken-1234567890abcdef"}`))
+	w = httptest.NewRecorder()
+	api.ImportNightscoutEntries(w, req.WithContext(contextWithSilentLogger()))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&started))
+	job, _ = api.ImportJobs.get(started.ID)
+	assert.Equal(t, "failed", job.snapshot().State)
+}
+
+func TestImportJobs_ShutdownTimeout(t *testing.T) {
+	jobs := NewImportJobs()
+	release := make(chan struct{})
+	defer close(release)
+	// a job that ignores cancellation
+	jobs.run(context.Background(), jobs.start(), func(ctx context.Context) {
+		<-release
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, jobs.Shutdown(ctx), context.DeadlineExceeded)
+}
+
+func TestImportJobs_AdminNotifies(t *testing.T) {
+	jobs := NewImportJobs()
+	jobs.AdminNotifies = models.NewAdminNotifies()
+
+	jobs.start().finish(errImportInterrupted)
+	jobs.start().finish(nil)
+	assert.Empty(t, jobs.AdminNotifies.Recent(time.Now()), "shutdown and success are not problems")
+
+	jobs.start().finish(errors.New("cannot fetch entries from remote nightscout instance"))
+	notifies := jobs.AdminNotifies.Recent(time.Now())
+	assert.Len(t, notifies, 1)
+	assert.Equal(t, "Import failed", notifies[0].Title)
+	assert.Equal(t, "cannot fetch entries from remote nightscout instance", notifies[0].Message)
+}
+
+func TestApiV1_ImportStatus(t *testing.T) {
+	api := ApiV1{ImportJobs: NewImportJobs()}
+	job := api.ImportJobs.start()
+	job.update(func(status *APIV1ImportStatusResponse) {
+		status.BatchesFetched = 3
+	})
+	r := setupTestRouter(api.ImportStatus, "GET", "/import/status/{id}")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/import/status/"+job.snapshot().ID, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var status APIV1ImportStatusResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, "running", status.State)
+	assert.Equal(t, 3, status.BatchesFetched)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/import/status/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestApiV1_ImportCSVEntries(t *testing.T) {
+	const clarityExport = `Index,Timestamp (YYYY-MM-DDThh:mm:ss),Event Type,Event Subtype,Patient Info,Device Info,Source Device ID,Glucose Value (mg/dL)
+1,2024-06-01T00:58:00,EGV,,,,Android G6,105
+2,2024-06-01T01:03:00,EGV,,,,Android G6,115
+`
+	var created []models.Entry
+	api := ApiV1{
+		CSVRepository: repository.NewCSVImportRepository(),
+		EntryRepository: mockEntryRepository{
+			createEntriesFn: func(ctx context.Context, entries []models.Entry) []models.Entry {
+				created = entries
+				return entries[1:]
+			},
+		},
+	}
+	r := setupTestRouter(api.ImportCSVEntries, "POST", "/entries/import/csv")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/entries/import/csv?tz=Europe/London", strings.NewReader(clarityExport)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res APIV1ImportCSVResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	assert.Equal(t, APIV1ImportCSVResponse{Format: "clarity", EntriesRead: 2, EntriesInserted: 1}, res)
+	assert.Len(t, created, 2)
+	assert.Equal(t, time.Date(2024, 5, 31, 23, 58, 0, 0, time.UTC), created[0].Time.UTC())
+
+	// multipart upload, as sent by a browser form
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, _ := mw.CreateFormFile("file", "clarity.csv")
+	_, _ = fw.Write([]byte(clarityExport))
+	_ = mw.Close()
+	req := httptest.NewRequest("POST", "/entries/import/csv", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, time.Date(2024, 6, 1, 0, 58, 0, 0, time.UTC), created[0].Time.UTC(), "defaults to utc")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/entries/import/csv", strings.NewReader("a,b,c\n1,2,3\n")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/entries/import/csv?tz=Mars/Olympus", strings.NewReader(clarityExport)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestApiV1_ImportArchiveEntries(t *testing.T) {
+	var created []models.Entry
+	api := ApiV1{
+		ArchiveRepository: repository.NewArchiveImportRepository(),
+		EntryRepository: mockEntryRepository{
+			createEntriesFn: func(ctx context.Context, entries []models.Entry) []models.Entry {
+				created = entries
+				return entries[1:]
+			},
+		},
+	}
+	r := setupTestRouter(api.ImportArchiveEntries, "POST", "/entries/import/archive")
+
+	for name, archive := range map[string]string{
+		"version 1": `[{"_id":"674708e0575df739a9711a40","type":"sgv","sgv":105,"direction":"Flat","device":"xDrip","dateString":"2024-11-27T11:50:21.723Z","sysTime":"2024-11-27T11:56:16Z"},` +
+			`{"_id":"674708e0575df739a9711a41","type":"sgv","sgv":110,"direction":"Flat","device":"xDrip","dateString":"2024-11-27T11:55:21.723Z","sysTime":"2024-11-27T11:56:16Z"},` +
+			`{"_id":"notime","type":"sgv","sgv":110}]`,
+		"version 2": `{"version":2,"data":[{"_id":"674708e0575df739a9711a40","type":"sgv","sgv":105,"direction":"Flat","device":"xDrip","dateString":"2024-11-27T11:50:21.723Z","sysTime":"2024-11-27T11:56:16Z"},` +
+			`{"_id":"674708e0575df739a9711a41","type":"sgv","sgv":110,"direction":"Flat","device":"xDrip","dateString":"2024-11-27T11:55:21.723Z","sysTime":"2024-11-27T11:56:16Z"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/entries/import/archive", strings.NewReader(archive)))
+			assert.Equal(t, http.StatusOK, w.Code)
+			var res APIV1ImportArchiveResponse
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+			assert.Equal(t, APIV1ImportArchiveResponse{EntriesRead: 2, EntriesInserted: 1}, res)
+			assert.Len(t, created, 2)
+			assert.Equal(t, "674708e0575df739a9711a40", created[0].Oid)
+			assert.Equal(t, "xDrip", created[0].Device)
+			assert.Equal(t, time.Date(2024, 11, 27, 11, 50, 21, 723000000, time.UTC), created[0].Time.UTC())
+		})
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/entries/import/archive", strings.NewReader(`{"version":99,"data":[]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/entries/import/archive", strings.NewReader(`sgv,time`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// pastYearFileExists reports whether a year file holding entries from year
+// has been uploaded once the repository is flushed
+func pastYearFileExists(t *testing.T, bs *bucketstore.BucketStore, repo *repository.BucketEntryRepository, year int) bool {
+	ctx := contextWithSilentLogger()
+	assert.NoError(t, repo.Flush(ctx))
+	exists, err := bs.Bucket.Exists(ctx, fmt.Sprintf("ns-year/%d.json", year))
+	assert.NoError(t, err)
+	return exists
+}
+
+func TestApiV1_ImportArchiveEntriesPastYear(t *testing.T) {
+	bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+	entryRepo := repository.NewBucketEntryRepository(bs)
+	api := ApiV1{
+		ArchiveRepository: repository.NewArchiveImportRepository(),
+		EntryRepository:   entryRepo,
+	}
+	r := setupTestRouter(api.ImportArchiveEntries, "POST", "/entries/import/archive")
+
+	year := time.Now().Year() - 2
+	archive := fmt.Sprintf(`{"version":2,"data":[{"_id":"674708e0575df739a9711a40","type":"sgv","sgv":105,"direction":"Flat","device":"xDrip","dateString":"%d-11-27T11:50:21.723Z","sysTime":"%d-11-27T11:56:16Z"}]}`, year, year)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/entries/import/archive", strings.NewReader(archive)).WithContext(contextWithSilentLogger()))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, pastYearFileExists(t, bs, entryRepo, year))
+}
+
+func TestApiV1_ImportJSONLEntries(t *testing.T) {
+	var lines []string
+	for i := 0; i < jsonlImportChunkSize+1; i++ {
+		lines = append(lines, fmt.Sprintf(`{"type":"sgv","sgv":%d,"dateString":"%s","device":"xDrip"}`,
+			100+i%50, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i)*5*time.Minute).Format(time.RFC3339)))
+	}
+	lines = append(lines, "", `{"type":"sgv","sgv":100,"dateString":"yesterday"}`, `not json`)
+
+	var chunks []int
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			createEntriesFn: func(ctx context.Context, entries []models.Entry) []models.Entry {
+				chunks = append(chunks, len(entries))
+				return entries
+			},
+		},
+	}
+	r := setupTestRouter(api.ImportJSONLEntries, "POST", "/entries/import/jsonl")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/entries/import/jsonl", strings.NewReader(strings.Join(lines, "\n"))))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res APIV1ImportJSONLResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	assert.Equal(t, jsonlImportChunkSize+3, res.LinesRead, "blank lines are not counted")
+	assert.Equal(t, jsonlImportChunkSize+1, res.EntriesInserted)
+	assert.Equal(t, []string{
+		fmt.Sprintf("line %d: invalid date format", jsonlImportChunkSize+3),
+		fmt.Sprintf("line %d: invalid json", jsonlImportChunkSize+4),
+	}, res.Errors)
+	assert.Equal(t, []int{jsonlImportChunkSize, 1}, chunks, "entries are inserted in chunks")
+}
+
+// imports seed history, so entries from earlier years must reach their year
+// files rather than only being held in memory
+func TestApiV1_ImportEntriesPastYear(t *testing.T) {
+	year := time.Now().Year() - 2
+	pastTime := time.Date(year, 6, 1, 1, 3, 0, 0, time.UTC)
+	nsRepo := mockNightscoutRepository{
+		fetchEntriesBeforeFn: func(ctx context.Context, nsCfg repository.NightscoutConfig, before time.Time, count int) ([]models.Entry, error) {
+			return []models.Entry{{Type: "sgv", SgvMgdl: 115, Device: "test", Time: pastTime}}, nil
+		},
+		fetchProfilesFn: func(ctx context.Context, nsCfg repository.NightscoutConfig) ([]models.Profile, error) {
+			return nil, nil
+		},
+		fetchDeviceStatusFn: func(ctx context.Context, nsCfg repository.NightscoutConfig, since time.Time) ([]models.DeviceStatus, error) {
+			return nil, nil
+		},
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		handle func(api ApiV1) http.HandlerFunc
+	}{
+		{
+			name:   "csv",
+			path:   "/entries/import/csv",
+			body:   fmt.Sprintf("Index,Timestamp (YYYY-MM-DDThh:mm:ss),Event Type,Event Subtype,Patient Info,Device Info,Source Device ID,Glucose Value (mg/dL)\n1,%s,EGV,,,,Android G6,115\n", pastTime.Format("2006-01-02T15:04:05")),
+			handle: func(api ApiV1) http.HandlerFunc { return api.ImportCSVEntries },
+		},
+		{
+			name:   "jsonl",
+			path:   "/entries/import/jsonl",
+			body:   fmt.Sprintf(`{"type":"sgv","sgv":115,"dateString":"%s","device":"xDrip"}`, pastTime.Format(time.RFC3339)),
+			handle: func(api ApiV1) http.HandlerFunc { return api.ImportJSONLEntries },
+		},
+		{
+			name:   "nightscout",
+			path:   "/entries/import/nightscout",
+			body:   `{"url": "https://example.com", "token": "sometoken-1234567890abcdef"}`,
+			handle: func(api ApiV1) http.HandlerFunc { return api.ImportNightscoutEntries },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := &bucketstore.BucketStore{Bucket: objstore.NewInMemBucket()}
+			entryRepo := repository.NewBucketEntryRepository(bs)
+			api := ApiV1{
+				CSVRepository:          repository.NewCSVImportRepository(),
+				EntryRepository:        entryRepo,
+				NightscoutRepository:   nsRepo,
+				ProfileRepository:      &mockProfileRepository{},
+				DeviceStatusRepository: &mockDeviceStatusRepository{},
+				ImportCursorRepository: &mockImportCursorRepository{},
+				ImportJobs:             NewImportJobs(),
+			}
+			r := setupTestRouter(tt.handle(api), "POST", tt.path)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body)).WithContext(contextWithSilentLogger()))
+			assert.Less(t, w.Code, 300)
+			if w.Code == http.StatusAccepted {
+				var started APIV1ImportStatusResponse
+				assert.NoError(t, json.NewDecoder(w.Body).Decode(&started))
+				job, _ := api.ImportJobs.get(started.ID)
+				assert.Eventually(t, func() bool {
+					return job.snapshot().State != "running"
+				}, time.Second, time.Millisecond)
+				assert.Equal(t, 1, job.snapshot().EntriesInserted)
+			}
+			assert.True(t, pastYearFileExists(t, bs, entryRepo, year))
 		})
 	}
 }
@@ -491,3 +1071,668 @@ func TestApiV1_ListEntries(t *testing.T) {
 		})
 	}
 }
+
+func TestApiV1_CountLimits(t *testing.T) {
+	var requested int
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			fetchLatestSGVsFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+				requested = maxEntries
+				return nil, nil
+			},
+		},
+		TreatmentRepository: mockTreatmentRepository{
+			fetchLatestFn: func(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error) {
+				requested = maxTreatments
+				return nil, nil
+			},
+		},
+		CountLimits: CountLimits{Default: 5, Max: 100},
+		Settings:    NewLiveSettings(Settings{Language: "de"}),
+	}
+
+	for _, path := range []string{"/entries/sgv", "/treatments"} {
+		handler := api.ListSGVs
+		if path == "/treatments" {
+			handler = api.ListTreatments
+		}
+		r := setupTestRouter(handler, "GET", path)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path+".json", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 5, requested)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path+".json?count=100", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 100, requested)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path+".json?count=101", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "count muss <= 100 sein\n", w.Body.String())
+	}
+}
+
+func TestApiV1_Units(t *testing.T) {
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			fetchLatestListFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+				return []models.Entry{*createTestEntry("test")}, nil
+			},
+		},
+		TreatmentRepository: mockTreatmentRepository{
+			fetchLatestFn: func(ctx context.Context, maxTime time.Time, maxTreatments int) ([]models.Treatment, error) {
+				return []models.Treatment{
+					{ID: "a", Type: "BG Check", Fields: map[string]interface{}{"glucose": "8.9", "units": "mmol"}},
+					{ID: "b", Type: "BG Check", Fields: map[string]interface{}{"glucose": 135.0}},
+				}, nil
+			},
+		},
+		Settings: NewLiveSettings(Settings{Units: models.UnitsMgdl}),
+	}
+	entries := setupTestRouter(api.ListEntries, "GET", "/entries")
+	treatments := setupTestRouter(api.ListTreatments, "GET", "/treatments")
+
+	w := httptest.NewRecorder()
+	entries.ServeHTTP(w, httptest.NewRequest("GET", "/entries.json?units=mmol", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response []APIV1EntryResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal(t, 6.7, response[0].Sgv)
+	assert.Equal(t, "mmol", response[0].Units)
+
+	w = httptest.NewRecorder()
+	entries.ServeHTTP(w, httptest.NewRequest("GET", "/entries?units=mmol", nil))
+	assert.Equal(t, "6.7", strings.Split(w.Body.String(), "\t")[2])
+
+	w = httptest.NewRecorder()
+	entries.ServeHTTP(w, httptest.NewRequest("GET", "/entries.json?units=furlongs", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// treatments are returned as stored unless units are asked for
+	var treatmentResponse []map[string]interface{}
+	w = httptest.NewRecorder()
+	treatments.ServeHTTP(w, httptest.NewRequest("GET", "/treatments.json", nil))
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&treatmentResponse))
+	assert.Equal(t, "8.9", treatmentResponse[0]["glucose"])
+	assert.Equal(t, 135.0, treatmentResponse[1]["glucose"])
+
+	w = httptest.NewRecorder()
+	treatments.ServeHTTP(w, httptest.NewRequest("GET", "/treatments.json?units=mg/dl", nil))
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&treatmentResponse))
+	assert.Equal(t, 160.0, treatmentResponse[0]["glucose"])
+	assert.Equal(t, "mg/dl", treatmentResponse[0]["units"])
+	assert.Equal(t, 135.0, treatmentResponse[1]["glucose"])
+
+	api.APIUnits = models.UnitsMmol
+	treatments = setupTestRouter(api.ListTreatments, "GET", "/treatments")
+	w = httptest.NewRecorder()
+	treatments.ServeHTTP(w, httptest.NewRequest("GET", "/treatments.json", nil))
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&treatmentResponse))
+	assert.Equal(t, 8.9, treatmentResponse[0]["glucose"])
+	assert.Equal(t, 7.5, treatmentResponse[1]["glucose"], "without units, glucose is in the server's units")
+	assert.Equal(t, "mmol", treatmentResponse[1]["units"])
+}
+
+func TestApiV1_ListEntriesStreamed(t *testing.T) {
+	entries := []models.Entry{*createTestEntry("first"), *createTestEntry("second")}
+	mock := mockEntryRepository{
+		fetchLatestListFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+			return entries[:min(maxEntries, len(entries))], nil
+		},
+	}
+	api := ApiV1{EntryRepository: mock}
+	r := setupTestRouter(api.ListEntries, "GET", "/entries")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/entries.json", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	var response []APIV1EntryResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []string{"first", "second"}, []string{response[0].Oid, response[1].Oid})
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/entries", nil))
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Len(t, strings.Split(w.Body.String(), "\r\n"), 2)
+
+	// an empty list is an empty array, not null
+	entries = nil
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/entries.json", nil))
+	assert.Equal(t, "[]\n", w.Body.String())
+}
+
+func TestApiV1_ListEntriesFind(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedFrom   time.Time
+		expectedTo     time.Time
+		expectedType   string
+	}{
+		{
+			name:           "ms range as sent by xdrip",
+			query:          "count=1440&find%5Bdate%5D%5B$gt%5D=1733875200000.0&find%5Bdate%5D%5B$lte%5D=1733961600000.0",
+			expectedStatus: http.StatusOK,
+			expectedFrom:   time.UnixMilli(1733875200000).UTC().Add(time.Nanosecond),
+			expectedTo:     time.UnixMilli(1733961600000).UTC().Add(time.Nanosecond),
+		},
+		{
+			name:           "dateString range, type and stray brace",
+			query:          "find[type]=sgv&find[dateString][$gte]=2019-07-01&find[dateString][$lt]=2019-11-20T10:00:00Z}",
+			expectedStatus: http.StatusOK,
+			expectedFrom:   time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC),
+			expectedTo:     time.Date(2019, 11, 20, 10, 0, 0, 0, time.UTC),
+			expectedType:   "sgv",
+		},
+		{
+			name:           "invalid date",
+			query:          "find[date][$gte]=yesterday",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var from, to time.Time
+			var entryType string
+			mock := mockEntryRepository{
+				fetchBetweenFn: func(ctx context.Context, f, tu time.Time, typ string, maxEntries int) ([]models.Entry, error) {
+					from, to, entryType = f, tu, typ
+					return []models.Entry{*createTestEntry("test")}, nil
+				},
+			}
+			api := ApiV1{EntryRepository: mock}
+
+			r := setupTestRouter(api.ListEntries, "GET", "/entries")
+			req := httptest.NewRequest("GET", "/entries.json?"+tt.query, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tt.expectedFrom, from)
+			assert.Equal(t, tt.expectedTo, to)
+			assert.Equal(t, tt.expectedType, entryType)
+		})
+	}
+}
+
+func TestApiV1_CreateEntries(t *testing.T) {
+	stored := createTestEntry("67261314d689f977f773bc19")
+	var created []models.Entry
+	mock := mockEntryRepository{
+		fetchByOidFn: func(ctx context.Context, oid string) (*models.Entry, error) {
+			if oid == stored.Oid {
+				return stored, nil
+			}
+			return nil, models.ErrNotFound
+		},
+		fetchMatchingFn: func(ctx context.Context, entry models.Entry) (*models.Entry, error) {
+			if entry.Time.Equal(stored.Time) && entry.Device == stored.Device && entry.SgvMgdl == stored.SgvMgdl {
+				return stored, nil
+			}
+			return nil, models.ErrNotFound
+		},
+		fetchLatestFn: func(ctx context.Context, maxTime time.Time) (*models.Entry, error) {
+			return nil, models.ErrNotFound
+		},
+		createEntriesFn: func(ctx context.Context, entries []models.Entry) []models.Entry {
+			created = append(created, entries...)
+			for i := range entries {
+				if entries[i].Oid == "" {
+					entries[i].Oid = "67261314d689f977f773bc20"
+				}
+			}
+			return entries
+		},
+	}
+	api := ApiV1{EntryRepository: mock}
+	r := setupTestRouter(api.CreateEntries, "POST", "/entries")
+
+	body := `[
+		{"_id":"6726131dd689f977f773bc1a","type":"sgv","sgv":121,"dateString":"2024-01-02T12:18:14.000Z","device":"test device","utcOffset":-300},
+		{"_id":"67261314d689f977f773bc19","type":"sgv","sgv":99,"dateString":"2024-01-02T13:00:00.000Z","device":"test device"},
+		{"type":"sgv","sgv":120,"dateString":"2024-01-02T12:13:14.000000015Z","device":"test device"},
+		{"_id":"not-an-oid","type":"sgv","sgv":122,"dateString":"2024-01-02T12:23:14.000Z","device":"test device"}
+	]`
+	req := httptest.NewRequest("POST", "/entries.json", strings.NewReader(body)).WithContext(contextWithSilentLogger())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response []APIV1EntryResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+
+	// matches by _id and by time/device/sgv return the stored record, in
+	// request order among the new entries
+	assert.Len(t, response, 4)
+	assert.Equal(t, "6726131dd689f977f773bc1a", response[0].Oid)
+	assert.Equal(t, -300, response[0].UtcOffset)
+	assert.Equal(t, stored.Oid, response[1].Oid)
+	assert.Equal(t, stored.Oid, response[2].Oid)
+	assert.Equal(t, "67261314d689f977f773bc20", response[3].Oid, "an _id that is not an oid is replaced")
+	assert.Len(t, created, 2)
+	assert.Equal(t, 121, created[0].SgvMgdl)
+	assert.Equal(t, -300, created[0].UtcOffset)
+	assert.Empty(t, created[1].Oid)
+}
+
+func TestApiV1_CreateEntriesDirection(t *testing.T) {
+	stored := &models.Entry{Type: "sgv", SgvMgdl: 100, Time: time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)}
+	var created []models.Entry
+	api := ApiV1{EntryRepository: mockEntryRepository{
+		fetchByOidFn: func(ctx context.Context, oid string) (*models.Entry, error) {
+			return nil, models.ErrNotFound
+		},
+		fetchMatchingFn: func(ctx context.Context, entry models.Entry) (*models.Entry, error) {
+			return nil, models.ErrNotFound
+		},
+		fetchLatestFn: func(ctx context.Context, maxTime time.Time) (*models.Entry, error) {
+			assert.True(t, maxTime.Before(time.Date(2024, 1, 2, 12, 5, 0, 0, time.UTC)))
+			return stored, nil
+		},
+		createEntriesFn: func(ctx context.Context, entries []models.Entry) []models.Entry {
+			created = append(created, entries...)
+			return entries
+		},
+	}}
+	r := setupTestRouter(api.CreateEntries, "POST", "/entries")
+
+	// newest first, as xDrip uploads them
+	body := `[
+		{"type":"sgv","sgv":140,"dateString":"2024-01-02T12:15:00.000Z","device":"xDrip","direction":"Flat"},
+		{"type":"sgv","sgv":140,"dateString":"2024-01-02T12:10:00.000Z","device":"xDrip"},
+		{"type":"sgv","sgv":110,"dateString":"2024-01-02T12:05:00.000Z","device":"xDrip"}
+	]`
+	req := httptest.NewRequest("POST", "/entries.json", strings.NewReader(body)).WithContext(contextWithSilentLogger())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, created, 3)
+	assert.Equal(t, "Flat", created[0].Direction, "uploaded direction is kept")
+	assert.Equal(t, "DoubleUp", created[1].Direction)
+	assert.Equal(t, "FortyFiveUp", created[2].Direction, "derived from the stored sgv")
+}
+
+func TestApiV1_CreateTreatments_EnteredBy(t *testing.T) {
+	var created []models.Treatment
+	api := ApiV1{TreatmentRepository: mockTreatmentRepository{
+		createTreatmentsFn: func(ctx context.Context, treatments []models.Treatment) []models.Treatment {
+			created = append(created, treatments...)
+			return treatments
+		},
+	}}
+	body := `[{"eventType":"Note","notes":"a"},{"eventType":"Note","notes":"b","enteredBy":"xDrip4iOS"}]`
+
+	ctx := nsmiddleware.WithAuthn(contextWithSilentLogger(), &models.Authn{AuthSubject: &models.AuthSubject{Name: "careportal", RoleNames: []string{"careportal"}}})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/treatments", strings.NewReader(body)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	api.CreateTreatments(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "careportal", created[0].Fields["enteredBy"])
+	assert.Equal(t, "xDrip4iOS", created[1].Fields["enteredBy"], "enteredBy is kept when given")
+
+	created = nil
+	ctx = nsmiddleware.WithAuthn(contextWithSilentLogger(), &models.Authn{AuthSubject: &models.AuthSubject{Name: "anonymous"}})
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/treatments", strings.NewReader(body)).WithContext(ctx)
+	api.CreateTreatments(httptest.NewRecorder(), req)
+	assert.NotContains(t, created[0].Fields, "enteredBy")
+}
+
+func TestApiV1_CreateTreatments_ProfileSwitch(t *testing.T) {
+	var created []models.Treatment
+	api := ApiV1{
+		TreatmentRepository: mockTreatmentRepository{
+			createTreatmentsFn: func(ctx context.Context, treatments []models.Treatment) []models.Treatment {
+				created = append(created, treatments...)
+				return treatments
+			},
+		},
+		ProfileRepository: &mockProfileRepository{profiles: []models.Profile{{
+			Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			Fields: map[string]interface{}{
+				"defaultProfile": "Default",
+				"store":          map[string]interface{}{"Default": map[string]interface{}{}, "Exercise": map[string]interface{}{}},
+			},
+		}}},
+	}
+	tests := []struct {
+		name       string
+		body       string
+		expectCode int
+	}{
+		{name: "stored profile", body: `[{"eventType":"Profile Switch","profile":"Exercise","duration":"60","percentage":80}]`, expectCode: http.StatusOK},
+		{name: "unknown profile", body: `[{"eventType":"Profile Switch","profile":"Holiday"}]`, expectCode: http.StatusBadRequest},
+		{name: "with profileJson", body: `[{"eventType":"Profile Switch","profile":"Holiday","profileJson":"{\"dia\":5}"}]`, expectCode: http.StatusOK},
+		{name: "no profile", body: `[{"eventType":"Profile Switch","duration":60}]`, expectCode: http.StatusBadRequest},
+		{name: "bad percentage", body: `[{"eventType":"Profile Switch","profile":"Exercise","percentage":0}]`, expectCode: http.StatusBadRequest},
+		{name: "bad profileJson", body: `[{"eventType":"Profile Switch","profile":"Exercise","profileJson":"{"}]`, expectCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created = nil
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/treatments", strings.NewReader(tt.body)).WithContext(contextWithSilentLogger())
+			w := httptest.NewRecorder()
+			api.CreateTreatments(w, req)
+			assert.Equal(t, tt.expectCode, w.Code)
+		})
+	}
+
+	created = nil
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/treatments", strings.NewReader(tests[0].body)).WithContext(contextWithSilentLogger())
+	api.CreateTreatments(httptest.NewRecorder(), req)
+	assert.Equal(t, 60.0, created[0].Fields["duration"], "duration recorded as a number")
+	assert.Equal(t, 80.0, created[0].Fields["percentage"])
+}
+
+func TestApiV1_CreateTreatments_PreBolus(t *testing.T) {
+	var created []models.Treatment
+	api := ApiV1{TreatmentRepository: mockTreatmentRepository{
+		createTreatmentsFn: func(ctx context.Context, treatments []models.Treatment) []models.Treatment {
+			created = append(created, treatments...)
+			return treatments
+		},
+	}}
+	body := `[
+		{"eventType":"Combo Bolus","created_at":"2024-12-15T12:50:46.682Z","insulin":7.5,"carbs":4,"preBolus":-15,"notes":"tes combo bolus","enteredinsulin":"10","splitNow":"75","splitExt":"25","relative":30,"duration":5},
+		{"eventType":"Meal Bolus","created_at":"2024-12-15T12:40:00.000Z","insulin":0.5,"preBolus":"-15"},
+		{"eventType":"Meal Bolus","created_at":"2024-12-15T13:00:00.000Z","insulin":1,"carbs":20}
+	]`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/treatments", strings.NewReader(body)).WithContext(contextWithSilentLogger())
+	w := httptest.NewRecorder()
+	api.CreateTreatments(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, created, 5)
+
+	combo := created[0]
+	assert.Equal(t, "Combo Bolus", combo.Type)
+	assert.NotContains(t, combo.Fields, "carbs", "carbs moved to the prebolus treatment")
+	assert.Equal(t, 7.5, combo.Fields["insulin"])
+	assert.Equal(t, models.Treatment{
+		Type:   "Combo Bolus",
+		Time:   time.Date(2024, 12, 15, 12, 35, 46, 682000000, time.UTC),
+		Fields: map[string]interface{}{"carbs": 4.0, "notes": "tes combo bolus"},
+	}, created[1])
+
+	assert.Equal(t, models.Treatment{
+		Type:   "Meal Bolus",
+		Time:   time.Date(2024, 12, 15, 12, 25, 0, 0, time.UTC),
+		Fields: map[string]interface{}{"carbs": ""},
+	}, created[3], "as cgm-remote-monitor, carbs is empty when none were given")
+
+	assert.Equal(t, 20.0, created[4].Fields["carbs"], "no preBolus, no split")
+}
+
+func TestApiV1_CreateTreatments_TreatmentTypes(t *testing.T) {
+	api := ApiV1{
+		TreatmentRepository: mockTreatmentRepository{
+			createTreatmentsFn: func(ctx context.Context, treatments []models.Treatment) []models.Treatment { return treatments },
+		},
+		Settings: NewLiveSettings(Settings{TreatmentTypes: models.DefaultTreatmentTypes.Register("Ketones", "ketones")}),
+	}
+	tests := []struct {
+		body       string
+		expectCode int
+	}{
+		{body: `[{"eventType":"Ketones","ketones":0.6}]`, expectCode: http.StatusOK},
+		{body: `[{"eventType":"Ketones","notes":"forgot"}]`, expectCode: http.StatusBadRequest},
+		{body: `[{"eventType":"Pump Battery Change"}]`, expectCode: http.StatusOK},
+		{body: `[{"eventType":"Carbs","carbs":0}]`, expectCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/treatments", strings.NewReader(tt.body)).WithContext(contextWithSilentLogger())
+		w := httptest.NewRecorder()
+		api.CreateTreatments(w, req)
+		assert.Equal(t, tt.expectCode, w.Code, tt.body)
+	}
+}
+
+func TestApiV1_PutTreatment(t *testing.T) {
+	var updated []string
+	api := ApiV1{TreatmentRepository: mockTreatmentRepository{
+		updateByOidFn: func(ctx context.Context, oid string, treatment *models.Treatment) error {
+			if oid == "675ed102d689f977f7aa9eb2" {
+				return models.ErrNotFound
+			}
+			updated = append(updated, oid)
+			return nil
+		},
+	}}
+	r := setupTestRouter(api.PutTreatment, "PUT", "/api/v1/treatments/{oid}")
+	r.Put("/api/v1/treatments", api.PutTreatment)
+
+	tests := []struct {
+		name         string
+		path         string
+		body         string
+		expectCode   int
+		expectUpdate string
+	}{
+		{name: "oid in body", path: "/api/v1/treatments", body: `{"_id":"675ed0cbd689f977f7aa9e4f","eventType":"Note"}`, expectCode: http.StatusNoContent, expectUpdate: "675ed0cbd689f977f7aa9e4f"},
+		{name: "oid in path", path: "/api/v1/treatments/675ed0cbd689f977f7aa9e4f", body: `{"eventType":"Note"}`, expectCode: http.StatusNoContent, expectUpdate: "675ed0cbd689f977f7aa9e4f"},
+		{name: "oid in both", path: "/api/v1/treatments/675ed0cbd689f977f7aa9e4f", body: `{"_id":"675ed0cbd689f977f7aa9e4f","eventType":"Note"}`, expectCode: http.StatusNoContent, expectUpdate: "675ed0cbd689f977f7aa9e4f"},
+		{name: "oid mismatch", path: "/api/v1/treatments/675ed0cbd689f977f7aa9e4f", body: `{"_id":"675ed165d689f977f7aa9f53","eventType":"Note"}`, expectCode: http.StatusBadRequest},
+		{name: "not found", path: "/api/v1/treatments/675ed102d689f977f7aa9eb2", body: `{"eventType":"Note"}`, expectCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated = nil
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body)))
+			assert.Equal(t, tt.expectCode, w.Code)
+			if tt.expectUpdate != "" {
+				assert.Equal(t, []string{tt.expectUpdate}, updated)
+			} else {
+				assert.Empty(t, updated)
+			}
+		})
+	}
+}
+
+func TestApiV1_DeleteTreatments(t *testing.T) {
+	day := time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC)
+	treatments := []models.Treatment{
+		{ID: "yesterday", Type: "Note", Time: day.Add(-time.Hour)},
+		{ID: "note", Type: "Note", Time: day.Add(10 * time.Hour)},
+		{ID: "sensor", Type: "Sensor Start", Time: day.Add(11 * time.Hour)},
+		{ID: "change", Type: "Sensor Change", Time: day.Add(12 * time.Hour)},
+		{ID: "tomorrow", Type: "Note", Time: day.Add(25 * time.Hour)},
+	}
+	var minTimes []time.Time
+	var deleted []string
+	api := ApiV1{TreatmentRepository: mockTreatmentRepository{
+		fetchAfterFn: func(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+			minTimes = append(minTimes, minTime)
+			var after []models.Treatment
+			for _, t := range treatments {
+				if t.Time.After(minTime) {
+					after = append(after, t)
+				}
+			}
+			return after, nil
+		},
+		deleteByOidFn: func(ctx context.Context, oid string) error {
+			deleted = append(deleted, oid)
+			return nil
+		},
+	}}
+
+	tests := []struct {
+		name          string
+		query         string
+		expectCode    int
+		expectDeleted []string
+		expectBody    string
+	}{
+		{name: "day", query: "find[created_at][$gte]=2024-12-15&find[created_at][$lt]=2024-12-16", expectCode: http.StatusOK, expectDeleted: []string{"note", "sensor", "change"}, expectBody: `{"n":3,"ok":1}`},
+		{name: "eventType", query: "find[created_at][$gte]=2024-12-15&find[eventType]=Note", expectCode: http.StatusOK, expectDeleted: []string{"note", "tomorrow"}, expectBody: `{"n":2,"ok":1}`},
+		{name: "eventType regex", query: "find[eventType]=/Sensor Start|Sensor Change/", expectCode: http.StatusOK, expectDeleted: []string{"sensor", "change"}, expectBody: `{"n":2,"ok":1}`},
+		{name: "exclusive bound", query: "find[created_at][$gt]=2024-12-15T10:00:00Z&find[created_at][$lte]=2024-12-15T11:00:00Z", expectCode: http.StatusOK, expectDeleted: []string{"sensor"}, expectBody: `{"n":1,"ok":1}`},
+		{name: "no find", query: "count=10", expectCode: http.StatusBadRequest},
+		{name: "bad time", query: "find[created_at][$gte]=yesterday", expectCode: http.StatusBadRequest},
+		{name: "bad regex", query: "find[eventType]=/(/", expectCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted = nil
+			req := httptest.NewRequest(http.MethodDelete, "/api/v1/treatments?"+url.PathEscape(tt.query), nil).WithContext(contextWithSilentLogger())
+			w := httptest.NewRecorder()
+			api.DeleteTreatments(w, req)
+			assert.Equal(t, tt.expectCode, w.Code)
+			assert.Equal(t, tt.expectDeleted, deleted)
+			if tt.expectBody != "" {
+				assert.JSONEq(t, tt.expectBody, w.Body.String())
+			}
+		})
+	}
+	assert.True(t, minTimes[0].Before(day), "treatments at the $gte bound are fetched")
+}
+
+func TestApiV1_ListTreatmentsFind(t *testing.T) {
+	day := time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC)
+	treatments := []models.Treatment{
+		{ID: "675ecfe2d689f977f7aa9cb7", Type: "Snack Bolus", Time: day.Add(11 * time.Hour), Fields: map[string]interface{}{"notes": "2xbagel", "enteredBy": "adam"}},
+		{ID: "675ed03ed689f977f7aa9d47", Type: "Meal Bolus", Time: day.Add(12 * time.Hour), Fields: map[string]interface{}{"notes": "Pizza night", "enteredBy": "xDrip4iOS"}},
+		{ID: "675ed058d689f977f7aa9d85", Type: "Correction Bolus", Time: day.Add(13 * time.Hour), Fields: map[string]interface{}{"notes": "after pizza", "enteredBy": "adam"}},
+		{ID: "675ed165d689f977f7aa9f53", Type: "Site Change", Time: day.Add(14 * time.Hour), Fields: map[string]interface{}{}},
+	}
+	api := ApiV1{TreatmentRepository: mockTreatmentRepository{
+		fetchAfterFn: func(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+			return treatments, nil
+		},
+	}}
+
+	tests := []struct {
+		name      string
+		query     string
+		expectIDs []string
+	}{
+		{name: "notes regex ignoring case", query: "find[notes]=/pizza/i", expectIDs: []string{"675ed058d689f977f7aa9d85", "675ed03ed689f977f7aa9d47"}},
+		{name: "notes regex", query: "find[notes]=/pizza/", expectIDs: []string{"675ed058d689f977f7aa9d85"}},
+		{name: "$regex with $options", query: "find[notes][$regex]=PIZZA&find[notes][$options]=i&count=1", expectIDs: []string{"675ed058d689f977f7aa9d85"}},
+		{name: "enteredBy", query: "find[enteredBy]=adam", expectIDs: []string{"675ed058d689f977f7aa9d85", "675ecfe2d689f977f7aa9cb7"}},
+		{name: "enteredBy and notes", query: "find[enteredBy]=adam&find[notes]=/bagel/", expectIDs: []string{"675ecfe2d689f977f7aa9cb7"}},
+		{name: "eventType", query: "count=1&find[eventType]=Site Change", expectIDs: []string{"675ed165d689f977f7aa9f53"}},
+		{name: "no match", query: "find[notes]=/salad/", expectIDs: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/treatments?"+url.PathEscape(tt.query), nil).WithContext(contextWithSilentLogger())
+			w := httptest.NewRecorder()
+			api.ListTreatments(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			var got []struct {
+				ID string `json:"_id"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			var ids []string
+			for _, g := range got {
+				ids = append(ids, g.ID)
+			}
+			assert.Equal(t, tt.expectIDs, ids)
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/treatments?find[notes]=/(/", nil).WithContext(contextWithSilentLogger())
+	w := httptest.NewRecorder()
+	api.ListTreatments(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestApiV1_CreateTreatments_BGCheckMbg(t *testing.T) {
+	var createdEntries []models.Entry
+	api := ApiV1{
+		TreatmentRepository: mockTreatmentRepository{
+			createTreatmentsFn: func(ctx context.Context, treatments []models.Treatment) []models.Treatment { return treatments },
+		},
+		EntryRepository: mockEntryRepository{
+			fetchMatchingFn: func(ctx context.Context, entry models.Entry) (*models.Entry, error) {
+				if entry.Device == "retried" {
+					return &entry, nil
+				}
+				return nil, models.ErrNotFound
+			},
+			createEntriesFn: func(ctx context.Context, entries []models.Entry) []models.Entry {
+				createdEntries = append(createdEntries, entries...)
+				return entries
+			},
+		},
+		Settings: NewLiveSettings(Settings{Units: models.UnitsMmol, BGCheckMbg: true}),
+	}
+	body := `[
+		{"eventType":"BG Check","created_at":"2024-12-15T12:46:30.679Z","enteredBy":"adam","glucose":8.9,"glucoseType":"Finger","units":"mmol"},
+		{"eventType":"BG Check","created_at":"2024-12-13T18:24:04.319Z","enteredBy":"xDrip4iOS","glucose":135,"glucoseType":"Finger: 7.5 mmol/L","units":"mg/dl"},
+		{"eventType":"BG Check","created_at":"2024-12-15T13:00:00.000Z","glucose":"6.1","glucoseType":"Finger"},
+		{"eventType":"BG Check","created_at":"2024-12-15T13:10:00.000Z","glucose":8.7,"glucoseType":"Sensor","units":"mmol"},
+		{"eventType":"BG Check","created_at":"2024-12-15T13:20:00.000Z","enteredBy":"retried","glucose":7,"glucoseType":"Finger"},
+		{"eventType":"Note","created_at":"2024-12-15T13:30:00.000Z","glucose":8.7,"units":"mmol"}
+	]`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/treatments", strings.NewReader(body)).WithContext(contextWithSilentLogger())
+	w := httptest.NewRecorder()
+	api.CreateTreatments(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	type mbg struct {
+		mgdl   int
+		device string
+		time   time.Time
+	}
+	var got []mbg
+	for _, e := range createdEntries {
+		assert.Equal(t, "mbg", e.Type)
+		got = append(got, mbg{e.SgvMgdl, e.Device, e.Time})
+	}
+	assert.Equal(t, []mbg{
+		{160, "adam", time.Date(2024, 12, 15, 12, 46, 30, 679000000, time.UTC)},
+		{135, "xDrip4iOS", time.Date(2024, 12, 13, 18, 24, 4, 319000000, time.UTC)},
+		{110, "careportal", time.Date(2024, 12, 15, 13, 0, 0, 0, time.UTC)}, // in UNITS without units
+	}, got)
+
+	// off by default
+	createdEntries = nil
+	api.Settings = NewLiveSettings(Settings{})
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/treatments", strings.NewReader(body)).WithContext(contextWithSilentLogger())
+	api.CreateTreatments(httptest.NewRecorder(), req)
+	assert.Empty(t, createdEntries)
+}
+
+type mockNotifier struct {
+	notifications []models.Notification
+}
+
+func (m *mockNotifier) Notify(ctx context.Context, n models.Notification) {
+	m.notifications = append(m.notifications, n)
+}
+
+func TestApiV1_CreateTreatments_Announcement(t *testing.T) {
+	notifier := &mockNotifier{}
+	api := ApiV1{
+		TreatmentRepository: mockTreatmentRepository{
+			createTreatmentsFn: func(ctx context.Context, treatments []models.Treatment) []models.Treatment { return treatments },
+		},
+		Notifier: notifier,
+	}
+	body := `[
+		{"eventType":"Announcement","created_at":"2024-12-15T11:50:00.000Z","notes":"test announcement","isAnnouncement":true},
+		{"eventType":"Announcement","created_at":"2024-12-15T12:00:00.000Z","notes":"sensor failed","isAnnouncement":"true","urgent":true},
+		{"eventType":"Note","created_at":"2024-12-15T12:10:00.000Z","notes":"just a note"}
+	]`
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/treatments", strings.NewReader(body)).WithContext(contextWithSilentLogger())
+	w := httptest.NewRecorder()
+	api.CreateTreatments(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, []models.Notification{
+		{Level: models.LevelInfo, Title: "Announcement", Message: "test announcement", Group: models.AnnouncementGroup, Time: time.Date(2024, 12, 15, 11, 50, 0, 0, time.UTC), IsAnnouncement: true},
+		{Level: models.LevelUrgent, Title: "Announcement", Message: "sensor failed", Group: models.AnnouncementGroup, Time: time.Date(2024, 12, 15, 12, 0, 0, 0, time.UTC), IsAnnouncement: true},
+	}, notifier.notifications)
+}
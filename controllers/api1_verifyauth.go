@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"github.com/adamlounds/nightscout-go/middleware"
+	"github.com/go-chi/render"
+	"net/http"
+)
+
+// APIV1VerifyAuthResponse is nightscout's verifyauth response, which clients
+// (eg xDrip, AAPS) use to check their secret or token before uploading
+type APIV1VerifyAuthResponse struct {
+	Status  int                    `json:"status"`
+	Message APIV1VerifyAuthMessage `json:"message"`
+}
+
+type APIV1VerifyAuthMessage struct {
+	CanRead     bool   `json:"canRead"`
+	CanWrite    bool   `json:"canWrite"`
+	IsAdmin     bool   `json:"isAdmin"`
+	Message     string `json:"message"`     // OK or UNAUTHORIZED
+	RoleFound   string `json:"rolefound"`   // FOUND if a token or proxy user was recognised
+	Permissions string `json:"permissions"` // DEFAULT if only AUTH_DEFAULT_ROLES apply, else ROLE
+}
+
+// VerifyAuth reports what the request's credentials allow, as nightscout
+// does. It always succeeds: unrecognised credentials are UNAUTHORIZED, with
+// whatever AUTH_DEFAULT_ROLES allows.
+func (a ApiV1) VerifyAuth(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authn := middleware.GetAuthn(ctx)
+
+	var message APIV1VerifyAuthMessage
+	defaults := true
+	if authn != nil {
+		defaults = authn.AuthSubject.IsAnonymous()
+		message.CanRead = a.IsPermitted(ctx, authn, "*:*:read")
+		message.CanWrite = a.IsPermitted(ctx, authn, "*:*:write")
+		message.IsAdmin = a.IsPermitted(ctx, authn, "*:*:admin")
+	}
+
+	message.Message = "UNAUTHORIZED"
+	if (message.CanRead && !defaults) || message.IsAdmin {
+		message.Message = "OK"
+	}
+	// as in nightscout, the api secret is not a role
+	message.RoleFound = "NOTFOUND"
+	if !defaults && !authn.APISecret {
+		message.RoleFound = "FOUND"
+	}
+	message.Permissions = "ROLE"
+	if message.CanRead && defaults {
+		message.Permissions = "DEFAULT"
+	}
+
+	render.JSON(w, r, APIV1VerifyAuthResponse{Status: http.StatusOK, Message: message})
+}
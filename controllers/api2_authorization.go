@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/adamlounds/nightscout-go/i18n"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// AuthorizationRequest supports /api/v2/authorization/request/{token},
+// exchanging an access token for a JWT to send as Authorization: Bearer (or
+// ?token=) on later requests.
+func (a ApiV1) AuthorizationRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+
+	accessToken := chi.URLParam(r, "token")
+	source := a.AuthFailures.source(r)
+	if a.AuthFailures.refuse(w, r, source, a.Settings.Load().Language) {
+		return
+	}
+	issued, err := a.IssueJWT(ctx, accessToken, time.Now())
+	a.AuthFailures.record(ctx, source, !errors.Is(err, models.ErrNotFound))
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, i18n.New(a.Settings.Load().Language).T("Unauthorized"), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Warn("cannot issue jwt", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	log.Debug("issued jwt", slog.String("sub", issued.AuthSubject.Name))
+	render.JSON(w, r, APIV1StatusAuthorized{
+		Token:            issued.Token,
+		Sub:              issued.AuthSubject.Name,
+		PermissionGroups: a.PermissionGroups(ctx, issued.AuthSubject),
+		Iat:              issued.IssuedAt.Unix(),
+		Exp:              issued.ExpiresAt.Unix(),
+	})
+}
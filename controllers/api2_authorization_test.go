@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiV1_AuthorizationRequest(t *testing.T) {
+	now := time.Date(2024, 11, 28, 10, 0, 0, 0, time.UTC)
+	api := ApiV1{
+		AuthService: mockAuthService{
+			permissionGroupsFn: func(ctx context.Context, authSubject *models.AuthSubject) [][]string {
+				return [][]string{{"*:*:read"}}
+			},
+			issueJWTFn: func(ctx context.Context, accessToken string, _ time.Time) (*models.JWT, error) {
+				if accessToken != "reports-358de43470f328f3" {
+					return nil, models.ErrNotFound
+				}
+				return &models.JWT{
+					Token:       "eyJhbGciOiJIUzI1NiJ9.e30.c2ln",
+					AuthSubject: &models.AuthSubject{Name: "reports", RoleNames: []string{"readable"}},
+					IssuedAt:    now,
+					ExpiresAt:   now.Add(models.JWTLifetime),
+				}, nil
+			},
+		},
+		AuthFailures: NewAuthFailureTracker(0, 2, time.Minute, nil),
+	}
+	r := setupTestRouter(api.AuthorizationRequest, "GET", "/api/v2/authorization/request/{token}")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/authorization/request/reports-358de43470f328f3", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"token":"eyJhbGciOiJIUzI1NiJ9.e30.c2ln","sub":"reports","permissionGroups":[["*:*:read"]],"iat":1732788000,"exp":1732816800}`, w.Body.String())
+
+	for _, expected := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/authorization/request/reports-0000000000000000", nil))
+		assert.Equal(t, expected, w.Code)
+	}
+}
@@ -0,0 +1,519 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	slogctx "github.com/veqryn/slog-context"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Properties are what nightscout's plugins compute from recent data, keyed by
+// plugin name. Glucose values are given in mg/dL, with scaled and display
+// values in the configured units.
+
+// APIV2BGNowProperty is the latest sgv
+type APIV2BGNowProperty struct {
+	Last   int     `json:"last"` // mg/dL
+	Mills  int64   `json:"mills"`
+	Scaled float64 `json:"scaled"`
+}
+
+// APIV2DeltaProperty is the change between the last two sgvs, per five
+// minutes. Readings further apart are interpolated.
+type APIV2DeltaProperty struct {
+	Absolute     int     `json:"absolute"` // mg/dL between the readings
+	ElapsedMins  float64 `json:"elapsedMins"`
+	Interpolated bool    `json:"interpolated"`
+	Mgdl         int     `json:"mgdl"`
+	Scaled       float64 `json:"scaled"`
+	Display      string  `json:"display"` // eg +0.3
+}
+
+// APIV2DirectionProperty is the trend arrow of the latest sgv
+type APIV2DirectionProperty struct {
+	Value  string `json:"value"` // eg FortyFiveUp
+	Label  string `json:"label"`
+	Entity string `json:"entity"`
+}
+
+// APIV2IOBProperty is the insulin on board from bolus treatments
+type APIV2IOBProperty struct {
+	IOB         float64                `json:"iob"`      // U
+	Activity    float64                `json:"activity"` // U/min, nightscout scales this by the profile's sensitivity
+	LastBolus   map[string]interface{} `json:"lastBolus,omitempty"`
+	Source      string                 `json:"source"`
+	Display     string                 `json:"display"`     // eg 1.23
+	DisplayLine string                 `json:"displayLine"` // eg IOB: 1.23U
+}
+
+// APIV2COBProperty is the carbs on board from carb treatments
+type APIV2COBProperty struct {
+	COB           float64                `json:"cob"` // g
+	DecayedBy     string                 `json:"decayedBy,omitempty"`
+	IsDecaying    int                    `json:"isDecaying"` // 1 while carbs are being absorbed, as nightscout
+	CarbsHr       float64                `json:"carbs_hr"`
+	RawCarbImpact float64                `json:"rawCarbImpact"` // glucose rise per minute, in the profile's units
+	LastCarbs     map[string]interface{} `json:"lastCarbs,omitempty"`
+	Source        string                 `json:"source"`
+	Display       string                 `json:"display"`     // eg 12.5
+	DisplayLine   string                 `json:"displayLine"` // eg COB: 12.5g
+}
+
+// APIV2AR2Property is the ar2 forecast from the latest sgvs, drawn by the web
+// ui when showForecast includes ar2. Level is set when the next half hour is
+// heading out of range, and eventName says which way.
+type APIV2AR2Property struct {
+	Forecast    APIV2Forecast `json:"forecast"`
+	Level       int           `json:"level"`
+	EventName   string        `json:"eventName,omitempty"` // high or low
+	In20Mins    int           `json:"in20mins"`            // mg/dL
+	DisplayLine string        `json:"displayLine"`         // eg BG 20m: 7.5 mmol/L
+}
+
+type APIV2Forecast struct {
+	Predicted []APIV2ForecastPoint `json:"predicted"`
+	AvgLoss   float64              `json:"avgLoss"`
+}
+
+// APIV2ForecastPoint is a predicted value, with the cone either side of it.
+// All are mg/dL.
+type APIV2ForecastPoint struct {
+	Mills int64 `json:"mills"`
+	Mgdl  int   `json:"mgdl"`
+	Upper int   `json:"upper"`
+	Lower int   `json:"lower"`
+}
+
+// APIV2BasalProperty is the current basal rate from the active profile and
+// any temp basal, with the rates over the last day for the basal chart
+type APIV2BasalProperty struct {
+	Display string              `json:"display"` // eg T: 0.850U
+	Current APIV2BasalRate      `json:"current"`
+	Series  []APIV2BasalSegment `json:"series"`
+}
+
+// APIV2BasalRate is a basal rate, in U/hour
+type APIV2BasalRate struct {
+	Basal      float64                `json:"basal"` // as scheduled
+	TempBasal  float64                `json:"tempbasal"`
+	TotalBasal float64                `json:"totalbasal"`
+	Treatment  map[string]interface{} `json:"treatment,omitempty"` // the running temp basal
+}
+
+// APIV2BasalSegment is a period at a constant basal rate
+type APIV2BasalSegment struct {
+	Mills    int64 `json:"mills"`
+	EndMills int64 `json:"endmills"`
+	APIV2BasalRate
+}
+
+// APIV2AgeProperty is how long ago the cannula (cage), sensor (sage) or
+// insulin (iage) was changed, from the latest Site Change, Sensor
+// Start/Change or Insulin Change treatment
+type APIV2AgeProperty struct {
+	Found         bool   `json:"found"`
+	Age           int    `json:"age"` // whole hours
+	Days          int    `json:"days"`
+	Hours         int    `json:"hours"` // after Days
+	TreatmentDate int64  `json:"treatmentDate,omitempty"`
+	EventType     string `json:"eventType,omitempty"`
+	Notes         string `json:"notes,omitempty"`
+	Level         int    `json:"level"`
+	Display       string `json:"display"` // eg 2d3h
+}
+
+// APIV2UpbatProperty is the battery of each uploader that reported one in
+// devicestatus, with the lowest as Battery, Level and Display
+type APIV2UpbatProperty struct {
+	Battery int                    `json:"battery"` // percent
+	Level   int                    `json:"level"`
+	Display string                 `json:"display"` // eg 85%
+	Devices []APIV2UploaderBattery `json:"devices"` // lowest battery first
+}
+
+// APIV2UploaderBattery is the latest battery level one uploader reported
+type APIV2UploaderBattery struct {
+	Device  string `json:"device"`
+	Battery int    `json:"battery"` // percent
+	Mills   int64  `json:"mills"`
+	Level   int    `json:"level"`
+	Display string `json:"display"`
+}
+
+// upbatLookback is how recently an uploader must have reported its battery
+// to be included
+const upbatLookback = 24 * time.Hour
+
+// upbatMaxStatuses limits how many recent device statuses are searched for
+// battery levels
+const upbatMaxStatuses = 1000
+
+// deviceAgeLookback is how far back we look for cannula, sensor and insulin
+// changes. Older changes are not found.
+const deviceAgeLookback = 30 * 24 * time.Hour
+
+// basalLookback is how much of the basal chart the basal property gives
+const basalLookback = 24 * time.Hour
+
+// cobLookback is how far back carbs can still be on board
+const cobLookback = 12 * time.Hour
+
+// maxDeltaGap is the furthest apart readings can be for a delta
+const maxDeltaGap = 30 * time.Minute
+
+var directionLabels = map[string]APIV2DirectionProperty{
+	"NONE":              {Label: "⇼", Entity: "&#8700;"},
+	"DoubleUp":          {Label: "⇈", Entity: "&#8648;"},
+	"SingleUp":          {Label: "↑", Entity: "&#8593;"},
+	"FortyFiveUp":       {Label: "↗", Entity: "&#8599;"},
+	"Flat":              {Label: "→", Entity: "&#8594;"},
+	"FortyFiveDown":     {Label: "↘", Entity: "&#8600;"},
+	"SingleDown":        {Label: "↓", Entity: "&#8595;"},
+	"DoubleDown":        {Label: "⇊", Entity: "&#8650;"},
+	"NOT COMPUTABLE":    {Label: "-", Entity: "&#45;"},
+	"RATE OUT OF RANGE": {Label: "⇕", Entity: "&#8661;"},
+}
+
+// Properties handler supports /api/v2/properties, and eg
+// /api/v2/properties/bgnow,delta for just some of them
+func (a ApiV1) Properties(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	log := slogctx.FromCtx(ctx)
+	settings := a.Settings.Load()
+
+	sgvs, err := a.FetchLatestSGVs(ctx, time.Now(), 2)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		log.Warn("cannot fetch sgvs for properties", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	properties := make(map[string]interface{})
+	err = a.treatmentProperties(ctx, time.Now(), properties)
+	if err != nil {
+		log.Warn("cannot calculate treatment properties", slog.Any("error", err))
+		a.httpError(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if a.DeviceStatusRepository != nil {
+		statuses, err := a.DeviceStatusRepository.FetchLatestDeviceStatuses(ctx, time.Now(), upbatMaxStatuses)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			log.Warn("cannot fetch device statuses for properties", slog.Any("error", err))
+			a.httpError(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		if upbat, ok := upbatProperty(settings.UploaderBattery, statuses, time.Now()); ok {
+			properties["upbat"] = upbat
+		}
+	}
+	if len(sgvs) > 0 {
+		properties["bgnow"] = APIV2BGNowProperty{
+			Last:   sgvs[0].SgvMgdl,
+			Mills:  sgvs[0].Time.UnixMilli(),
+			Scaled: scaleMgdl(settings.Units, sgvs[0].SgvMgdl),
+		}
+		properties["direction"] = directionProperty(sgvs)
+	}
+	if len(sgvs) > 1 {
+		if delta, ok := deltaProperty(settings.Units, sgvs[0], sgvs[1]); ok {
+			properties["delta"] = delta
+		}
+		if forecast, ok := models.AR2Forecast(sgvs[0], sgvs[1]); ok {
+			properties["ar2"] = ar2Property(settings, forecast)
+		}
+	}
+
+	if names := chi.URLParam(r, "names"); names != "" {
+		selected := make(map[string]interface{})
+		for _, name := range strings.Split(names, ",") {
+			if p, ok := properties[name]; ok {
+				selected[name] = p
+			}
+		}
+		properties = selected
+	}
+	render.JSON(w, r, properties)
+}
+
+// directionProperty returns the direction of the latest of sgvs (newest
+// first), deriving it from the previous reading if the uploader did not
+// give one
+func directionProperty(sgvs []models.Entry) APIV2DirectionProperty {
+	value := sgvs[0].Direction
+	if value == "" && len(sgvs) > 1 {
+		value = models.DirectionBetween(sgvs[1], sgvs[0])
+	}
+	d, ok := directionLabels[value]
+	if !ok {
+		value = "NONE"
+		d = directionLabels[value]
+	}
+	d.Value = value
+	return d
+}
+
+func deltaProperty(units string, last, prev models.Entry) (APIV2DeltaProperty, bool) {
+	elapsed := last.Time.Sub(prev.Time)
+	if elapsed <= 0 || elapsed > maxDeltaGap {
+		return APIV2DeltaProperty{}, false
+	}
+	d := APIV2DeltaProperty{
+		Absolute:    last.SgvMgdl - prev.SgvMgdl,
+		ElapsedMins: elapsed.Minutes(),
+	}
+	d.Mgdl = d.Absolute
+	if d.ElapsedMins > 9 {
+		d.Interpolated = true
+		d.Mgdl = int(float64(d.Absolute) * 5 / d.ElapsedMins)
+	}
+	if units == models.UnitsMmol {
+		d.Scaled = models.MgdlToMmol(d.Mgdl)
+		d.Display = fmt.Sprintf("%+.1f", d.Scaled)
+	} else {
+		d.Scaled = float64(d.Mgdl)
+		d.Display = fmt.Sprintf("%+d", d.Mgdl)
+	}
+	return d, true
+}
+
+func ar2Property(settings Settings, forecast models.Forecast) APIV2AR2Property {
+	p := APIV2AR2Property{
+		Forecast: APIV2Forecast{AvgLoss: forecast.AvgLoss},
+		Level:    forecast.Level,
+		In20Mins: forecast.In(20 * time.Minute),
+	}
+	for _, f := range forecast.Predicted {
+		p.Forecast.Predicted = append(p.Forecast.Predicted, APIV2ForecastPoint{
+			Mills: f.Time.UnixMilli(),
+			Mgdl:  f.Mgdl,
+			Upper: f.Upper,
+			Lower: f.Lower,
+		})
+	}
+
+	thresholds := settings.Thresholds
+	if thresholds == (models.Thresholds{}) {
+		thresholds = models.DefaultThresholds
+	}
+	if p.Level != models.LevelNone {
+		if p.In20Mins > thresholds.TargetTop {
+			p.EventName = "high"
+		} else if p.In20Mins < thresholds.TargetBottom {
+			p.EventName = "low"
+		}
+	}
+
+	if settings.Units == models.UnitsMmol {
+		p.DisplayLine = fmt.Sprintf("BG 20m: %.1f mmol/L", models.MgdlToMmol(p.In20Mins))
+	} else {
+		p.DisplayLine = fmt.Sprintf("BG 20m: %d mg/dL", p.In20Mins)
+	}
+	return p
+}
+
+// treatmentProperties adds the properties calculated from recent treatments
+// and the profile in effect (after any Profile Switch): iob, cob, cage, sage,
+// iage and, if the profile schedules basal rates, basal
+func (a ApiV1) treatmentProperties(ctx context.Context, now time.Time, properties map[string]interface{}) error {
+	treatments, err := a.FetchTreatmentsAfter(ctx, now.Add(-deviceAgeLookback))
+	if err != nil {
+		return err
+	}
+	profiles, err := a.fetchProfiles(ctx)
+	if err != nil {
+		return err
+	}
+	profile := models.ProfileAt(profiles, treatments, now)
+
+	settings := a.Settings.Load()
+	insulin := settings.Insulin
+	carbs := models.CarbModel{AbsorptionRate: settings.CarbAbsorptionRate}
+	var sens float64
+	if profile != nil {
+		if hours, ok := profile.Float("dia"); ok && hours > 0 {
+			insulin.DIA = time.Duration(hours * float64(time.Hour))
+		}
+		if rate, ok := profile.Float("carbs_hr"); ok && rate > 0 {
+			carbs.AbsorptionRate = rate
+		}
+		carbs.CarbRatio, _ = profile.ScheduleValue("carbratio", now)
+		sens, _ = profile.ScheduleValue("sens", now)
+	}
+	carbs.Insulin = insulin
+
+	properties["cage"] = ageProperty(models.CannulaAgeRule.Age(treatments, now))
+	properties["sage"] = ageProperty(models.SensorAgeRule.Age(treatments, now))
+	properties["iage"] = ageProperty(models.InsulinAgeRule.Age(treatments, now))
+
+	// the rest only need recent treatments, though a profile switch
+	// started before then may still be running
+	lookback := max(insulin.Duration(), cobLookback, basalLookback)
+	start, _ := slices.BinarySearchFunc(treatments, now.Add(-lookback), func(t models.Treatment, target time.Time) int {
+		return t.Time.Compare(target)
+	})
+	recent := treatments[start:]
+	properties["iob"] = iobProperty(insulin.OnBoard(recent, now))
+	properties["cob"] = cobProperty(carbs, sens, carbs.OnBoard(recent, now))
+	if profile != nil {
+		if _, ok := profile.ScheduleValue("basal", now); ok {
+			properties["basal"] = basalProperty(profiles, treatments, now)
+		}
+	}
+	return nil
+}
+
+func ageProperty(age models.DeviceAge) APIV2AgeProperty {
+	p := APIV2AgeProperty{Level: age.Level, Display: "n/a"}
+	if age.Treatment == nil {
+		return p
+	}
+	hours := int(age.Age.Hours())
+	p.Found = true
+	p.Age = hours
+	p.Days = hours / 24
+	p.Hours = hours % 24
+	p.TreatmentDate = age.Treatment.Time.UnixMilli()
+	p.EventType = age.Treatment.Type
+	p.Notes, _ = age.Treatment.Fields["notes"].(string)
+	p.Display = fmt.Sprintf("%dh", p.Hours)
+	if p.Days > 0 {
+		p.Display = fmt.Sprintf("%dd%s", p.Days, p.Display)
+	}
+	return p
+}
+
+// upbatProperty returns the battery levels uploaders reported in the last
+// upbatLookback, or false if none did
+func upbatProperty(thresholds models.BatteryThresholds, statuses []models.DeviceStatus, now time.Time) (APIV2UpbatProperty, bool) {
+	recent := slices.DeleteFunc(slices.Clone(statuses), func(s models.DeviceStatus) bool {
+		return s.Time.Before(now.Add(-upbatLookback))
+	})
+	batteries := thresholds.UploaderBatteries(recent)
+	if len(batteries) == 0 {
+		return APIV2UpbatProperty{}, false
+	}
+	p := APIV2UpbatProperty{
+		Battery: batteries[0].Battery,
+		Level:   batteries[0].Level,
+		Display: fmt.Sprintf("%d%%", batteries[0].Battery),
+	}
+	for _, b := range batteries {
+		p.Devices = append(p.Devices, APIV2UploaderBattery{
+			Device:  b.Device,
+			Battery: b.Battery,
+			Mills:   b.Time.UnixMilli(),
+			Level:   b.Level,
+			Display: fmt.Sprintf("%d%%", b.Battery),
+		})
+	}
+	return p, true
+}
+
+func iobProperty(onBoard models.InsulinOnBoard) APIV2IOBProperty {
+	p := APIV2IOBProperty{
+		IOB:      onBoard.IOB,
+		Activity: onBoard.Activity,
+		Source:   "Care Portal",
+		Display:  fmt.Sprintf("%.2f", onBoard.IOB),
+	}
+	p.DisplayLine = "IOB: " + p.Display + "U"
+	if onBoard.LastBolus != nil {
+		p.LastBolus = treatmentResponse(*onBoard.LastBolus, "", "")
+	}
+	return p
+}
+
+// cobProperty returns carbs on board. The carb impact, the rate carbs raise
+// glucose, needs the profile's sensitivity and carb ratio.
+func cobProperty(model models.CarbModel, sens float64, onBoard models.CarbsOnBoard) APIV2COBProperty {
+	cob := math.Round(onBoard.COB*10) / 10
+	p := APIV2COBProperty{
+		COB:     cob,
+		CarbsHr: model.AbsorptionRate,
+		Source:  "Care Portal",
+		Display: strconv.FormatFloat(cob, 'f', -1, 64),
+	}
+	if p.CarbsHr <= 0 {
+		p.CarbsHr = models.DefaultCarbAbsorptionRate
+	}
+	p.DisplayLine = "COB: " + p.Display + "g"
+	if !onBoard.DecayedBy.IsZero() {
+		p.DecayedBy = onBoard.DecayedBy.UTC().Format(rfc3339msLayout)
+	}
+	if onBoard.IsDecaying {
+		p.IsDecaying = 1
+		if model.CarbRatio > 0 {
+			p.RawCarbImpact = sens / model.CarbRatio * p.CarbsHr / 60
+		}
+	}
+	if onBoard.LastCarbs != nil {
+		p.LastCarbs = treatmentResponse(*onBoard.LastCarbs, "", "")
+	}
+	return p
+}
+
+// basalProperty returns the current basal rate, and the rates over the last
+// basalLookback for the basal chart, following any profile switches
+func basalProperty(profiles []models.Profile, treatments []models.Treatment, now time.Time) APIV2BasalProperty {
+	current := models.ProfileAt(profiles, treatments, now).BasalAt(treatments, now)
+	p := APIV2BasalProperty{
+		Current: basalRateResponse(current),
+		Display: strconv.FormatFloat(current.TotalBasal, 'f', 3, 64) + "U",
+	}
+	if current.Treatment != nil {
+		p.Display = "T: " + p.Display
+	}
+	for _, s := range models.SwitchedBasalTimeline(profiles, treatments, now.Add(-basalLookback), now) {
+		p.Series = append(p.Series, APIV2BasalSegment{
+			Mills:          s.Start.UnixMilli(),
+			EndMills:       s.End.UnixMilli(),
+			APIV2BasalRate: basalRateResponse(s.BasalRate),
+		})
+	}
+	return p
+}
+
+func basalRateResponse(rate models.BasalRate) APIV2BasalRate {
+	r := APIV2BasalRate{
+		Basal:      rate.Basal,
+		TempBasal:  rate.TempBasal,
+		TotalBasal: rate.TotalBasal,
+	}
+	if rate.Treatment != nil {
+		r.Treatment = treatmentResponse(*rate.Treatment, "", "")
+	}
+	return r
+}
+
+// fetchProfiles returns the stored profiles oldest first (the repository
+// gives them most recent first, as nightscout does), or none if there is no
+// profile repository
+func (a ApiV1) fetchProfiles(ctx context.Context) ([]models.Profile, error) {
+	if a.ProfileRepository == nil {
+		return nil, nil
+	}
+	profiles, err := a.ProfileRepository.FetchProfiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(profiles, func(a, b models.Profile) int { return a.Time.Compare(b.Time) })
+	return profiles, nil
+}
+
+// scaleMgdl returns a glucose value in units
+func scaleMgdl(units string, mgdl int) float64 {
+	if units == models.UnitsMmol {
+		return models.MgdlToMmol(mgdl)
+	}
+	return float64(mgdl)
+}
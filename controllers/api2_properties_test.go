@@ -0,0 +1,373 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/adamlounds/nightscout-go/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiV1_Properties(t *testing.T) {
+	last := time.Date(2024, 11, 28, 12, 0, 0, 0, time.UTC)
+	sgvs := []models.Entry{
+		{Type: "sgv", SgvMgdl: 130, Time: last},
+		{Type: "sgv", SgvMgdl: 110, Time: last.Add(-10 * time.Minute)},
+	}
+
+	tests := []struct {
+		name         string
+		units        string
+		path         string
+		expectBGNow  float64
+		expectDelta  string
+		expectValues []string
+	}{
+		{name: "mg/dl", units: models.UnitsMgdl, path: "/api/v2/properties", expectBGNow: 130, expectDelta: "+10", expectValues: []string{"ar2", "bgnow", "cage", "cob", "delta", "direction", "iage", "iob", "sage"}},
+		{name: "mmol", units: models.UnitsMmol, path: "/api/v2/properties", expectBGNow: 7.2, expectDelta: "+0.6", expectValues: []string{"ar2", "bgnow", "cage", "cob", "delta", "direction", "iage", "iob", "sage"}},
+		{name: "selected", units: models.UnitsMgdl, path: "/api/v2/properties/bgnow,iob,cob", expectBGNow: 130, expectValues: []string{"bgnow", "cob", "iob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := ApiV1{
+				EntryRepository: mockEntryRepository{
+					fetchLatestSGVsFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+						return sgvs, nil
+					},
+				},
+				TreatmentRepository: mockTreatmentRepository{},
+				Settings:            NewLiveSettings(Settings{Units: tt.units}),
+			}
+			r := setupTestRouter(api.Properties, "GET", "/api/v2/properties")
+			r.Get("/api/v2/properties/{names}", api.Properties)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var response struct {
+				BGNow     *APIV2BGNowProperty     `json:"bgnow"`
+				Delta     *APIV2DeltaProperty     `json:"delta"`
+				Direction *APIV2DirectionProperty `json:"direction"`
+			}
+			body := w.Body.Bytes()
+			assert.NoError(t, json.Unmarshal(body, &response))
+			var keys map[string]json.RawMessage
+			assert.NoError(t, json.Unmarshal(body, &keys))
+			assert.Len(t, keys, len(tt.expectValues))
+			for _, k := range tt.expectValues {
+				assert.Contains(t, keys, k)
+			}
+
+			assert.Equal(t, 130, response.BGNow.Last)
+			assert.Equal(t, tt.expectBGNow, response.BGNow.Scaled)
+			if tt.expectDelta == "" {
+				return
+			}
+			assert.True(t, response.Delta.Interpolated)
+			assert.Equal(t, 20, response.Delta.Absolute)
+			assert.Equal(t, 10, response.Delta.Mgdl)
+			assert.Equal(t, tt.expectDelta, response.Delta.Display)
+			// derived, as the uploader did not give a direction
+			assert.Equal(t, "FortyFiveUp", response.Direction.Value)
+			assert.Equal(t, "↗", response.Direction.Label)
+		})
+	}
+}
+
+func TestApiV1_PropertiesIOB(t *testing.T) {
+	var fetchedAfter time.Time
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			fetchLatestSGVsFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+				return nil, models.ErrNotFound
+			},
+		},
+		TreatmentRepository: mockTreatmentRepository{
+			fetchAfterFn: func(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+				fetchedAfter = minTime
+				return []models.Treatment{
+					{ID: "bolus", Type: "Correction Bolus", Time: time.Now().Add(-75 * time.Minute), Fields: map[string]interface{}{"insulin": 2.0}},
+				}, nil
+			},
+		},
+		// the profile's dia overrides the configured one
+		ProfileRepository: &mockProfileRepository{profiles: []models.Profile{{
+			Time: time.Now().Add(-24 * time.Hour),
+			Fields: map[string]interface{}{
+				"defaultProfile": "Default",
+				"store":          map[string]interface{}{"Default": map[string]interface{}{"dia": 3.0}},
+			},
+		}}},
+		Settings: NewLiveSettings(Settings{Insulin: models.InsulinModel{DIA: 5 * time.Hour}}),
+	}
+	r := setupTestRouter(api.Properties, "GET", "/api/v2/properties/{names}")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/properties/iob", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		IOB APIV2IOBProperty `json:"iob"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	// treatments are looked for further back than the dia, for device ages
+	assert.InDelta(t, 30*24*time.Hour, time.Since(fetchedAfter), float64(time.Minute))
+	assert.InDelta(t, 1.111, response.IOB.IOB, 0.002)
+	assert.Equal(t, "1.11", response.IOB.Display)
+	assert.Equal(t, "IOB: 1.11U", response.IOB.DisplayLine)
+	assert.Equal(t, "bolus", response.IOB.LastBolus["_id"])
+}
+
+func TestApiV1_PropertiesCOB(t *testing.T) {
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			fetchLatestSGVsFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+				return nil, models.ErrNotFound
+			},
+		},
+		TreatmentRepository: mockTreatmentRepository{
+			fetchAfterFn: func(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+				return []models.Treatment{
+					{ID: "meal", Type: "Carb Correction", Time: time.Now().Add(-50 * time.Minute), Fields: map[string]interface{}{"carbs": 30.0}},
+				}, nil
+			},
+		},
+		// the profile's carbs_hr overrides the configured one
+		ProfileRepository: &mockProfileRepository{profiles: []models.Profile{{
+			Time: time.Now().Add(-24 * time.Hour),
+			Fields: map[string]interface{}{
+				"defaultProfile": "Default",
+				"store": map[string]interface{}{"Default": map[string]interface{}{
+					"carbs_hr":  20.0,
+					"carbratio": []interface{}{map[string]interface{}{"time": "00:00", "value": 10.0}},
+					"sens":      []interface{}{map[string]interface{}{"time": "00:00", "value": 50.0}},
+				}},
+			},
+		}}},
+		Settings: NewLiveSettings(Settings{CarbAbsorptionRate: 40}),
+	}
+	r := setupTestRouter(api.Properties, "GET", "/api/v2/properties/{names}")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/properties/cob", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		COB APIV2COBProperty `json:"cob"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	// absorbing for 30 of the 90 minutes 30g takes at 20g/hour
+	assert.InDelta(t, 20, response.COB.COB, 0.1)
+	assert.Equal(t, 1, response.COB.IsDecaying)
+	assert.Equal(t, 20.0, response.COB.CarbsHr)
+	assert.InDelta(t, 50.0/10*20/60, response.COB.RawCarbImpact, 0.001)
+	assert.Equal(t, "COB: "+response.COB.Display+"g", response.COB.DisplayLine)
+	assert.Equal(t, "meal", response.COB.LastCarbs["_id"])
+}
+
+func TestApiV1_PropertiesAR2(t *testing.T) {
+	last := time.Now().Truncate(time.Second)
+	tests := []struct {
+		name              string
+		sgvs              []int // mg/dL, newest first, 5 minutes apart
+		units             string
+		expectLevel       int
+		expectEvent       string
+		expectDisplayLine string
+	}{
+		{name: "in range", sgvs: []int{140, 140}, units: models.UnitsMgdl, expectLevel: models.LevelNone, expectDisplayLine: "BG 20m: 140 mg/dL"},
+		{name: "rising", sgvs: []int{200, 180}, units: models.UnitsMgdl, expectLevel: models.LevelWarn, expectEvent: "high", expectDisplayLine: "BG 20m: 239 mg/dL"},
+		{name: "falling", sgvs: []int{60, 70}, units: models.UnitsMmol, expectLevel: models.LevelUrgent, expectEvent: "low", expectDisplayLine: "BG 20m: 2.6 mmol/L"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := ApiV1{
+				EntryRepository: mockEntryRepository{
+					fetchLatestSGVsFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+						return []models.Entry{
+							{Type: "sgv", SgvMgdl: tt.sgvs[0], Time: last},
+							{Type: "sgv", SgvMgdl: tt.sgvs[1], Time: last.Add(-5 * time.Minute)},
+						}, nil
+					},
+				},
+				TreatmentRepository: mockTreatmentRepository{},
+				Settings:            NewLiveSettings(Settings{Units: tt.units}),
+			}
+			r := setupTestRouter(api.Properties, "GET", "/api/v2/properties/{names}")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/properties/ar2", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var response struct {
+				AR2 APIV2AR2Property `json:"ar2"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			ar2 := response.AR2
+			assert.Len(t, ar2.Forecast.Predicted, 13)
+			assert.Equal(t, last.Add(5*time.Minute).UnixMilli(), ar2.Forecast.Predicted[0].Mills)
+			assert.Equal(t, ar2.Forecast.Predicted[3].Mgdl, ar2.In20Mins)
+			assert.Equal(t, tt.expectLevel, ar2.Level)
+			assert.Equal(t, tt.expectEvent, ar2.EventName)
+			assert.Equal(t, tt.expectDisplayLine, ar2.DisplayLine)
+		})
+	}
+}
+
+func TestApiV1_PropertiesBasal(t *testing.T) {
+	now := time.Now()
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			fetchLatestSGVsFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+				return nil, models.ErrNotFound
+			},
+		},
+		TreatmentRepository: mockTreatmentRepository{
+			fetchAfterFn: func(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+				return []models.Treatment{
+					{ID: "temp", Type: "Temp Basal", Time: now.Add(-30 * time.Minute), Fields: map[string]interface{}{"percent": -20.0, "duration": 60.0}},
+				}, nil
+			},
+		},
+		ProfileRepository: &mockProfileRepository{profiles: []models.Profile{{
+			Time: now.Add(-48 * time.Hour),
+			Fields: map[string]interface{}{
+				"defaultProfile": "Default",
+				"store": map[string]interface{}{"Default": map[string]interface{}{
+					"basal": []interface{}{map[string]interface{}{"time": "00:00", "value": 1.0}},
+				}},
+			},
+		}}},
+	}
+	r := setupTestRouter(api.Properties, "GET", "/api/v2/properties/{names}")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/properties/basal", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Basal APIV2BasalProperty `json:"basal"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	basal := response.Basal
+	assert.Equal(t, "T: 0.800U", basal.Display)
+	assert.Equal(t, 1.0, basal.Current.Basal)
+	assert.Equal(t, 0.8, basal.Current.TotalBasal)
+	assert.Equal(t, "temp", basal.Current.Treatment["_id"])
+
+	// a day at the scheduled rate, then the temp basal
+	assert.Len(t, basal.Series, 2)
+	assert.Equal(t, now.Add(-24*time.Hour).UnixMilli(), basal.Series[0].Mills)
+	assert.Equal(t, 1.0, basal.Series[0].TotalBasal)
+	assert.Equal(t, now.Add(-30*time.Minute).UnixMilli(), basal.Series[1].Mills)
+	assert.Equal(t, now.UnixMilli(), basal.Series[1].EndMills)
+	assert.Equal(t, 0.8, basal.Series[1].TotalBasal)
+
+	// a running profile switch scales the scheduled rate, and the chart
+	// follows it
+	api.TreatmentRepository = mockTreatmentRepository{
+		fetchAfterFn: func(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+			return []models.Treatment{
+				{ID: "switch", Type: models.ProfileSwitchType, Time: now.Add(-2 * time.Hour), Fields: map[string]interface{}{"profile": "Default", "percentage": 150.0, "duration": 180.0}},
+			}, nil
+		},
+	}
+	r = setupTestRouter(api.Properties, "GET", "/api/v2/properties/{names}")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/properties/basal", nil))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "1.500U", response.Basal.Display)
+	assert.Len(t, response.Basal.Series, 2)
+	assert.Equal(t, now.Add(-2*time.Hour).UnixMilli(), response.Basal.Series[1].Mills)
+	assert.Equal(t, 1.5, response.Basal.Series[1].TotalBasal)
+
+	// without a basal schedule there is no basal property
+	api.ProfileRepository = &mockProfileRepository{}
+	r = setupTestRouter(api.Properties, "GET", "/api/v2/properties/{names}")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/properties/basal", nil))
+	assert.JSONEq(t, "{}", w.Body.String())
+}
+
+func TestApiV1_PropertiesDeviceAge(t *testing.T) {
+	now := time.Now()
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			fetchLatestSGVsFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+				return nil, models.ErrNotFound
+			},
+		},
+		TreatmentRepository: mockTreatmentRepository{
+			fetchAfterFn: func(ctx context.Context, minTime time.Time) ([]models.Treatment, error) {
+				return []models.Treatment{
+					{ID: "sensor", Type: "Sensor Start", Time: now.Add(-(6*24 + 21) * time.Hour), Fields: map[string]interface{}{"notes": "left arm"}},
+					{ID: "site", Type: "Site Change", Time: now.Add(-50*time.Hour - 10*time.Minute)},
+				}, nil
+			},
+		},
+	}
+	r := setupTestRouter(api.Properties, "GET", "/api/v2/properties/{names}")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/properties/cage,sage,iage", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		CAGE APIV2AgeProperty `json:"cage"`
+		SAGE APIV2AgeProperty `json:"sage"`
+		IAGE APIV2AgeProperty `json:"iage"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, APIV2AgeProperty{
+		Found: true, Age: 50, Days: 2, Hours: 2,
+		TreatmentDate: now.Add(-50*time.Hour - 10*time.Minute).UnixMilli(),
+		EventType:     "Site Change", Level: models.LevelWarn, Display: "2d2h",
+	}, response.CAGE)
+	assert.Equal(t, 165, response.SAGE.Age)
+	assert.Equal(t, "6d21h", response.SAGE.Display)
+	assert.Equal(t, "left arm", response.SAGE.Notes)
+	assert.Equal(t, models.LevelWarn, response.SAGE.Level)
+	assert.Equal(t, APIV2AgeProperty{Level: models.LevelNone, Display: "n/a"}, response.IAGE)
+}
+
+func TestApiV1_PropertiesUpbat(t *testing.T) {
+	now := time.Now().Truncate(time.Millisecond)
+	statuses := &mockDeviceStatusRepository{statuses: []models.DeviceStatus{
+		{Device: "xdrip", Time: now, Fields: map[string]interface{}{"uploader": map[string]interface{}{"battery": 28.0}}},
+		{Device: "loop", Time: now.Add(-time.Hour), Fields: map[string]interface{}{"uploaderBattery": 75.0}},
+		{Device: "old", Time: now.Add(-25 * time.Hour), Fields: map[string]interface{}{"uploaderBattery": 5.0}},
+	}}
+	api := ApiV1{
+		EntryRepository: mockEntryRepository{
+			fetchLatestSGVsFn: func(ctx context.Context, maxTime time.Time, maxEntries int) ([]models.Entry, error) {
+				return nil, models.ErrNotFound
+			},
+		},
+		TreatmentRepository:    mockTreatmentRepository{},
+		DeviceStatusRepository: statuses,
+		Settings:               NewLiveSettings(Settings{UploaderBattery: models.DefaultBatteryThresholds}),
+	}
+	r := setupTestRouter(api.Properties, "GET", "/api/v2/properties/{names}")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/properties/upbat", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Upbat APIV2UpbatProperty `json:"upbat"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, APIV2UpbatProperty{
+		Battery: 28,
+		Level:   models.LevelWarn,
+		Display: "28%",
+		Devices: []APIV2UploaderBattery{
+			{Device: "xdrip", Battery: 28, Mills: now.UnixMilli(), Level: models.LevelWarn, Display: "28%"},
+			{Device: "loop", Battery: 75, Mills: now.Add(-time.Hour).UnixMilli(), Level: models.LevelNone, Display: "75%"},
+		},
+	}, response.Upbat)
+
+	// no upbat when no uploader has reported its battery recently
+	statuses.statuses = statuses.statuses[2:]
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/api/v2/properties/upbat", nil))
+	assert.JSONEq(t, "{}", w.Body.String())
+}
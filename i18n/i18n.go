@@ -0,0 +1,104 @@
+package i18n
+
+// translations holds user-facing strings for each supported language. As in
+// nightscout-js, strings are keyed by their english text, so a missing
+// translation falls back to english.
+var translations = map[string]map[string]string{
+	"de": {
+		"not found":                                            "nicht gefunden",
+		"internal server error":                                "interner Serverfehler",
+		"Unauthorized":                                         "Nicht autorisiert",
+		"invalid request body":                                 "ungültiger Anfrageinhalt",
+		"unsupported media type":                               "nicht unterstützter Medientyp",
+		"count must be an integer":                             "count muss eine ganze Zahl sein",
+		"count must be >= 1":                                   "count muss >= 1 sein",
+		"count must be <= %d":                                  "count muss <= %d sein",
+		"invalid date format":                                  "ungültiges Datumsformat",
+		"invalid type":                                         "ungültiger Typ",
+		"unparseable treatment eventTime":                      "eventTime der Behandlung nicht lesbar",
+		"unknown treatment type":                               "unbekannter Behandlungstyp",
+		"invalid treatment type":                               "ungültiger Behandlungstyp",
+		"missing url":                                          "URL fehlt",
+		"bad url":                                              "ungültige URL",
+		"url must be http/https":                               "URL muss http/https sein",
+		"url must include a hostname":                          "URL muss einen Hostnamen enthalten",
+		"token or api_secret must be supplied":                 "token oder api_secret muss angegeben werden",
+		"api_secret must be at least 12 characters long":       "api_secret muss mindestens 12 Zeichen lang sein",
+		"token must be at least 17 characters long":            "token muss mindestens 17 Zeichen lang sein",
+		"Cannot fetch entries from remote nightscout instance": "Einträge können nicht von der entfernten Nightscout-Instanz abgerufen werden",
+	},
+	"es": {
+		"not found":                                            "no encontrado",
+		"internal server error":                                "error interno del servidor",
+		"Unauthorized":                                         "No autorizado",
+		"invalid request body":                                 "cuerpo de la solicitud no válido",
+		"unsupported media type":                               "tipo de medio no soportado",
+		"count must be an integer":                             "count debe ser un número entero",
+		"count must be >= 1":                                   "count debe ser >= 1",
+		"count must be <= %d":                                  "count debe ser <= %d",
+		"invalid date format":                                  "formato de fecha no válido",
+		"invalid type":                                         "tipo no válido",
+		"unparseable treatment eventTime":                      "eventTime del tratamiento ilegible",
+		"unknown treatment type":                               "tipo de tratamiento desconocido",
+		"invalid treatment type":                               "tipo de tratamiento no válido",
+		"missing url":                                          "falta la url",
+		"bad url":                                              "url no válida",
+		"url must be http/https":                               "la url debe ser http/https",
+		"url must include a hostname":                          "la url debe incluir un nombre de host",
+		"token or api_secret must be supplied":                 "se debe proporcionar token o api_secret",
+		"api_secret must be at least 12 characters long":       "api_secret debe tener al menos 12 caracteres",
+		"token must be at least 17 characters long":            "token debe tener al menos 17 caracteres",
+		"Cannot fetch entries from remote nightscout instance": "No se pueden obtener entradas de la instancia remota de nightscout",
+	},
+	"fr": {
+		"not found":                                            "introuvable",
+		"internal server error":                                "erreur interne du serveur",
+		"Unauthorized":                                         "Non autorisé",
+		"invalid request body":                                 "corps de requête invalide",
+		"unsupported media type":                               "type de média non pris en charge",
+		"count must be an integer":                             "count doit être un entier",
+		"count must be >= 1":                                   "count doit être >= 1",
+		"count must be <= %d":                                  "count doit être <= %d",
+		"invalid date format":                                  "format de date invalide",
+		"invalid type":                                         "type invalide",
+		"unparseable treatment eventTime":                      "eventTime du traitement illisible",
+		"unknown treatment type":                               "type de traitement inconnu",
+		"invalid treatment type":                               "type de traitement invalide",
+		"missing url":                                          "url manquante",
+		"bad url":                                              "url invalide",
+		"url must be http/https":                               "l'url doit être http/https",
+		"url must include a hostname":                          "l'url doit inclure un nom d'hôte",
+		"token or api_secret must be supplied":                 "token ou api_secret doit être fourni",
+		"api_secret must be at least 12 characters long":       "api_secret doit comporter au moins 12 caractères",
+		"token must be at least 17 characters long":            "token doit comporter au moins 17 caractères",
+		"Cannot fetch entries from remote nightscout instance": "Impossible de récupérer les entrées de l'instance nightscout distante",
+	},
+}
+
+// Translator translates user-facing strings into a single language
+type Translator struct {
+	language string
+}
+
+func New(language string) Translator {
+	return Translator{language: language}
+}
+
+// T returns the translation of s, or s itself if there is no translation
+func (t Translator) T(s string) string {
+	translated, ok := translations[t.language][s]
+	if !ok {
+		return s
+	}
+	return translated
+}
+
+// IsSupported reports whether we have translations for the language.
+// english is always supported.
+func IsSupported(language string) bool {
+	if language == "en" {
+		return true
+	}
+	_, ok := translations[language]
+	return ok
+}
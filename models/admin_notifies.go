@@ -0,0 +1,107 @@
+package models
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AdminNotifyLifetime is how long an admin notify is shown after it was last
+// recorded, as in nightscout
+const AdminNotifyLifetime = 8 * time.Hour
+
+// AdminNotify is a problem operators should know about, eg uploads to the
+// bucket failing, shown in the admin notifies panel. Repeats of a message
+// are counted rather than listed again.
+type AdminNotify struct {
+	Title        string
+	Message      string
+	Count        int
+	LastRecorded time.Time
+}
+
+// AdminNotifies holds recent admin notifies in memory, so they do not
+// survive a restart. A nil *AdminNotifies drops everything, so subsystems
+// need not check one is configured.
+type AdminNotifies struct {
+	lock     sync.Mutex
+	notifies []AdminNotify
+	acked    map[string]time.Time // when each subject last acknowledged
+}
+
+func NewAdminNotifies() *AdminNotifies {
+	return &AdminNotifies{acked: make(map[string]time.Time)}
+}
+
+// Add records a notify, or counts it again if its message is already shown
+func (n *AdminNotifies) Add(title, message string) {
+	n.add(title, message, time.Now())
+}
+
+func (n *AdminNotifies) add(title, message string, now time.Time) {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.prune(now)
+	i := slices.IndexFunc(n.notifies, func(an AdminNotify) bool { return an.Message == message })
+	if i >= 0 {
+		n.notifies[i].Count++
+		n.notifies[i].LastRecorded = now
+		return
+	}
+	n.notifies = append(n.notifies, AdminNotify{Title: title, Message: message, Count: 1, LastRecorded: now})
+}
+
+// Recent returns the notifies recorded within AdminNotifyLifetime of now,
+// oldest first
+func (n *AdminNotifies) Recent(now time.Time) []AdminNotify {
+	if n == nil {
+		return []AdminNotify{}
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.prune(now)
+	return slices.Clone(n.notifies)
+}
+
+// Ack hides the notifies recorded so far from subject. Notifies recorded
+// later, including repeats of acknowledged ones, are shown again.
+func (n *AdminNotifies) Ack(subject string, now time.Time) {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.prune(now)
+	n.acked[subject] = now
+}
+
+// RecentFor is Recent without the notifies subject has acknowledged
+func (n *AdminNotifies) RecentFor(subject string, now time.Time) []AdminNotify {
+	recent := n.Recent(now)
+	if n == nil {
+		return recent
+	}
+	n.lock.Lock()
+	acked := n.acked[subject]
+	n.lock.Unlock()
+	return slices.DeleteFunc(recent, func(an AdminNotify) bool { return !an.LastRecorded.After(acked) })
+}
+
+// prune forgets notifies older than AdminNotifyLifetime. Callers must hold
+// lock.
+func (n *AdminNotifies) prune(now time.Time) {
+	n.notifies = slices.DeleteFunc(n.notifies, func(an AdminNotify) bool {
+		return now.Sub(an.LastRecorded) >= AdminNotifyLifetime
+	})
+	if n.notifies == nil {
+		n.notifies = []AdminNotify{}
+	}
+	// nothing from before an old ack is left to hide
+	maps.DeleteFunc(n.acked, func(subject string, acked time.Time) bool {
+		return now.Sub(acked) >= AdminNotifyLifetime
+	})
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminNotifies(t *testing.T) {
+	now := time.Date(2024, 12, 15, 12, 0, 0, 0, time.UTC)
+	n := NewAdminNotifies()
+	assert.Equal(t, []AdminNotify{}, n.Recent(now))
+
+	n.add("Upload failing", "cannot write ns-day/2024-12-15.json", now)
+	n.add("CGM login failed", "librelinkup cannot authenticate", now.Add(time.Minute))
+	n.add("Upload failing", "cannot write ns-day/2024-12-15.json", now.Add(time.Hour))
+	assert.Equal(t, []AdminNotify{
+		{Title: "Upload failing", Message: "cannot write ns-day/2024-12-15.json", Count: 2, LastRecorded: now.Add(time.Hour)},
+		{Title: "CGM login failed", Message: "librelinkup cannot authenticate", Count: 1, LastRecorded: now.Add(time.Minute)},
+	}, n.Recent(now.Add(time.Hour)))
+
+	assert.Equal(t, []AdminNotify{
+		{Title: "Upload failing", Message: "cannot write ns-day/2024-12-15.json", Count: 2, LastRecorded: now.Add(time.Hour)},
+	}, n.Recent(now.Add(AdminNotifyLifetime+time.Minute)), "old notifies are forgotten")
+
+	var disabled *AdminNotifies
+	disabled.Add("Upload failing", "dropped")
+	assert.Empty(t, disabled.Recent(now))
+}
+
+func TestAdminNotifies_Ack(t *testing.T) {
+	now := time.Date(2024, 12, 15, 12, 0, 0, 0, time.UTC)
+	n := NewAdminNotifies()
+	n.add("Upload failing", "cannot write ns-day/2024-12-15.json", now)
+	n.add("Import failed", "cannot fetch entries", now)
+
+	n.Ack("admin", now.Add(time.Minute))
+	assert.Empty(t, n.RecentFor("admin", now.Add(time.Minute)))
+	assert.Len(t, n.RecentFor("ops", now.Add(time.Minute)), 2, "acks are per subject")
+
+	n.add("Upload failing", "cannot write ns-day/2024-12-15.json", now.Add(time.Hour))
+	recent := n.RecentFor("admin", now.Add(time.Hour))
+	assert.Len(t, recent, 1, "repeats are shown again")
+	assert.Equal(t, 2, recent[0].Count)
+
+	n.Recent(now.Add(time.Minute + AdminNotifyLifetime))
+	assert.Empty(t, n.acked, "old acks are forgotten")
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// DeviceAgeRule is how nightscout's cage, sage and iage plugins judge the age
+// of a cannula, sensor or insulin: from the latest treatment of one of
+// Types, with the level rising as it passes each threshold.
+type DeviceAgeRule struct {
+	Types  []string
+	Info   time.Duration
+	Warn   time.Duration
+	Urgent time.Duration
+}
+
+// nightscout's default thresholds
+var (
+	CannulaAgeRule = DeviceAgeRule{Types: []string{"Site Change"}, Info: 44 * time.Hour, Warn: 48 * time.Hour, Urgent: 72 * time.Hour}
+	SensorAgeRule  = DeviceAgeRule{Types: []string{"Sensor Start", "Sensor Change"}, Info: 144 * time.Hour, Warn: 164 * time.Hour, Urgent: 166 * time.Hour}
+	InsulinAgeRule = DeviceAgeRule{Types: []string{"Insulin Change"}, Info: 44 * time.Hour, Warn: 48 * time.Hour, Urgent: 72 * time.Hour}
+)
+
+// DeviceAge is how long ago a cannula, sensor or insulin was changed
+type DeviceAge struct {
+	Treatment *Treatment // nil if there was no change
+	Age       time.Duration
+	Level     int
+}
+
+// Age returns the age at `at` from the latest matching treatment, from
+// treatments sorted oldest first
+func (r DeviceAgeRule) Age(treatments []Treatment, at time.Time) DeviceAge {
+	age := DeviceAge{Level: LevelNone}
+	for i := len(treatments) - 1; i >= 0; i-- {
+		t := treatments[i]
+		if t.Time.After(at) || !slices.Contains(r.Types, t.Type) {
+			continue
+		}
+		age.Treatment = &treatments[i]
+		age.Age = at.Sub(t.Time)
+		break
+	}
+	if age.Treatment == nil {
+		return age
+	}
+
+	switch {
+	case age.Age >= r.Urgent:
+		age.Level = LevelUrgent
+	case age.Age >= r.Warn:
+		age.Level = LevelWarn
+	case age.Age >= r.Info:
+		age.Level = LevelInfo
+	}
+	return age
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceAgeRule_Age(t *testing.T) {
+	now := time.Date(2024, 11, 28, 12, 0, 0, 0, time.UTC)
+	treatments := []Treatment{
+		{ID: "old", Type: "Sensor Start", Time: now.Add(-20 * 24 * time.Hour)},
+		{ID: "change", Type: "Sensor Change", Time: now.Add(-30 * time.Hour)},
+		{ID: "site", Type: "Site Change", Time: now.Add(-10 * time.Hour)},
+		{ID: "future", Type: "Sensor Start", Time: now.Add(time.Hour)},
+	}
+
+	age := SensorAgeRule.Age(treatments, now)
+	assert.Equal(t, "change", age.Treatment.ID)
+	assert.Equal(t, 30*time.Hour, age.Age)
+	assert.Equal(t, LevelNone, age.Level)
+
+	tests := []struct {
+		at     time.Duration
+		expect int
+	}{
+		{at: 43 * time.Hour, expect: LevelNone},
+		{at: 44 * time.Hour, expect: LevelInfo},
+		{at: 48 * time.Hour, expect: LevelWarn},
+		{at: 72 * time.Hour, expect: LevelUrgent},
+	}
+	for _, tt := range tests {
+		age := CannulaAgeRule.Age(treatments, now.Add(-10*time.Hour+tt.at))
+		assert.Equal(t, tt.at, age.Age)
+		assert.Equal(t, tt.expect, age.Level, tt.at)
+	}
+
+	age = InsulinAgeRule.Age(treatments, now)
+	assert.Nil(t, age.Treatment)
+	assert.Equal(t, LevelNone, age.Level)
+}
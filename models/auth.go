@@ -2,22 +2,36 @@ package models
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	slogctx "github.com/veqryn/slog-context"
 	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
+var ErrInvalidRole = errors.New("invalid role")
+
 type AuthService struct {
 	AuthRepository
+	rolesLock sync.Mutex
+	roles     map[string]*Role // nil until loaded, see RolesByName
 }
 
 type AuthSubject struct {
 	CreatedTime time.Time
 	UpdatedTime time.Time
+	ExpiryTime  time.Time // zero never expires
+	RevokedTime time.Time // zero if not revoked
 	Oid         string
 	Name        string
 	Notes       string
 	RoleNames   []string
+	ShareLink   bool // read-only, with a long token
 	ID          int
 }
 
@@ -32,15 +46,21 @@ type Role struct {
 
 type AuthRepository interface {
 	GetAPISecretHash(ctx context.Context) string
+	GetOldAPISecretHash(ctx context.Context) (hash string, until time.Time)
 	GetDefaultRole(ctx context.Context) string
-	//FetchAllRoles(ctx middleware.Context) []*Role
 	FetchAuthSubjectByAuthToken(ctx context.Context, authToken string) *AuthSubject
+	FetchAuthSubjectByOid(ctx context.Context, oid string) *AuthSubject
+	FetchRoles(ctx context.Context) ([]Role, error)
+	SaveRole(ctx context.Context, role Role) (*Role, error)
+	DeleteRole(ctx context.Context, name string) error
 }
 
 type Authn struct {
 	AuthSubject   *AuthSubject
 	ApiSecretHash string
 	AuthToken     string
+	APISecret     bool // authenticated with the api secret rather than a token
+	OldAPISecret  bool // authenticated with the secret being rotated out
 }
 
 func (a Authn) LogValue() slog.Value {
@@ -56,14 +76,28 @@ func (a Authn) LogValue() slog.Value {
 func (service *AuthService) AuthFromHTTP(ctx context.Context, apiSecretHash string, authToken string) *Authn {
 	authSubject := service.FetchAuthSubject(ctx, apiSecretHash, authToken)
 
-	return &Authn{
+	authn := &Authn{
 		ApiSecretHash: apiSecretHash,
 		AuthToken:     authToken,
 		AuthSubject:   authSubject,
+		APISecret:     authSubject == adminAuthSubject,
+		OldAPISecret:  authSubject == adminAuthSubject && service.isOldAPISecretHash(ctx, apiSecretHash, time.Now()),
+	}
+	if authSubject.IsAnonymous() {
+		authn.AuthSubject = &AuthSubject{Name: authSubject.Name, RoleNames: service.DefaultRoleNames(ctx)}
 	}
+	return authn
+}
+
+// DefaultRoleNames returns the roles unauthenticated requests get, eg
+// readable, or denied for a private site. As in nightscout several may be
+// given, separated by commas or spaces.
+func (service *AuthService) DefaultRoleNames(ctx context.Context) []string {
+	return strings.FieldsFunc(service.GetDefaultRole(ctx), func(r rune) bool { return r == ',' || r == ' ' })
 }
 
 var adminAuthSubject = &AuthSubject{Name: "admin", RoleNames: []string{"admin"}}
+var anonymousAuthSubject = &AuthSubject{Name: "anonymous", RoleNames: []string{}}
 
 func (service *AuthService) FetchAuthSubject(ctx context.Context, apiSecretHash string, authToken string) *AuthSubject {
 	log := slogctx.FromCtx(ctx)
@@ -72,6 +106,15 @@ func (service *AuthService) FetchAuthSubject(ctx context.Context, apiSecretHash
 		return adminAuthSubject
 	}
 
+	if IsJWT(authToken) {
+		as, err := service.FetchAuthSubjectByJWT(ctx, authToken, time.Now())
+		if err != nil {
+			log.Debug("jwt rejected", slog.Any("error", err))
+			return anonymousAuthSubject
+		}
+		return as
+	}
+
 	as := service.FetchAuthSubjectByAuthToken(ctx, authToken)
 	if as.IsAnonymous() {
 		// api-secret header can contain a token 🤪
@@ -95,22 +138,134 @@ var defaultRoles = map[string]*Role{
 
 var additionalRoles = map[string]*Role{
 	"cgm-uploader": {Name: "cgm-uploader", Permissions: []string{"api:entries:read", "api:entries:create"}},
+	ShareLinkRole:  {Name: ShareLinkRole, Permissions: []string{"*:*:read"}},
+}
+
+// ShareLinkRole is held by share links, so must stay read-only
+const ShareLinkRole = "share-link"
+
+// protectedRoles cannot be changed: the api secret relies on admin, and share
+// links on ShareLinkRole being read-only
+var protectedRoles = []string{"admin", ShareLinkRole}
+
+// RolesByName returns the built-in roles, overridden by any stored roles of
+// the same name. Roles are cached until changed through the service, so
+// changes made by another instance are only seen after a restart.
+func (service *AuthService) RolesByName(ctx context.Context) map[string]*Role {
+	log := slogctx.FromCtx(ctx)
+	service.rolesLock.Lock()
+	defer service.rolesLock.Unlock()
+	if service.roles != nil {
+		return service.roles
+	}
+
+	roles := make(map[string]*Role, len(defaultRoles)+len(additionalRoles))
+	maps.Copy(roles, defaultRoles)
+	maps.Copy(roles, additionalRoles)
+	stored, err := service.FetchRoles(ctx)
+	if err != nil {
+		// built-in roles still work, try again next time
+		log.Warn("cannot fetch roles", slog.Any("error", err))
+		return roles
+	}
+	for i := range stored {
+		roles[stored[i].Name] = &stored[i]
+	}
+	service.roles = roles
+	return roles
+}
+
+func (service *AuthService) roleByName(ctx context.Context, roleName string) (*Role, bool) {
+	role, ok := service.RolesByName(ctx)[roleName]
+	return role, ok
+}
+
+// ListRoles returns all roles, by name
+func (service *AuthService) ListRoles(ctx context.Context) []Role {
+	rolesByName := service.RolesByName(ctx)
+	roles := make([]Role, 0, len(rolesByName))
+	for _, name := range slices.Sorted(maps.Keys(rolesByName)) {
+		roles = append(roles, *rolesByName[name])
+	}
+	return roles
+}
+
+// IsBuiltInRole reports whether a role is provided by default. Built-in roles
+// can be overridden, and revert to the default when the override is deleted.
+func IsBuiltInRole(name string) bool {
+	_, isDefault := defaultRoles[name]
+	_, isAdditional := additionalRoles[name]
+	return isDefault || isAdditional
+}
+
+// SaveRole creates or replaces a role. Permissions are shiro-style, eg
+// api:entries:read or api:*:read. Protected roles cannot be changed.
+func (service *AuthService) SaveRole(ctx context.Context, role Role) (*Role, error) {
+	err := validateRole(role)
+	if err != nil {
+		return nil, err
+	}
+	defer service.InvalidateRoles()
+	return service.AuthRepository.SaveRole(ctx, role)
+}
+
+// DeleteRole deletes a stored role. Built-in roles revert to their default.
+func (service *AuthService) DeleteRole(ctx context.Context, name string) error {
+	if slices.Contains(protectedRoles, name) {
+		return fmt.Errorf("%w: the %s role cannot be changed", ErrInvalidRole, name)
+	}
+	defer service.InvalidateRoles()
+	return service.AuthRepository.DeleteRole(ctx, name)
+}
+
+// InvalidateRoles drops the cached roles, so they are fetched again, eg after
+// the repository has reloaded them
+func (service *AuthService) InvalidateRoles() {
+	service.rolesLock.Lock()
+	defer service.rolesLock.Unlock()
+	service.roles = nil
+}
+
+func validateRole(role Role) error {
+	if role.Name == "" || strings.ContainsFunc(role.Name, func(r rune) bool { return r == '/' || r == ' ' }) {
+		return fmt.Errorf("%w: name must be supplied, without spaces or slashes", ErrInvalidRole)
+	}
+	if slices.Contains(protectedRoles, role.Name) {
+		return fmt.Errorf("%w: the %s role cannot be changed", ErrInvalidRole, role.Name)
+	}
+	for _, permission := range role.Permissions {
+		if slices.Contains(strings.Split(permission, ":"), "") {
+			return fmt.Errorf("%w: permission %q is not of the form api:entries:read", ErrInvalidRole, permission)
+		}
+	}
+	return nil
+}
+
+// PermissionGroups returns the permissions of each of the subject's roles, as
+// used in the nightscout `authorized` status payload
+func (service *AuthService) PermissionGroups(ctx context.Context, as *AuthSubject) [][]string {
+	permissionGroups := make([][]string, 0, len(as.RoleNames))
+	for _, roleName := range as.RoleNames {
+		role, ok := service.roleByName(ctx, roleName)
+		if !ok {
+			continue
+		}
+		permissionGroups = append(permissionGroups, role.Permissions)
+	}
+	return permissionGroups
 }
 
 func (service *AuthService) IsPermitted(ctx context.Context, a *Authn, requiredPermission string) bool {
 	log := slogctx.FromCtx(ctx)
 	for _, roleName := range a.AuthSubject.RoleNames {
-		role, ok := defaultRoles[roleName]
+		role, ok := service.roleByName(ctx, roleName)
 		if !ok {
-			role, ok = additionalRoles[roleName]
-			if !ok {
-				log.Debug("role not found", "roleName", roleName)
-				continue
-			}
+			log.Debug("role not found", "roleName", roleName)
+			continue
 		}
 
 		for _, permission := range role.Permissions {
-			if permission == requiredPermission {
+			if shiroImplies(permission, requiredPermission) {
 				log.Debug("named role is allowed",
 					slog.String("roleName", roleName),
 					slog.String("perm", permission),
@@ -118,29 +273,65 @@ func (service *AuthService) IsPermitted(ctx context.Context, a *Authn, requiredP
 				)
 				return true
 			}
-
-			// nightscout uses shiro-style permissions https://shiro.apache.org/permissions.html
-			// eg api:entries:read, api:*:read, admin:api:subjects:read
-			// TODO: implement full shiro permission checks
-
-			if permission == "*" {
-				log.Debug("admin role is allowed",
-					slog.String("roleName", roleName),
-					slog.String("perm", permission),
-					slog.String("requiredPerm", requiredPermission),
-				)
-				return true
-			}
 		}
 	}
 
 	return false
 }
 
+// IsAPISecretHashValid compares in constant time, so response times do not
+// reveal how much of a guessed hash is correct. While the secret is being
+// rotated, the old secret is accepted until its grace period ends.
 func (service *AuthService) IsAPISecretHashValid(ctx context.Context, apiSecretHash string) (isValid bool) {
-	return apiSecretHash == service.AuthRepository.GetAPISecretHash(ctx)
+	return secretHashMatches(apiSecretHash, service.AuthRepository.GetAPISecretHash(ctx)) ||
+		service.isOldAPISecretHash(ctx, apiSecretHash, time.Now())
+}
+
+func (service *AuthService) isOldAPISecretHash(ctx context.Context, apiSecretHash string, now time.Time) bool {
+	oldHash, until := service.AuthRepository.GetOldAPISecretHash(ctx)
+	return now.Before(until) && secretHashMatches(apiSecretHash, oldHash)
+}
+
+// secretHashMatches compares in constant time. An unset secret never matches.
+func secretHashMatches(apiSecretHash string, expected string) bool {
+	if apiSecretHash == "" || expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(apiSecretHash), []byte(expected)) == 1
 }
 
 func (as *AuthSubject) IsAnonymous() bool {
 	return as.Name == "anonymous"
 }
+
+// IsActiveAt reports whether the subject's token can be used at now, ie it has
+// been neither revoked nor expired
+func (as *AuthSubject) IsActiveAt(now time.Time) bool {
+	if !as.RevokedTime.IsZero() {
+		return false
+	}
+	return as.ExpiryTime.IsZero() || now.Before(as.ExpiryTime)
+}
+
+// shiroImplies reports whether a shiro-style permission grants required, as
+// nightscout does https://shiro.apache.org/permissions.html
+// eg * and api:*:read both grant api:entries:read, api:entries,treatments:read
+// grants api:treatments:read, and api:entries grants api:entries:create
+func shiroImplies(permission string, required string) bool {
+	parts := strings.Split(permission, ":")
+	requiredParts := strings.Split(required, ":")
+	for i, requiredPart := range requiredParts {
+		if i >= len(parts) {
+			return true // missing trailing parts are wildcards
+		}
+		if parts[i] != "*" && !slices.Contains(strings.Split(parts[i], ","), requiredPart) {
+			return false
+		}
+	}
+	for _, part := range parts[len(requiredParts):] {
+		if part != "*" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"strings"
+	"time"
+)
+
+// Clients such as the reports page exchange an access token for a short-lived
+// JWT (GET /api/v2/authorization/request/{token}) and send that instead.
+// Unlike cgm-remote-monitor the JWT carries the subject's oid rather than the
+// access token, as a JWT is readable by anyone who sees it and the access
+// token does not expire. The subject is looked up on every request, so
+// deleting or revoking a subject also revokes its JWTs.
+//
+// JWTs are signed with a key derived from the api secret hash, so every
+// instance sharing a secret accepts them, and changing the secret revokes them.
+
+// JWTLifetime matches the lifetime of tokens issued by cgm-remote-monitor
+const JWTLifetime = 8 * time.Hour
+
+var ErrInvalidJWT = errors.New("invalid jwt")
+
+type JWT struct {
+	Token       string
+	AuthSubject *AuthSubject
+	IssuedAt    time.Time
+	ExpiresAt   time.Time
+}
+
+type jwtClaims struct {
+	AuthSubjectOid string `json:"oid"`
+	jwt.RegisteredClaims
+}
+
+// IsJWT reports whether a token looks like a JWT rather than a name-hash
+// access token
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (service *AuthService) jwtKey(ctx context.Context) []byte {
+	mac := hmac.New(sha256.New, []byte(service.AuthRepository.GetAPISecretHash(ctx)))
+	mac.Write([]byte("nightscout-go jwt"))
+	return mac.Sum(nil)
+}
+
+// IssueJWT exchanges an access token for a JWT, returning ErrNotFound if the
+// access token is not recognised
+func (service *AuthService) IssueJWT(ctx context.Context, accessToken string, now time.Time) (*JWT, error) {
+	as := service.FetchAuthSubjectByAuthToken(ctx, accessToken)
+	if as.IsAnonymous() {
+		return nil, ErrNotFound
+	}
+	issued := &JWT{
+		AuthSubject: as,
+		IssuedAt:    now.Truncate(time.Second),
+		ExpiresAt:   now.Add(JWTLifetime).Truncate(time.Second),
+	}
+	if !as.ExpiryTime.IsZero() && as.ExpiryTime.Before(issued.ExpiresAt) {
+		issued.ExpiresAt = as.ExpiryTime.Truncate(time.Second)
+	}
+	claims := jwtClaims{
+		AuthSubjectOid: as.Oid,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   as.Name,
+			IssuedAt:  jwt.NewNumericDate(issued.IssuedAt),
+			ExpiresAt: jwt.NewNumericDate(issued.ExpiresAt),
+		},
+	}
+	var err error
+	issued.Token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(service.jwtKey(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign jwt: %w", err)
+	}
+	return issued, nil
+}
+
+// FetchAuthSubjectByJWT verifies a JWT, returning the subject it was issued
+// for
+func (service *AuthService) FetchAuthSubjectByJWT(ctx context.Context, token string, now time.Time) (*AuthSubject, error) {
+	var claims jwtClaims
+	_, err := jwt.ParseWithClaims(token, &claims,
+		func(*jwt.Token) (interface{}, error) { return service.jwtKey(ctx), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(func() time.Time { return now }),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidJWT, err)
+	}
+	as := service.FetchAuthSubjectByOid(ctx, claims.AuthSubjectOid)
+	if as.IsAnonymous() {
+		return nil, fmt.Errorf("%w: access token has been revoked", ErrInvalidJWT)
+	}
+	return as, nil
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWT(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 11, 28, 10, 0, 0, 0, time.UTC)
+	repo := &mockAuthRepository{
+		apiSecretHash: "945a6dadff2d6cd1e8faf31b2da50ce467c440e1",
+		subjects:      []AuthSubject{{Oid: "674846dc2a9abd0d2c5a3e2b", Name: "reports", RoleNames: []string{"readable"}}},
+	}
+	service := &AuthService{AuthRepository: repo}
+
+	_, err := service.IssueJWT(ctx, "reports-0000000000000000", now)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	issued, err := service.IssueJWT(ctx, "reports-358de43470f328f3", now)
+	assert.NoError(t, err)
+	assert.True(t, IsJWT(issued.Token))
+	assert.False(t, IsJWT("reports-358de43470f328f3"))
+	assert.Equal(t, now.Add(8*time.Hour), issued.ExpiresAt)
+
+	// the claims identify the subject without giving away its access token
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(issued.Token, ".")[1])
+	assert.NoError(t, err)
+	assert.Contains(t, string(payload), `"oid":"674846dc2a9abd0d2c5a3e2b"`)
+	assert.NotContains(t, string(payload), "358de43470f328f3")
+
+	as, err := service.FetchAuthSubjectByJWT(ctx, issued.Token, now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, "reports", as.Name)
+
+	_, err = service.FetchAuthSubjectByJWT(ctx, issued.Token, now.Add(9*time.Hour))
+	assert.ErrorIs(t, err, ErrInvalidJWT, "expired")
+	_, err = service.FetchAuthSubjectByJWT(ctx, issued.Token[:len(issued.Token)-2], now)
+	assert.ErrorIs(t, err, ErrInvalidJWT, "bad signature")
+
+	other := &AuthService{AuthRepository: &mockAuthRepository{apiSecretHash: "other", subjects: repo.subjects}}
+	_, err = other.FetchAuthSubjectByJWT(ctx, issued.Token, now)
+	assert.ErrorIs(t, err, ErrInvalidJWT, "a new api secret revokes jwts")
+
+	repo.subjects[0].ExpiryTime = now.Add(time.Hour)
+	issued, err = service.IssueJWT(ctx, "reports-358de43470f328f3", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour), issued.ExpiresAt, "jwts do not outlive their subject")
+
+	repo.subjects = nil
+	_, err = service.FetchAuthSubjectByJWT(ctx, issued.Token, now)
+	assert.ErrorIs(t, err, ErrInvalidJWT, "deleting the subject revokes jwts")
+}
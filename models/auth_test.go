@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAuthRepository struct {
+	apiSecretHash     string
+	defaultRole       string
+	oldAPISecretHash  string
+	oldAPISecretUntil time.Time
+	subjects          []AuthSubject // token is name-358de43470f328f3
+	roles             []Role
+	numFetched        int
+}
+
+func (m *mockAuthRepository) GetAPISecretHash(ctx context.Context) string { return m.apiSecretHash }
+func (m *mockAuthRepository) GetOldAPISecretHash(ctx context.Context) (string, time.Time) {
+	return m.oldAPISecretHash, m.oldAPISecretUntil
+}
+func (m *mockAuthRepository) GetDefaultRole(ctx context.Context) string { return m.defaultRole }
+func (m *mockAuthRepository) FetchAuthSubjectByAuthToken(ctx context.Context, authToken string) *AuthSubject {
+	for _, as := range m.subjects {
+		if as.Name+"-358de43470f328f3" == authToken {
+			return &as
+		}
+	}
+	return anonymousAuthSubject
+}
+
+func (m *mockAuthRepository) FetchAuthSubjectByOid(ctx context.Context, oid string) *AuthSubject {
+	for _, as := range m.subjects {
+		if as.Oid == oid {
+			return &as
+		}
+	}
+	return anonymousAuthSubject
+}
+
+func (m *mockAuthRepository) FetchRoles(ctx context.Context) ([]Role, error) {
+	m.numFetched++
+	return m.roles, nil
+}
+
+func (m *mockAuthRepository) SaveRole(ctx context.Context, role Role) (*Role, error) {
+	m.roles = append(m.roles, role)
+	return &role, nil
+}
+
+func (m *mockAuthRepository) DeleteRole(ctx context.Context, name string) error {
+	for i, r := range m.roles {
+		if r.Name == name {
+			m.roles = append(m.roles[:i], m.roles[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func TestAuthServiceRoles(t *testing.T) {
+	ctx := context.Background()
+	repo := &mockAuthRepository{}
+	service := &AuthService{AuthRepository: repo}
+	reporter := &AuthSubject{RoleNames: []string{"reporter", "readable"}}
+
+	assert.Equal(t, [][]string{{"*:*:read"}}, service.PermissionGroups(ctx, reporter))
+	service.PermissionGroups(ctx, reporter)
+	assert.Equal(t, 1, repo.numFetched, "roles are cached")
+
+	_, err := service.SaveRole(ctx, Role{Name: "reporter", Permissions: []string{"api:entries:read"}})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"api:entries:read"}, {"*:*:read"}}, service.PermissionGroups(ctx, reporter))
+	assert.Equal(t, 2, repo.numFetched, "saving a role invalidates the cache")
+
+	// stored roles override built-in roles until deleted
+	_, err = service.SaveRole(ctx, Role{Name: "readable", Permissions: []string{"api:entries:read"}})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"api:entries:read"}, {"api:entries:read"}}, service.PermissionGroups(ctx, reporter))
+	assert.NoError(t, service.DeleteRole(ctx, "readable"))
+	assert.Equal(t, [][]string{{"api:entries:read"}, {"*:*:read"}}, service.PermissionGroups(ctx, reporter))
+
+	_, err = service.SaveRole(ctx, Role{Name: "admin", Permissions: []string{"api:entries:read"}})
+	assert.ErrorIs(t, err, ErrInvalidRole)
+	_, err = service.SaveRole(ctx, Role{Name: "broken", Permissions: []string{"api::read"}})
+	assert.ErrorIs(t, err, ErrInvalidRole)
+	assert.ErrorIs(t, service.DeleteRole(ctx, "admin"), ErrInvalidRole)
+	_, err = service.SaveRole(ctx, Role{Name: ShareLinkRole, Permissions: []string{"*"}})
+	assert.ErrorIs(t, err, ErrInvalidRole, "share links stay read-only")
+}
+
+func TestIsAPISecretHashValid(t *testing.T) {
+	ctx := context.Background()
+	service := &AuthService{AuthRepository: &mockAuthRepository{apiSecretHash: "945a6dadff2d6cd1e8faf31b2da50ce467c440e1"}}
+	assert.True(t, service.IsAPISecretHashValid(ctx, "945a6dadff2d6cd1e8faf31b2da50ce467c440e1"))
+	assert.False(t, service.IsAPISecretHashValid(ctx, "945a6dadff2d6cd1e8faf31b2da50ce467c440e"))
+	assert.False(t, service.IsAPISecretHashValid(ctx, ""))
+
+	service = &AuthService{AuthRepository: &mockAuthRepository{}}
+	assert.False(t, service.IsAPISecretHashValid(ctx, ""), "an unset secret never matches")
+
+	repo := &mockAuthRepository{
+		apiSecretHash:     "945a6dadff2d6cd1e8faf31b2da50ce467c440e1",
+		oldAPISecretHash:  "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c",
+		oldAPISecretUntil: time.Now().Add(time.Hour),
+	}
+	service = &AuthService{AuthRepository: repo}
+	assert.True(t, service.IsAPISecretHashValid(ctx, "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"))
+	authn := service.AuthFromHTTP(ctx, "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c", "")
+	assert.Equal(t, "admin", authn.AuthSubject.Name)
+	assert.True(t, authn.OldAPISecret)
+	assert.False(t, service.AuthFromHTTP(ctx, "945a6dadff2d6cd1e8faf31b2da50ce467c440e1", "").OldAPISecret)
+
+	repo.oldAPISecretUntil = time.Now().Add(-time.Hour)
+	assert.False(t, service.IsAPISecretHashValid(ctx, "b6589fc6ab0dc82cf12099d1c2d40ab994e8410c"), "grace period is over")
+	assert.True(t, service.IsAPISecretHashValid(ctx, "945a6dadff2d6cd1e8faf31b2da50ce467c440e1"))
+}
+
+func TestShiroImplies(t *testing.T) {
+	tests := []struct {
+		permission string
+		required   string
+		want       bool
+	}{
+		{"*", "api:entries:read", true},
+		{"api:entries:read", "api:entries:read", true},
+		{"api:entries:read", "api:entries:create", false},
+		{"*:*:read", "api:entries:read", true},
+		{"*:*:read", "admin:api:subjects:read", false},
+		{"api:*:read", "api:treatments:read", true},
+		{"api:entries,treatments:read", "api:treatments:read", true},
+		{"api:entries,treatments:read", "api:profile:read", false},
+		{"api:entries", "api:entries:create", true},
+		{"api:entries:read:*", "api:entries:read", true},
+		{"api:entries:read:mine", "api:entries:read", false},
+		{"", "api:entries:read", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, shiroImplies(tt.permission, tt.required), "%s implies %s", tt.permission, tt.required)
+	}
+}
+
+func TestAuthFromHTTP_DefaultRoles(t *testing.T) {
+	ctx := context.Background()
+	repo := &mockAuthRepository{defaultRole: "readable"}
+	service := &AuthService{AuthRepository: repo}
+
+	authn := service.AuthFromHTTP(ctx, "", "")
+	assert.True(t, authn.AuthSubject.IsAnonymous())
+	assert.True(t, service.IsPermitted(ctx, authn, "api:entries:read"))
+	assert.False(t, service.IsPermitted(ctx, authn, "api:entries:create"))
+	assert.Empty(t, anonymousAuthSubject.RoleNames, "the shared anonymous subject is not changed")
+
+	repo.defaultRole = "denied"
+	assert.False(t, service.IsPermitted(ctx, service.AuthFromHTTP(ctx, "", ""), "api:entries:read"))
+
+	repo.defaultRole = "status-only, careportal"
+	authn = service.AuthFromHTTP(ctx, "", "")
+	assert.Equal(t, []string{"status-only", "careportal"}, authn.AuthSubject.RoleNames)
+	assert.True(t, service.IsPermitted(ctx, authn, "api:treatments:create"))
+}
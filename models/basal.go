@@ -0,0 +1,129 @@
+package models
+
+import (
+	"slices"
+	"time"
+)
+
+// TempBasalType is the eventType of temporary basal rate treatments. They
+// set an absolute rate (U/hour) or a percent change to the scheduled rate,
+// for duration minutes. A later temp basal replaces an earlier one, and one
+// with no duration cancels it.
+const TempBasalType = "Temp Basal"
+
+// BasalRate is the basal rate in effect at a time
+type BasalRate struct {
+	Basal      float64    // U/hour, as scheduled by the profile
+	TempBasal  float64    // U/hour, the scheduled rate unless a temp basal is running
+	TotalBasal float64    // U/hour
+	Treatment  *Treatment // the running temp basal, if any
+}
+
+// BasalSegment is a period at a constant basal rate
+type BasalSegment struct {
+	Start time.Time
+	End   time.Time
+	BasalRate
+}
+
+// BasalAt returns the rate the profile schedules at t, adjusted by any temp
+// basal running then. treatments must be oldest first.
+func (p Profile) BasalAt(treatments []Treatment, t time.Time) BasalRate {
+	basal, _ := p.ScheduleValue("basal", t)
+	rate := BasalRate{Basal: basal, TempBasal: basal}
+	if temp := activeTempBasal(treatments, t); temp != nil {
+		rate.Treatment = temp
+		if absolute, ok := temp.Float("absolute"); ok {
+			rate.TempBasal = absolute
+		} else if percent, ok := temp.Float("percent"); ok {
+			rate.TempBasal = basal * (100 + percent) / 100
+		}
+	}
+	rate.TotalBasal = rate.TempBasal
+	return rate
+}
+
+// BasalTimeline returns the basal rates from `from` to `to`, oldest first, as
+// the web ui's basal plugin draws them. Neighbouring periods at the same rate
+// are merged. treatments must be oldest first.
+func (p Profile) BasalTimeline(treatments []Treatment, from, to time.Time) []BasalSegment {
+	if !from.Before(to) {
+		return nil
+	}
+	changes := []time.Time{from, to}
+	changes = append(changes, p.scheduleChanges("basal", from, to)...)
+	for _, t := range treatments {
+		if t.Type != TempBasalType {
+			continue
+		}
+		minutes, _ := t.Float("duration")
+		for _, change := range []time.Time{t.Time, t.Time.Add(time.Duration(minutes * float64(time.Minute)))} {
+			if change.After(from) && change.Before(to) {
+				changes = append(changes, change)
+			}
+		}
+	}
+	slices.SortFunc(changes, func(a, b time.Time) int { return a.Compare(b) })
+	changes = slices.CompactFunc(changes, func(a, b time.Time) bool { return a.Equal(b) })
+
+	var timeline []BasalSegment
+	for i := 0; i < len(changes)-1; i++ {
+		rate := p.BasalAt(treatments, changes[i])
+		if n := len(timeline); n > 0 && sameBasalRate(timeline[n-1].BasalRate, rate) {
+			timeline[n-1].End = changes[i+1]
+			continue
+		}
+		timeline = append(timeline, BasalSegment{Start: changes[i], End: changes[i+1], BasalRate: rate})
+	}
+	return timeline
+}
+
+func sameBasalRate(a, b BasalRate) bool {
+	return a.Basal == b.Basal && a.TotalBasal == b.TotalBasal && (a.Treatment == nil) == (b.Treatment == nil)
+}
+
+// activeTempBasal returns the temp basal running at t, if any
+func activeTempBasal(treatments []Treatment, t time.Time) *Treatment {
+	var active *Treatment
+	for i, treatment := range treatments {
+		if treatment.Type != TempBasalType || treatment.Time.After(t) {
+			continue
+		}
+		minutes, _ := treatment.Float("duration")
+		active = nil
+		if t.Before(treatment.Time.Add(time.Duration(minutes * float64(time.Minute)))) {
+			active = &treatments[i]
+		}
+	}
+	return active
+}
+
+// scheduleChanges returns the times between from and to that a time-of-day
+// schedule moves to its next slot, in the profile's timezone
+func (p Profile) scheduleChanges(name string, from, to time.Time) []time.Time {
+	settings := p.settings()
+	loc := time.UTC
+	if tz, _ := settings["timezone"].(string); tz != "" {
+		if l, err := time.LoadLocation(tz); err == nil {
+			loc = l
+		}
+	}
+	schedule, _ := settings[name].([]interface{})
+
+	var changes []time.Time
+	start := from.In(loc)
+	for day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, s := range schedule {
+			slot, _ := s.(map[string]interface{})
+			seconds, ok := slotStart(slot)
+			if !ok {
+				continue
+			}
+			change := day.Add(time.Duration(seconds) * time.Second)
+			if change.After(from) && change.Before(to) {
+				changes = append(changes, change)
+			}
+		}
+	}
+	return changes
+}
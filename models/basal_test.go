@@ -0,0 +1,64 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfile_BasalTimeline(t *testing.T) {
+	profile := Profile{Fields: map[string]interface{}{
+		"defaultProfile": "Default",
+		"store": map[string]interface{}{"Default": map[string]interface{}{
+			"timezone": "Europe/London",
+			"basal": []interface{}{
+				map[string]interface{}{"time": "00:00", "value": 0.5},
+				map[string]interface{}{"time": "06:00", "value": 1.0},
+				map[string]interface{}{"time": "22:00", "value": 0.5},
+			},
+		}},
+	}}
+	day := time.Date(2024, 11, 28, 0, 0, 0, 0, time.UTC)
+	treatments := []Treatment{
+		{ID: "absolute", Type: TempBasalType, Time: day.Add(8 * time.Hour), Fields: map[string]interface{}{"absolute": 2.0, "duration": 60.0}},
+		// replaced after 30 minutes
+		{ID: "percent", Type: TempBasalType, Time: day.Add(12 * time.Hour), Fields: map[string]interface{}{"percent": 50.0, "duration": 120.0}},
+		{ID: "replacement", Type: TempBasalType, Time: day.Add(12*time.Hour + 30*time.Minute), Fields: map[string]interface{}{"absolute": 0.0, "duration": 30.0}},
+		// cancels itself straight away
+		{ID: "cancelled", Type: TempBasalType, Time: day.Add(14 * time.Hour), Fields: map[string]interface{}{"absolute": 3.0, "duration": 0.0}},
+		{ID: "bolus", Type: "Correction Bolus", Time: day.Add(15 * time.Hour), Fields: map[string]interface{}{"insulin": 1.0}},
+	}
+
+	timeline := profile.BasalTimeline(treatments, day, day.Add(24*time.Hour))
+	type segment struct {
+		start, end time.Duration
+		total      float64
+		temp       string
+	}
+	var got []segment
+	for _, s := range timeline {
+		temp := ""
+		if s.Treatment != nil {
+			temp = s.Treatment.ID
+		}
+		got = append(got, segment{s.Start.Sub(day), s.End.Sub(day), s.TotalBasal, temp})
+	}
+	assert.Equal(t, []segment{
+		{0, 6 * time.Hour, 0.5, ""},
+		{6 * time.Hour, 8 * time.Hour, 1, ""},
+		{8 * time.Hour, 9 * time.Hour, 2, "absolute"},
+		{9 * time.Hour, 12 * time.Hour, 1, ""},
+		{12 * time.Hour, 12*time.Hour + 30*time.Minute, 1.5, "percent"},
+		{12*time.Hour + 30*time.Minute, 13 * time.Hour, 0, "replacement"},
+		{13 * time.Hour, 22 * time.Hour, 1, ""},
+		{22 * time.Hour, 24 * time.Hour, 0.5, ""},
+	}, got)
+
+	rate := profile.BasalAt(treatments, day.Add(12*time.Hour+15*time.Minute))
+	assert.Equal(t, 1.0, rate.Basal)
+	assert.Equal(t, 1.5, rate.TempBasal)
+	assert.Equal(t, "percent", rate.Treatment.ID)
+
+	assert.Empty(t, profile.BasalTimeline(treatments, day, day))
+}
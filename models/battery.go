@@ -0,0 +1,77 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// BatteryThresholds are the uploader battery percentages at and below which
+// the upbat plugin warns, as UPBAT_WARN and UPBAT_URGENT
+type BatteryThresholds struct {
+	Warn   int
+	Urgent int
+}
+
+// DefaultBatteryThresholds are nightscout's defaults
+var DefaultBatteryThresholds = BatteryThresholds{Warn: 30, Urgent: 20}
+
+// UploaderBattery is the latest battery level a device reported
+type UploaderBattery struct {
+	Device  string
+	Battery int // percent
+	Time    time.Time
+	Level   int
+}
+
+// UploaderBatteries returns each device's latest battery level from
+// statuses, lowest battery first. Uploaders report it as uploader.battery, or
+// uploaderBattery in older clients; statuses without either are skipped.
+func (th BatteryThresholds) UploaderBatteries(statuses []DeviceStatus) []UploaderBattery {
+	latest := make(map[string]UploaderBattery)
+	for _, s := range statuses {
+		battery, ok := uploaderBattery(s)
+		if !ok {
+			continue
+		}
+		if b, seen := latest[s.Device]; seen && !s.Time.After(b.Time) {
+			continue
+		}
+		latest[s.Device] = UploaderBattery{Device: s.Device, Battery: battery, Time: s.Time, Level: th.level(battery)}
+	}
+
+	batteries := make([]UploaderBattery, 0, len(latest))
+	for _, b := range latest {
+		batteries = append(batteries, b)
+	}
+	slices.SortFunc(batteries, func(a, b UploaderBattery) int {
+		if a.Battery != b.Battery {
+			return a.Battery - b.Battery
+		}
+		return strings.Compare(a.Device, b.Device)
+	})
+	return batteries
+}
+
+func (th BatteryThresholds) level(battery int) int {
+	switch {
+	case battery <= th.Urgent:
+		return LevelUrgent
+	case battery <= th.Warn:
+		return LevelWarn
+	}
+	return LevelNone
+}
+
+func uploaderBattery(s DeviceStatus) (int, bool) {
+	battery, ok := floatField(s.Fields, "uploaderBattery")
+	if uploader, isMap := s.Fields["uploader"].(map[string]interface{}); isMap {
+		if b, found := floatField(uploader, "battery"); found {
+			battery, ok = b, true
+		}
+	}
+	if !ok || battery < 0 || battery > 100 {
+		return 0, false
+	}
+	return int(battery), true
+}
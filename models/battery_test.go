@@ -0,0 +1,29 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatteryThresholds_UploaderBatteries(t *testing.T) {
+	now := time.Date(2024, 11, 28, 12, 0, 0, 0, time.UTC)
+	statuses := []DeviceStatus{
+		{Device: "xdrip", Time: now, Fields: map[string]interface{}{"uploader": map[string]interface{}{"battery": 25.0}}},
+		{Device: "xdrip", Time: now.Add(-5 * time.Minute), Fields: map[string]interface{}{"uploader": map[string]interface{}{"battery": 80.0}}},
+		{Device: "loop", Time: now.Add(-time.Minute), Fields: map[string]interface{}{"uploaderBattery": "90"}},
+		{Device: "phone", Time: now, Fields: map[string]interface{}{"uploaderBattery": 15}},
+		{Device: "pump", Time: now, Fields: map[string]interface{}{"pump": map[string]interface{}{"battery": map[string]interface{}{"percent": 10.0}}}},
+		{Device: "broken", Time: now, Fields: map[string]interface{}{"uploaderBattery": -1.0}},
+	}
+
+	batteries := DefaultBatteryThresholds.UploaderBatteries(statuses)
+	assert.Equal(t, []UploaderBattery{
+		{Device: "phone", Battery: 15, Time: now, Level: LevelUrgent},
+		{Device: "xdrip", Battery: 25, Time: now, Level: LevelWarn},
+		{Device: "loop", Battery: 90, Time: now.Add(-time.Minute), Level: LevelNone},
+	}, batteries)
+
+	assert.Empty(t, DefaultBatteryThresholds.UploaderBatteries(nil))
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultCarbAbsorptionRate is used when neither config nor the profile give
+// carbs_hr, in g/hour
+const DefaultCarbAbsorptionRate = 30.0
+
+// carbDelay is how long after eating carbs start to be absorbed
+const carbDelay = 20 * time.Minute
+
+// liverSensRatio is how much more strongly insulin activity slows carb
+// absorption than it lowers glucose, as in nightscout's cob plugin
+const liverSensRatio = 8
+
+// CarbModel is how carbs are absorbed: linearly at AbsorptionRate after a
+// delay, slowed by insulin activity if the carb ratio is known.
+type CarbModel struct {
+	AbsorptionRate float64 // g/hour
+	CarbRatio      float64 // g/U, 0 if unknown
+	Insulin        InsulinModel
+}
+
+// CarbsOnBoard is the carbs still to be absorbed from recent treatments
+type CarbsOnBoard struct {
+	COB        float64 // g
+	DecayedBy  time.Time
+	IsDecaying bool
+	LastCarbs  *Treatment
+}
+
+// OnBoard returns the carbs on board at, from treatments (oldest first) with
+// a carbs field. Carbs eaten while earlier carbs are still being absorbed
+// start once those are done.
+func (m CarbModel) OnBoard(treatments []Treatment, at time.Time) CarbsOnBoard {
+	rate := m.AbsorptionRate
+	if rate <= 0 {
+		rate = DefaultCarbAbsorptionRate
+	}
+
+	var result CarbsOnBoard
+	var lastDecayedBy time.Time
+	for i, t := range treatments {
+		carbs, ok := t.Float("carbs")
+		if !ok || carbs <= 0 || !t.Time.Before(at) {
+			continue
+		}
+		result.LastCarbs = &treatments[i]
+
+		start := t.Time.Add(carbDelay)
+		if lastDecayedBy.After(start) {
+			start = lastDecayedBy
+		}
+		decayedBy := start.Add(time.Duration(carbs / rate * float64(time.Hour)))
+		isDecaying := at.Before(lastDecayedBy) || at.After(t.Time.Add(carbDelay))
+
+		if m.CarbRatio > 0 && decayedBy.Sub(at) > -10*time.Hour {
+			activity := (m.Insulin.OnBoard(treatments, lastDecayedBy).Activity + m.Insulin.OnBoard(treatments, decayedBy).Activity) / 2
+			delayedCarbs := activity * liverSensRatio * m.CarbRatio
+			if delayMinutes := math.Round(delayedCarbs / rate * 60); delayMinutes > 0 {
+				decayedBy = decayedBy.Add(time.Duration(delayMinutes) * time.Minute)
+			}
+		}
+		lastDecayedBy = decayedBy
+
+		if decaysIn := decayedBy.Sub(at); decaysIn > 0 {
+			result.COB += math.Min(carbs, decaysIn.Hours()*rate)
+			result.IsDecaying = isDecaying
+		} else {
+			result.COB = 0
+		}
+	}
+	result.DecayedBy = lastDecayedBy
+	return result
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCarbModel_OnBoard(t *testing.T) {
+	now := time.Date(2024, 11, 28, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		ago          time.Duration
+		expect       float64
+		expectDecays bool
+	}{
+		{name: "just eaten", ago: time.Minute, expect: 30},
+		{name: "still delayed", ago: 15 * time.Minute, expect: 30},
+		{name: "half absorbed", ago: 50 * time.Minute, expect: 15, expectDecays: true},
+		{name: "absorbed", ago: 80 * time.Minute, expect: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			treatments := []Treatment{{Type: "Carb Correction", Time: now.Add(-tt.ago), Fields: map[string]interface{}{"carbs": 30.0}}}
+			onBoard := CarbModel{}.OnBoard(treatments, now)
+			assert.InDelta(t, tt.expect, onBoard.COB, 0.01)
+			assert.Equal(t, tt.expectDecays, onBoard.IsDecaying)
+		})
+	}
+}
+
+func TestCarbModel_OnBoardTreatments(t *testing.T) {
+	now := time.Date(2024, 11, 28, 12, 0, 0, 0, time.UTC)
+	treatments := []Treatment{
+		{ID: "bolus", Type: "Correction Bolus", Time: now.Add(-time.Hour), Fields: map[string]interface{}{"insulin": 10.0}},
+		{ID: "first", Type: "Meal Bolus", Time: now.Add(-40 * time.Minute), Fields: map[string]interface{}{"carbs": "30"}},
+		{ID: "second", Type: "Carb Correction", Time: now.Add(-30 * time.Minute), Fields: map[string]interface{}{"carbs": 15.0}},
+		{ID: "future", Type: "Carb Correction", Time: now.Add(10 * time.Minute), Fields: map[string]interface{}{"carbs": 50.0}},
+	}
+
+	// the second meal starts once the first is absorbed, at 60g/hour
+	onBoard := CarbModel{AbsorptionRate: 60}.OnBoard(treatments, now)
+	assert.InDelta(t, 45-20, onBoard.COB, 0.01)
+	assert.True(t, onBoard.IsDecaying)
+	assert.Equal(t, "second", onBoard.LastCarbs.ID)
+	assert.Equal(t, now.Add(25*time.Minute), onBoard.DecayedBy)
+
+	// insulin activity slows absorption once the carb ratio is known
+	slowed := CarbModel{AbsorptionRate: 60, CarbRatio: 10}.OnBoard(treatments, now)
+	assert.True(t, slowed.DecayedBy.After(onBoard.DecayedBy))
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// CGMConnection is a patient whose readings a cgm account can follow
+type CGMConnection struct {
+	PatientID string
+	Name      string
+	Selected  bool
+}
+
+// Sensor is the cgm sensor currently in use
+type Sensor struct {
+	Serial    string
+	StartTime time.Time
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// DirectionForRate returns the nightscout direction (trend arrow) for a rate
+// of change in mg/dL per minute, using the same thresholds as xDrip and
+// the dexcom uploaders.
+func DirectionForRate(mgdlPerMinute float64) string {
+	switch {
+	case mgdlPerMinute <= -3.5:
+		return "DoubleDown"
+	case mgdlPerMinute <= -2:
+		return "SingleDown"
+	case mgdlPerMinute <= -1:
+		return "FortyFiveDown"
+	case mgdlPerMinute <= 1:
+		return "Flat"
+	case mgdlPerMinute <= 2:
+		return "FortyFiveUp"
+	case mgdlPerMinute <= 3.5:
+		return "SingleUp"
+	default:
+		return "DoubleUp"
+	}
+}
+
+// maxDirectionGap is the longest gap between readings we will derive a
+// direction from. Beyond this the slope says little about the current trend.
+const maxDirectionGap = 20 * time.Minute
+
+// DirectionBetween returns the direction implied by moving from prev to e, or
+// "" if the readings are too far apart (or out of order) to say.
+func DirectionBetween(prev, e Entry) string {
+	gap := e.Time.Sub(prev.Time)
+	if gap <= 0 || gap > maxDirectionGap {
+		return ""
+	}
+	rate := float64(e.SgvMgdl-prev.SgvMgdl) / gap.Minutes()
+	return DirectionForRate(rate)
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectionBetween(t *testing.T) {
+	t0 := time.Date(2024, 11, 28, 10, 0, 0, 0, time.UTC)
+	prev := Entry{SgvMgdl: 100, Time: t0}
+
+	tests := []struct {
+		sgv       int
+		after     time.Duration
+		direction string
+	}{
+		{100, 15 * time.Minute, "Flat"},
+		{115, 15 * time.Minute, "Flat"},
+		{116, 15 * time.Minute, "FortyFiveUp"},
+		{140, 15 * time.Minute, "SingleUp"},
+		{160, 15 * time.Minute, "DoubleUp"},
+		{80, 15 * time.Minute, "FortyFiveDown"},
+		{70, 15 * time.Minute, "SingleDown"},
+		{40, 15 * time.Minute, "DoubleDown"},
+		{140, 21 * time.Minute, ""},
+		{140, 0, ""},
+	}
+	for _, tt := range tests {
+		e := Entry{SgvMgdl: tt.sgv, Time: t0.Add(tt.after)}
+		assert.Equal(t, tt.direction, DirectionBetween(prev, e), "sgv %d after %s", tt.sgv, tt.after)
+	}
+}
@@ -8,6 +8,20 @@ import (
 
 var ErrNotFound = errors.New("models: no resource could be found")
 
+// IsOid reports whether s is a mongo-style oid, 24 lowercase hexits, as the
+// api's {oid} routes expect
+func IsOid(s string) bool {
+	if len(s) != 24 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 type EntryRepository interface {
 	FetchEntry(ctx context.Context, id int) (*Entry, error)
 }
@@ -21,6 +35,7 @@ type Entry struct {
 	Device      string
 	Time        time.Time
 	CreatedTime time.Time
+	UtcOffset   int // minutes east of UTC where the reading was taken, as given by the uploader
 }
 
 type EntryService struct {
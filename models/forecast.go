@@ -0,0 +1,100 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+// AR2 is nightscout's default forecast: a second order autoregressive model
+// of log(mg/dL / 140), run forward from the latest two sgvs in 5-minute steps.
+const (
+	ar2BGRef      = 140
+	ar2BGMin      = 36
+	ar2BGMax      = 400
+	ar2Step       = 5 * time.Minute
+	ar2MaxGap     = 10 * time.Minute // readings further apart are too stale to forecast from
+	ar2LossWindow = 30 * time.Minute // how far ahead avgLoss looks
+	ar2ConeFactor = 2                // nightscout's default AR2_CONE_FACTOR
+)
+
+var ar2Coefficients = [2]float64{-0.723, 1.716}
+
+// ar2Cone widens the forecast at each step, in log space
+var ar2Cone = []float64{0.020, 0.041, 0.061, 0.081, 0.099, 0.116, 0.132, 0.146, 0.159, 0.171, 0.182, 0.192, 0.201}
+
+// avgLoss above these means glucose is heading out of range
+const (
+	ar2WarnLoss   = 0.05
+	ar2UrgentLoss = 0.10
+)
+
+// ForecastPoint is a predicted glucose value, with the cone around it
+type ForecastPoint struct {
+	Time  time.Time
+	Mgdl  int
+	Upper int
+	Lower int
+}
+
+// Forecast is the predicted glucose for the next hour. AvgLoss measures how
+// far the first half hour strays from 120 mg/dL, and sets Level.
+type Forecast struct {
+	Predicted []ForecastPoint
+	AvgLoss   float64
+	Level     int
+}
+
+// In returns the predicted glucose d after the last reading, rounded down to
+// a whole step, or 0 if that is beyond the forecast
+func (f Forecast) In(d time.Duration) int {
+	i := int(d/ar2Step) - 1
+	if i < 0 || i >= len(f.Predicted) {
+		return 0
+	}
+	return f.Predicted[i].Mgdl
+}
+
+// AR2Forecast forecasts glucose from the latest two sgvs. It returns false if
+// they are too far apart, or too low to be trusted. Readings more than a step
+// apart are interpolated.
+func AR2Forecast(last, prev Entry) (Forecast, bool) {
+	elapsed := last.Time.Sub(prev.Time)
+	if elapsed <= 0 || elapsed > ar2MaxGap || last.SgvMgdl < ar2BGMin || prev.SgvMgdl < ar2BGMin {
+		return Forecast{}, false
+	}
+	prevMgdl := float64(prev.SgvMgdl)
+	if elapsed > ar2Step+6*time.Second {
+		prevMgdl = float64(last.SgvMgdl) - float64(last.SgvMgdl-prev.SgvMgdl)*ar2Step.Minutes()/elapsed.Minutes()
+	}
+	y := [2]float64{math.Log(prevMgdl / ar2BGRef), math.Log(float64(last.SgvMgdl) / ar2BGRef)}
+
+	f := Forecast{Level: LevelNone}
+	numLoss := int(ar2LossWindow / ar2Step)
+	for i, cone := range ar2Cone {
+		y = [2]float64{y[1], ar2Coefficients[0]*y[0] + ar2Coefficients[1]*y[1]}
+		p := ForecastPoint{
+			Time:  last.Time.Add(time.Duration(i+1) * ar2Step),
+			Mgdl:  ar2Mgdl(y[1]),
+			Upper: ar2Mgdl(y[1] + cone*ar2ConeFactor),
+			Lower: ar2Mgdl(y[1] - cone*ar2ConeFactor),
+		}
+		f.Predicted = append(f.Predicted, p)
+		if i < numLoss {
+			f.AvgLoss += math.Pow(math.Log10(float64(p.Mgdl)/120), 2) / float64(numLoss)
+		}
+	}
+
+	switch {
+	case f.AvgLoss > ar2UrgentLoss:
+		f.Level = LevelUrgent
+	case f.AvgLoss > ar2WarnLoss:
+		f.Level = LevelWarn
+	}
+	return f, true
+}
+
+// ar2Mgdl converts back from log space, clamped to what a cgm can report
+func ar2Mgdl(y float64) int {
+	mgdl := int(math.Round(ar2BGRef * math.Exp(y)))
+	return min(max(mgdl, ar2BGMin), ar2BGMax)
+}
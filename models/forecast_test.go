@@ -0,0 +1,60 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAR2Forecast(t *testing.T) {
+	last := time.Date(2024, 11, 28, 12, 0, 0, 0, time.UTC)
+	sgv := func(mgdl int, ago time.Duration) Entry {
+		return Entry{Type: "sgv", SgvMgdl: mgdl, Time: last.Add(-ago)}
+	}
+
+	// steady glucose at the model's reference stays put, with a cone either
+	// side
+	f, ok := AR2Forecast(sgv(140, 0), sgv(140, 5*time.Minute))
+	assert.True(t, ok)
+	assert.Len(t, f.Predicted, 13)
+	for _, p := range f.Predicted {
+		assert.Equal(t, 140, p.Mgdl)
+		assert.Greater(t, p.Upper, p.Mgdl)
+		assert.Less(t, p.Lower, p.Mgdl)
+	}
+	assert.Equal(t, last.Add(5*time.Minute), f.Predicted[0].Time)
+	assert.Equal(t, last.Add(time.Hour+5*time.Minute), f.Predicted[12].Time)
+	assert.Less(t, f.AvgLoss, 0.01)
+	assert.Equal(t, LevelNone, f.Level)
+	// the cone widens
+	assert.Greater(t, f.Predicted[12].Upper, f.Predicted[0].Upper)
+
+	// rising is heading out of range, the further the more urgent
+	f, ok = AR2Forecast(sgv(200, 0), sgv(180, 5*time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, 239, f.In(20*time.Minute))
+	assert.Equal(t, f.Predicted[3].Mgdl, f.In(20*time.Minute))
+	assert.Equal(t, LevelWarn, f.Level)
+	assert.Zero(t, f.In(2*time.Hour))
+	f, _ = AR2Forecast(sgv(250, 0), sgv(230, 5*time.Minute))
+	assert.Equal(t, LevelUrgent, f.Level)
+
+	// as is dropping
+	f, _ = AR2Forecast(sgv(70, 0), sgv(80, 5*time.Minute))
+	assert.Equal(t, 57, f.In(20*time.Minute))
+	assert.Equal(t, LevelWarn, f.Level)
+	f, _ = AR2Forecast(sgv(60, 0), sgv(70, 5*time.Minute))
+	assert.Equal(t, LevelUrgent, f.Level)
+
+	// readings 10 minutes apart are interpolated to 5
+	interpolated, _ := AR2Forecast(sgv(130, 0), sgv(110, 10*time.Minute))
+	expected, _ := AR2Forecast(sgv(130, 0), sgv(120, 5*time.Minute))
+	assert.Equal(t, expected, interpolated)
+
+	// no forecast from stale or implausible readings
+	_, ok = AR2Forecast(sgv(130, 0), sgv(110, 15*time.Minute))
+	assert.False(t, ok)
+	_, ok = AR2Forecast(sgv(30, 0), sgv(40, 5*time.Minute))
+	assert.False(t, ok)
+}
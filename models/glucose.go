@@ -0,0 +1,33 @@
+package models
+
+import "math"
+
+// MgdlPerMmol converts between mmol/L and mg/dL
+const MgdlPerMmol = 18.0182
+
+// MmolToMgdl converts a glucose value in mmol/L to the nearest mg/dL
+func MmolToMgdl(mmol float64) int {
+	return int(math.Round(mmol * MgdlPerMmol))
+}
+
+// Units glucose can be displayed in, as named in nightscout's UNITS setting
+const (
+	UnitsMgdl = "mg/dl"
+	UnitsMmol = "mmol"
+)
+
+// MgdlToMmol converts a glucose value in mg/dL to mmol/L, to one decimal place
+func MgdlToMmol(mgdl int) float64 {
+	return math.Round(float64(mgdl)/MgdlPerMmol*10) / 10
+}
+
+// Thresholds are the glucose levels, in mg/dL, readings are judged against
+type Thresholds struct {
+	High         int `json:"bgHigh"`
+	TargetTop    int `json:"bgTargetTop"`
+	TargetBottom int `json:"bgTargetBottom"`
+	Low          int `json:"bgLow"`
+}
+
+// DefaultThresholds are nightscout's defaults
+var DefaultThresholds = Thresholds{High: 260, TargetTop: 180, TargetBottom: 80, Low: 55}
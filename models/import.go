@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// ImportCursor records how far back an import from a remote source has got,
+// so an interrupted import can resume rather than start again.
+type ImportCursor struct {
+	Source         string    // remote host
+	Before         time.Time // earliest entry fetched so far
+	EntriesFetched int
+	Complete       bool
+}
+
+// FollowCursor records the newest entry and treatment fetched from a followed
+// nightscout, so the follower picks up where it left off even when other
+// sources have newer data.
+type FollowCursor struct {
+	Source     string    // remote host
+	Entries    time.Time // newest entry fetched
+	Treatments time.Time // newest treatment fetched
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+// Insulin action curves, as the insulin plugins name them
+const (
+	InsulinCurveBilinear    = "bilinear"
+	InsulinCurveExponential = "exponential"
+)
+
+// InsulinModel is how a bolus is absorbed: over the duration of insulin
+// action (DIA), along nightscout's bilinear curve or oref0's exponential one.
+type InsulinModel struct {
+	DIA   time.Duration
+	Curve string
+	Peak  time.Duration // time to peak activity, exponential curve only
+}
+
+// DefaultInsulinModel is nightscout's default, used when neither config nor
+// the profile give a DIA
+var DefaultInsulinModel = InsulinModel{DIA: 3 * time.Hour, Curve: InsulinCurveBilinear, Peak: 75 * time.Minute}
+
+// minExponentialDIA is the shortest DIA oref0 allows for exponential curves;
+// shorter is treated as this
+const minExponentialDIA = 5 * time.Hour
+
+// InsulinOnBoard is the insulin still to act from recent boluses
+type InsulinOnBoard struct {
+	IOB       float64 // U
+	Activity  float64 // U/min being used now
+	LastBolus *Treatment
+}
+
+func (m InsulinModel) withDefaults() InsulinModel {
+	if m.DIA <= 0 {
+		m.DIA = DefaultInsulinModel.DIA
+	}
+	if m.Curve == "" {
+		m.Curve = DefaultInsulinModel.Curve
+	}
+	if m.Peak <= 0 {
+		m.Peak = DefaultInsulinModel.Peak
+	}
+	if m.Curve == InsulinCurveExponential && m.DIA < minExponentialDIA {
+		m.DIA = minExponentialDIA
+	}
+	return m
+}
+
+// Duration is how long a bolus stays on board
+func (m InsulinModel) Duration() time.Duration {
+	return m.withDefaults().DIA
+}
+
+// OnBoard returns the insulin on board at, from treatments with an insulin
+// field. Treatments after at are ignored.
+func (m InsulinModel) OnBoard(treatments []Treatment, at time.Time) InsulinOnBoard {
+	m = m.withDefaults()
+	var result InsulinOnBoard
+	for i, t := range treatments {
+		insulin, ok := t.Float("insulin")
+		if !ok || insulin <= 0 || t.Time.After(at) {
+			continue
+		}
+		if result.LastBolus == nil || t.Time.After(result.LastBolus.Time) {
+			result.LastBolus = &treatments[i]
+		}
+		onBoard, activity := m.curve(at.Sub(t.Time))
+		result.IOB += insulin * onBoard
+		result.Activity += insulin * activity
+	}
+	result.IOB = math.Round(result.IOB*1000) / 1000
+	result.Activity = math.Round(result.Activity*10000) / 10000
+	return result
+}
+
+// curve returns the fraction of a bolus still on board elapsed after it was
+// given, and the fraction being used per minute
+func (m InsulinModel) curve(elapsed time.Duration) (onBoard, activity float64) {
+	if elapsed < 0 || elapsed >= m.DIA {
+		return 0, 0
+	}
+	if m.Curve == InsulinCurveExponential {
+		return exponentialCurve(elapsed.Minutes(), m.DIA.Minutes(), m.Peak.Minutes())
+	}
+	return bilinearCurve(elapsed.Minutes(), m.DIA.Hours())
+}
+
+// bilinearCurve is nightscout's iob plugin: a 3 hour curve peaking at 75
+// minutes, scaled to the DIA
+func bilinearCurve(minutes, diaHours float64) (onBoard, activity float64) {
+	const peak = 75
+	minAgo := minutes * 3 / diaHours
+	switch {
+	case minAgo < peak:
+		x := minAgo/5 + 1
+		return 1 - 0.001852*x*x + 0.001852*x, 2 / diaHours / 60 / peak * minAgo
+	case minAgo < 180:
+		x := (minAgo - peak) / 5
+		return 0.001323*x*x - 0.054233*x + 0.55556, 2/diaHours/60 - (minAgo-peak)*2/diaHours/60/(180-peak)
+	}
+	return 0, 0
+}
+
+// exponentialCurve is oref0's exponential curve, see
+// https://github.com/openaps/oref0/pull/1066
+func exponentialCurve(minutes, end, peak float64) (onBoard, activity float64) {
+	tau := peak * (1 - peak/end) / (1 - 2*peak/end)
+	a := 2 * tau / end
+	s := 1 / (1 - a + (1+a)*math.Exp(-end/tau))
+	decay := math.Exp(-minutes / tau)
+	activity = s / (tau * tau) * minutes * (1 - minutes/end) * decay
+	onBoard = 1 - s*(1-a)*((minutes*minutes/(tau*end*(1-a))-minutes/tau-1)*decay+1)
+	return onBoard, activity
+}
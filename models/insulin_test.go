@@ -0,0 +1,48 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsulinModel_OnBoard(t *testing.T) {
+	now := time.Date(2024, 11, 28, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		model  InsulinModel
+		ago    time.Duration
+		expect float64
+	}{
+		{name: "bilinear just given", model: InsulinModel{}, ago: 0, expect: 1},
+		{name: "bilinear at peak", model: InsulinModel{}, ago: 75 * time.Minute, expect: 0.556},
+		{name: "bilinear scaled to dia", model: InsulinModel{DIA: 4 * time.Hour}, ago: 100 * time.Minute, expect: 0.556},
+		{name: "bilinear after dia", model: InsulinModel{}, ago: 3 * time.Hour, expect: 0},
+		{name: "exponential just given", model: InsulinModel{Curve: InsulinCurveExponential}, ago: 0, expect: 1},
+		{name: "exponential at 2h", model: InsulinModel{Curve: InsulinCurveExponential}, ago: 2 * time.Hour, expect: 0.411},
+		{name: "exponential dia is at least 5h", model: InsulinModel{DIA: 3 * time.Hour, Curve: InsulinCurveExponential}, ago: 4 * time.Hour, expect: 0.033},
+		{name: "exponential after dia", model: InsulinModel{DIA: 6 * time.Hour, Curve: InsulinCurveExponential}, ago: 6 * time.Hour, expect: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			treatments := []Treatment{{Type: "Correction Bolus", Time: now.Add(-tt.ago), Fields: map[string]interface{}{"insulin": 2.0}}}
+			assert.InDelta(t, 2*tt.expect, tt.model.OnBoard(treatments, now).IOB, 0.002)
+		})
+	}
+}
+
+func TestInsulinModel_OnBoardTreatments(t *testing.T) {
+	now := time.Date(2024, 11, 28, 12, 0, 0, 0, time.UTC)
+	treatments := []Treatment{
+		{ID: "old", Type: "Meal Bolus", Time: now.Add(-time.Hour), Fields: map[string]interface{}{"insulin": "1.5", "carbs": 30.0}},
+		{ID: "carbs", Type: "Carbs", Time: now.Add(-30 * time.Minute), Fields: map[string]interface{}{"carbs": 10.0}},
+		{ID: "last", Type: "Correction Bolus", Time: now.Add(-10 * time.Minute), Fields: map[string]interface{}{"insulin": 1.0}},
+		{ID: "future", Type: "Correction Bolus", Time: now.Add(10 * time.Minute), Fields: map[string]interface{}{"insulin": 5.0}},
+	}
+	// the string insulin is parsed, carbs-only and future treatments ignored
+	onBoard := InsulinModel{}.OnBoard(treatments, now)
+	assert.InDelta(t, 1.5*0.711+0.989, onBoard.IOB, 0.002)
+	assert.Equal(t, "last", onBoard.LastBolus.ID)
+	assert.Greater(t, onBoard.Activity, 0.0)
+}
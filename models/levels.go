@@ -0,0 +1,11 @@
+package models
+
+// Levels are how serious a plugin thinks things are, with nightscout's
+// values: the web ui colours pills by them, and alarms sound for warn and
+// urgent.
+const (
+	LevelUrgent = 2
+	LevelWarn   = 1
+	LevelInfo   = 0
+	LevelNone   = -3
+)
@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// Notification is something to tell users about, eg an announcement, at one
+// of the alarm levels. Notifications in the same Group replace each other.
+type Notification struct {
+	Level          int
+	Title          string
+	Message        string
+	Group          string
+	Time           time.Time
+	IsAnnouncement bool
+}
+
+// AnnouncementGroup is the group of announcement notifications, as
+// nightscout names it
+const AnnouncementGroup = "Announcement"
+
+// Announcement returns the notification an announcement treatment (one with
+// isAnnouncement set, eg from xDrip or the careportal) asks for. It is urgent
+// if the treatment says so, and info otherwise. It returns false if the
+// treatment is not an announcement.
+func (t Treatment) Announcement() (Notification, bool) {
+	if !boolField(t.Fields, "isAnnouncement") {
+		return Notification{}, false
+	}
+	n := Notification{
+		Level:          LevelInfo,
+		Title:          "Announcement",
+		Group:          AnnouncementGroup,
+		Time:           t.Time,
+		IsAnnouncement: true,
+	}
+	n.Message, _ = t.Fields["notes"].(string)
+	if boolField(t.Fields, "urgent") {
+		n.Level = LevelUrgent
+	}
+	return n, true
+}
+
+// boolField reports whether a field is true, as json or as a form value
+func boolField(fields map[string]interface{}, name string) bool {
+	switch v := fields[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true" || v == "on"
+	}
+	return false
+}
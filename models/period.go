@@ -0,0 +1,54 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrInvalidPeriod = errors.New("period must be yyyy, yyyy-mm or yyyy-mm-dd")
+
+// Period is a day, month or year, as stored in the bucket's day, month and
+// year files
+type Period struct {
+	Name  string    // eg 2024, 2024-11 or 2024-11-28
+	Unit  string    // day, month or year
+	Start time.Time // inclusive
+	End   time.Time // exclusive
+}
+
+// ParsePeriod parses a period named as in bucket file names, eg 2024-11
+func ParsePeriod(s string) (Period, error) {
+	units := []struct {
+		unit   string
+		layout string
+		years  int
+		months int
+		days   int
+	}{
+		{"day", time.DateOnly, 0, 0, 1},
+		{"month", "2006-01", 0, 1, 0},
+		{"year", "2006", 1, 0, 0},
+	}
+	for _, u := range units {
+		if len(s) != len(u.layout) {
+			continue
+		}
+		start, err := time.Parse(u.layout, s)
+		if err != nil {
+			return Period{}, ErrInvalidPeriod
+		}
+		return Period{
+			Name:  s,
+			Unit:  u.unit,
+			Start: start,
+			End:   start.AddDate(u.years, u.months, u.days),
+		}, nil
+	}
+	return Period{}, ErrInvalidPeriod
+}
+
+// ReloadResult counts what was read back from the bucket by a reload
+type ReloadResult struct {
+	Entries    int
+	Treatments int
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePeriod(t *testing.T) {
+	p, err := ParsePeriod("2024-11-28")
+	assert.NoError(t, err)
+	assert.Equal(t, Period{
+		Name:  "2024-11-28",
+		Unit:  "day",
+		Start: time.Date(2024, 11, 28, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2024, 11, 29, 0, 0, 0, 0, time.UTC),
+	}, p)
+
+	p, err = ParsePeriod("2024-12")
+	assert.NoError(t, err)
+	assert.Equal(t, "month", p.Unit)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), p.End)
+
+	p, err = ParsePeriod("2023")
+	assert.NoError(t, err)
+	assert.Equal(t, "year", p.Unit)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), p.End)
+
+	for _, s := range []string{"", "24", "2024-1", "2024-13", "2024-11-31", "latest"} {
+		_, err := ParsePeriod(s)
+		assert.ErrorIs(t, err, ErrInvalidPeriod, s)
+	}
+}
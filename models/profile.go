@@ -0,0 +1,102 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Profile is a nightscout profile document: basal rates, carb ratios,
+// sensitivities and targets, keyed by profile name in its "store" field.
+// Like treatments, profiles are free-form so all fields are kept.
+type Profile struct {
+	ID     string
+	Time   time.Time // startDate, when the profile takes effect
+	Fields map[string]interface{}
+}
+
+// ActiveProfile returns the profile in effect at t, from profiles sorted
+// oldest first, or nil if none had started
+func ActiveProfile(profiles []Profile, t time.Time) *Profile {
+	for i := len(profiles) - 1; i >= 0; i-- {
+		if !profiles[i].Time.After(t) {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+// Float returns a numeric setting, eg dia or carbs_hr, from the profile's
+// default store entry
+func (p Profile) Float(name string) (float64, bool) {
+	return floatField(p.settings(), name)
+}
+
+// ScheduleValue returns the value of a time-of-day schedule, eg basal or
+// carbratio, at t in the profile's timezone. Each slot applies from its
+// start time until the next slot starts.
+func (p Profile) ScheduleValue(name string, t time.Time) (float64, bool) {
+	settings := p.settings()
+	if v, ok := floatField(settings, name); ok {
+		return v, true
+	}
+	if tz, _ := settings["timezone"].(string); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			t = t.In(loc)
+		}
+	}
+	seconds := t.Hour()*3600 + t.Minute()*60 + t.Second()
+
+	schedule, _ := settings[name].([]interface{})
+	value, latestStart := 0.0, -1
+	for _, s := range schedule {
+		slot, _ := s.(map[string]interface{})
+		start, ok := slotStart(slot)
+		if !ok || start > seconds || start <= latestStart {
+			continue
+		}
+		if v, ok := floatField(slot, "value"); ok {
+			value, latestStart = v, start
+		}
+	}
+	return value, latestStart >= 0
+}
+
+// settings returns the profile's default store entry
+func (p Profile) settings() map[string]interface{} {
+	store, _ := p.Fields["store"].(map[string]interface{})
+	defaultName, _ := p.Fields["defaultProfile"].(string)
+	settings, _ := store[defaultName].(map[string]interface{})
+	return settings
+}
+
+// slotStart returns the seconds after midnight a schedule slot starts, from
+// timeAsSeconds or else its "HH:MM" time
+func slotStart(slot map[string]interface{}) (int, bool) {
+	if seconds, ok := floatField(slot, "timeAsSeconds"); ok {
+		return int(seconds), true
+	}
+	clock, _ := slot["time"].(string)
+	hh, mm, ok := strings.Cut(clock, ":")
+	if !ok {
+		return 0, false
+	}
+	hours, err := strconv.Atoi(hh)
+	if err != nil {
+		return 0, false
+	}
+	minutes, err := strconv.Atoi(mm)
+	if err != nil {
+		return 0, false
+	}
+	return hours*3600 + minutes*60, true
+}
+
+// DeviceStatus is a status report from an uploader, pump or closed-loop
+// system (battery, reservoir, loop predictions etc)
+type DeviceStatus struct {
+	ID     string
+	Device string
+	Time   time.Time
+	Fields map[string]interface{}
+}
@@ -0,0 +1,249 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"time"
+)
+
+// ProfileSwitchType is the eventType of treatments that switch to another
+// profile in the store, named by profile, for duration minutes or (with no
+// duration) until the next switch. AAPS also sends the switched-to profile
+// as profileJson, and may scale it by percentage or move it by timeshift
+// hours, eg when travelling.
+const ProfileSwitchType = "Profile Switch"
+
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// ValidProfileSwitch checks a profile switch names a profile and that its
+// duration, percentage and timeshift are sensible, storing them as numbers
+// if sent as strings. Whether the profile exists is for the caller to check
+// with HasProfile.
+func (t Treatment) ValidProfileSwitch(ctx context.Context) error {
+	name, _ := t.Fields["profile"].(string)
+	if name == "" {
+		return errors.New("profile switch must name a profile")
+	}
+	if raw, ok := t.Fields["profileJson"]; ok {
+		s, _ := raw.(string)
+		var settings map[string]interface{}
+		if err := json.Unmarshal([]byte(s), &settings); err != nil {
+			return errors.New("profileJson must be a json object")
+		}
+	}
+
+	for _, f := range []struct {
+		name     string
+		min, max float64
+	}{
+		{"duration", 0, math.MaxFloat64},
+		{"percentage", 1, 1000},
+		{"timeshift", -23, 23},
+	} {
+		raw, ok := t.Fields[f.name]
+		if !ok || raw == nil {
+			continue
+		}
+		v, ok := floatField(t.Fields, f.name)
+		if !ok {
+			return fmt.Errorf("%s field must be numeric", f.name)
+		}
+		if v < f.min || v > f.max {
+			return fmt.Errorf("%s field out of range", f.name)
+		}
+		t.Fields[f.name] = v
+	}
+	return nil
+}
+
+// HasProfile reports whether name is in the profile's store
+func (p Profile) HasProfile(name string) bool {
+	store, _ := p.Fields["store"].(map[string]interface{})
+	_, ok := store[name].(map[string]interface{})
+	return ok
+}
+
+// ProfileAt returns the profile in effect at t: the active one from profiles
+// (sorted oldest first), switched by any Profile Switch in treatments (also
+// oldest first) that is running at t. It returns nil if no profile had
+// started.
+func ProfileAt(profiles []Profile, treatments []Treatment, t time.Time) *Profile {
+	profile := ActiveProfile(profiles, t)
+	if profile == nil {
+		return nil
+	}
+	if sw := activeProfileSwitch(treatments, t); sw != nil {
+		switched := profile.Switch(*sw)
+		return &switched
+	}
+	return profile
+}
+
+// Switch returns the profile a Profile Switch treatment changes p to: the
+// profileJson it carries or else the named store entry, with basal rates
+// scaled by percentage, carb ratios and sensitivities scaled inversely, and
+// schedules moved later by timeshift hours. p is returned unchanged if the
+// switch names an unknown profile.
+func (p Profile) Switch(sw Treatment) Profile {
+	name, _ := sw.Fields["profile"].(string)
+	store, _ := p.Fields["store"].(map[string]interface{})
+	settings, _ := store[name].(map[string]interface{})
+	if s, ok := sw.Fields["profileJson"].(string); ok {
+		var fromJSON map[string]interface{}
+		if json.Unmarshal([]byte(s), &fromJSON) == nil {
+			settings = fromJSON
+		}
+	}
+	if settings == nil {
+		return p
+	}
+	settings = maps.Clone(settings)
+
+	if percentage, ok := sw.Float("percentage"); ok && percentage > 0 && percentage != 100 {
+		scaleSchedule(settings, "basal", percentage/100)
+		scaleSchedule(settings, "carbratio", 100/percentage)
+		scaleSchedule(settings, "sens", 100/percentage)
+	}
+	if hours, ok := sw.Float("timeshift"); ok && hours != 0 {
+		for _, name := range []string{"basal", "carbratio", "sens", "target_low", "target_high"} {
+			shiftSchedule(settings, name, time.Duration(hours*float64(time.Hour)))
+		}
+	}
+
+	fields := maps.Clone(p.Fields)
+	fields["defaultProfile"] = name
+	fields["store"] = map[string]interface{}{name: settings}
+	return Profile{ID: p.ID, Time: p.Time, Fields: fields}
+}
+
+// activeProfileSwitch returns the profile switch running at t, if any
+func activeProfileSwitch(treatments []Treatment, t time.Time) *Treatment {
+	var active *Treatment
+	for i, treatment := range treatments {
+		if treatment.Type != ProfileSwitchType || treatment.Time.After(t) {
+			continue
+		}
+		active = &treatments[i]
+		if minutes, _ := treatment.Float("duration"); minutes > 0 && !t.Before(treatment.Time.Add(time.Duration(minutes*float64(time.Minute)))) {
+			active = nil
+		}
+	}
+	return active
+}
+
+// profileSwitchChanges returns the times between from and to that a profile
+// switch starts or ends
+func profileSwitchChanges(treatments []Treatment, from, to time.Time) []time.Time {
+	var changes []time.Time
+	for _, t := range treatments {
+		if t.Type != ProfileSwitchType {
+			continue
+		}
+		changes = append(changes, t.Time)
+		if minutes, _ := t.Float("duration"); minutes > 0 {
+			changes = append(changes, t.Time.Add(time.Duration(minutes*float64(time.Minute))))
+		}
+	}
+	return slices.DeleteFunc(changes, func(c time.Time) bool { return !c.After(from) || !c.Before(to) })
+}
+
+// scaleSchedule multiplies a schedule's values, or a single value, by factor
+func scaleSchedule(settings map[string]interface{}, name string, factor float64) {
+	if v, ok := floatField(settings, name); ok {
+		settings[name] = v * factor
+		return
+	}
+	schedule, _ := settings[name].([]interface{})
+	scaled := make([]interface{}, 0, len(schedule))
+	for _, s := range schedule {
+		slot, _ := s.(map[string]interface{})
+		if v, ok := floatField(slot, "value"); ok {
+			slot = maps.Clone(slot)
+			slot["value"] = v * factor
+		}
+		scaled = append(scaled, slot)
+	}
+	if schedule != nil {
+		settings[name] = scaled
+	}
+}
+
+// shiftSchedule moves a time-of-day schedule later by shift, so the slot
+// that started at midnight starts at shift. The slot running over midnight
+// is repeated from midnight so the schedule still covers the whole day.
+func shiftSchedule(settings map[string]interface{}, name string, shift time.Duration) {
+	schedule, ok := settings[name].([]interface{})
+	if !ok {
+		return
+	}
+	const day = 24 * 60 * 60
+	offset := int(shift.Seconds())
+	var shifted []map[string]interface{}
+	for _, s := range schedule {
+		slot, _ := s.(map[string]interface{})
+		start, ok := slotStart(slot)
+		if !ok {
+			continue
+		}
+		start = ((start+offset)%day + day) % day
+		slot = maps.Clone(slot)
+		slot["timeAsSeconds"] = float64(start)
+		slot["time"] = fmt.Sprintf("%02d:%02d", start/3600, start%3600/60)
+		shifted = append(shifted, slot)
+	}
+	if len(shifted) == 0 {
+		return
+	}
+	slices.SortFunc(shifted, func(a, b map[string]interface{}) int {
+		sa, _ := slotStart(a)
+		sb, _ := slotStart(b)
+		return sa - sb
+	})
+	if first, _ := slotStart(shifted[0]); first != 0 {
+		midnight := maps.Clone(shifted[len(shifted)-1])
+		midnight["timeAsSeconds"] = 0.0
+		midnight["time"] = "00:00"
+		shifted = append([]map[string]interface{}{midnight}, shifted...)
+	}
+
+	result := make([]interface{}, len(shifted))
+	for i, slot := range shifted {
+		result[i] = slot
+	}
+	settings[name] = result
+}
+
+// SwitchedBasalTimeline is BasalTimeline across profile switches: the basal
+// rates from `from` to `to` under whichever profile ProfileAt gives. It
+// returns nil if no profile had started.
+func SwitchedBasalTimeline(profiles []Profile, treatments []Treatment, from, to time.Time) []BasalSegment {
+	bounds := append([]time.Time{from, to}, profileSwitchChanges(treatments, from, to)...)
+	for _, p := range profiles {
+		if p.Time.After(from) && p.Time.Before(to) {
+			bounds = append(bounds, p.Time)
+		}
+	}
+	slices.SortFunc(bounds, func(a, b time.Time) int { return a.Compare(b) })
+	bounds = slices.CompactFunc(bounds, func(a, b time.Time) bool { return a.Equal(b) })
+
+	var timeline []BasalSegment
+	for i := 0; i < len(bounds)-1; i++ {
+		profile := ProfileAt(profiles, treatments, bounds[i])
+		if profile == nil {
+			continue
+		}
+		for _, s := range profile.BasalTimeline(treatments, bounds[i], bounds[i+1]) {
+			if n := len(timeline); n > 0 && timeline[n-1].End.Equal(s.Start) && sameBasalRate(timeline[n-1].BasalRate, s.BasalRate) {
+				timeline[n-1].End = s.End
+				continue
+			}
+			timeline = append(timeline, s)
+		}
+	}
+	return timeline
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfileAt(t *testing.T) {
+	day := time.Date(2024, 11, 28, 0, 0, 0, 0, time.UTC)
+	profiles := []Profile{{Time: day.Add(-24 * time.Hour), Fields: map[string]interface{}{
+		"defaultProfile": "Default",
+		"store": map[string]interface{}{
+			"Default": map[string]interface{}{
+				"basal":     []interface{}{map[string]interface{}{"time": "00:00", "value": 1.0}},
+				"carbratio": 10.0,
+			},
+			"Night": map[string]interface{}{
+				"basal": []interface{}{
+					map[string]interface{}{"time": "00:00", "value": 0.4},
+					map[string]interface{}{"time": "06:00", "value": 0.8},
+				},
+				"carbratio": 12.0,
+			},
+		},
+	}}}
+	treatments := []Treatment{
+		{ID: "exercise", Type: ProfileSwitchType, Time: day.Add(2 * time.Hour), Fields: map[string]interface{}{"profile": "Default", "percentage": 50.0, "duration": 60.0}},
+		{ID: "travel", Type: ProfileSwitchType, Time: day.Add(4 * time.Hour), Fields: map[string]interface{}{"profile": "Night", "timeshift": 2.0, "percentage": 200.0}},
+		{ID: "unknown", Type: ProfileSwitchType, Time: day.Add(30 * time.Hour), Fields: map[string]interface{}{"profile": "Missing"}},
+	}
+
+	tests := []struct {
+		at        time.Duration
+		basal     float64
+		carbratio float64
+	}{
+		{at: time.Hour, basal: 1, carbratio: 10},
+		{at: 2*time.Hour + 30*time.Minute, basal: 0.5, carbratio: 20},
+		{at: 3 * time.Hour, basal: 1, carbratio: 10}, // expired
+		// Night, scaled by 200% and moved 2 hours later
+		{at: 4 * time.Hour, basal: 0.8, carbratio: 6},
+		{at: 7 * time.Hour, basal: 0.8, carbratio: 6},
+		{at: 8 * time.Hour, basal: 1.6, carbratio: 6},
+		{at: 25 * time.Hour, basal: 1.6, carbratio: 6}, // over midnight
+		{at: 26 * time.Hour, basal: 0.8, carbratio: 6}, // from the 00:00 slot, moved to 02:00
+		{at: 31 * time.Hour, basal: 1, carbratio: 10},  // switch to an unknown profile leaves the default
+	}
+	for _, tt := range tests {
+		profile := ProfileAt(profiles, treatments, day.Add(tt.at))
+		basal, _ := profile.ScheduleValue("basal", day.Add(tt.at))
+		carbratio, _ := profile.ScheduleValue("carbratio", day.Add(tt.at))
+		assert.Equal(t, tt.basal, basal, tt.at)
+		assert.Equal(t, tt.carbratio, carbratio, tt.at)
+	}
+	assert.Equal(t, 10.0, profiles[0].settings()["carbratio"], "stored profile unchanged")
+	assert.Nil(t, ProfileAt(profiles, treatments, day.Add(-48*time.Hour)))
+
+	timeline := SwitchedBasalTimeline(profiles, treatments, day, day.Add(4*time.Hour))
+	assert.Len(t, timeline, 3)
+	assert.Equal(t, day.Add(2*time.Hour), timeline[1].Start)
+	assert.Equal(t, day.Add(3*time.Hour), timeline[1].End)
+	assert.Equal(t, 0.5, timeline[1].TotalBasal)
+	assert.Equal(t, day.Add(4*time.Hour), timeline[2].End)
+}
@@ -0,0 +1,8 @@
+package models
+
+// PurgeResult counts what was removed by a purge
+type PurgeResult struct {
+	Entries    int
+	Treatments int
+	Files      int // device status and hires day files
+}
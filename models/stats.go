@@ -0,0 +1,97 @@
+package models
+
+import "math"
+
+// minStatsSgv is the lowest sgv counted in statistics. Lower values are
+// sensor error codes, as in nightscout.
+const minStatsSgv = 39
+
+// TimeInRange is the percentage of sgv readings in each band of the
+// thresholds: VeryLow below Low, Low up to TargetBottom, InRange up to and
+// including TargetTop, High up to and including High, and VeryHigh above.
+// Below is VeryLow plus Low, and Above is High plus VeryHigh.
+type TimeInRange struct {
+	Readings int
+	VeryLow  float64
+	Low      float64
+	Below    float64
+	InRange  float64
+	Above    float64
+	High     float64
+	VeryHigh float64
+}
+
+// TimeInRange judges sgvs against the thresholds. Each reading counts the
+// same, so the percentages are of time as long as readings are evenly spaced.
+func (th Thresholds) TimeInRange(sgvs []Entry) TimeInRange {
+	var veryLow, low, inRange, high, veryHigh int
+	for _, e := range sgvs {
+		switch {
+		case e.SgvMgdl < minStatsSgv:
+			continue
+		case e.SgvMgdl < th.Low:
+			veryLow++
+		case e.SgvMgdl < th.TargetBottom:
+			low++
+		case e.SgvMgdl <= th.TargetTop:
+			inRange++
+		case e.SgvMgdl <= th.High:
+			high++
+		default:
+			veryHigh++
+		}
+	}
+	readings := veryLow + low + inRange + high + veryHigh
+	return TimeInRange{
+		Readings: readings,
+		VeryLow:  percentage(veryLow, readings),
+		Low:      percentage(low, readings),
+		Below:    percentage(veryLow+low, readings),
+		InRange:  percentage(inRange, readings),
+		Above:    percentage(high+veryHigh, readings),
+		High:     percentage(high, readings),
+		VeryHigh: percentage(veryHigh, readings),
+	}
+}
+
+// percentage returns n as a percentage of total, to one decimal place
+func percentage(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(n)*1000/float64(total)) / 10
+}
+
+// GlucoseMean is the mean of some sgvs and the HbA1c it suggests, in %: the
+// Glucose Management Indicator (Bergenstal et al, 2018) and the older
+// estimated A1c (Nathan et al, 2008). GMI is meant for 14 or more days of
+// cgm data.
+type GlucoseMean struct {
+	Readings int
+	MeanMgdl int
+	GMI      float64
+	EA1c     float64
+}
+
+// MeanGlucose returns the mean of sgvs, and the GMI and eA1c from it. All
+// are zero without any readings.
+func MeanGlucose(sgvs []Entry) GlucoseMean {
+	var readings, total int
+	for _, e := range sgvs {
+		if e.SgvMgdl < minStatsSgv {
+			continue
+		}
+		readings++
+		total += e.SgvMgdl
+	}
+	if readings == 0 {
+		return GlucoseMean{}
+	}
+	mean := float64(total) / float64(readings)
+	return GlucoseMean{
+		Readings: readings,
+		MeanMgdl: int(math.Round(mean)),
+		GMI:      math.Round((3.31+0.02392*mean)*10) / 10,
+		EA1c:     math.Round((mean+46.7)/28.7*10) / 10,
+	}
+}
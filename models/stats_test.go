@@ -0,0 +1,38 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThresholds_TimeInRange(t *testing.T) {
+	var sgvs []Entry
+	for _, mgdl := range []int{
+		10,     // error code, ignored
+		50,     // very low
+		55, 79, // low
+		80, 120, 180, // in range
+		181, 260, // high
+		261, // very high
+	} {
+		sgvs = append(sgvs, Entry{Type: "sgv", SgvMgdl: mgdl})
+	}
+	assert.Equal(t, TimeInRange{Readings: 9, VeryLow: 11.1, Low: 22.2, Below: 33.3, InRange: 33.3, Above: 33.3, High: 22.2, VeryHigh: 11.1}, DefaultThresholds.TimeInRange(sgvs))
+
+	assert.Equal(t, TimeInRange{}, DefaultThresholds.TimeInRange(nil))
+}
+
+func TestMeanGlucose(t *testing.T) {
+	sgvs := []Entry{
+		{Type: "sgv", SgvMgdl: 10}, // error code, ignored
+		{Type: "sgv", SgvMgdl: 100},
+		{Type: "sgv", SgvMgdl: 154},
+		{Type: "sgv", SgvMgdl: 200},
+	}
+	// a mean of 154 mg/dL is a GMI of 7.0% and an eA1c of 7.0%
+	assert.Equal(t, GlucoseMean{Readings: 3, MeanMgdl: 151, GMI: 6.9, EA1c: 6.9}, MeanGlucose(sgvs))
+	assert.Equal(t, GlucoseMean{Readings: 1, MeanMgdl: 154, GMI: 7.0, EA1c: 7.0}, MeanGlucose(sgvs[2:3]))
+
+	assert.Equal(t, GlucoseMean{}, MeanGlucose(nil))
+}
@@ -5,8 +5,10 @@ import (
 	"errors"
 	slogctx "github.com/veqryn/slog-context"
 	"log/slog"
+	"math"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,13 +21,28 @@ type Treatment struct {
 	Fields map[string]interface{}
 }
 
+// Valid checks a treatment against DefaultTreatmentTypes
 func (t *Treatment) Valid(ctx context.Context) error {
-	if t.Type == "Carbs" {
-		return t.ValidCarbs(ctx)
-	}
+	return DefaultTreatmentTypes.Validate(ctx, t)
+}
 
-	// unknown/unvalidated types are all accepted. Anything goes, baby :)
-	return nil
+// Float returns a numeric field, eg insulin or carbs. Older uploaders send
+// numbers as strings, which are parsed.
+func (t Treatment) Float(name string) (float64, bool) {
+	return floatField(t.Fields, name)
+}
+
+func floatField(fields map[string]interface{}, name string) (float64, bool) {
+	switch v := fields[name].(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
 }
 
 var numRE = regexp.MustCompile(`^-?[0-9]*[.]?[0-9]*$`)
@@ -67,6 +84,59 @@ func (t Treatment) ValidCarbs(ctx context.Context) error {
 	return nil
 }
 
+// BGCheckType is the eventType of finger-stick (or sensor) glucose checks
+const BGCheckType = "BG Check"
+
+// GlucoseMgdl returns a treatment's glucose in mg/dL, converting from its
+// units ("mmol" or "mg/dl"), or defaultUnits if it has none. It returns false
+// if there is no glucose, or it is implausible.
+func (t Treatment) GlucoseMgdl(defaultUnits string) (int, bool) {
+	glucose, ok := t.Float("glucose")
+	if !ok {
+		return 0, false
+	}
+	units, _ := t.Fields["units"].(string)
+	if units == "" {
+		units = defaultUnits
+	}
+	mgdl := int(math.Round(glucose))
+	if strings.HasPrefix(strings.ToLower(units), UnitsMmol) {
+		mgdl = MmolToMgdl(glucose)
+	}
+	if mgdl < 20 || mgdl > 600 {
+		return 0, false
+	}
+	return mgdl, true
+}
+
+// SplitPreBolus moves the carbs of a treatment with a preBolus (minutes,
+// usually negative: the insulin is given before eating) to a new treatment
+// of the same type when the carbs are eaten, as cgm-remote-monitor does for
+// meal and combo boluses. The new treatment has only eventType, carbs and
+// any notes, and carbs is "" if the original had none. It returns nil when
+// there is no preBolus.
+func (t *Treatment) SplitPreBolus() *Treatment {
+	minutes, _ := floatField(t.Fields, "preBolus")
+	if minutes == 0 {
+		return nil
+	}
+	carbs, ok := t.Fields["carbs"]
+	if !ok || carbs == nil {
+		carbs = ""
+	}
+	delete(t.Fields, "carbs")
+
+	pb := &Treatment{
+		Type:   t.Type,
+		Time:   t.Time.Add(time.Duration(minutes * float64(time.Minute))),
+		Fields: map[string]interface{}{"carbs": carbs},
+	}
+	if notes, _ := t.Fields["notes"].(string); notes != "" {
+		pb.Fields["notes"] = notes
+	}
+	return pb
+}
+
 // type Treatment struct {
 // 	ID             string    `json:"_id"`
 // 	Time           time.Time `json:"created_at"`
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// TreatmentType is how treatments of one eventType are checked: fields they
+// must have, and any further validation
+type TreatmentType struct {
+	Required []string
+	validate func(Treatment, context.Context) error
+}
+
+// TreatmentTypes is a registry of eventTypes, keyed by name. Treatments of
+// types not in it are accepted as they are, so uploaders with their own
+// eventTypes keep working. A nil registry has DefaultTreatmentTypes.
+type TreatmentTypes map[string]TreatmentType
+
+// DefaultTreatmentTypes are the eventTypes validated without any config
+var DefaultTreatmentTypes = TreatmentTypes{
+	"Carbs":           {validate: Treatment.ValidCarbs},
+	ProfileSwitchType: {validate: Treatment.ValidProfileSwitch},
+}
+
+// Register returns a registry with name added, or with more required fields
+// if it is already known. The receiver is not changed.
+func (r TreatmentTypes) Register(name string, required ...string) TreatmentTypes {
+	if r == nil {
+		r = DefaultTreatmentTypes
+	}
+	registered := maps.Clone(r)
+	tt := registered[name]
+	tt.Required = slices.Concat(tt.Required, required)
+	registered[name] = tt
+	return registered
+}
+
+// Validate checks a treatment against its type, if registered. It may
+// tidy fields, eg parsing numbers sent as strings.
+func (r TreatmentTypes) Validate(ctx context.Context, t *Treatment) error {
+	if r == nil {
+		r = DefaultTreatmentTypes
+	}
+	tt, ok := r[t.Type]
+	if !ok {
+		return nil
+	}
+	for _, field := range tt.Required {
+		if v, ok := t.Fields[field]; !ok || v == nil || v == "" {
+			return fmt.Errorf("%s treatments must have a %s field", t.Type, field)
+		}
+	}
+	if tt.validate != nil {
+		return tt.validate(*t, ctx)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreatmentTypes_Validate(t *testing.T) {
+	ctx := context.Background()
+	types := DefaultTreatmentTypes.Register("Ketones", "ketones").Register("Carbs", "notes")
+	assert.NotContains(t, DefaultTreatmentTypes, "Ketones", "defaults unchanged")
+
+	tests := []struct {
+		name      string
+		types     TreatmentTypes
+		treatment Treatment
+		expectErr string
+	}{
+		{name: "unknown type", types: types, treatment: Treatment{Type: "Pump Battery Change", Fields: map[string]interface{}{}}},
+		{name: "custom type", types: types, treatment: Treatment{Type: "Ketones", Fields: map[string]interface{}{"ketones": 0.4}}},
+		{name: "custom type missing field", types: types, treatment: Treatment{Type: "Ketones", Fields: map[string]interface{}{"ketones": ""}}, expectErr: "Ketones treatments must have a ketones field"},
+		{name: "default type with extra field", types: types, treatment: Treatment{Type: "Carbs", Fields: map[string]interface{}{"carbs": 10.0}}, expectErr: "Carbs treatments must have a notes field"},
+		{name: "default validation kept", types: types, treatment: Treatment{Type: "Carbs", Fields: map[string]interface{}{"carbs": -1.0, "notes": "x"}}, expectErr: "carbs field must be positive"},
+		{name: "nil registry has the defaults", treatment: Treatment{Type: "Carbs", Fields: map[string]interface{}{}}, expectErr: "carbs type must have carbs field"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.treatment.Time = time.Now()
+			err := tt.types.Validate(ctx, &tt.treatment)
+			if tt.expectErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.expectErr)
+		})
+	}
+}
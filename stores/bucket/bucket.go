@@ -4,28 +4,34 @@ import (
 	"context"
 	"fmt"
 	kitlog "github.com/go-kit/log"
-	"github.com/thanos-io/objstore/providers/s3"
+	"github.com/thanos-io/objstore"
+	"github.com/thanos-io/objstore/client"
 	"io"
 	"net/http"
 	"os"
+	"slices"
+	"time"
 )
 
 type BucketStore struct {
-	Bucket *s3.Bucket
+	Bucket objstore.Bucket
 }
 
-func New(cfg s3.Config) (*BucketStore, error) {
+// New configures a bucket store from Thanos objstore client config, eg
+// `{"type":"GCS","config":{"bucket":"nightscout"}}`. Any provider supported by
+// the Thanos client factory may be used: S3, GCS, AZURE, SWIFT, FILESYSTEM etc.
+func New(conf []byte) (*BucketStore, error) {
 	wrt := func(rt http.RoundTripper) http.RoundTripper {
 		return rt
 	}
 
 	kitlogger := kitlog.NewJSONLogger(kitlog.NewSyncWriter(os.Stdout))
-	client, err := s3.NewBucketWithConfig(kitlogger, cfg, "component", wrt)
+	bucket, err := client.NewBucket(kitlogger, conf, "component", wrt)
 	if err != nil {
 		return nil, fmt.Errorf("cannot configure bucket store: %w", err)
 	}
 
-	return &BucketStore{Bucket: client}, nil
+	return &BucketStore{Bucket: bucket}, nil
 }
 
 func (b *BucketStore) Close() {
@@ -46,6 +52,56 @@ func (b *BucketStore) Upload(ctx context.Context, name string, r io.Reader) erro
 	return b.Bucket.Upload(ctx, name, r)
 }
 
+// Delete removes a named object from the store.
+func (b *BucketStore) Delete(ctx context.Context, name string) error {
+	return b.Bucket.Delete(ctx, name)
+}
+
+// List returns the names of objects in dir, in lexical order.
+func (b *BucketStore) List(ctx context.Context, dir string) ([]string, error) {
+	var names []string
+	err := b.Bucket.Iter(ctx, dir, func(name string) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// ListModifiedSince returns the names of objects in dir (including
+// subdirectories) modified after since, in lexical order. Objects without a
+// modification time are always included, as are all objects from providers
+// that cannot report modification times.
+func (b *BucketStore) ListModifiedSince(ctx context.Context, dir string, since time.Time) ([]string, error) {
+	options := []objstore.IterOption{objstore.WithRecursiveIter()}
+	if slices.Contains(b.Bucket.SupportedIterOptions(), objstore.UpdatedAt) {
+		options = append(options, objstore.WithUpdatedAt())
+	}
+
+	var names []string
+	err := b.Bucket.IterWithAttributes(ctx, dir, func(attrs objstore.IterObjectAttributes) error {
+		modified, ok := attrs.LastModified()
+		if !ok || modified.After(since) {
+			names = append(names, attrs.Name)
+		}
+		return nil
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// Attributes returns the size and modification time of a named object,
+// without fetching it.
+func (b *BucketStore) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	return b.Bucket.Attributes(ctx, name)
+}
+
 func (b *BucketStore) IsAccessDeniedErr(err error) bool {
 	return b.Bucket.IsAccessDeniedErr(err)
 }
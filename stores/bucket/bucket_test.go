@@ -0,0 +1,53 @@
+package bucketstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFilesystem(t *testing.T) {
+	ctx := context.Background()
+	conf := fmt.Sprintf(`{"type":"FILESYSTEM","config":{"directory":%q}}`, t.TempDir())
+	bs, err := New([]byte(conf))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, bs.Ping(ctx))
+
+	started := time.Now().Add(-time.Second)
+	assert.NoError(t, bs.Upload(ctx, "ns-day/2024-11-28.json", bytes.NewBufferString(`[]`)))
+	assert.NoError(t, bs.Upload(ctx, "ns-day/2024-11-28/01JDTW.jsonl", bytes.NewBufferString("")))
+
+	r, err := bs.Get(ctx, "ns-day/2024-11-28.json")
+	if assert.NoError(t, err) {
+		b, _ := io.ReadAll(r)
+		r.Close()
+		assert.Equal(t, "[]", string(b))
+	}
+
+	_, err = bs.Get(ctx, "ns-day/2024-11-27.json")
+	assert.True(t, bs.IsObjNotFoundErr(err))
+
+	names, err := bs.List(ctx, "ns-day/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ns-day/2024-11-28.json", "ns-day/2024-11-28/"}, names)
+
+	names, err = bs.ListModifiedSince(ctx, "ns-day/", started)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ns-day/2024-11-28.json", "ns-day/2024-11-28/01JDTW.jsonl"}, names)
+
+	names, err = bs.ListModifiedSince(ctx, "ns-day/", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestNewUnknownProvider(t *testing.T) {
+	_, err := New([]byte(`{"type":"TAPE","config":{}}`))
+	assert.Error(t, err)
+}
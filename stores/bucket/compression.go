@@ -0,0 +1,139 @@
+package bucketstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strings"
+)
+
+// Compression is how objects are compressed before upload. An object's name
+// records how it was compressed (.gz, .zst), so changing compression does not
+// strand objects written earlier.
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+var compressionSuffixes = map[Compression]string{
+	CompressionNone: "",
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+// ParseCompression parses "none", "gzip" or "zstd". Empty means none.
+func ParseCompression(s string) (Compression, error) {
+	switch c := Compression(strings.ToLower(s)); c {
+	case "none":
+		return CompressionNone, nil
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return c, nil
+	}
+	return CompressionNone, fmt.Errorf("unknown compression %q, expected none, gzip or zstd", s)
+}
+
+// Name returns the object name for uncompressed name, eg
+// ns-year/2024.json.gz
+func (c Compression) Name(name string) string {
+	return name + compressionSuffixes[c]
+}
+
+// Names returns every name an object may be stored under, this compression
+// first
+func (c Compression) Names(name string) []string {
+	names := []string{c.Name(name)}
+	for _, other := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		if other != c {
+			names = append(names, other.Name(name))
+		}
+	}
+	return names
+}
+
+// Compress compresses b, returning it unchanged for CompressionNone
+func (c Compression) Compress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch c {
+	case CompressionGzip:
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(b)
+		if err != nil {
+			return nil, err
+		}
+		err = zw.Close()
+		if err != nil {
+			return nil, err
+		}
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		_, err = zw.Write(b)
+		if err != nil {
+			return nil, err
+		}
+		err = zw.Close()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return b, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// CompressionOf returns how the named object was compressed, and its
+// uncompressed name
+func CompressionOf(name string) (Compression, string) {
+	for _, c := range []Compression{CompressionGzip, CompressionZstd} {
+		if strings.HasSuffix(name, compressionSuffixes[c]) {
+			return c, strings.TrimSuffix(name, compressionSuffixes[c])
+		}
+	}
+	return CompressionNone, name
+}
+
+// Decompress wraps r, the contents of the named object, so reads return
+// uncompressed data. Closing the returned reader closes r.
+func Decompress(name string, r io.ReadCloser) (io.ReadCloser, error) {
+	c, _ := CompressionOf(name)
+	switch c {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("cannot decompress %s: %w", name, err)
+		}
+		return decompressor{Reader: zr, closers: []io.Closer{zr, r}}, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("cannot decompress %s: %w", name, err)
+		}
+		return decompressor{Reader: zr, closers: []io.Closer{zr.IOReadCloser(), r}}, nil
+	}
+	return r, nil
+}
+
+type decompressor struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d decompressor) Close() error {
+	var firstErr error
+	for _, c := range d.closers {
+		err := c.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,47 @@
+package bucketstore
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCompression(t *testing.T) {
+	for s, expected := range map[string]Compression{"": CompressionNone, "none": CompressionNone, "GZIP": CompressionGzip, "zstd": CompressionZstd} {
+		c, err := ParseCompression(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, c, s)
+	}
+	_, err := ParseCompression("bzip2")
+	assert.Error(t, err)
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"sgv":105,"direction":"Flat"},`), 100)
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		compressed, err := c.Compress(data)
+		assert.NoError(t, err)
+		if c != CompressionNone {
+			assert.Less(t, len(compressed), len(data), c)
+		}
+
+		name := c.Name("ns-year/2024.json")
+		detected, uncompressed := CompressionOf(name)
+		assert.Equal(t, c, detected)
+		assert.Equal(t, "ns-year/2024.json", uncompressed)
+
+		r, err := Decompress(name, io.NopCloser(bytes.NewReader(compressed)))
+		assert.NoError(t, err)
+		decompressed, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.NoError(t, r.Close())
+		assert.Equal(t, data, decompressed, c)
+	}
+}
+
+func TestCompressionNames(t *testing.T) {
+	assert.Equal(t, []string{"a.json.zst", "a.json", "a.json.gz"}, CompressionZstd.Names("a.json"))
+	assert.Equal(t, []string{"a.json", "a.json.gz", "a.json.zst"}, CompressionNone.Names("a.json"))
+}
@@ -0,0 +1,253 @@
+package bucketstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/thanos-io/objstore"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedDirs hold objects that are large and rarely change, so are worth
+// keeping on disk between restarts
+var cachedDirs = []string{"ns-year/", "ns-month/"}
+
+// AttributesBucket is a Bucket that can report object size and modification
+// time without fetching the object
+type AttributesBucket interface {
+	Bucket
+	Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error)
+}
+
+// DiskCache wraps a bucket, keeping a copy of year and month objects on local
+// disk so restarts do not re-download them.
+//
+// objstore does not expose ETags, so before a cached copy is used the object's
+// size and modification time are fetched (a HEAD request for s3) and compared
+// with those recorded when it was cached. Least recently used objects are
+// removed once the cache grows beyond maxBytes.
+type DiskCache struct {
+	AttributesBucket
+	dir      string
+	maxBytes int64
+	lock     sync.Mutex
+}
+
+// cacheMeta is stored alongside each cached object
+type cacheMeta struct {
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+func NewDiskCache(b AttributesBucket, dir string, maxBytes int64) (*DiskCache, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cache dir: %w", err)
+	}
+	return &DiskCache{
+		AttributesBucket: b,
+		dir:              dir,
+		maxBytes:         maxBytes,
+	}, nil
+}
+
+// Get returns the cached copy of year and month objects if it is still
+// current, otherwise fetches from the bucket and caches the result. Other
+// objects are always fetched from the bucket.
+func (c *DiskCache) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !isCached(name) {
+		return c.AttributesBucket.Get(ctx, name)
+	}
+
+	attrs, err := c.AttributesBucket.Attributes(ctx, name)
+	if err != nil {
+		// let Get report not found/access denied in the usual way
+		return c.AttributesBucket.Get(ctx, name)
+	}
+	meta := cacheMeta{Size: attrs.Size, LastModified: attrs.LastModified}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	r, ok := c.open(name, meta)
+	if ok {
+		return r, nil
+	}
+
+	r, err = c.AttributesBucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// the cache is an optimisation, we can carry on without it
+	_ = c.store(name, meta, b)
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Upload writes to the bucket and drops any cached copy. The new object is
+// cached the next time it is read.
+func (c *DiskCache) Upload(ctx context.Context, name string, r io.Reader) error {
+	if isCached(name) {
+		c.lock.Lock()
+		c.remove(name)
+		c.lock.Unlock()
+	}
+	return c.AttributesBucket.Upload(ctx, name, r)
+}
+
+// List passes through to the wrapped bucket, if it can list objects
+func (c *DiskCache) List(ctx context.Context, dir string) ([]string, error) {
+	lister, ok := c.AttributesBucket.(interface {
+		List(ctx context.Context, dir string) ([]string, error)
+	})
+	if !ok {
+		return nil, errors.New("bucketstore: wrapped bucket cannot list objects")
+	}
+	return lister.List(ctx, dir)
+}
+
+// Delete drops any cached copy and deletes from the wrapped bucket, if it can
+// delete objects
+func (c *DiskCache) Delete(ctx context.Context, name string) error {
+	deleter, ok := c.AttributesBucket.(interface {
+		Delete(ctx context.Context, name string) error
+	})
+	if !ok {
+		return errors.New("bucketstore: wrapped bucket cannot delete objects")
+	}
+	if isCached(name) {
+		c.lock.Lock()
+		c.remove(name)
+		c.lock.Unlock()
+	}
+	return deleter.Delete(ctx, name)
+}
+
+func isCached(name string) bool {
+	return slices.ContainsFunc(cachedDirs, func(dir string) bool { return strings.HasPrefix(name, dir) })
+}
+
+func (c *DiskCache) path(name string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(name))
+}
+
+// open returns the cached object if it matches meta. Callers must hold lock.
+func (c *DiskCache) open(name string, meta cacheMeta) (io.ReadCloser, bool) {
+	path := c.path(name)
+	b, err := os.ReadFile(path + ".meta")
+	if err != nil {
+		return nil, false
+	}
+	var cached cacheMeta
+	err = json.Unmarshal(b, &cached)
+	if err != nil || cached.Size != meta.Size || !cached.LastModified.Equal(meta.LastModified) {
+		return nil, false
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	// mtime records last use, for eviction
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return f, true
+}
+
+// store writes b and its meta to the cache, then evicts old objects if the
+// cache is too big. Callers must hold lock.
+func (c *DiskCache) store(name string, meta cacheMeta, b []byte) error {
+	if int64(len(b)) > c.maxBytes {
+		return nil
+	}
+	path := c.path(name)
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// write the object before its meta, so a crash cannot leave meta that
+	// validates a partial object
+	c.remove(name)
+	err = writeFileAtomic(path, b)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(path+".meta", mb)
+	if err != nil {
+		return err
+	}
+	return c.evict()
+}
+
+// remove drops a cached object. Callers must hold lock.
+func (c *DiskCache) remove(name string) {
+	path := c.path(name)
+	_ = os.Remove(path + ".meta")
+	_ = os.Remove(path)
+}
+
+// evict removes least recently used objects until the cache fits in
+// maxBytes. Callers must hold lock.
+func (c *DiskCache) evict() error {
+	type cachedFile struct {
+		path    string
+		size    int64
+		lastUse time.Time
+	}
+	var files []cachedFile
+	var total int64
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, ".meta") || strings.HasSuffix(path, ".tmp") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, cachedFile{path: path, size: info.Size(), lastUse: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slices.SortFunc(files, func(a, b cachedFile) int { return a.lastUse.Compare(b.lastUse) })
+	for _, f := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		_ = os.Remove(f.path + ".meta")
+		_ = os.Remove(f.path)
+		total -= f.size
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, b, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
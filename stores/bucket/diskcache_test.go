@@ -0,0 +1,93 @@
+package bucketstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+type countingBucket struct {
+	*objstore.InMemBucket
+	gets int
+}
+
+func (b *countingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.gets++
+	return b.InMemBucket.Get(ctx, name)
+}
+
+func readString(t *testing.T, r io.ReadCloser, err error) string {
+	t.Helper()
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestDiskCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bucket := &countingBucket{InMemBucket: objstore.NewInMemBucket()}
+	assert.NoError(t, bucket.Upload(ctx, "ns-year/2023.json", strings.NewReader("[2023]")))
+	assert.NoError(t, bucket.Upload(ctx, "ns-day/2024-11-28.json", strings.NewReader("[today]")))
+
+	c, err := NewDiskCache(bucket, dir, 1<<20)
+	assert.NoError(t, err)
+
+	r, err := c.Get(ctx, "ns-year/2023.json")
+	assert.Equal(t, "[2023]", readString(t, r, err))
+	assert.Equal(t, 1, bucket.gets)
+
+	// a new cache (ie after restart) reads from disk
+	c, err = NewDiskCache(bucket, dir, 1<<20)
+	assert.NoError(t, err)
+	r, err = c.Get(ctx, "ns-year/2023.json")
+	assert.Equal(t, "[2023]", readString(t, r, err))
+	assert.Equal(t, 1, bucket.gets)
+
+	// day files are not cached
+	for range 2 {
+		r, err = c.Get(ctx, "ns-day/2024-11-28.json")
+		assert.Equal(t, "[today]", readString(t, r, err))
+	}
+	assert.Equal(t, 3, bucket.gets)
+
+	// changed objects are fetched again
+	assert.NoError(t, bucket.Upload(ctx, "ns-year/2023.json", strings.NewReader("[2023,more]")))
+	r, err = c.Get(ctx, "ns-year/2023.json")
+	assert.Equal(t, "[2023,more]", readString(t, r, err))
+	assert.Equal(t, 4, bucket.gets)
+
+	// uploads through the cache drop the cached copy
+	assert.NoError(t, c.Upload(ctx, "ns-year/2023.json", strings.NewReader("[new]")))
+	r, err = c.Get(ctx, "ns-year/2023.json")
+	assert.Equal(t, "[new]", readString(t, r, err))
+	assert.Equal(t, 5, bucket.gets)
+
+	_, err = c.Get(ctx, "ns-year/2020.json")
+	assert.True(t, c.IsObjNotFoundErr(err))
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	bucket := &countingBucket{InMemBucket: objstore.NewInMemBucket()}
+	for _, name := range []string{"ns-year/2022.json", "ns-year/2023.json"} {
+		assert.NoError(t, bucket.Upload(ctx, name, strings.NewReader(strings.Repeat("x", 600))))
+	}
+
+	c, err := NewDiskCache(bucket, t.TempDir(), 1000)
+	assert.NoError(t, err)
+	for _, name := range []string{"ns-year/2022.json", "ns-year/2023.json", "ns-year/2023.json", "ns-year/2022.json"} {
+		r, err := c.Get(ctx, name)
+		readString(t, r, err)
+	}
+	// 2022 was evicted to make room for 2023, so is fetched again
+	assert.Equal(t, 3, bucket.gets)
+}
@@ -0,0 +1,188 @@
+package bucketstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault is returned by FaultInjector when it decides an operation
+// should fail.
+var ErrInjectedFault = errors.New("bucketstore: injected fault")
+
+// Bucket is the subset of bucket operations the repositories use
+type Bucket interface {
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	Upload(ctx context.Context, name string, r io.Reader) error
+	IsObjNotFoundErr(err error) bool
+	IsAccessDeniedErr(err error) bool
+}
+
+// FaultConfig determines how often a FaultInjector misbehaves. Rates are
+// probabilities between 0 and 1.
+type FaultConfig struct {
+	ErrorRate        float64       // Get/Upload fail outright
+	PartialWriteRate float64       // Upload writes a truncated object, then fails
+	MaxLatency       time.Duration // each call sleeps for up to this long
+	Seed             int64         // for repeatable runs, 0 means random
+}
+
+// ParseFaultConfig parses config of the form
+// "error=0.1,partial=0.05,latency=2s,seed=42", as used by BUCKET_FAULTS.
+func ParseFaultConfig(s string) (FaultConfig, error) {
+	var cfg FaultConfig
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return cfg, fmt.Errorf("bad fault config %q: expected key=value", kv)
+		}
+		var err error
+		switch strings.TrimSpace(k) {
+		case "error":
+			cfg.ErrorRate, err = strconv.ParseFloat(v, 64)
+		case "partial":
+			cfg.PartialWriteRate, err = strconv.ParseFloat(v, 64)
+		case "latency":
+			cfg.MaxLatency, err = time.ParseDuration(v)
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(v, 10, 64)
+		default:
+			return cfg, fmt.Errorf("bad fault config: unknown key %q", k)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("bad fault config %q: %w", kv, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Enabled reports whether any faults are configured
+func (cfg FaultConfig) Enabled() bool {
+	return cfg.ErrorRate > 0 || cfg.PartialWriteRate > 0 || cfg.MaxLatency > 0
+}
+
+// FaultInjector wraps a Bucket, adding random latency, errors and partial
+// writes. It is intended for testing how we cope with an unreliable object
+// store, and must never be enabled in production.
+type FaultInjector struct {
+	Bucket
+	cfg      FaultConfig
+	rand     *rand.Rand
+	randLock sync.Mutex
+}
+
+func NewFaultInjector(b Bucket, cfg FaultConfig) *FaultInjector {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &FaultInjector{
+		Bucket: b,
+		cfg:    cfg,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (f *FaultInjector) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	err := f.delay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if f.chance(f.cfg.ErrorRate) {
+		return nil, fmt.Errorf("get %s: %w", name, ErrInjectedFault)
+	}
+	return f.Bucket.Get(ctx, name)
+}
+
+func (f *FaultInjector) Upload(ctx context.Context, name string, r io.Reader) error {
+	err := f.delay(ctx)
+	if err != nil {
+		return err
+	}
+	if f.chance(f.cfg.ErrorRate) {
+		return fmt.Errorf("upload %s: %w", name, ErrInjectedFault)
+	}
+	if f.chance(f.cfg.PartialWriteRate) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		err = f.Bucket.Upload(ctx, name, bytes.NewReader(b[:len(b)/2]))
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("partial upload %s: %w", name, ErrInjectedFault)
+	}
+	return f.Bucket.Upload(ctx, name, r)
+}
+
+// List passes through to the wrapped bucket, if it can list objects
+func (f *FaultInjector) List(ctx context.Context, dir string) ([]string, error) {
+	lister, ok := f.Bucket.(interface {
+		List(ctx context.Context, dir string) ([]string, error)
+	})
+	if !ok {
+		return nil, errors.New("bucketstore: wrapped bucket cannot list objects")
+	}
+	err := f.delay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if f.chance(f.cfg.ErrorRate) {
+		return nil, fmt.Errorf("list %s: %w", dir, ErrInjectedFault)
+	}
+	return lister.List(ctx, dir)
+}
+
+// Delete passes through to the wrapped bucket, if it can delete objects
+func (f *FaultInjector) Delete(ctx context.Context, name string) error {
+	deleter, ok := f.Bucket.(interface {
+		Delete(ctx context.Context, name string) error
+	})
+	if !ok {
+		return errors.New("bucketstore: wrapped bucket cannot delete objects")
+	}
+	err := f.delay(ctx)
+	if err != nil {
+		return err
+	}
+	if f.chance(f.cfg.ErrorRate) {
+		return fmt.Errorf("delete %s: %w", name, ErrInjectedFault)
+	}
+	return deleter.Delete(ctx, name)
+}
+
+func (f *FaultInjector) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	f.randLock.Lock()
+	defer f.randLock.Unlock()
+	return f.rand.Float64() < rate
+}
+
+func (f *FaultInjector) delay(ctx context.Context) error {
+	if f.cfg.MaxLatency <= 0 {
+		return nil
+	}
+	f.randLock.Lock()
+	d := time.Duration(f.rand.Int63n(int64(f.cfg.MaxLatency)))
+	f.randLock.Unlock()
+
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,65 @@
+package bucketstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thanos-io/objstore"
+)
+
+func TestParseFaultConfig(t *testing.T) {
+	cfg, err := ParseFaultConfig("error=0.1,partial=0.05,latency=2s,seed=42")
+	assert.NoError(t, err)
+	assert.Equal(t, FaultConfig{ErrorRate: 0.1, PartialWriteRate: 0.05, MaxLatency: 2 * time.Second, Seed: 42}, cfg)
+	assert.True(t, cfg.Enabled())
+
+	cfg, err = ParseFaultConfig("")
+	assert.NoError(t, err)
+	assert.False(t, cfg.Enabled())
+
+	_, err = ParseFaultConfig("errors=0.1")
+	assert.Error(t, err)
+	_, err = ParseFaultConfig("latency=soon")
+	assert.Error(t, err)
+}
+
+func TestFaultInjector(t *testing.T) {
+	ctx := context.Background()
+	bucket := objstore.NewInMemBucket()
+
+	// no faults configured: operations pass through
+	f := NewFaultInjector(bucket, FaultConfig{})
+	assert.NoError(t, f.Upload(ctx, "ok.json", strings.NewReader("[1,2,3,4]")))
+	r, err := f.Get(ctx, "ok.json")
+	assert.NoError(t, err)
+	b, _ := io.ReadAll(r)
+	assert.Equal(t, "[1,2,3,4]", string(b))
+
+	// errors
+	f = NewFaultInjector(bucket, FaultConfig{ErrorRate: 1})
+	_, err = f.Get(ctx, "ok.json")
+	assert.True(t, errors.Is(err, ErrInjectedFault))
+	err = f.Upload(ctx, "ok.json", strings.NewReader("[]"))
+	assert.True(t, errors.Is(err, ErrInjectedFault))
+
+	// partial writes leave a truncated object behind
+	f = NewFaultInjector(bucket, FaultConfig{PartialWriteRate: 1})
+	err = f.Upload(ctx, "partial.json", strings.NewReader("[1,2,3,4]"))
+	assert.True(t, errors.Is(err, ErrInjectedFault))
+	r, err = bucket.Get(ctx, "partial.json")
+	assert.NoError(t, err)
+	b, _ = io.ReadAll(r)
+	assert.Equal(t, "[1,2", string(b))
+
+	// latency respects context cancellation
+	f = NewFaultInjector(bucket, FaultConfig{MaxLatency: time.Hour, Seed: 1})
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = f.Get(cancelledCtx, "ok.json")
+	assert.ErrorIs(t, err, context.Canceled)
+}
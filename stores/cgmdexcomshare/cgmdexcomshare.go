@@ -0,0 +1,345 @@
+package cgmdexcomshare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	slogctx "github.com/veqryn/slog-context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrAuthnFailed = errors.New("dexcomshare: authentication failed")
+var ErrSessionExpired = errors.New("dexcomshare: session expired")
+var ErrUnexpectedDataFormat = errors.New("dexcomshare: unexpected data format")
+
+// applicationID is the id used by the Dexcom follow app, as used by all
+// known share clients (eg share2nightscout-bridge)
+const applicationID = "d89443d2-327c-4a6f-89e5-496bbb0317db"
+
+// nullSessionID is returned instead of an error for some authn failures
+const nullSessionID = "00000000-0000-0000-0000-000000000000"
+
+var knownEndpoints = map[string]string{
+	"us":  "share2.dexcom.com",
+	"ous": "shareous1.dexcom.com",
+	"jp":  "share.dexcom.jp",
+}
+
+type DexcomShareConfig struct {
+	Username string
+	Password string
+	Region   string
+}
+
+type DexcomShareStore struct {
+	url       *url.URL
+	config    DexcomShareConfig
+	accountID string
+	sessionID string
+}
+
+func New(cfg *DexcomShareConfig) *DexcomShareStore {
+	endpointString, ok := knownEndpoints[strings.ToLower(cfg.Region)]
+	if !ok {
+		endpointString = knownEndpoints["us"]
+	}
+	u, _ := url.Parse("https://" + endpointString)
+	return &DexcomShareStore{
+		url:    u,
+		config: *cfg,
+	}
+}
+
+// FetchRecent fetches entries newer than `lastSeen`, in oldest-first order
+// Share stores readings at 5-minute intervals and will return up to 24h of
+// readings, so the first fetch after startup will backfill a day of data.
+func (s *DexcomShareStore) FetchRecent(ctx context.Context, lastSeen time.Time) ([]models.Entry, error) {
+	log := slogctx.FromCtx(ctx)
+	log.Debug("fetching recent entries from dexcom share")
+	if s.sessionID == "" {
+		err := s.login(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetchRecent/login: %w", err)
+		}
+	}
+
+	entries, err := s.latestGlucoseValues(ctx, lastSeen)
+	if errors.Is(err, ErrSessionExpired) {
+		log.Debug("dexcomShareStore session expired, logging in again")
+		s.sessionID = ""
+		err = s.login(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetchRecent/login: %w", err)
+		}
+		entries, err = s.latestGlucoseValues(ctx, lastSeen)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetchRecent/latestGlucoseValues: %w", err)
+	}
+
+	var recentEntries []models.Entry
+	for _, e := range entries {
+		if !e.Time.After(lastSeen) {
+			continue
+		}
+		recentEntries = append(recentEntries, e)
+	}
+
+	return recentEntries, nil
+}
+
+type shareAuthRequest struct {
+	AccountName   string `json:"accountName,omitempty"`
+	AccountID     string `json:"accountId,omitempty"`
+	Password      string `json:"password"`
+	ApplicationID string `json:"applicationId"`
+}
+
+type shareErrorResponse struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+// shareReading is a single glucose value. Times are in .net json format,
+// eg "Date(1691455258000)" or "Date(1691455258000-0400)"
+type shareReading struct {
+	WT    string     `json:"WT"` // wall time
+	ST    string     `json:"ST"` // system (receiver) time
+	DT    string     `json:"DT"` // display time, includes tz offset
+	Value int        `json:"Value"`
+	Trend shareTrend `json:"Trend"`
+}
+
+// shareTrend is either a trend name (current api) or a number (legacy api)
+type shareTrend string
+
+func (t *shareTrend) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*t = shareTrend(name)
+		return nil
+	}
+	var n int
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*t = shareTrend(strconv.Itoa(n))
+	return nil
+}
+
+// directionForTrend maps share trends (by name or legacy number) to nightscout directions
+var directionForTrend = map[shareTrend]string{
+	"None":           "NONE",
+	"DoubleUp":       "DoubleUp",
+	"SingleUp":       "SingleUp",
+	"FortyFiveUp":    "FortyFiveUp",
+	"Flat":           "Flat",
+	"FortyFiveDown":  "FortyFiveDown",
+	"SingleDown":     "SingleDown",
+	"DoubleDown":     "DoubleDown",
+	"NotComputable":  "NOT COMPUTABLE",
+	"RateOutOfRange": "RATE OUT OF RANGE",
+	"0":              "NONE",
+	"1":              "DoubleUp",
+	"2":              "SingleUp",
+	"3":              "FortyFiveUp",
+	"4":              "Flat",
+	"5":              "FortyFiveDown",
+	"6":              "SingleDown",
+	"7":              "DoubleDown",
+	"8":              "NOT COMPUTABLE",
+	"9":              "RATE OUT OF RANGE",
+}
+
+var shareDateRE = regexp.MustCompile(`Date\((\d+)`)
+
+func parseShareTime(s string) (time.Time, error) {
+	m := shareDateRE.FindStringSubmatch(s)
+	if m == nil {
+		return time.Time{}, ErrUnexpectedDataFormat
+	}
+	ms, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return time.Time{}, ErrUnexpectedDataFormat
+	}
+	return time.UnixMilli(ms).UTC(), nil
+}
+
+func (s *DexcomShareStore) latestGlucoseValues(ctx context.Context, lastSeen time.Time) ([]models.Entry, error) {
+	log := slogctx.FromCtx(ctx)
+
+	// ask for as little data as possible, share will return at most 24h
+	minutes := 1440
+	if !lastSeen.IsZero() {
+		sinceLastSeen := int(time.Since(lastSeen).Minutes()) + 5
+		if sinceLastSeen < minutes {
+			minutes = sinceLastSeen
+		}
+	}
+
+	u := *s.url
+	u.Path = path.Join(u.Path, "ShareWebServices", "Services", "Publisher", "ReadPublisherLatestGlucoseValues")
+	q := u.Query()
+	q.Set("sessionId", s.sessionID)
+	q.Set("minutes", strconv.Itoa(minutes))
+	q.Set("maxCount", strconv.Itoa(minutes/5+1))
+	u.RawQuery = q.Encode()
+
+	body, err := s.post(ctx, &u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var readings []shareReading
+	err = json.Unmarshal(body, &readings)
+	if err != nil {
+		log.Info("dexcomShareStore latestGlucoseValues cannot Decode body", slog.Any("err", err))
+		return nil, ErrUnexpectedDataFormat
+	}
+
+	now := time.Now().UTC()
+	entries := make([]models.Entry, 0, len(readings))
+
+	// share returns most-recent-first, we want oldest-first
+	for i := len(readings) - 1; i >= 0; i-- {
+		r := readings[i]
+		eventTime, err := parseShareTime(r.WT)
+		if err != nil {
+			log.Warn("dexcomShareStore cannot parse timestamp", slog.String("timestamp", r.WT))
+			return nil, err
+		}
+		entries = append(entries, models.Entry{
+			Type:        "sgv",
+			SgvMgdl:     r.Value,
+			Direction:   directionForTrend[r.Trend],
+			Time:        eventTime,
+			Device:      "dexcom share ingestor",
+			CreatedTime: now,
+		})
+	}
+	return entries, nil
+}
+
+func (s *DexcomShareStore) login(ctx context.Context) error {
+	log := slogctx.FromCtx(ctx)
+
+	if s.accountID == "" {
+		u := *s.url
+		u.Path = path.Join(u.Path, "ShareWebServices", "Services", "General", "AuthenticatePublisherAccount")
+		body, err := s.post(ctx, &u, shareAuthRequest{
+			AccountName:   s.config.Username,
+			Password:      s.config.Password,
+			ApplicationID: applicationID,
+		})
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(body, &s.accountID)
+		if err != nil {
+			log.Info("dexcomShareStore login cannot unmarshal account id", slog.Any("err", err))
+			return ErrUnexpectedDataFormat
+		}
+		if s.accountID == nullSessionID {
+			s.accountID = ""
+			return ErrAuthnFailed
+		}
+	}
+
+	u := *s.url
+	u.Path = path.Join(u.Path, "ShareWebServices", "Services", "General", "LoginPublisherAccountById")
+	body, err := s.post(ctx, &u, shareAuthRequest{
+		AccountID:     s.accountID,
+		Password:      s.config.Password,
+		ApplicationID: applicationID,
+	})
+	if err != nil {
+		return err
+	}
+
+	var sessionID string
+	err = json.Unmarshal(body, &sessionID)
+	if err != nil {
+		log.Info("dexcomShareStore login cannot unmarshal session id", slog.Any("err", err))
+		return ErrUnexpectedDataFormat
+	}
+	if sessionID == "" || sessionID == nullSessionID {
+		return ErrAuthnFailed
+	}
+	s.sessionID = sessionID
+	log.Debug("dexcomShareStore login: session obtained ok", slog.String("region", s.config.Region))
+	return nil
+}
+
+// post sends a share api request, returning the response body.
+// Share reports errors as a non-200 response with a json body containing a Code
+func (s *DexcomShareStore) post(ctx context.Context, u *url.URL, reqBody any) ([]byte, error) {
+	log := slogctx.FromCtx(ctx)
+
+	b := []byte("")
+	if reqBody != nil {
+		var err error
+		b, err = json.Marshal(reqBody)
+		if err != nil {
+			return nil, fmt.Errorf("dexcomShareStore cannot create req json: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("dexcomShareStore cannot NewRequestWithContext: %w", err)
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("User-Agent", "Dexcom Share/3.0.2.11 CFNetwork/711.2.23 Darwin/14.0.0")
+
+	client := http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		var dnsError *net.DNSError
+		if errors.As(err, &dnsError) {
+			log.Info("dexcomShareStore DNSError", slog.Any("err", dnsError))
+			return nil, fmt.Errorf("dexcomShareStore remote server NOT FOUND: %w", err)
+		}
+		return nil, fmt.Errorf("dexcomShareStore cannot Do req: %w", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	log.Debug("dexcomShareStore got response",
+		slog.Int("code", res.StatusCode),
+		slog.String("path", u.Path),
+	)
+
+	if res.StatusCode != 200 {
+		var errRes shareErrorResponse
+		_ = json.Unmarshal(body, &errRes)
+		log.Info("dexcomShareStore got non-200 res",
+			slog.Int("code", res.StatusCode),
+			slog.String("path", u.Path),
+			slog.String("errCode", errRes.Code),
+		)
+		switch errRes.Code {
+		case "SessionIdNotFound", "SessionNotValid":
+			return nil, ErrSessionExpired
+		case "AccountPasswordInvalid", "SSO_AuthenticateAccountNotFound", "SSO_AuthenticatePasswordInvalid", "SSO_AuthenticateMaxAttemptsExceeed":
+			return nil, ErrAuthnFailed
+		}
+		return nil, fmt.Errorf("dexcomShareStore got non-200 response: %d %s", res.StatusCode, errRes.Code)
+	}
+	return body, nil
+}
+
+func (s *DexcomShareStore) ErrorIsAuthnFailed(err error) bool {
+	return errors.Is(err, ErrAuthnFailed)
+}
@@ -0,0 +1,225 @@
+package cgmdexcomshare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseShareTime(t *testing.T) {
+	want := time.Date(2023, 8, 8, 0, 40, 58, 0, time.UTC)
+	tests := map[string]string{
+		"bare":             "Date(1691455258000)",
+		"negative offset":  "Date(1691455258000-0400)",
+		"positive offset":  "Date(1691455258000+0100)",
+		"wcf json escaped": "/Date(1691455258000-0400)/",
+	}
+	for name, s := range tests {
+		t.Run(name, func(t *testing.T) {
+			// the offset is the display timezone, the milliseconds are utc
+			got, err := parseShareTime(s)
+			assert.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+
+	for _, s := range []string{"", "2023-08-08T00:40:58Z", "Date()", "Date(99999999999999999999)"} {
+		_, err := parseShareTime(s)
+		assert.ErrorIs(t, err, ErrUnexpectedDataFormat, s)
+	}
+}
+
+func TestDirectionForTrend(t *testing.T) {
+	tests := []struct {
+		trend     string
+		direction string
+	}{
+		{`"Flat"`, "Flat"},
+		{`"DoubleUp"`, "DoubleUp"},
+		{`"FortyFiveDown"`, "FortyFiveDown"},
+		{`"None"`, "NONE"},
+		{`"NotComputable"`, "NOT COMPUTABLE"},
+		{`"RateOutOfRange"`, "RATE OUT OF RANGE"},
+		// legacy numeric trends
+		{`0`, "NONE"},
+		{`1`, "DoubleUp"},
+		{`4`, "Flat"},
+		{`7`, "DoubleDown"},
+		{`8`, "NOT COMPUTABLE"},
+		{`9`, "RATE OUT OF RANGE"},
+		// unknown trends have no direction
+		{`"Sideways"`, ""},
+		{`42`, ""},
+	}
+	for _, tt := range tests {
+		var r shareReading
+		err := json.Unmarshal([]byte(`{"Value":100,"Trend":`+tt.trend+`}`), &r)
+		assert.NoError(t, err, tt.trend)
+		assert.Equal(t, tt.direction, directionForTrend[r.Trend], tt.trend)
+	}
+
+	var r shareReading
+	assert.Error(t, json.Unmarshal([]byte(`{"Trend":{}}`), &r))
+}
+
+const (
+	authenticatePath = "/ShareWebServices/Services/General/AuthenticatePublisherAccount"
+	loginPath        = "/ShareWebServices/Services/General/LoginPublisherAccountById"
+	readingsPath     = "/ShareWebServices/Services/Publisher/ReadPublisherLatestGlucoseValues"
+)
+
+// fakeShare is a share server. The first failures requests to errorPath fail
+// with errorCode, as share reports errors.
+type fakeShare struct {
+	accountID string
+	sessionID string
+	readings  string
+	errorPath string
+	errorCode string
+	failures  int
+	calls     map[string]int
+}
+
+func (f *fakeShare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.calls[r.URL.Path]++
+	if r.URL.Path == f.errorPath && f.calls[r.URL.Path] <= f.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintf(w, `{"Code":%q,"Message":"fake error"}`, f.errorCode)
+		return
+	}
+	switch r.URL.Path {
+	case authenticatePath:
+		_, _ = fmt.Fprintf(w, "%q", f.accountID)
+	case loginPath:
+		_, _ = fmt.Fprintf(w, "%q", f.sessionID)
+	case readingsPath:
+		if r.URL.Query().Get("sessionId") != f.sessionID {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"Code":"SessionNotValid"}`))
+			return
+		}
+		_, _ = w.Write([]byte(f.readings))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestStore(t *testing.T, f *fakeShare) *DexcomShareStore {
+	f.calls = map[string]int{}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	s := New(&DexcomShareConfig{Username: "user", Password: "pass", Region: "ous"})
+	s.url, _ = url.Parse(srv.URL)
+	return s
+}
+
+func TestFetchRecent(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeShare{
+		accountID: "acc",
+		sessionID: "sess",
+		// most recent first
+		readings: `[{"WT":"Date(1691455558000)","ST":"Date(1691455558000)","DT":"Date(1691455558000-0400)","Value":110,"Trend":"SingleUp"},` +
+			`{"WT":"Date(1691455258000)","ST":"Date(1691455258000)","DT":"Date(1691455258000-0400)","Value":100,"Trend":4}]`,
+	}
+	s := newTestStore(t, f)
+
+	entries, err := s.FetchRecent(ctx, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, 100, entries[0].SgvMgdl, "oldest first")
+	assert.Equal(t, "Flat", entries[0].Direction)
+	assert.Equal(t, 110, entries[1].SgvMgdl)
+	assert.Equal(t, "SingleUp", entries[1].Direction)
+	assert.Equal(t, time.UnixMilli(1691455558000).UTC(), entries[1].Time)
+
+	// readings we have already seen are skipped, without logging in again
+	entries, err = s.FetchRecent(ctx, time.UnixMilli(1691455258000))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, 1, f.calls[loginPath])
+}
+
+func TestFetchRecentSessionExpired(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeShare{accountID: "acc", sessionID: "sess", readings: `[]`}
+	s := newTestStore(t, f)
+	_, err := s.FetchRecent(ctx, time.Time{})
+	assert.NoError(t, err)
+
+	// share has expired our session: log in again, reusing the account id
+	f.sessionID = "sess2"
+	_, err = s.FetchRecent(ctx, time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "sess2", s.sessionID)
+	assert.Equal(t, 1, f.calls[authenticatePath])
+	assert.Equal(t, 2, f.calls[loginPath])
+	assert.Equal(t, 3, f.calls[readingsPath])
+}
+
+func TestFetchRecentErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		share     fakeShare
+		authnFail bool
+		err       error
+	}{
+		{
+			name:      "bad password",
+			share:     fakeShare{accountID: "acc", sessionID: "sess", errorPath: authenticatePath, errorCode: "AccountPasswordInvalid", failures: 1},
+			authnFail: true,
+		},
+		{
+			name:      "unknown account",
+			share:     fakeShare{accountID: "acc", sessionID: "sess", errorPath: authenticatePath, errorCode: "SSO_AuthenticateAccountNotFound", failures: 1},
+			authnFail: true,
+		},
+		{
+			name:      "null account id",
+			share:     fakeShare{accountID: nullSessionID, sessionID: "sess"},
+			authnFail: true,
+		},
+		{
+			name:      "null session id",
+			share:     fakeShare{accountID: "acc", sessionID: nullSessionID},
+			authnFail: true,
+		},
+		{
+			name:  "server error",
+			share: fakeShare{accountID: "acc", sessionID: "sess", errorPath: loginPath, errorCode: "InternalError", failures: 1},
+		},
+		{
+			name:  "session keeps expiring",
+			share: fakeShare{accountID: "acc", sessionID: "sess", errorPath: readingsPath, errorCode: "SessionIdNotFound", failures: 2},
+			err:   ErrSessionExpired,
+		},
+		{
+			name:  "unexpected readings",
+			share: fakeShare{accountID: "acc", sessionID: "sess", readings: `{"not":"a list"}`},
+			err:   ErrUnexpectedDataFormat,
+		},
+		{
+			name:  "unexpected timestamp",
+			share: fakeShare{accountID: "acc", sessionID: "sess", readings: `[{"WT":"yesterday","Value":100,"Trend":"Flat"}]`},
+			err:   ErrUnexpectedDataFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t, &tt.share)
+			_, err := s.FetchRecent(context.Background(), time.Time{})
+			assert.Error(t, err)
+			assert.Equal(t, tt.authnFail, s.ErrorIsAuthnFailed(err))
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+}
@@ -12,11 +12,15 @@ import (
 	slogctx "github.com/veqryn/slog-context"
 	"io"
 	"log/slog"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,6 +28,13 @@ var ErrAuthnFailed = errors.New("llu: authentication failed")
 var ErrNoConnections = errors.New("llu: no connections found")
 var ErrUnexpectedDataFormat = errors.New("llu: unexpected data format")
 var ErrDownForMaintenance = errors.New("llu: servers down for maintenance")
+var ErrPatientNotFound = errors.New("llu: configured patient not found")
+var ErrRateLimited = errors.New("llu: rate limited")
+var ErrBackingOff = errors.New("llu: backing off after rate limit/maintenance")
+
+// backoff bounds, used when llu asks us to go away without a Retry-After
+const minBackoff = 2 * time.Minute
+const maxBackoff = time.Hour
 
 var knownEndpoints = map[string]string{
 	"ae":  "api-ae.libreview.io",
@@ -41,9 +52,30 @@ var knownEndpoints = map[string]string{
 }
 
 type LLUConfig struct {
-	Username string
-	Password string
-	Region   string
+	Username     string
+	Password     string
+	Region       string
+	PatientID    string         // patient id or "firstname lastname", defaults to first connection
+	Location     *time.Location // llu timestamps are in the patient's local time, defaults to UTC
+	Archiver     Archiver       // if set, raw responses are archived for debugging
+	ArchiveLimit int            // number of archived responses to keep
+}
+
+// Archiver stores raw llu responses, typically in the bucket
+type Archiver interface {
+	Upload(ctx context.Context, name string, r io.Reader) error
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context, dir string) ([]string, error)
+}
+
+const archiveDir = "ns-debug/llu/"
+
+// Connection is a patient the account can follow
+type Connection struct {
+	PatientID string
+	FirstName string
+	LastName  string
+	Selected  bool
 }
 
 type LLUStore struct {
@@ -58,6 +90,23 @@ type LLUStore struct {
 	SensorID          string
 	SensorSerial      string
 	SensorStartTime   time.Time
+	available         []Connection // connections available at last login
+	availableLock     sync.Mutex
+	retryAfter        time.Duration // from the last 429/911 response
+	backoffUntil      time.Time
+	backoffFailures   int
+	archived          []string      // oldest first, nil until listed
+	latest            *models.Entry // raw 1-minute reading from the last graph
+}
+
+// lluTimeLayout is used for llu timestamps, which have no timezone
+const lluTimeLayout = "1/2/2006 3:04:05 PM"
+
+func (s *LLUStore) location() *time.Location {
+	if s.config.Location == nil {
+		return time.UTC
+	}
+	return s.config.Location
 }
 
 func New(cfg *LLUConfig) *LLUStore {
@@ -79,7 +128,66 @@ func New(cfg *LLUConfig) *LLUStore {
 // This means we get
 // - Initial backfill of 12 hours of data at startup
 // - Continuous real-time updates when polling every minute
+//
+// When llu rate-limits us or is down for maintenance we back off
+// exponentially (respecting Retry-After) rather than polling every minute.
 func (s *LLUStore) FetchRecent(ctx context.Context, lastSeen time.Time) ([]models.Entry, error) {
+	log := slogctx.FromCtx(ctx)
+	now := time.Now()
+	if now.Before(s.backoffUntil) {
+		log.Debug("lluStore backing off", slog.Time("until", s.backoffUntil))
+		return nil, fmt.Errorf("%w until %s", ErrBackingOff, s.backoffUntil.Format(time.RFC3339))
+	}
+
+	entries, err := s.fetchRecent(ctx, lastSeen)
+	if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrDownForMaintenance) {
+		s.backoffFailures++
+		delay := backoffDelay(s.backoffFailures, s.retryAfter, rand.Float64())
+		s.backoffUntil = now.Add(delay)
+		s.retryAfter = 0
+		log.Warn("lluStore backing off",
+			slog.Any("reason", err),
+			slog.Int("consecutiveFailures", s.backoffFailures),
+			slog.Duration("delay", delay),
+			slog.Time("until", s.backoffUntil),
+		)
+		return nil, err
+	}
+	if err == nil && s.backoffFailures > 0 {
+		log.Info("lluStore recovered, no longer backing off", slog.Int("consecutiveFailures", s.backoffFailures))
+		s.backoffFailures = 0
+	}
+	return entries, err
+}
+
+// backoffDelay doubles the delay for each consecutive failure, with up to
+// 20% jitter so many clients do not return at once. Retry-After takes
+// precedence when it is longer.
+func backoffDelay(failures int, retryAfter time.Duration, jitter float64) time.Duration {
+	delay := maxBackoff
+	if failures < 10 {
+		delay = min(minBackoff<<(failures-1), maxBackoff)
+	}
+	delay += time.Duration(float64(delay) * 0.2 * jitter)
+	return max(delay, retryAfter)
+}
+
+// parseRetryAfter parses a Retry-After header, in either seconds or
+// http-date form. Unparseable values are ignored.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+func (s *LLUStore) fetchRecent(ctx context.Context, lastSeen time.Time) ([]models.Entry, error) {
 	log := slogctx.FromCtx(ctx)
 	log.Debug("fetching recent freshEntries from librelinkup")
 	if s.authTicket == "" || s.UserID == "" || s.authTicketExpires.Before(time.Now()) {
@@ -145,7 +253,7 @@ func (s *LLUStore) graph(ctx context.Context) ([]models.Entry, error) {
 
 	// historical readings at 15-minute intervals
 	for _, e := range graph.Data.GraphData {
-		eventTime, err := time.Parse("1/2/2006 3:04:05 PM", e.Timestamp)
+		eventTime, err := time.ParseInLocation(lluTimeLayout, e.Timestamp, s.location())
 		if err != nil {
 			log.Warn("lluStore graph cannot parse timestamp",
 				slog.Any("err", err),
@@ -154,14 +262,20 @@ func (s *LLUStore) graph(ctx context.Context) ([]models.Entry, error) {
 			return nil, ErrUnexpectedDataFormat
 		}
 
-		// nb no trend available for historic data
-		entries = append(entries, models.Entry{
+		entry := models.Entry{
 			Type:        "sgv",
 			SgvMgdl:     e.ValueInMgPerDl,
-			Time:        eventTime,
+			Time:        eventTime.UTC(),
 			Device:      device,
 			CreatedTime: now,
-		})
+		}
+
+		// nb no trend available for historic data, derive it from the slope
+		// between consecutive points
+		if len(entries) > 0 {
+			entry.Direction = models.DirectionBetween(entries[len(entries)-1], entry)
+		}
+		entries = append(entries, entry)
 	}
 
 	// latest reading available at 1-minute intervals
@@ -181,7 +295,7 @@ func (s *LLUStore) graph(ctx context.Context) ([]models.Entry, error) {
 	}
 
 	trendString := directionForTrendArrow[latestReading.TrendArrow]
-	latestTime, err := time.Parse("1/2/2006 3:04:05 PM", latestReading.Timestamp)
+	latestTime, err := time.ParseInLocation(lluTimeLayout, latestReading.Timestamp, s.location())
 	if err != nil {
 		log.Warn("lluStore graph cannot parse timestamp",
 			slog.Any("err", err),
@@ -190,14 +304,16 @@ func (s *LLUStore) graph(ctx context.Context) ([]models.Entry, error) {
 		return nil, ErrUnexpectedDataFormat
 	}
 
-	entries = append(entries, models.Entry{
+	latest := models.Entry{
 		Type:        "sgv",
 		SgvMgdl:     latestReading.ValueInMgPerDl,
 		Direction:   trendString,
-		Time:        latestTime,
+		Time:        latestTime.UTC(),
 		Device:      device,
 		CreatedTime: now,
-	})
+	}
+	s.latest = &latest
+	entries = append(entries, latest)
 
 	return entries, nil
 }
@@ -232,6 +348,7 @@ func (s *LLUStore) fetchGraph(ctx context.Context) (*graphResponse, error) {
 		return nil, fmt.Errorf("lluStore graph cannot Do req: %w", err)
 	}
 	body, _ := io.ReadAll(res.Body)
+	s.archive(ctx, "graph", body)
 	log.Debug("lluStore graph got response",
 		slog.Int("code", res.StatusCode),
 		slog.String("url", u.String()),
@@ -239,8 +356,14 @@ func (s *LLUStore) fetchGraph(ctx context.Context) (*graphResponse, error) {
 	)
 
 	if res.StatusCode != 200 {
+		if res.StatusCode == http.StatusTooManyRequests {
+			log.Debug("lluStore graph got 429 (rate limited) response")
+			s.retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+			return nil, ErrRateLimited
+		}
 		if res.StatusCode == 911 {
 			log.Debug("lluStore graph got 911 (maintenance) response")
+			s.retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
 			return nil, ErrDownForMaintenance
 		}
 		log.Info("lluStore graph got non-200 res",
@@ -336,10 +459,15 @@ func (s *LLUStore) login(ctx context.Context) error {
 		slog.String("body", string(body)),
 	)
 
-	// TODO: cope with 911 returned during maintenance
 	if res.StatusCode != 200 {
+		if res.StatusCode == http.StatusTooManyRequests {
+			log.Debug("lluStore login got 429 (rate limited) response")
+			s.retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+			return ErrRateLimited
+		}
 		if res.StatusCode == 911 {
 			log.Debug("lluStore login got 911 (maintenance) response")
+			s.retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
 			return ErrDownForMaintenance
 		}
 
@@ -436,6 +564,7 @@ func (s *LLUStore) connections(ctx context.Context) error {
 		return fmt.Errorf("lluStore connections cannot Do req: %w", err)
 	}
 	body, _ := io.ReadAll(res.Body)
+	s.archive(ctx, "connections", body)
 	log.Debug("lluStore connections got response",
 		slog.Int("code", res.StatusCode),
 		slog.String("url", u.String()),
@@ -443,8 +572,14 @@ func (s *LLUStore) connections(ctx context.Context) error {
 	)
 
 	if res.StatusCode != 200 {
+		if res.StatusCode == http.StatusTooManyRequests {
+			log.Debug("lluStore connections got 429 (rate limited) response")
+			s.retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+			return ErrRateLimited
+		}
 		if res.StatusCode == 911 {
 			log.Debug("lluStore connections got 911 (maintenance) response")
+			s.retryAfter = parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
 			return ErrDownForMaintenance
 		}
 		log.Info("lluStore connections got non-200 res",
@@ -479,12 +614,125 @@ func (s *LLUStore) connections(ctx context.Context) error {
 		return ErrNoConnections
 	}
 
-	//s.connectionID = llucr.Data[0].ID
-	s.PatientID = llucr.Data[0].PatientId
+	connections := make([]Connection, len(llucr.Data))
+	for i, c := range llucr.Data {
+		connections[i] = Connection{
+			PatientID: c.PatientId,
+			FirstName: c.FirstName,
+			LastName:  c.LastName,
+		}
+	}
+
+	patient, err := selectConnection(connections, s.config.PatientID)
+	for i := range connections {
+		connections[i].Selected = err == nil && connections[i].PatientID == patient.PatientID
+	}
+	s.availableLock.Lock()
+	s.available = connections
+	s.availableLock.Unlock()
+
+	if err != nil {
+		log.Warn("lluStore connections: configured patient not found, check LINK_UP_PATIENT_ID",
+			slog.String("patientID", s.config.PatientID),
+			slog.Any("connections", connections),
+		)
+		return err
+	}
+	if len(connections) > 1 {
+		log.Info("lluStore connections: account follows several patients",
+			slog.String("selectedPatientID", patient.PatientID),
+			slog.Any("connections", connections),
+		)
+	}
+	s.PatientID = patient.PatientID
 
 	return nil
 }
 
+// ActiveSensor returns the sensor seen in the most recent graph, or nil if
+// there is no active sensor
+func (s *LLUStore) ActiveSensor() *models.Sensor {
+	if s.SensorSerial == "" {
+		return nil
+	}
+	return &models.Sensor{
+		Serial:    s.SensorSerial,
+		StartTime: s.SensorStartTime,
+	}
+}
+
+// archive writes a raw llu response to the bucket, keeping at most
+// ArchiveLimit responses. Failures are logged but otherwise ignored, this is
+// a debugging aid.
+func (s *LLUStore) archive(ctx context.Context, kind string, body []byte) {
+	log := slogctx.FromCtx(ctx)
+	if s.config.Archiver == nil || s.config.ArchiveLimit <= 0 {
+		return
+	}
+
+	if s.archived == nil {
+		archived, err := s.config.Archiver.List(ctx, archiveDir)
+		if err != nil {
+			log.Warn("lluStore archive cannot list archived responses", slog.Any("err", err))
+			return
+		}
+		s.archived = archived
+	}
+
+	name := fmt.Sprintf("%s%s-%s.json", archiveDir, time.Now().UTC().Format("20060102T150405.000Z"), kind)
+	err := s.config.Archiver.Upload(ctx, name, bytes.NewReader(body))
+	if err != nil {
+		log.Warn("lluStore archive cannot upload response", slog.String("name", name), slog.Any("err", err))
+		return
+	}
+	s.archived = append(s.archived, name)
+
+	for len(s.archived) > s.config.ArchiveLimit {
+		err = s.config.Archiver.Delete(ctx, s.archived[0])
+		if err != nil {
+			log.Warn("lluStore archive cannot delete old response", slog.String("name", s.archived[0]), slog.Any("err", err))
+			return
+		}
+		s.archived = s.archived[1:]
+	}
+}
+
+// LatestReading returns the raw (unsmoothed) reading from the most recent
+// graph, or nil
+func (s *LLUStore) LatestReading() *models.Entry {
+	return s.latest
+}
+
+// AvailableConnections returns the patients the account could follow, as
+// of the last login
+func (s *LLUStore) AvailableConnections() []Connection {
+	s.availableLock.Lock()
+	defer s.availableLock.Unlock()
+	return slices.Clone(s.available)
+}
+
+// selectConnection picks the connection matching patientID, which may be a
+// patient id or a case-insensitive "firstname lastname". With no patientID
+// we use the first connection, as the llu app does.
+func selectConnection(connections []Connection, patientID string) (Connection, error) {
+	if patientID == "" {
+		return connections[0], nil
+	}
+	for _, c := range connections {
+		if c.PatientID == patientID || strings.EqualFold(c.FirstName+" "+c.LastName, patientID) {
+			return c, nil
+		}
+	}
+	return Connection{}, ErrPatientNotFound
+}
+
+func (c Connection) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("patientID", c.PatientID),
+		slog.String("name", c.FirstName+" "+c.LastName),
+	)
+}
+
 func (s *LLUStore) setRegion(region string) {
 	s.config.Region = strings.ToLower(region)
 	endpointString, ok := knownEndpoints[s.config.Region]
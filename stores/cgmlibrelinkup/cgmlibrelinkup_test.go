@@ -0,0 +1,92 @@
+package cgmlibrelinkup
+
+import (
+	"context"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectConnection(t *testing.T) {
+	connections := []Connection{
+		{PatientID: "e25e9a58-8c91-11ef-9073-d6090acef5fa", FirstName: "Alex", LastName: "Smith"},
+		{PatientID: "f6a0b2c4-8c91-11ef-9073-d6090acef5fa", FirstName: "Sam", LastName: "Jones"},
+	}
+
+	c, err := selectConnection(connections, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "Alex", c.FirstName, "defaults to first connection")
+
+	c, err = selectConnection(connections, "f6a0b2c4-8c91-11ef-9073-d6090acef5fa")
+	assert.NoError(t, err)
+	assert.Equal(t, "Sam", c.FirstName, "matches patient id")
+
+	c, err = selectConnection(connections, "sam jones")
+	assert.NoError(t, err)
+	assert.Equal(t, "Sam", c.FirstName, "matches name, case-insensitively")
+
+	_, err = selectConnection(connections, "Sam")
+	assert.ErrorIs(t, err, ErrPatientNotFound)
+}
+
+func TestBackoffDelay(t *testing.T) {
+	assert.Equal(t, 2*time.Minute, backoffDelay(1, 0, 0))
+	assert.Equal(t, 4*time.Minute, backoffDelay(2, 0, 0))
+	assert.Equal(t, 8*time.Minute, backoffDelay(3, 0, 0))
+	assert.Equal(t, time.Hour, backoffDelay(7, 0, 0), "capped")
+	assert.Equal(t, time.Hour, backoffDelay(100, 0, 0), "no overflow")
+	assert.Equal(t, 2*time.Minute+24*time.Second, backoffDelay(1, 0, 1), "up to 20% jitter")
+	assert.Equal(t, 3*time.Hour, backoffDelay(1, 3*time.Hour, 0.5), "longer Retry-After wins")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 11, 28, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 5*time.Minute, parseRetryAfter("Thu, 28 Nov 2024 10:05:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
+
+type memArchiver struct {
+	objects map[string][]byte
+}
+
+func (m *memArchiver) Upload(ctx context.Context, name string, r io.Reader) error {
+	m.objects[name], _ = io.ReadAll(r)
+	return nil
+}
+
+func (m *memArchiver) Delete(ctx context.Context, name string) error {
+	delete(m.objects, name)
+	return nil
+}
+
+func (m *memArchiver) List(ctx context.Context, dir string) ([]string, error) {
+	var names []string
+	for name := range m.objects {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	archiver := &memArchiver{objects: map[string][]byte{
+		"ns-debug/llu/20241127T100000.000Z-graph.json": []byte("{}"),
+	}}
+
+	s := New(&LLUConfig{})
+	s.archive(ctx, "graph", []byte(`{"status":0}`))
+	assert.Len(t, archiver.objects, 1, "archiving disabled by default")
+
+	s = New(&LLUConfig{Archiver: archiver, ArchiveLimit: 2})
+	s.archive(ctx, "graph", []byte(`{"status":0}`))
+	assert.Len(t, archiver.objects, 2)
+	s.archive(ctx, "connections", []byte(`{"status":0}`))
+	assert.Len(t, archiver.objects, 2, "oldest response removed")
+	assert.NotContains(t, archiver.objects, "ns-debug/llu/20241127T100000.000Z-graph.json")
+}
@@ -0,0 +1,263 @@
+// Package csvimport parses the csv exports offered by Dexcom Clarity and
+// LibreView, so users without a live nightscout can seed their history.
+package csvimport
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/adamlounds/nightscout-go/models"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnknownFormat = errors.New("csvimport: unrecognised csv format")
+
+const (
+	FormatClarity   = "clarity"
+	FormatLibreView = "libreview"
+)
+
+// Dexcom reports readings outside the sensor's range as "Low" or "High"
+const (
+	clarityLowMgdl  = 40
+	clarityHighMgdl = 400
+)
+
+// headerSearchRows is how far into the file we look for a header. LibreView
+// exports start with a line of report metadata.
+const headerSearchRows = 3
+
+// ParseEntries detects the export format from its header and returns the
+// glucose readings it contains, oldest first. Export timestamps are local
+// time with no offset, so loc says where they were recorded.
+func ParseEntries(r io.Reader, loc *time.Location) (string, []models.Entry, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+
+	for i := 0; i < headerSearchRows; i++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("csvimport cannot read header: %w", err)
+		}
+		header := newColumns(record)
+
+		var entries []models.Entry
+		var format string
+		switch {
+		case header.has("Event Type") && header.hasPrefix("Timestamp (") && header.hasPrefix("Glucose Value ("):
+			format = FormatClarity
+			entries, err = parseClarity(cr, header, loc)
+		case header.has("Device Timestamp") && header.has("Record Type"):
+			format = FormatLibreView
+			entries, err = parseLibreView(cr, header, loc)
+		default:
+			continue
+		}
+		if err != nil {
+			return format, nil, err
+		}
+		slices.SortStableFunc(entries, func(a, b models.Entry) int {
+			return a.Time.Compare(b.Time)
+		})
+		for i := 1; i < len(entries); i++ {
+			entries[i].Direction = models.DirectionBetween(entries[i-1], entries[i])
+		}
+		return format, entries, nil
+	}
+	return "", nil, ErrUnknownFormat
+}
+
+// columns maps header names to their index
+type columns map[string]int
+
+func newColumns(header []string) columns {
+	c := make(columns, len(header))
+	for i, name := range header {
+		c[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	return c
+}
+
+func (c columns) has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+func (c columns) hasPrefix(prefix string) bool {
+	return c.findPrefix(prefix) != ""
+}
+
+// findPrefix returns the first column name starting with prefix. Column
+// names include units, eg "Glucose Value (mg/dL)".
+func (c columns) findPrefix(prefix string) string {
+	for name := range c {
+		if strings.HasPrefix(name, prefix) {
+			return name
+		}
+	}
+	return ""
+}
+
+// get returns the named field from a record, or "" if it is missing
+func (c columns) get(record []string, name string) string {
+	i, ok := c[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// glucoseColumn finds the column with the given prefix, and whether its
+// values are in mmol/L
+func (c columns) glucoseColumn(prefix string) (string, bool) {
+	name := c.findPrefix(prefix)
+	return name, strings.Contains(strings.ToLower(name), "mmol")
+}
+
+func parseGlucose(s string, mmol bool) (int, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if mmol {
+		return models.MmolToMgdl(v), nil
+	}
+	return int(v), nil
+}
+
+// parseClarity reads Clarity rows. Alongside readings (event type EGV),
+// exports include patient and device details, calibrations and any events
+// entered in the Dexcom app. Only readings are imported.
+func parseClarity(cr *csv.Reader, header columns, loc *time.Location) ([]models.Entry, error) {
+	timeColumn := header.findPrefix("Timestamp (")
+	glucoseColumn, mmol := header.glucoseColumn("Glucose Value (")
+
+	var entries []models.Entry
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csvimport cannot read clarity export: %w", err)
+		}
+		if header.get(record, "Event Type") != "EGV" {
+			continue
+		}
+
+		ts := header.get(record, timeColumn)
+		t, err := time.ParseInLocation("2006-01-02T15:04:05", ts, loc)
+		if err != nil {
+			return nil, fmt.Errorf("csvimport bad clarity timestamp %q: %w", ts, err)
+		}
+
+		var sgv int
+		switch v := header.get(record, glucoseColumn); v {
+		case "Low":
+			sgv = clarityLowMgdl
+		case "High":
+			sgv = clarityHighMgdl
+		default:
+			sgv, err = parseGlucose(v, mmol)
+			if err != nil {
+				return nil, fmt.Errorf("csvimport bad clarity glucose value %q: %w", v, err)
+			}
+		}
+
+		device := header.get(record, "Source Device ID")
+		if device == "" {
+			device = "Dexcom Clarity"
+		}
+		entries = append(entries, models.Entry{
+			Type:    "sgv",
+			SgvMgdl: sgv,
+			Device:  device,
+			Time:    t.UTC(),
+		})
+	}
+}
+
+// LibreView record types we import
+const (
+	libreViewHistoric = "0" // 15-minute history
+	libreViewScan     = "1" // on-demand scan
+)
+
+// parseLibreView reads LibreView rows. Timestamps follow the exporting
+// account's locale, either month-first (US) or day-first, so we look at every
+// row before deciding which.
+func parseLibreView(cr *csv.Reader, header columns, loc *time.Location) ([]models.Entry, error) {
+	historicColumn, historicMmol := header.glucoseColumn("Historic Glucose")
+	scanColumn, scanMmol := header.glucoseColumn("Scan Glucose")
+
+	type reading struct {
+		ts     string
+		sgv    int
+		device string
+	}
+	var readings []reading
+	dayFirst := false
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csvimport cannot read libreview export: %w", err)
+		}
+
+		var v string
+		var mmol bool
+		switch header.get(record, "Record Type") {
+		case libreViewHistoric:
+			v, mmol = header.get(record, historicColumn), historicMmol
+		case libreViewScan:
+			v, mmol = header.get(record, scanColumn), scanMmol
+		default:
+			continue
+		}
+		sgv, err := parseGlucose(v, mmol)
+		if err != nil {
+			return nil, fmt.Errorf("csvimport bad libreview glucose value %q: %w", v, err)
+		}
+
+		ts := header.get(record, "Device Timestamp")
+		if first, _, ok := strings.Cut(ts, "-"); ok {
+			if n, err := strconv.Atoi(first); err == nil && n > 12 {
+				dayFirst = true
+			}
+		}
+		readings = append(readings, reading{ts: ts, sgv: sgv, device: header.get(record, "Device")})
+	}
+
+	layout := "01-02-2006 15:04"
+	if dayFirst {
+		layout = "02-01-2006 15:04"
+	}
+	entries := make([]models.Entry, 0, len(readings))
+	for _, r := range readings {
+		t, err := time.ParseInLocation(layout, r.ts, loc)
+		if err != nil {
+			return nil, fmt.Errorf("csvimport bad libreview timestamp %q: %w", r.ts, err)
+		}
+		device := r.device
+		if device == "" {
+			device = "LibreView"
+		}
+		entries = append(entries, models.Entry{
+			Type:    "sgv",
+			SgvMgdl: r.sgv,
+			Device:  device,
+			Time:    t.UTC(),
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,60 @@
+package csvimport
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const clarityExport = `Index,Timestamp (YYYY-MM-DDThh:mm:ss),Event Type,Event Subtype,Patient Info,Device Info,Source Device ID,Glucose Value (mg/dL),Insulin Value (u),Carb Value (grams),Duration (hh:mm:ss),Glucose Rate of Change (mg/dL/min),Transmitter Time (Long Integer),Transmitter ID
+1,,FirstName,,Jo,,,,,,,,,
+2,,Device,,,"Android G6",,,,,,,,
+3,2024-06-01T00:58:00,EGV,,,,Android G6,105,,,,,1234,8XXXXX
+4,2024-06-01T01:03:00,EGV,,,,Android G6,115,,,,,1534,8XXXXX
+5,2024-06-01T01:05:00,Insulin,Fast-Acting,,,Android G6,,4,,,,,
+6,2024-06-01T02:08:00,EGV,,,,Android G6,Low,,,,,1834,8XXXXX
+`
+
+const libreViewExport = `Glucose Data,Generated on,04-02-2024 10:00 UTC,Generated by,Jo Bloggs
+Device,Serial Number,Device Timestamp,Record Type,Historic Glucose mmol/L,Scan Glucose mmol/L,Non-numeric Rapid-Acting Insulin,Rapid-Acting Insulin (units)
+FreeStyle LibreLink,ABC-123,31-03-2024 01:15,0,6.1,,,
+FreeStyle LibreLink,ABC-123,31-03-2024 01:00,0,5.5,,,
+FreeStyle LibreLink,ABC-123,31-03-2024 01:07,1,,5.8,,
+FreeStyle LibreLink,ABC-123,31-03-2024 01:10,5,,,,2
+`
+
+func TestParseClarity(t *testing.T) {
+	london, _ := time.LoadLocation("Europe/London")
+	format, entries, err := ParseEntries(strings.NewReader(clarityExport), london)
+	assert.NoError(t, err)
+	assert.Equal(t, FormatClarity, format)
+	assert.Len(t, entries, 3, "only EGV rows imported")
+
+	// local times, BST is UTC+1
+	assert.Equal(t, time.Date(2024, 5, 31, 23, 58, 0, 0, time.UTC), entries[0].Time)
+	assert.Equal(t, 105, entries[0].SgvMgdl)
+	assert.Equal(t, "Android G6", entries[0].Device)
+	assert.Equal(t, 40, entries[2].SgvMgdl, "Low is reported as 40")
+	assert.Equal(t, "FortyFiveUp", entries[1].Direction)
+}
+
+func TestParseLibreView(t *testing.T) {
+	format, entries, err := ParseEntries(strings.NewReader(libreViewExport), time.UTC)
+	assert.NoError(t, err)
+	assert.Equal(t, FormatLibreView, format)
+	assert.Len(t, entries, 3, "historic and scan readings imported")
+
+	// day-first dates detected, sorted oldest first
+	assert.Equal(t, time.Date(2024, 3, 31, 1, 0, 0, 0, time.UTC), entries[0].Time)
+	assert.Equal(t, 99, entries[0].SgvMgdl, "5.5 mmol/L")
+	assert.Equal(t, 105, entries[1].SgvMgdl, "scan, 5.8 mmol/L")
+	assert.Equal(t, "FreeStyle LibreLink", entries[1].Device)
+	assert.Equal(t, "Flat", entries[1].Direction)
+}
+
+func TestParseUnknown(t *testing.T) {
+	_, _, err := ParseEntries(strings.NewReader("a,b,c\n1,2,3\n"), time.UTC)
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
@@ -1,6 +1,7 @@
 package nightscoutstore
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
@@ -9,11 +10,13 @@ import (
 	"fmt"
 	"github.com/adamlounds/nightscout-go/models"
 	slogctx "github.com/veqryn/slog-context"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
 	"strconv"
 	"time"
 )
@@ -40,7 +43,7 @@ type nsEntry struct {
 	SysTime    string `json:"sysTime"`    // same as dateString
 	Date       int64  `json:"date"`       // ms since epoch
 	Mills      int64  `json:"mills"`      // ms since epoch
-	UtcOffset  int64  `json:"utcOffset"`  // always 0
+	UtcOffset  int    `json:"utcOffset"`  // minutes
 	SgvMgdl    int    `json:"sgv"`        //
 }
 
@@ -51,7 +54,7 @@ func (cfg NightscoutConfig) String() string {
 }
 
 func (cfg NightscoutConfig) SecretHash() string {
-	if cfg.secretHash == "" {
+	if cfg.secretHash != "" {
 		return cfg.secretHash
 	}
 	if cfg.APISecret == "" {
@@ -79,29 +82,12 @@ func (s *NightscoutStore) Ping(ctx context.Context) error {
 	//return err
 }
 
-// FetchAllEntries fetches all possible entries from the remote nightscout
-// instance, in reverse date order
-func (s *NightscoutStore) FetchAllEntries(ctx context.Context) ([]models.Entry, error) {
-	maxBatches := 100 // just in case something _weird_ happens, don't keep hammering remote server
-	batchSize := 1000 // it may just be me, but my ns instance won't send more than 5417 entries, either in tsv or json...
-	// another ns instance capped itself at 1152 entries, 258KB. Maybe investigate js side?
-
-	lastEntry := models.Entry{}
-	allEntries := []models.Entry{}
-	for i := 0; i < maxBatches; i++ {
-		batchOfEntries, err := s.fetchBatchOfEntries(ctx, batchSize, lastEntry)
-		if err != nil {
-			return nil, fmt.Errorf("cannot FetchAllEntries: %w", err)
-		}
-
-		allEntries = append(allEntries, batchOfEntries...)
-		if len(batchOfEntries) < batchSize {
-			return allEntries, nil
-		}
-
-		lastEntry = batchOfEntries[len(batchOfEntries)-1]
-	}
-	return allEntries, nil
+// FetchEntriesBefore fetches up to count entries before the given time from
+// the remote nightscout instance, in reverse date order. A zero time fetches
+// the most recent entries. Callers page back through history by passing the
+// time of the earliest entry seen so far.
+func (s *NightscoutStore) FetchEntriesBefore(ctx context.Context, before time.Time, count int) ([]models.Entry, error) {
+	return s.fetchBatchOfEntries(ctx, count, models.Entry{Time: before})
 }
 
 var rfc3339msLayout = "2006-01-02T15:04:05.000Z"
@@ -120,16 +106,8 @@ func (s *NightscoutStore) fetchBatchOfEntries(ctx context.Context, batchSize int
 	log := slogctx.FromCtx(ctx)
 	log.Debug("fetchEntryBatch called", slog.Int("batchSize", batchSize), slog.String("lastSeenTime", lastSeen.Time.Format(rfc3339msLayout)))
 
-	u := *s.URL
-	u.Path = path.Join(u.Path, "api", "v1", "entries.json")
-	q := u.Query()
+	q := url.Values{}
 	q.Set("count", strconv.Itoa(batchSize))
-	if s.Token != "" {
-		q.Set("token", s.Token)
-	}
-	if s.SecretHash != "" {
-		q.Set("secret", s.SecretHash)
-	}
 
 	if lastSeen.Time.IsZero() {
 		// The first time fetchBatchOfEntries is called, it is passed a zero
@@ -149,36 +127,250 @@ func (s *NightscoutStore) fetchBatchOfEntries(ctx context.Context, batchSize int
 		q.Set("find[date][$lt]", strconv.FormatInt(lastSeen.Time.UnixMilli(), 10))
 	}
 
-	u.RawQuery = q.Encode()
+	mEntries, err := s.getEntries(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("fetchBatchOfEntries %w", err)
+	}
+	if len(mEntries) == 0 {
+		return mEntries, nil
+	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	req.Header.Add("User-Agent", "nightscout-go/0.3")
-	if s.SecretHash != "" {
-		req.Header.Add("api-secret", s.SecretHash)
+	log.Debug("fetchBatchOfEntries parsed entries",
+		slog.Int("batchSize", batchSize),
+		slog.Int("numEntriesParsed", len(mEntries)),
+		slog.Time("latestEntry", mEntries[0].Time),
+		slog.Time("earliestEntry", mEntries[len(mEntries)-1].Time),
+	)
+
+	if !lastSeen.Time.IsZero() {
+		if !mEntries[len(mEntries)-1].Time.Before(lastSeen.Time) {
+			// wtf? nightscout is not giving us older entries...
+			slog.Warn("fetchBatchOfEntries remote ns not giving us older entries!")
+			return []models.Entry{}, nil
+		}
 	}
+	return mEntries, nil
+}
+
+// FetchEntriesSince fetches up to count entries at or after since from the
+// remote nightscout instance, oldest first, so callers can page forward by
+// passing the time of the latest entry seen so far. Entries in that same
+// millisecond are returned again, rather than risk losing any on a page
+// boundary.
+func (s *NightscoutStore) FetchEntriesSince(ctx context.Context, since time.Time, count int) ([]models.Entry, error) {
+	q := url.Values{}
+	q.Set("count", strconv.Itoa(count))
+	q.Set("find[date][$gte]", strconv.FormatInt(since.UnixMilli(), 10))
+	q.Set("sort[date]", "1")
+
+	mEntries, err := s.getEntries(ctx, q)
 	if err != nil {
-		return nil, fmt.Errorf("fetchBatchOfEntries cannot NewRequestWithContext: %w", err)
+		return nil, fmt.Errorf("FetchEntriesSince %w", err)
+	}
+	if !slices.IsSortedFunc(mEntries, func(a, b models.Entry) int { return a.Time.Compare(b.Time) }) {
+		return nil, errors.New("FetchEntriesSince remote ns did not sort entries oldest first")
 	}
+	return mEntries, nil
+}
 
-	client := http.Client{}
-	res, err := client.Do(req)
+// FetchTreatmentsSince fetches up to count treatments at or after since from
+// the remote nightscout instance, oldest first, as FetchEntriesSince.
+func (s *NightscoutStore) FetchTreatmentsSince(ctx context.Context, since time.Time, count int) ([]models.Treatment, error) {
+	q := url.Values{}
+	q.Set("count", strconv.Itoa(count))
+	q.Set("find[created_at][$gte]", since.UTC().Format(rfc3339msLayout))
+	q.Set("sort[created_at]", "1")
+
+	mTreatments, err := s.getTreatments(ctx, q)
 	if err != nil {
-		var dnsError *net.DNSError
-		if errors.As(err, &dnsError) {
-			log.Info("fetchBatchOfEntries DNSError", slog.Any("err", dnsError))
-			return nil, fmt.Errorf("fetchBatchOfEntries remote server NOT FOUND: %w", err)
+		return nil, fmt.Errorf("FetchTreatmentsSince %w", err)
+	}
+	if !slices.IsSortedFunc(mTreatments, func(a, b models.Treatment) int { return a.Time.Compare(b.Time) }) {
+		return nil, errors.New("FetchTreatmentsSince remote ns did not sort treatments oldest first")
+	}
+	return mTreatments, nil
+}
+
+// FetchAllTreatments fetches all possible treatments from the remote
+// nightscout instance, in reverse date order. Treatments are fetched in
+// batches, each asking for treatments created before the oldest seen so far.
+func (s *NightscoutStore) FetchAllTreatments(ctx context.Context) ([]models.Treatment, error) {
+	log := slogctx.FromCtx(ctx)
+	maxBatches := 100 // just in case something _weird_ happens, don't keep hammering remote server
+	batchSize := 1000
+
+	var lastSeen time.Time
+	allTreatments := []models.Treatment{}
+	for i := 0; i < maxBatches; i++ {
+		q := url.Values{}
+		q.Set("count", strconv.Itoa(batchSize))
+		if lastSeen.IsZero() {
+			// as with entries, be explicit so we are not limited to recent
+			// treatments
+			q.Set("find[created_at][$gt]", time.UnixMilli(0).UTC().Format(rfc3339msLayout))
+		} else {
+			// nb `lt` will lose treatments in the same millisecond on a
+			// batch boundary, see fetchBatchOfEntries
+			q.Set("find[created_at][$lt]", lastSeen.UTC().Format(rfc3339msLayout))
+		}
+
+		batchOfTreatments, err := s.getTreatments(ctx, q)
+		if err != nil {
+			return nil, fmt.Errorf("cannot FetchAllTreatments: %w", err)
+		}
+		if len(batchOfTreatments) == 0 {
+			return allTreatments, nil
+		}
+		oldest := batchOfTreatments[len(batchOfTreatments)-1].Time
+		if !lastSeen.IsZero() && !oldest.Before(lastSeen) {
+			log.Warn("FetchAllTreatments remote ns not giving us older treatments!")
+			return allTreatments, nil
+		}
+		log.Debug("FetchAllTreatments fetched batch",
+			slog.Int("numTreatments", len(batchOfTreatments)),
+			slog.Time("latestTreatment", batchOfTreatments[0].Time),
+			slog.Time("earliestTreatment", oldest),
+		)
+
+		allTreatments = append(allTreatments, batchOfTreatments...)
+		if len(batchOfTreatments) < batchSize {
+			return allTreatments, nil
+		}
+		lastSeen = oldest
+	}
+	return allTreatments, nil
+}
+
+// FetchProfiles fetches all profiles from the remote nightscout instance
+func (s *NightscoutStore) FetchProfiles(ctx context.Context) ([]models.Profile, error) {
+	log := slogctx.FromCtx(ctx)
+
+	docs, err := s.getDocuments(ctx, "profile.json", url.Values{})
+	if err != nil {
+		return nil, fmt.Errorf("FetchProfiles %w", err)
+	}
+
+	mProfiles := make([]models.Profile, 0, len(docs))
+	for _, p := range docs {
+		oid, _ := p["_id"].(string)
+		startDate, _ := p["startDate"].(string)
+		startTime, err := time.Parse(time.RFC3339, startDate)
+		if err != nil {
+			createdAt, _ := p["created_at"].(string)
+			startTime, err = time.Parse(time.RFC3339, createdAt)
+		}
+		if err != nil {
+			log.Info("FetchProfiles skipping profile with bad startDate", slog.String("oid", oid), slog.String("startDate", startDate))
+			continue
+		}
+		mProfiles = append(mProfiles, models.Profile{
+			ID:     oid,
+			Time:   startTime,
+			Fields: p,
+		})
+	}
+	return mProfiles, nil
+}
+
+// FetchDeviceStatusSince fetches device statuses after since from the remote
+// nightscout instance, in reverse date order. At most 1000 statuses are
+// returned.
+func (s *NightscoutStore) FetchDeviceStatusSince(ctx context.Context, since time.Time) ([]models.DeviceStatus, error) {
+	log := slogctx.FromCtx(ctx)
+
+	q := url.Values{}
+	q.Set("count", "1000")
+	q.Set("find[created_at][$gt]", since.UTC().Format(rfc3339msLayout))
+
+	docs, err := s.getDocuments(ctx, "devicestatus.json", q)
+	if err != nil {
+		return nil, fmt.Errorf("FetchDeviceStatusSince %w", err)
+	}
+
+	mStatuses := make([]models.DeviceStatus, 0, len(docs))
+	for _, d := range docs {
+		oid, _ := d["_id"].(string)
+		device, _ := d["device"].(string)
+		createdAt, _ := d["created_at"].(string)
+		statusTime, err := time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			log.Info("FetchDeviceStatusSince skipping status with bad created_at", slog.String("oid", oid), slog.String("created_at", createdAt))
+			continue
 		}
-		return nil, fmt.Errorf("fetchBatchOfEntries cannot Do req: %w", err)
+		mStatuses = append(mStatuses, models.DeviceStatus{
+			ID:     oid,
+			Device: device,
+			Time:   statusTime,
+			Fields: d,
+		})
 	}
-	if res.StatusCode != 200 {
-		log.Info("fetchBatchOfEntries got non-200 res", slog.Int("code", res.StatusCode), slog.String("url", u.String()))
-		return nil, fmt.Errorf("fetchBatchOfEntries got non-200 response: %w", err)
+	return mStatuses, nil
+}
+
+// getTreatments fetches treatments matching q from the remote nightscout
+// instance. Treatments are free-form, so all fields are kept.
+func (s *NightscoutStore) getTreatments(ctx context.Context, q url.Values) ([]models.Treatment, error) {
+	log := slogctx.FromCtx(ctx)
+
+	nsTreatments, err := s.getDocuments(ctx, "treatments.json", q)
+	if err != nil {
+		return nil, err
 	}
 
+	mTreatments := make([]models.Treatment, 0, len(nsTreatments))
+	for _, t := range nsTreatments {
+		oid, _ := t["_id"].(string)
+		eventType, _ := t["eventType"].(string)
+		createdAt, _ := t["created_at"].(string)
+		treatmentTime, err := time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			log.Info("getTreatments skipping treatment with bad created_at", slog.String("oid", oid), slog.String("created_at", createdAt))
+			continue
+		}
+		mTreatments = append(mTreatments, models.Treatment{
+			ID:     oid,
+			Type:   eventType,
+			Time:   treatmentTime,
+			Fields: t,
+		})
+	}
+	return mTreatments, nil
+}
+
+// getDocuments fetches free-form documents (treatments, profiles etc)
+// matching q from the remote nightscout instance
+func (s *NightscoutStore) getDocuments(ctx context.Context, collection string, q url.Values) ([]map[string]interface{}, error) {
+	log := slogctx.FromCtx(ctx)
+
+	res, err := s.get(ctx, collection, q)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var docs []map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&docs)
+	if err != nil {
+		log.Info("getDocuments cannot parse response", slog.String("collection", collection), slog.Any("err", err))
+		return nil, err
+	}
+	return docs, nil
+}
+
+// getEntries fetches entries matching q from the remote nightscout instance
+func (s *NightscoutStore) getEntries(ctx context.Context, q url.Values) ([]models.Entry, error) {
+	log := slogctx.FromCtx(ctx)
+
+	res, err := s.get(ctx, "entries.json", q)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
 	var nsEntries []nsEntry
 	err = json.NewDecoder(res.Body).Decode(&nsEntries)
 	if err != nil {
-		log.Info("fetchBatchOfEntries cannot parse entries", slog.Any("err", err))
+		log.Info("getEntries cannot parse entries", slog.Any("err", err))
 		return nil, err
 	}
 
@@ -197,24 +389,146 @@ func (s *NightscoutStore) fetchBatchOfEntries(ctx context.Context, batchSize int
 			Device:      e.Device,
 			Time:        entryTime,
 			CreatedTime: sysTime,
+			UtcOffset:   e.UtcOffset,
 		}
 	}
+	return mEntries, nil
+}
 
-	log.Debug("fetchBatchOfEntries parsed entries",
-		slog.Int("batchSize", batchSize),
-		slog.Int("numEntriesParsed", len(mEntries)),
-		slog.Time("latestEntry", mEntries[0].Time),
-		slog.Time("earliestEntry", mEntries[len(mEntries)-1].Time),
-	)
+// get performs an authenticated GET against the remote nightscout api. The
+// caller must close the response body.
+func (s *NightscoutStore) get(ctx context.Context, collection string, q url.Values) (*http.Response, error) {
+	log := slogctx.FromCtx(ctx)
 
-	if !lastSeen.Time.IsZero() {
-		if !mEntries[len(mEntries)-1].Time.Before(lastSeen.Time) {
-			// wtf? nightscout is not giving us older entries...
-			slog.Warn("fetchBatchOfEntries remote ns not giving us older entries!")
-			return []models.Entry{}, nil
+	u := *s.URL
+	u.Path = path.Join(u.Path, "api", "v1", collection)
+	if s.Token != "" {
+		q.Set("token", s.Token)
+	}
+	if s.SecretHash != "" {
+		q.Set("secret", s.SecretHash)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot NewRequestWithContext: %w", err)
+	}
+	req.Header.Add("User-Agent", "nightscout-go/0.3")
+	if s.SecretHash != "" {
+		req.Header.Add("api-secret", s.SecretHash)
+	}
+
+	client := http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		var dnsError *net.DNSError
+		if errors.As(err, &dnsError) {
+			log.Info("get DNSError", slog.Any("err", dnsError))
+			return nil, fmt.Errorf("remote server NOT FOUND: %w", err)
 		}
+		return nil, fmt.Errorf("cannot Do req: %w", err)
 	}
-	return mEntries, nil
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		log.Info("get got non-200 res", slog.Int("code", res.StatusCode), slog.String("collection", collection))
+		if res.StatusCode == http.StatusUnauthorized {
+			return nil, ErrAccessDenied
+		}
+		return nil, fmt.Errorf("got non-200 response: %d", res.StatusCode)
+	}
+	return res, nil
+}
+
+type nsUploadEntry struct {
+	Type       string `json:"type"`
+	Direction  string `json:"direction,omitempty"`
+	Device     string `json:"device"`
+	DateString string `json:"dateString"`
+	SysTime    string `json:"sysTime"`
+	Date       int64  `json:"date"`
+	SgvMgdl    int    `json:"sgv"`
+	UtcOffset  int    `json:"utcOffset,omitempty"`
+}
+
+// UploadEntries POSTs entries to the remote nightscout instance. nightscout
+// upserts entries by sysTime and type, so re-sending entries is harmless.
+func (s *NightscoutStore) UploadEntries(ctx context.Context, entries []models.Entry) error {
+	uploadEntries := make([]nsUploadEntry, len(entries))
+	for i, e := range entries {
+		uploadEntries[i] = nsUploadEntry{
+			Type:       e.Type,
+			Direction:  e.Direction,
+			Device:     e.Device,
+			DateString: e.Time.UTC().Format(rfc3339msLayout),
+			SysTime:    e.Time.UTC().Format(rfc3339msLayout),
+			Date:       e.Time.UnixMilli(),
+			SgvMgdl:    e.SgvMgdl,
+			UtcOffset:  e.UtcOffset,
+		}
+	}
+	return s.post(ctx, "entries", uploadEntries)
+}
+
+// UploadTreatments POSTs treatments to the remote nightscout instance.
+// nightscout upserts treatments by created_at and eventType, so re-sending
+// treatments is harmless.
+func (s *NightscoutStore) UploadTreatments(ctx context.Context, treatments []models.Treatment) error {
+	uploadTreatments := make([]map[string]interface{}, len(treatments))
+	for i, t := range treatments {
+		ut := map[string]interface{}{}
+		for k, v := range t.Fields {
+			ut[k] = v
+		}
+		ut["eventType"] = t.Type
+		ut["created_at"] = t.Time.UTC().Format(rfc3339msLayout)
+		uploadTreatments[i] = ut
+	}
+	return s.post(ctx, "treatments", uploadTreatments)
+}
+
+func (s *NightscoutStore) post(ctx context.Context, collection string, payload any) error {
+	log := slogctx.FromCtx(ctx)
+
+	u := *s.URL
+	u.Path = path.Join(u.Path, "api", "v1", collection)
+	if s.Token != "" {
+		q := u.Query()
+		q.Set("token", s.Token)
+		u.RawQuery = q.Encode()
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("post cannot marshal %s: %w", collection, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("post cannot NewRequestWithContext: %w", err)
+	}
+	req.Header.Add("User-Agent", "nightscout-go/0.3")
+	req.Header.Add("Content-Type", "application/json")
+	if s.SecretHash != "" {
+		req.Header.Add("api-secret", s.SecretHash)
+	}
+
+	client := http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post cannot Do req: %w", err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return ErrAccessDenied
+	}
+	if res.StatusCode != http.StatusOK {
+		log.Info("post got non-200 res", slog.Int("code", res.StatusCode), slog.String("collection", collection))
+		return fmt.Errorf("post %s got non-200 response: %d", collection, res.StatusCode)
+	}
+	return nil
 }
 
 func (b *NightscoutStore) IsAccessDeniedErr(err error) bool {
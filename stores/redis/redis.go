@@ -0,0 +1,48 @@
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+// ErrCacheMiss is returned by Get when the key does not exist
+var ErrCacheMiss = errors.New("redisstore: cache miss")
+
+// RedisStore is a redis server used as a shared cache between instances
+type RedisStore struct {
+	client *redis.Client
+}
+
+// New configures a client for the server at url, eg redis://localhost:6379/0
+func New(url string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("cannot configure redis store: %w", err)
+	}
+	return &RedisStore{client: redis.NewClient(opts)}, nil
+}
+
+func (r *RedisStore) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+func (r *RedisStore) Close() error {
+	return r.client.Close()
+}
+
+// Get returns the value stored at key, or ErrCacheMiss
+func (r *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := r.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrCacheMiss
+	}
+	return b, err
+}
+
+// Set stores value at key, expiring after ttl
+func (r *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}